@@ -0,0 +1,112 @@
+package jpegstructure
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/dsoprea/go-logging"
+)
+
+var (
+	adobePrefix = []byte("Adobe")
+)
+
+var (
+	// ErrNoAdobe is returned if the Adobe segment was requested but not
+	// found.
+	ErrNoAdobe = errors.New("no Adobe segment")
+)
+
+const (
+	// adobeSegmentSize is the size of the APP14 payload.
+	adobeSegmentSize = 12
+)
+
+// AdobeColorTransform is the transform that was applied to the components
+// before they were encoded.
+type AdobeColorTransform byte
+
+const (
+	// AdobeColorTransformNone indicates that the components are stored as
+	// they are (RGB or CMYK).
+	AdobeColorTransformNone AdobeColorTransform = 0
+
+	// AdobeColorTransformYCbCr indicates that RGB was converted to YCbCr.
+	AdobeColorTransformYCbCr AdobeColorTransform = 1
+
+	// AdobeColorTransformYcck indicates that the CMY of CMYK was converted to
+	// YCbCr, with K stored as it is.
+	AdobeColorTransformYcck AdobeColorTransform = 2
+)
+
+// String returns a descriptive string.
+func (act AdobeColorTransform) String() string {
+	switch act {
+	case AdobeColorTransformNone:
+		return "None"
+	case AdobeColorTransformYCbCr:
+		return "YCbCr"
+	case AdobeColorTransformYcck:
+		return "YCCK"
+	}
+
+	return fmt.Sprintf("Unknown(%d)", byte(act))
+}
+
+// AdobeSegment is the information in an Adobe APP14 segment. Its presence
+// also tells decoders that the CMYK values are inverted, which is how
+// Photoshop writes them.
+type AdobeSegment struct {
+	// Version is the version of the segment (usually 100).
+	Version uint16
+
+	// Flags0 has bit 15 set if the encoder blended the image down.
+	Flags0 uint16
+
+	// Flags1 is not used.
+	Flags1 uint16
+
+	// ColorTransform is how the components are encoded.
+	ColorTransform AdobeColorTransform
+}
+
+// ParseAdobeSegment parses the payload of an Adobe APP14 segment.
+func ParseAdobeSegment(data []byte) (as *AdobeSegment, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if len(data) < adobeSegmentSize || string(data[:len(adobePrefix)]) != string(adobePrefix) {
+		log.Panicf("not an Adobe segment")
+	}
+
+	as = &AdobeSegment{
+		Version:        binary.BigEndian.Uint16(data[5:7]),
+		Flags0:         binary.BigEndian.Uint16(data[7:9]),
+		Flags1:         binary.BigEndian.Uint16(data[9:11]),
+		ColorTransform: AdobeColorTransform(data[11]),
+	}
+
+	return as, nil
+}
+
+// Encode returns the APP14 payload for this segment.
+func (as *AdobeSegment) Encode() []byte {
+	data := make([]byte, adobeSegmentSize)
+
+	copy(data, adobePrefix)
+	binary.BigEndian.PutUint16(data[5:7], as.Version)
+	binary.BigEndian.PutUint16(data[7:9], as.Flags0)
+	binary.BigEndian.PutUint16(data[9:11], as.Flags1)
+	data[11] = byte(as.ColorTransform)
+
+	return data
+}
+
+// String returns a descriptive string.
+func (as *AdobeSegment) String() string {
+	return fmt.Sprintf("AdobeSegment<VERSION=(%d) FLAGS0=(0x%04x) FLAGS1=(0x%04x) TRANSFORM=[%s]>", as.Version, as.Flags0, as.Flags1, as.ColorTransform)
+}
@@ -0,0 +1,108 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dsoprea/go-logging"
+)
+
+func TestParseAdobeSegment(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	data := []byte{'A', 'd', 'o', 'b', 'e', 0x00, 0x64, 0x80, 0x00, 0x00, 0x00, 0x02}
+
+	as, err := ParseAdobeSegment(data)
+	log.PanicIf(err)
+
+	expected := AdobeSegment{
+		Version:        100,
+		Flags0:         0x8000,
+		Flags1:         0,
+		ColorTransform: AdobeColorTransformYcck,
+	}
+
+	if *as != expected {
+		t.Fatalf("Segment not correct: %s", as)
+	} else if as.String() != "AdobeSegment<VERSION=(100) FLAGS0=(0x8000) FLAGS1=(0x0000) TRANSFORM=[YCCK]>" {
+		t.Fatalf("String not correct: [%s]", as.String())
+	} else if bytes.Equal(as.Encode(), data) != true {
+		t.Fatalf("Encoding not correct.")
+	}
+}
+
+func TestParseAdobeSegment_Invalid(t *testing.T) {
+	_, err := ParseAdobeSegment([]byte("Adobe\000\144"))
+	if err == nil {
+		t.Fatalf("Expected error for short segment.")
+	}
+
+	_, err = ParseAdobeSegment([]byte("Abode\000\144\000\000\000\000\001"))
+	if err == nil {
+		t.Fatalf("Expected error for wrong prefix.")
+	}
+}
+
+func TestAdobeColorTransform_String(t *testing.T) {
+	if AdobeColorTransformYCbCr.String() != "YCbCr" {
+		t.Fatalf("String not correct: [%s]", AdobeColorTransformYCbCr)
+	} else if AdobeColorTransform(9).String() != "Unknown(9)" {
+		t.Fatalf("String not correct: [%s]", AdobeColorTransform(9))
+	}
+}
+
+func TestSegmentList_Adobe(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := NewSegmentList(nil)
+
+	_, err := sl.Adobe()
+	if err != ErrNoAdobe {
+		t.Fatalf("Expected no Adobe segment: %v", err)
+	}
+
+	as := &AdobeSegment{
+		Version:        101,
+		ColorTransform: AdobeColorTransformNone,
+	}
+
+	// Other APP14 segments are skipped.
+
+	other := &Segment{
+		MarkerId: MARKER_APP14,
+		Data:     []byte("Ducky\000\000"),
+	}
+
+	adobe := &Segment{
+		MarkerId: MARKER_APP14,
+		Data:     as.Encode(),
+	}
+
+	sl = NewSegmentList([]*Segment{other, adobe})
+
+	index, s, err := sl.FindAdobe()
+	log.PanicIf(err)
+
+	if index != 1 || s != adobe {
+		t.Fatalf("Wrong segment found: (%d)", index)
+	}
+
+	recovered, err := sl.Adobe()
+	log.PanicIf(err)
+
+	if *recovered != *as {
+		t.Fatalf("Segment not correct: %s", recovered)
+	}
+}
@@ -0,0 +1,806 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrArithmeticCodeInvalid indicates that arithmetic-coded data decoded to
+	// something that isn't possible.
+	ErrArithmeticCodeInvalid = errors.New("arithmetic-coded data not valid")
+)
+
+// qeEntry is one row of the probability estimation state machine (T.81 Table
+// D.2).
+type qeEntry struct {
+	qe        uint32
+	nextLps   byte
+	nextMps   byte
+	switchMps bool
+}
+
+// qeTable is T.81 Table D.2. The last entry isn't in the standard; like
+// libjpeg, it's a fixed, even probability that never adapts and is used for
+// the signs of AC coefficients and for successive-approximation bits.
+var qeTable = [114]qeEntry{
+	{0x5a1d, 1, 1, true},
+	{0x2586, 14, 2, false},
+	{0x1114, 16, 3, false},
+	{0x080b, 18, 4, false},
+	{0x03d8, 20, 5, false},
+	{0x01da, 23, 6, false},
+	{0x00e5, 25, 7, false},
+	{0x006f, 28, 8, false},
+	{0x0036, 30, 9, false},
+	{0x001a, 33, 10, false},
+	{0x000d, 35, 11, false},
+	{0x0006, 9, 12, false},
+	{0x0003, 10, 13, false},
+	{0x0001, 12, 13, false},
+	{0x5a7f, 15, 15, true},
+	{0x3f25, 36, 16, false},
+	{0x2cf2, 38, 17, false},
+	{0x207c, 39, 18, false},
+	{0x17b9, 40, 19, false},
+	{0x1182, 42, 20, false},
+	{0x0cef, 43, 21, false},
+	{0x09a1, 45, 22, false},
+	{0x072f, 46, 23, false},
+	{0x055c, 48, 24, false},
+	{0x0406, 49, 25, false},
+	{0x0303, 51, 26, false},
+	{0x0240, 52, 27, false},
+	{0x01b1, 54, 28, false},
+	{0x0144, 56, 29, false},
+	{0x00f5, 57, 30, false},
+	{0x00b7, 59, 31, false},
+	{0x008a, 60, 32, false},
+	{0x0068, 62, 33, false},
+	{0x004e, 63, 34, false},
+	{0x003b, 32, 35, false},
+	{0x002c, 33, 9, false},
+	{0x5ae1, 37, 37, true},
+	{0x484c, 64, 38, false},
+	{0x3a0d, 65, 39, false},
+	{0x2ef1, 67, 40, false},
+	{0x261f, 68, 41, false},
+	{0x1f33, 69, 42, false},
+	{0x19a8, 70, 43, false},
+	{0x1518, 72, 44, false},
+	{0x1177, 73, 45, false},
+	{0x0e74, 74, 46, false},
+	{0x0bfb, 75, 47, false},
+	{0x09f8, 77, 48, false},
+	{0x0861, 78, 49, false},
+	{0x0706, 79, 50, false},
+	{0x05cd, 48, 51, false},
+	{0x04de, 50, 52, false},
+	{0x040f, 50, 53, false},
+	{0x0363, 51, 54, false},
+	{0x02d4, 52, 55, false},
+	{0x025c, 53, 56, false},
+	{0x01f8, 54, 57, false},
+	{0x01a4, 55, 58, false},
+	{0x0160, 56, 59, false},
+	{0x0125, 57, 60, false},
+	{0x00f6, 58, 61, false},
+	{0x00cb, 59, 62, false},
+	{0x00ab, 61, 63, false},
+	{0x008f, 61, 32, false},
+	{0x5b12, 65, 65, true},
+	{0x4d04, 80, 66, false},
+	{0x412c, 81, 67, false},
+	{0x37d8, 82, 68, false},
+	{0x2fe8, 83, 69, false},
+	{0x293c, 84, 70, false},
+	{0x2379, 86, 71, false},
+	{0x1edf, 87, 72, false},
+	{0x1aa9, 87, 73, false},
+	{0x174e, 72, 74, false},
+	{0x1424, 72, 75, false},
+	{0x119c, 74, 76, false},
+	{0x0f6b, 74, 77, false},
+	{0x0d51, 75, 78, false},
+	{0x0bb6, 77, 79, false},
+	{0x0a40, 77, 48, false},
+	{0x5832, 80, 81, true},
+	{0x4d1c, 88, 82, false},
+	{0x438e, 89, 83, false},
+	{0x3bdd, 90, 84, false},
+	{0x34ee, 91, 85, false},
+	{0x2eae, 92, 86, false},
+	{0x299a, 93, 87, false},
+	{0x2516, 86, 71, false},
+	{0x5570, 88, 89, true},
+	{0x4ca9, 95, 90, false},
+	{0x44d9, 96, 91, false},
+	{0x3e22, 97, 92, false},
+	{0x3824, 99, 93, false},
+	{0x32b4, 99, 94, false},
+	{0x2e17, 93, 86, false},
+	{0x56a8, 95, 96, true},
+	{0x4f46, 101, 97, false},
+	{0x47e5, 102, 98, false},
+	{0x41cf, 103, 99, false},
+	{0x3c3d, 104, 100, false},
+	{0x375e, 99, 93, false},
+	{0x5231, 105, 102, false},
+	{0x4c0f, 106, 103, false},
+	{0x4639, 107, 104, false},
+	{0x415e, 103, 99, false},
+	{0x5627, 105, 106, true},
+	{0x50e7, 108, 107, false},
+	{0x4b85, 109, 103, false},
+	{0x5597, 110, 109, false},
+	{0x504f, 111, 107, false},
+	{0x5a10, 110, 111, true},
+	{0x5522, 112, 109, false},
+	{0x59eb, 112, 111, true},
+	{0x5a1d, 113, 113, false},
+}
+
+const (
+	// fixedProbabilityState is the state of the fixed, even probability.
+	fixedProbabilityState = 113
+)
+
+// nextStateAfterLps returns the state that follows a less-probable symbol.
+// The high bit of a state is the value of the more-probable symbol.
+func nextStateAfterLps(state byte) byte {
+	e := &qeTable[state&0x7f]
+
+	next := (state & 0x80) | e.nextLps
+	if e.switchMps == true {
+		next ^= 0x80
+	}
+
+	return next
+}
+
+// nextStateAfterMps returns the state that follows a more-probable symbol.
+func nextStateAfterMps(state byte) byte {
+	return (state & 0x80) | qeTable[state&0x7f].nextMps
+}
+
+// arithmeticDecoder is the binary arithmetic decoder (T.81 D.2). This follows
+// libjpeg.
+type arithmeticDecoder struct {
+	data []byte
+	pos  int
+
+	c  uint32
+	a  uint32
+	ct int
+
+	// markerReached is true once we've run into a marker. Zeros are decoded
+	// from then on, which is the convention.
+	markerReached bool
+	markerId      byte
+}
+
+func newArithmeticDecoder(data []byte) *arithmeticDecoder {
+	ad := &arithmeticDecoder{
+		data: data,
+	}
+
+	ad.reset()
+
+	return ad
+}
+
+// reset forces the next decision to read the two initial bytes.
+func (ad *arithmeticDecoder) reset() {
+	ad.c = 0
+	ad.a = 0
+	ad.ct = -16
+}
+
+// nextByte returns the next byte of data with any stuffing removed.
+func (ad *arithmeticDecoder) nextByte() uint32 {
+	if ad.markerReached == true || ad.pos >= len(ad.data) {
+		return 0
+	}
+
+	value := ad.data[ad.pos]
+	ad.pos++
+
+	if value != 0xff {
+		return uint32(value)
+	}
+
+	for ad.pos < len(ad.data) && ad.data[ad.pos] == 0xff {
+		ad.pos++
+	}
+
+	if ad.pos >= len(ad.data) {
+		return 0
+	}
+
+	next := ad.data[ad.pos]
+	ad.pos++
+
+	if next == 0 {
+		return 0xff
+	}
+
+	ad.markerReached = true
+	ad.markerId = next
+
+	return 0
+}
+
+// decode returns the next decision using the given statistics bin.
+func (ad *arithmeticDecoder) decode(state *byte) int {
+	// Renormalize and read data (D.2.6).
+	for ad.a < 0x8000 {
+		ad.ct--
+		if ad.ct < 0 {
+			ad.c = ad.c<<8 | ad.nextByte()
+
+			ad.ct += 8
+			if ad.ct < 0 {
+				ad.ct++
+				if ad.ct == 0 {
+					// We have the two initial bytes.
+					ad.a = 0x8000
+				}
+			}
+		}
+
+		ad.a <<= 1
+	}
+
+	sv := *state
+	qe := qeTable[sv&0x7f].qe
+
+	temp := ad.a - qe
+	ad.a = temp
+	temp <<= uint(ad.ct)
+
+	if ad.c >= temp {
+		ad.c -= temp
+
+		// Conditional exchange of the less-probable symbol.
+		if ad.a < qe {
+			ad.a = qe
+			*state = nextStateAfterMps(sv)
+		} else {
+			ad.a = qe
+			*state = nextStateAfterLps(sv)
+			sv ^= 0x80
+		}
+	} else if ad.a < 0x8000 {
+		// Conditional exchange of the more-probable symbol.
+		if ad.a < qe {
+			*state = nextStateAfterLps(sv)
+			sv ^= 0x80
+		} else {
+			*state = nextStateAfterMps(sv)
+		}
+	}
+
+	return int(sv >> 7)
+}
+
+// processRestart finds the expected restart marker and resets the decoder.
+// Since the encoder drops trailing zeros, the decoder doesn't necessarily read
+// everything before the marker, so anything before it is skipped.
+func (ad *arithmeticDecoder) processRestart(expected int) (err error) {
+	if ad.markerReached == false {
+		for {
+			if ad.pos+1 >= len(ad.data) {
+				return ErrEntropyTruncated
+			}
+
+			if ad.data[ad.pos] == 0xff && ad.data[ad.pos+1] != 0x00 && ad.data[ad.pos+1] != 0xff {
+				ad.markerId = ad.data[ad.pos+1]
+				ad.pos += 2
+
+				break
+			}
+
+			ad.pos++
+		}
+	}
+
+	if ad.markerId != byte(MARKER_RST0+expected) {
+		return fmt.Errorf("expected RST%d but found marker (0x%02x)", expected, ad.markerId)
+	}
+
+	ad.markerReached = false
+	ad.reset()
+
+	return nil
+}
+
+// arithmeticEncoder is the binary arithmetic encoder (T.81 D.1). This follows
+// libjpeg, which defers zero bytes so that trailing ones can be dropped.
+type arithmeticEncoder struct {
+	b *bytes.Buffer
+
+	c  uint32
+	a  uint32
+	ct int
+
+	// sc is the number of stacked 0xff bytes, which might still overflow.
+	sc int
+
+	// zc is the number of deferred zero bytes.
+	zc int
+
+	// buffer is the last byte, which might still overflow, or -1.
+	buffer int
+}
+
+func newArithmeticEncoder() *arithmeticEncoder {
+	ae := &arithmeticEncoder{
+		b: new(bytes.Buffer),
+	}
+
+	ae.reset()
+
+	return ae
+}
+
+func (ae *arithmeticEncoder) reset() {
+	ae.c = 0
+	ae.a = 0x10000
+	ae.ct = 11
+	ae.sc = 0
+	ae.zc = 0
+	ae.buffer = -1
+}
+
+// emitZeros writes the deferred zero bytes.
+func (ae *arithmeticEncoder) emitZeros() {
+	for ; ae.zc > 0; ae.zc-- {
+		ae.b.WriteByte(0x00)
+	}
+}
+
+// emitByte writes a byte with stuffing.
+func (ae *arithmeticEncoder) emitByte(value byte) {
+	ae.b.WriteByte(value)
+
+	if value == 0xff {
+		ae.b.WriteByte(0x00)
+	}
+}
+
+// emitOverflow writes the buffered byte plus a carry. The stacked 0xff bytes
+// become zeros.
+func (ae *arithmeticEncoder) emitOverflow() {
+	if ae.buffer >= 0 {
+		ae.emitZeros()
+		ae.emitByte(byte(ae.buffer + 1))
+	}
+
+	ae.zc += ae.sc
+	ae.sc = 0
+}
+
+// emitSettled writes the buffered byte and the stacked 0xff bytes, which can't
+// overflow anymore.
+func (ae *arithmeticEncoder) emitSettled() {
+	if ae.buffer == 0 {
+		ae.zc++
+	} else if ae.buffer >= 0 {
+		ae.emitZeros()
+		ae.emitByte(byte(ae.buffer))
+	}
+
+	if ae.sc > 0 {
+		ae.emitZeros()
+
+		for ; ae.sc > 0; ae.sc-- {
+			ae.emitByte(0xff)
+		}
+	}
+}
+
+// encode codes the decision using the given statistics bin.
+func (ae *arithmeticEncoder) encode(state *byte, value int) {
+	sv := *state
+	qe := qeTable[sv&0x7f].qe
+
+	ae.a -= qe
+
+	if value != int(sv>>7) {
+		// Code the less-probable symbol, exchanging it with the more-probable
+		// one if its interval would be larger.
+		if ae.a >= qe {
+			ae.c += ae.a
+			ae.a = qe
+		}
+
+		*state = nextStateAfterLps(sv)
+	} else {
+		if ae.a >= 0x8000 {
+			return
+		}
+
+		if ae.a < qe {
+			ae.c += ae.a
+			ae.a = qe
+		}
+
+		*state = nextStateAfterMps(sv)
+	}
+
+	// Renormalize and write data (D.1.6).
+	for {
+		ae.a <<= 1
+		ae.c <<= 1
+
+		ae.ct--
+		if ae.ct == 0 {
+			temp := int(ae.c >> 19)
+
+			if temp > 0xff {
+				ae.emitOverflow()
+
+				ae.buffer = temp & 0xff
+			} else if temp == 0xff {
+				ae.sc++
+			} else {
+				ae.emitSettled()
+
+				ae.buffer = temp
+			}
+
+			ae.c &= 0x7ffff
+			ae.ct += 8
+		}
+
+		if ae.a >= 0x8000 {
+			break
+		}
+	}
+}
+
+// flush terminates the coded data (T.81 D.1.8). Trailing zero bytes are
+// dropped.
+func (ae *arithmeticEncoder) flush() {
+	// Find the value in the interval with the most trailing zero bits.
+	temp := (ae.a - 1 + ae.c) & 0xffff0000
+	if temp < ae.c {
+		ae.c = temp + 0x8000
+	} else {
+		ae.c = temp
+	}
+
+	ae.c <<= uint(ae.ct)
+
+	if ae.c&0xf8000000 != 0 {
+		ae.emitOverflow()
+	} else {
+		ae.emitSettled()
+	}
+
+	if ae.c&0x7fff800 != 0 {
+		ae.emitZeros()
+		ae.emitByte(byte(ae.c >> 19))
+
+		if ae.c&0x7f800 != 0 {
+			ae.emitByte(byte(ae.c >> 11))
+		}
+	}
+
+	ae.zc = 0
+}
+
+// writeRestart terminates the current interval and writes a restart marker.
+func (ae *arithmeticEncoder) writeRestart(index int) {
+	ae.flush()
+
+	ae.b.WriteByte(0xff)
+	ae.b.WriteByte(byte(MARKER_RST0 + index%8))
+
+	ae.reset()
+}
+
+// arithmeticConditioning has the conditioning of each table, either from DAC
+// segments or the defaults.
+type arithmeticConditioning struct {
+	dcLower [4]uint
+	dcUpper [4]uint
+	acLimit [4]int
+}
+
+func newArithmeticConditioning() *arithmeticConditioning {
+	ac := new(arithmeticConditioning)
+
+	for i := 0; i < 4; i++ {
+		ac.dcLower[i] = 0
+		ac.dcUpper[i] = 1
+		ac.acLimit[i] = 5
+	}
+
+	return ac
+}
+
+// set applies the entries from a DAC segment.
+func (ac *arithmeticConditioning) set(conditioning []*ArithmeticConditioning) {
+	for _, entry := range conditioning {
+		if entry.Class == HuffmanClassDc {
+			ac.dcLower[entry.Id] = uint(entry.Value & 0x0f)
+			ac.dcUpper[entry.Id] = uint(entry.Value >> 4)
+		} else {
+			ac.acLimit[entry.Id] = int(entry.Value)
+		}
+	}
+}
+
+// arithmeticScanContext is the adaptive state of one arithmetic-coded scan.
+// Both the encoder and the decoder use it so that they can't disagree about
+// the statistics.
+type arithmeticScanContext struct {
+	conditioning *arithmeticConditioning
+	progressive  bool
+	sh           *ScanHeader
+
+	dcStats  [4][64]byte
+	acStats  [4][256]byte
+	fixedBin byte
+
+	// lastDc and dcContexts are indexed by scan component.
+	lastDc     []int32
+	dcContexts []int
+}
+
+func newArithmeticScanContext(conditioning *arithmeticConditioning, progressive bool, sh *ScanHeader) *arithmeticScanContext {
+	asc := &arithmeticScanContext{
+		conditioning: conditioning,
+		progressive:  progressive,
+		sh:           sh,
+		lastDc:       make([]int32, len(sh.Components)),
+		dcContexts:   make([]int, len(sh.Components)),
+	}
+
+	asc.reset()
+
+	return asc
+}
+
+// reset clears the statistics that the scan uses. This happens at the start of
+// the scan and at each restart.
+func (asc *arithmeticScanContext) reset() {
+	sh := asc.sh
+
+	for i, sc := range sh.Components {
+		if asc.progressive == false || (sh.SpectralStart == 0 && sh.ApproximationHigh == 0) {
+			asc.dcStats[sc.DcTableId] = [64]byte{}
+			asc.lastDc[i] = 0
+			asc.dcContexts[i] = 0
+		}
+
+		if asc.progressive == false || sh.SpectralStart > 0 {
+			asc.acStats[sc.AcTableId] = [256]byte{}
+		}
+	}
+
+	asc.fixedBin = fixedProbabilityState
+}
+
+// updateDcContext establishes the conditioning category for the next DC
+// difference from the magnitude of the last one (T.81 F.1.4.4.1.2).
+func (asc *arithmeticScanContext) updateDcContext(i int, magnitude int32, isNegative bool) {
+	tableId := asc.sh.Components[i].DcTableId
+
+	context := 4
+	if isNegative == true {
+		context = 8
+	}
+
+	if magnitude < int32(1)<<asc.conditioning.dcLower[tableId]>>1 {
+		context = 0
+	} else if magnitude > int32(1)<<asc.conditioning.dcUpper[tableId]>>1 {
+		context += 8
+	}
+
+	asc.dcContexts[i] = context
+}
+
+// decodeDc decodes a DC value for the given scan component (T.81 F.2.4.1).
+func (asc *arithmeticScanContext) decodeDc(ad *arithmeticDecoder, i int) (dc int32, err error) {
+	stats := &asc.dcStats[asc.sh.Components[i].DcTableId]
+	s0 := asc.dcContexts[i]
+
+	if ad.decode(&stats[s0]) == 0 {
+		asc.dcContexts[i] = 0
+		return asc.lastDc[i], nil
+	}
+
+	sign := ad.decode(&stats[s0+1])
+	st := s0 + 2 + sign
+
+	m := int32(ad.decode(&stats[st]))
+	if m != 0 {
+		st = 20
+		for ad.decode(&stats[st]) != 0 {
+			m <<= 1
+			if m == 0x8000 {
+				return 0, ErrArithmeticCodeInvalid
+			}
+
+			st++
+		}
+	}
+
+	asc.updateDcContext(i, m, sign == 1)
+
+	v := m
+	st += 14
+
+	for m >>= 1; m != 0; m >>= 1 {
+		if ad.decode(&stats[st]) != 0 {
+			v |= m
+		}
+	}
+
+	v++
+	if sign == 1 {
+		v = -v
+	}
+
+	asc.lastDc[i] += v
+
+	return asc.lastDc[i], nil
+}
+
+// encodeDc encodes a DC value for the given scan component (T.81 F.1.4.1).
+func (asc *arithmeticScanContext) encodeDc(ae *arithmeticEncoder, i int, dc int32) {
+	stats := &asc.dcStats[asc.sh.Components[i].DcTableId]
+	s0 := asc.dcContexts[i]
+
+	v := dc - asc.lastDc[i]
+	if v == 0 {
+		ae.encode(&stats[s0], 0)
+		asc.dcContexts[i] = 0
+
+		return
+	}
+
+	asc.lastDc[i] = dc
+	ae.encode(&stats[s0], 1)
+
+	isNegative := v < 0
+
+	st := s0 + 2
+	if isNegative == true {
+		v = -v
+		ae.encode(&stats[s0+1], 1)
+		st++
+	} else {
+		ae.encode(&stats[s0+1], 0)
+	}
+
+	m := int32(0)
+
+	v--
+	if v != 0 {
+		ae.encode(&stats[st], 1)
+		m = 1
+
+		st = 20
+		for v2 := v >> 1; v2 != 0; v2 >>= 1 {
+			ae.encode(&stats[st], 1)
+			m <<= 1
+			st++
+		}
+	}
+
+	ae.encode(&stats[st], 0)
+
+	asc.updateDcContext(i, m, isNegative)
+
+	st += 14
+	for m >>= 1; m != 0; m >>= 1 {
+		if m&v != 0 {
+			ae.encode(&stats[st], 1)
+		} else {
+			ae.encode(&stats[st], 0)
+		}
+	}
+}
+
+// decodeAcValue decodes the sign and magnitude of a non-zero AC coefficient of
+// the given scan component. `st` is the first statistics bin for the
+// coefficient's position.
+func (asc *arithmeticScanContext) decodeAcValue(ad *arithmeticDecoder, i, k, st int) (value int32, err error) {
+	tableId := asc.sh.Components[i].AcTableId
+	stats := &asc.acStats[tableId]
+
+	sign := ad.decode(&asc.fixedBin)
+	st += 2
+
+	m := int32(ad.decode(&stats[st]))
+	if m != 0 && ad.decode(&stats[st]) != 0 {
+		m <<= 1
+
+		st = 217
+		if k <= asc.conditioning.acLimit[tableId] {
+			st = 189
+		}
+
+		for ad.decode(&stats[st]) != 0 {
+			m <<= 1
+			if m == 0x8000 {
+				return 0, ErrArithmeticCodeInvalid
+			}
+
+			st++
+		}
+	}
+
+	v := m
+	st += 14
+
+	for m >>= 1; m != 0; m >>= 1 {
+		if ad.decode(&stats[st]) != 0 {
+			v |= m
+		}
+	}
+
+	v++
+	if sign == 1 {
+		v = -v
+	}
+
+	return v, nil
+}
+
+// encodeAcValue encodes a non-zero AC coefficient, including the decision
+// that it's non-zero.
+func (asc *arithmeticScanContext) encodeAcValue(ae *arithmeticEncoder, i, k, st int, value int32) {
+	tableId := asc.sh.Components[i].AcTableId
+	stats := &asc.acStats[tableId]
+
+	ae.encode(&stats[st+1], 1)
+
+	v := value
+	if v < 0 {
+		v = -v
+		ae.encode(&asc.fixedBin, 1)
+	} else {
+		ae.encode(&asc.fixedBin, 0)
+	}
+
+	st += 2
+	m := int32(0)
+
+	v--
+	if v != 0 {
+		ae.encode(&stats[st], 1)
+		m = 1
+
+		if v2 := v >> 1; v2 != 0 {
+			ae.encode(&stats[st], 1)
+			m <<= 1
+
+			st = 217
+			if k <= asc.conditioning.acLimit[tableId] {
+				st = 189
+			}
+
+			for v2 >>= 1; v2 != 0; v2 >>= 1 {
+				ae.encode(&stats[st], 1)
+				m <<= 1
+				st++
+			}
+		}
+	}
+
+	ae.encode(&stats[st], 0)
+
+	st += 14
+	for m >>= 1; m != 0; m >>= 1 {
+		if m&v != 0 {
+			ae.encode(&stats[st], 1)
+		} else {
+			ae.encode(&stats[st], 0)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package jpegstructure
+
+import (
+	"fmt"
+
+	"github.com/dsoprea/go-logging"
+)
+
+// arithmeticScanDecoder decodes arithmetic-coded DCT scans into coefficients
+// (T.81 F.2.4 and G.2). This follows libjpeg.
+type arithmeticScanDecoder struct {
+	frame  *SofSegment
+	planes []*ComponentCoefficients
+
+	conditioning *arithmeticConditioning
+
+	restartInterval int
+
+	coverage coefficientCoverage
+}
+
+func newArithmeticScanDecoder(fh *SofSegment) (asd *arithmeticScanDecoder, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if fh.IsArithmetic() == false {
+		log.Panicf("frame is not arithmetic-coded: [%s]", markerNames[fh.MarkerId])
+	}
+
+	err = checkDctFrame(fh)
+	log.PanicIf(err)
+
+	asd = &arithmeticScanDecoder{
+		frame:        fh,
+		planes:       newCoefficientPlanes(fh),
+		conditioning: newArithmeticConditioning(),
+		coverage:     newCoefficientCoverage(len(fh.Components)),
+	}
+
+	return asd, nil
+}
+
+// setHuffmanTables ignores the DHT segments, which have no effect on
+// arithmetic coding.
+func (asd *arithmeticScanDecoder) setHuffmanTables(tables []*HuffmanTable) error {
+	return nil
+}
+
+func (asd *arithmeticScanDecoder) setArithmeticConditioning(conditioning []*ArithmeticConditioning) error {
+	asd.conditioning.set(conditioning)
+	return nil
+}
+
+func (asd *arithmeticScanDecoder) setRestartInterval(interval int) {
+	asd.restartInterval = interval
+}
+
+func (asd *arithmeticScanDecoder) incompleteComponents() (ids []byte) {
+	return asd.coverage.incompleteComponents(asd.frame)
+}
+
+func (asd *arithmeticScanDecoder) coefficientPlanes() []*ComponentCoefficients {
+	return asd.planes
+}
+
+// decodeScan decodes the entropy-coded data of one scan. Whatever was decoded
+// before a failure is kept and the stats reflect how far we got. Since the
+// encoder drops trailing zeros and the decoder supplies them, running out of
+// data isn't an error by itself and unconsumed bytes aren't counted.
+func (asd *arithmeticScanDecoder) decodeScan(sh *ScanHeader, data []byte) (stats scanDecodeStats, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	fh := asd.frame
+
+	indices, err := checkScanHeader(fh, sh)
+	log.PanicIf(err)
+
+	err = asd.coverage.update(fh, indices, sh)
+	log.PanicIf(err)
+
+	mcuColumns, mcuRows := scanMcuLayout(fh, sh)
+	stats.expectedMcus = mcuColumns * mcuRows
+
+	asc := newArithmeticScanContext(asd.conditioning, fh.IsProgressive(), sh)
+	ad := newArithmeticDecoder(data)
+
+	decodeBlock := asd.blockDecoder(sh)
+
+	for mcu := 0; mcu < stats.expectedMcus; mcu++ {
+		if asd.restartInterval > 0 && mcu > 0 && mcu%asd.restartInterval == 0 {
+			expected := stats.restartMarkers % 8
+
+			err := ad.processRestart(expected)
+			if err != nil {
+				stats.isTruncated = err == ErrEntropyTruncated
+
+				log.Panicf("restart failed before MCU (%d) of (%d): %s", mcu, stats.expectedMcus, err.Error())
+			}
+
+			stats.restartMarkers++
+
+			asc.reset()
+		}
+
+		mcuColumn := mcu % mcuColumns
+		mcuRow := mcu / mcuColumns
+
+		if len(indices) == 1 {
+			plane := asd.planes[indices[0]]
+
+			err := decodeBlock(ad, asc, 0, plane.Block(mcuColumn, mcuRow))
+			if err != nil {
+				log.Panicf("could not decode MCU (%d) of (%d): %s", mcu, stats.expectedMcus, err.Error())
+			}
+		} else {
+			for i, j := range indices {
+				fc := fh.Components[j]
+				plane := asd.planes[j]
+
+				for v := 0; v < int(fc.VerticalSampling); v++ {
+					for h := 0; h < int(fc.HorizontalSampling); h++ {
+						block := plane.Block(mcuColumn*int(fc.HorizontalSampling)+h, mcuRow*int(fc.VerticalSampling)+v)
+
+						err := decodeBlock(ad, asc, i, block)
+						if err != nil {
+							log.Panicf("could not decode MCU (%d) of (%d): %s", mcu, stats.expectedMcus, err.Error())
+						}
+					}
+				}
+			}
+		}
+
+		stats.decodedMcus = mcu + 1
+	}
+
+	return stats, nil
+}
+
+type arithmeticBlockDecoderFunc func(ad *arithmeticDecoder, asc *arithmeticScanContext, i int, block *CoefficientBlock) error
+
+func (asd *arithmeticScanDecoder) blockDecoder(sh *ScanHeader) arithmeticBlockDecoderFunc {
+	if asd.frame.IsProgressive() == false {
+		return decodeArithmeticBlockSequential
+	} else if sh.SpectralStart == 0 {
+		if sh.ApproximationHigh == 0 {
+			return decodeArithmeticBlockDcFirst
+		}
+
+		return decodeArithmeticBlockDcRefine
+	} else if sh.ApproximationHigh == 0 {
+		return decodeArithmeticBlockAcFirst
+	}
+
+	return decodeArithmeticBlockAcRefine
+}
+
+func decodeArithmeticBlockSequential(ad *arithmeticDecoder, asc *arithmeticScanContext, i int, block *CoefficientBlock) (err error) {
+	dc, err := asc.decodeDc(ad, i)
+	if err != nil {
+		return err
+	}
+
+	block[0] = int16(dc)
+
+	stats := &asc.acStats[asc.sh.Components[i].AcTableId]
+
+	for k := 0; k < 63; {
+		st := 3 * k
+		if ad.decode(&stats[st]) != 0 {
+			// End of block.
+			break
+		}
+
+		for {
+			k++
+			if ad.decode(&stats[st+1]) != 0 {
+				break
+			}
+
+			st += 3
+			if k >= 63 {
+				return fmt.Errorf("AC coefficient index out of range: (%d)", k+1)
+			}
+		}
+
+		value, err := asc.decodeAcValue(ad, i, k, st)
+		if err != nil {
+			return err
+		}
+
+		block[zigzag[k]] = int16(value)
+	}
+
+	return nil
+}
+
+func decodeArithmeticBlockDcFirst(ad *arithmeticDecoder, asc *arithmeticScanContext, i int, block *CoefficientBlock) (err error) {
+	dc, err := asc.decodeDc(ad, i)
+	if err != nil {
+		return err
+	}
+
+	block[0] = int16(dc << asc.sh.ApproximationLow)
+
+	return nil
+}
+
+func decodeArithmeticBlockDcRefine(ad *arithmeticDecoder, asc *arithmeticScanContext, i int, block *CoefficientBlock) (err error) {
+	if ad.decode(&asc.fixedBin) != 0 {
+		block[0] |= 1 << asc.sh.ApproximationLow
+	}
+
+	return nil
+}
+
+func decodeArithmeticBlockAcFirst(ad *arithmeticDecoder, asc *arithmeticScanContext, i int, block *CoefficientBlock) (err error) {
+	sh := asc.sh
+	stats := &asc.acStats[sh.Components[0].AcTableId]
+
+	se := int(sh.SpectralEnd)
+
+	for k := int(sh.SpectralStart); k <= se; k++ {
+		st := 3 * (k - 1)
+		if ad.decode(&stats[st]) != 0 {
+			// End of band.
+			break
+		}
+
+		for ad.decode(&stats[st+1]) == 0 {
+			st += 3
+
+			k++
+			if k > se {
+				return fmt.Errorf("AC coefficient index out of range: (%d)", k)
+			}
+		}
+
+		value, err := asc.decodeAcValue(ad, 0, k, st)
+		if err != nil {
+			return err
+		}
+
+		block[zigzag[k]] = int16(value << sh.ApproximationLow)
+	}
+
+	return nil
+}
+
+// decodeArithmeticBlockAcRefine implements the AC successive-approximation
+// refinement (T.81 G.2.3.3).
+func decodeArithmeticBlockAcRefine(ad *arithmeticDecoder, asc *arithmeticScanContext, i int, block *CoefficientBlock) (err error) {
+	sh := asc.sh
+	stats := &asc.acStats[sh.Components[0].AcTableId]
+
+	se := int(sh.SpectralEnd)
+
+	p1 := int16(1) << sh.ApproximationLow
+	m1 := int16(-1) << sh.ApproximationLow
+
+	// The end-of-block position from the previous stages.
+	kex := se
+	for ; kex > 0; kex-- {
+		if block[zigzag[kex]] != 0 {
+			break
+		}
+	}
+
+	for k := int(sh.SpectralStart) - 1; k < se; {
+		st := 3 * k
+		if k >= kex && ad.decode(&stats[st]) != 0 {
+			// End of band.
+			break
+		}
+
+		for {
+			k++
+			coefficient := &block[zigzag[k]]
+
+			if *coefficient != 0 {
+				// Already non-zero, so this is a correction bit.
+				if ad.decode(&stats[st+2]) != 0 {
+					if *coefficient < 0 {
+						*coefficient += m1
+					} else {
+						*coefficient += p1
+					}
+				}
+
+				break
+			}
+
+			if ad.decode(&stats[st+1]) != 0 {
+				// Newly non-zero.
+				if ad.decode(&asc.fixedBin) != 0 {
+					*coefficient = m1
+				} else {
+					*coefficient = p1
+				}
+
+				break
+			}
+
+			st += 3
+			if k >= se {
+				return fmt.Errorf("AC coefficient index out of range: (%d)", k+1)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package jpegstructure
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dsoprea/go-logging"
+)
+
+func TestNewArithmeticScanDecoder_NotArithmetic(t *testing.T) {
+	fh := &SofSegment{
+		MarkerId:      MARKER_SOF0,
+		BitsPerSample: 8,
+		Width:         8,
+		Height:        8,
+		Components: []FrameComponent{
+			{Id: 1, HorizontalSampling: 1, VerticalSampling: 1},
+		},
+	}
+
+	_, err := newArithmeticScanDecoder(fh)
+	if err == nil {
+		t.Fatalf("Expected error for Huffman-coded frame.")
+	}
+}
+
+func TestArithmeticScanDecoder_MissingRestart(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	original := getTestGeneratedJpeg(64, 48, true)
+	sl := getCoefficientsTestSegmentList(original)
+
+	err := sl.Reencode(&WriteCoefficientsOptions{Arithmetic: true})
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	// Claim restart markers that were never written. Since arithmetic-coded
+	// data is only checked at the markers, we run off the end looking for the
+	// first one.
+
+	dri := &Segment{
+		MarkerId: MARKER_DRI,
+		Data:     []byte{0, 2},
+	}
+
+	segments := []*Segment{sl.segments[0], dri}
+	segments = append(segments, sl.segments[1:]...)
+
+	sl = NewSegmentList(segments)
+
+	report, err := sl.CheckScanData()
+	log.PanicIf(err)
+
+	expected := []string{
+		FindingEntropyTruncated,
+	}
+
+	if reflect.DeepEqual(report.Findings.Codes(), expected) != true {
+		t.Fatalf("Findings not correct: %v", report.Findings)
+	} else if report.Scans[0].DecodedMcus != 2 {
+		t.Fatalf("Expected decoding to stop at the first restart: %s", report.Scans[0])
+	}
+}
@@ -0,0 +1,219 @@
+package jpegstructure
+
+import (
+	"github.com/dsoprea/go-logging"
+)
+
+// encodeArithmeticScan returns the arithmetic-coded data of the given scan
+// (T.81 F.1.4 and G.1.3). This follows libjpeg.
+func (se *scanEncoder) encodeArithmeticScan(sh *ScanHeader, conditioning *arithmeticConditioning) (data []byte, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	fh := se.frame
+
+	indices, err := checkScanHeader(fh, sh)
+	log.PanicIf(err)
+
+	asc := newArithmeticScanContext(conditioning, fh.IsProgressive(), sh)
+	ae := newArithmeticEncoder()
+
+	var encodeBlock func(ae *arithmeticEncoder, asc *arithmeticScanContext, i int, block *CoefficientBlock)
+
+	if fh.IsProgressive() == false {
+		encodeBlock = encodeArithmeticBlockSequential
+	} else if sh.SpectralStart == 0 {
+		if sh.ApproximationHigh == 0 {
+			encodeBlock = encodeArithmeticBlockDcFirst
+		} else {
+			encodeBlock = encodeArithmeticBlockDcRefine
+		}
+	} else if sh.ApproximationHigh == 0 {
+		encodeBlock = encodeArithmeticBlockAcFirst
+	} else {
+		encodeBlock = encodeArithmeticBlockAcRefine
+	}
+
+	restart := func(index int) {
+		ae.writeRestart(index)
+		asc.reset()
+	}
+
+	visit := func(i int, block *CoefficientBlock) {
+		encodeBlock(ae, asc, i, block)
+	}
+
+	se.walkScanBlocks(sh, indices, restart, visit)
+
+	ae.flush()
+
+	return ae.b.Bytes(), nil
+}
+
+// pointTransform returns the magnitude of the coefficient after the point
+// transform.
+func pointTransform(coefficient int16, al byte) int32 {
+	v := int32(coefficient)
+	if v < 0 {
+		v = -v
+	}
+
+	return v >> al
+}
+
+func encodeArithmeticBlockSequential(ae *arithmeticEncoder, asc *arithmeticScanContext, i int, block *CoefficientBlock) {
+	asc.encodeDc(ae, i, int32(block[0]))
+
+	stats := &asc.acStats[asc.sh.Components[i].AcTableId]
+
+	// Find the end of the block.
+	ke := 63
+	for ; ke > 0; ke-- {
+		if block[zigzag[ke]] != 0 {
+			break
+		}
+	}
+
+	k := 0
+	for k < ke {
+		st := 3 * k
+		ae.encode(&stats[st], 0)
+
+		for {
+			k++
+			if block[zigzag[k]] != 0 {
+				break
+			}
+
+			ae.encode(&stats[st+1], 0)
+			st += 3
+		}
+
+		asc.encodeAcValue(ae, i, k, st, int32(block[zigzag[k]]))
+	}
+
+	if k < 63 {
+		ae.encode(&stats[3*k], 1)
+	}
+}
+
+func encodeArithmeticBlockDcFirst(ae *arithmeticEncoder, asc *arithmeticScanContext, i int, block *CoefficientBlock) {
+	// Unlike the AC coefficients, the DC is shifted arithmetically.
+	asc.encodeDc(ae, i, int32(block[0])>>asc.sh.ApproximationLow)
+}
+
+func encodeArithmeticBlockDcRefine(ae *arithmeticEncoder, asc *arithmeticScanContext, i int, block *CoefficientBlock) {
+	ae.encode(&asc.fixedBin, int(int32(block[0])>>asc.sh.ApproximationLow)&1)
+}
+
+func encodeArithmeticBlockAcFirst(ae *arithmeticEncoder, asc *arithmeticScanContext, i int, block *CoefficientBlock) {
+	sh := asc.sh
+	stats := &asc.acStats[sh.Components[0].AcTableId]
+
+	al := sh.ApproximationLow
+	se := int(sh.SpectralEnd)
+
+	// Find the end of the band.
+	ke := se
+	for ; ke > 0; ke-- {
+		if pointTransform(block[zigzag[ke]], al) != 0 {
+			break
+		}
+	}
+
+	k := int(sh.SpectralStart) - 1
+	for k < ke {
+		st := 3 * k
+		ae.encode(&stats[st], 0)
+
+		for {
+			k++
+			if pointTransform(block[zigzag[k]], al) != 0 {
+				break
+			}
+
+			ae.encode(&stats[st+1], 0)
+			st += 3
+		}
+
+		value := pointTransform(block[zigzag[k]], al)
+		if block[zigzag[k]] < 0 {
+			value = -value
+		}
+
+		asc.encodeAcValue(ae, 0, k, st, value)
+	}
+
+	if k < se {
+		ae.encode(&stats[3*k], 1)
+	}
+}
+
+// encodeArithmeticBlockAcRefine implements the AC successive-approximation
+// refinement (T.81 G.1.3.3).
+func encodeArithmeticBlockAcRefine(ae *arithmeticEncoder, asc *arithmeticScanContext, i int, block *CoefficientBlock) {
+	sh := asc.sh
+	stats := &asc.acStats[sh.Components[0].AcTableId]
+
+	al := sh.ApproximationLow
+	se := int(sh.SpectralEnd)
+
+	// Find the end of the band in this stage and in the previous ones.
+
+	ke := se
+	for ; ke > 0; ke-- {
+		if pointTransform(block[zigzag[ke]], al) != 0 {
+			break
+		}
+	}
+
+	kex := ke
+	for ; kex > 0; kex-- {
+		if pointTransform(block[zigzag[kex]], sh.ApproximationHigh) != 0 {
+			break
+		}
+	}
+
+	k := int(sh.SpectralStart) - 1
+	for k < ke {
+		st := 3 * k
+		if k >= kex {
+			ae.encode(&stats[st], 0)
+		}
+
+		for {
+			k++
+
+			v := pointTransform(block[zigzag[k]], al)
+			if v == 0 {
+				ae.encode(&stats[st+1], 0)
+				st += 3
+
+				continue
+			}
+
+			if v>>1 != 0 {
+				// Already non-zero, so this is a correction bit.
+				ae.encode(&stats[st+2], int(v&1))
+			} else {
+				// Newly non-zero.
+				ae.encode(&stats[st+1], 1)
+
+				if block[zigzag[k]] < 0 {
+					ae.encode(&asc.fixedBin, 1)
+				} else {
+					ae.encode(&asc.fixedBin, 0)
+				}
+			}
+
+			break
+		}
+	}
+
+	if k < se {
+		ae.encode(&stats[3*k], 1)
+	}
+}
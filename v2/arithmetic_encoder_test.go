@@ -0,0 +1,186 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"testing"
+
+	"image/jpeg"
+
+	"github.com/dsoprea/go-logging"
+)
+
+// checkArithmeticRoundTrip writes the coefficients with arithmetic coding and
+// makes sure that they survive.
+func checkArithmeticRoundTrip(t *testing.T, original []byte, options *WriteCoefficientsOptions, expectedMarkerId byte) *SegmentList {
+	sl := getCoefficientsTestSegmentList(original)
+
+	coefficients, err := sl.ReadCoefficients()
+	log.PanicIf(err)
+
+	err = sl.WriteCoefficients(coefficients, options)
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	for _, s := range sl.Segments() {
+		if s.MarkerId == MARKER_DHT {
+			t.Fatalf("Arithmetic-coded image has a DHT segment.")
+		}
+	}
+
+	report, err := sl.CheckScanData()
+	log.PanicIf(err)
+
+	if report.IsValid() != true || len(report.Findings) != 0 {
+		t.Fatalf("Scan-data not valid: %v", report.Findings)
+	} else if report.Frame.MarkerId != expectedMarkerId {
+		t.Fatalf("Frame not correct: %s", report.Frame)
+	}
+
+	recovered, err := sl.ReadCoefficients()
+	log.PanicIf(err)
+
+	if equalVisibleCoefficients(recovered, coefficients) != true {
+		t.Fatalf("Coefficients not equal after round-trip.")
+	}
+
+	return sl
+}
+
+func TestScanEncoder_Arithmetic(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	options := &WriteCoefficientsOptions{
+		Arithmetic: true,
+	}
+
+	original := getTestGeneratedJpeg(100, 75, false)
+	checkArithmeticRoundTrip(t, original, options, MARKER_SOF9)
+
+	original = getTestGeneratedJpeg(100, 75, true)
+	checkArithmeticRoundTrip(t, original, options, MARKER_SOF9)
+}
+
+func TestScanEncoder_Arithmetic_Progressive(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	options := &WriteCoefficientsOptions{
+		Arithmetic:      true,
+		Progressive:     true,
+		RestartInterval: 4,
+	}
+
+	original := getTestGeneratedJpeg(100, 75, false)
+	checkArithmeticRoundTrip(t, original, options, MARKER_SOF10)
+}
+
+func TestScanEncoder_Arithmetic_Conditioning(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	conditioning := []*ArithmeticConditioning{
+		{Class: HuffmanClassDc, Id: 0, Value: 0x62},
+		{Class: HuffmanClassAc, Id: 0, Value: 20},
+		{Class: HuffmanClassAc, Id: 1, Value: 1},
+	}
+
+	options := &WriteCoefficientsOptions{
+		Arithmetic:             true,
+		ArithmeticConditioning: conditioning,
+		RestartInterval:        2,
+	}
+
+	original := getTestGeneratedJpeg(100, 75, false)
+	sl := checkArithmeticRoundTrip(t, original, options, MARKER_SOF9)
+
+	found := false
+	for _, s := range sl.Segments() {
+		if s.MarkerId == MARKER_DAC {
+			found = true
+			break
+		}
+	}
+
+	if found != true {
+		t.Fatalf("DAC segment not written.")
+	}
+
+	options.ArithmeticConditioning = []*ArithmeticConditioning{
+		{Class: HuffmanClassDc, Id: 0, Value: 0x26},
+	}
+
+	err := sl.Reencode(options)
+	if err == nil {
+		t.Fatalf("Expected error for invalid conditioning.")
+	}
+}
+
+func TestSegmentList_Reencode_Arithmetic(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	original := getTestGeneratedJpeg(100, 75, false)
+	sl := getCoefficientsTestSegmentList(original)
+
+	err := sl.Reencode(&WriteCoefficientsOptions{Arithmetic: true})
+	log.PanicIf(err)
+
+	sl, arithmeticData := reparseSegmentList(sl)
+
+	// The standard decoder can't handle it, but ours can.
+
+	_, err = jpeg.Decode(bytes.NewReader(arithmeticData))
+	if err == nil {
+		t.Fatalf("Expected the standard decoder to fail.")
+	}
+
+	jmp := NewJpegMediaParser()
+
+	arithmeticImage, err := jmp.GetImage(bytes.NewReader(arithmeticData))
+	log.PanicIf(err)
+
+	originalImage, err := jpeg.Decode(bytes.NewReader(original))
+	log.PanicIf(err)
+
+	bounds := originalImage.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if arithmeticImage.At(x, y) != originalImage.At(x, y) {
+				t.Fatalf("Pixel (%d, %d) not equal.", x, y)
+			}
+		}
+	}
+
+	// And back to Huffman, which is exactly the original image.
+
+	err = sl.Reencode(nil)
+	log.PanicIf(err)
+
+	_, huffmanData := reparseSegmentList(sl)
+
+	if bytes.Equal(huffmanData, original) != true {
+		t.Fatalf("Huffman-coded image not equal to the original.")
+	}
+}
@@ -0,0 +1,162 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"testing"
+
+	"math/rand"
+)
+
+// getArithmeticTestDecisions returns decisions with a mix of skewed and even
+// probabilities across a few contexts.
+func getArithmeticTestDecisions(count int) (contexts []int, values []int) {
+	r := rand.New(rand.NewSource(1))
+
+	contexts = make([]int, count)
+	values = make([]int, count)
+
+	for i := 0; i < count; i++ {
+		context := r.Intn(4)
+		contexts[i] = context
+
+		// Context (0) is almost always zero, which produces long runs of
+		// settled 0xff and 0x00 bytes.
+		switch context {
+		case 0:
+			if r.Intn(1000) == 0 {
+				values[i] = 1
+			}
+		case 1:
+			if r.Intn(10) < 8 {
+				values[i] = 1
+			}
+		default:
+			values[i] = r.Intn(2)
+		}
+	}
+
+	return contexts, values
+}
+
+func TestArithmeticCoder_RoundTrip(t *testing.T) {
+	contexts, values := getArithmeticTestDecisions(100000)
+
+	var encoderStates [4]byte
+	ae := newArithmeticEncoder()
+
+	for i, context := range contexts {
+		ae.encode(&encoderStates[context], values[i])
+	}
+
+	ae.flush()
+
+	data := ae.b.Bytes()
+
+	// Make sure that the data is stuffed.
+	for i := 0; i < len(data)-1; i++ {
+		if data[i] == 0xff && data[i+1] != 0x00 {
+			t.Fatalf("Unstuffed 0xff at (%d).", i)
+		}
+	}
+
+	var decoderStates [4]byte
+	ad := newArithmeticDecoder(data)
+
+	for i, context := range contexts {
+		value := ad.decode(&decoderStates[context])
+		if value != values[i] {
+			t.Fatalf("Decision (%d) not correct: (%d) != (%d)", i, value, values[i])
+		}
+	}
+
+	if encoderStates != decoderStates {
+		t.Fatalf("States not equal: %v != %v", decoderStates, encoderStates)
+	}
+}
+
+func TestArithmeticCoder_Restart(t *testing.T) {
+	contexts, values := getArithmeticTestDecisions(3000)
+
+	ae := newArithmeticEncoder()
+
+	var encoderStates [4]byte
+	for i, context := range contexts {
+		if i > 0 && i%1000 == 0 {
+			ae.writeRestart(i/1000 - 1)
+			encoderStates = [4]byte{}
+		}
+
+		ae.encode(&encoderStates[context], values[i])
+	}
+
+	ae.flush()
+
+	data := ae.b.Bytes()
+
+	if bytes.Contains(data, []byte{0xff, MARKER_RST0 + 1}) != true {
+		t.Fatalf("RST1 not found.")
+	}
+
+	ad := newArithmeticDecoder(data)
+
+	var decoderStates [4]byte
+	for i, context := range contexts {
+		if i > 0 && i%1000 == 0 {
+			err := ad.processRestart(i/1000 - 1)
+			if err != nil {
+				t.Fatalf("Restart before decision (%d) failed: %s", i, err.Error())
+			}
+
+			decoderStates = [4]byte{}
+		}
+
+		value := ad.decode(&decoderStates[context])
+		if value != values[i] {
+			t.Fatalf("Decision (%d) not correct: (%d) != (%d)", i, value, values[i])
+		}
+	}
+
+	// The wrong marker.
+
+	ad = newArithmeticDecoder(data)
+
+	err := ad.processRestart(5)
+	if err == nil {
+		t.Fatalf("Expected error for the wrong restart marker.")
+	}
+}
+
+func TestArithmeticCoder_Empty(t *testing.T) {
+	ae := newArithmeticEncoder()
+
+	var state byte
+	for i := 0; i < 100; i++ {
+		ae.encode(&state, 0)
+	}
+
+	ae.flush()
+
+	// Trailing zeros are dropped, and the decoder supplies them.
+
+	ad := newArithmeticDecoder(ae.b.Bytes())
+
+	state = 0
+	for i := 0; i < 100; i++ {
+		if ad.decode(&state) != 0 {
+			t.Fatalf("Decision (%d) not correct.", i)
+		}
+	}
+}
+
+func TestNextStateAfterLps(t *testing.T) {
+	// State (0) switches the more-probable symbol.
+	if nextStateAfterLps(0x00) != 0x81 {
+		t.Fatalf("State not correct: (0x%02x)", nextStateAfterLps(0x00))
+	} else if nextStateAfterLps(0x81) != 0x8e {
+		t.Fatalf("State not correct: (0x%02x)", nextStateAfterLps(0x81))
+	} else if nextStateAfterMps(0x81) != 0x82 {
+		t.Fatalf("State not correct: (0x%02x)", nextStateAfterMps(0x81))
+	} else if nextStateAfterLps(fixedProbabilityState) != fixedProbabilityState || nextStateAfterMps(fixedProbabilityState) != fixedProbabilityState {
+		t.Fatalf("Fixed state is not fixed.")
+	}
+}
@@ -0,0 +1,518 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+
+	"encoding/base64"
+	"image/png"
+
+	"github.com/dsoprea/go-logging"
+)
+
+var (
+	// ErrNoAuxiliaryImage is returned if there's no auxiliary image of the
+	// requested kind.
+	ErrNoAuxiliaryImage = errors.New("no auxiliary image")
+)
+
+const (
+	xmpNamespaceGDepth = "http://ns.google.com/photos/1.0/depthmap/"
+	xmpNamespaceGImage = "http://ns.google.com/photos/1.0/image/"
+
+	// xmpNamespaceDepthMap is the namespace of the depth maps of Dynamic
+	// Depth, whose images are items of the container directory.
+	xmpNamespaceDepthMap = "http://ns.google.com/photos/dd/1.0/depthmap/"
+
+	// xmpNamespaceApdi is Apple's namespace for the auxiliary images that it
+	// stores as MPF images.
+	xmpNamespaceApdi = "http://ns.apple.com/pixeldatainfo/1.0/"
+)
+
+// AuxiliaryImageKind is what an auxiliary image represents.
+type AuxiliaryImageKind int
+
+const (
+	// AuxiliaryImageKindDepth is a depth (or disparity) map.
+	AuxiliaryImageKindDepth AuxiliaryImageKind = iota
+
+	// AuxiliaryImageKindConfidence is the confidence of each value of a
+	// depth map.
+	AuxiliaryImageKindConfidence
+
+	// AuxiliaryImageKindOriginal is the image from before a portrait-mode
+	// effect (e.g. blur) was applied to the primary image.
+	AuxiliaryImageKindOriginal
+
+	// AuxiliaryImageKindMatte is a segmentation matte (e.g. Apple's
+	// portrait-effects matte).
+	AuxiliaryImageKindMatte
+)
+
+// String returns a descriptive string.
+func (aik AuxiliaryImageKind) String() string {
+	switch aik {
+	case AuxiliaryImageKindDepth:
+		return "Depth"
+	case AuxiliaryImageKindConfidence:
+		return "Confidence"
+	case AuxiliaryImageKindOriginal:
+		return "Original"
+	case AuxiliaryImageKindMatte:
+		return "Matte"
+	}
+
+	return fmt.Sprintf("Unknown(%d)", int(aik))
+}
+
+// AuxiliaryImageSource is where an auxiliary image is stored.
+type AuxiliaryImageSource int
+
+const (
+	// AuxiliaryImageSourceGDepth is base64 in the "GDepth" XMP properties
+	// (in either the main or the extended XMP).
+	AuxiliaryImageSourceGDepth AuxiliaryImageSource = iota
+
+	// AuxiliaryImageSourceGImage is base64 in the "GImage" XMP properties.
+	AuxiliaryImageSourceGImage
+
+	// AuxiliaryImageSourceContainer is an item of the container directory
+	// (Dynamic Depth).
+	AuxiliaryImageSourceContainer
+
+	// AuxiliaryImageSourceMpf is an MPF image.
+	AuxiliaryImageSourceMpf
+)
+
+// String returns a descriptive string.
+func (ais AuxiliaryImageSource) String() string {
+	switch ais {
+	case AuxiliaryImageSourceGDepth:
+		return "GDepth"
+	case AuxiliaryImageSourceGImage:
+		return "GImage"
+	case AuxiliaryImageSourceContainer:
+		return "Container"
+	case AuxiliaryImageSourceMpf:
+		return "Mpf"
+	}
+
+	return fmt.Sprintf("Unknown(%d)", int(ais))
+}
+
+// AuxiliaryImage is an image that's stored alongside the primary image to
+// support portrait-mode effects.
+type AuxiliaryImage struct {
+	// Kind is what the image represents.
+	Kind AuxiliaryImageKind
+
+	// Source is where the image is stored.
+	Source AuxiliaryImageSource
+
+	// Mime is the type of the image ("image/jpeg" or "image/png").
+	Mime string
+
+	// Format is how the values of a depth map are encoded ("RangeInverse" or
+	// "RangeLinear"). For MPF images with Apple's metadata, it's the
+	// auxiliary-image type instead.
+	Format string
+
+	// Near and Far are the distances that the smallest and largest values of
+	// a depth map correspond to, in `Units`. They're (0) if not given.
+	Near float64
+	Far  float64
+
+	// Units are the units of `Near` and `Far` (e.g. "m" or "Meters").
+	Units string
+
+	// MeasureType is how the distances are measured ("OpticalAxis" or
+	// "OpticRay").
+	MeasureType string
+
+	// Data is the encoded image.
+	Data []byte
+}
+
+// String returns a descriptive string.
+func (ai *AuxiliaryImage) String() string {
+	return fmt.Sprintf("AuxiliaryImage<KIND=[%s] SOURCE=[%s] MIME=[%s] FORMAT=[%s] NEAR=(%v) FAR=(%v) SIZE=(%d)>", ai.Kind, ai.Source, ai.Mime, ai.Format, ai.Near, ai.Far, len(ai.Data))
+}
+
+// SegmentList parses the image, which has to be a JPEG.
+func (ai *AuxiliaryImage) SegmentList() (sl *SegmentList, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if ai.Mime != "image/jpeg" {
+		log.Panicf("auxiliary image is not a JPEG: [%s]", ai.Mime)
+	}
+
+	intfc, err := NewJpegMediaParser().ParseBytes(ai.Data)
+	log.PanicIf(err)
+
+	return intfc.(*SegmentList), nil
+}
+
+// Image decodes the image. JPEGs are decoded with `DecodeImage`, so depth
+// maps with more than eight bits are kept intact.
+func (ai *AuxiliaryImage) Image() (img image.Image, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	switch ai.Mime {
+	case "image/jpeg":
+		sl, err := ai.SegmentList()
+		log.PanicIf(err)
+
+		img, err = sl.DecodeImage(nil)
+		log.PanicIf(err)
+	case "image/png":
+		img, err = png.Decode(bytes.NewReader(ai.Data))
+		log.PanicIf(err)
+	default:
+		log.Panicf("auxiliary image type not supported: [%s]", ai.Mime)
+	}
+
+	return img, nil
+}
+
+// decodeXmpBase64 decodes base64 from XMP, which may be wrapped.
+func decodeXmpBase64(raw string) (data []byte, err error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(raw), ""))
+}
+
+// xmpFloat returns the value of a property as a float, or (0) if it's not
+// there.
+func xmpFloat(value string, found bool) (f float64, err error) {
+	if found == false {
+		return 0, nil
+	}
+
+	return strconv.ParseFloat(strings.TrimSpace(value), 64)
+}
+
+// xmpAuxiliaryImages returns the images that are stored as base64 in the
+// GDepth and GImage properties. The data is usually big enough to be in the
+// extended XMP, so that's searched, too.
+func xmpAuxiliaryImages(documents []*xmpDocument) (images []*AuxiliaryImage, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	property := func(namespace, local string) (string, bool) {
+		for _, xd := range documents {
+			if value, found := xd.property(namespace, local); found == true {
+				return value, true
+			}
+		}
+
+		return "", false
+	}
+
+	type source struct {
+		kind       AuxiliaryImageKind
+		source     AuxiliaryImageSource
+		namespace  string
+		dataLocal  string
+		mimeLocal  string
+		isDepthMap bool
+	}
+
+	sources := []source{
+		{AuxiliaryImageKindDepth, AuxiliaryImageSourceGDepth, xmpNamespaceGDepth, "Data", "Mime", true},
+		{AuxiliaryImageKindConfidence, AuxiliaryImageSourceGDepth, xmpNamespaceGDepth, "Confidence", "ConfidenceMime", false},
+		{AuxiliaryImageKindOriginal, AuxiliaryImageSourceGImage, xmpNamespaceGImage, "Data", "Mime", false},
+	}
+
+	images = make([]*AuxiliaryImage, 0)
+
+	for _, src := range sources {
+		raw, found := property(src.namespace, src.dataLocal)
+		if found == false {
+			continue
+		}
+
+		// An image that we can't decode is skipped rather than failing the
+		// others.
+		data, err := decodeXmpBase64(raw)
+		if err != nil {
+			continue
+		}
+
+		ai := &AuxiliaryImage{
+			Kind:   src.kind,
+			Source: src.source,
+			Mime:   "image/jpeg",
+			Data:   data,
+		}
+
+		if mime, found := property(src.namespace, src.mimeLocal); found == true {
+			ai.Mime = mime
+		}
+
+		if src.isDepthMap == true {
+			ai.Format, _ = property(xmpNamespaceGDepth, "Format")
+			ai.Units, _ = property(xmpNamespaceGDepth, "Units")
+			ai.MeasureType, _ = property(xmpNamespaceGDepth, "MeasureType")
+
+			ai.Near, err = xmpFloat(property(xmpNamespaceGDepth, "Near"))
+			log.PanicIf(err)
+
+			ai.Far, err = xmpFloat(property(xmpNamespaceGDepth, "Far"))
+			log.PanicIf(err)
+		}
+
+		images = append(images, ai)
+	}
+
+	return images, nil
+}
+
+// containerAuxiliaryImages returns the depth, confidence, and original images
+// in the container directory, along with the Dynamic Depth depth-map
+// properties that refer to them by their semantic.
+func (sl *SegmentList) containerAuxiliaryImages(xd *xmpDocument) (images []*AuxiliaryImage, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	items, err := xd.containerDirectory()
+	log.PanicIf(err)
+
+	images = make([]*AuxiliaryImage, 0)
+
+	for i := 1; i < len(items); i++ {
+		ci := items[i]
+
+		var kind AuxiliaryImageKind
+
+		switch ci.Semantic {
+		case "Depth":
+			kind = AuxiliaryImageKindDepth
+		case "Confidence":
+			kind = AuxiliaryImageKindConfidence
+		case "Original":
+			kind = AuxiliaryImageKindOriginal
+		default:
+			continue
+		}
+
+		start := containerItemOffset(items, i)
+		end := start + ci.Length
+
+		// An item that isn't within the trailer is skipped rather than
+		// failing the others.
+		if ci.Length == 0 || end > len(sl.trailer) {
+			continue
+		}
+
+		// Don't alias the trailer.
+		data := make([]byte, ci.Length)
+		copy(data, sl.trailer[start:end])
+
+		ai := &AuxiliaryImage{
+			Kind:   kind,
+			Source: AuxiliaryImageSourceContainer,
+			Mime:   ci.Mime,
+			Data:   data,
+		}
+
+		if kind == AuxiliaryImageKindDepth {
+			xd.walk(func(xe *xmpElement) {
+				if err != nil {
+					return
+				} else if semantic, _ := xe.property(xmpNamespaceDepthMap, "ItemSemantic"); semantic != ci.Semantic {
+					return
+				}
+
+				ai.Format, _ = xe.property(xmpNamespaceDepthMap, "Format")
+				ai.Units, _ = xe.property(xmpNamespaceDepthMap, "Units")
+				ai.MeasureType, _ = xe.property(xmpNamespaceDepthMap, "MeasureType")
+
+				ai.Near, err = xmpFloat(xe.property(xmpNamespaceDepthMap, "Near"))
+				if err != nil {
+					return
+				}
+
+				ai.Far, err = xmpFloat(xe.property(xmpNamespaceDepthMap, "Far"))
+			})
+
+			log.PanicIf(err)
+		}
+
+		images = append(images, ai)
+	}
+
+	return images, nil
+}
+
+// mpfAuxiliaryImage returns the MPF image as an auxiliary image, or nil if
+// it's something else (e.g. a thumbnail, a gain map, or a view of a stereo
+// pair). Apple describes its auxiliary images in the XMP of each; otherwise,
+// a one-component disparity image is taken to be a depth map rather than a
+// view.
+func mpfAuxiliaryImage(me MpfEntry, data []byte) (ai *AuxiliaryImage, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	intfc, err := NewJpegMediaParser().ParseBytes(data)
+	log.PanicIf(err)
+
+	sl := intfc.(*SegmentList)
+
+	// Don't alias the trailer.
+	copied := make([]byte, len(data))
+	copy(copied, data)
+
+	ai = &AuxiliaryImage{
+		Source: AuxiliaryImageSourceMpf,
+		Mime:   "image/jpeg",
+		Data:   copied,
+	}
+
+	_, s, err := sl.FindXmp()
+	if err == nil {
+		xd, err := parseXmpDocument(s.Data[len(xmpPrefix):])
+		log.PanicIf(err)
+
+		if auxiliaryType, found := xd.property(xmpNamespaceApdi, "AuxiliaryImageType"); found == true {
+			ai.Format = auxiliaryType
+
+			lower := strings.ToLower(auxiliaryType)
+
+			if strings.Contains(lower, "depth") == true || strings.Contains(lower, "disparity") == true {
+				ai.Kind = AuxiliaryImageKindDepth
+			} else if strings.Contains(lower, "matte") == true {
+				ai.Kind = AuxiliaryImageKindMatte
+			} else {
+				return nil, nil
+			}
+
+			return ai, nil
+		}
+	} else if err != ErrNoXmp {
+		log.Panic(err)
+	}
+
+	if me.Type() != MpfImageTypeMultiFrameDisparity {
+		return nil, nil
+	}
+
+	fh, err := sl.frameHeader()
+	log.PanicIf(err)
+
+	if fh == nil || len(fh.Components) != 1 {
+		return nil, nil
+	}
+
+	ai.Kind = AuxiliaryImageKindDepth
+
+	return ai, nil
+}
+
+// AuxiliaryImages returns the depth maps, confidence maps, mattes, and
+// pre-effect originals that phones store with portrait-mode images. They're
+// found in the GDepth and GImage XMP properties (including the extended XMP),
+// in the container directory (Dynamic Depth), and among the MPF images. The
+// list is empty if there are none. Images that can't be extracted (e.g. an MPF
+// image that doesn't parse or a container item that's outside the trailer) are
+// skipped.
+func (sl *SegmentList) AuxiliaryImages() (images []*AuxiliaryImage, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	images = make([]*AuxiliaryImage, 0)
+
+	_, s, err := sl.FindXmp()
+	if err == nil {
+		xd, err := parseXmpDocument(s.Data[len(xmpPrefix):])
+		log.PanicIf(err)
+
+		documents := []*xmpDocument{xd}
+
+		extended, err := sl.extendedXmp(xd)
+		log.PanicIf(err)
+
+		if extended != nil {
+			documents = append(documents, extended)
+		}
+
+		xmpImages, err := xmpAuxiliaryImages(documents)
+		log.PanicIf(err)
+
+		images = append(images, xmpImages...)
+
+		containerImages, err := sl.containerAuxiliaryImages(xd)
+		log.PanicIf(err)
+
+		images = append(images, containerImages...)
+	} else if err != ErrNoXmp {
+		log.Panic(err)
+	}
+
+	mi, err := sl.Mpf()
+	if err == nil {
+		for i := 1; i < len(mi.Entries); i++ {
+			data, err := sl.MpfImage(i)
+			if err != nil {
+				continue
+			}
+
+			// We can't tell what an image that doesn't parse is, so it's
+			// skipped.
+			ai, err := mpfAuxiliaryImage(mi.Entries[i], data)
+			if err != nil {
+				continue
+			}
+
+			if ai != nil {
+				images = append(images, ai)
+			}
+		}
+	} else if err != ErrNoMpf {
+		log.Panic(err)
+	}
+
+	return images, nil
+}
+
+// AuxiliaryImage returns the first auxiliary image of the given kind.
+// `ErrNoAuxiliaryImage` is returned if there isn't one.
+func (sl *SegmentList) AuxiliaryImage(kind AuxiliaryImageKind) (ai *AuxiliaryImage, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	images, err := sl.AuxiliaryImages()
+	log.PanicIf(err)
+
+	for _, ai := range images {
+		if ai.Kind == kind {
+			return ai, nil
+		}
+	}
+
+	return nil, ErrNoAuxiliaryImage
+}
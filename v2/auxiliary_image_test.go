@@ -0,0 +1,383 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"testing"
+
+	"encoding/base64"
+	"encoding/binary"
+	"image/png"
+
+	"github.com/dsoprea/go-logging"
+)
+
+const (
+	auxiliaryImageTestGuid = "0123456789abcdef0123456789abcdef"
+
+	auxiliaryImageTestMainPacket = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:xmpNote="http://ns.adobe.com/xmp/note/"
+    xmlns:GDepth="http://ns.google.com/photos/1.0/depthmap/"
+    xmlns:GImage="http://ns.google.com/photos/1.0/image/"
+    xmpNote:HasExtendedXMP="` + auxiliaryImageTestGuid + `"
+    GDepth:Format="RangeInverse"
+    GDepth:Near="0.25"
+    GDepth:Far="4.5"
+    GDepth:Units="m"
+    GDepth:MeasureType="OpticalAxis"
+    GDepth:Mime="image/jpeg"
+    GDepth:ConfidenceMime="image/png"
+    GImage:Mime="image/jpeg"/>
+ </rdf:RDF>
+</x:xmpmeta>`
+
+	auxiliaryImageTestExtendedPacket = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:GDepth="http://ns.google.com/photos/1.0/depthmap/"
+    xmlns:GImage="http://ns.google.com/photos/1.0/image/"
+    GDepth:Data="%s"
+    GDepth:Confidence="%s">
+   <GImage:Data>%s</GImage:Data>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`
+
+	auxiliaryImageTestDynamicDepthPacket = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:Container="http://ns.google.com/photos/1.0/container/"
+    xmlns:Item="http://ns.google.com/photos/1.0/container/item/"
+    xmlns:Device="http://ns.google.com/photos/dd/1.0/device/"
+    xmlns:Camera="http://ns.google.com/photos/dd/1.0/camera/"
+    xmlns:DepthMap="http://ns.google.com/photos/dd/1.0/depthmap/">
+   <Container:Directory>
+    <rdf:Seq>
+     <rdf:li rdf:parseType="Resource"><Container:Item Item:Semantic="Primary" Item:Mime="image/jpeg"/></rdf:li>
+     <rdf:li rdf:parseType="Resource"><Container:Item Item:Semantic="Depth" Item:Mime="image/jpeg" Item:Length="%d"/></rdf:li>
+    </rdf:Seq>
+   </Container:Directory>
+   <Device:Cameras>
+    <rdf:Seq>
+     <rdf:li rdf:parseType="Resource">
+      <Device:Camera rdf:parseType="Resource">
+       <Camera:DepthMap rdf:parseType="Resource">
+        <DepthMap:Format>RangeLinear</DepthMap:Format>
+        <DepthMap:Near>0.5</DepthMap:Near>
+        <DepthMap:Far>10</DepthMap:Far>
+        <DepthMap:Units>Meters</DepthMap:Units>
+        <DepthMap:MeasureType>OpticRay</DepthMap:MeasureType>
+        <DepthMap:ItemSemantic>Depth</DepthMap:ItemSemantic>
+       </Camera:DepthMap>
+      </Device:Camera>
+     </rdf:li>
+    </rdf:Seq>
+   </Device:Cameras>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`
+
+	auxiliaryImageTestApplePacket = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:apdi="http://ns.apple.com/pixeldatainfo/1.0/" apdi:AuxiliaryImageType="%s"/>
+ </rdf:RDF>
+</x:xmpmeta>`
+)
+
+// getAuxiliaryImageTestJpeg returns a generated image with the given XMP, if
+// any.
+func getAuxiliaryImageTestJpeg(width, height int, isGray bool, packet string) []byte {
+	data := getTestGeneratedJpeg(width, height, isGray)
+	if packet == "" {
+		return data
+	}
+
+	sl := getCoefficientsTestSegmentList(data)
+
+	s := &Segment{
+		MarkerId:   MARKER_APP1,
+		MarkerName: markerNames[MARKER_APP1],
+		Data:       append(append([]byte{}, xmpPrefix...), packet...),
+	}
+
+	sl.segments = append([]*Segment{sl.segments[0], s}, sl.segments[1:]...)
+
+	_, data = reparseSegmentList(sl)
+
+	return data
+}
+
+// getExtendedXmpTestSegments splits extended XMP into segments of at most
+// `partSize` bytes of data.
+func getExtendedXmpTestSegments(guid string, data []byte, partSize int) []*Segment {
+	segments := make([]*Segment, 0)
+
+	for offset := 0; offset < len(data); offset += partSize {
+		end := offset + partSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		b := new(bytes.Buffer)
+		b.Write(xmpExtensionPrefix)
+		b.WriteString(guid)
+		binary.Write(b, binary.BigEndian, []uint32{uint32(len(data)), uint32(offset)})
+		b.Write(data[offset:end])
+
+		s := &Segment{
+			MarkerId:   MARKER_APP1,
+			MarkerName: markerNames[MARKER_APP1],
+			Data:       b.Bytes(),
+		}
+
+		segments = append(segments, s)
+	}
+
+	return segments
+}
+
+// getAuxiliaryImageTestGDepthSegmentList returns an image with a depth map, a
+// confidence map, and an original image in the XMP, the data of which is in
+// the extended XMP.
+func getAuxiliaryImageTestGDepthSegmentList() (sl *SegmentList, depth, confidence, original []byte) {
+	depth = getTestGeneratedJpeg(16, 12, true)
+	original = getTestGeneratedJpeg(32, 24, false)
+
+	gray := image.NewGray(image.Rect(0, 0, 8, 6))
+	for i := range gray.Pix {
+		gray.Pix[i] = byte(i * 5)
+	}
+
+	b := new(bytes.Buffer)
+
+	err := png.Encode(b, gray)
+	log.PanicIf(err)
+
+	confidence = b.Bytes()
+
+	extended := fmt.Sprintf(
+		auxiliaryImageTestExtendedPacket,
+		base64.StdEncoding.EncodeToString(depth),
+		base64.StdEncoding.EncodeToString(confidence),
+		base64.StdEncoding.EncodeToString(original))
+
+	sl = getCoefficientsTestSegmentList(getTestGeneratedJpeg(32, 24, false))
+
+	s := &Segment{
+		MarkerId:   MARKER_APP1,
+		MarkerName: markerNames[MARKER_APP1],
+		Data:       append(append([]byte{}, xmpPrefix...), auxiliaryImageTestMainPacket...),
+	}
+
+	segments := append([]*Segment{sl.segments[0], s}, getExtendedXmpTestSegments(auxiliaryImageTestGuid, []byte(extended), 1000)...)
+	sl.segments = append(segments, sl.segments[1:]...)
+
+	sl, _ = reparseSegmentList(sl)
+
+	return sl, depth, confidence, original
+}
+
+func TestSegmentList_AuxiliaryImages_GDepth(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl, depth, confidence, original := getAuxiliaryImageTestGDepthSegmentList()
+
+	images, err := sl.AuxiliaryImages()
+	log.PanicIf(err)
+
+	if len(images) != 3 {
+		t.Fatalf("Images not correct: %v", images)
+	}
+
+	ai := images[0]
+
+	if ai.Kind != AuxiliaryImageKindDepth || ai.Source != AuxiliaryImageSourceGDepth || ai.Mime != "image/jpeg" {
+		t.Fatalf("Depth map not correct: %s", ai)
+	} else if ai.Format != "RangeInverse" || ai.Near != 0.25 || ai.Far != 4.5 || ai.Units != "m" || ai.MeasureType != "OpticalAxis" {
+		t.Fatalf("Depth-map metadata not correct: %s", ai)
+	} else if bytes.Equal(ai.Data, depth) != true {
+		t.Fatalf("Depth-map data not correct.")
+	} else if ai.String() != "AuxiliaryImage<KIND=[Depth] SOURCE=[GDepth] MIME=[image/jpeg] FORMAT=[RangeInverse] NEAR=(0.25) FAR=(4.5) SIZE=("+fmt.Sprintf("%d", len(depth))+")>" {
+		t.Fatalf("String not correct: [%s]", ai)
+	}
+
+	img, err := ai.Image()
+	log.PanicIf(err)
+
+	if _, ok := img.(*image.Gray16); ok != true || img.Bounds() != image.Rect(0, 0, 16, 12) {
+		t.Fatalf("Depth-map image not correct: %T %v", img, img.Bounds())
+	}
+
+	depthSl, err := ai.SegmentList()
+	log.PanicIf(err)
+
+	fh, err := depthSl.frameHeader()
+	log.PanicIf(err)
+
+	if fh.Width != 16 || len(fh.Components) != 1 {
+		t.Fatalf("Depth-map segments not correct: %s", fh)
+	}
+
+	ai = images[1]
+
+	if ai.Kind != AuxiliaryImageKindConfidence || ai.Mime != "image/png" || bytes.Equal(ai.Data, confidence) != true || ai.Near != 0 {
+		t.Fatalf("Confidence map not correct: %s", ai)
+	}
+
+	img, err = ai.Image()
+	log.PanicIf(err)
+
+	if img.Bounds() != image.Rect(0, 0, 8, 6) {
+		t.Fatalf("Confidence-map image not correct: %v", img.Bounds())
+	} else if _, err := ai.SegmentList(); err == nil {
+		t.Fatalf("Expected error for a PNG.")
+	}
+
+	ai = images[2]
+
+	if ai.Kind != AuxiliaryImageKindOriginal || ai.Source != AuxiliaryImageSourceGImage || bytes.Equal(ai.Data, original) != true {
+		t.Fatalf("Original not correct: %s", ai)
+	}
+
+	ai, err = sl.AuxiliaryImage(AuxiliaryImageKindOriginal)
+	log.PanicIf(err)
+
+	if bytes.Equal(ai.Data, original) != true {
+		t.Fatalf("Original not found.")
+	}
+
+	if _, err := sl.AuxiliaryImage(AuxiliaryImageKindMatte); err != ErrNoAuxiliaryImage {
+		t.Fatalf("Expected no matte: %v", err)
+	}
+}
+
+func TestSegmentList_AuxiliaryImages_DynamicDepth(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	depth := getTestGeneratedJpeg(16, 12, true)
+	data := getAuxiliaryImageTestJpeg(32, 24, false, fmt.Sprintf(auxiliaryImageTestDynamicDepthPacket, len(depth)))
+
+	sl := getCoefficientsTestSegmentList(data)
+	sl.SetTrailer(depth)
+
+	ai, err := sl.AuxiliaryImage(AuxiliaryImageKindDepth)
+	log.PanicIf(err)
+
+	if ai.Source != AuxiliaryImageSourceContainer || bytes.Equal(ai.Data, depth) != true {
+		t.Fatalf("Depth map not correct: %s", ai)
+	} else if ai.Format != "RangeLinear" || ai.Near != 0.5 || ai.Far != 10 || ai.Units != "Meters" || ai.MeasureType != "OpticRay" {
+		t.Fatalf("Depth-map metadata not correct: %s", ai)
+	}
+
+	// The data is a copy.
+
+	ai.Data[0] = 0
+
+	if bytes.Equal(sl.Trailer(), depth) != true {
+		t.Fatalf("Trailer was changed through the image data.")
+	}
+
+	// The trailer is too short, so the item is skipped.
+
+	sl.SetTrailer(depth[:10])
+
+	images, err := sl.AuxiliaryImages()
+	log.PanicIf(err)
+
+	if len(images) != 0 {
+		t.Fatalf("Expected the truncated item to be skipped: %v", images)
+	}
+}
+
+func TestSegmentList_AuxiliaryImages_Mpf(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	disparity := getTestGeneratedJpeg(16, 12, true)
+	view := getTestGeneratedJpeg(32, 24, false)
+	broken := []byte("not a JPEG")
+	matte := getAuxiliaryImageTestJpeg(16, 12, true, fmt.Sprintf(auxiliaryImageTestApplePacket, "urn:com:apple:photo:2018:aux:portraiteffectsmatte"))
+	gainMap := getAuxiliaryImageTestJpeg(16, 12, true, fmt.Sprintf(auxiliaryImageTestApplePacket, "urn:com:apple:photo:2020:aux:hdrgainmap"))
+	thumbnail := getTestGeneratedJpeg(16, 12, true)
+
+	// The image that doesn't parse is skipped.
+
+	images := [][]byte{disparity, view, broken, matte, gainMap, thumbnail}
+
+	types := []MpfImageType{
+		MpfImageTypeMultiFrameDisparity,
+		MpfImageTypeMultiFrameDisparity,
+		MpfImageTypeMultiFrameDisparity,
+		MpfImageTypeUndefined,
+		MpfImageTypeUndefined,
+		MpfImageTypeLargeThumbnailVga,
+	}
+
+	sl := getMpfTestSegmentList(getTestGeneratedJpeg(32, 24, false), images, types)
+
+	found, err := sl.AuxiliaryImages()
+	log.PanicIf(err)
+
+	if len(found) != 2 {
+		t.Fatalf("Images not correct: %v", found)
+	} else if found[0].Kind != AuxiliaryImageKindDepth || found[0].Source != AuxiliaryImageSourceMpf || bytes.Equal(found[0].Data, disparity) != true {
+		t.Fatalf("Depth map not correct: %s", found[0])
+	} else if found[1].Kind != AuxiliaryImageKindMatte || found[1].Format != "urn:com:apple:photo:2018:aux:portraiteffectsmatte" || bytes.Equal(found[1].Data, matte) != true {
+		t.Fatalf("Matte not correct: %s", found[1])
+	}
+}
+
+func TestSegmentList_AuxiliaryImages_None(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	for _, sl := range []*SegmentList{getSanitizeTestSegmentList(), getCoefficientsTestSegmentList(getTestGeneratedJpeg(16, 16, false))} {
+		images, err := sl.AuxiliaryImages()
+		log.PanicIf(err)
+
+		if len(images) != 0 {
+			t.Fatalf("Expected no images: %v", images)
+		}
+	}
+
+	// An Ultra HDR gain map isn't an auxiliary image.
+
+	sl, _ := getUltraHdrTestSegmentList()
+
+	if _, err := sl.AuxiliaryImage(AuxiliaryImageKindDepth); err != ErrNoAuxiliaryImage {
+		t.Fatalf("Expected no depth map: %v", err)
+	}
+}
+
+func TestAuxiliaryImageKind_String(t *testing.T) {
+	if AuxiliaryImageKindMatte.String() != "Matte" || AuxiliaryImageKind(99).String() != "Unknown(99)" {
+		t.Fatalf("String not correct.")
+	} else if AuxiliaryImageSourceMpf.String() != "Mpf" || AuxiliaryImageSource(99).String() != "Unknown(99)" {
+		t.Fatalf("Source string not correct.")
+	}
+}
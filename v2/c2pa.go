@@ -0,0 +1,720 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+
+	"github.com/dsoprea/go-logging"
+)
+
+var (
+	// ErrNoC2paHardBinding is returned if the active manifest doesn't have a
+	// data-hash assertion, which is how C2PA binds a manifest to a JPEG.
+	ErrNoC2paHardBinding = errors.New("no C2PA hard-binding assertion")
+)
+
+const (
+	// c2paHashDataLabel is the label of the data-hash assertion. Additional
+	// instances have a "__<n>" suffix.
+	c2paHashDataLabel = "c2pa.hash.data"
+
+	// c2paJumbfUriPrefix starts the URIs that refer to boxes in the manifest
+	// store.
+	c2paJumbfUriPrefix = "self#jumbf="
+
+	// c2paDefaultAlgorithm is the hash algorithm if the claim doesn't say.
+	c2paDefaultAlgorithm = "sha256"
+
+	// coseSign1Tag is the CBOR tag of a COSE_Sign1 structure.
+	coseSign1Tag = 18
+
+	// coseHeaderAlgorithm is the label of the algorithm header parameter.
+	coseHeaderAlgorithm = 1
+
+	// coseHeaderX5Chain is the label of the certificate-chain header
+	// parameter.
+	coseHeaderX5Chain = 33
+)
+
+const (
+	// CoseAlgorithmEs256 is ECDSA with SHA-256.
+	CoseAlgorithmEs256 = -7
+
+	// CoseAlgorithmEs384 is ECDSA with SHA-384.
+	CoseAlgorithmEs384 = -35
+
+	// CoseAlgorithmEs512 is ECDSA with SHA-512.
+	CoseAlgorithmEs512 = -36
+
+	// CoseAlgorithmPs256 is RSASSA-PSS with SHA-256.
+	CoseAlgorithmPs256 = -37
+
+	// CoseAlgorithmPs384 is RSASSA-PSS with SHA-384.
+	CoseAlgorithmPs384 = -38
+
+	// CoseAlgorithmPs512 is RSASSA-PSS with SHA-512.
+	CoseAlgorithmPs512 = -39
+
+	// CoseAlgorithmEdDsa is EdDSA.
+	CoseAlgorithmEdDsa = -8
+)
+
+// C2paExclusion is a range of the file that the data-hash doesn't cover.
+type C2paExclusion struct {
+	Start  int
+	Length int
+}
+
+// C2paSignature is the COSE signature of a claim, ready to verify.
+type C2paSignature struct {
+	// Algorithm is the COSE algorithm identifier.
+	Algorithm int64
+
+	// Certificates are the DER certificates of the signer, leaf first.
+	Certificates [][]byte
+
+	// SignedData is the encoded COSE Sig_structure, which is what was signed.
+	SignedData []byte
+
+	// Signature is the signature.
+	Signature []byte
+}
+
+// C2paSignatureVerifier verifies claim signatures, which includes deciding
+// whether the signer is trusted.
+type C2paSignatureVerifier interface {
+	// VerifyC2paSignature returns nil if the signature is valid and trusted.
+	VerifyC2paSignature(cs *C2paSignature) error
+}
+
+// X509C2paSignatureVerifier verifies the certificate chain of the signer
+// against local trust anchors and then the signature with the leaf
+// certificate. ECDSA and RSASSA-PSS are supported.
+type X509C2paSignatureVerifier struct {
+	// Roots are the trust anchors.
+	Roots *x509.CertPool
+
+	// CurrentTime is when to check the certificates' validity for. If zero,
+	// the current time is used.
+	CurrentTime time.Time
+}
+
+// VerifyC2paSignature verifies the chain and the signature.
+func (xcsv *X509C2paSignatureVerifier) VerifyC2paSignature(cs *C2paSignature) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if len(cs.Certificates) == 0 {
+		log.Panicf("no signer certificate")
+	}
+
+	certificates := make([]*x509.Certificate, len(cs.Certificates))
+	for i, der := range cs.Certificates {
+		certificates[i], err = x509.ParseCertificate(der)
+		log.PanicIf(err)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, certificate := range certificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+
+	options := x509.VerifyOptions{
+		Roots:         xcsv.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   xcsv.CurrentTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+
+	_, err = certificates[0].Verify(options)
+	log.PanicIf(err)
+
+	var hashType crypto.Hash
+	var isPss bool
+
+	switch cs.Algorithm {
+	case CoseAlgorithmEs256:
+		hashType = crypto.SHA256
+	case CoseAlgorithmEs384:
+		hashType = crypto.SHA384
+	case CoseAlgorithmEs512:
+		hashType = crypto.SHA512
+	case CoseAlgorithmPs256:
+		hashType, isPss = crypto.SHA256, true
+	case CoseAlgorithmPs384:
+		hashType, isPss = crypto.SHA384, true
+	case CoseAlgorithmPs512:
+		hashType, isPss = crypto.SHA512, true
+	default:
+		log.Panicf("signature algorithm not supported: (%d)", cs.Algorithm)
+	}
+
+	h := hashType.New()
+	h.Write(cs.SignedData)
+	digest := h.Sum(nil)
+
+	switch publicKey := certificates[0].PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		// COSE has the two integers concatenated rather than in DER.
+		if isPss == true || len(cs.Signature) == 0 || len(cs.Signature)%2 != 0 {
+			log.Panicf("ECDSA signature not valid")
+		}
+
+		half := len(cs.Signature) / 2
+		r := new(big.Int).SetBytes(cs.Signature[:half])
+		s := new(big.Int).SetBytes(cs.Signature[half:])
+
+		if ecdsa.Verify(publicKey, digest, r, s) == false {
+			log.Panicf("ECDSA signature not correct")
+		}
+	case *rsa.PublicKey:
+		if isPss == false {
+			log.Panicf("RSA signature must be PSS")
+		}
+
+		options := &rsa.PSSOptions{
+			SaltLength: rsa.PSSSaltLengthEqualsHash,
+		}
+
+		err := rsa.VerifyPSS(publicKey, hashType, digest, cs.Signature, options)
+		log.PanicIf(err)
+	default:
+		log.Panicf("signer key not supported: %T", publicKey)
+	}
+
+	return nil
+}
+
+// C2paVerification is the result of verifying the active manifest against
+// the image.
+type C2paVerification struct {
+	// Manifest is the label of the active manifest.
+	Manifest string
+
+	// Algorithm is the hash algorithm of the data-hash.
+	Algorithm string
+
+	// Exclusions are the ranges that the data-hash doesn't cover.
+	Exclusions []C2paExclusion
+
+	// ExpectedHash is the data-hash from the assertion.
+	ExpectedHash []byte
+
+	// ActualHash is the hash of the image as it would be written, or nil if
+	// the exclusions don't fit in it.
+	ActualHash []byte
+
+	// IsHashValid is true if the hashes match, which means that nothing
+	// outside of the exclusions was changed after signing.
+	IsHashValid bool
+
+	// ExclusionsCoverManifest is true if the exclusions are exactly the APP11
+	// segments of the manifest store. If they aren't, the manifest moved
+	// (something before it changed size) or other data is unprotected.
+	ExclusionsCoverManifest bool
+
+	// IsAssertionBound is true if the hash of the data-hash assertion matches
+	// the one in the claim.
+	IsAssertionBound bool
+
+	// IsSignatureChecked is true if a verifier was given.
+	IsSignatureChecked bool
+
+	// SignatureError is why the signature was not accepted, if it wasn't.
+	SignatureError error
+}
+
+// IsBindingValid returns true if the image is unchanged, the exclusions cover
+// only the manifest store, and the data-hash is bound to the claim. Exclusions
+// that reach anything else would leave it unprotected, so the hash alone isn't
+// enough. This says nothing about who signed the claim.
+func (cv *C2paVerification) IsBindingValid() bool {
+	return cv.IsHashValid == true && cv.ExclusionsCoverManifest == true && cv.IsAssertionBound == true
+}
+
+// IsValid returns true if the binding is valid (see `IsBindingValid`) and the
+// claim signature was checked and accepted. It's always false if no verifier
+// was given, since anyone could have made the claim.
+func (cv *C2paVerification) IsValid() bool {
+	return cv.IsBindingValid() == true && cv.IsSignatureChecked == true && cv.SignatureError == nil
+}
+
+// String returns a descriptive string.
+func (cv *C2paVerification) String() string {
+	return fmt.Sprintf("C2paVerification<MANIFEST=[%s] HASH-VALID=[%v] COVERS-MANIFEST=[%v] ASSERTION-BOUND=[%v] SIGNATURE-CHECKED=[%v] SIGNATURE-ERROR=[%v]>", cv.Manifest, cv.IsHashValid, cv.ExclusionsCoverManifest, cv.IsAssertionBound, cv.IsSignatureChecked, cv.SignatureError)
+}
+
+// c2paHash returns a new hash for the C2PA algorithm name.
+func c2paHash(algorithm string) (h hash.Hash, err error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha384":
+		return sha512.New384(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+
+	return nil, fmt.Errorf("hash algorithm not supported: [%s]", algorithm)
+}
+
+// c2paDigest returns the digest of the data.
+func c2paDigest(algorithm string, data []byte) (digest []byte, err error) {
+	h, err := c2paHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	h.Write(data)
+
+	return h.Sum(nil), nil
+}
+
+// resolveC2paUri returns the box that a URI refers to. Relative URIs are
+// relative to the manifest, and absolute ones start with the label of the
+// store.
+func resolveC2paUri(store, manifest *JumbfBox, uri string) (box *JumbfBox, found bool) {
+	if strings.HasPrefix(uri, c2paJumbfUriPrefix) == false {
+		return nil, false
+	}
+
+	path := uri[len(c2paJumbfUriPrefix):]
+
+	if strings.HasPrefix(path, "/") == true {
+		parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+		if len(parts) != 2 || parts[0] != store.Label() {
+			return nil, false
+		}
+
+		return store.Find(parts[1])
+	}
+
+	return manifest.Find(path)
+}
+
+// c2paCborContent decodes the CBOR content box of a superbox.
+func c2paCborContent(jb *JumbfBox) (value interface{}, raw []byte, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	content, found := jb.Content()
+	if found == false || content.Type != JumbfBoxTypeCbor {
+		log.Panicf("box [%s] has no CBOR content", jb.Label())
+	}
+
+	value, err = decodeCbor(content.Payload)
+	log.PanicIf(err)
+
+	return value, content.Payload, nil
+}
+
+// cborMapValue returns the value for a text key.
+func cborMapValue(m map[interface{}]interface{}, key string) interface{} {
+	return m[key]
+}
+
+// c2paHashData finds and decodes the data-hash assertion of the manifest.
+func c2paHashData(manifest *JumbfBox) (assertion *JumbfBox, exclusions []C2paExclusion, algorithm string, expected []byte, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	for _, child := range manifest.Children {
+		if child.ContentType() != JumbfContentTypeC2paAssertionStore {
+			continue
+		}
+
+		for _, candidate := range child.Children {
+			label := candidate.Label()
+			if label == c2paHashDataLabel || strings.HasPrefix(label, c2paHashDataLabel+"__") == true {
+				assertion = candidate
+				break
+			}
+		}
+	}
+
+	if assertion == nil {
+		return nil, nil, "", nil, ErrNoC2paHardBinding
+	}
+
+	value, _, err := c2paCborContent(assertion)
+	log.PanicIf(err)
+
+	m, ok := value.(map[interface{}]interface{})
+	if ok == false {
+		log.Panicf("data-hash assertion is not a map")
+	}
+
+	expected, ok = cborMapValue(m, "hash").([]byte)
+	if ok == false {
+		log.Panicf("data-hash assertion has no hash")
+	}
+
+	if alg, ok := cborMapValue(m, "alg").(string); ok == true {
+		algorithm = alg
+	}
+
+	exclusions = make([]C2paExclusion, 0)
+
+	if rawExclusions, found := m["exclusions"]; found == true {
+		array, ok := rawExclusions.([]interface{})
+		if ok == false {
+			log.Panicf("data-hash exclusions are not an array")
+		}
+
+		for _, item := range array {
+			em, ok := item.(map[interface{}]interface{})
+			if ok == false {
+				log.Panicf("data-hash exclusion is not a map")
+			}
+
+			start, ok1 := cborInt(cborMapValue(em, "start"))
+			length, ok2 := cborInt(cborMapValue(em, "length"))
+
+			if ok1 == false || ok2 == false || start < 0 || length < 0 {
+				log.Panicf("data-hash exclusion not valid: %v", em)
+			}
+
+			exclusions = append(exclusions, C2paExclusion{Start: int(start), Length: int(length)})
+		}
+	}
+
+	sort.Slice(exclusions, func(i, j int) bool {
+		return exclusions[i].Start < exclusions[j].Start
+	})
+
+	return assertion, exclusions, algorithm, expected, nil
+}
+
+// hashWithExclusions hashes everything outside of the (sorted) exclusions. It
+// returns nil if they overlap or don't fit in the data.
+func hashWithExclusions(algorithm string, data []byte, exclusions []C2paExclusion) (digest []byte, err error) {
+	h, err := c2paHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	position := 0
+
+	for _, ce := range exclusions {
+		if ce.Start < position || ce.Start+ce.Length > len(data) {
+			return nil, nil
+		}
+
+		h.Write(data[position:ce.Start])
+		position = ce.Start + ce.Length
+	}
+
+	h.Write(data[position:])
+
+	return h.Sum(nil), nil
+}
+
+// mergeC2paExclusions joins ranges that touch.
+func mergeC2paExclusions(exclusions []C2paExclusion) (merged []C2paExclusion) {
+	merged = make([]C2paExclusion, 0, len(exclusions))
+
+	for _, ce := range exclusions {
+		if ce.Length == 0 {
+			continue
+		}
+
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			if last.Start+last.Length == ce.Start {
+				last.Length += ce.Length
+				continue
+			}
+		}
+
+		merged = append(merged, ce)
+	}
+
+	return merged
+}
+
+// jumbfSegmentRanges returns the ranges of the file taken by the APP11
+// segments of the given box instance, markers included.
+func (sl *SegmentList) jumbfSegmentRanges(instance uint16) (ranges []C2paExclusion) {
+	offsets, _ := sl.encodedOffsets()
+
+	ranges = make([]C2paExclusion, 0)
+
+	for i, s := range sl.segments {
+		if s.IsJumbf() == false || s.Data[2] != byte(instance>>8) || s.Data[3] != byte(instance) {
+			continue
+		}
+
+		ce := C2paExclusion{
+			Start:  offsets[i],
+			Length: 4 + len(s.Data),
+		}
+
+		ranges = append(ranges, ce)
+	}
+
+	return mergeC2paExclusions(ranges)
+}
+
+// c2paSignature returns the signature of the claim, ready to verify.
+func c2paSignature(signatureBox *JumbfBox, claim []byte) (cs *C2paSignature, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	value, _, err := c2paCborContent(signatureBox)
+	log.PanicIf(err)
+
+	array, ok := cborUntag(value, coseSign1Tag).([]interface{})
+	if ok == false || len(array) != 4 {
+		log.Panicf("claim signature is not a COSE_Sign1 structure")
+	}
+
+	protected, ok1 := array[0].([]byte)
+	unprotected, ok2 := array[1].(map[interface{}]interface{})
+	signature, ok3 := array[3].([]byte)
+
+	if ok1 == false || ok2 == false || ok3 == false {
+		log.Panicf("COSE_Sign1 structure not valid")
+	}
+
+	protectedHeaders := make(map[interface{}]interface{})
+
+	if len(protected) > 0 {
+		decoded, err := decodeCbor(protected)
+		log.PanicIf(err)
+
+		protectedHeaders, ok = decoded.(map[interface{}]interface{})
+		if ok == false {
+			log.Panicf("COSE protected headers are not a map")
+		}
+	}
+
+	cs = &C2paSignature{
+		Signature: signature,
+	}
+
+	algorithm, found := protectedHeaders[uint64(coseHeaderAlgorithm)]
+	if found == false {
+		log.Panicf("COSE signature has no algorithm")
+	}
+
+	cs.Algorithm, ok = cborInt(algorithm)
+	if ok == false {
+		log.Panicf("COSE algorithm not supported: %v", algorithm)
+	}
+
+	// Older manifests used a text label for the chain in the unprotected
+	// headers.
+	var chain interface{}
+	for _, headers := range []map[interface{}]interface{}{protectedHeaders, unprotected} {
+		for _, label := range []interface{}{uint64(coseHeaderX5Chain), "x5chain"} {
+			if value, found := headers[label]; found == true && chain == nil {
+				chain = value
+			}
+		}
+	}
+
+	switch c := chain.(type) {
+	case []byte:
+		cs.Certificates = [][]byte{c}
+	case []interface{}:
+		for _, item := range c {
+			der, ok := item.([]byte)
+			if ok == false {
+				log.Panicf("COSE certificate not valid")
+			}
+
+			cs.Certificates = append(cs.Certificates, der)
+		}
+	}
+
+	// The claim is the detached payload.
+
+	sigStructure := []interface{}{
+		"Signature1",
+		protected,
+		[]byte{},
+		claim,
+	}
+
+	cs.SignedData, err = encodeCbor(sigStructure)
+	log.PanicIf(err)
+
+	return cs, nil
+}
+
+// VerifyC2pa verifies the hard binding of the active C2PA manifest to the
+// image as it would be written now: the data-hash is computed over the bytes
+// outside of the exclusions, and the assertion is checked against the claim.
+// If a verifier is given, it's used to check the claim signature. `ErrNoC2pa`
+// is returned if there's no manifest store and `ErrNoC2paHardBinding` if the
+// manifest has no data-hash.
+func (sl *SegmentList) VerifyC2pa(verifier C2paSignatureVerifier) (cv *C2paVerification, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	store, _, instance, err := sl.c2paManifestStore()
+	if err != nil {
+		if err == ErrNoC2pa {
+			return nil, err
+		}
+
+		log.Panic(err)
+	}
+
+	manifests := store.C2paManifests()
+	if len(manifests) == 0 {
+		log.Panicf("manifest store has no manifests")
+	}
+
+	manifest := manifests[len(manifests)-1]
+
+	cv = &C2paVerification{
+		Manifest: manifest.Label(),
+	}
+
+	// Find the claim.
+
+	var claimBox *JumbfBox
+	for _, child := range manifest.Children {
+		if child.ContentType() == JumbfContentTypeC2paClaim {
+			claimBox = child
+			break
+		}
+	}
+
+	if claimBox == nil {
+		log.Panicf("manifest has no claim")
+	}
+
+	value, claim, err := c2paCborContent(claimBox)
+	log.PanicIf(err)
+
+	claimMap, ok := value.(map[interface{}]interface{})
+	if ok == false {
+		log.Panicf("claim is not a map")
+	}
+
+	claimAlgorithm := c2paDefaultAlgorithm
+	if alg, ok := cborMapValue(claimMap, "alg").(string); ok == true {
+		claimAlgorithm = alg
+	}
+
+	// Check the data-hash.
+
+	assertion, exclusions, algorithm, expected, err := c2paHashData(manifest)
+	if err != nil {
+		if err == ErrNoC2paHardBinding {
+			return nil, err
+		}
+
+		log.Panic(err)
+	}
+
+	if algorithm == "" {
+		algorithm = claimAlgorithm
+	}
+
+	cv.Algorithm = algorithm
+	cv.Exclusions = exclusions
+	cv.ExpectedHash = expected
+
+	b := new(bytes.Buffer)
+
+	err = sl.Write(b)
+	log.PanicIf(err)
+
+	cv.ActualHash, err = hashWithExclusions(algorithm, b.Bytes(), exclusions)
+	log.PanicIf(err)
+
+	cv.IsHashValid = cv.ActualHash != nil && bytes.Equal(cv.ActualHash, expected) == true
+
+	ranges := sl.jumbfSegmentRanges(instance)
+	merged := mergeC2paExclusions(exclusions)
+
+	cv.ExclusionsCoverManifest = len(ranges) == len(merged)
+	for i := 0; cv.ExclusionsCoverManifest == true && i < len(ranges); i++ {
+		cv.ExclusionsCoverManifest = ranges[i] == merged[i]
+	}
+
+	// Check that the claim refers to this assertion.
+
+	for _, key := range []string{"assertions", "created_assertions", "gathered_assertions"} {
+		references, _ := cborMapValue(claimMap, key).([]interface{})
+
+		for _, reference := range references {
+			rm, ok := reference.(map[interface{}]interface{})
+			if ok == false {
+				continue
+			}
+
+			uri, _ := cborMapValue(rm, "url").(string)
+			referenced, found := resolveC2paUri(store, manifest, uri)
+			if found == false || referenced != assertion {
+				continue
+			}
+
+			referenceAlgorithm := claimAlgorithm
+			if alg, ok := cborMapValue(rm, "alg").(string); ok == true {
+				referenceAlgorithm = alg
+			}
+
+			digest, err := c2paDigest(referenceAlgorithm, assertion.contents)
+			log.PanicIf(err)
+
+			referenceHash, _ := cborMapValue(rm, "hash").([]byte)
+			cv.IsAssertionBound = bytes.Equal(digest, referenceHash)
+		}
+	}
+
+	// Check the signature.
+
+	if verifier != nil {
+		cv.IsSignatureChecked = true
+
+		signatureUri, _ := cborMapValue(claimMap, "signature").(string)
+
+		signatureBox, found := resolveC2paUri(store, manifest, signatureUri)
+		if found == false {
+			cv.SignatureError = fmt.Errorf("claim signature not found: [%s]", signatureUri)
+			return cv, nil
+		}
+
+		cs, err := c2paSignature(signatureBox, claim)
+		if err != nil {
+			cv.SignatureError = err
+			return cv, nil
+		}
+
+		cv.SignatureError = verifier.VerifyC2paSignature(cs)
+	}
+
+	return cv, nil
+}
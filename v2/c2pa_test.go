@@ -0,0 +1,413 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+
+	"github.com/dsoprea/go-logging"
+)
+
+// getC2paTestSigner returns a self-signed signing certificate and its key.
+func getC2paTestSigner() (key *ecdsa.PrivateKey, certificate *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	log.PanicIf(err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test signer"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	log.PanicIf(err)
+
+	certificate, err = x509.ParseCertificate(der)
+	log.PanicIf(err)
+
+	return key, certificate
+}
+
+// getC2paTestSegmentList returns an image with a signed manifest store in
+// APP11 segments right after the SOI, whose data-hash excludes them.
+func getC2paTestSegmentList(key *ecdsa.PrivateKey, certificate *x509.Certificate) *SegmentList {
+	return getC2paTestSegmentListWithExclusions(key, certificate, false)
+}
+
+// getC2paTestSegmentListWithExclusions returns a signed image. If
+// `isImageExcluded` is true, the exclusions also cover everything from the
+// frame header to the EOI marker, which a valid manifest mustn't do.
+func getC2paTestSegmentListWithExclusions(key *ecdsa.PrivateKey, certificate *x509.Certificate, isImageExcluded bool) *SegmentList {
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(16, 16, false))
+
+	// The exclusion is at a fixed position so the hash of everything else is
+	// just the hash of the image without the store.
+
+	b := new(bytes.Buffer)
+
+	err := sl.Write(b)
+	log.PanicIf(err)
+
+	data := b.Bytes()
+	imageStart := 0
+
+	if isImageExcluded == true {
+		offsets, _ := sl.encodedOffsets()
+
+		for i, s := range sl.segments {
+			if isSofMarker(s.MarkerId) == true {
+				imageStart = offsets[i]
+				break
+			}
+		}
+
+		data = append(append([]byte{}, data[:imageStart]...), data[len(data)-2:]...)
+	}
+
+	imageHash := sha256.Sum256(data)
+
+	var segments []*Segment
+
+	for length, previous := 0, -1; length != previous; {
+		exclusions := []interface{}{
+			map[string]interface{}{
+				"start":  2,
+				"length": length,
+			},
+		}
+
+		if isImageExcluded == true {
+			exclusions = append(exclusions, map[string]interface{}{
+				"start":  length + imageStart,
+				"length": b.Len() - 2 - imageStart,
+			})
+		}
+
+		hashData := map[string]interface{}{
+			"alg":        "sha256",
+			"hash":       imageHash[:],
+			"name":       "jumbf manifest",
+			"exclusions": exclusions,
+		}
+
+		assertionCbor, err := encodeCbor(hashData)
+		log.PanicIf(err)
+
+		assertion := getJumbfTestSuperbox(
+			JumbfContentTypeCbor,
+			c2paHashDataLabel,
+			getJumbfTestBox(JumbfBoxTypeCbor, assertionCbor))
+
+		assertionHash := sha256.Sum256(assertion[jumbfBoxHeaderSize:])
+
+		claim := map[string]interface{}{
+			"alg":       "sha256",
+			"signature": "self#jumbf=c2pa.signature",
+			"assertions": []interface{}{
+				map[string]interface{}{
+					"url":  "self#jumbf=c2pa.assertions/c2pa.hash.data",
+					"hash": assertionHash[:],
+				},
+			},
+		}
+
+		claimCbor, err := encodeCbor(claim)
+		log.PanicIf(err)
+
+		// Protected headers: {1: ES256, 33: certificate}.
+		protected := []byte{0xa2, 0x01, 0x26, 0x18, coseHeaderX5Chain}
+		protected = appendCbor(protected, certificate.Raw)
+
+		sigStructure, err := encodeCbor([]interface{}{"Signature1", protected, []byte{}, claimCbor})
+		log.PanicIf(err)
+
+		digest := sha256.Sum256(sigStructure)
+
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		log.PanicIf(err)
+
+		signature := make([]byte, 64)
+		rBytes := r.Bytes()
+		sBytes := s.Bytes()
+		copy(signature[32-len(rBytes):], rBytes)
+		copy(signature[64-len(sBytes):], sBytes)
+
+		cose := appendCborHead(nil, cborMajorTag, coseSign1Tag)
+		cose = appendCborHead(cose, cborMajorArray, 4)
+		cose = appendCbor(cose, protected)
+		cose = append(cose, 0xa0, 0xf6)
+		cose = appendCbor(cose, signature)
+
+		manifest := getJumbfTestSuperbox(
+			JumbfContentTypeC2paManifest,
+			"urn:uuid:1234",
+			getJumbfTestSuperbox(JumbfContentTypeC2paAssertionStore, "c2pa.assertions", assertion),
+			getJumbfTestSuperbox(JumbfContentTypeC2paClaim, "c2pa.claim", getJumbfTestBox(JumbfBoxTypeCbor, claimCbor)),
+			getJumbfTestSuperbox(JumbfContentTypeC2paClaimSignature, "c2pa.signature", getJumbfTestBox(JumbfBoxTypeCbor, cose)))
+
+		store := getJumbfTestSuperbox(JumbfContentTypeC2paManifestStore, "c2pa", manifest)
+
+		segments = getJumbfTestSegments(1, store, 200)
+
+		previous = length
+		length = 0
+		for _, s := range segments {
+			length += 4 + len(s.Data)
+		}
+	}
+
+	inserted := append([]*Segment{sl.segments[0]}, segments...)
+	sl.segments = append(inserted, sl.segments[1:]...)
+
+	return sl
+}
+
+// capturingC2paSignatureVerifier records the signature and then defers to
+// another verifier.
+type capturingC2paSignatureVerifier struct {
+	signature *C2paSignature
+	verifier  C2paSignatureVerifier
+}
+
+func (ccsv *capturingC2paSignatureVerifier) VerifyC2paSignature(cs *C2paSignature) error {
+	ccsv.signature = cs
+	return ccsv.verifier.VerifyC2paSignature(cs)
+}
+
+func TestSegmentList_VerifyC2pa(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	key, certificate := getC2paTestSigner()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(certificate)
+
+	verifier := &capturingC2paSignatureVerifier{
+		verifier: &X509C2paSignatureVerifier{Roots: roots},
+	}
+
+	sl := getC2paTestSegmentList(key, certificate)
+	sl, _ = reparseSegmentList(sl)
+
+	cv, err := sl.VerifyC2pa(verifier)
+	log.PanicIf(err)
+
+	if cv.Manifest != "urn:uuid:1234" || cv.Algorithm != "sha256" {
+		t.Fatalf("Verification not correct: %s", cv)
+	} else if cv.IsHashValid != true || cv.ExclusionsCoverManifest != true || cv.IsAssertionBound != true {
+		t.Fatalf("Binding not valid: %s", cv)
+	} else if cv.IsSignatureChecked != true || cv.SignatureError != nil {
+		t.Fatalf("Signature not valid: %s", cv)
+	} else if cv.IsValid() != true {
+		t.Fatalf("Expected to be valid.")
+	}
+
+	cs := verifier.signature
+	if cs.Algorithm != CoseAlgorithmEs256 || len(cs.Certificates) != 1 || bytes.Equal(cs.Certificates[0], certificate.Raw) != true {
+		t.Fatalf("Signature not correct: (%d) (%d)", cs.Algorithm, len(cs.Certificates))
+	}
+
+	cs.Signature[10] ^= 0xff
+
+	if err := verifier.verifier.VerifyC2paSignature(cs); err == nil {
+		t.Fatalf("Expected a changed signature to be rejected.")
+	}
+
+	// Without a verifier, only the binding is checked, which isn't enough to
+	// be valid.
+
+	cv, err = sl.VerifyC2pa(nil)
+	log.PanicIf(err)
+
+	if cv.IsSignatureChecked != false || cv.IsBindingValid() != true || cv.IsValid() != false {
+		t.Fatalf("Unchecked verification not correct: %s", cv)
+	}
+}
+
+func TestSegmentList_VerifyC2pa_Edited(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	key, certificate := getC2paTestSigner()
+
+	// A comment goes after the APP11 segments, so the manifest stays where it
+	// was but the image changed.
+
+	sl := getC2paTestSegmentList(key, certificate)
+	sl.AddComment("edited")
+
+	cv, err := sl.VerifyC2pa(nil)
+	log.PanicIf(err)
+
+	if cv.IsHashValid != false || cv.ExclusionsCoverManifest != true || cv.IsAssertionBound != true {
+		t.Fatalf("Comment edit not detected correctly: %s", cv)
+	} else if cv.IsBindingValid() != false {
+		t.Fatalf("Expected to be invalid.")
+	}
+
+	// EXIF goes before them, so the manifest moved.
+
+	sl = getC2paTestSegmentList(key, certificate)
+
+	rootIb, err := sl.ConstructExifBuilder()
+	log.PanicIf(err)
+
+	err = sl.SetExif(rootIb)
+	log.PanicIf(err)
+
+	cv, err = sl.VerifyC2pa(nil)
+	log.PanicIf(err)
+
+	if cv.IsHashValid != false || cv.ExclusionsCoverManifest != false {
+		t.Fatalf("EXIF edit not detected correctly: %s", cv)
+	} else if cv.IsBindingValid() != false {
+		t.Fatalf("Expected to be invalid after the EXIF edit.")
+	}
+}
+
+func TestSegmentList_VerifyC2pa_ExclusionsTooWide(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	key, certificate := getC2paTestSigner()
+
+	sl := getC2paTestSegmentListWithExclusions(key, certificate, true)
+	sl, _ = reparseSegmentList(sl)
+
+	// Change the pixels. The hash still matches, since the scan data is
+	// excluded, but that's exactly what isn't allowed.
+
+	scanData := sl.segments[len(sl.segments)-2]
+	if scanData.MarkerId != 0 {
+		t.Fatalf("Expected scan data: [%s]", scanData.MarkerName)
+	}
+
+	scanData.Data[0] ^= 0x55
+
+	cv, err := sl.VerifyC2pa(nil)
+	log.PanicIf(err)
+
+	if cv.IsHashValid != true || cv.IsAssertionBound != true || len(cv.Exclusions) != 2 {
+		t.Fatalf("Verification not correct: %s", cv)
+	} else if cv.ExclusionsCoverManifest != false {
+		t.Fatalf("Expected the exclusions to reach outside the manifest.")
+	} else if cv.IsBindingValid() != false {
+		t.Fatalf("Expected to be invalid.")
+	}
+}
+
+func TestSegmentList_VerifyC2pa_Untrusted(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	key, certificate := getC2paTestSigner()
+	_, otherCertificate := getC2paTestSigner()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(otherCertificate)
+
+	verifier := &X509C2paSignatureVerifier{
+		Roots: roots,
+	}
+
+	sl := getC2paTestSegmentList(key, certificate)
+
+	cv, err := sl.VerifyC2pa(verifier)
+	log.PanicIf(err)
+
+	if cv.IsHashValid != true || cv.SignatureError == nil || cv.IsValid() != false {
+		t.Fatalf("Untrusted signer not detected: %s", cv)
+	}
+}
+
+func TestSegmentList_VerifyC2pa_Missing(t *testing.T) {
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(16, 16, false))
+
+	if _, err := sl.VerifyC2pa(nil); err != ErrNoC2pa {
+		t.Fatalf("Expected no C2PA: %v", err)
+	}
+
+	// The test store has a data-hash assertion but under a different label
+	// here.
+
+	store := getJumbfTestSuperbox(
+		JumbfContentTypeC2paManifestStore,
+		"c2pa",
+		getJumbfTestSuperbox(
+			JumbfContentTypeC2paManifest,
+			"urn:uuid:1234",
+			getJumbfTestSuperbox(JumbfContentTypeC2paAssertionStore, "c2pa.assertions"),
+			getJumbfTestSuperbox(JumbfContentTypeC2paClaim, "c2pa.claim", getJumbfTestBox(JumbfBoxTypeCbor, []byte{0xa0}))))
+
+	sl = getJumbfTestSegmentList(getJumbfTestSegments(1, store, 1000))
+
+	if _, err := sl.VerifyC2pa(nil); err != ErrNoC2paHardBinding {
+		t.Fatalf("Expected no hard binding: %v", err)
+	}
+}
+
+func TestHashWithExclusions(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	data := []byte("abcdefghij")
+
+	digest, err := hashWithExclusions("sha256", data, []C2paExclusion{{1, 2}, {5, 0}, {8, 2}})
+	log.PanicIf(err)
+
+	expected := sha256.Sum256([]byte("adefgh"))
+	if bytes.Equal(digest, expected[:]) != true {
+		t.Fatalf("Digest not correct.")
+	}
+
+	for _, exclusions := range [][]C2paExclusion{{{8, 3}}, {{1, 3}, {2, 1}}} {
+		digest, err := hashWithExclusions("sha256", data, exclusions)
+		log.PanicIf(err)
+
+		if digest != nil {
+			t.Fatalf("Expected no digest for exclusions: %v", exclusions)
+		}
+	}
+
+	if _, err := hashWithExclusions("md5", data, nil); err == nil {
+		t.Fatalf("Expected error for an unsupported algorithm.")
+	}
+}
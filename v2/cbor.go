@@ -0,0 +1,371 @@
+package jpegstructure
+
+import (
+	"math"
+	"sort"
+
+	"encoding/binary"
+
+	"github.com/dsoprea/go-logging"
+)
+
+// This is just enough CBOR (RFC 8949) to read C2PA assertions, claims, and
+// COSE signatures, and to encode the structure that COSE signs.
+
+const (
+	cborMajorUnsigned = 0
+	cborMajorNegative = 1
+	cborMajorBytes    = 2
+	cborMajorText     = 3
+	cborMajorArray    = 4
+	cborMajorMap      = 5
+	cborMajorTag      = 6
+	cborMajorSimple   = 7
+
+	// cborIndefinite is the additional information for an indefinite length.
+	cborIndefinite = 31
+)
+
+// cborTag is a tagged value.
+type cborTag struct {
+	Number  uint64
+	Content interface{}
+}
+
+// cborBreak marks the end of an indefinite-length item.
+type cborBreak struct{}
+
+// cborDecoder decodes items from a buffer.
+type cborDecoder struct {
+	data []byte
+}
+
+// decodeCbor decodes the single item that makes up the data. Unsigned integers
+// are uint64, negative integers are int64, byte strings are []byte, text
+// strings are string, arrays are []interface{}, maps are
+// map[interface{}]interface{}, and tags are cborTag.
+func decodeCbor(data []byte) (value interface{}, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	cd := &cborDecoder{
+		data: data,
+	}
+
+	value = cd.item(0)
+
+	if _, ok := value.(cborBreak); ok == true {
+		log.Panicf("unexpected CBOR break")
+	} else if len(cd.data) > 0 {
+		log.Panicf("extra data after CBOR item: (%d)", len(cd.data))
+	}
+
+	return value, nil
+}
+
+// take returns the next `n` bytes.
+func (cd *cborDecoder) take(n uint64) []byte {
+	if n > uint64(len(cd.data)) {
+		log.Panicf("CBOR data truncated: (%d) > (%d)", n, len(cd.data))
+	}
+
+	taken := cd.data[:n]
+	cd.data = cd.data[n:]
+
+	return taken
+}
+
+// head returns the major type and the argument of the next item.
+func (cd *cborDecoder) head() (major byte, info byte, argument uint64) {
+	initial := cd.take(1)[0]
+
+	major = initial >> 5
+	info = initial & 0x1f
+
+	switch {
+	case info < 24:
+		argument = uint64(info)
+	case info == 24:
+		argument = uint64(cd.take(1)[0])
+	case info == 25:
+		argument = uint64(binary.BigEndian.Uint16(cd.take(2)))
+	case info == 26:
+		argument = uint64(binary.BigEndian.Uint32(cd.take(4)))
+	case info == 27:
+		argument = binary.BigEndian.Uint64(cd.take(8))
+	case info == cborIndefinite:
+		if major == cborMajorUnsigned || major == cborMajorNegative || major == cborMajorTag {
+			log.Panicf("CBOR major type (%d) can't be indefinite", major)
+		}
+	default:
+		log.Panicf("CBOR additional information not valid: (%d)", info)
+	}
+
+	return major, info, argument
+}
+
+// item decodes the next item. The depth protects against nesting that would
+// exhaust the stack.
+func (cd *cborDecoder) item(depth int) interface{} {
+	if depth > 64 {
+		log.Panicf("CBOR nested too deeply")
+	}
+
+	major, info, argument := cd.head()
+
+	switch major {
+	case cborMajorUnsigned:
+		return argument
+	case cborMajorNegative:
+		if argument > math.MaxInt64 {
+			log.Panicf("CBOR negative integer too large")
+		}
+
+		return -1 - int64(argument)
+	case cborMajorBytes, cborMajorText:
+		var data []byte
+
+		if info == cborIndefinite {
+			data = make([]byte, 0)
+
+			for {
+				chunk := cd.item(depth + 1)
+				if _, ok := chunk.(cborBreak); ok == true {
+					break
+				}
+
+				switch c := chunk.(type) {
+				case []byte:
+					if major != cborMajorBytes {
+						log.Panicf("CBOR string chunk type not correct")
+					}
+
+					data = append(data, c...)
+				case string:
+					if major != cborMajorText {
+						log.Panicf("CBOR string chunk type not correct")
+					}
+
+					data = append(data, c...)
+				default:
+					log.Panicf("CBOR string chunk not valid: %v", chunk)
+				}
+			}
+		} else {
+			data = cd.take(argument)
+		}
+
+		if major == cborMajorText {
+			return string(data)
+		}
+
+		return data
+	case cborMajorArray:
+		array := make([]interface{}, 0)
+
+		for i := uint64(0); info == cborIndefinite || i < argument; i++ {
+			value := cd.item(depth + 1)
+			if _, ok := value.(cborBreak); ok == true {
+				if info != cborIndefinite {
+					log.Panicf("unexpected CBOR break")
+				}
+
+				break
+			}
+
+			array = append(array, value)
+		}
+
+		return array
+	case cborMajorMap:
+		m := make(map[interface{}]interface{})
+
+		for i := uint64(0); info == cborIndefinite || i < argument; i++ {
+			key := cd.item(depth + 1)
+			if _, ok := key.(cborBreak); ok == true {
+				if info != cborIndefinite {
+					log.Panicf("unexpected CBOR break")
+				}
+
+				break
+			}
+
+			switch key.(type) {
+			case uint64, int64, string, bool:
+			case []byte:
+				key = string(key.([]byte))
+			default:
+				log.Panicf("CBOR map key not supported: %v", key)
+			}
+
+			value := cd.item(depth + 1)
+			if _, ok := value.(cborBreak); ok == true {
+				log.Panicf("unexpected CBOR break")
+			}
+
+			m[key] = value
+		}
+
+		return m
+	case cborMajorTag:
+		return cborTag{
+			Number:  argument,
+			Content: cd.item(depth + 1),
+		}
+	}
+
+	// Simple values and floats.
+
+	switch info {
+	case 20:
+		return false
+	case 21:
+		return true
+	case 22, 23:
+		return nil
+	case 25:
+		return float64(float16ToFloat32(uint16(argument)))
+	case 26:
+		return float64(math.Float32frombits(uint32(argument)))
+	case 27:
+		return math.Float64frombits(argument)
+	case cborIndefinite:
+		return cborBreak{}
+	}
+
+	log.Panicf("CBOR simple value not supported: (%d)", argument)
+	return nil
+}
+
+// float16ToFloat32 converts a half-precision float.
+func float16ToFloat32(half uint16) float32 {
+	sign := uint32(half>>15) << 31
+	exponent := int(half>>10) & 0x1f
+	mantissa := uint32(half & 0x3ff)
+
+	switch exponent {
+	case 0:
+		// Subnormal (or zero).
+		value := float32(mantissa) / (1 << 24)
+		if sign != 0 {
+			value = -value
+		}
+
+		return value
+	case 0x1f:
+		return math.Float32frombits(sign | 0xff<<23 | mantissa<<13)
+	}
+
+	return math.Float32frombits(sign | uint32(exponent+127-15)<<23 | mantissa<<13)
+}
+
+// cborInt returns the value as a signed integer, if it's an integer that fits.
+func cborInt(value interface{}) (i int64, ok bool) {
+	switch v := value.(type) {
+	case uint64:
+		if v > math.MaxInt64 {
+			return 0, false
+		}
+
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+
+	return 0, false
+}
+
+// cborUntag returns the content of a tagged value with the given tag number,
+// or the value itself if it isn't tagged.
+func cborUntag(value interface{}, number uint64) interface{} {
+	if tag, ok := value.(cborTag); ok == true && tag.Number == number {
+		return tag.Content
+	}
+
+	return value
+}
+
+// appendCborHead appends the head of an item with the given major type and
+// argument, in the shortest form.
+func appendCborHead(data []byte, major byte, argument uint64) []byte {
+	initial := major << 5
+
+	switch {
+	case argument < 24:
+		return append(data, initial|byte(argument))
+	case argument <= math.MaxUint8:
+		return append(data, initial|24, byte(argument))
+	case argument <= math.MaxUint16:
+		data = append(data, initial|25, 0, 0)
+		binary.BigEndian.PutUint16(data[len(data)-2:], uint16(argument))
+	case argument <= math.MaxUint32:
+		data = append(data, initial|26, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(data[len(data)-4:], uint32(argument))
+	default:
+		data = append(data, initial|27, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(data[len(data)-8:], argument)
+	}
+
+	return data
+}
+
+// encodeCbor encodes integers, byte and text strings, arrays, and maps with
+// text keys (in sorted order).
+func encodeCbor(value interface{}) (data []byte, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	return appendCbor(nil, value), nil
+}
+
+func appendCbor(data []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case int:
+		return appendCbor(data, int64(v))
+	case int64:
+		if v < 0 {
+			return appendCborHead(data, cborMajorNegative, uint64(-1-v))
+		}
+
+		return appendCborHead(data, cborMajorUnsigned, uint64(v))
+	case uint64:
+		return appendCborHead(data, cborMajorUnsigned, v)
+	case []byte:
+		data = appendCborHead(data, cborMajorBytes, uint64(len(v)))
+		return append(data, v...)
+	case string:
+		data = appendCborHead(data, cborMajorText, uint64(len(v)))
+		return append(data, v...)
+	case []interface{}:
+		data = appendCborHead(data, cborMajorArray, uint64(len(v)))
+		for _, item := range v {
+			data = appendCbor(data, item)
+		}
+
+		return data
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		data = appendCborHead(data, cborMajorMap, uint64(len(v)))
+		for _, key := range keys {
+			data = appendCbor(data, key)
+			data = appendCbor(data, v[key])
+		}
+
+		return data
+	}
+
+	log.Panicf("CBOR type not supported: %T", value)
+	return nil
+}
@@ -0,0 +1,127 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/dsoprea/go-logging"
+)
+
+func TestDecodeCbor(t *testing.T) {
+	cases := []struct {
+		data  []byte
+		value interface{}
+	}{
+		{[]byte{0x00}, uint64(0)},
+		{[]byte{0x18, 0x64}, uint64(100)},
+		{[]byte{0x19, 0x03, 0xe8}, uint64(1000)},
+		{[]byte{0x1b, 0, 0, 0, 0xe8, 0xd4, 0xa5, 0x10, 0x00}, uint64(1000000000000)},
+		{[]byte{0x20}, int64(-1)},
+		{[]byte{0x38, 0x63}, int64(-100)},
+		{[]byte{0x43, 1, 2, 3}, []byte{1, 2, 3}},
+		{[]byte{0x64, 'I', 'E', 'T', 'F'}, "IETF"},
+		{[]byte{0x83, 0x01, 0x82, 0x02, 0x03, 0x04}, []interface{}{uint64(1), []interface{}{uint64(2), uint64(3)}, uint64(4)}},
+		{[]byte{0xa2, 0x61, 'a', 0x01, 0x02, 0x03}, map[interface{}]interface{}{"a": uint64(1), uint64(2): uint64(3)}},
+		{[]byte{0xd2, 0x80}, cborTag{Number: 18, Content: []interface{}{}}},
+		{[]byte{0xf4}, false},
+		{[]byte{0xf5}, true},
+		{[]byte{0xf6}, nil},
+		{[]byte{0xf9, 0x3c, 0x00}, float64(1)},
+		{[]byte{0xf9, 0xc4, 0x00}, float64(-4)},
+		{[]byte{0xf9, 0x00, 0x01}, float64(5.960464477539063e-8)},
+		{[]byte{0xfa, 0x47, 0xc3, 0x50, 0x00}, float64(100000)},
+		{[]byte{0xfb, 0x3f, 0xf1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a}, 1.1},
+
+		// Indefinite lengths.
+		{[]byte{0x5f, 0x42, 1, 2, 0x41, 3, 0xff}, []byte{1, 2, 3}},
+		{[]byte{0x7f, 0x62, 'a', 'b', 0x61, 'c', 0xff}, "abc"},
+		{[]byte{0x9f, 0x01, 0x02, 0xff}, []interface{}{uint64(1), uint64(2)}},
+		{[]byte{0xbf, 0x61, 'a', 0x01, 0xff}, map[interface{}]interface{}{"a": uint64(1)}},
+	}
+
+	for i, c := range cases {
+		value, err := decodeCbor(c.data)
+		if err != nil {
+			t.Fatalf("Case (%d) failed: %v", i, err)
+		} else if reflect.DeepEqual(value, c.value) != true {
+			t.Fatalf("Case (%d) not correct: %v (%T) != %v (%T)", i, value, value, c.value, c.value)
+		}
+	}
+
+	value, err := decodeCbor([]byte{0xf9, 0x7c, 0x00})
+	if err != nil {
+		t.Fatalf("Infinity failed: %v", err)
+	} else if math.IsInf(value.(float64), 1) != true {
+		t.Fatalf("Infinity not correct: %v", value)
+	}
+}
+
+func TestDecodeCbor_Invalid(t *testing.T) {
+	cases := [][]byte{
+		{},
+		{0x18},
+		{0x43, 1, 2},
+		{0x01, 0x02},
+		{0xff},
+		{0x82, 0x01, 0xff},
+		{0x1f},
+		{0x5f, 0x61, 'a', 0xff},
+		{0xa1, 0x80, 0x01},
+		bytes.Repeat([]byte{0x81}, 100),
+	}
+
+	for i, data := range cases {
+		if _, err := decodeCbor(data); err == nil {
+			t.Fatalf("Case (%d) expected an error: %x", i, data)
+		}
+	}
+}
+
+func TestEncodeCbor(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	value := []interface{}{
+		"Signature1",
+		[]byte{0xa1, 0x01, 0x26},
+		[]byte{},
+		map[string]interface{}{
+			"b": -500,
+			"a": uint64(70000),
+		},
+	}
+
+	data, err := encodeCbor(value)
+	log.PanicIf(err)
+
+	expected := []byte{
+		0x84,
+		0x6a, 'S', 'i', 'g', 'n', 'a', 't', 'u', 'r', 'e', '1',
+		0x43, 0xa1, 0x01, 0x26,
+		0x40,
+		0xa2, 0x61, 'a', 0x1a, 0x00, 0x01, 0x11, 0x70, 0x61, 'b', 0x39, 0x01, 0xf3,
+	}
+
+	if bytes.Equal(data, expected) != true {
+		t.Fatalf("Encoding not correct:\nACTUAL: %x\nEXPECTED: %x", data, expected)
+	}
+
+	decoded, err := decodeCbor(data)
+	log.PanicIf(err)
+
+	m := decoded.([]interface{})[3].(map[interface{}]interface{})
+	if m["a"] != uint64(70000) || m["b"] != int64(-500) {
+		t.Fatalf("Round-trip not correct: %v", m)
+	}
+
+	if _, err := encodeCbor(1.5); err == nil {
+		t.Fatalf("Expected error for an unsupported type.")
+	}
+}
@@ -0,0 +1,802 @@
+package jpegstructure
+
+import (
+	"fmt"
+
+	"encoding/binary"
+
+	"github.com/dsoprea/go-logging"
+)
+
+// CoefficientBlock is one 8x8 block of quantized DCT coefficients in natural
+// (row-major) order.
+type CoefficientBlock [64]int16
+
+// ComponentCoefficients holds the quantized DCT coefficients of one component.
+// The blocks cover the component padded out to a whole number of MCUs.
+type ComponentCoefficients struct {
+	// ComponentId is the ID of the component in the frame.
+	ComponentId byte
+
+	// BlocksWide is the number of block columns.
+	BlocksWide int
+
+	// BlocksHigh is the number of block rows.
+	BlocksHigh int
+
+	// Blocks are in row-major order.
+	Blocks []CoefficientBlock
+}
+
+func newComponentCoefficients(componentId byte, blocksWide, blocksHigh int) *ComponentCoefficients {
+	return &ComponentCoefficients{
+		ComponentId: componentId,
+		BlocksWide:  blocksWide,
+		BlocksHigh:  blocksHigh,
+		Blocks:      make([]CoefficientBlock, blocksWide*blocksHigh),
+	}
+}
+
+// Block returns the block at the given block column and row.
+func (cc *ComponentCoefficients) Block(column, row int) *CoefficientBlock {
+	return &cc.Blocks[row*cc.BlocksWide+column]
+}
+
+// Coefficients is the complete set of quantized DCT coefficients of an image
+// along with what's needed to interpret them.
+type Coefficients struct {
+	// Frame describes the image. Its dimensions and components must agree
+	// with `Components`.
+	Frame *SofSegment
+
+	// QuantizationTables are indexed by table ID. Only the tables referred to
+	// by the frame are required.
+	QuantizationTables [4]*QuantizationTable
+
+	// Components are in the same order as the frame's components.
+	Components []*ComponentCoefficients
+}
+
+// String returns a descriptive string.
+func (c *Coefficients) String() string {
+	return fmt.Sprintf("Coefficients<%s>", c.Frame)
+}
+
+// ReadCoefficients decodes every scan in the image and returns the quantized
+// DCT coefficients. Both sequential and progressive images are supported,
+// whether Huffman- or arithmetic-coded. An error is returned if any of the
+// scans can not be decoded or the scans do not code every coefficient.
+func (sl *SegmentList) ReadCoefficients() (coefficients *Coefficients, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	fh, sd, quantizationTables, err := sl.decodeScans()
+	log.PanicIf(err)
+
+	coefficients, err = decodedCoefficients(fh, sd, quantizationTables)
+	log.PanicIf(err)
+
+	return coefficients, nil
+}
+
+// decodedCoefficients returns the coefficients from a decoder that has
+// decoded every scan.
+func decodedCoefficients(fh *SofSegment, sd scanDecoder, quantizationTables [4]*QuantizationTable) (coefficients *Coefficients, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if fh.IsLossless() == true {
+		log.Panicf("lossless frames have no coefficients: [%s]", markerNames[fh.MarkerId])
+	}
+
+	for _, fc := range fh.Components {
+		if fc.QuantizationTableId > 3 || quantizationTables[fc.QuantizationTableId] == nil {
+			log.Panicf("quantization table (%d) not defined for component (%d)", fc.QuantizationTableId, fc.Id)
+		}
+	}
+
+	coefficients = &Coefficients{
+		Frame:              fh,
+		QuantizationTables: quantizationTables,
+		Components:         sd.coefficientPlanes(),
+	}
+
+	return coefficients, nil
+}
+
+// decodeScans decodes every scan in the image. The quantization tables are
+// the ones defined before the first scan. An error is returned if any of the
+// scans can not be decoded or the scans do not code everything.
+func (sl *SegmentList) decodeScans() (frame *SofSegment, sd scanDecoder, quantizationTables [4]*QuantizationTable, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	segments, err := sl.expandedSegments()
+	log.PanicIf(err)
+
+	var pendingTables []*HuffmanTable
+	var pendingConditioning []*ArithmeticConditioning
+	restartInterval := 0
+	scanCount := 0
+
+	for i, s := range segments {
+		switch {
+		case s.MarkerId == MARKER_DQT:
+			// Tables redefined after the first scan can't apply to the frame.
+			if scanCount > 0 {
+				continue
+			}
+
+			tables, err := ParseQuantizationTables(s.Data)
+			log.PanicIf(err)
+
+			for _, qt := range tables {
+				if qt.Id > 3 {
+					log.Panicf("quantization table ID not valid: (%d)", qt.Id)
+				}
+
+				quantizationTables[qt.Id] = qt
+			}
+		case s.MarkerId == MARKER_DHT:
+			tables, err := ParseHuffmanTables(s.Data)
+			log.PanicIf(err)
+
+			if sd == nil {
+				pendingTables = append(pendingTables, tables...)
+			} else {
+				err := sd.setHuffmanTables(tables)
+				log.PanicIf(err)
+			}
+		case s.MarkerId == MARKER_DAC:
+			conditioning, err := ParseArithmeticConditioning(s.Data)
+			log.PanicIf(err)
+
+			if sd == nil {
+				pendingConditioning = append(pendingConditioning, conditioning...)
+			} else {
+				err := sd.setArithmeticConditioning(conditioning)
+				log.PanicIf(err)
+			}
+		case s.MarkerId == MARKER_DRI:
+			interval, err := ParseRestartInterval(s.Data)
+			log.PanicIf(err)
+
+			restartInterval = interval
+
+			if sd != nil {
+				sd.setRestartInterval(interval)
+			}
+		case isSofMarker(s.MarkerId) == true:
+			if sd != nil {
+				log.Panicf("more than one SOF segment")
+			}
+
+			fh, err := ParseSofSegment(s.MarkerId, s.Data)
+			log.PanicIf(err)
+
+			sd, err = newScanDecoder(fh)
+			log.PanicIf(err)
+
+			sd.setRestartInterval(restartInterval)
+
+			err = sd.setHuffmanTables(pendingTables)
+			log.PanicIf(err)
+
+			err = sd.setArithmeticConditioning(pendingConditioning)
+			log.PanicIf(err)
+
+			frame = fh
+		case s.MarkerId == MARKER_SOS:
+			if sd == nil {
+				log.Panicf("SOS segment before any SOF segment")
+			}
+
+			sh, err := ParseScanHeader(s.Data)
+			log.PanicIf(err)
+
+			var entropyData []byte
+			if i+1 < len(segments) && segments[i+1].MarkerId == 0 {
+				entropyData = segments[i+1].Data
+			}
+
+			_, err = sd.decodeScan(sh, entropyData)
+			log.PanicIf(err)
+
+			scanCount++
+		}
+	}
+
+	if sd == nil {
+		log.Panicf("no SOF segment")
+	} else if scanCount == 0 {
+		log.Panicf("no SOS segment")
+	} else if ids := sd.incompleteComponents(); len(ids) > 0 {
+		log.Panicf("not all coefficients were coded for components %v", ids)
+	}
+
+	return frame, sd, quantizationTables, nil
+}
+
+// WriteCoefficientsOptions controls how `WriteCoefficients` encodes the image.
+type WriteCoefficientsOptions struct {
+	// OptimizeHuffman builds Huffman tables from the image's own statistics
+	// rather than using the standard tables. The tables are always optimized
+	// if the standard ones can't represent the coefficients.
+	OptimizeHuffman bool
+
+	// RestartInterval is the number of MCUs between restart markers. Zero
+	// disables restart markers.
+	RestartInterval int
+
+	// Progressive writes a progressive image rather than a sequential one.
+	// Scans of a single component only code the blocks that are in the image,
+	// so the blocks that just pad the MCUs lose their AC coefficients (as with
+	// jpegtran). This has no effect on the pixels.
+	Progressive bool
+
+	// Arithmetic uses arithmetic coding rather than Huffman coding. The
+	// Huffman options are ignored.
+	Arithmetic bool
+
+	// ArithmeticConditioning overrides the default conditioning of the
+	// arithmetic coder. It's written as a DAC segment.
+	ArithmeticConditioning []*ArithmeticConditioning
+
+	// ScanScript is the sequence of scans to use for a progressive image. The
+	// Huffman table IDs are assigned automatically. If empty,
+	// `DefaultScanScript` is used.
+	ScanScript []*ScanHeader
+}
+
+// checkCoefficients makes sure that the coefficients agree with the frame.
+func checkCoefficients(coefficients *Coefficients) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	fh := coefficients.Frame
+
+	if fh == nil {
+		log.Panicf("no frame header")
+	} else if fh.Width == 0 || fh.Height == 0 {
+		log.Panicf("frame dimensions not valid: (%d)x(%d)", fh.Width, fh.Height)
+	} else if fh.BitsPerSample != 8 && fh.BitsPerSample != 12 {
+		log.Panicf("sample precision not supported: (%d)", fh.BitsPerSample)
+	} else if len(fh.Components) == 0 || len(fh.Components) != len(coefficients.Components) {
+		log.Panicf("component count does not agree with frame: (%d) != (%d)", len(coefficients.Components), len(fh.Components))
+	}
+
+	for i, fc := range fh.Components {
+		if fc.HorizontalSampling < 1 || fc.HorizontalSampling > 4 || fc.VerticalSampling < 1 || fc.VerticalSampling > 4 {
+			log.Panicf("sampling factors not valid for component (%d): (%d)x(%d)", fc.Id, fc.HorizontalSampling, fc.VerticalSampling)
+		} else if fc.QuantizationTableId > 3 || coefficients.QuantizationTables[fc.QuantizationTableId] == nil {
+			log.Panicf("quantization table (%d) not defined for component (%d)", fc.QuantizationTableId, fc.Id)
+		}
+
+		cc := coefficients.Components[i]
+		columns, rows := fh.ComponentBlocks(i)
+
+		if cc.ComponentId != fc.Id {
+			log.Panicf("component (%d) does not agree with frame: (%d)", i, cc.ComponentId)
+		} else if cc.BlocksWide != columns || cc.BlocksHigh != rows || len(cc.Blocks) != columns*rows {
+			log.Panicf("block dimensions for component (%d) do not agree with frame: (%d)x(%d) != (%d)x(%d)", fc.Id, cc.BlocksWide, cc.BlocksHigh, columns, rows)
+		}
+	}
+
+	return nil
+}
+
+// sequentialScanHeaders returns the scans used to encode the image. All of
+// the components are interleaved if the MCU would be small enough.
+func sequentialScanHeaders(fh *SofSegment) []*ScanHeader {
+	scanComponent := func(i int, fc FrameComponent) ScanComponent {
+		// Like libjpeg, the first component gets the luminance tables and
+		// the others share the chrominance tables.
+		tableId := byte(0)
+		if i > 0 {
+			tableId = 1
+		}
+
+		return ScanComponent{
+			ComponentId: fc.Id,
+			DcTableId:   tableId,
+			AcTableId:   tableId,
+		}
+	}
+
+	blocks := 0
+	for _, fc := range fh.Components {
+		blocks += int(fc.HorizontalSampling) * int(fc.VerticalSampling)
+	}
+
+	if len(fh.Components) <= 4 && (len(fh.Components) == 1 || blocks <= maxBlocksPerMcu) {
+		sh := &ScanHeader{
+			Components:  make([]ScanComponent, len(fh.Components)),
+			SpectralEnd: 63,
+		}
+
+		for i, fc := range fh.Components {
+			sh.Components[i] = scanComponent(i, fc)
+		}
+
+		return []*ScanHeader{sh}
+	}
+
+	headers := make([]*ScanHeader, len(fh.Components))
+	for i, fc := range fh.Components {
+		headers[i] = &ScanHeader{
+			Components:  []ScanComponent{scanComponent(i, fc)},
+			SpectralEnd: 63,
+		}
+	}
+
+	return headers
+}
+
+// selectHuffmanTables returns the tables to use for each class and ID that
+// the statistics show as used.
+func selectHuffmanTables(hs *huffmanStatistics, optimize bool) (tables []*HuffmanTable) {
+	tables = make([]*HuffmanTable, 0)
+
+	for id := byte(0); id < 4; id++ {
+		for class := byte(0); class < 2; class++ {
+			frequencies := &hs.frequencies[class][id]
+
+			used := false
+			for _, count := range frequencies {
+				if count > 0 {
+					used = true
+					break
+				}
+			}
+
+			if used == false {
+				continue
+			}
+
+			if optimize == false {
+				var standard *HuffmanTable
+				for _, ht := range standardHuffmanTables {
+					if ht.Class == class && ht.Id == id {
+						standard = ht
+						break
+					}
+				}
+
+				if standard != nil {
+					het := newHuffmanEncoderTable(standard)
+
+					complete := true
+					for symbol, count := range frequencies {
+						if count > 0 && het[symbol].length == 0 {
+							complete = false
+							break
+						}
+					}
+
+					if complete == true {
+						tables = append(tables, standard)
+						continue
+					}
+				}
+			}
+
+			tables = append(tables, buildOptimalHuffmanTable(class, id, frequencies))
+		}
+	}
+
+	return tables
+}
+
+// progressiveScanHeaders returns the scans used to encode a progressive image.
+// The script is copied and the Huffman tables are assigned the same way as for
+// sequential images.
+func progressiveScanHeaders(fh *SofSegment, script []*ScanHeader) (headers []*ScanHeader, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if len(script) == 0 {
+		script = DefaultScanScript(fh)
+	}
+
+	err = CheckScanScript(fh, script)
+	log.PanicIf(err)
+
+	headers = make([]*ScanHeader, len(script))
+	for i, original := range script {
+		sh := *original
+		sh.Components = make([]ScanComponent, len(original.Components))
+
+		for j, sc := range original.Components {
+			tableId := byte(0)
+			if fh.ComponentIndex(sc.ComponentId) > 0 {
+				tableId = 1
+			}
+
+			sh.Components[j] = ScanComponent{
+				ComponentId: sc.ComponentId,
+				DcTableId:   tableId,
+				AcTableId:   tableId,
+			}
+		}
+
+		headers[i] = &sh
+	}
+
+	return headers, nil
+}
+
+// encodeHuffmanScans returns the SOS and entropy-coded segments of the
+// Huffman-coded scans, along with the tables to write with the frame. Any
+// other tables are written in front of the scans that use them.
+func encodeHuffmanScans(se *scanEncoder, headers []*ScanHeader, options *WriteCoefficientsOptions) (scanSegments []*Segment, headerTables []*HuffmanTable, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	// Sequential images share one set of tables. Progressive images get a set
+	// for each scan, since the statistics of each scan are very different.
+
+	scanTables := make([][]*HuffmanTable, len(headers))
+
+	if options.Progressive == true {
+		for i, sh := range headers {
+			hs := new(huffmanStatistics)
+
+			err := se.walkScan(sh, hs)
+			log.PanicIf(err)
+
+			scanTables[i] = selectHuffmanTables(hs, options.OptimizeHuffman)
+		}
+	} else {
+		hs := new(huffmanStatistics)
+		for _, sh := range headers {
+			err := se.walkScan(sh, hs)
+			log.PanicIf(err)
+		}
+
+		scanTables[0] = selectHuffmanTables(hs, options.OptimizeHuffman)
+	}
+
+	hsw := &huffmanScanWriter{}
+
+	scanSegments = make([]*Segment, 0, len(headers)*3)
+	for i, sh := range headers {
+		for _, ht := range scanTables[i] {
+			hsw.tables[ht.Class][ht.Id] = newHuffmanEncoderTable(ht)
+		}
+
+		// The tables for the first scan are written with the frame.
+		if i > 0 && len(scanTables[i]) > 0 {
+			s := &Segment{
+				MarkerId:   MARKER_DHT,
+				MarkerName: markerNames[MARKER_DHT],
+				Data:       EncodeHuffmanTables(scanTables[i]),
+			}
+
+			scanSegments = append(scanSegments, s)
+		}
+
+		hsw.ew = newEntropyWriter()
+
+		err := se.walkScan(sh, hsw)
+		log.PanicIf(err)
+
+		hsw.ew.flush()
+
+		scanSegments = append(
+			scanSegments,
+			&Segment{
+				MarkerId:   MARKER_SOS,
+				MarkerName: markerNames[MARKER_SOS],
+				Data:       sh.Encode(),
+			},
+			&Segment{
+				MarkerId:   0,
+				MarkerName: scanDataMarkerName,
+				Data:       hsw.ew.b.Bytes(),
+			})
+	}
+
+	return scanSegments, scanTables[0], nil
+}
+
+// encodeArithmeticScans returns the SOS and entropy-coded segments of the
+// arithmetic-coded scans.
+func encodeArithmeticScans(se *scanEncoder, headers []*ScanHeader, conditioning *arithmeticConditioning) (scanSegments []*Segment, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	scanSegments = make([]*Segment, 0, len(headers)*2)
+	for _, sh := range headers {
+		data, err := se.encodeArithmeticScan(sh, conditioning)
+		log.PanicIf(err)
+
+		scanSegments = append(
+			scanSegments,
+			&Segment{
+				MarkerId:   MARKER_SOS,
+				MarkerName: markerNames[MARKER_SOS],
+				Data:       sh.Encode(),
+			},
+			&Segment{
+				MarkerId:   0,
+				MarkerName: scanDataMarkerName,
+				Data:       data,
+			})
+	}
+
+	return scanSegments, nil
+}
+
+// WriteCoefficients encodes the given coefficients as a single-frame image,
+// either sequential (baseline, if the precision allows) or progressive and
+// either Huffman- or arithmetic-coded, and replaces the existing tables, frame
+// and scans with the result. All other segments are kept. The coefficients
+// must agree with their frame (see `ReadCoefficients`).
+func (sl *SegmentList) WriteCoefficients(coefficients *Coefficients, options *WriteCoefficientsOptions) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if options == nil {
+		options = new(WriteCoefficientsOptions)
+	}
+
+	if options.RestartInterval < 0 || options.RestartInterval > 0xffff {
+		log.Panicf("restart interval not valid: (%d)", options.RestartInterval)
+	}
+
+	// Make sure that the conditioning would parse.
+	_, err = ParseArithmeticConditioning(EncodeArithmeticConditioning(options.ArithmeticConditioning))
+	log.PanicIf(err)
+
+	err = checkCoefficients(coefficients)
+	log.PanicIf(err)
+
+	fh := *coefficients.Frame
+	fh.Components = make([]FrameComponent, len(coefficients.Frame.Components))
+	copy(fh.Components, coefficients.Frame.Components)
+
+	// Find the quantization tables that are actually used.
+
+	quantizationTables := make([]*QuantizationTable, 0)
+	isExtended := fh.BitsPerSample != 8
+
+	for id, qt := range coefficients.QuantizationTables {
+		if qt == nil {
+			continue
+		}
+
+		used := false
+		for _, fc := range fh.Components {
+			if int(fc.QuantizationTableId) == id {
+				used = true
+				break
+			}
+		}
+
+		if used == false {
+			continue
+		}
+
+		qt := *qt
+		qt.Id = byte(id)
+
+		for _, value := range qt.Values {
+			if value > 0xff {
+				qt.Precision = 1
+			}
+		}
+
+		if qt.Precision != 0 {
+			isExtended = true
+		}
+
+		quantizationTables = append(quantizationTables, &qt)
+	}
+
+	if isExtended == true {
+		fh.MarkerId = MARKER_SOF1
+	} else {
+		fh.MarkerId = MARKER_SOF0
+	}
+
+	var headers []*ScanHeader
+
+	if options.Progressive == true {
+		fh.MarkerId = MARKER_SOF2
+
+		headers, err = progressiveScanHeaders(&fh, options.ScanScript)
+		log.PanicIf(err)
+	} else {
+		headers = sequentialScanHeaders(&fh)
+	}
+
+	if options.Arithmetic == true {
+		if options.Progressive == true {
+			fh.MarkerId = MARKER_SOF10
+		} else {
+			fh.MarkerId = MARKER_SOF9
+		}
+	}
+
+	se := newScanEncoder(&fh, coefficients.Components, options.RestartInterval)
+
+	var scanSegments []*Segment
+	var huffmanTables []*HuffmanTable
+
+	if options.Arithmetic == true {
+		conditioning := newArithmeticConditioning()
+		conditioning.set(options.ArithmeticConditioning)
+
+		scanSegments, err = encodeArithmeticScans(se, headers, conditioning)
+		log.PanicIf(err)
+	} else {
+		scanSegments, huffmanTables, err = encodeHuffmanScans(se, headers, options)
+		log.PanicIf(err)
+	}
+
+	scanData, err := joinScanData(scanSegments)
+	log.PanicIf(err)
+
+	tableSegments := []*Segment{
+		{
+			MarkerId:   MARKER_DQT,
+			MarkerName: markerNames[MARKER_DQT],
+			Data:       EncodeQuantizationTables(quantizationTables),
+		},
+		{
+			MarkerId:   fh.MarkerId,
+			MarkerName: markerNames[fh.MarkerId],
+			Data:       fh.Encode(),
+		},
+	}
+
+	if options.Arithmetic == true && len(options.ArithmeticConditioning) > 0 {
+		s := &Segment{
+			MarkerId:   MARKER_DAC,
+			MarkerName: markerNames[MARKER_DAC],
+			Data:       EncodeArithmeticConditioning(options.ArithmeticConditioning),
+		}
+
+		tableSegments = append(tableSegments, s)
+	}
+
+	if len(huffmanTables) > 0 {
+		s := &Segment{
+			MarkerId:   MARKER_DHT,
+			MarkerName: markerNames[MARKER_DHT],
+			Data:       EncodeHuffmanTables(huffmanTables),
+		}
+
+		tableSegments = append(tableSegments, s)
+	}
+
+	if options.RestartInterval > 0 {
+		data := make([]byte, 2)
+		binary.BigEndian.PutUint16(data, uint16(options.RestartInterval))
+
+		s := &Segment{
+			MarkerId:   MARKER_DRI,
+			MarkerName: markerNames[MARKER_DRI],
+			Data:       data,
+		}
+
+		tableSegments = append(tableSegments, s)
+	}
+
+	err = sl.replaceImageData(tableSegments, scanData)
+	log.PanicIf(err)
+
+	return nil
+}
+
+// Reencode losslessly re-encodes the image with the given options, such as to
+// optimize the Huffman tables or to convert between sequential and progressive
+// coding, in the manner of jpegtran. Only the tables, frame and scans are
+// replaced; all other segments are kept as they are.
+func (sl *SegmentList) Reencode(options *WriteCoefficientsOptions) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	coefficients, err := sl.ReadCoefficients()
+	log.PanicIf(err)
+
+	err = sl.WriteCoefficients(coefficients, options)
+	log.PanicIf(err)
+
+	return nil
+}
+
+// isImageDataSegment returns true for the segments that describe how the image
+// is coded.
+func isImageDataSegment(markerId byte) bool {
+	switch markerId {
+	case MARKER_DQT, MARKER_DHT, MARKER_DAC, MARKER_DRI, MARKER_DNL:
+		return true
+	}
+
+	return isSofMarker(markerId)
+}
+
+// replaceImageData replaces the tables, frame and scans with the given
+// segments and scan-data. The new image data is placed just before the EOI
+// segment.
+func (sl *SegmentList) replaceImageData(tableSegments []*Segment, scanData []byte) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	segments := make([]*Segment, 0, len(sl.segments))
+	insertAt := -1
+	hasImageData := false
+
+	for _, s := range sl.segments {
+		if s.MarkerId == MARKER_SOS || s.MarkerId == 0 || isImageDataSegment(s.MarkerId) == true {
+			hasImageData = true
+			continue
+		} else if s.MarkerId == MARKER_EOI && insertAt == -1 {
+			insertAt = len(segments)
+		}
+
+		segments = append(segments, s)
+	}
+
+	if hasImageData == false {
+		log.Panicf("no image data to replace")
+	}
+
+	imageSegments := append(
+		tableSegments,
+		&Segment{
+			MarkerId:   MARKER_SOS,
+			MarkerName: markerNames[MARKER_SOS],
+		},
+		&Segment{
+			MarkerId:   0,
+			MarkerName: scanDataMarkerName,
+			Data:       scanData,
+		})
+
+	if insertAt == -1 {
+		s := &Segment{
+			MarkerId:   MARKER_EOI,
+			MarkerName: markerNames[MARKER_EOI],
+		}
+
+		imageSegments = append(imageSegments, s)
+		insertAt = len(segments)
+	}
+
+	tail := append(imageSegments, segments[insertAt:]...)
+	sl.segments = append(segments[:insertAt], tail...)
+
+	return nil
+}
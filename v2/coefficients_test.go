@@ -0,0 +1,232 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"path"
+	"reflect"
+	"testing"
+
+	"image/jpeg"
+
+	"github.com/dsoprea/go-logging"
+)
+
+func getCoefficientsTestSegmentList(data []byte) *SegmentList {
+	jmp := NewJpegMediaParser()
+
+	intfc, err := jmp.ParseBytes(data)
+	log.PanicIf(err)
+
+	return intfc.(*SegmentList)
+}
+
+// reparseSegmentList writes the segments and parses them back.
+func reparseSegmentList(sl *SegmentList) (*SegmentList, []byte) {
+	b := new(bytes.Buffer)
+
+	err := sl.Write(b)
+	log.PanicIf(err)
+
+	data := b.Bytes()
+
+	return getCoefficientsTestSegmentList(data), data
+}
+
+func TestSegmentList_ReadCoefficients(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getValidationTestSegmentList()
+
+	coefficients, err := sl.ReadCoefficients()
+	log.PanicIf(err)
+
+	if coefficients.Frame.Width != 64 || coefficients.Frame.Height != 48 {
+		t.Fatalf("Frame not correct: %s", coefficients.Frame)
+	} else if len(coefficients.Components) != 3 {
+		t.Fatalf("Component count not correct: (%d)", len(coefficients.Components))
+	} else if coefficients.QuantizationTables[0] == nil || coefficients.QuantizationTables[1] == nil {
+		t.Fatalf("Quantization tables not read.")
+	}
+
+	// Luminance is 2x2 and chrominance is 1x1 in a 4:2:0 image.
+
+	expected := [][2]int{{8, 6}, {4, 3}, {4, 3}}
+	for i, cc := range coefficients.Components {
+		if cc.ComponentId != coefficients.Frame.Components[i].Id {
+			t.Fatalf("Component (%d) ID not correct: (%d)", i, cc.ComponentId)
+		} else if cc.BlocksWide != expected[i][0] || cc.BlocksHigh != expected[i][1] {
+			t.Fatalf("Component (%d) dimensions not correct: (%d)x(%d)", i, cc.BlocksWide, cc.BlocksHigh)
+		}
+	}
+
+	// The gradient has energy in the luminance.
+	if coefficients.Components[0].Block(7, 5)[0] == 0 {
+		t.Fatalf("Expected non-zero DC.")
+	}
+}
+
+func TestSegmentList_WriteCoefficients_RoundTrip(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	original := getTestGeneratedJpeg(61, 45, false)
+	sl := getCoefficientsTestSegmentList(original)
+
+	coefficients, err := sl.ReadCoefficients()
+	log.PanicIf(err)
+
+	err = sl.WriteCoefficients(coefficients, nil)
+	log.PanicIf(err)
+
+	sl, data := reparseSegmentList(sl)
+
+	recovered, err := sl.ReadCoefficients()
+	log.PanicIf(err)
+
+	if reflect.DeepEqual(recovered.Components, coefficients.Components) != true {
+		t.Fatalf("Coefficients not equal after round-trip.")
+	} else if recovered.Frame.MarkerId != MARKER_SOF0 {
+		t.Fatalf("Expected baseline frame: %s", recovered.Frame)
+	}
+
+	// Go's encoder uses the standard tables, so the result should be
+	// identical to what we started with.
+	if bytes.Equal(data, original) != true {
+		t.Fatalf("Encoded image not identical to original.")
+	}
+}
+
+func TestSegmentList_WriteCoefficients_Optimized(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	original := getTestGeneratedJpeg(100, 75, false)
+	sl := getCoefficientsTestSegmentList(original)
+
+	coefficients, err := sl.ReadCoefficients()
+	log.PanicIf(err)
+
+	options := &WriteCoefficientsOptions{
+		OptimizeHuffman: true,
+		RestartInterval: 5,
+	}
+
+	err = sl.WriteCoefficients(coefficients, options)
+	log.PanicIf(err)
+
+	sl, data := reparseSegmentList(sl)
+
+	if len(data) >= len(original) {
+		t.Fatalf("Expected optimized image to be smaller: (%d) >= (%d)", len(data), len(original))
+	}
+
+	report, err := sl.CheckScanData()
+	log.PanicIf(err)
+
+	if report.IsValid() != true || len(report.Findings) != 0 {
+		t.Fatalf("Scan-data not valid: %v", report.Findings)
+	} else if report.Scans[0].RestartMarkers != (7*5-1)/5 {
+		t.Fatalf("Restart count not correct: %s", report.Scans[0])
+	}
+
+	recovered, err := sl.ReadCoefficients()
+	log.PanicIf(err)
+
+	if reflect.DeepEqual(recovered.Components, coefficients.Components) != true {
+		t.Fatalf("Coefficients not equal after round-trip.")
+	}
+
+	// The pixels should be exactly the same.
+
+	originalImage, err := jpeg.Decode(bytes.NewReader(original))
+	log.PanicIf(err)
+
+	recoveredImage, err := jpeg.Decode(bytes.NewReader(data))
+	log.PanicIf(err)
+
+	if reflect.DeepEqual(originalImage, recoveredImage) != true {
+		t.Fatalf("Decoded images not equal.")
+	}
+}
+
+func TestSegmentList_WriteCoefficients_Asset(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	assetsPath := GetTestAssetsPath()
+	filepath := path.Join(assetsPath, "20180428_212314.jpg")
+
+	jmp := NewJpegMediaParser()
+
+	intfc, err := jmp.ParseFile(filepath)
+	log.PanicIf(err)
+
+	sl := intfc.(*SegmentList)
+
+	coefficients, err := sl.ReadCoefficients()
+	log.PanicIf(err)
+
+	options := &WriteCoefficientsOptions{
+		OptimizeHuffman: true,
+	}
+
+	err = sl.WriteCoefficients(coefficients, options)
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	// The metadata must survive.
+
+	_, _, err = sl.Exif()
+	log.PanicIf(err)
+
+	recovered, err := sl.ReadCoefficients()
+	log.PanicIf(err)
+
+	if reflect.DeepEqual(recovered.Components, coefficients.Components) != true {
+		t.Fatalf("Coefficients not equal after round-trip.")
+	}
+}
+
+func TestSegmentList_WriteCoefficients_Mismatch(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getValidationTestSegmentList()
+
+	coefficients, err := sl.ReadCoefficients()
+	log.PanicIf(err)
+
+	coefficients.Frame.Width = 200
+
+	err = sl.WriteCoefficients(coefficients, nil)
+	if err == nil {
+		t.Fatalf("Expected error for dimensions that disagree with the frame.")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/dsoprea/go-logging"
+	"github.com/jessevdk/go-flags"
+
+	"github.com/dsoprea/go-jpeg-image-structure/v2"
+)
+
+var (
+	options = &struct {
+		FirstFilepath  string `short:"a" long:"first-filepath" required:"true" description:"File-path of the original JPEG image"`
+		SecondFilepath string `short:"b" long:"second-filepath" required:"true" description:"File-path of the JPEG image to compare with"`
+		Json           bool   `short:"j" long:"json" description:"Print as JSON"`
+		Verbose        bool   `short:"v" long:"verbose" description:"Enable logging verbosity"`
+	}{}
+)
+
+type segmentResult struct {
+	Kind     string `json:"kind"`
+	Change   string `json:"change"`
+	OldIndex int    `json:"old_index"`
+	NewIndex int    `json:"new_index"`
+	OldSize  int    `json:"old_size"`
+	NewSize  int    `json:"new_size"`
+}
+
+type propertyResult struct {
+	Name     string `json:"name"`
+	Change   string `json:"change"`
+	OldValue string `json:"old_value"`
+	NewValue string `json:"new_value"`
+}
+
+type diffResult struct {
+	IsEqual             bool             `json:"is_equal"`
+	Segments            []segmentResult  `json:"segments"`
+	Exif                []propertyResult `json:"exif"`
+	Xmp                 []propertyResult `json:"xmp"`
+	Iptc                []propertyResult `json:"iptc"`
+	Icc                 []propertyResult `json:"icc"`
+	Quantization        []propertyResult `json:"quantization"`
+	IsScanDataIdentical bool             `json:"is_scan_data_identical"`
+	IsTrailerIdentical  bool             `json:"is_trailer_identical"`
+}
+
+func propertyResults(diffs []*jpegstructure.PropertyDiff) []propertyResult {
+	results := make([]propertyResult, len(diffs))
+	for i, pd := range diffs {
+		results[i] = propertyResult{
+			Name:     pd.Name,
+			Change:   string(pd.Change),
+			OldValue: pd.OldValue,
+			NewValue: pd.NewValue,
+		}
+	}
+
+	return results
+}
+
+func readSegmentList(filepath string) *jpegstructure.SegmentList {
+	data, err := ioutil.ReadFile(filepath)
+	log.PanicIf(err)
+
+	jmp := jpegstructure.NewJpegMediaParser()
+
+	intfc, err := jmp.ParseBytes(data)
+	log.PanicIf(err)
+
+	return intfc.(*jpegstructure.SegmentList)
+}
+
+func main() {
+	defer func() {
+		if errRaw := recover(); errRaw != nil {
+			err := errRaw.(error)
+			log.PrintError(err)
+
+			os.Exit(-2)
+		}
+	}()
+
+	_, err := flags.Parse(options)
+	if err != nil {
+		os.Exit(-1)
+	}
+
+	if options.Verbose == true {
+		scp := log.NewStaticConfigurationProvider()
+		scp.SetLevelName(log.LevelNameDebug)
+
+		log.LoadConfiguration(scp)
+
+		cla := log.NewConsoleLogAdapter()
+		log.AddAdapter("console", cla)
+	}
+
+	oldSl := readSegmentList(options.FirstFilepath)
+	newSl := readSegmentList(options.SecondFilepath)
+
+	jd, err := jpegstructure.DiffSegmentLists(oldSl, newSl)
+	log.PanicIf(err)
+
+	if options.Json == true {
+		result := diffResult{
+			IsEqual:             jd.IsEqual(),
+			Segments:            make([]segmentResult, len(jd.Segments)),
+			Exif:                propertyResults(jd.Exif),
+			Xmp:                 propertyResults(jd.Xmp),
+			Iptc:                propertyResults(jd.Iptc),
+			Icc:                 propertyResults(jd.Icc),
+			Quantization:        propertyResults(jd.Quantization),
+			IsScanDataIdentical: jd.IsScanDataIdentical,
+			IsTrailerIdentical:  jd.IsTrailerIdentical,
+		}
+
+		for i, sd := range jd.Segments {
+			result.Segments[i] = segmentResult{
+				Kind:     sd.Kind,
+				Change:   string(sd.Change),
+				OldIndex: sd.OldIndex,
+				NewIndex: sd.NewIndex,
+				OldSize:  sd.OldSize,
+				NewSize:  sd.NewSize,
+			}
+		}
+
+		raw, err := json.MarshalIndent(result, "", "  ")
+		log.PanicIf(err)
+
+		fmt.Println(string(raw))
+	} else {
+		fmt.Print(jd.Dump())
+	}
+
+	// Like diff(1), differences are reported with the exit status.
+	if jd.IsEqual() == false {
+		os.Exit(1)
+	}
+}
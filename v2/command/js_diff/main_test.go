@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	"github.com/dsoprea/go-logging"
+
+	"github.com/dsoprea/go-jpeg-image-structure/v2"
+)
+
+// getChangedFilepath writes a copy of the test image with a comment and
+// without the EXIF.
+func getChangedFilepath() string {
+	assetsPath := jpegstructure.GetTestAssetsPath()
+	imageFilepath := path.Join(assetsPath, "20180428_212314.jpg")
+
+	jmp := jpegstructure.NewJpegMediaParser()
+
+	intfc, err := jmp.ParseFile(imageFilepath)
+	log.PanicIf(err)
+
+	sl := intfc.(*jpegstructure.SegmentList)
+
+	_, err = sl.DropExif()
+	log.PanicIf(err)
+
+	sl.AddComment("changed")
+
+	f, err := ioutil.TempFile("", "")
+	log.PanicIf(err)
+
+	defer f.Close()
+
+	err = sl.Write(f)
+	log.PanicIf(err)
+
+	return f.Name()
+}
+
+func TestMain_Plain_Identical(t *testing.T) {
+	appFilepath := getAppFilepath()
+
+	assetsPath := jpegstructure.GetTestAssetsPath()
+	imageFilepath := path.Join(assetsPath, "20180428_212314.jpg")
+
+	cmd := exec.Command(
+		"go", "run", appFilepath,
+		"--first-filepath", imageFilepath,
+		"--second-filepath", imageFilepath)
+
+	b := new(bytes.Buffer)
+	cmd.Stdout = b
+	cmd.Stderr = b
+
+	err := cmd.Run()
+	actual := b.String()
+
+	if err != nil {
+		fmt.Printf(actual)
+		panic(err)
+	}
+
+	if actual != "Identical.\n" {
+		t.Fatalf("Output not expected: [%s]", actual)
+	}
+}
+
+func TestMain_Json_Changed(t *testing.T) {
+	appFilepath := getAppFilepath()
+
+	assetsPath := jpegstructure.GetTestAssetsPath()
+	imageFilepath := path.Join(assetsPath, "20180428_212314.jpg")
+
+	changedFilepath := getChangedFilepath()
+	defer os.Remove(changedFilepath)
+
+	cmd := exec.Command(
+		"go", "run", appFilepath,
+		"--json",
+		"--first-filepath", imageFilepath,
+		"--second-filepath", changedFilepath)
+
+	b := new(bytes.Buffer)
+	cmd.Stdout = b
+
+	err := cmd.Run()
+	raw := b.Bytes()
+
+	// The exit status of "go run" itself is (1) for any failure, so the output
+	// is what tells the difference.
+	if _, ok := err.(*exec.ExitError); ok == false {
+		fmt.Printf(string(raw))
+		t.Fatalf("Expected the command to report differences: %v", err)
+	}
+
+	result := make(map[string]interface{})
+
+	err = json.Unmarshal(raw, &result)
+	log.PanicIf(err)
+
+	if result["is_equal"] != false || result["is_scan_data_identical"] != true {
+		t.Fatalf("Result not correct: %s", raw)
+	}
+
+	segments := result["segments"].([]interface{})
+
+	kinds := make([]string, len(segments))
+	for i, segment := range segments {
+		sr := segment.(map[string]interface{})
+		kinds[i] = fmt.Sprintf("%s %s", sr["change"], sr["kind"])
+	}
+
+	expected := "removed APP1 [Exif],added COM"
+	if strings.Join(kinds, ",") != expected {
+		t.Fatalf("Segments not correct: %v", kinds)
+	}
+
+	if len(result["exif"].([]interface{})) == 0 {
+		t.Fatalf("Expected EXIF differences.")
+	}
+}
+
+func getAppFilepath() string {
+	moduleRootPath := jpegstructure.GetModuleRootPath()
+	return path.Join(moduleRootPath, "command", "js_diff", "main.go")
+}
@@ -15,9 +15,10 @@ import (
 
 var (
 	options = &struct {
-		Filepath       string `short:"f" long:"filepath" required:"true" description:"File-path of JPEG image ('-' for STDIN)"`
-		Json           bool   `short:"j" long:"json" description:"Print as JSON"`
-		DoPrintVerbose bool   `short:"v" long:"verbose" description:"Print logging"`
+		Filepath          string `short:"f" long:"filepath" required:"true" description:"File-path of JPEG image ('-' for STDIN)"`
+		Json              bool   `short:"j" long:"json" description:"Print as JSON"`
+		ThumbnailFilepath string `short:"t" long:"thumbnail-filepath" description:"Write the EXIF thumbnail to this file-path"`
+		DoPrintVerbose    bool   `short:"v" long:"verbose" description:"Print logging"`
 	}{}
 )
 
@@ -114,6 +115,23 @@ func main() {
 		}
 	}
 
+	if options.ThumbnailFilepath != "" {
+		sl := intfc.(*jpegstructure.SegmentList)
+
+		_, thumbnailData, err := sl.ExifThumbnail()
+		if err != nil {
+			if log.Is(err, exif.ErrNoThumbnail) == true {
+				fmt.Printf("No thumbnail.\n")
+				os.Exit(11)
+			}
+
+			log.Panic(err)
+		}
+
+		err = ioutil.WriteFile(options.ThumbnailFilepath, thumbnailData, 0644)
+		log.PanicIf(err)
+	}
+
 	if options.Json == true {
 		raw, err := json.MarshalIndent(et, "  ", "  ")
 		log.PanicIf(err)
@@ -7,6 +7,8 @@ import (
 	"testing"
 
 	"encoding/json"
+	"io/ioutil"
+	"os"
 	"os/exec"
 
 	"github.com/dsoprea/go-logging"
@@ -147,6 +149,46 @@ func TestMain_Json_Exif(t *testing.T) {
 	}
 }
 
+func TestMain_Thumbnail(t *testing.T) {
+	appFilepath := getAppFilepath()
+
+	assetsPath := jpegstructure.GetTestAssetsPath()
+	imageFilepath := path.Join(assetsPath, "20180428_212314.jpg")
+
+	f, err := ioutil.TempFile("", "")
+	log.PanicIf(err)
+
+	thumbnailFilepath := f.Name()
+
+	f.Close()
+	defer os.Remove(thumbnailFilepath)
+
+	cmd := exec.Command(
+		"go", "run", appFilepath,
+		"--json",
+		"--thumbnail-filepath", thumbnailFilepath,
+		"--filepath", imageFilepath)
+
+	b := new(bytes.Buffer)
+	cmd.Stdout = b
+	cmd.Stderr = b
+
+	err = cmd.Run()
+	if err != nil {
+		fmt.Printf(b.String())
+		panic(err)
+	}
+
+	data, err := ioutil.ReadFile(thumbnailFilepath)
+	log.PanicIf(err)
+
+	if len(data) != 18318 {
+		t.Fatalf("Thumbnail size not correct: (%d)", len(data))
+	} else if bytes.HasPrefix(data, []byte{0xff, 0xd8}) != true {
+		t.Fatalf("Thumbnail is not a JPEG.")
+	}
+}
+
 func getAppFilepath() string {
 	moduleRootPath := jpegstructure.GetModuleRootPath()
 	return path.Join(moduleRootPath, "command", "js_exif", "main.go")
@@ -15,6 +15,8 @@ var (
 	options = &struct {
 		InputFilepath  string `short:"f" long:"input-filepath" required:"true" description:"File-path of JPEG image to read"`
 		OutputFilepath string `short:"o" long:"output-filepath" description:"File-path of JPEG image to write (if not provided, then the input JPEG will be used)"`
+		KeepBackup     bool   `short:"b" long:"backup" description:"Keep a copy of any file being overwritten with a '.bak' suffix"`
+		PreserveTimes  bool   `short:"t" long:"preserve-times" description:"Keep the modification-time of any file being overwritten"`
 	}{}
 )
 
@@ -48,11 +50,12 @@ func main() {
 		outputFilepath = options.InputFilepath
 	}
 
-	f, err := os.OpenFile(outputFilepath, os.O_CREATE|os.O_WRONLY, 0644)
-	log.PanicIf(err)
-
-	defer f.Close()
+	wfo := &jpegstructure.WriteFileOptions{
+		KeepBackup:      options.KeepBackup,
+		PreserveMode:    true,
+		PreserveModTime: options.PreserveTimes,
+	}
 
-	err = sl.Write(f)
+	err = sl.WriteFile(outputFilepath, wfo)
 	log.PanicIf(err)
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"testing"
+
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	"github.com/dsoprea/go-exif/v3"
+	"github.com/dsoprea/go-logging"
+
+	"github.com/dsoprea/go-jpeg-image-structure/v2"
+)
+
+var (
+	testTrailer = []byte("trailing data")
+)
+
+// getTrailerFilepath writes a copy of the test image with data after the EOI
+// marker.
+func getTrailerFilepath() string {
+	assetsPath := jpegstructure.GetTestAssetsPath()
+	imageFilepath := path.Join(assetsPath, "20180428_212314.jpg")
+
+	jmp := jpegstructure.NewJpegMediaParser()
+
+	intfc, err := jmp.ParseFile(imageFilepath)
+	log.PanicIf(err)
+
+	sl := intfc.(*jpegstructure.SegmentList)
+	sl.SetTrailer(testTrailer)
+
+	f, err := ioutil.TempFile("", "")
+	log.PanicIf(err)
+
+	defer f.Close()
+
+	err = sl.Write(f)
+	log.PanicIf(err)
+
+	return f.Name()
+}
+
+func TestMain_Trailer(t *testing.T) {
+	appFilepath := getAppFilepath()
+
+	inputFilepath := getTrailerFilepath()
+	defer os.Remove(inputFilepath)
+
+	outputFilepath := inputFilepath + ".out"
+	defer os.Remove(outputFilepath)
+
+	cmd := exec.Command(
+		"go", "run", appFilepath,
+		"--input-filepath", inputFilepath,
+		"--output-filepath", outputFilepath)
+
+	b := new(bytes.Buffer)
+	cmd.Stdout = b
+	cmd.Stderr = b
+
+	err := cmd.Run()
+	actual := b.String()
+
+	if err != nil {
+		fmt.Printf(actual)
+		panic(err)
+	}
+
+	if actual != "true\n" {
+		t.Fatalf("Output not expected: [%s]", actual)
+	}
+
+	// The trailer is written back after the EOI, and the image is still
+	// valid.
+
+	data, err := ioutil.ReadFile(outputFilepath)
+	log.PanicIf(err)
+
+	jmp := jpegstructure.NewJpegMediaParser()
+
+	intfc, err := jmp.ParseBytes(data)
+	log.PanicIf(err)
+
+	sl := intfc.(*jpegstructure.SegmentList)
+
+	err = sl.Validate(data)
+	log.PanicIf(err)
+
+	findings, err := sl.ValidateStructure()
+	log.PanicIf(err)
+
+	if findings.HasErrors() == true {
+		t.Fatalf("Output not valid: %v", findings)
+	}
+
+	if bytes.Equal(sl.Trailer(), testTrailer) != true {
+		t.Fatalf("Trailer not correct: [%s]", sl.Trailer())
+	}
+
+	if _, _, err := sl.Exif(); log.Is(err, exif.ErrNoExif) != true {
+		t.Fatalf("Expected no EXIF: %v", err)
+	}
+}
+
+func getAppFilepath() string {
+	moduleRootPath := jpegstructure.GetModuleRootPath()
+	return path.Join(moduleRootPath, "command", "js_exif_drop", "main.go")
+}
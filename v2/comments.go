@@ -0,0 +1,253 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"fmt"
+
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+var (
+	utf8ByteOrderMark     = []byte{0xef, 0xbb, 0xbf}
+	utf16BigEndianMark    = []byte{0xfe, 0xff}
+	utf16LittleEndianMark = []byte{0xff, 0xfe}
+)
+
+// CommentCharset is the character-set that a comment was detected as. The
+// COM segment doesn't declare one.
+type CommentCharset string
+
+const (
+	// CommentCharsetAscii is seven-bit ASCII.
+	CommentCharsetAscii CommentCharset = "ASCII"
+
+	// CommentCharsetUtf8 is UTF-8, with or without a byte-order mark.
+	CommentCharsetUtf8 CommentCharset = "UTF-8"
+
+	// CommentCharsetUtf16BigEndian is UTF-16 with a big-endian byte-order
+	// mark.
+	CommentCharsetUtf16BigEndian CommentCharset = "UTF-16BE"
+
+	// CommentCharsetUtf16LittleEndian is UTF-16 with a little-endian
+	// byte-order mark.
+	CommentCharsetUtf16LittleEndian CommentCharset = "UTF-16LE"
+
+	// CommentCharsetLatin1 is ISO-8859-1, which is what anything that isn't
+	// valid UTF-8 is assumed to be.
+	CommentCharsetLatin1 CommentCharset = "ISO-8859-1"
+)
+
+// Comment is the text of one or more consecutive COM segments.
+type Comment struct {
+	// Text is the decoded text, without any byte-order mark or trailing NULs.
+	Text string
+
+	// Charset is the detected character-set of the raw bytes.
+	Charset CommentCharset
+
+	// Raw is the payload as stored. If the comment was split across segments,
+	// this is all of them joined.
+	Raw []byte
+}
+
+// String returns a descriptive string.
+func (c *Comment) String() string {
+	return fmt.Sprintf("Comment<CHARSET=[%s] TEXT=%q>", c.Charset, c.Text)
+}
+
+// decodeComment detects the character-set of a comment and decodes it.
+func decodeComment(raw []byte) *Comment {
+	c := &Comment{
+		Raw: raw,
+	}
+
+	data := raw
+
+	switch {
+	case bytes.HasPrefix(data, utf8ByteOrderMark) == true:
+		c.Charset = CommentCharsetUtf8
+		c.Text = string(data[len(utf8ByteOrderMark):])
+	case len(data)%2 == 0 && (bytes.HasPrefix(data, utf16BigEndianMark) == true || bytes.HasPrefix(data, utf16LittleEndianMark) == true):
+		isBigEndian := data[0] == utf16BigEndianMark[0]
+
+		units := make([]uint16, 0, len(data)/2-1)
+		for i := 2; i < len(data); i += 2 {
+			if isBigEndian == true {
+				units = append(units, uint16(data[i])<<8|uint16(data[i+1]))
+			} else {
+				units = append(units, uint16(data[i+1])<<8|uint16(data[i]))
+			}
+		}
+
+		if isBigEndian == true {
+			c.Charset = CommentCharsetUtf16BigEndian
+		} else {
+			c.Charset = CommentCharsetUtf16LittleEndian
+		}
+
+		c.Text = string(utf16.Decode(units))
+	case isAscii(data) == true:
+		c.Charset = CommentCharsetAscii
+		c.Text = string(data)
+	case utf8.Valid(data) == true:
+		c.Charset = CommentCharsetUtf8
+		c.Text = string(data)
+	default:
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+
+		c.Charset = CommentCharsetLatin1
+		c.Text = string(runes)
+	}
+
+	// Some writers terminate the text as a C string.
+	for len(c.Text) > 0 && c.Text[len(c.Text)-1] == 0 {
+		c.Text = c.Text[:len(c.Text)-1]
+	}
+
+	return c
+}
+
+// isAscii returns true if all of the bytes are seven-bit.
+func isAscii(data []byte) bool {
+	for _, b := range data {
+		if b >= 0x80 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Comments returns the comments in the COM segments. A comment that is too
+// long for one segment is split across consecutive segments, all but the last
+// of which are full, and is returned as one comment.
+func (sl *SegmentList) Comments() (comments []*Comment) {
+	comments = make([]*Comment, 0)
+
+	var raw []byte
+	isContinued := false
+
+	for _, s := range sl.segments {
+		if s.MarkerId != MARKER_COM {
+			if isContinued == true {
+				comments = append(comments, decodeComment(raw))
+				isContinued = false
+			}
+
+			continue
+		}
+
+		if isContinued == true {
+			raw = append(raw, s.Data...)
+		} else {
+			raw = append([]byte{}, s.Data...)
+		}
+
+		isContinued = len(s.Data) == maxSegmentPayloadSize
+		if isContinued == false {
+			comments = append(comments, decodeComment(raw))
+		}
+	}
+
+	if isContinued == true {
+		comments = append(comments, decodeComment(raw))
+	}
+
+	return comments
+}
+
+// commentSegments returns the COM segments for the given text, stored as
+// UTF-8 and split into as many segments as needed. Only the last segment is
+// less than full, so that the text isn't joined with the next comment when
+// it's read back. Empty segments aren't allowed, so text that would exactly
+// fill its segments is terminated with a NUL, and empty text has none.
+func commentSegments(text string) (segments []*Segment) {
+	data := []byte(text)
+
+	if len(data) > 0 && len(data)%maxSegmentPayloadSize == 0 {
+		data = append(data, 0)
+	}
+
+	for len(data) > 0 {
+		size := len(data)
+		if size > maxSegmentPayloadSize {
+			size = maxSegmentPayloadSize
+		}
+
+		s := &Segment{
+			MarkerId:   MARKER_COM,
+			MarkerName: markerNames[MARKER_COM],
+			Data:       data[:size],
+		}
+
+		segments = append(segments, s)
+		data = data[size:]
+	}
+
+	return segments
+}
+
+// commentInsertIndex returns where new comments go: after any existing
+// comments and the application segments at the front of the image, but before
+// the tables and frame.
+func (sl *SegmentList) commentInsertIndex() int {
+	index := 0
+
+	for i, s := range sl.segments {
+		if i == 0 && s.MarkerId == MARKER_SOI {
+			index = 1
+			continue
+		}
+
+		if s.MarkerId != MARKER_COM && (s.MarkerId < MARKER_APP0 || s.MarkerId > MARKER_APP15) {
+			break
+		}
+
+		index = i + 1
+	}
+
+	return index
+}
+
+// AddComment adds the text, as UTF-8, after any existing comments. Text that
+// is too long for one COM segment is split across as many as needed. Empty
+// text is not added.
+func (sl *SegmentList) AddComment(text string) {
+	index := sl.commentInsertIndex()
+
+	segments := commentSegments(text)
+
+	tail := append(segments, sl.segments[index:]...)
+	sl.segments = append(sl.segments[:index], tail...)
+}
+
+// SetComments replaces all of the comments with the given ones.
+func (sl *SegmentList) SetComments(texts []string) {
+	sl.DropComments()
+
+	for _, text := range texts {
+		sl.AddComment(text)
+	}
+}
+
+// DropComments drops all of the COM segments.
+func (sl *SegmentList) DropComments() (wasDropped bool) {
+	segments := make([]*Segment, 0, len(sl.segments))
+
+	for _, s := range sl.segments {
+		if s.MarkerId == MARKER_COM {
+			wasDropped = true
+			continue
+		}
+
+		segments = append(segments, s)
+	}
+
+	sl.segments = segments
+
+	return wasDropped
+}
@@ -0,0 +1,162 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/dsoprea/go-logging"
+)
+
+func TestDecodeComment(t *testing.T) {
+	cases := []struct {
+		raw     []byte
+		charset CommentCharset
+		text    string
+	}{
+		{[]byte("job 1234\000"), CommentCharsetAscii, "job 1234"},
+		{[]byte("caf\xc3\xa9"), CommentCharsetUtf8, "café"},
+		{[]byte("\xef\xbb\xbfjob"), CommentCharsetUtf8, "job"},
+		{[]byte("caf\xe9"), CommentCharsetLatin1, "café"},
+		{[]byte{0xfe, 0xff, 0x00, 'h', 0x00, 0xe9}, CommentCharsetUtf16BigEndian, "hé"},
+		{[]byte{0xff, 0xfe, 'h', 0x00, 0xe9, 0x00, 0x00, 0x00}, CommentCharsetUtf16LittleEndian, "hé"},
+		{[]byte{}, CommentCharsetAscii, ""},
+	}
+
+	for i, c := range cases {
+		comment := decodeComment(c.raw)
+
+		if comment.Charset != c.charset || comment.Text != c.text {
+			t.Fatalf("Case (%d) not correct: %s", i, comment)
+		} else if bytes.Equal(comment.Raw, c.raw) != true {
+			t.Fatalf("Case (%d) raw bytes not correct.", i)
+		}
+	}
+}
+
+func TestSegmentList_AddComment(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(16, 16, false))
+
+	if len(sl.Comments()) != 0 {
+		t.Fatalf("Expected no comments.")
+	}
+
+	rootIb, err := sl.ConstructExifBuilder()
+	log.PanicIf(err)
+
+	err = sl.SetExif(rootIb)
+	log.PanicIf(err)
+
+	sl.AddComment("job 1234")
+	sl.AddComment("frame 5")
+
+	sl, _ = reparseSegmentList(sl)
+
+	comments := sl.Comments()
+	if len(comments) != 2 {
+		t.Fatalf("Comment count not correct: (%d)", len(comments))
+	} else if comments[0].Text != "job 1234" || comments[1].Text != "frame 5" {
+		t.Fatalf("Comments not correct: %v", comments)
+	}
+
+	// They go after the application segments and before the image data.
+
+	markerIds := make([]byte, 0)
+	for _, s := range sl.Segments()[:5] {
+		markerIds = append(markerIds, s.MarkerId)
+	}
+
+	expected := []byte{MARKER_SOI, MARKER_APP1, MARKER_COM, MARKER_COM, MARKER_DQT}
+	if bytes.Equal(markerIds, expected) != true {
+		t.Fatalf("Segment order not correct: %x", markerIds)
+	}
+}
+
+func TestSegmentList_AddComment_Long(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(16, 16, false))
+
+	long := strings.Repeat("é", maxSegmentPayloadSize)
+	exact := strings.Repeat("x", maxSegmentPayloadSize)
+
+	sl.AddComment(long)
+	sl.AddComment(exact)
+	sl.AddComment("short")
+
+	sl, _ = reparseSegmentList(sl)
+
+	count := 0
+	for _, s := range sl.Segments() {
+		if s.MarkerId == MARKER_COM {
+			count++
+		}
+	}
+
+	// Three segments for the long text (the last with just a NUL), two for
+	// the text that would exactly fill one, and one more.
+	if count != 6 {
+		t.Fatalf("Segment count not correct: (%d)", count)
+	}
+
+	comments := sl.Comments()
+	if len(comments) != 3 {
+		t.Fatalf("Comment count not correct: (%d)", len(comments))
+	} else if comments[0].Text != long || comments[0].Charset != CommentCharsetUtf8 {
+		t.Fatalf("Long comment not correct.")
+	} else if comments[1].Text != exact || comments[1].Charset != CommentCharsetAscii {
+		t.Fatalf("Exact comment not correct.")
+	} else if comments[2].Text != "short" {
+		t.Fatalf("Short comment not correct: %s", comments[2])
+	}
+}
+
+func TestSegmentList_SetComments(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(16, 16, false))
+
+	sl.AddComment("old")
+	sl.AddComment("")
+
+	if len(sl.Comments()) != 1 {
+		t.Fatalf("Empty comment shouldn't have been added.")
+	}
+
+	sl.SetComments([]string{"new 1", "new 2"})
+
+	sl, _ = reparseSegmentList(sl)
+
+	comments := sl.Comments()
+	if len(comments) != 2 || comments[0].Text != "new 1" || comments[1].Text != "new 2" {
+		t.Fatalf("Comments not correct: %v", comments)
+	}
+
+	if sl.DropComments() != true {
+		t.Fatalf("Expected comments to be dropped.")
+	} else if len(sl.Comments()) != 0 {
+		t.Fatalf("Comments not dropped.")
+	} else if sl.DropComments() != false {
+		t.Fatalf("Expected nothing more to drop.")
+	}
+}
@@ -0,0 +1,171 @@
+package jpegstructure
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/dsoprea/go-logging"
+)
+
+const (
+	xmpNamespaceContainer     = "http://ns.google.com/photos/1.0/container/"
+	xmpNamespaceContainerItem = "http://ns.google.com/photos/1.0/container/item/"
+)
+
+// containerItem is one item of the container directory that Google formats
+// (Ultra HDR, Motion Photo) put in the XMP of the primary image. The first item
+// is the primary image and the rest are stored after it, in order.
+type containerItem struct {
+	// Semantic is the role of the item ("Primary", "GainMap", "MotionPhoto",
+	// etc..).
+	Semantic string
+
+	// Mime is the MIME type of the item.
+	Mime string
+
+	// Length is the size of the item. It's (0) for the primary image.
+	Length int
+
+	// Padding is the number of bytes after the item and before the next one.
+	Padding int
+}
+
+// String returns a descriptive string.
+func (ci containerItem) String() string {
+	return fmt.Sprintf("ContainerItem<SEMANTIC=[%s] MIME=[%s] LENGTH=(%d) PADDING=(%d)>", ci.Semantic, ci.Mime, ci.Length, ci.Padding)
+}
+
+// containerDirectory returns the items of the container directory, or nil if
+// there isn't one.
+func (xd *xmpDocument) containerDirectory() (items []containerItem, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	xd.walk(func(xe *xmpElement) {
+		if xe.is(xmpNamespaceContainer, "Item") == false {
+			return
+		}
+
+		ci := containerItem{}
+
+		ci.Semantic, _ = xe.property(xmpNamespaceContainerItem, "Semantic")
+		ci.Mime, _ = xe.property(xmpNamespaceContainerItem, "Mime")
+
+		if raw, found := xe.property(xmpNamespaceContainerItem, "Length"); found == true {
+			ci.Length, err = strconv.Atoi(raw)
+			log.PanicIf(err)
+		}
+
+		if raw, found := xe.property(xmpNamespaceContainerItem, "Padding"); found == true {
+			ci.Padding, err = strconv.Atoi(raw)
+			log.PanicIf(err)
+		}
+
+		if ci.Length < 0 || ci.Padding < 0 {
+			log.Panicf("container item not valid: %s", ci)
+		}
+
+		items = append(items, ci)
+	})
+
+	return items, nil
+}
+
+// containerItemOffset returns where the item is, relative to the end of the
+// primary image.
+func containerItemOffset(items []containerItem, i int) int {
+	offset := 0
+	for _, ci := range items[:i] {
+		offset += ci.Length + ci.Padding
+	}
+
+	return offset
+}
+
+// setContainerDirectory replaces the container directory with the given
+// items. The new directory goes in a description of its own, which is
+// returned.
+func (xd *xmpDocument) setContainerDirectory(items []containerItem) (description *xmpElement, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	xd.removeProperties(func(namespace, local string) bool {
+		return namespace == xmpNamespaceContainer && local == "Directory"
+	})
+
+	description, err = xd.addDescription()
+	log.PanicIf(err)
+
+	containerPrefix := description.declareNamespace("Container", xmpNamespaceContainer)
+	itemPrefix := description.declareNamespace("Item", xmpNamespaceContainerItem)
+
+	rdfPrefix := description.Prefix
+
+	seq := &xmpElement{
+		Prefix:    rdfPrefix,
+		Local:     "Seq",
+		Namespace: xmpNamespaceRdf,
+	}
+
+	for _, ci := range items {
+		item := &xmpElement{
+			Prefix:    containerPrefix,
+			Local:     "Item",
+			Namespace: xmpNamespaceContainer,
+		}
+
+		attributes := []struct {
+			local string
+			value string
+		}{
+			{"Semantic", ci.Semantic},
+			{"Mime", ci.Mime},
+			{"Length", strconv.Itoa(ci.Length)},
+			{"Padding", strconv.Itoa(ci.Padding)},
+		}
+
+		for _, attribute := range attributes {
+			if attribute.value == "" || attribute.value == "0" {
+				continue
+			}
+
+			xa := &xmpAttribute{
+				Prefix:    itemPrefix,
+				Local:     attribute.local,
+				Namespace: xmpNamespaceContainerItem,
+				Value:     attribute.value,
+			}
+
+			item.Attributes = append(item.Attributes, xa)
+		}
+
+		li := &xmpElement{
+			Prefix:    rdfPrefix,
+			Local:     "li",
+			Namespace: xmpNamespaceRdf,
+			Attributes: []*xmpAttribute{
+				{Prefix: rdfPrefix, Local: "parseType", Namespace: xmpNamespaceRdf, Value: "Resource"},
+			},
+			Children: []xmpNode{item},
+		}
+
+		seq.Children = append(seq.Children, li)
+	}
+
+	directory := &xmpElement{
+		Prefix:    containerPrefix,
+		Local:     "Directory",
+		Namespace: xmpNamespaceContainer,
+		Children:  []xmpNode{seq},
+	}
+
+	description.Children = append(description.Children, directory)
+
+	return description, nil
+}
@@ -0,0 +1,103 @@
+package jpegstructure
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dsoprea/go-logging"
+)
+
+const (
+	containerTestPacket = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:Container="http://ns.google.com/photos/1.0/container/" xmlns:Item="http://ns.google.com/photos/1.0/container/item/">
+   <dc:format>image/jpeg</dc:format>
+   <Container:Directory>
+    <rdf:Seq>
+     <rdf:li rdf:parseType="Resource"><Container:Item Item:Semantic="Primary" Item:Mime="image/jpeg" Item:Padding="8"/></rdf:li>
+     <rdf:li rdf:parseType="Resource"><Container:Item><Item:Semantic>GainMap</Item:Semantic><Item:Mime>image/jpeg</Item:Mime><Item:Length>100</Item:Length></Container:Item></rdf:li>
+     <rdf:li rdf:parseType="Resource"><Container:Item Item:Semantic="MotionPhoto" Item:Mime="video/mp4" Item:Length="200"/></rdf:li>
+    </rdf:Seq>
+   </Container:Directory>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`
+)
+
+func TestXmpDocument_containerDirectory(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	xd, err := parseXmpDocument([]byte(containerTestPacket))
+	log.PanicIf(err)
+
+	items, err := xd.containerDirectory()
+	log.PanicIf(err)
+
+	expected := []containerItem{
+		{Semantic: "Primary", Mime: "image/jpeg", Padding: 8},
+		{Semantic: "GainMap", Mime: "image/jpeg", Length: 100},
+		{Semantic: "MotionPhoto", Mime: "video/mp4", Length: 200},
+	}
+
+	if reflect.DeepEqual(items, expected) != true {
+		t.Fatalf("Items not correct: %v", items)
+	} else if containerItemOffset(items, 1) != 8 || containerItemOffset(items, 2) != 108 {
+		t.Fatalf("Offsets not correct.")
+	}
+
+	xd, err = parseXmpDocument([]byte(xmpTestPacket))
+	log.PanicIf(err)
+
+	items, err = xd.containerDirectory()
+	log.PanicIf(err)
+
+	if items != nil {
+		t.Fatalf("Expected no items: %v", items)
+	}
+}
+
+func TestXmpDocument_setContainerDirectory(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	xd, err := parseXmpDocument([]byte(containerTestPacket))
+	log.PanicIf(err)
+
+	items := []containerItem{
+		{Semantic: "Primary", Mime: "image/jpeg"},
+		{Semantic: "MotionPhoto", Mime: "video/mp4", Length: 300, Padding: 2},
+	}
+
+	_, err = xd.setContainerDirectory(items)
+	log.PanicIf(err)
+
+	encoded := xd.encode()
+
+	if strings.Count(string(encoded), "Container:Directory>") != 2 {
+		t.Fatalf("Expected one directory:\n%s", encoded)
+	}
+
+	reparsed, err := parseXmpDocument(encoded)
+	log.PanicIf(err)
+
+	recovered, err := reparsed.containerDirectory()
+	log.PanicIf(err)
+
+	if reflect.DeepEqual(recovered, items) != true {
+		t.Fatalf("Items not correct: %v", recovered)
+	} else if value, _ := reparsed.property(xmpNamespaceDc, "format"); value != "image/jpeg" {
+		t.Fatalf("Other properties not kept: [%s]", value)
+	}
+}
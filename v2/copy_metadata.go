@@ -0,0 +1,351 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+
+	"image/color"
+	"image/jpeg"
+
+	"github.com/dsoprea/go-exif/v3"
+	"github.com/dsoprea/go-logging"
+)
+
+const (
+	// defaultExifThumbnailSize is the largest dimension of the thumbnails that
+	// we generate, which is what cameras usually use.
+	defaultExifThumbnailSize = 160
+
+	// exifThumbnailQuality is the quality that the thumbnails are encoded
+	// with.
+	exifThumbnailQuality = 75
+)
+
+// CopyMetadataOptions describes what `CopyMetadataFrom` copies.
+type CopyMetadataOptions struct {
+	// Exif copies the EXIF segment.
+	Exif bool
+
+	// Xmp copies the XMP segment and any extended XMP.
+	Xmp bool
+
+	// Photoshop copies the Photoshop segment, which has the IPTC data.
+	Photoshop bool
+
+	// IccProfile copies the ICC profile.
+	IccProfile bool
+
+	// Comments copies the COM segments.
+	Comments bool
+
+	// ResetOrientation sets the orientation to (1). Otherwise, it's only
+	// reset if the destination has the dimensions of the source transposed
+	// and the orientation is one that transposes, which means that whatever
+	// produced the destination already applied it.
+	ResetOrientation bool
+
+	// ThumbnailSize is the largest dimension of the EXIF thumbnail that's
+	// generated from the destination image if the source EXIF has a
+	// thumbnail. If zero, (160) is used. If negative, no thumbnail is
+	// generated.
+	ThumbnailSize int
+}
+
+// DefaultCopyMetadataOptions returns options that copy everything.
+func DefaultCopyMetadataOptions() *CopyMetadataOptions {
+	return &CopyMetadataOptions{
+		Exif:       true,
+		Xmp:        true,
+		Photoshop:  true,
+		IccProfile: true,
+		Comments:   true,
+	}
+}
+
+// isCopied returns true if the segment is one of the kinds being copied.
+func (cmo *CopyMetadataOptions) isCopied(s *Segment) bool {
+	switch {
+	case s.IsExif() == true:
+		return cmo.Exif
+	case s.IsXmp() == true:
+		return cmo.Xmp
+	case s.MarkerId == MARKER_APP1 && bytes.HasPrefix(s.Data, xmpExtensionPrefix) == true:
+		return cmo.Xmp
+	case s.MarkerId == MARKER_APP13 && bytes.HasPrefix(s.Data, ps30Prefix) == true:
+		return cmo.Photoshop
+	case s.IsIccProfile() == true:
+		return cmo.IccProfile
+	case s.MarkerId == MARKER_COM:
+		return cmo.Comments
+	}
+
+	return false
+}
+
+// frameHeader returns the header of the first frame, or nil.
+func (sl *SegmentList) frameHeader() (fh *SofSegment, err error) {
+	for _, s := range sl.segments {
+		if isSofMarker(s.MarkerId) == true {
+			return ParseSofSegment(s.MarkerId, s.Data)
+		}
+	}
+
+	return nil, nil
+}
+
+// thumbnailImage reduces the image so that its largest dimension is at most
+// `size`, averaging the pixels that go into each one.
+func thumbnailImage(img image.Image, size int) *image.RGBA {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	thumbnailWidth := width
+	thumbnailHeight := height
+
+	if width >= height && width > size {
+		thumbnailWidth = size
+		thumbnailHeight = (height*size + width/2) / width
+	} else if height > width && height > size {
+		thumbnailHeight = size
+		thumbnailWidth = (width*size + height/2) / height
+	}
+
+	if thumbnailWidth < 1 {
+		thumbnailWidth = 1
+	}
+
+	if thumbnailHeight < 1 {
+		thumbnailHeight = 1
+	}
+
+	thumbnail := image.NewRGBA(image.Rect(0, 0, thumbnailWidth, thumbnailHeight))
+
+	for ty := 0; ty < thumbnailHeight; ty++ {
+		y0 := ty * height / thumbnailHeight
+		y1 := (ty + 1) * height / thumbnailHeight
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+
+		for tx := 0; tx < thumbnailWidth; tx++ {
+			x0 := tx * width / thumbnailWidth
+			x1 := (tx + 1) * width / thumbnailWidth
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var sums [3]uint32
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+
+					sums[0] += r >> 8
+					sums[1] += g >> 8
+					sums[2] += b >> 8
+				}
+			}
+
+			count := uint32((y1 - y0) * (x1 - x0))
+
+			c := color.RGBA{
+				R: uint8(sums[0] / count),
+				G: uint8(sums[1] / count),
+				B: uint8(sums[2] / count),
+				A: 0xff,
+			}
+
+			thumbnail.SetRGBA(tx, ty, c)
+		}
+	}
+
+	return thumbnail
+}
+
+// updateXmpGeometry updates the dimensions (and the orientation, if reset)
+// in the XMP segment, where they are already present.
+func updateXmpGeometry(s *Segment, width, height int, resetOrientation bool) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	xd, err := parseXmpDocument(s.Data[len(xmpPrefix):])
+	log.PanicIf(err)
+
+	xd.setProperty(xmpNamespaceExif, "PixelXDimension", fmt.Sprintf("%d", width))
+	xd.setProperty(xmpNamespaceExif, "PixelYDimension", fmt.Sprintf("%d", height))
+	xd.setProperty(xmpNamespaceTiff, "ImageWidth", fmt.Sprintf("%d", width))
+	xd.setProperty(xmpNamespaceTiff, "ImageLength", fmt.Sprintf("%d", height))
+
+	if resetOrientation == true {
+		xd.setProperty(xmpNamespaceTiff, "Orientation", "1")
+	}
+
+	// The thumbnails are of the source image.
+	xd.removeProperties(func(namespace, local string) bool {
+		return namespace == xmpNamespaceXmp && local == "Thumbnails"
+	})
+
+	err = setXmpDocument(s, xd)
+	log.PanicIf(err)
+
+	return nil
+}
+
+// CopyMetadataFrom replaces the metadata of this image with that of the
+// source, for the kinds of metadata that the options select. Those kinds are
+// removed from this image even if the source doesn't have them. The MPF index
+// is never copied, since it describes images that only the source has.
+//
+// This is for restoring the metadata of an image that was re-encoded by
+// something that didn't keep it. The EXIF and XMP dimensions are updated to
+// match this image, the orientation is reset if it was already applied (see
+// `CopyMetadataOptions`), and the thumbnails from the source are dropped. An
+// EXIF thumbnail is generated from this image in place of the source's.
+// Nothing is changed if there's an error (e.g. EXIF that can't be rebuilt).
+func (sl *SegmentList) CopyMetadataFrom(src *SegmentList, options *CopyMetadataOptions) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if options == nil {
+		options = DefaultCopyMetadataOptions()
+	}
+
+	fh, err := sl.frameHeader()
+	log.PanicIf(err)
+
+	if fh == nil {
+		return ErrNoImageData
+	}
+
+	width := int(fh.Width)
+	height := int(fh.Height)
+
+	// Decide whether to reset the orientation.
+
+	orientation, err := src.Orientation()
+	log.PanicIf(err)
+
+	resetOrientation := options.ResetOrientation
+
+	if tt := OrientationTransform(orientation); tt != 0 && resetOrientation == false {
+		if transposes, _, _ := tt.parameters(); transposes == true {
+			srcFh, err := src.frameHeader()
+			log.PanicIf(err)
+
+			if srcFh != nil && srcFh.Width != srcFh.Height && int(srcFh.Width) == height && int(srcFh.Height) == width {
+				resetOrientation = true
+			}
+		}
+	}
+
+	// Generate the thumbnail before anything changes.
+
+	var thumbnail []byte
+
+	if options.Exif == true && options.ThumbnailSize >= 0 {
+		_, _, err := src.ExifThumbnail()
+		if err == nil {
+			size := options.ThumbnailSize
+			if size == 0 {
+				size = defaultExifThumbnailSize
+			}
+
+			b := new(bytes.Buffer)
+
+			err := sl.Write(b)
+			log.PanicIf(err)
+
+			img, err := NewJpegMediaParser().GetImage(b)
+			log.PanicIf(err)
+
+			b = new(bytes.Buffer)
+
+			err = jpeg.Encode(b, thumbnailImage(img, size), &jpeg.Options{Quality: exifThumbnailQuality})
+			log.PanicIf(err)
+
+			thumbnail = b.Bytes()
+		} else if log.Is(err, exif.ErrNoThumbnail) == false && log.Is(err, exif.ErrNoExif) == false {
+			log.Panic(err)
+		}
+	}
+
+	// Replace the segments, on a copy so that nothing is changed if there's an
+	// error. The copies go after the JFIF segments, with the XMP and Photoshop
+	// thumbnails (which are of the source) dropped.
+
+	copied := make([]*Segment, 0)
+
+	for _, s := range src.segments {
+		if options.isCopied(s) == false {
+			continue
+		}
+
+		c := &Segment{
+			MarkerId:   s.MarkerId,
+			MarkerName: s.MarkerName,
+			Data:       append([]byte{}, s.Data...),
+		}
+
+		if c.IsXmp() == true {
+			err := updateXmpGeometry(c, width, height, resetOrientation)
+			log.PanicIf(err)
+		} else if c.MarkerId == MARKER_APP13 {
+			policy := &SanitizePolicy{
+				DropThumbnails: true,
+			}
+
+			_, isEmpty, err := sanitizePhotoshop(c, policy, new(SanitizeReport))
+			log.PanicIf(err)
+
+			if isEmpty == true {
+				continue
+			}
+		}
+
+		copied = append(copied, c)
+	}
+
+	work := sl.clone()
+
+	kept := make([]*Segment, 0, len(work.segments)+len(copied))
+	for _, s := range work.segments {
+		if options.isCopied(s) == false {
+			kept = append(kept, s)
+		}
+	}
+
+	i := 0
+	for i < len(kept) && (kept[i].MarkerId == MARKER_SOI || kept[i].MarkerId == MARKER_APP0) {
+		i++
+	}
+
+	tail := append(copied, kept[i:]...)
+	work.segments = append(kept[:i], tail...)
+
+	if options.Exif == true {
+		err := work.updateExifGeometry(width, height, resetOrientation)
+		log.PanicIf(err)
+
+		_, err = work.DropExifThumbnail()
+		log.PanicIf(err)
+
+		if thumbnail != nil {
+			// If it doesn't fit, there's just no thumbnail.
+			err := work.SetExifThumbnail(thumbnail)
+			if err != nil && log.Is(err, ErrExifTooLarge) == false {
+				log.Panic(err)
+			}
+		}
+	}
+
+	*sl = *work
+
+	return nil
+}
@@ -0,0 +1,358 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"image"
+	"reflect"
+	"testing"
+
+	"github.com/dsoprea/go-exif/v3"
+	"github.com/dsoprea/go-logging"
+)
+
+// getCopyMetadataTestSource returns the sanitize test image (64x48, with an
+// orientation of (6)) with the pixel dimensions in the EXIF and XMP.
+func getCopyMetadataTestSource() *SegmentList {
+	sl := getSanitizeTestSegmentList()
+
+	_, thumbnailData, err := sl.ExifThumbnail()
+	log.PanicIf(err)
+
+	rootIb, err := sl.ConstructExifBuilder()
+	log.PanicIf(err)
+
+	exifIb, err := exif.GetOrCreateIbFromRootIb(rootIb, "IFD/Exif")
+	log.PanicIf(err)
+
+	err = exifIb.AddStandardWithName("PixelXDimension", []uint32{64})
+	log.PanicIf(err)
+
+	err = exifIb.AddStandardWithName("PixelYDimension", []uint32{48})
+	log.PanicIf(err)
+
+	err = sl.SetExif(rootIb)
+	log.PanicIf(err)
+
+	err = sl.SetExifThumbnail(thumbnailData)
+	log.PanicIf(err)
+
+	for _, s := range sl.segments {
+		if s.IsXmp() == true {
+			packet := bytes.Replace(s.Data[len(xmpPrefix):], []byte(`tiff:Orientation="6"`), []byte(`tiff:Orientation="6" tiff:ImageWidth="64" tiff:ImageLength="48"`), 1)
+			s.Data = append(append([]byte{}, xmpPrefix...), packet...)
+		}
+	}
+
+	sl, _ = reparseSegmentList(sl)
+
+	return sl
+}
+
+// getCopyMetadataTestDestination returns a bare image, as an encoder would
+// write it, with a comment of its own.
+func getCopyMetadataTestDestination(width, height int) *SegmentList {
+	sl := getCoefficientsTestSegmentList(getPerceptualHashTestJpeg(width, height, 80, false))
+	sl.AddComment("encoder")
+
+	return sl
+}
+
+func TestSegmentList_CopyMetadataFrom(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	src := getCopyMetadataTestSource()
+
+	// The encoder applied the orientation, so the dimensions are swapped.
+	sl := getCopyMetadataTestDestination(48, 64)
+
+	original, err := sl.ContentFingerprint()
+	log.PanicIf(err)
+
+	err = sl.CopyMetadataFrom(src, nil)
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	fingerprint, err := sl.ContentFingerprint()
+	log.PanicIf(err)
+
+	if bytes.Equal(fingerprint, original) != true {
+		t.Fatalf("Image changed.")
+	}
+
+	kinds := make([]string, 0)
+	for _, s := range sl.segments {
+		if isContentSegment(s.MarkerId) == true {
+			continue
+		}
+
+		kinds = append(kinds, segmentKind(s))
+	}
+
+	expectedKinds := []string{
+		"SOI",
+		"APP1 [Exif]",
+		"APP1 [http://ns.adobe.com/xap/1.0/]",
+		"APP1 [http://ns.adobe.com/xmp/extensio]",
+		"APP2 [ICC_PROFILE]",
+		"APP2 [ICC_PROFILE]",
+		"APP13 [Photoshop 3.0]",
+		"COM",
+		"EOI",
+	}
+
+	if reflect.DeepEqual(kinds, expectedKinds) != true {
+		t.Fatalf("Segments not correct: %v", kinds)
+	}
+
+	if comments := sl.Comments(); len(comments) != 1 || comments[0].Text != "taken at home" {
+		t.Fatalf("Comments not correct: %v", comments)
+	}
+
+	// The dimensions and orientation match the new image.
+
+	orientation, err := sl.Orientation()
+	log.PanicIf(err)
+
+	if orientation != 1 {
+		t.Fatalf("Orientation not reset: (%d)", orientation)
+	}
+
+	exifProperties, err := sl.exifProperties()
+	log.PanicIf(err)
+
+	if exifProperties["IFD/Exif/PixelXDimension"] != "[48]" || exifProperties["IFD/Exif/PixelYDimension"] != "[64]" {
+		t.Fatalf("EXIF dimensions not correct: %v", exifProperties)
+	} else if exifProperties["IFD/Artist"] != "Someone" {
+		t.Fatalf("EXIF not copied: %v", exifProperties)
+	}
+
+	xmpProperties, err := sl.xmpProperties()
+	log.PanicIf(err)
+
+	if xmpProperties["tiff:Orientation"] != "1" || xmpProperties["tiff:ImageWidth"] != "48" || xmpProperties["tiff:ImageLength"] != "64" {
+		t.Fatalf("XMP not correct: %v", xmpProperties)
+	} else if xmpProperties["dc:creator[1]"] != "Someone" {
+		t.Fatalf("XMP not copied: %v", xmpProperties)
+	}
+
+	// The source thumbnails are gone, and the EXIF one is of the new image.
+
+	for _, s := range sl.segments {
+		if s.MarkerId != MARKER_APP13 {
+			continue
+		}
+
+		resources, err := parsePhotoshopResources(s.Data[len(ps30Prefix):])
+		log.PanicIf(err)
+
+		if len(resources) != 3 {
+			t.Fatalf("Photoshop resources not correct: (%d)", len(resources))
+		}
+
+		for _, resource := range resources {
+			if resource.Id == photoshopThumbnailResourceId {
+				t.Fatalf("Photoshop thumbnail not dropped.")
+			}
+		}
+	}
+
+	thumbnailSl, _, err := sl.ExifThumbnail()
+	log.PanicIf(err)
+
+	fh, err := thumbnailSl.frameHeader()
+	log.PanicIf(err)
+
+	if fh.Width != 48 || fh.Height != 64 {
+		t.Fatalf("Thumbnail not correct: (%d) x (%d)", fh.Width, fh.Height)
+	}
+}
+
+func TestSegmentList_CopyMetadataFrom_KeepOrientation(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	src := getCopyMetadataTestSource()
+
+	// The same dimensions, so the orientation still applies.
+
+	sl := getCopyMetadataTestDestination(64, 48)
+
+	err := sl.CopyMetadataFrom(src, nil)
+	log.PanicIf(err)
+
+	orientation, err := sl.Orientation()
+	log.PanicIf(err)
+
+	if orientation != 6 {
+		t.Fatalf("Orientation not kept: (%d)", orientation)
+	}
+
+	// Unless it's reset explicitly.
+
+	sl = getCopyMetadataTestDestination(64, 48)
+
+	options := DefaultCopyMetadataOptions()
+	options.ResetOrientation = true
+
+	err = sl.CopyMetadataFrom(src, options)
+	log.PanicIf(err)
+
+	orientation, err = sl.Orientation()
+	log.PanicIf(err)
+
+	if orientation != 1 {
+		t.Fatalf("Orientation not reset: (%d)", orientation)
+	}
+
+	xmpProperties, err := sl.xmpProperties()
+	log.PanicIf(err)
+
+	if xmpProperties["tiff:Orientation"] != "1" {
+		t.Fatalf("XMP orientation not reset: %v", xmpProperties)
+	}
+}
+
+func TestSegmentList_CopyMetadataFrom_NormalOrientation(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	src := getOrientationTestSegmentList(getTestGeneratedJpeg(64, 48, false), 1)
+	sl := getCopyMetadataTestDestination(48, 64)
+
+	err := sl.CopyMetadataFrom(src, nil)
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	rootIfd, _, err := sl.Exif()
+	log.PanicIf(err)
+
+	_, err = rootIfd.FindTagWithId(exifOrientationTagId)
+	log.PanicIf(err)
+
+	orientation, err := sl.Orientation()
+	log.PanicIf(err)
+
+	if orientation != 1 {
+		t.Fatalf("Orientation not correct: (%d)", orientation)
+	}
+}
+
+func TestSegmentList_CopyMetadataFrom_Options(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	src := getCopyMetadataTestSource()
+	sl := getCopyMetadataTestDestination(48, 64)
+
+	options := &CopyMetadataOptions{
+		Exif:          true,
+		IccProfile:    true,
+		ThumbnailSize: -1,
+	}
+
+	err := sl.CopyMetadataFrom(src, options)
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	if _, _, err := sl.ExifThumbnail(); log.Is(err, exif.ErrNoThumbnail) != true {
+		t.Fatalf("Expected no thumbnail: %v", err)
+	} else if _, err := sl.IccProfile(); err != nil {
+		t.Fatalf("ICC profile not copied: %v", err)
+	} else if comments := sl.Comments(); len(comments) != 1 || comments[0].Text != "encoder" {
+		t.Fatalf("Comments changed: %v", comments)
+	}
+
+	for _, s := range sl.segments {
+		if s.IsXmp() == true || s.MarkerId == MARKER_APP13 {
+			t.Fatalf("Segment copied: [%s]", segmentKind(s))
+		}
+	}
+}
+
+func TestSegmentList_CopyMetadataFrom_NoImage(t *testing.T) {
+	sl := NewSegmentList([]*Segment{
+		{MarkerId: MARKER_SOI, MarkerName: markerNames[MARKER_SOI]},
+		{MarkerId: MARKER_EOI, MarkerName: markerNames[MARKER_EOI]},
+	})
+
+	if err := sl.CopyMetadataFrom(getCopyMetadataTestSource(), nil); err != ErrNoImageData {
+		t.Fatalf("Expected no image data: %v", err)
+	}
+}
+
+func TestSegmentList_CopyMetadataFrom_ExifNotRebuildable(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	src, _ := getFujiTestSegmentList()
+	sl := getCopyMetadataTestDestination(48, 64)
+
+	b := new(bytes.Buffer)
+
+	err := sl.Write(b)
+	log.PanicIf(err)
+
+	original := b.Bytes()
+
+	err = sl.CopyMetadataFrom(src, nil)
+	if err == nil {
+		t.Fatalf("Expected error for EXIF that can't be rebuilt.")
+	}
+
+	// None of the metadata was copied.
+
+	b = new(bytes.Buffer)
+
+	err = sl.Write(b)
+	log.PanicIf(err)
+
+	if bytes.Equal(b.Bytes(), original) != true {
+		t.Fatalf("Image was changed by the failed copy.")
+	}
+}
+
+func Test_thumbnailImage(t *testing.T) {
+	thumbnail := thumbnailImage(getThumbnailTestImage(400, 100, false), 160)
+
+	if thumbnail.Bounds() != image.Rect(0, 0, 160, 40) {
+		t.Fatalf("Thumbnail size not correct: %v", thumbnail.Bounds())
+	}
+
+	small := getThumbnailTestImage(30, 20, false)
+	thumbnail = thumbnailImage(small, 160)
+
+	if thumbnail.Bounds() != small.Bounds() {
+		t.Fatalf("Small image resized: %v", thumbnail.Bounds())
+	} else if reflect.DeepEqual(thumbnail.Pix, small.Pix) != true {
+		t.Fatalf("Small image changed.")
+	}
+}
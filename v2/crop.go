@@ -0,0 +1,157 @@
+package jpegstructure
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/dsoprea/go-logging"
+)
+
+// CropResult describes the outcome of `Crop`.
+type CropResult struct {
+	// Requested is the rectangle that was asked for.
+	Requested image.Rectangle
+
+	// Actual is the rectangle that was kept, in the coordinates of the
+	// original image. It covers as much of the requested rectangle as is in
+	// the image.
+	Actual image.Rectangle
+}
+
+// IsAdjusted returns true if the actual rectangle is not the one requested.
+func (cr *CropResult) IsAdjusted() bool {
+	return cr.Actual != cr.Requested
+}
+
+// String returns a descriptive string.
+func (cr *CropResult) String() string {
+	return fmt.Sprintf("CropResult<REQUESTED=%v ACTUAL=%v>", cr.Requested, cr.Actual)
+}
+
+// snapCropRectangle returns the rectangle that can actually be cropped. The
+// top-left corner must fall on the iMCU grid, so it's moved up and left as
+// needed and the rectangle grows to still cover the requested area. The
+// bottom-right corner can be anywhere.
+func snapCropRectangle(fh *SofSegment, r image.Rectangle) (snapped image.Rectangle, err error) {
+	bounds := image.Rect(0, 0, int(fh.Width), int(fh.Height))
+
+	clipped := r.Intersect(bounds)
+	if clipped.Empty() == true {
+		return image.Rectangle{}, fmt.Errorf("crop rectangle does not overlap image: %v", r)
+	}
+
+	imcuWidth, imcuHeight := imcuSize(fh)
+
+	snapped = image.Rectangle{
+		Min: image.Point{
+			X: clipped.Min.X / imcuWidth * imcuWidth,
+			Y: clipped.Min.Y / imcuHeight * imcuHeight,
+		},
+		Max: clipped.Max,
+	}
+
+	return snapped, nil
+}
+
+// cropCoefficients returns the coefficients for the given (snapped) area.
+func cropCoefficients(coefficients *Coefficients, r image.Rectangle) (cropped *Coefficients) {
+	fh := coefficients.Frame
+
+	nf := *fh
+	nf.Components = make([]FrameComponent, len(fh.Components))
+	copy(nf.Components, fh.Components)
+
+	nf.Width = uint16(r.Dx())
+	nf.Height = uint16(r.Dy())
+
+	cropped = &Coefficients{
+		Frame:              &nf,
+		QuantizationTables: coefficients.QuantizationTables,
+		Components:         make([]*ComponentCoefficients, len(nf.Components)),
+	}
+
+	imcuWidth, imcuHeight := imcuSize(fh)
+
+	for i, fc := range nf.Components {
+		hSampling, vSampling := int(fc.HorizontalSampling), int(fc.VerticalSampling)
+		if len(nf.Components) == 1 {
+			hSampling, vSampling = 1, 1
+		}
+
+		offsetX := r.Min.X / imcuWidth * hSampling
+		offsetY := r.Min.Y / imcuHeight * vSampling
+
+		columns, rows := nf.ComponentBlocks(i)
+
+		src := coefficients.Components[i]
+		dst := newComponentCoefficients(fc.Id, columns, rows)
+
+		for y := 0; y < rows; y++ {
+			for x := 0; x < columns; x++ {
+				sx, sy := offsetX+x, offsetY+y
+				if sx >= src.BlocksWide || sy >= src.BlocksHigh {
+					continue
+				}
+
+				*dst.Block(x, y) = *src.Block(sx, sy)
+			}
+		}
+
+		cropped.Components[i] = dst
+	}
+
+	return cropped
+}
+
+// Crop losslessly crops the image to the given rectangle by keeping only the
+// DCT blocks that cover it. Because blocks can't be split, the top-left corner
+// is snapped to the iMCU grid; the returned result reports the rectangle that
+// was actually kept. The image is re-encoded with the same coding process
+// (with optimized Huffman tables if Huffman-coded). If there is EXIF, the pixel
+// dimensions are updated if present. Every embedded thumbnail is dropped, since
+// it would still show what was cropped out. Nothing is changed if there's an
+// error (e.g. EXIF that can't be rebuilt).
+func (sl *SegmentList) Crop(r image.Rectangle) (result *CropResult, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	coefficients, err := sl.ReadCoefficients()
+	log.PanicIf(err)
+
+	snapped, err := snapCropRectangle(coefficients.Frame, r)
+	log.PanicIf(err)
+
+	cropped := cropCoefficients(coefficients, snapped)
+
+	// Work on a copy so that nothing changes if any step fails. The metadata
+	// is done first since it's the most likely to.
+
+	work := sl.clone()
+
+	err = work.updateExifGeometry(snapped.Dx(), snapped.Dy(), false)
+	log.PanicIf(err)
+
+	err = work.dropThumbnails()
+	log.PanicIf(err)
+
+	wco := &WriteCoefficientsOptions{
+		OptimizeHuffman: true,
+		Progressive:     coefficients.Frame.IsProgressive(),
+		Arithmetic:      coefficients.Frame.IsArithmetic(),
+	}
+
+	err = work.WriteCoefficients(cropped, wco)
+	log.PanicIf(err)
+
+	*sl = *work
+
+	result = &CropResult{
+		Requested: r,
+		Actual:    snapped,
+	}
+
+	return result, nil
+}
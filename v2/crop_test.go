@@ -0,0 +1,277 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"image"
+	"testing"
+
+	"image/jpeg"
+
+	"github.com/dsoprea/go-exif/v3"
+	"github.com/dsoprea/go-exif/v3/common"
+	"github.com/dsoprea/go-logging"
+)
+
+// checkCroppedImage compares the cropped image to the same area of the
+// original.
+func checkCroppedImage(t *testing.T, original, cropped []byte, r image.Rectangle) {
+	originalImage, err := jpeg.Decode(bytes.NewReader(original))
+	log.PanicIf(err)
+
+	croppedImage, err := jpeg.Decode(bytes.NewReader(cropped))
+	log.PanicIf(err)
+
+	if croppedImage.Bounds().Dx() != r.Dx() || croppedImage.Bounds().Dy() != r.Dy() {
+		t.Fatalf("Cropped dimensions not correct: %v", croppedImage.Bounds())
+	}
+
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			r1, g1, b1, _ := originalImage.At(r.Min.X+x, r.Min.Y+y).RGBA()
+			r2, g2, b2, _ := croppedImage.At(x, y).RGBA()
+
+			for _, pair := range [][2]uint32{{r1, r2}, {g1, g2}, {b1, b2}} {
+				difference := int(pair[0]>>8) - int(pair[1]>>8)
+				if difference < -3 || difference > 3 {
+					t.Fatalf("Pixel (%d, %d) not correct: (%d) != (%d)", x, y, pair[0]>>8, pair[1]>>8)
+				}
+			}
+		}
+	}
+}
+
+func TestSegmentList_Crop(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	original := getTestGeneratedJpeg(100, 75, false)
+	sl := getCoefficientsTestSegmentList(original)
+
+	requested := image.Rect(20, 10, 70, 60)
+
+	result, err := sl.Crop(requested)
+	log.PanicIf(err)
+
+	// The image is 4:2:0, so the iMCU is 16x16.
+	if result.Actual != image.Rect(16, 0, 70, 60) {
+		t.Fatalf("Actual rectangle not correct: %s", result)
+	} else if result.Requested != requested {
+		t.Fatalf("Requested rectangle not correct: %s", result)
+	} else if result.IsAdjusted() != true {
+		t.Fatalf("Expected the rectangle to be adjusted.")
+	}
+
+	_, data := reparseSegmentList(sl)
+
+	checkCroppedImage(t, original, data, result.Actual)
+}
+
+func TestSegmentList_Crop_Grayscale(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	original := getTestGeneratedJpeg(100, 75, true)
+	sl := getCoefficientsTestSegmentList(original)
+
+	// Extends past the image.
+	requested := image.Rect(24, 41, 150, 150)
+
+	result, err := sl.Crop(requested)
+	log.PanicIf(err)
+
+	if result.Actual != image.Rect(24, 40, 100, 75) {
+		t.Fatalf("Actual rectangle not correct: %s", result)
+	}
+
+	_, data := reparseSegmentList(sl)
+
+	checkCroppedImage(t, original, data, result.Actual)
+}
+
+func TestSegmentList_Crop_Aligned(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getValidationTestSegmentList()
+
+	requested := image.Rect(16, 16, 48, 32)
+
+	result, err := sl.Crop(requested)
+	log.PanicIf(err)
+
+	if result.IsAdjusted() != false {
+		t.Fatalf("Expected no adjustment: %s", result)
+	}
+}
+
+func TestSegmentList_Crop_Outside(t *testing.T) {
+	sl := getValidationTestSegmentList()
+
+	_, err := sl.Crop(image.Rect(100, 100, 200, 200))
+	if err == nil {
+		t.Fatalf("Expected error for rectangle outside of the image.")
+	}
+}
+
+func TestSegmentList_Crop_Exif(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getValidationTestSegmentList()
+
+	im, err := exifcommon.NewIfdMappingWithStandard()
+	log.PanicIf(err)
+
+	ti := exif.NewTagIndex()
+
+	rootIb := exif.NewIfdBuilder(im, ti, exifcommon.IfdStandardIfdIdentity, exifcommon.TestDefaultByteOrder)
+
+	err = rootIb.AddStandardWithName("Orientation", []uint16{6})
+	log.PanicIf(err)
+
+	exifIb, err := exif.GetOrCreateIbFromRootIb(rootIb, "IFD/Exif")
+	log.PanicIf(err)
+
+	err = exifIb.AddStandardWithName("PixelXDimension", []uint32{64})
+	log.PanicIf(err)
+
+	err = exifIb.AddStandardWithName("PixelYDimension", []uint32{48})
+	log.PanicIf(err)
+
+	err = sl.SetExif(rootIb)
+	log.PanicIf(err)
+
+	_, err = sl.Crop(image.Rect(0, 0, 40, 20))
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	rootIfd, _, err := sl.Exif()
+	log.PanicIf(err)
+
+	// The orientation is still needed.
+
+	results, err := rootIfd.FindTagWithName("Orientation")
+	log.PanicIf(err)
+
+	value, err := results[0].Value()
+	log.PanicIf(err)
+
+	if value.([]uint16)[0] != 6 {
+		t.Fatalf("Orientation not correct: %v", value)
+	}
+
+	exifIfd, err := rootIfd.ChildWithIfdPath(exifcommon.IfdExifStandardIfdIdentity)
+	log.PanicIf(err)
+
+	expected := map[string]uint32{
+		"PixelXDimension": 40,
+		"PixelYDimension": 20,
+	}
+
+	for tagName, expectedValue := range expected {
+		results, err := exifIfd.FindTagWithName(tagName)
+		log.PanicIf(err)
+
+		value, err := results[0].Value()
+		log.PanicIf(err)
+
+		if value.([]uint32)[0] != expectedValue {
+			t.Fatalf("Tag [%s] not correct: %v", tagName, value)
+		}
+	}
+}
+
+func TestSegmentList_Crop_Thumbnails(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getSanitizeTestSegmentList()
+
+	thumbnails, err := sl.Thumbnails()
+	log.PanicIf(err)
+
+	if len(thumbnails) == 0 {
+		t.Fatalf("Test image should have thumbnails.")
+	}
+
+	_, err = sl.Crop(image.Rect(0, 0, 32, 32))
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	// They would still show what was cropped out.
+
+	thumbnails, err = sl.Thumbnails()
+	log.PanicIf(err)
+
+	if len(thumbnails) != 0 {
+		t.Fatalf("Thumbnails not dropped: %v", thumbnails)
+	}
+
+	_, _, err = sl.ExifThumbnail()
+	if log.Is(err, exif.ErrNoThumbnail) == false {
+		t.Fatalf("Expected no EXIF thumbnail: %v", err)
+	}
+
+	// The rest of the EXIF is kept.
+
+	rootIfd, _, err := sl.Exif()
+	log.PanicIf(err)
+
+	_, err = rootIfd.FindTagWithName("Artist")
+	log.PanicIf(err)
+}
+
+func TestSegmentList_Crop_ExifNotRebuildable(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl, original := getFujiTestSegmentList()
+
+	_, err := sl.Crop(image.Rect(0, 0, 64, 64))
+	if err == nil {
+		t.Fatalf("Expected error for EXIF that can't be rebuilt.")
+	}
+
+	// Nothing was changed.
+
+	b := new(bytes.Buffer)
+
+	err = sl.Write(b)
+	log.PanicIf(err)
+
+	if bytes.Equal(b.Bytes(), original) != true {
+		t.Fatalf("Image was changed by the failed crop.")
+	}
+}
@@ -0,0 +1,713 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dsoprea/go-exif/v3"
+	"github.com/dsoprea/go-iptc"
+	"github.com/dsoprea/go-logging"
+)
+
+// DiffChange describes how something differs between two images.
+type DiffChange string
+
+const (
+	// DiffAdded is only in the second image.
+	DiffAdded DiffChange = "added"
+
+	// DiffRemoved is only in the first image.
+	DiffRemoved DiffChange = "removed"
+
+	// DiffChanged is in both but different.
+	DiffChanged DiffChange = "changed"
+
+	// DiffMoved is in both and the same but in a different position relative
+	// to the other segments.
+	DiffMoved DiffChange = "moved"
+)
+
+// SegmentDiff is a segment that was added, removed, changed, or moved. A
+// segment that was both moved and changed is reported as changed.
+type SegmentDiff struct {
+	// Kind identifies the segment (the marker name, with the identifier for
+	// APPn segments). Segments of the same kind are paired up in order.
+	Kind string
+
+	Change DiffChange
+
+	// OldIndex is the index of the segment in the first image, or (-1).
+	OldIndex int
+
+	// NewIndex is the index of the segment in the second image, or (-1).
+	NewIndex int
+
+	OldSize int
+	NewSize int
+}
+
+// String returns a descriptive string.
+func (sd *SegmentDiff) String() string {
+	return fmt.Sprintf("SegmentDiff<KIND=[%s] CHANGE=[%s] OLD-INDEX=(%d) NEW-INDEX=(%d) OLD-SIZE=(%d) NEW-SIZE=(%d)>", sd.Kind, sd.Change, sd.OldIndex, sd.NewIndex, sd.OldSize, sd.NewSize)
+}
+
+// PropertyDiff is a metadata property that was added, removed, or changed.
+type PropertyDiff struct {
+	Name     string
+	Change   DiffChange
+	OldValue string
+	NewValue string
+}
+
+// String returns a descriptive string.
+func (pd *PropertyDiff) String() string {
+	switch pd.Change {
+	case DiffAdded:
+		return fmt.Sprintf("+ %s: [%s]", pd.Name, pd.NewValue)
+	case DiffRemoved:
+		return fmt.Sprintf("- %s: [%s]", pd.Name, pd.OldValue)
+	}
+
+	return fmt.Sprintf("~ %s: [%s] -> [%s]", pd.Name, pd.OldValue, pd.NewValue)
+}
+
+// JpegDiff is the difference between two images, both segment by segment and,
+// for the kinds of data that we understand, property by property.
+type JpegDiff struct {
+	Segments []*SegmentDiff
+
+	// Exif are the changed tags, named by IFD path and tag name. The IFD
+	// pointers and the thumbnail offset are left out since they move whenever
+	// anything else does.
+	Exif []*PropertyDiff
+
+	// Xmp are the changed properties of the main XMP packet, named by their
+	// path.
+	Xmp []*PropertyDiff
+
+	// Iptc are the changed IPTC datasets.
+	Iptc []*PropertyDiff
+
+	// Icc describes the ICC profile, if it changed.
+	Icc []*PropertyDiff
+
+	// Quantization are the changed quantization tables, with the estimated
+	// quality as the value.
+	Quantization []*PropertyDiff
+
+	// IsScanDataIdentical is true if the scan headers and the scan data are
+	// the same.
+	IsScanDataIdentical bool
+
+	// IsTrailerIdentical is true if the data after the EOI is the same.
+	IsTrailerIdentical bool
+}
+
+// IsEqual returns true if there are no differences at all (the two images are
+// byte-for-byte the same).
+func (jd *JpegDiff) IsEqual() bool {
+	return len(jd.Segments) == 0 && jd.IsTrailerIdentical == true
+}
+
+// Dump returns a readable description of the differences.
+func (jd *JpegDiff) Dump() string {
+	b := new(strings.Builder)
+
+	if jd.IsEqual() == true {
+		b.WriteString("Identical.\n")
+		return b.String()
+	}
+
+	fmt.Fprintf(b, "Segments:\n")
+
+	for _, sd := range jd.Segments {
+		switch sd.Change {
+		case DiffAdded:
+			fmt.Fprintf(b, "  + (%d) %s (%d) bytes\n", sd.NewIndex, sd.Kind, sd.NewSize)
+		case DiffRemoved:
+			fmt.Fprintf(b, "  - (%d) %s (%d) bytes\n", sd.OldIndex, sd.Kind, sd.OldSize)
+		case DiffMoved:
+			fmt.Fprintf(b, "  > (%d) -> (%d) %s (%d) bytes\n", sd.OldIndex, sd.NewIndex, sd.Kind, sd.OldSize)
+		default:
+			fmt.Fprintf(b, "  ~ (%d) -> (%d) %s (%d) -> (%d) bytes\n", sd.OldIndex, sd.NewIndex, sd.Kind, sd.OldSize, sd.NewSize)
+		}
+	}
+
+	sections := []struct {
+		name  string
+		diffs []*PropertyDiff
+	}{
+		{"EXIF", jd.Exif},
+		{"XMP", jd.Xmp},
+		{"IPTC", jd.Iptc},
+		{"ICC", jd.Icc},
+		{"Quantization", jd.Quantization},
+	}
+
+	for _, section := range sections {
+		if len(section.diffs) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(b, "\n%s:\n", section.name)
+
+		for _, pd := range section.diffs {
+			fmt.Fprintf(b, "  %s\n", pd)
+		}
+	}
+
+	fmt.Fprintf(b, "\nScan data identical: %v\n", jd.IsScanDataIdentical)
+	fmt.Fprintf(b, "Trailer identical: %v\n", jd.IsTrailerIdentical)
+
+	return b.String()
+}
+
+// segmentKind returns what's used to pair up segments between images.
+func segmentKind(s *Segment) string {
+	if s.MarkerId == 0 {
+		return "scan data"
+	}
+
+	name := markerNames[s.MarkerId]
+	if name == "" {
+		name = fmt.Sprintf("0x%02x", s.MarkerId)
+	}
+
+	if s.MarkerId >= MARKER_APP0 && s.MarkerId <= MARKER_APP15 {
+		return fmt.Sprintf("%s [%s]", name, segmentIdentifier(s))
+	}
+
+	return name
+}
+
+// diffProperties compares two sets of properties. The result is sorted by
+// name.
+func diffProperties(oldProperties, newProperties map[string]string) (diffs []*PropertyDiff) {
+	diffs = make([]*PropertyDiff, 0)
+
+	for name, oldValue := range oldProperties {
+		newValue, found := newProperties[name]
+
+		if found == false {
+			diffs = append(diffs, &PropertyDiff{Name: name, Change: DiffRemoved, OldValue: oldValue})
+		} else if newValue != oldValue {
+			diffs = append(diffs, &PropertyDiff{Name: name, Change: DiffChanged, OldValue: oldValue, NewValue: newValue})
+		}
+	}
+
+	for name, newValue := range newProperties {
+		if _, found := oldProperties[name]; found == false {
+			diffs = append(diffs, &PropertyDiff{Name: name, Change: DiffAdded, NewValue: newValue})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Name < diffs[j].Name
+	})
+
+	return diffs
+}
+
+// exifProperties returns the EXIF tags by IFD path and name.
+func (sl *SegmentList) exifProperties() (properties map[string]string, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	properties = make(map[string]string)
+
+	_, _, exifTags, err := sl.DumpExif()
+	if err != nil {
+		if err == exif.ErrNoExif {
+			return properties, nil
+		}
+
+		log.Panic(err)
+	}
+
+	for _, et := range exifTags {
+		if et.ChildIfdPath != "" {
+			continue
+		} else if et.IfdPath == exif.ThumbnailFqIfdPath && et.TagId == exif.ThumbnailOffsetTagId {
+			continue
+		}
+
+		name := fmt.Sprintf("%s/%s", et.IfdPath, et.TagName)
+
+		// Repeated tags are unusual but possible.
+		for i := 2; ; i++ {
+			if _, found := properties[name]; found == false {
+				break
+			}
+
+			name = fmt.Sprintf("%s/%s (%d)", et.IfdPath, et.TagName, i)
+		}
+
+		properties[name] = et.Formatted
+	}
+
+	return properties, nil
+}
+
+// flattenXmpProperty adds the value of a property element, expanding arrays
+// and structures into more properties.
+func flattenXmpProperty(properties map[string]string, name string, xe *xmpElement) {
+	if resource := xe.attribute(xmpNamespaceRdf, "resource"); resource != nil {
+		properties[name] = resource.Value
+		return
+	}
+
+	hasChildren := false
+
+	for _, xa := range xe.Attributes {
+		if xa.isNamespaceDeclaration() == true || xa.Namespace == xmpNamespaceRdf || xa.Namespace == xmlNamespace || xa.Namespace == "" {
+			continue
+		}
+
+		properties[name+"/"+xa.Prefix+":"+xa.Local] = xa.Value
+		hasChildren = true
+	}
+
+	for _, node := range xe.Children {
+		child, ok := node.(*xmpElement)
+		if ok == false {
+			continue
+		}
+
+		hasChildren = true
+
+		switch {
+		case child.is(xmpNamespaceRdf, "Bag") == true || child.is(xmpNamespaceRdf, "Seq") == true || child.is(xmpNamespaceRdf, "Alt") == true:
+			i := 0
+			for _, itemNode := range child.Children {
+				item, ok := itemNode.(*xmpElement)
+				if ok == false || item.is(xmpNamespaceRdf, "li") == false {
+					continue
+				}
+
+				i++
+
+				itemName := fmt.Sprintf("%s[%d]", name, i)
+				if lang := item.attribute(xmlNamespace, "lang"); lang != nil {
+					itemName = fmt.Sprintf("%s[%s]", name, lang.Value)
+				}
+
+				flattenXmpProperty(properties, itemName, item)
+			}
+		case child.is(xmpNamespaceRdf, "Description") == true:
+			flattenXmpProperty(properties, name, child)
+		default:
+			flattenXmpProperty(properties, name+"/"+child.qualifiedName(), child)
+		}
+	}
+
+	if hasChildren == false {
+		properties[name] = strings.TrimSpace(xe.text())
+	}
+}
+
+// xmpProperties returns the properties of the main XMP packet by path.
+func (sl *SegmentList) xmpProperties() (properties map[string]string, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	properties = make(map[string]string)
+
+	_, s, err := sl.FindXmp()
+	if err != nil {
+		if err == ErrNoXmp {
+			return properties, nil
+		}
+
+		log.Panic(err)
+	}
+
+	xd, err := parseXmpDocument(s.Data[len(xmpPrefix):])
+	log.PanicIf(err)
+
+	xd.walk(func(xe *xmpElement) {
+		if xe.is(xmpNamespaceRdf, "RDF") == false {
+			return
+		}
+
+		for _, node := range xe.Children {
+			description, ok := node.(*xmpElement)
+			if ok == false || description.is(xmpNamespaceRdf, "Description") == false {
+				continue
+			}
+
+			for _, xa := range description.Attributes {
+				if xa.isNamespaceDeclaration() == true || xa.Namespace == xmpNamespaceRdf || xa.Namespace == "" {
+					continue
+				}
+
+				properties[xa.Prefix+":"+xa.Local] = xa.Value
+			}
+
+			for _, childNode := range description.Children {
+				if child, ok := childNode.(*xmpElement); ok == true {
+					flattenXmpProperty(properties, child.qualifiedName(), child)
+				}
+			}
+		}
+	})
+
+	return properties, nil
+}
+
+// iptcProperties returns the IPTC datasets by number and name. Repeated
+// datasets are joined.
+func (sl *SegmentList) iptcProperties() (properties map[string]string, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	properties = make(map[string]string)
+
+	tags, err := sl.Iptc()
+	if err != nil {
+		if log.Is(err, ErrNoIptc) == true {
+			return properties, nil
+		}
+
+		log.Panic(err)
+	}
+
+	for key, values := range tags {
+		name := key.String()
+
+		if sti, err := iptc.GetTagInfo(int(key.RecordNumber), int(key.DatasetNumber)); err == nil {
+			name = fmt.Sprintf("%s (%s)", name, sti.Description)
+		}
+
+		parts := make([]string, len(values))
+		for i, value := range values {
+			parts[i] = value.String()
+		}
+
+		properties[name] = strings.Join(parts, "; ")
+	}
+
+	return properties, nil
+}
+
+// iccProperties describes the ICC profile.
+func (sl *SegmentList) iccProperties() (properties map[string]string, profile []byte, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	properties = make(map[string]string)
+
+	profile, err = sl.IccProfile()
+	if err != nil {
+		if err == ErrNoIccProfile {
+			return properties, nil, nil
+		}
+
+		log.Panic(err)
+	}
+
+	properties["size"] = fmt.Sprintf("%d", len(profile))
+
+	ip, err := ParseIccProfile(profile)
+	if err != nil {
+		properties["profile"] = "not valid"
+		return properties, profile, nil
+	}
+
+	properties["version"] = fmt.Sprintf("0x%08x", ip.Version)
+	properties["class"] = ip.Class
+	properties["color space"] = ip.ColorSpace
+	properties["connection space"] = ip.ConnectionSpace
+
+	return properties, profile, nil
+}
+
+// quantizationTables returns the quantization tables by ID. Later
+// definitions replace earlier ones.
+func (sl *SegmentList) quantizationTables() (tables map[byte]*QuantizationTable, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	tables = make(map[byte]*QuantizationTable)
+
+	for _, s := range sl.segments {
+		if s.MarkerId != MARKER_DQT {
+			continue
+		}
+
+		parsed, err := ParseQuantizationTables(s.Data)
+		log.PanicIf(err)
+
+		for _, qt := range parsed {
+			tables[qt.Id] = qt
+		}
+	}
+
+	return tables, nil
+}
+
+// scanData returns the scan headers and the scan data together.
+func (sl *SegmentList) scanData() []byte {
+	b := new(bytes.Buffer)
+
+	for _, s := range sl.segments {
+		if s.MarkerId == MARKER_SOS || s.MarkerId == 0 {
+			b.WriteByte(s.MarkerId)
+			b.Write(s.Data)
+		}
+	}
+
+	return b.Bytes()
+}
+
+// orderedPairs returns the old indices of the largest set of paired segments
+// that are in the same order in both images. Any other paired segment was
+// moved. `newIndices` has the index in the new image of each old segment, or
+// (-1) if it wasn't paired.
+func orderedPairs(newIndices []int) map[int]bool {
+	// This is the longest increasing subsequence. Segment lists are short, so
+	// the quadratic method is fine.
+
+	lengths := make([]int, len(newIndices))
+	previous := make([]int, len(newIndices))
+	last := -1
+
+	for i, j := range newIndices {
+		previous[i] = -1
+
+		if j == -1 {
+			continue
+		}
+
+		lengths[i] = 1
+
+		for k := 0; k < i; k++ {
+			if newIndices[k] != -1 && newIndices[k] < j && lengths[k]+1 > lengths[i] {
+				lengths[i] = lengths[k] + 1
+				previous[i] = k
+			}
+		}
+
+		if last == -1 || lengths[i] > lengths[last] {
+			last = i
+		}
+	}
+
+	ordered := make(map[int]bool)
+	for i := last; i != -1; i = previous[i] {
+		ordered[i] = true
+	}
+
+	return ordered
+}
+
+// DiffSegmentLists compares two images. Segments are paired up by kind (the
+// first EXIF segment of each, then the second, and so on), and the metadata
+// that we understand is compared property by property. Paired segments that
+// are no longer in the same order as the others are reported as moved.
+func DiffSegmentLists(oldSl, newSl *SegmentList) (jd *JpegDiff, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	jd = &JpegDiff{
+		Segments: make([]*SegmentDiff, 0),
+	}
+
+	// Pair up the segments.
+
+	newIndices := make(map[string][]int)
+	for i, s := range newSl.segments {
+		kind := segmentKind(s)
+		newIndices[kind] = append(newIndices[kind], i)
+	}
+
+	pairs := make([]int, len(oldSl.segments))
+	paired := make(map[int]bool)
+	seen := make(map[string]int)
+
+	for i, s := range oldSl.segments {
+		kind := segmentKind(s)
+
+		occurrence := seen[kind]
+		seen[kind]++
+
+		if occurrence < len(newIndices[kind]) {
+			j := newIndices[kind][occurrence]
+
+			pairs[i] = j
+			paired[j] = true
+		} else {
+			pairs[i] = -1
+		}
+	}
+
+	ordered := orderedPairs(pairs)
+
+	for i, s := range oldSl.segments {
+		kind := segmentKind(s)
+
+		j := pairs[i]
+		if j == -1 {
+			sd := &SegmentDiff{
+				Kind:     kind,
+				Change:   DiffRemoved,
+				OldIndex: i,
+				NewIndex: -1,
+				OldSize:  len(s.Data),
+			}
+
+			jd.Segments = append(jd.Segments, sd)
+			continue
+		}
+
+		other := newSl.segments[j]
+
+		change := DiffChanged
+		if bytes.Equal(s.Data, other.Data) == true {
+			if ordered[i] == true {
+				continue
+			}
+
+			change = DiffMoved
+		}
+
+		sd := &SegmentDiff{
+			Kind:     kind,
+			Change:   change,
+			OldIndex: i,
+			NewIndex: j,
+			OldSize:  len(s.Data),
+			NewSize:  len(other.Data),
+		}
+
+		jd.Segments = append(jd.Segments, sd)
+	}
+
+	for j, s := range newSl.segments {
+		if paired[j] == true {
+			continue
+		}
+
+		sd := &SegmentDiff{
+			Kind:     segmentKind(s),
+			Change:   DiffAdded,
+			OldIndex: -1,
+			NewIndex: j,
+			NewSize:  len(s.Data),
+		}
+
+		jd.Segments = append(jd.Segments, sd)
+	}
+
+	// Compare the metadata.
+
+	oldExif, err := oldSl.exifProperties()
+	log.PanicIf(err)
+
+	newExif, err := newSl.exifProperties()
+	log.PanicIf(err)
+
+	jd.Exif = diffProperties(oldExif, newExif)
+
+	oldXmp, err := oldSl.xmpProperties()
+	log.PanicIf(err)
+
+	newXmp, err := newSl.xmpProperties()
+	log.PanicIf(err)
+
+	jd.Xmp = diffProperties(oldXmp, newXmp)
+
+	oldIptc, err := oldSl.iptcProperties()
+	log.PanicIf(err)
+
+	newIptc, err := newSl.iptcProperties()
+	log.PanicIf(err)
+
+	jd.Iptc = diffProperties(oldIptc, newIptc)
+
+	oldIcc, oldProfile, err := oldSl.iccProperties()
+	log.PanicIf(err)
+
+	newIcc, newProfile, err := newSl.iccProperties()
+	log.PanicIf(err)
+
+	jd.Icc = diffProperties(oldIcc, newIcc)
+
+	if len(jd.Icc) == 0 && bytes.Equal(oldProfile, newProfile) == false {
+		// Something other than the header changed.
+		pd := &PropertyDiff{
+			Name:     "profile",
+			Change:   DiffChanged,
+			OldValue: fmt.Sprintf("(%d) bytes", len(oldProfile)),
+			NewValue: fmt.Sprintf("(%d) bytes", len(newProfile)),
+		}
+
+		jd.Icc = append(jd.Icc, pd)
+	}
+
+	// Compare the image data.
+
+	oldTables, err := oldSl.quantizationTables()
+	log.PanicIf(err)
+
+	newTables, err := newSl.quantizationTables()
+	log.PanicIf(err)
+
+	// Tables can differ without the estimated quality changing.
+
+	jd.Quantization = make([]*PropertyDiff, 0)
+
+	for id := 0; id < 16; id++ {
+		oldQt, oldFound := oldTables[byte(id)]
+		newQt, newFound := newTables[byte(id)]
+
+		pd := &PropertyDiff{
+			Name: fmt.Sprintf("table %d", id),
+		}
+
+		if oldFound == true {
+			pd.OldValue = fmt.Sprintf("quality (%d)", oldQt.EstimateQuality())
+		}
+
+		if newFound == true {
+			pd.NewValue = fmt.Sprintf("quality (%d)", newQt.EstimateQuality())
+		}
+
+		switch {
+		case oldFound == true && newFound == false:
+			pd.Change = DiffRemoved
+		case oldFound == false && newFound == true:
+			pd.Change = DiffAdded
+		case oldFound == true && newFound == true && oldQt.Values != newQt.Values:
+			pd.Change = DiffChanged
+		default:
+			continue
+		}
+
+		jd.Quantization = append(jd.Quantization, pd)
+	}
+
+	jd.IsScanDataIdentical = bytes.Equal(oldSl.scanData(), newSl.scanData())
+	jd.IsTrailerIdentical = bytes.Equal(oldSl.trailer, newSl.trailer)
+
+	return jd, nil
+}
@@ -0,0 +1,269 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"image/jpeg"
+
+	"github.com/dsoprea/go-logging"
+)
+
+func TestDiffSegmentLists_Identical(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	oldSl := getSanitizeTestSegmentList()
+	newSl, _ := reparseSegmentList(oldSl)
+
+	jd, err := DiffSegmentLists(oldSl, newSl)
+	log.PanicIf(err)
+
+	if jd.IsEqual() != true {
+		t.Fatalf("Expected no differences:\n%s", jd.Dump())
+	} else if len(jd.Exif) != 0 || len(jd.Xmp) != 0 || len(jd.Iptc) != 0 || len(jd.Icc) != 0 || len(jd.Quantization) != 0 {
+		t.Fatalf("Expected no property differences.")
+	} else if jd.IsScanDataIdentical != true {
+		t.Fatalf("Expected identical scan data.")
+	} else if jd.Dump() != "Identical.\n" {
+		t.Fatalf("Dump not correct: [%s]", jd.Dump())
+	}
+}
+
+func TestDiffSegmentLists_Sanitized(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	oldSl := getSanitizeTestSegmentList()
+	newSl, _ := reparseSegmentList(oldSl)
+
+	_, err := newSl.Sanitize(StrictSanitizePolicy())
+	log.PanicIf(err)
+
+	jd, err := DiffSegmentLists(oldSl, newSl)
+	log.PanicIf(err)
+
+	if jd.IsEqual() != false || jd.IsScanDataIdentical != true || jd.IsTrailerIdentical != false {
+		t.Fatalf("Diff not correct:\n%s", jd.Dump())
+	}
+
+	segments := make([]string, len(jd.Segments))
+	for i, sd := range jd.Segments {
+		segments[i] = string(sd.Change) + " " + sd.Kind
+	}
+
+	expectedSegments := []string{
+		"changed APP1 [Exif]",
+		"changed APP0 [JFIF]",
+		"removed APP0 [JFXX]",
+		"changed APP1 [http://ns.adobe.com/xap/1.0/]",
+		"removed APP1 [http://ns.adobe.com/xmp/extensio]",
+		"changed APP13 [Photoshop 3.0]",
+		"removed COM",
+		"removed APP11 [JP]",
+	}
+
+	if reflect.DeepEqual(segments, expectedSegments) != true {
+		t.Fatalf("Segment differences not correct: %v", segments)
+	}
+
+	names := func(diffs []*PropertyDiff) []string {
+		names := make([]string, len(diffs))
+		for i, pd := range diffs {
+			if pd.Change != DiffRemoved {
+				t.Fatalf("Expected only removals: %s", pd)
+			}
+
+			names[i] = pd.Name
+		}
+
+		return names
+	}
+
+	expectedExif := []string{
+		"IFD/Artist",
+		"IFD/Exif/BodySerialNumber",
+		"IFD/Exif/MakerNote",
+		"IFD/GPSInfo/GPSVersionID",
+		"IFD1/Compression",
+		"IFD1/JPEGInterchangeFormatLength",
+	}
+
+	if exifNames := names(jd.Exif); reflect.DeepEqual(exifNames, expectedExif) != true {
+		t.Fatalf("EXIF differences not correct: %v", exifNames)
+	}
+
+	expectedXmp := []string{
+		"Iptc4xmpCore:CreatorContactInfo",
+		"aux:SerialNumber",
+		"dc:creator[1]",
+		"exif:GPSLatitude",
+		"xmpMM:History[1]",
+		"xmpNote:HasExtendedXMP",
+	}
+
+	if xmpNames := names(jd.Xmp); reflect.DeepEqual(xmpNames, expectedXmp) != true {
+		t.Fatalf("XMP differences not correct: %v", xmpNames)
+	}
+
+	expectedIptc := []string{
+		"2:118 (Contact)",
+		"2:80 (By-line)",
+	}
+
+	if iptcNames := names(jd.Iptc); reflect.DeepEqual(iptcNames, expectedIptc) != true {
+		t.Fatalf("IPTC differences not correct: %v", iptcNames)
+	}
+
+	if jd.Xmp[2].OldValue != "Someone" {
+		t.Fatalf("XMP value not correct: %s", jd.Xmp[2])
+	} else if strings.Contains(jd.Dump(), "  - 2:80 (By-line): [Someone]\n") != true {
+		t.Fatalf("Dump not correct:\n%s", jd.Dump())
+	}
+}
+
+func TestDiffSegmentLists_Reencoded(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	b := new(bytes.Buffer)
+
+	err := jpeg.Encode(b, getTestGeneratedImage(64, 48, false), &jpeg.Options{Quality: 50})
+	log.PanicIf(err)
+
+	oldSl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(64, 48, false))
+	newSl := getCoefficientsTestSegmentList(b.Bytes())
+
+	jd, err := DiffSegmentLists(oldSl, newSl)
+	log.PanicIf(err)
+
+	if jd.IsScanDataIdentical != false || jd.IsTrailerIdentical != true {
+		t.Fatalf("Diff not correct:\n%s", jd.Dump())
+	} else if len(jd.Exif) != 0 || len(jd.Xmp) != 0 || len(jd.Icc) != 0 {
+		t.Fatalf("Expected no metadata differences.")
+	}
+
+	expected := []*PropertyDiff{
+		{Name: "table 0", Change: DiffChanged, OldValue: "quality (90)", NewValue: "quality (50)"},
+		{Name: "table 1", Change: DiffChanged, OldValue: "quality (90)", NewValue: "quality (50)"},
+	}
+
+	if reflect.DeepEqual(jd.Quantization, expected) != true {
+		t.Fatalf("Quantization differences not correct: %v", jd.Quantization)
+	}
+}
+
+func TestDiffSegmentLists_Moved(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	oldSl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(64, 48, false))
+	oldSl.AddComment("a comment")
+
+	// Swap the comment with the first DQT.
+
+	newSl, _ := reparseSegmentList(oldSl)
+
+	commentIndex := -1
+	dqtIndex := -1
+	for i, s := range newSl.segments {
+		if s.MarkerId == MARKER_COM {
+			commentIndex = i
+		} else if s.MarkerId == MARKER_DQT && dqtIndex == -1 {
+			dqtIndex = i
+		}
+	}
+
+	if commentIndex == -1 || dqtIndex == -1 {
+		t.Fatalf("Test image doesn't have the segments we need.")
+	}
+
+	newSl.segments[commentIndex], newSl.segments[dqtIndex] = newSl.segments[dqtIndex], newSl.segments[commentIndex]
+
+	jd, err := DiffSegmentLists(oldSl, newSl)
+	log.PanicIf(err)
+
+	if jd.IsEqual() != false {
+		t.Fatalf("Expected a reordering to be a difference.")
+	} else if jd.IsScanDataIdentical != true {
+		t.Fatalf("Expected identical scan data.")
+	} else if len(jd.Segments) != 1 {
+		t.Fatalf("Expected exactly one segment difference:\n%s", jd.Dump())
+	}
+
+	sd := jd.Segments[0]
+	if sd.Change != DiffMoved || sd.OldIndex == sd.NewIndex {
+		t.Fatalf("Segment difference not correct: %s", sd)
+	} else if strings.Contains(jd.Dump(), "  > ") != true {
+		t.Fatalf("Dump not correct:\n%s", jd.Dump())
+	}
+}
+
+func TestSegmentList_xmpProperties(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	packet := `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:xmpRights="http://ns.adobe.com/xap/1.0/rights/" xmlns:stRef="http://ns.adobe.com/xap/1.0/sType/ResourceRef#" xmlns:xmpMM="http://ns.adobe.com/xap/1.0/mm/">
+   <dc:title><rdf:Alt><rdf:li xml:lang="x-default">Title</rdf:li></rdf:Alt></dc:title>
+   <dc:subject><rdf:Bag><rdf:li>one</rdf:li><rdf:li>two</rdf:li></rdf:Bag></dc:subject>
+   <xmpRights:WebStatement rdf:resource="http://example.com/"/>
+   <xmpMM:DerivedFrom stRef:documentID="doc"><stRef:instanceID>instance</stRef:instanceID></xmpMM:DerivedFrom>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`
+
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(16, 16, false))
+
+	s := &Segment{
+		MarkerId:   MARKER_APP1,
+		MarkerName: markerNames[MARKER_APP1],
+		Data:       append(append([]byte{}, xmpPrefix...), packet...),
+	}
+
+	sl.segments = append([]*Segment{sl.segments[0], s}, sl.segments[1:]...)
+
+	properties, err := sl.xmpProperties()
+	log.PanicIf(err)
+
+	expected := map[string]string{
+		"dc:title[x-default]":                "Title",
+		"dc:subject[1]":                      "one",
+		"dc:subject[2]":                      "two",
+		"xmpRights:WebStatement":             "http://example.com/",
+		"xmpMM:DerivedFrom/stRef:documentID": "doc",
+		"xmpMM:DerivedFrom/stRef:instanceID": "instance",
+	}
+
+	if reflect.DeepEqual(properties, expected) != true {
+		t.Fatalf("Properties not correct: %v", properties)
+	}
+}
@@ -0,0 +1,566 @@
+package jpegstructure
+
+import (
+	"fmt"
+
+	"github.com/dsoprea/go-logging"
+)
+
+// scanDecodeStats describes how far the decoding of a single scan got.
+type scanDecodeStats struct {
+	expectedMcus    int
+	decodedMcus     int
+	restartMarkers  int
+	unconsumedBytes int
+
+	// isTruncated is true if decoding failed because the data ran out.
+	isTruncated bool
+}
+
+// huffmanScanDecoder decodes Huffman-coded DCT scans into coefficients.
+type huffmanScanDecoder struct {
+	frame  *SofSegment
+	planes []*ComponentCoefficients
+
+	dcTables [4]*huffmanLookup
+	acTables [4]*huffmanLookup
+
+	restartInterval int
+
+	coverage coefficientCoverage
+}
+
+// scanDecoder decodes the entropy-coded scans of a frame into coefficients
+// (or samples, for lossless frames).
+type scanDecoder interface {
+	// setHuffmanTables installs tables from a DHT segment.
+	setHuffmanTables(tables []*HuffmanTable) error
+
+	// setArithmeticConditioning installs the entries from a DAC segment.
+	setArithmeticConditioning(conditioning []*ArithmeticConditioning) error
+
+	// setRestartInterval sets the interval from a DRI segment.
+	setRestartInterval(interval int)
+
+	// decodeScan decodes the entropy-coded data of one scan.
+	decodeScan(sh *ScanHeader, data []byte) (stats scanDecodeStats, err error)
+
+	// incompleteComponents returns the IDs of the components that don't have
+	// all of their coefficients fully coded.
+	incompleteComponents() (ids []byte)
+
+	// coefficientPlanes returns the coefficients decoded so far.
+	coefficientPlanes() []*ComponentCoefficients
+}
+
+// newScanDecoder returns the decoder for the frame's coding process.
+func newScanDecoder(fh *SofSegment) (sd scanDecoder, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if fh.IsLossless() == true {
+		sd, err = newLosslessScanDecoder(fh)
+		log.PanicIf(err)
+	} else if fh.IsArithmetic() == true {
+		sd, err = newArithmeticScanDecoder(fh)
+		log.PanicIf(err)
+	} else {
+		sd, err = newHuffmanScanDecoder(fh)
+		log.PanicIf(err)
+	}
+
+	return sd, nil
+}
+
+// checkDctFrame makes sure that we can decode the coefficients of the frame.
+func checkDctFrame(fh *SofSegment) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if fh.IsLossless() == true || fh.IsHierarchical() == true {
+		log.Panicf("coding process not supported: [%s]", markerNames[fh.MarkerId])
+	} else if fh.Width == 0 || fh.Height == 0 {
+		log.Panicf("frame dimensions must be known: (%d)x(%d)", fh.Width, fh.Height)
+	} else if len(fh.Components) == 0 {
+		log.Panicf("frame has no components")
+	}
+
+	for _, fc := range fh.Components {
+		if fc.HorizontalSampling < 1 || fc.HorizontalSampling > 4 || fc.VerticalSampling < 1 || fc.VerticalSampling > 4 {
+			log.Panicf("sampling factors not valid for component (%d): (%d)x(%d)", fc.Id, fc.HorizontalSampling, fc.VerticalSampling)
+		}
+	}
+
+	return nil
+}
+
+// newCoefficientPlanes allocates the coefficients for every component of the
+// frame.
+func newCoefficientPlanes(fh *SofSegment) []*ComponentCoefficients {
+	planes := make([]*ComponentCoefficients, len(fh.Components))
+
+	for i := range fh.Components {
+		columns, rows := fh.ComponentBlocks(i)
+
+		planes[i] = newComponentCoefficients(fh.Components[i].Id, columns, rows)
+	}
+
+	return planes
+}
+
+func newHuffmanScanDecoder(fh *SofSegment) (hsd *huffmanScanDecoder, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if fh.IsArithmetic() == true {
+		log.Panicf("frame is arithmetic-coded: [%s]", markerNames[fh.MarkerId])
+	}
+
+	err = checkDctFrame(fh)
+	log.PanicIf(err)
+
+	hsd = &huffmanScanDecoder{
+		frame:    fh,
+		planes:   newCoefficientPlanes(fh),
+		coverage: newCoefficientCoverage(len(fh.Components)),
+	}
+
+	return hsd, nil
+}
+
+// setHuffmanTables installs tables from a DHT segment.
+func (hsd *huffmanScanDecoder) setHuffmanTables(tables []*HuffmanTable) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	for _, ht := range tables {
+		if ht.Id > 3 {
+			log.Panicf("Huffman table ID not valid: (%d)", ht.Id)
+		}
+
+		hl, err := newHuffmanLookup(ht)
+		log.PanicIf(err)
+
+		if ht.Class == HuffmanClassDc {
+			hsd.dcTables[ht.Id] = hl
+		} else {
+			hsd.acTables[ht.Id] = hl
+		}
+	}
+
+	return nil
+}
+
+// setArithmeticConditioning ignores the DAC segments, which have no effect on
+// Huffman coding.
+func (hsd *huffmanScanDecoder) setArithmeticConditioning(conditioning []*ArithmeticConditioning) error {
+	return nil
+}
+
+func (hsd *huffmanScanDecoder) setRestartInterval(interval int) {
+	hsd.restartInterval = interval
+}
+
+func (hsd *huffmanScanDecoder) coefficientPlanes() []*ComponentCoefficients {
+	return hsd.planes
+}
+
+// scanComponent has the state for one component of the current scan.
+type scanComponent struct {
+	frameIndex int
+	plane      *ComponentCoefficients
+	dcTable    *huffmanLookup
+	acTable    *huffmanLookup
+	hSampling  int
+	vSampling  int
+	predictor  int32
+}
+
+// scanMcuLayout returns the number of MCU columns and rows in the scan.
+func scanMcuLayout(fh *SofSegment, sh *ScanHeader) (columns, rows int) {
+	if len(sh.Components) == 1 {
+		i := fh.ComponentIndex(sh.Components[0].ComponentId)
+		return fh.ComponentVisibleBlocks(i)
+	}
+
+	return fh.McuCount()
+}
+
+func (hsd *huffmanScanDecoder) checkScanParameters(sh *ScanHeader) (components []*scanComponent, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	fh := hsd.frame
+
+	indices, err := checkScanHeader(fh, sh)
+	log.PanicIf(err)
+
+	components = make([]*scanComponent, len(sh.Components))
+
+	for i, sc := range sh.Components {
+		j := indices[i]
+		fc := fh.Components[j]
+
+		c := &scanComponent{
+			frameIndex: j,
+			plane:      hsd.planes[j],
+			dcTable:    hsd.dcTables[sc.DcTableId],
+			acTable:    hsd.acTables[sc.AcTableId],
+			hSampling:  int(fc.HorizontalSampling),
+			vSampling:  int(fc.VerticalSampling),
+		}
+
+		if sh.SpectralStart == 0 && sh.ApproximationHigh == 0 && c.dcTable == nil {
+			log.Panicf("DC Huffman table (%d) not defined", sc.DcTableId)
+		} else if sh.SpectralEnd > 0 && c.acTable == nil {
+			log.Panicf("AC Huffman table (%d) not defined", sc.AcTableId)
+		}
+
+		components[i] = c
+	}
+
+	err = hsd.coverage.update(fh, indices, sh)
+	log.PanicIf(err)
+
+	return components, nil
+}
+
+// incompleteComponents returns the IDs of the components that don't have all
+// of their coefficients fully coded.
+func (hsd *huffmanScanDecoder) incompleteComponents() (ids []byte) {
+	return hsd.coverage.incompleteComponents(hsd.frame)
+}
+
+// decodeScan decodes the entropy-coded data of one scan. Whatever was
+// decoded before a failure is kept and the stats reflect how far we got.
+func (hsd *huffmanScanDecoder) decodeScan(sh *ScanHeader, data []byte) (stats scanDecodeStats, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	components, err := hsd.checkScanParameters(sh)
+	log.PanicIf(err)
+
+	mcuColumns, mcuRows := scanMcuLayout(hsd.frame, sh)
+	stats.expectedMcus = mcuColumns * mcuRows
+
+	decodeBlock := hsd.blockDecoder(sh)
+
+	er := newEntropyReader(data)
+	eobrun := 0
+
+	for mcu := 0; mcu < stats.expectedMcus; mcu++ {
+		if hsd.restartInterval > 0 && mcu > 0 && mcu%hsd.restartInterval == 0 {
+			expected := stats.restartMarkers % 8
+
+			err := er.processRestart(expected)
+			if err != nil {
+				stats.isTruncated = err == ErrEntropyTruncated
+
+				log.Panicf("restart failed before MCU (%d) of (%d): %s", mcu, stats.expectedMcus, err.Error())
+			}
+
+			stats.restartMarkers++
+
+			for _, c := range components {
+				c.predictor = 0
+			}
+
+			eobrun = 0
+		}
+
+		mcuColumn := mcu % mcuColumns
+		mcuRow := mcu / mcuColumns
+
+		if len(components) == 1 {
+			c := components[0]
+
+			err := decodeBlock(er, c, c.plane.Block(mcuColumn, mcuRow), &eobrun)
+			if err != nil {
+				// If the zeros supplied past the end of the data made an invalid code,
+				// the data is short rather than damaged.
+				stats.isTruncated = er.overrun > 0 && er.markerReached == false
+
+				log.Panicf("could not decode MCU (%d) of (%d) at byte (%d): %s", mcu, stats.expectedMcus, er.bytePosition(), err.Error())
+			}
+		} else {
+			for _, c := range components {
+				for v := 0; v < c.vSampling; v++ {
+					for h := 0; h < c.hSampling; h++ {
+						block := c.plane.Block(mcuColumn*c.hSampling+h, mcuRow*c.vSampling+v)
+
+						err := decodeBlock(er, c, block, &eobrun)
+						if err != nil {
+							stats.isTruncated = er.overrun > 0 && er.markerReached == false
+
+							log.Panicf("could not decode MCU (%d) of (%d) at byte (%d): %s", mcu, stats.expectedMcus, er.bytePosition(), err.Error())
+						}
+					}
+				}
+			}
+		}
+
+		if er.overrun > 0 {
+			// If we stopped at a restart marker then the data is damaged
+			// rather than short.
+			stats.isTruncated = er.markerReached == false
+
+			log.Panicf("entropy-coded data ended in MCU (%d) of (%d)", mcu, stats.expectedMcus)
+		}
+
+		stats.decodedMcus = mcu + 1
+	}
+
+	stats.unconsumedBytes = len(data) - er.bytePosition()
+
+	return stats, nil
+}
+
+type blockDecoderFunc func(er *entropyReader, c *scanComponent, block *CoefficientBlock, eobrun *int) error
+
+func (hsd *huffmanScanDecoder) blockDecoder(sh *ScanHeader) blockDecoderFunc {
+	ss := int(sh.SpectralStart)
+	se := int(sh.SpectralEnd)
+	al := uint(sh.ApproximationLow)
+
+	if hsd.frame.IsProgressive() == false {
+		return decodeBlockSequential
+	} else if ss == 0 {
+		if sh.ApproximationHigh == 0 {
+			return func(er *entropyReader, c *scanComponent, block *CoefficientBlock, eobrun *int) error {
+				return decodeBlockDcFirst(er, c, block, al)
+			}
+		}
+
+		return func(er *entropyReader, c *scanComponent, block *CoefficientBlock, eobrun *int) error {
+			if er.readBit() != 0 {
+				block[0] |= 1 << al
+			}
+
+			return nil
+		}
+	} else if sh.ApproximationHigh == 0 {
+		return func(er *entropyReader, c *scanComponent, block *CoefficientBlock, eobrun *int) error {
+			return decodeBlockAcFirst(er, c, block, ss, se, al, eobrun)
+		}
+	}
+
+	return func(er *entropyReader, c *scanComponent, block *CoefficientBlock, eobrun *int) error {
+		return decodeBlockAcRefine(er, c, block, ss, se, al, eobrun)
+	}
+}
+
+func decodeDcDifference(er *entropyReader, c *scanComponent) (err error) {
+	t, err := er.decodeHuffman(c.dcTable)
+	if err != nil {
+		return err
+	} else if t > 16 {
+		return fmt.Errorf("DC magnitude category not valid: (%d)", t)
+	}
+
+	c.predictor += er.receiveExtend(uint(t))
+
+	return nil
+}
+
+func decodeBlockSequential(er *entropyReader, c *scanComponent, block *CoefficientBlock, eobrun *int) (err error) {
+	err = decodeDcDifference(er, c)
+	if err != nil {
+		return err
+	}
+
+	block[0] = int16(c.predictor)
+
+	for k := 1; k < 64; k++ {
+		rs, err := er.decodeHuffman(c.acTable)
+		if err != nil {
+			return err
+		}
+
+		r := int(rs >> 4)
+		s := uint(rs & 0x0f)
+
+		if s == 0 {
+			if r != 15 {
+				break
+			}
+
+			k += 15
+			continue
+		}
+
+		k += r
+		if k > 63 {
+			return fmt.Errorf("AC coefficient index out of range: (%d)", k)
+		}
+
+		block[zigzag[k]] = int16(er.receiveExtend(s))
+	}
+
+	return nil
+}
+
+func decodeBlockDcFirst(er *entropyReader, c *scanComponent, block *CoefficientBlock, al uint) (err error) {
+	err = decodeDcDifference(er, c)
+	if err != nil {
+		return err
+	}
+
+	block[0] = int16(c.predictor << al)
+
+	return nil
+}
+
+func decodeBlockAcFirst(er *entropyReader, c *scanComponent, block *CoefficientBlock, ss, se int, al uint, eobrun *int) (err error) {
+	if *eobrun > 0 {
+		*eobrun--
+		return nil
+	}
+
+	for k := ss; k <= se; k++ {
+		rs, err := er.decodeHuffman(c.acTable)
+		if err != nil {
+			return err
+		}
+
+		r := int(rs >> 4)
+		s := uint(rs & 0x0f)
+
+		if s == 0 {
+			if r != 15 {
+				*eobrun = 1<<uint(r) - 1
+
+				if r > 0 {
+					*eobrun += int(er.readBits(uint(r)))
+				}
+
+				break
+			}
+
+			k += 15
+			continue
+		}
+
+		k += r
+		if k > 63 {
+			return fmt.Errorf("AC coefficient index out of range: (%d)", k)
+		}
+
+		block[zigzag[k]] = int16(er.receiveExtend(s) << al)
+	}
+
+	return nil
+}
+
+// refineNonZero applies a correction bit to an already non-zero coefficient.
+func refineNonZero(er *entropyReader, coefficient *int16, p1 int16) {
+	if er.readBit() == 0 {
+		return
+	}
+
+	if *coefficient&p1 != 0 {
+		return
+	}
+
+	if *coefficient >= 0 {
+		*coefficient += p1
+	} else {
+		*coefficient -= p1
+	}
+}
+
+// decodeBlockAcRefine implements the AC successive-approximation refinement
+// (T.81 G.1.2.3).
+func decodeBlockAcRefine(er *entropyReader, c *scanComponent, block *CoefficientBlock, ss, se int, al uint, eobrun *int) (err error) {
+	p1 := int16(1) << al
+	k := ss
+
+	if *eobrun == 0 {
+		for ; k <= se; k++ {
+			rs, err := er.decodeHuffman(c.acTable)
+			if err != nil {
+				return err
+			}
+
+			r := int(rs >> 4)
+			s := int(rs & 0x0f)
+
+			value := int16(0)
+			if s != 0 {
+				if s != 1 {
+					return fmt.Errorf("refinement magnitude not valid: (%d)", s)
+				}
+
+				if er.readBit() != 0 {
+					value = p1
+				} else {
+					value = -p1
+				}
+			} else if r != 15 {
+				*eobrun = 1 << uint(r)
+
+				if r > 0 {
+					*eobrun += int(er.readBits(uint(r)))
+				}
+
+				break
+			}
+
+			// Skip `r` zero-valued coefficients, refining the non-zero ones
+			// that we pass over.
+			for ; k <= se; k++ {
+				coefficient := &block[zigzag[k]]
+
+				if *coefficient != 0 {
+					refineNonZero(er, coefficient, p1)
+				} else {
+					if r == 0 {
+						break
+					}
+
+					r--
+				}
+			}
+
+			if value != 0 {
+				if k > se {
+					return fmt.Errorf("refinement coefficient index out of range: (%d)", k)
+				}
+
+				block[zigzag[k]] = value
+			}
+		}
+	}
+
+	if *eobrun > 0 {
+		// Refine the remaining non-zero coefficients in the band.
+		for ; k <= se; k++ {
+			coefficient := &block[zigzag[k]]
+
+			if *coefficient != 0 {
+				refineNonZero(er, coefficient, p1)
+			}
+		}
+
+		*eobrun--
+	}
+
+	return nil
+}
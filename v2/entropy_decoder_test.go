@@ -0,0 +1,128 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"testing"
+
+	"github.com/dsoprea/go-logging"
+)
+
+func TestHuffmanScanDecoder_DecodeScan(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	// A flat image only has DC coefficients and they're all the same.
+
+	img := image.NewGray(image.Rect(0, 0, 24, 16))
+	for i := range img.Pix {
+		img.Pix[i] = 200
+	}
+
+	b := new(bytes.Buffer)
+
+	err := jpeg.Encode(b, img, &jpeg.Options{Quality: 90})
+	log.PanicIf(err)
+
+	jmp := NewJpegMediaParser()
+
+	intfc, err := jmp.ParseBytes(b.Bytes())
+	log.PanicIf(err)
+
+	sl := intfc.(*SegmentList)
+
+	segments, err := sl.expandedSegments()
+	log.PanicIf(err)
+
+	var hsd *huffmanScanDecoder
+	var tables []*HuffmanTable
+	var sh *ScanHeader
+	var data []byte
+
+	for i, s := range segments {
+		if s.MarkerId == MARKER_DHT {
+			tables, err = ParseHuffmanTables(s.Data)
+			log.PanicIf(err)
+		} else if s.MarkerId == MARKER_SOF0 {
+			fh, err := ParseSofSegment(s.MarkerId, s.Data)
+			log.PanicIf(err)
+
+			hsd, err = newHuffmanScanDecoder(fh)
+			log.PanicIf(err)
+		} else if s.MarkerId == MARKER_SOS {
+			sh, err = ParseScanHeader(s.Data)
+			log.PanicIf(err)
+
+			data = segments[i+1].Data
+		}
+	}
+
+	err = hsd.setHuffmanTables(tables)
+	log.PanicIf(err)
+
+	if ids := hsd.incompleteComponents(); len(ids) != 1 {
+		t.Fatalf("Expected component to be incomplete before decoding: %v", ids)
+	}
+
+	stats, err := hsd.decodeScan(sh, data)
+	log.PanicIf(err)
+
+	if stats.expectedMcus != 6 || stats.decodedMcus != 6 {
+		t.Fatalf("MCU counts not correct: %v", stats)
+	} else if ids := hsd.incompleteComponents(); len(ids) != 0 {
+		t.Fatalf("Expected all components to be complete: %v", ids)
+	}
+
+	plane := hsd.planes[0]
+	if plane.BlocksWide != 3 || plane.BlocksHigh != 2 {
+		t.Fatalf("Plane dimensions not correct: (%d)x(%d)", plane.BlocksWide, plane.BlocksHigh)
+	}
+
+	dc := plane.Blocks[0][0]
+	if dc <= 0 {
+		t.Fatalf("DC not correct: (%d)", dc)
+	}
+
+	for i, block := range plane.Blocks {
+		if block[0] != dc {
+			t.Fatalf("DC of block (%d) not correct: (%d) != (%d)", i, block[0], dc)
+		}
+
+		for k := 1; k < 64; k++ {
+			if block[k] != 0 {
+				t.Fatalf("AC (%d) of block (%d) not zero: (%d)", k, i, block[k])
+			}
+		}
+	}
+}
+
+func TestNewHuffmanScanDecoder_Unsupported(t *testing.T) {
+	fh := &SofSegment{
+		MarkerId:      MARKER_SOF3,
+		BitsPerSample: 8,
+		Width:         8,
+		Height:        8,
+		Components: []FrameComponent{
+			{Id: 1, HorizontalSampling: 1, VerticalSampling: 1},
+		},
+	}
+
+	_, err := newHuffmanScanDecoder(fh)
+	if err == nil {
+		t.Fatalf("Expected error for lossless frame.")
+	}
+
+	fh.MarkerId = MARKER_SOF0
+	fh.Components[0].HorizontalSampling = 0
+
+	_, err = newHuffmanScanDecoder(fh)
+	if err == nil {
+		t.Fatalf("Expected error for sampling factors.")
+	}
+}
@@ -0,0 +1,218 @@
+package jpegstructure
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"sort"
+
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+
+	"github.com/dsoprea/go-logging"
+)
+
+var (
+	// ErrNoImageData is returned when there's no frame to fingerprint.
+	ErrNoImageData = errors.New("no image data")
+)
+
+const (
+	// perceptualHashSampleSize is the size of the grayscale image that the
+	// perceptual hash is computed from.
+	perceptualHashSampleSize = 32
+
+	// perceptualHashSize is the number of low frequencies (on each axis) that
+	// make up the perceptual hash.
+	perceptualHashSize = 8
+)
+
+// isContentSegment returns true if the segment defines the image, rather than
+// describing it.
+func isContentSegment(markerId byte) bool {
+	return markerId == MARKER_SOS || markerId == 0 || isImageDataSegment(markerId) == true
+}
+
+// ContentFingerprint returns a SHA-256 digest of just the segments that define
+// the image: the frame, the tables, the scan headers, and the scan data.
+// Application segments, comments, and the trailer are ignored, so the
+// fingerprint doesn't change when the metadata is edited and it can be used
+// to find copies of the same image with different metadata.
+//
+// Note that this identifies the encoded image. Re-encoding or transforming it
+// (even losslessly) changes the fingerprint, but changing the EXIF orientation
+// doesn't. Use `PerceptualHash` to find images that look the same.
+func (sl *SegmentList) ContentFingerprint() (digest []byte, err error) {
+	h := sha256.New()
+
+	hasFrame := false
+	header := make([]byte, 5)
+
+	for _, s := range sl.segments {
+		if isContentSegment(s.MarkerId) == false {
+			continue
+		}
+
+		if isSofMarker(s.MarkerId) == true {
+			hasFrame = true
+		}
+
+		// Include the marker and length so that the boundaries between
+		// segments are part of the digest.
+
+		header[0] = s.MarkerId
+		binary.BigEndian.PutUint32(header[1:], uint32(len(s.Data)))
+
+		h.Write(header)
+		h.Write(s.Data)
+	}
+
+	if hasFrame == false {
+		return nil, ErrNoImageData
+	}
+
+	return h.Sum(nil), nil
+}
+
+// PerceptualHash is a 64-bit hash of the appearance of an image. Images that
+// look alike have hashes that differ in few bits.
+type PerceptualHash uint64
+
+// Distance returns the number of bits that differ between the two hashes.
+// Roughly, ten or fewer indicate the same picture.
+func (ph PerceptualHash) Distance(other PerceptualHash) int {
+	return bits.OnesCount64(uint64(ph ^ other))
+}
+
+// String returns the hash as hex.
+func (ph PerceptualHash) String() string {
+	return fmt.Sprintf("%016x", uint64(ph))
+}
+
+// perceptualHashSample returns the luminance of the image averaged down to a
+// square grid.
+func perceptualHashSample(img image.Image) (sample [][]float64) {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	sample = make([][]float64, perceptualHashSampleSize)
+
+	for i := 0; i < perceptualHashSampleSize; i++ {
+		sample[i] = make([]float64, perceptualHashSampleSize)
+
+		y0 := i * height / perceptualHashSampleSize
+		y1 := (i + 1) * height / perceptualHashSampleSize
+
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+
+		for j := 0; j < perceptualHashSampleSize; j++ {
+			x0 := j * width / perceptualHashSampleSize
+			x1 := (j + 1) * width / perceptualHashSampleSize
+
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			sum := 0.0
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+				}
+			}
+
+			sample[i][j] = sum / float64((y1-y0)*(x1-x0))
+		}
+	}
+
+	return sample
+}
+
+// PerceptualHashImage returns the perceptual hash of the image. The image is
+// reduced to a small grayscale sample, and each bit says whether one of the
+// lowest frequencies of its DCT is above the median of them.
+func PerceptualHashImage(img image.Image) PerceptualHash {
+	if img.Bounds().Empty() == true {
+		return 0
+	}
+
+	sample := perceptualHashSample(img)
+
+	n := float64(perceptualHashSampleSize)
+
+	cosines := make([][]float64, perceptualHashSize)
+	for u := 0; u < perceptualHashSize; u++ {
+		cosines[u] = make([]float64, perceptualHashSampleSize)
+
+		for x := 0; x < perceptualHashSampleSize; x++ {
+			cosines[u][x] = math.Cos((2*float64(x) + 1) * float64(u) * math.Pi / (2 * n))
+		}
+	}
+
+	// Transform the rows and then the columns, for just the frequencies that
+	// we need.
+
+	rows := make([][]float64, perceptualHashSampleSize)
+	for y := 0; y < perceptualHashSampleSize; y++ {
+		rows[y] = make([]float64, perceptualHashSize)
+
+		for u := 0; u < perceptualHashSize; u++ {
+			for x := 0; x < perceptualHashSampleSize; x++ {
+				rows[y][u] += sample[y][x] * cosines[u][x]
+			}
+		}
+	}
+
+	coefficients := make([]float64, perceptualHashSize*perceptualHashSize)
+	for v := 0; v < perceptualHashSize; v++ {
+		for u := 0; u < perceptualHashSize; u++ {
+			sum := 0.0
+			for y := 0; y < perceptualHashSampleSize; y++ {
+				sum += rows[y][u] * cosines[v][y]
+			}
+
+			coefficients[v*perceptualHashSize+u] = sum
+		}
+	}
+
+	// The DC term is the overall brightness and would skew the median.
+
+	sorted := make([]float64, len(coefficients)-1)
+	copy(sorted, coefficients[1:])
+	sort.Float64s(sorted)
+
+	median := sorted[len(sorted)/2]
+
+	var ph PerceptualHash
+	for _, coefficient := range coefficients {
+		ph <<= 1
+
+		if coefficient > median {
+			ph |= 1
+		}
+	}
+
+	return ph
+}
+
+// PerceptualHash decodes the image, applies the EXIF orientation, and returns
+// its perceptual hash. Unlike `ContentFingerprint`, this survives
+// re-encoding, resizing, and small edits, and can be used to find
+// near-duplicates.
+func (sl *SegmentList) PerceptualHash() (ph PerceptualHash, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	img, err := sl.OrientedImage()
+	log.PanicIf(err)
+
+	return PerceptualHashImage(img), nil
+}
@@ -0,0 +1,192 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"image"
+	"testing"
+
+	"image/color"
+	"image/jpeg"
+
+	"github.com/dsoprea/go-logging"
+)
+
+func TestSegmentList_ContentFingerprint(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	data := getTestGeneratedJpeg(64, 48, false)
+
+	sl := getCoefficientsTestSegmentList(data)
+
+	original, err := sl.ContentFingerprint()
+	log.PanicIf(err)
+
+	// Metadata edits don't change it.
+
+	rootIb, err := sl.ConstructExifBuilder()
+	log.PanicIf(err)
+
+	err = sl.SetExif(rootIb)
+	log.PanicIf(err)
+
+	sl.AddComment("edited")
+	sl.SetTrailer([]byte("trailer"))
+
+	sl, _ = reparseSegmentList(sl)
+
+	edited, err := sl.ContentFingerprint()
+	log.PanicIf(err)
+
+	if bytes.Equal(edited, original) != true {
+		t.Fatalf("Fingerprint changed with the metadata.")
+	}
+
+	// Changes to the image do.
+
+	err = sl.Transform(TransformFlipHorizontal, nil)
+	log.PanicIf(err)
+
+	transformed, err := sl.ContentFingerprint()
+	log.PanicIf(err)
+
+	if bytes.Equal(transformed, original) == true {
+		t.Fatalf("Fingerprint didn't change with the image.")
+	}
+
+	sl = getCoefficientsTestSegmentList(data)
+
+	err = sl.Reencode(&WriteCoefficientsOptions{Progressive: true})
+	log.PanicIf(err)
+
+	reencoded, err := sl.ContentFingerprint()
+	log.PanicIf(err)
+
+	if bytes.Equal(reencoded, original) == true {
+		t.Fatalf("Fingerprint didn't change with the encoding.")
+	}
+}
+
+func TestSegmentList_ContentFingerprint_NoImage(t *testing.T) {
+	sl := NewSegmentList([]*Segment{
+		{MarkerId: MARKER_SOI, MarkerName: markerNames[MARKER_SOI]},
+		{MarkerId: MARKER_EOI, MarkerName: markerNames[MARKER_EOI]},
+	})
+
+	if _, err := sl.ContentFingerprint(); err != ErrNoImageData {
+		t.Fatalf("Expected no image data: %v", err)
+	}
+}
+
+func TestPerceptualHash_Distance(t *testing.T) {
+	ph := PerceptualHash(0xf0)
+
+	if ph.Distance(0x0f) != 8 || ph.Distance(ph) != 0 {
+		t.Fatalf("Distance not correct.")
+	} else if ph.String() != "00000000000000f0" {
+		t.Fatalf("String not correct: [%s]", ph)
+	}
+}
+
+// getPerceptualHashTestJpeg returns a picture with some large shapes, drawn
+// in proportion to the size.
+func getPerceptualHashTestJpeg(width, height, quality int, isGray bool) []byte {
+	r := image.Rect(0, 0, width, height)
+
+	var img interface {
+		image.Image
+		Set(x, y int, c color.Color)
+	}
+
+	if isGray == true {
+		img = image.NewGray(r)
+	} else {
+		img = image.NewRGBA(r)
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			u := float64(x) / float64(width)
+			v := float64(y) / float64(height)
+
+			c := color.RGBA{R: uint8(u * 200), G: 40, B: uint8(v * 200), A: 0xff}
+
+			if (u-0.3)*(u-0.3)+(v-0.35)*(v-0.35) < 0.04 {
+				c = color.RGBA{R: 250, G: 230, B: 40, A: 0xff}
+			} else if u > 0.6 && u < 0.9 && v > 0.55 && v < 0.85 {
+				c = color.RGBA{R: 20, G: 20, B: 60, A: 0xff}
+			}
+
+			img.Set(x, y, c)
+		}
+	}
+
+	b := new(bytes.Buffer)
+
+	err := jpeg.Encode(b, img, &jpeg.Options{Quality: quality})
+	log.PanicIf(err)
+
+	return b.Bytes()
+}
+
+func TestSegmentList_PerceptualHash(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	data := getPerceptualHashTestJpeg(160, 128, 90, false)
+
+	original, err := getCoefficientsTestSegmentList(data).PerceptualHash()
+	log.PanicIf(err)
+
+	// Heavier compression, a smaller size, and grayscale still look the same.
+
+	similar := [][]byte{
+		getPerceptualHashTestJpeg(160, 128, 20, false),
+		getPerceptualHashTestJpeg(80, 64, 90, false),
+		getPerceptualHashTestJpeg(160, 128, 90, true),
+	}
+
+	for i, other := range similar {
+		ph, err := getCoefficientsTestSegmentList(other).PerceptualHash()
+		log.PanicIf(err)
+
+		if distance := original.Distance(ph); distance > 4 {
+			t.Fatalf("Similar image (%d) too far: (%d) [%s] [%s]", i, distance, original, ph)
+		}
+	}
+
+	// A flipped image doesn't, unless the orientation flips it back.
+
+	sl := getCoefficientsTestSegmentList(data)
+
+	err = sl.Transform(TransformFlipVertical, nil)
+	log.PanicIf(err)
+
+	flipped, err := sl.PerceptualHash()
+	log.PanicIf(err)
+
+	if distance := original.Distance(flipped); distance < 16 {
+		t.Fatalf("Flipped image too close: (%d)", distance)
+	}
+
+	_, flippedData := reparseSegmentList(sl)
+
+	sl = getOrientationTestSegmentList(flippedData, 4)
+
+	oriented, err := sl.PerceptualHash()
+	log.PanicIf(err)
+
+	if distance := original.Distance(oriented); distance > 2 {
+		t.Fatalf("Oriented image too far: (%d)", distance)
+	}
+}
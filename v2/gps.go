@@ -0,0 +1,403 @@
+package jpegstructure
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/dsoprea/go-exif/v3"
+	"github.com/dsoprea/go-exif/v3/common"
+	"github.com/dsoprea/go-logging"
+)
+
+const (
+	// exifGpsIfdTagId is the tag (in the first IFD) that points to the GPS
+	// IFD.
+	exifGpsIfdTagId = uint16(0x8825)
+
+	gpsLatitudeRefTagId       = uint16(0x0001)
+	gpsLatitudeTagId          = uint16(0x0002)
+	gpsLongitudeRefTagId      = uint16(0x0003)
+	gpsLongitudeTagId         = uint16(0x0004)
+	gpsAltitudeRefTagId       = uint16(0x0005)
+	gpsAltitudeTagId          = uint16(0x0006)
+	gpsTimeStampTagId         = uint16(0x0007)
+	gpsImageDirectionRefTagId = uint16(0x0010)
+	gpsImageDirectionTagId    = uint16(0x0011)
+	gpsDateStampTagId         = uint16(0x001d)
+
+	// gpsDateStampLayout is the layout of the GPS date.
+	gpsDateStampLayout = "2006:01:02"
+)
+
+var (
+	// ErrNoGps is returned if GPS data was requested but there's no EXIF, no
+	// GPS IFD, or no position in it.
+	ErrNoGps = errors.New("no GPS data")
+)
+
+// GpsInfo is the position (and what goes with it) from the GPS IFD, in
+// decimal.
+type GpsInfo struct {
+	// Latitude is in degrees. It's negative in the south.
+	Latitude float64
+
+	// Longitude is in degrees. It's negative in the west.
+	Longitude float64
+
+	// HasAltitude is true if there's an altitude.
+	HasAltitude bool
+
+	// Altitude is in meters. It's negative below sea level.
+	Altitude float64
+
+	// Timestamp is when the position was taken, in UTC. It's zero if there's
+	// no date or time.
+	Timestamp time.Time
+
+	// HasImageDirection is true if there's an image direction.
+	HasImageDirection bool
+
+	// ImageDirection is the direction that the camera was pointed in, in
+	// degrees from north.
+	ImageDirection float64
+
+	// IsMagneticDirection is true if the direction is from magnetic north
+	// rather than true north.
+	IsMagneticDirection bool
+}
+
+// String returns a descriptive string.
+func (gi *GpsInfo) String() string {
+	return fmt.Sprintf("GpsInfo<LAT=(%.06f) LON=(%.06f) ALT=(%.02f) TIME=[%s]>", gi.Latitude, gi.Longitude, gi.Altitude, gi.Timestamp)
+}
+
+// gpsRationals returns the rationals of the tag as floats. `found` is false
+// if the tag isn't there.
+func gpsRationals(ifd *exif.Ifd, tagId uint16, count int) (values []float64, found bool, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	results, err := ifd.FindTagWithId(tagId)
+	if err != nil {
+		if log.Is(err, exif.ErrTagNotFound) == true {
+			return nil, false, nil
+		}
+
+		log.Panic(err)
+	}
+
+	value, err := results[0].Value()
+	log.PanicIf(err)
+
+	rationals, ok := value.([]exifcommon.Rational)
+	if ok == false || len(rationals) < count {
+		log.Panicf("GPS tag (0x%04x) not valid: %v", tagId, value)
+	}
+
+	values = make([]float64, count)
+	for i := range values {
+		if rationals[i].Denominator == 0 {
+			log.Panicf("GPS tag (0x%04x) has a zero denominator", tagId)
+		}
+
+		values[i] = float64(rationals[i].Numerator) / float64(rationals[i].Denominator)
+	}
+
+	return values, true, nil
+}
+
+// gpsString returns the value of an ASCII tag, or an empty string if the tag
+// isn't there.
+func gpsString(ifd *exif.Ifd, tagId uint16) (value string, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	results, err := ifd.FindTagWithId(tagId)
+	if err != nil {
+		if log.Is(err, exif.ErrTagNotFound) == true {
+			return "", nil
+		}
+
+		log.Panic(err)
+	}
+
+	raw, err := results[0].Value()
+	log.PanicIf(err)
+
+	value, ok := raw.(string)
+	if ok == false {
+		log.Panicf("GPS tag (0x%04x) not a string: %v", tagId, raw)
+	}
+
+	return strings.TrimSpace(value), nil
+}
+
+// GpsInfo returns the GPS data. `ErrNoGps` is returned if there's no EXIF, no
+// GPS IFD, or no position.
+func (sl *SegmentList) GpsInfo() (gi *GpsInfo, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	rootIfd, _, err := sl.Exif()
+	if err != nil {
+		if log.Is(err, exif.ErrNoExif) == true {
+			return nil, ErrNoGps
+		}
+
+		log.Panic(err)
+	}
+
+	gpsIfd, err := rootIfd.ChildWithIfdPath(exifcommon.IfdGpsInfoStandardIfdIdentity)
+	if err != nil {
+		if log.Is(err, exif.ErrTagNotFound) == true {
+			return nil, ErrNoGps
+		}
+
+		log.Panic(err)
+	}
+
+	latitude, foundLatitude, err := gpsRationals(gpsIfd, gpsLatitudeTagId, 3)
+	log.PanicIf(err)
+
+	longitude, foundLongitude, err := gpsRationals(gpsIfd, gpsLongitudeTagId, 3)
+	log.PanicIf(err)
+
+	if foundLatitude == false || foundLongitude == false {
+		return nil, ErrNoGps
+	}
+
+	gi = &GpsInfo{
+		Latitude:  latitude[0] + latitude[1]/60 + latitude[2]/3600,
+		Longitude: longitude[0] + longitude[1]/60 + longitude[2]/3600,
+	}
+
+	latitudeRef, err := gpsString(gpsIfd, gpsLatitudeRefTagId)
+	log.PanicIf(err)
+
+	if latitudeRef == "S" {
+		gi.Latitude = -gi.Latitude
+	}
+
+	longitudeRef, err := gpsString(gpsIfd, gpsLongitudeRefTagId)
+	log.PanicIf(err)
+
+	if longitudeRef == "W" {
+		gi.Longitude = -gi.Longitude
+	}
+
+	altitude, found, err := gpsRationals(gpsIfd, gpsAltitudeTagId, 1)
+	log.PanicIf(err)
+
+	if found == true {
+		gi.HasAltitude = true
+		gi.Altitude = altitude[0]
+
+		results, err := gpsIfd.FindTagWithId(gpsAltitudeRefTagId)
+		if err == nil {
+			value, err := results[0].Value()
+			log.PanicIf(err)
+
+			if raw, ok := value.([]byte); ok == true && len(raw) > 0 && raw[0] == 1 && gi.Altitude != 0 {
+				gi.Altitude = -gi.Altitude
+			}
+		} else if log.Is(err, exif.ErrTagNotFound) == false {
+			log.Panic(err)
+		}
+	}
+
+	timeStamp, foundTimeStamp, err := gpsRationals(gpsIfd, gpsTimeStampTagId, 3)
+	log.PanicIf(err)
+
+	dateStamp, err := gpsString(gpsIfd, gpsDateStampTagId)
+	log.PanicIf(err)
+
+	if foundTimeStamp == true && dateStamp != "" {
+		date, err := time.Parse(gpsDateStampLayout, dateStamp)
+		log.PanicIf(err)
+
+		seconds := timeStamp[0]*3600 + timeStamp[1]*60 + timeStamp[2]
+		gi.Timestamp = date.Add(time.Duration(math.Round(seconds*1000)) * time.Millisecond)
+	}
+
+	direction, found, err := gpsRationals(gpsIfd, gpsImageDirectionTagId, 1)
+	log.PanicIf(err)
+
+	if found == true {
+		gi.HasImageDirection = true
+		gi.ImageDirection = direction[0]
+
+		directionRef, err := gpsString(gpsIfd, gpsImageDirectionRefTagId)
+		log.PanicIf(err)
+
+		gi.IsMagneticDirection = directionRef == "M"
+	}
+
+	return gi, nil
+}
+
+// gpsDegreesRationals returns degrees, minutes, and seconds (to a thousandth).
+func gpsDegreesRationals(decimal float64) []exifcommon.Rational {
+	// Round once, so that the seconds never carry into the minutes.
+	total := uint32(math.Round(math.Abs(decimal) * 3600 * 1000))
+
+	return []exifcommon.Rational{
+		{Numerator: total / 3600000, Denominator: 1},
+		{Numerator: total / 60000 % 60, Denominator: 1},
+		{Numerator: total % 60000, Denominator: 1000},
+	}
+}
+
+// SetGps replaces the GPS IFD with one that has the given data. The EXIF
+// segment is created if there isn't one.
+func (sl *SegmentList) SetGps(gi *GpsInfo) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if gi.Latitude < -90 || gi.Latitude > 90 || math.IsNaN(gi.Latitude) == true {
+		log.Panicf("latitude not valid: (%f)", gi.Latitude)
+	} else if gi.Longitude < -180 || gi.Longitude > 180 || math.IsNaN(gi.Longitude) == true {
+		log.Panicf("longitude not valid: (%f)", gi.Longitude)
+	} else if gi.HasImageDirection == true && (gi.ImageDirection < 0 || gi.ImageDirection >= 360) {
+		log.Panicf("image direction not valid: (%f)", gi.ImageDirection)
+	} else if gi.HasAltitude == true && (math.IsNaN(gi.Altitude) == true || math.Abs(gi.Altitude) >= math.MaxUint32/1000) {
+		log.Panicf("altitude not valid: (%f)", gi.Altitude)
+	}
+
+	rootIb, err := sl.ConstructExifBuilder()
+	log.PanicIf(err)
+
+	_, err = rootIb.DeleteAll(exifGpsIfdTagId)
+	log.PanicIf(err)
+
+	gpsIb, err := exif.GetOrCreateIbFromRootIb(rootIb, "IFD/GPSInfo")
+	log.PanicIf(err)
+
+	err = gpsIb.AddStandardWithName("GPSVersionID", []byte{2, 2, 0, 0})
+	log.PanicIf(err)
+
+	latitudeRef := "N"
+	if gi.Latitude < 0 {
+		latitudeRef = "S"
+	}
+
+	err = gpsIb.AddStandardWithName("GPSLatitudeRef", latitudeRef)
+	log.PanicIf(err)
+
+	err = gpsIb.AddStandardWithName("GPSLatitude", gpsDegreesRationals(gi.Latitude))
+	log.PanicIf(err)
+
+	longitudeRef := "E"
+	if gi.Longitude < 0 {
+		longitudeRef = "W"
+	}
+
+	err = gpsIb.AddStandardWithName("GPSLongitudeRef", longitudeRef)
+	log.PanicIf(err)
+
+	err = gpsIb.AddStandardWithName("GPSLongitude", gpsDegreesRationals(gi.Longitude))
+	log.PanicIf(err)
+
+	if gi.HasAltitude == true {
+		altitudeRef := byte(0)
+		if gi.Altitude < 0 {
+			altitudeRef = 1
+		}
+
+		err = gpsIb.AddStandardWithName("GPSAltitudeRef", []byte{altitudeRef})
+		log.PanicIf(err)
+
+		altitude := []exifcommon.Rational{
+			{Numerator: uint32(math.Round(math.Abs(gi.Altitude) * 1000)), Denominator: 1000},
+		}
+
+		err = gpsIb.AddStandardWithName("GPSAltitude", altitude)
+		log.PanicIf(err)
+	}
+
+	if gi.Timestamp.IsZero() == false {
+		timestamp := gi.Timestamp.UTC()
+
+		timeStamp := []exifcommon.Rational{
+			{Numerator: uint32(timestamp.Hour()), Denominator: 1},
+			{Numerator: uint32(timestamp.Minute()), Denominator: 1},
+			{Numerator: uint32(timestamp.Second()*1000 + timestamp.Nanosecond()/1000000), Denominator: 1000},
+		}
+
+		err = gpsIb.AddStandardWithName("GPSTimeStamp", timeStamp)
+		log.PanicIf(err)
+
+		err = gpsIb.AddStandardWithName("GPSDateStamp", timestamp.Format(gpsDateStampLayout))
+		log.PanicIf(err)
+	}
+
+	if gi.HasImageDirection == true {
+		directionRef := "T"
+		if gi.IsMagneticDirection == true {
+			directionRef = "M"
+		}
+
+		err = gpsIb.AddStandardWithName("GPSImgDirectionRef", directionRef)
+		log.PanicIf(err)
+
+		direction := []exifcommon.Rational{
+			{Numerator: uint32(math.Round(gi.ImageDirection * 100)), Denominator: 100},
+		}
+
+		err = gpsIb.AddStandardWithName("GPSImgDirection", direction)
+		log.PanicIf(err)
+	}
+
+	err = sl.SetExif(rootIb)
+	log.PanicIf(err)
+
+	return nil
+}
+
+// DropGps drops the GPS IFD and leaves the rest of the EXIF alone. Nothing is
+// done (and `false` is returned) if there's no EXIF or no GPS IFD.
+func (sl *SegmentList) DropGps() (wasDropped bool, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	_, _, err = sl.FindExif()
+	if err != nil {
+		if log.Is(err, exif.ErrNoExif) == true {
+			return false, nil
+		}
+
+		log.Panic(err)
+	}
+
+	rootIb, err := sl.ConstructExifBuilder()
+	log.PanicIf(err)
+
+	n, err := rootIb.DeleteAll(exifGpsIfdTagId)
+	log.PanicIf(err)
+
+	if n == 0 {
+		return false, nil
+	}
+
+	err = sl.SetExif(rootIb)
+	log.PanicIf(err)
+
+	return true, nil
+}
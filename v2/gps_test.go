@@ -0,0 +1,282 @@
+package jpegstructure
+
+import (
+	"math"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dsoprea/go-exif/v3"
+	"github.com/dsoprea/go-exif/v3/common"
+	"github.com/dsoprea/go-logging"
+)
+
+func checkGpsTestProcessingSoftware(t *testing.T, sl *SegmentList) {
+	rootIfd, _, err := sl.Exif()
+	log.PanicIf(err)
+
+	results, err := rootIfd.FindTagWithName("ProcessingSoftware")
+	log.PanicIf(err)
+
+	value, err := results[0].Value()
+	log.PanicIf(err)
+
+	if value.(string) != "some software" {
+		t.Fatalf("Other tag not kept: [%v]", value)
+	}
+}
+
+func TestSegmentList_GpsInfo(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	filepath := path.Join(GetTestAssetsPath(), "20180428_212314.jpg")
+
+	intfc, err := NewJpegMediaParser().ParseFile(filepath)
+	log.PanicIf(err)
+
+	sl := intfc.(*SegmentList)
+
+	gi, err := sl.GpsInfo()
+	log.PanicIf(err)
+
+	if math.Abs(gi.Latitude-26.586667) > 1e-6 || math.Abs(gi.Longitude - -80.053611) > 1e-6 {
+		t.Fatalf("Position not correct: %s", gi)
+	} else if gi.HasAltitude != true || gi.Altitude != 0 || math.Signbit(gi.Altitude) == true {
+		t.Fatalf("Altitude not correct: %s", gi)
+	} else if gi.Timestamp.Equal(time.Date(2018, 4, 29, 1, 22, 57, 0, time.UTC)) != true {
+		t.Fatalf("Timestamp not correct: %s", gi)
+	} else if gi.HasImageDirection != false {
+		t.Fatalf("Direction not expected.")
+	}
+}
+
+func TestSegmentList_SetGps(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(64, 48, false))
+
+	rootIb, err := sl.ConstructExifBuilder()
+	log.PanicIf(err)
+
+	err = rootIb.AddStandardWithName("ProcessingSoftware", "some software")
+	log.PanicIf(err)
+
+	err = sl.SetExif(rootIb)
+	log.PanicIf(err)
+
+	// The timestamp is stored in UTC.
+
+	location := time.FixedZone("UTC+10", 10*60*60)
+
+	gi := &GpsInfo{
+		Latitude:            -33.856789,
+		Longitude:           151.215123,
+		HasAltitude:         true,
+		Altitude:            -12.5,
+		Timestamp:           time.Date(2021, 4, 5, 16, 7, 8, 500000000, location),
+		HasImageDirection:   true,
+		ImageDirection:      271.25,
+		IsMagneticDirection: true,
+	}
+
+	err = sl.SetGps(gi)
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	recovered, err := sl.GpsInfo()
+	log.PanicIf(err)
+
+	if math.Abs(recovered.Latitude-gi.Latitude) > 1e-6 || math.Abs(recovered.Longitude-gi.Longitude) > 1e-6 {
+		t.Fatalf("Position not correct: %s", recovered)
+	} else if recovered.HasAltitude != true || recovered.Altitude != -12.5 {
+		t.Fatalf("Altitude not correct: %s", recovered)
+	} else if recovered.Timestamp.Equal(gi.Timestamp) != true || recovered.Timestamp.Location() != time.UTC {
+		t.Fatalf("Timestamp not correct: %s", recovered)
+	} else if recovered.HasImageDirection != true || recovered.ImageDirection != 271.25 || recovered.IsMagneticDirection != true {
+		t.Fatalf("Direction not correct: %v", recovered)
+	}
+
+	// The library can read it, too.
+
+	rootIfd, _, err := sl.Exif()
+	log.PanicIf(err)
+
+	gpsIfd, err := rootIfd.ChildWithIfdPath(exifcommon.IfdGpsInfoStandardIfdIdentity)
+	log.PanicIf(err)
+
+	exifGi, err := gpsIfd.GpsInfo()
+	log.PanicIf(err)
+
+	if math.Abs(exifGi.Latitude.Decimal()-gi.Latitude) > 1e-6 || exifGi.Altitude != -12 {
+		t.Fatalf("GPS not readable by go-exif: %s", exifGi)
+	}
+
+	checkGpsTestProcessingSoftware(t, sl)
+
+	// Setting it again replaces all of it.
+
+	gi = &GpsInfo{
+		Latitude:  40.5,
+		Longitude: -74.25,
+	}
+
+	err = sl.SetGps(gi)
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	recovered, err = sl.GpsInfo()
+	log.PanicIf(err)
+
+	if reflect.DeepEqual(recovered, gi) != true {
+		t.Fatalf("Replaced GPS not correct: %v", recovered)
+	}
+
+	checkGpsTestProcessingSoftware(t, sl)
+}
+
+func TestSegmentList_SetGps_NoExif(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(64, 48, false))
+
+	_, err := sl.GpsInfo()
+	if err != ErrNoGps {
+		t.Fatalf("Expected ErrNoGps: %v", err)
+	}
+
+	err = sl.SetGps(&GpsInfo{Latitude: 1, Longitude: 2})
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	gi, err := sl.GpsInfo()
+	log.PanicIf(err)
+
+	if gi.Latitude != 1 || gi.Longitude != 2 || gi.HasAltitude != false || gi.Timestamp.IsZero() != true {
+		t.Fatalf("GPS not correct: %v", gi)
+	}
+}
+
+func TestSegmentList_SetGps_Invalid(t *testing.T) {
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(64, 48, false))
+
+	cases := []*GpsInfo{
+		{Latitude: 90.5},
+		{Longitude: -181},
+		{Latitude: math.NaN()},
+		{HasImageDirection: true, ImageDirection: 360},
+	}
+
+	for i, gi := range cases {
+		err := sl.SetGps(gi)
+		if err == nil {
+			t.Fatalf("Expected error for case (%d).", i)
+		}
+	}
+
+	if _, _, err := sl.FindExif(); log.Is(err, exif.ErrNoExif) == false {
+		t.Fatalf("EXIF shouldn't have been created.")
+	}
+}
+
+func TestSegmentList_DropGps(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(64, 48, false))
+
+	wasDropped, err := sl.DropGps()
+	log.PanicIf(err)
+
+	if wasDropped != false {
+		t.Fatalf("Expected nothing to drop without EXIF.")
+	}
+
+	rootIb, err := sl.ConstructExifBuilder()
+	log.PanicIf(err)
+
+	err = rootIb.AddStandardWithName("ProcessingSoftware", "some software")
+	log.PanicIf(err)
+
+	err = sl.SetExif(rootIb)
+	log.PanicIf(err)
+
+	err = sl.SetGps(&GpsInfo{Latitude: 1, Longitude: 2})
+	log.PanicIf(err)
+
+	wasDropped, err = sl.DropGps()
+	log.PanicIf(err)
+
+	if wasDropped != true {
+		t.Fatalf("Expected GPS to be dropped.")
+	}
+
+	sl, _ = reparseSegmentList(sl)
+
+	_, err = sl.GpsInfo()
+	if err != ErrNoGps {
+		t.Fatalf("Expected ErrNoGps: %v", err)
+	}
+
+	checkGpsTestProcessingSoftware(t, sl)
+
+	wasDropped, err = sl.DropGps()
+	log.PanicIf(err)
+
+	if wasDropped != false {
+		t.Fatalf("Expected nothing more to drop.")
+	}
+}
+
+func TestGpsDegreesRationals(t *testing.T) {
+	// The seconds round up into the next degree.
+	rationals := gpsDegreesRationals(-12.9999999999)
+
+	expected := []exifcommon.Rational{
+		{Numerator: 13, Denominator: 1},
+		{Numerator: 0, Denominator: 1},
+		{Numerator: 0, Denominator: 1000},
+	}
+
+	if reflect.DeepEqual(rationals, expected) != true {
+		t.Fatalf("Rationals not correct: %v", rationals)
+	}
+
+	rationals = gpsDegreesRationals(1.5125)
+
+	expected = []exifcommon.Rational{
+		{Numerator: 1, Denominator: 1},
+		{Numerator: 30, Denominator: 1},
+		{Numerator: 45000, Denominator: 1000},
+	}
+
+	if reflect.DeepEqual(rationals, expected) != true {
+		t.Fatalf("Rationals not correct: %v", rationals)
+	}
+}
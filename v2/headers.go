@@ -0,0 +1,689 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"fmt"
+
+	"encoding/binary"
+
+	"github.com/dsoprea/go-logging"
+)
+
+const (
+	// blockSize is the width and height of a DCT block.
+	blockSize = 8
+
+	// maxSegmentPayloadSize is the largest payload that a length-prefixed
+	// segment can carry (the length includes the two bytes of the length
+	// itself).
+	maxSegmentPayloadSize = 0xffff - 2
+)
+
+var (
+	// zigzag maps the position of a coefficient in the zig-zag order of the
+	// encoded stream to its position in the natural (row-major) order.
+	zigzag = [64]int{
+		0, 1, 8, 16, 9, 2, 3, 10,
+		17, 24, 32, 25, 18, 11, 4, 5,
+		12, 19, 26, 33, 40, 48, 41, 34,
+		27, 20, 13, 6, 7, 14, 21, 28,
+		35, 42, 49, 56, 57, 50, 43, 36,
+		29, 22, 15, 23, 30, 37, 44, 51,
+		58, 59, 52, 45, 38, 31, 39, 46,
+		53, 60, 61, 54, 47, 55, 62, 63,
+	}
+
+	// standardLuminanceQuantization is the example luminance table from Annex
+	// K of the specification, in natural order. Encoders derived from the
+	// IJG library scale it for their quality settings.
+	standardLuminanceQuantization = [64]uint16{
+		16, 11, 10, 16, 24, 40, 51, 61,
+		12, 12, 14, 19, 26, 58, 60, 55,
+		14, 13, 16, 24, 40, 57, 69, 56,
+		14, 17, 22, 29, 51, 87, 80, 62,
+		18, 22, 37, 56, 68, 109, 103, 77,
+		24, 35, 55, 64, 81, 104, 113, 92,
+		49, 64, 78, 87, 103, 121, 120, 101,
+		72, 92, 95, 98, 112, 100, 103, 99,
+	}
+
+	// standardChrominanceQuantization is the example chrominance table from
+	// Annex K, in natural order.
+	standardChrominanceQuantization = [64]uint16{
+		17, 18, 24, 47, 99, 99, 99, 99,
+		18, 21, 26, 66, 99, 99, 99, 99,
+		24, 26, 56, 99, 99, 99, 99, 99,
+		47, 66, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	}
+)
+
+// FrameComponent describes a single component from a SOF segment.
+type FrameComponent struct {
+	// Id is the component identifier that scans use to refer to it.
+	Id byte
+
+	// HorizontalSampling is the horizontal sampling factor (1-4).
+	HorizontalSampling byte
+
+	// VerticalSampling is the vertical sampling factor (1-4).
+	VerticalSampling byte
+
+	// QuantizationTableId is the DQT table used by this component.
+	QuantizationTableId byte
+}
+
+// SofSegment is a parsed SOF segment (the frame header).
+type SofSegment struct {
+	// MarkerId is the SOF marker that the header was read from. It determines
+	// the coding process.
+	MarkerId byte
+
+	// BitsPerSample is the sample precision.
+	BitsPerSample byte
+
+	// Width is the number of samples per line.
+	Width uint16
+
+	// Height is the number of lines. This may be (0) if a DNL segment follows
+	// the first scan.
+	Height uint16
+
+	// ComponentCount is the number of components, as read. `Encode` uses
+	// `Components`.
+	ComponentCount byte
+
+	// Components are the frame's components, in order.
+	Components []FrameComponent
+}
+
+// ParseSofSegment parses the payload of a SOF segment.
+func ParseSofSegment(markerId byte, data []byte) (fh *SofSegment, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if markerId < MARKER_SOF0 || markerId > MARKER_SOF15 || markerId == MARKER_DHT || markerId == MARKER_JPG || markerId == MARKER_DAC {
+		log.Panicf("not a SOF marker: (0x%02x)", markerId)
+	}
+
+	if len(data) < 6 {
+		log.Panicf("SOF segment too short: (%d)", len(data))
+	}
+
+	fh = &SofSegment{
+		MarkerId:       markerId,
+		BitsPerSample:  data[0],
+		Height:         binary.BigEndian.Uint16(data[1:3]),
+		Width:          binary.BigEndian.Uint16(data[3:5]),
+		ComponentCount: data[5],
+	}
+
+	componentCount := int(fh.ComponentCount)
+
+	if len(data) != 6+componentCount*3 {
+		log.Panicf("SOF segment length does not match component-count: LEN=(%d) COUNT=(%d)", len(data), componentCount)
+	}
+
+	fh.Components = make([]FrameComponent, componentCount)
+	for i := range fh.Components {
+		raw := data[6+i*3:]
+
+		fh.Components[i] = FrameComponent{
+			Id:                  raw[0],
+			HorizontalSampling:  raw[1] >> 4,
+			VerticalSampling:    raw[1] & 0x0f,
+			QuantizationTableId: raw[2],
+		}
+	}
+
+	return fh, nil
+}
+
+// Encode returns the SOF payload for this header.
+func (fh *SofSegment) Encode() []byte {
+	data := make([]byte, 6+len(fh.Components)*3)
+
+	data[0] = fh.BitsPerSample
+	binary.BigEndian.PutUint16(data[1:3], fh.Height)
+	binary.BigEndian.PutUint16(data[3:5], fh.Width)
+	data[5] = byte(len(fh.Components))
+
+	for i, fc := range fh.Components {
+		raw := data[6+i*3:]
+
+		raw[0] = fc.Id
+		raw[1] = fc.HorizontalSampling<<4 | fc.VerticalSampling
+		raw[2] = fc.QuantizationTableId
+	}
+
+	return data
+}
+
+// String returns a string representation of the SOF segment.
+func (ss SofSegment) String() string {
+	return fmt.Sprintf("SOF<Marker=[%s] BitsPerSample=(%d) Width=(%d) Height=(%d) ComponentCount=(%d)>", markerNames[ss.MarkerId], ss.BitsPerSample, ss.Width, ss.Height, ss.ComponentCount)
+}
+
+// IsProgressive returns true if the frame uses progressive DCT coding.
+func (fh *SofSegment) IsProgressive() bool {
+	return fh.MarkerId == MARKER_SOF2 || fh.MarkerId == MARKER_SOF6 || fh.MarkerId == MARKER_SOF10 || fh.MarkerId == MARKER_SOF14
+}
+
+// IsLossless returns true if the frame uses the (predictive) lossless process.
+func (fh *SofSegment) IsLossless() bool {
+	return fh.MarkerId == MARKER_SOF3 || fh.MarkerId == MARKER_SOF7 || fh.MarkerId == MARKER_SOF11 || fh.MarkerId == MARKER_SOF15
+}
+
+// IsHierarchical returns true if the frame is a differential frame from a
+// hierarchical image.
+func (fh *SofSegment) IsHierarchical() bool {
+	return fh.MarkerId >= MARKER_SOF5 && fh.MarkerId <= MARKER_SOF7 || fh.MarkerId >= MARKER_SOF13
+}
+
+// IsArithmetic returns true if the frame uses arithmetic entropy-coding rather
+// than Huffman.
+func (fh *SofSegment) IsArithmetic() bool {
+	return fh.MarkerId >= MARKER_SOF9
+}
+
+// MaxSampling returns the largest horizontal and vertical sampling factors
+// across all components.
+func (fh *SofSegment) MaxSampling() (h, v int) {
+	for _, fc := range fh.Components {
+		if int(fc.HorizontalSampling) > h {
+			h = int(fc.HorizontalSampling)
+		}
+
+		if int(fc.VerticalSampling) > v {
+			v = int(fc.VerticalSampling)
+		}
+	}
+
+	return h, v
+}
+
+// ComponentIndex returns the index of the component with the given ID or -1.
+func (fh *SofSegment) ComponentIndex(componentId byte) int {
+	for i, fc := range fh.Components {
+		if fc.Id == componentId {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// McuCount returns the number of MCU columns and rows in an interleaved scan.
+func (fh *SofSegment) McuCount() (columns, rows int) {
+	hMax, vMax := fh.MaxSampling()
+	if hMax == 0 || vMax == 0 {
+		return 0, 0
+	}
+
+	columns = ceilDiv(int(fh.Width), blockSize*hMax)
+	rows = ceilDiv(int(fh.Height), blockSize*vMax)
+
+	return columns, rows
+}
+
+// ComponentSize returns the dimensions, in samples, of the given component
+// after subsampling.
+func (fh *SofSegment) ComponentSize(index int) (width, height int) {
+	hMax, vMax := fh.MaxSampling()
+	fc := fh.Components[index]
+
+	width = ceilDiv(int(fh.Width)*int(fc.HorizontalSampling), hMax)
+	height = ceilDiv(int(fh.Height)*int(fc.VerticalSampling), vMax)
+
+	return width, height
+}
+
+// ComponentBlocks returns the number of block columns and rows that are
+// actually coded for the given component. This includes the padding needed to
+// fill whole MCUs, which is what interleaved scans and the coefficient arrays
+// use.
+func (fh *SofSegment) ComponentBlocks(index int) (columns, rows int) {
+	mcuColumns, mcuRows := fh.McuCount()
+	fc := fh.Components[index]
+
+	columns = mcuColumns * int(fc.HorizontalSampling)
+	rows = mcuRows * int(fc.VerticalSampling)
+
+	return columns, rows
+}
+
+// ComponentVisibleBlocks returns the number of block columns and rows that
+// cover the component's samples. Non-interleaved scans only code these.
+func (fh *SofSegment) ComponentVisibleBlocks(index int) (columns, rows int) {
+	width, height := fh.ComponentSize(index)
+
+	columns = ceilDiv(width, blockSize)
+	rows = ceilDiv(height, blockSize)
+
+	return columns, rows
+}
+
+// ScanComponent describes a single component of a SOS segment.
+type ScanComponent struct {
+	// ComponentId refers to a `FrameComponent`.
+	ComponentId byte
+
+	// DcTableId is the DC entropy-coding table.
+	DcTableId byte
+
+	// AcTableId is the AC entropy-coding table.
+	AcTableId byte
+}
+
+// ScanHeader is a parsed SOS segment.
+type ScanHeader struct {
+	// Components are the components coded in this scan, in order.
+	Components []ScanComponent
+
+	// SpectralStart is the first coefficient (in zig-zag order) coded in this
+	// scan. This is the predictor-selector for lossless images.
+	SpectralStart byte
+
+	// SpectralEnd is the last coefficient (in zig-zag order) coded in this
+	// scan.
+	SpectralEnd byte
+
+	// ApproximationHigh is the point-transform used by the previous scan of
+	// the same band (zero for the first scan of the band).
+	ApproximationHigh byte
+
+	// ApproximationLow is the point-transform of this scan.
+	ApproximationLow byte
+}
+
+// ParseScanHeader parses the payload of a SOS segment (excluding the length).
+func ParseScanHeader(data []byte) (sh *ScanHeader, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if len(data) < 1 {
+		log.Panicf("SOS segment is empty")
+	}
+
+	componentCount := int(data[0])
+
+	if len(data) != 1+componentCount*2+3 {
+		log.Panicf("SOS segment length does not match component-count: LEN=(%d) COUNT=(%d)", len(data), componentCount)
+	}
+
+	sh = &ScanHeader{
+		Components: make([]ScanComponent, componentCount),
+	}
+
+	for i := range sh.Components {
+		raw := data[1+i*2:]
+
+		sh.Components[i] = ScanComponent{
+			ComponentId: raw[0],
+			DcTableId:   raw[1] >> 4,
+			AcTableId:   raw[1] & 0x0f,
+		}
+	}
+
+	raw := data[1+componentCount*2:]
+
+	sh.SpectralStart = raw[0]
+	sh.SpectralEnd = raw[1]
+	sh.ApproximationHigh = raw[2] >> 4
+	sh.ApproximationLow = raw[2] & 0x0f
+
+	return sh, nil
+}
+
+// Encode returns the SOS payload for this header (excluding the length).
+func (sh *ScanHeader) Encode() []byte {
+	data := make([]byte, 1+len(sh.Components)*2+3)
+
+	data[0] = byte(len(sh.Components))
+
+	for i, sc := range sh.Components {
+		raw := data[1+i*2:]
+
+		raw[0] = sc.ComponentId
+		raw[1] = sc.DcTableId<<4 | sc.AcTableId
+	}
+
+	raw := data[1+len(sh.Components)*2:]
+
+	raw[0] = sh.SpectralStart
+	raw[1] = sh.SpectralEnd
+	raw[2] = sh.ApproximationHigh<<4 | sh.ApproximationLow
+
+	return data
+}
+
+// String returns a descriptive string.
+func (sh *ScanHeader) String() string {
+	return fmt.Sprintf("ScanHeader<COMPONENTS=(%d) Ss=(%d) Se=(%d) Ah=(%d) Al=(%d)>", len(sh.Components), sh.SpectralStart, sh.SpectralEnd, sh.ApproximationHigh, sh.ApproximationLow)
+}
+
+// IsDcScan returns true if the scan codes the DC coefficients.
+func (sh *ScanHeader) IsDcScan() bool {
+	return sh.SpectralStart == 0
+}
+
+const (
+	// HuffmanClassDc is the class of Huffman tables used for DC coefficients.
+	HuffmanClassDc = 0
+
+	// HuffmanClassAc is the class of Huffman tables used for AC coefficients.
+	HuffmanClassAc = 1
+)
+
+// HuffmanTable is a single table from a DHT segment.
+type HuffmanTable struct {
+	// Class is either `HuffmanClassDc` or `HuffmanClassAc`.
+	Class byte
+
+	// Id is the destination identifier that scans refer to.
+	Id byte
+
+	// Counts has the number of codes of each length (1-16 bits).
+	Counts [16]byte
+
+	// Symbols are the symbol values in order of increasing code length.
+	Symbols []byte
+}
+
+// ParseHuffmanTables parses all of the tables in a DHT segment.
+func ParseHuffmanTables(data []byte) (tables []*HuffmanTable, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	tables = make([]*HuffmanTable, 0)
+
+	for len(data) > 0 {
+		if len(data) < 17 {
+			log.Panicf("DHT table truncated: (%d)", len(data))
+		}
+
+		ht := &HuffmanTable{
+			Class: data[0] >> 4,
+			Id:    data[0] & 0x0f,
+		}
+
+		if ht.Class > HuffmanClassAc {
+			log.Panicf("DHT table-class not valid: (%d)", ht.Class)
+		}
+
+		copy(ht.Counts[:], data[1:17])
+
+		total := 0
+		for _, count := range ht.Counts {
+			total += int(count)
+		}
+
+		if total > 256 {
+			log.Panicf("DHT table has too many symbols: (%d)", total)
+		} else if len(data) < 17+total {
+			log.Panicf("DHT table symbols truncated: (%d) < (%d)", len(data)-17, total)
+		}
+
+		ht.Symbols = make([]byte, total)
+		copy(ht.Symbols, data[17:17+total])
+
+		tables = append(tables, ht)
+		data = data[17+total:]
+	}
+
+	return tables, nil
+}
+
+// EncodeHuffmanTables returns a DHT payload for the given tables.
+func EncodeHuffmanTables(tables []*HuffmanTable) []byte {
+	b := new(bytes.Buffer)
+
+	for _, ht := range tables {
+		b.WriteByte(ht.Class<<4 | ht.Id)
+		b.Write(ht.Counts[:])
+		b.Write(ht.Symbols)
+	}
+
+	return b.Bytes()
+}
+
+// ArithmeticConditioning is a single entry from a DAC segment. Tables that
+// aren't conditioned by a DAC segment have the default values.
+type ArithmeticConditioning struct {
+	// Class is either `HuffmanClassDc` or `HuffmanClassAc`. The arithmetic
+	// tables use the same classes.
+	Class byte
+
+	// Id is the destination identifier that scans refer to.
+	Id byte
+
+	// Value is the conditioning value. For DC tables, the lower nibble is the
+	// lower bound (L) and the upper nibble is the upper bound (U). For AC
+	// tables, this is the threshold (Kx).
+	Value byte
+}
+
+// String returns a descriptive string.
+func (ac *ArithmeticConditioning) String() string {
+	if ac.Class == HuffmanClassDc {
+		return fmt.Sprintf("ArithmeticConditioning<CLASS=DC ID=(%d) L=(%d) U=(%d)>", ac.Id, ac.Value&0x0f, ac.Value>>4)
+	}
+
+	return fmt.Sprintf("ArithmeticConditioning<CLASS=AC ID=(%d) K=(%d)>", ac.Id, ac.Value)
+}
+
+// ParseArithmeticConditioning parses all of the entries in a DAC segment.
+func ParseArithmeticConditioning(data []byte) (conditioning []*ArithmeticConditioning, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if len(data)%2 != 0 {
+		log.Panicf("DAC segment length not valid: (%d)", len(data))
+	}
+
+	conditioning = make([]*ArithmeticConditioning, 0, len(data)/2)
+
+	for i := 0; i < len(data); i += 2 {
+		ac := &ArithmeticConditioning{
+			Class: data[i] >> 4,
+			Id:    data[i] & 0x0f,
+			Value: data[i+1],
+		}
+
+		if ac.Class > HuffmanClassAc {
+			log.Panicf("DAC table-class not valid: (%d)", ac.Class)
+		} else if ac.Id > 3 {
+			log.Panicf("DAC table ID not valid: (%d)", ac.Id)
+		} else if ac.Class == HuffmanClassDc && ac.Value&0x0f > ac.Value>>4 {
+			log.Panicf("DAC DC bounds not valid: L=(%d) U=(%d)", ac.Value&0x0f, ac.Value>>4)
+		} else if ac.Class == HuffmanClassAc && (ac.Value < 1 || ac.Value > 63) {
+			log.Panicf("DAC AC threshold not valid: (%d)", ac.Value)
+		}
+
+		conditioning = append(conditioning, ac)
+	}
+
+	return conditioning, nil
+}
+
+// EncodeArithmeticConditioning returns a DAC payload for the given entries.
+func EncodeArithmeticConditioning(conditioning []*ArithmeticConditioning) []byte {
+	data := make([]byte, 0, len(conditioning)*2)
+
+	for _, ac := range conditioning {
+		data = append(data, ac.Class<<4|ac.Id, ac.Value)
+	}
+
+	return data
+}
+
+// QuantizationTable is a single table from a DQT segment.
+type QuantizationTable struct {
+	// Precision is (0) for 8-bit values and (1) for 16-bit values.
+	Precision byte
+
+	// Id is the destination identifier that frame components refer to.
+	Id byte
+
+	// Values are the quantization values in natural (row-major) order.
+	Values [64]uint16
+}
+
+// ParseQuantizationTables parses all of the tables in a DQT segment.
+func ParseQuantizationTables(data []byte) (tables []*QuantizationTable, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	tables = make([]*QuantizationTable, 0)
+
+	for len(data) > 0 {
+		qt := &QuantizationTable{
+			Precision: data[0] >> 4,
+			Id:        data[0] & 0x0f,
+		}
+
+		if qt.Precision > 1 {
+			log.Panicf("DQT precision not valid: (%d)", qt.Precision)
+		}
+
+		valueSize := int(qt.Precision) + 1
+
+		if len(data) < 1+64*valueSize {
+			log.Panicf("DQT table truncated: (%d)", len(data))
+		}
+
+		for i := 0; i < 64; i++ {
+			var value uint16
+			if valueSize == 1 {
+				value = uint16(data[1+i])
+			} else {
+				value = binary.BigEndian.Uint16(data[1+i*2:])
+			}
+
+			qt.Values[zigzag[i]] = value
+		}
+
+		tables = append(tables, qt)
+		data = data[1+64*valueSize:]
+	}
+
+	return tables, nil
+}
+
+// scaledStandardQuantization returns one of the standard tables scaled for the
+// given IJG quality (1-100).
+func scaledStandardQuantization(standard [64]uint16, quality int) (values [64]uint16) {
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+
+	for i, base := range standard {
+		value := (int(base)*scale + 50) / 100
+		if value < 1 {
+			value = 1
+		} else if value > 255 {
+			value = 255
+		}
+
+		values[i] = uint16(value)
+	}
+
+	return values
+}
+
+// EstimateQuality returns the IJG quality (1-100) whose luminance or
+// chrominance table is the closest to this one.
+func (qt *QuantizationTable) EstimateQuality() int {
+	bestQuality := 0
+	bestDistance := 0
+
+	for _, standard := range [][64]uint16{standardLuminanceQuantization, standardChrominanceQuantization} {
+		for quality := 1; quality <= 100; quality++ {
+			scaled := scaledStandardQuantization(standard, quality)
+
+			distance := 0
+			for i, value := range qt.Values {
+				difference := int(value) - int(scaled[i])
+				if difference < 0 {
+					difference = -difference
+				}
+
+				distance += difference
+			}
+
+			if bestQuality == 0 || distance < bestDistance {
+				bestQuality = quality
+				bestDistance = distance
+			}
+		}
+	}
+
+	return bestQuality
+}
+
+// EncodeQuantizationTables returns a DQT payload for the given tables.
+func EncodeQuantizationTables(tables []*QuantizationTable) []byte {
+	b := new(bytes.Buffer)
+
+	for _, qt := range tables {
+		b.WriteByte(qt.Precision<<4 | qt.Id)
+
+		for i := 0; i < 64; i++ {
+			value := qt.Values[zigzag[i]]
+
+			if qt.Precision == 0 {
+				b.WriteByte(byte(value))
+			} else {
+				b.WriteByte(byte(value >> 8))
+				b.WriteByte(byte(value))
+			}
+		}
+	}
+
+	return b.Bytes()
+}
+
+// ParseRestartInterval parses the payload of a DRI segment.
+func ParseRestartInterval(data []byte) (interval int, err error) {
+	if len(data) != 2 {
+		return 0, fmt.Errorf("DRI segment length not valid: (%d)", len(data))
+	}
+
+	interval = int(binary.BigEndian.Uint16(data))
+
+	return interval, nil
+}
+
+// ParseNumberOfLines parses the payload of a DNL segment.
+func ParseNumberOfLines(data []byte) (lines int, err error) {
+	if len(data) != 2 {
+		return 0, fmt.Errorf("DNL segment length not valid: (%d)", len(data))
+	}
+
+	lines = int(binary.BigEndian.Uint16(data))
+
+	return lines, nil
+}
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
@@ -0,0 +1,241 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"image/jpeg"
+
+	"github.com/dsoprea/go-logging"
+)
+
+func TestParseSofSegment(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	data := []byte{
+		0x08, 0x00, 0x30, 0x00, 0x40, 0x03,
+		0x01, 0x22, 0x00,
+		0x02, 0x11, 0x01,
+		0x03, 0x11, 0x01,
+	}
+
+	fh, err := ParseSofSegment(MARKER_SOF0, data)
+	log.PanicIf(err)
+
+	expected := &SofSegment{
+		MarkerId:       MARKER_SOF0,
+		BitsPerSample:  8,
+		Height:         48,
+		Width:          64,
+		ComponentCount: 3,
+		Components: []FrameComponent{
+			{Id: 1, HorizontalSampling: 2, VerticalSampling: 2, QuantizationTableId: 0},
+			{Id: 2, HorizontalSampling: 1, VerticalSampling: 1, QuantizationTableId: 1},
+			{Id: 3, HorizontalSampling: 1, VerticalSampling: 1, QuantizationTableId: 1},
+		},
+	}
+
+	if reflect.DeepEqual(fh, expected) != true {
+		t.Fatalf("Frame header not correct: %s", fh)
+	} else if bytes.Equal(fh.Encode(), data) != true {
+		t.Fatalf("Encoded frame header not correct.")
+	}
+
+	if columns, rows := fh.McuCount(); columns != 4 || rows != 3 {
+		t.Fatalf("MCU count not correct: (%d) (%d)", columns, rows)
+	} else if width, height := fh.ComponentSize(1); width != 32 || height != 24 {
+		t.Fatalf("Component size not correct: (%d) (%d)", width, height)
+	} else if columns, rows := fh.ComponentBlocks(0); columns != 8 || rows != 6 {
+		t.Fatalf("Component blocks not correct: (%d) (%d)", columns, rows)
+	}
+}
+
+func TestParseSofSegment_Truncated(t *testing.T) {
+	_, err := ParseSofSegment(MARKER_SOF0, []byte{0x08, 0x00, 0x30, 0x00, 0x40, 0x03})
+	if err == nil {
+		t.Fatalf("Expected error for truncated header.")
+	}
+}
+
+func TestParseScanHeader(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	data := []byte{0x02, 0x01, 0x00, 0x02, 0x11, 0x00, 0x3f, 0x00}
+
+	sh, err := ParseScanHeader(data)
+	log.PanicIf(err)
+
+	if len(sh.Components) != 2 || sh.Components[1].DcTableId != 1 || sh.Components[1].AcTableId != 1 || sh.SpectralEnd != 63 {
+		t.Fatalf("Scan header not correct: %s", sh)
+	} else if bytes.Equal(sh.Encode(), data) != true {
+		t.Fatalf("Encoded scan header not correct.")
+	}
+}
+
+func TestParseHuffmanTables(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	data := []byte{
+		0x10,
+		0, 2, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0x01, 0x02, 0x03,
+		0x01,
+		1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0x05,
+	}
+
+	tables, err := ParseHuffmanTables(data)
+	log.PanicIf(err)
+
+	if len(tables) != 2 {
+		t.Fatalf("Table count not correct: (%d)", len(tables))
+	} else if tables[0].Class != HuffmanClassAc || tables[0].Id != 0 || len(tables[0].Symbols) != 3 {
+		t.Fatalf("First table not correct.")
+	} else if tables[1].Class != HuffmanClassDc || tables[1].Id != 1 || bytes.Equal(tables[1].Symbols, []byte{5}) != true {
+		t.Fatalf("Second table not correct.")
+	} else if bytes.Equal(EncodeHuffmanTables(tables), data) != true {
+		t.Fatalf("Encoded tables not correct.")
+	}
+}
+
+func TestParseQuantizationTables(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	data := make([]byte, 1+64+1+128)
+	data[0] = 0x00
+	data[65] = 0x11
+
+	for i := 0; i < 64; i++ {
+		data[1+i] = byte(i + 1)
+		data[66+i*2+1] = byte(i + 100)
+	}
+
+	tables, err := ParseQuantizationTables(data)
+	log.PanicIf(err)
+
+	if len(tables) != 2 {
+		t.Fatalf("Table count not correct: (%d)", len(tables))
+	} else if tables[0].Values[0] != 1 || tables[0].Values[8] != 3 || tables[0].Values[63] != 64 {
+		t.Fatalf("First table not correct: %v", tables[0].Values)
+	} else if tables[1].Precision != 1 || tables[1].Id != 1 || tables[1].Values[1] != 101 {
+		t.Fatalf("Second table not correct: %v", tables[1].Values)
+	} else if bytes.Equal(EncodeQuantizationTables(tables), data) != true {
+		t.Fatalf("Encoded tables not correct.")
+	}
+}
+
+func TestQuantizationTable_EstimateQuality(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	img := getTestGeneratedImage(16, 16, false)
+
+	for _, quality := range []int{1, 10, 49, 50, 75, 90, 99, 100} {
+		b := new(bytes.Buffer)
+
+		err := jpeg.Encode(b, img, &jpeg.Options{Quality: quality})
+		log.PanicIf(err)
+
+		sl := getCoefficientsTestSegmentList(b.Bytes())
+
+		// Both the luminance and the chrominance tables.
+
+		tables := make([]*QuantizationTable, 0)
+		for _, s := range sl.Segments() {
+			if s.MarkerId == MARKER_DQT {
+				parsed, err := ParseQuantizationTables(s.Data)
+				log.PanicIf(err)
+
+				tables = append(tables, parsed...)
+			}
+		}
+
+		if len(tables) != 2 {
+			t.Fatalf("Table count for quality (%d) not correct: (%d)", quality, len(tables))
+		}
+
+		for _, table := range tables {
+			if table.EstimateQuality() != quality {
+				t.Fatalf("Quality of table (%d) not correct: (%d) != (%d)", table.Id, table.EstimateQuality(), quality)
+			}
+		}
+	}
+}
+
+func TestParseArithmeticConditioning(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	data := []byte{
+		0x01, 0x52,
+		0x13, 0x10,
+	}
+
+	conditioning, err := ParseArithmeticConditioning(data)
+	log.PanicIf(err)
+
+	if len(conditioning) != 2 {
+		t.Fatalf("Entry count not correct: (%d)", len(conditioning))
+	} else if conditioning[0].Class != HuffmanClassDc || conditioning[0].Id != 1 || conditioning[0].Value != 0x52 {
+		t.Fatalf("First entry not correct: %s", conditioning[0])
+	} else if conditioning[1].Class != HuffmanClassAc || conditioning[1].Id != 3 || conditioning[1].Value != 16 {
+		t.Fatalf("Second entry not correct: %s", conditioning[1])
+	} else if conditioning[0].String() != "ArithmeticConditioning<CLASS=DC ID=(1) L=(2) U=(5)>" {
+		t.Fatalf("String not correct: [%s]", conditioning[0])
+	} else if bytes.Equal(EncodeArithmeticConditioning(conditioning), data) != true {
+		t.Fatalf("Encoded entries not correct.")
+	}
+}
+
+func TestParseArithmeticConditioning_Invalid(t *testing.T) {
+	cases := map[string][]byte{
+		"odd length":     {0x00},
+		"bad class":      {0x20, 0x10},
+		"bad ID":         {0x04, 0x10},
+		"bounds":         {0x00, 0x25},
+		"zero threshold": {0x10, 0x00},
+		"big threshold":  {0x10, 0x40},
+	}
+
+	for name, data := range cases {
+		_, err := ParseArithmeticConditioning(data)
+		if err == nil {
+			t.Fatalf("Expected error: [%s]", name)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package jpegstructure
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dsoprea/go-logging"
+)
+
+const (
+	huffmanFastBits = 8
+)
+
+var (
+	// ErrInvalidHuffmanCode is returned when the entropy-coded data has a
+	// sequence of bits that is not a code in the current table.
+	ErrInvalidHuffmanCode = errors.New("invalid Huffman code")
+
+	// ErrEntropyTruncated is returned when the entropy-coded data ends before
+	// all of the MCUs have been decoded.
+	ErrEntropyTruncated = errors.New("entropy-coded data truncated")
+)
+
+// huffmanLookup is a decoding table built from a `HuffmanTable`.
+type huffmanLookup struct {
+	// fast maps the next `huffmanFastBits` bits to the length of the code
+	// (high byte) and the symbol (low byte). Zero means that the code is
+	// longer.
+	fast [1 << huffmanFastBits]uint16
+
+	// maxCode is the largest code of each length or -1 if there are none.
+	maxCode [17]int32
+
+	// valueOffset is added to a code of the given length to find the index of
+	// its symbol.
+	valueOffset [17]int32
+
+	symbols []byte
+}
+
+// newHuffmanLookup builds the decoding tables described in T.81 F.2.2.3 .
+func newHuffmanLookup(ht *HuffmanTable) (hl *huffmanLookup, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	hl = &huffmanLookup{
+		symbols: ht.Symbols,
+	}
+
+	code := int32(0)
+	k := int32(0)
+
+	for l := 1; l <= 16; l++ {
+		count := int32(ht.Counts[l-1])
+
+		hl.valueOffset[l] = k - code
+		hl.maxCode[l] = -1
+
+		if count > 0 {
+			if code+count > 1<<uint(l) {
+				log.Panicf("Huffman table is over-subscribed at length (%d)", l)
+			}
+
+			for i := int32(0); i < count; i++ {
+				if l <= huffmanFastBits {
+					shift := uint(huffmanFastBits - l)
+					entry := uint16(l)<<8 | uint16(ht.Symbols[k+i])
+
+					for j := (code + i) << shift; j < (code+i+1)<<shift; j++ {
+						hl.fast[j] = entry
+					}
+				}
+			}
+
+			code += count
+			k += count
+
+			hl.maxCode[l] = code - 1
+		}
+
+		code <<= 1
+	}
+
+	return hl, nil
+}
+
+// entropyReader reads bits from entropy-coded data. Stuffed zero-bytes are
+// removed and reading stops at the first marker. If more bits are consumed
+// than are available, zeros are supplied and the shortfall is counted.
+type entropyReader struct {
+	data []byte
+	pos  int
+
+	acc   uint64
+	nbits uint
+
+	// markerReached is true if we've stopped at a marker rather than the end
+	// of the data.
+	markerReached bool
+
+	// overrun is the number of (zero) bits supplied past the end of the data.
+	overrun int
+}
+
+func newEntropyReader(data []byte) *entropyReader {
+	return &entropyReader{
+		data: data,
+	}
+}
+
+func (er *entropyReader) fill() {
+	for er.nbits <= 56 && er.markerReached == false && er.pos < len(er.data) {
+		b := er.data[er.pos]
+
+		if b == 0xff {
+			if er.pos+1 >= len(er.data) {
+				// A lone 0xff at the end is half of a stuffed byte or of a
+				// marker, so the data was cut short.
+				return
+			} else if er.data[er.pos+1] != 0x00 {
+				er.markerReached = true
+				return
+			}
+
+			er.pos += 2
+		} else {
+			er.pos++
+		}
+
+		er.acc = er.acc<<8 | uint64(b)
+		er.nbits += 8
+	}
+}
+
+// readBits returns the next `n` (<= 16) bits.
+func (er *entropyReader) readBits(n uint) uint32 {
+	if n == 0 {
+		return 0
+	}
+
+	if er.nbits < n {
+		er.fill()
+
+		if er.nbits < n {
+			pad := n - er.nbits
+
+			er.acc <<= pad
+			er.nbits += pad
+			er.overrun += int(pad)
+		}
+	}
+
+	er.nbits -= n
+	value := uint32(er.acc>>er.nbits) & (1<<n - 1)
+
+	return value
+}
+
+func (er *entropyReader) readBit() uint32 {
+	return er.readBits(1)
+}
+
+// receiveExtend reads an `s`-bit magnitude and sign-extends it (T.81 F.2.2.1).
+func (er *entropyReader) receiveExtend(s uint) int32 {
+	if s == 0 {
+		return 0
+	}
+
+	v := int32(er.readBits(s))
+	if v < 1<<(s-1) {
+		v += -1<<s + 1
+	}
+
+	return v
+}
+
+// decodeHuffman decodes the next symbol using the given table.
+func (er *entropyReader) decodeHuffman(hl *huffmanLookup) (symbol byte, err error) {
+	if er.nbits < 16 {
+		er.fill()
+	}
+
+	if er.nbits >= huffmanFastBits {
+		peek := (er.acc >> (er.nbits - huffmanFastBits)) & (1<<huffmanFastBits - 1)
+
+		if entry := hl.fast[peek]; entry != 0 {
+			er.nbits -= uint(entry >> 8)
+			return byte(entry), nil
+		}
+	}
+
+	code := int32(0)
+	for l := 1; l <= 16; l++ {
+		code = code<<1 | int32(er.readBit())
+
+		if code <= hl.maxCode[l] {
+			return hl.symbols[code+hl.valueOffset[l]], nil
+		}
+	}
+
+	return 0, ErrInvalidHuffmanCode
+}
+
+// bytePosition returns the position of the next unread byte, counting bytes
+// that have been buffered but not consumed as unread.
+func (er *entropyReader) bytePosition() int {
+	return er.pos - int(er.nbits/8)
+}
+
+// alignedUnconsumed returns the number of whole bytes that have been buffered
+// but not consumed. Anything less than a byte is padding.
+func (er *entropyReader) alignedUnconsumed() int {
+	return int(er.nbits / 8)
+}
+
+// processRestart discards any padding bits and consumes the restart marker
+// that must be next. It returns an error if the next marker is not the
+// expected one. Any unconsumed whole bytes are also reported as an error.
+func (er *entropyReader) processRestart(expected int) (err error) {
+	unconsumed := er.alignedUnconsumed()
+
+	er.acc = 0
+	er.nbits = 0
+
+	// Find the marker, counting anything in front of it.
+	i := er.pos
+	for i < len(er.data) {
+		if er.data[i] == 0xff {
+			if i+1 < len(er.data) && er.data[i+1] == 0x00 {
+				i += 2
+				unconsumed++
+
+				continue
+			}
+
+			break
+		}
+
+		i++
+		unconsumed++
+	}
+
+	for i < len(er.data) && er.data[i] == 0xff {
+		i++
+	}
+
+	if i >= len(er.data) {
+		if unconsumed > 0 {
+			return fmt.Errorf("RST%d not found", expected)
+		}
+
+		return ErrEntropyTruncated
+	}
+
+	markerId := er.data[i]
+	if markerId != byte(MARKER_RST0+expected) {
+		return fmt.Errorf("expected RST%d but found marker (0x%02x)", expected, markerId)
+	}
+
+	er.pos = i + 1
+	er.markerReached = false
+
+	if unconsumed > 0 {
+		return fmt.Errorf("(%d) unconsumed bytes before RST%d", unconsumed, expected)
+	}
+
+	return nil
+}
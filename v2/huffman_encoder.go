@@ -0,0 +1,348 @@
+package jpegstructure
+
+import (
+	"bytes"
+
+	"github.com/dsoprea/go-logging"
+)
+
+var (
+	// standardHuffmanTables are the example tables from T.81 K.3 . Tables (0)
+	// are for luminance and tables (1) are for chrominance.
+	standardHuffmanTables = []*HuffmanTable{
+		{
+			Class:   HuffmanClassDc,
+			Id:      0,
+			Counts:  [16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+			Symbols: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+		},
+		{
+			Class:  HuffmanClassAc,
+			Id:     0,
+			Counts: [16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+			Symbols: []byte{
+				0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+				0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+				0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+				0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+				0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+				0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+				0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+				0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+				0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+				0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+				0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+				0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+				0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+				0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+				0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+				0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+				0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+				0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+				0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+				0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+				0xf9, 0xfa,
+			},
+		},
+		{
+			Class:   HuffmanClassDc,
+			Id:      1,
+			Counts:  [16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+			Symbols: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+		},
+		{
+			Class:  HuffmanClassAc,
+			Id:     1,
+			Counts: [16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+			Symbols: []byte{
+				0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+				0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+				0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+				0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+				0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+				0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+				0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+				0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+				0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+				0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+				0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+				0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+				0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+				0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+				0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+				0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+				0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+				0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+				0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+				0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+				0xf9, 0xfa,
+			},
+		},
+	}
+)
+
+// huffmanCode is a single code. A length of (0) means that the symbol has no
+// code.
+type huffmanCode struct {
+	code   uint16
+	length uint
+}
+
+// huffmanEncoderTable maps symbols to codes.
+type huffmanEncoderTable [256]huffmanCode
+
+// newHuffmanEncoderTable assigns the canonical codes (T.81 C.2).
+func newHuffmanEncoderTable(ht *HuffmanTable) *huffmanEncoderTable {
+	het := new(huffmanEncoderTable)
+
+	code := uint16(0)
+	k := 0
+
+	for l := uint(1); l <= 16; l++ {
+		for i := 0; i < int(ht.Counts[l-1]); i++ {
+			het[ht.Symbols[k]] = huffmanCode{
+				code:   code,
+				length: l,
+			}
+
+			code++
+			k++
+		}
+
+		code <<= 1
+	}
+
+	return het
+}
+
+// huffmanFrequencies counts how many times each symbol is used.
+type huffmanFrequencies [256]int
+
+// buildOptimalHuffmanTable builds a table with code lengths of no more than
+// sixteen bits for the given symbol frequencies (T.81 K.2). Like libjpeg, a
+// reserved symbol is included while the lengths are assigned so that no code
+// is all one-bits.
+func buildOptimalHuffmanTable(class, id byte, frequencies *huffmanFrequencies) *HuffmanTable {
+	var freq [257]int
+	copy(freq[:], frequencies[:])
+	freq[256] = 1
+
+	var codeSize [257]int
+	var others [257]int
+	for i := range others {
+		others[i] = -1
+	}
+
+	for {
+		// Find the two least-frequent symbols, preferring larger indices
+		// when there's a tie.
+
+		c1 := -1
+		v := int(^uint(0) >> 1)
+		for i := 0; i <= 256; i++ {
+			if freq[i] != 0 && freq[i] <= v {
+				v = freq[i]
+				c1 = i
+			}
+		}
+
+		c2 := -1
+		v = int(^uint(0) >> 1)
+		for i := 0; i <= 256; i++ {
+			if freq[i] != 0 && freq[i] <= v && i != c1 {
+				v = freq[i]
+				c2 = i
+			}
+		}
+
+		if c2 < 0 {
+			break
+		}
+
+		freq[c1] += freq[c2]
+		freq[c2] = 0
+
+		codeSize[c1]++
+		for others[c1] >= 0 {
+			c1 = others[c1]
+			codeSize[c1]++
+		}
+
+		others[c1] = c2
+
+		codeSize[c2]++
+		for others[c2] >= 0 {
+			c2 = others[c2]
+			codeSize[c2]++
+		}
+	}
+
+	var bits [33]int
+	for i := 0; i <= 256; i++ {
+		if codeSize[i] > 0 {
+			bits[codeSize[i]]++
+		}
+	}
+
+	// Limit the lengths to sixteen bits (T.81 Figure K.3).
+	for i := 32; i > 16; i-- {
+		for bits[i] > 0 {
+			j := i - 2
+			for bits[j] == 0 {
+				j--
+			}
+
+			bits[i] -= 2
+			bits[i-1]++
+			bits[j+1] += 2
+			bits[j]--
+		}
+	}
+
+	// Remove the reserved symbol, which has one of the longest codes.
+	i := 16
+	for bits[i] == 0 {
+		i--
+	}
+
+	bits[i]--
+
+	ht := &HuffmanTable{
+		Class:   class,
+		Id:      id,
+		Symbols: make([]byte, 0),
+	}
+
+	for l := 1; l <= 16; l++ {
+		ht.Counts[l-1] = byte(bits[l])
+	}
+
+	for l := 1; l <= 32; l++ {
+		for symbol := 0; symbol < 256; symbol++ {
+			if codeSize[symbol] == l {
+				ht.Symbols = append(ht.Symbols, byte(symbol))
+			}
+		}
+	}
+
+	return ht
+}
+
+// entropyWriter writes entropy-coded data, stuffing a zero after every 0xff
+// byte.
+type entropyWriter struct {
+	b *bytes.Buffer
+
+	acc   uint32
+	nbits uint
+}
+
+func newEntropyWriter() *entropyWriter {
+	return &entropyWriter{
+		b: new(bytes.Buffer),
+	}
+}
+
+// writeBits writes the low `n` (<= 16) bits of `value`.
+func (ew *entropyWriter) writeBits(value uint32, n uint) {
+	ew.acc = ew.acc<<n | value&(1<<n-1)
+	ew.nbits += n
+
+	for ew.nbits >= 8 {
+		ew.nbits -= 8
+
+		b := byte(ew.acc >> ew.nbits)
+		ew.b.WriteByte(b)
+
+		if b == 0xff {
+			ew.b.WriteByte(0x00)
+		}
+	}
+}
+
+// flush pads the last byte with one-bits.
+func (ew *entropyWriter) flush() {
+	if ew.nbits > 0 {
+		ew.writeBits(0xff, 8-ew.nbits)
+	}
+
+	ew.acc = 0
+}
+
+// writeRestart flushes and writes the restart marker with the given index.
+func (ew *entropyWriter) writeRestart(index int) {
+	ew.flush()
+
+	ew.b.WriteByte(0xff)
+	ew.b.WriteByte(byte(MARKER_RST0 + index%8))
+}
+
+// magnitudeCategory returns the number of bits needed for the magnitude of
+// `value` and the bits themselves (T.81 F.1.2.1).
+func magnitudeCategory(value int32) (category uint, bits uint32) {
+	magnitude := value
+	if value < 0 {
+		magnitude = -value
+		value--
+	}
+
+	for magnitude != 0 {
+		category++
+		magnitude >>= 1
+	}
+
+	return category, uint32(value) & (1<<category - 1)
+}
+
+// scanSymbolVisitor receives the symbols of a scan in the order that they're
+// coded. It's used both to gather statistics and to write the data.
+type scanSymbolVisitor interface {
+	// symbol is called for each Huffman-coded symbol.
+	symbol(class, tableId, symbol byte)
+
+	// bits is called for the additional bits that follow a symbol.
+	bits(value uint32, n uint)
+
+	// restart is called before the first MCU of each restart interval except
+	// the first.
+	restart(index int)
+}
+
+// huffmanStatistics is a `scanSymbolVisitor` that counts symbol usage.
+type huffmanStatistics struct {
+	frequencies [2][4]huffmanFrequencies
+}
+
+func (hs *huffmanStatistics) symbol(class, tableId, symbol byte) {
+	hs.frequencies[class][tableId][symbol]++
+}
+
+func (hs *huffmanStatistics) bits(value uint32, n uint) {
+}
+
+func (hs *huffmanStatistics) restart(index int) {
+}
+
+// huffmanScanWriter is a `scanSymbolVisitor` that writes the entropy-coded
+// data.
+type huffmanScanWriter struct {
+	ew     *entropyWriter
+	tables [2][4]*huffmanEncoderTable
+}
+
+func (hsw *huffmanScanWriter) symbol(class, tableId, symbol byte) {
+	hc := hsw.tables[class][tableId][symbol]
+	if hc.length == 0 {
+		log.Panicf("no Huffman code for symbol: CLASS=(%d) TABLE=(%d) SYMBOL=(0x%02x)", class, tableId, symbol)
+	}
+
+	hsw.ew.writeBits(uint32(hc.code), hc.length)
+}
+
+func (hsw *huffmanScanWriter) bits(value uint32, n uint) {
+	hsw.ew.writeBits(value, n)
+}
+
+func (hsw *huffmanScanWriter) restart(index int) {
+	hsw.ew.writeRestart(index)
+}
@@ -0,0 +1,142 @@
+package jpegstructure
+
+import (
+	"testing"
+
+	"github.com/dsoprea/go-logging"
+)
+
+func TestBuildOptimalHuffmanTable(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	// Fibonacci frequencies produce the deepest possible tree, which forces
+	// the lengths to be limited.
+
+	var frequencies huffmanFrequencies
+
+	a, b := 1, 1
+	for i := 0; i < 30; i++ {
+		frequencies[i] = a
+		a, b = b, a+b
+	}
+
+	ht := buildOptimalHuffmanTable(HuffmanClassAc, 1, &frequencies)
+
+	if ht.Class != HuffmanClassAc || ht.Id != 1 {
+		t.Fatalf("Table class or ID not correct.")
+	} else if len(ht.Symbols) != 30 {
+		t.Fatalf("Symbol count not correct: (%d)", len(ht.Symbols))
+	}
+
+	total := 0
+	for _, count := range ht.Counts {
+		total += int(count)
+	}
+
+	if total != 30 {
+		t.Fatalf("Code count not correct: (%d)", total)
+	}
+
+	het := newHuffmanEncoderTable(ht)
+
+	// The most frequent symbol should have the shortest code.
+	if het[29].length != het[ht.Symbols[0]].length {
+		t.Fatalf("Most-frequent symbol does not have the shortest code: (%d)", het[29].length)
+	}
+
+	// Make sure that every code can be decoded.
+
+	hl, err := newHuffmanLookup(ht)
+	log.PanicIf(err)
+
+	ew := newEntropyWriter()
+
+	for i := 0; i < 30; i++ {
+		hc := het[i]
+		if hc.length == 0 || hc.length > 16 {
+			t.Fatalf("Code length for symbol (%d) not valid: (%d)", i, hc.length)
+		}
+
+		ew.writeBits(uint32(hc.code), hc.length)
+	}
+
+	ew.flush()
+
+	er := newEntropyReader(ew.b.Bytes())
+	for i := 0; i < 30; i++ {
+		symbol, err := er.decodeHuffman(hl)
+		log.PanicIf(err)
+
+		if int(symbol) != i {
+			t.Fatalf("Decoded symbol not correct: (%d) != (%d)", symbol, i)
+		}
+	}
+}
+
+func TestBuildOptimalHuffmanTable_Single(t *testing.T) {
+	var frequencies huffmanFrequencies
+	frequencies[0] = 100
+
+	ht := buildOptimalHuffmanTable(HuffmanClassDc, 0, &frequencies)
+
+	// The reserved symbol makes sure that the only code isn't all one-bits.
+	if ht.Counts[0] != 1 || len(ht.Symbols) != 1 || ht.Symbols[0] != 0 {
+		t.Fatalf("Table not correct: %v %v", ht.Counts, ht.Symbols)
+	}
+
+	het := newHuffmanEncoderTable(ht)
+	if het[0].code != 0 || het[0].length != 1 {
+		t.Fatalf("Code not correct: %v", het[0])
+	}
+}
+
+func TestMagnitudeCategory(t *testing.T) {
+	values := []struct {
+		value    int32
+		category uint
+		bits     uint32
+	}{
+		{0, 0, 0},
+		{1, 1, 1},
+		{-1, 1, 0},
+		{5, 3, 5},
+		{-5, 3, 2},
+		{1023, 10, 1023},
+		{-1024, 11, 1023},
+	}
+
+	for _, v := range values {
+		category, bits := magnitudeCategory(v.value)
+		if category != v.category || bits != v.bits {
+			t.Fatalf("Category for (%d) not correct: (%d) (%d)", v.value, category, bits)
+		}
+
+		er := newEntropyReader([]byte{byte(bits << (8 - category)), 0, 0})
+		if category <= 8 {
+			if decoded := er.receiveExtend(category); decoded != v.value {
+				t.Fatalf("Value (%d) did not round-trip: (%d)", v.value, decoded)
+			}
+		}
+	}
+}
+
+func TestEntropyWriter_Stuffing(t *testing.T) {
+	ew := newEntropyWriter()
+
+	ew.writeBits(0xff, 8)
+	ew.writeBits(0x1, 1)
+	ew.writeRestart(9)
+	ew.writeBits(0x0, 2)
+	ew.flush()
+
+	expected := []byte{0xff, 0x00, 0xff, 0x00, 0xff, 0xd1, 0x3f}
+	if string(ew.b.Bytes()) != string(expected) {
+		t.Fatalf("Data not correct: %x", ew.b.Bytes())
+	}
+}
@@ -0,0 +1,132 @@
+package jpegstructure
+
+import (
+	"testing"
+
+	"github.com/dsoprea/go-logging"
+)
+
+func getHuffmanTestTable() *HuffmanTable {
+	// Codes: 0 => 'a' (1 bit), 10 => 'b', 110 => 'c', 1110 => 'd' .
+	return &HuffmanTable{
+		Counts:  [16]byte{1, 1, 1, 1},
+		Symbols: []byte{'a', 'b', 'c', 'd'},
+	}
+}
+
+func TestNewHuffmanLookup_OverSubscribed(t *testing.T) {
+	ht := &HuffmanTable{
+		Counts:  [16]byte{3},
+		Symbols: []byte{1, 2, 3},
+	}
+
+	_, err := newHuffmanLookup(ht)
+	if err == nil {
+		t.Fatalf("Expected error for over-subscribed table.")
+	}
+}
+
+func TestEntropyReader_DecodeHuffman(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	hl, err := newHuffmanLookup(getHuffmanTestTable())
+	log.PanicIf(err)
+
+	// d c b a a, then padding: 1110 110 10 0 0 11111 => 0xed 0x1f .
+	er := newEntropyReader([]byte{0xed, 0x1f})
+
+	expected := []byte{'d', 'c', 'b', 'a', 'a'}
+	for i, symbol := range expected {
+		actual, err := er.decodeHuffman(hl)
+		log.PanicIf(err)
+
+		if actual != symbol {
+			t.Fatalf("Symbol (%d) not correct: [%c] != [%c]", i, actual, symbol)
+		}
+	}
+
+	if er.overrun != 0 {
+		t.Fatalf("Expected no overrun: (%d)", er.overrun)
+	}
+
+	// The padding is all one-bits, which is not a code.
+	_, err = er.decodeHuffman(hl)
+	if err != ErrInvalidHuffmanCode {
+		t.Fatalf("Expected invalid code: %v", err)
+	}
+}
+
+func TestEntropyReader_Stuffing(t *testing.T) {
+	er := newEntropyReader([]byte{0xff, 0x00, 0x80, 0xff, 0xd0, 0x01})
+
+	if v := er.readBits(12); v != 0xff8 {
+		t.Fatalf("Value not correct: (0x%x)", v)
+	} else if er.markerReached != true {
+		t.Fatalf("Expected to stop at marker.")
+	}
+
+	// Only four bits remain before the marker.
+	er.readBits(8)
+
+	if er.overrun != 4 {
+		t.Fatalf("Overrun not correct: (%d)", er.overrun)
+	}
+}
+
+func TestEntropyReader_ReceiveExtend(t *testing.T) {
+	// 3 bits "010" => -5, 3 bits "101" => 5 .
+	er := newEntropyReader([]byte{0x54})
+
+	if v := er.receiveExtend(3); v != -5 {
+		t.Fatalf("Negative value not correct: (%d)", v)
+	} else if v := er.receiveExtend(3); v != 5 {
+		t.Fatalf("Positive value not correct: (%d)", v)
+	}
+}
+
+func TestEntropyReader_ProcessRestart(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	er := newEntropyReader([]byte{0xa0, 0xff, 0xd3, 0x80})
+
+	er.readBits(3)
+
+	err := er.processRestart(3)
+	log.PanicIf(err)
+
+	if v := er.readBits(1); v != 1 {
+		t.Fatalf("Expected to resume after the marker.")
+	}
+
+	er = newEntropyReader([]byte{0xa0, 0xff, 0xd3})
+
+	if err := er.processRestart(4); err == nil {
+		t.Fatalf("Expected error for wrong marker.")
+	}
+
+	er = newEntropyReader([]byte{0xa0, 0x11})
+	er.readBits(3)
+
+	if err := er.processRestart(0); err == nil || err == ErrEntropyTruncated {
+		t.Fatalf("Expected error for missing marker: %v", err)
+	}
+
+	er = newEntropyReader([]byte{0xa0})
+	er.readBits(3)
+
+	if err := er.processRestart(0); err != ErrEntropyTruncated {
+		t.Fatalf("Expected truncation: %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package jpegstructure
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/dsoprea/go-logging"
+)
+
+var (
+	iccProfilePrefix = []byte("ICC_PROFILE\000")
+)
+
+var (
+	// ErrNoIccProfile is returned if the ICC profile was requested but not
+	// found.
+	ErrNoIccProfile = errors.New("no ICC profile")
+)
+
+const (
+	// iccHeaderSize is the size of the profile header, which is followed by
+	// the tag table.
+	iccHeaderSize = 128
+)
+
+// IccProfile is a parsed ICC profile. Only the header is interpreted; the
+// tags are available as raw data.
+type IccProfile struct {
+	// Version is the profile version, in the same encoding as the header
+	// (e.g. 0x02100000 for 2.1).
+	Version uint32
+
+	// Class is the profile/device class (e.g. "mntr" or "prtr").
+	Class string
+
+	// ColorSpace is the color space of the data (e.g. "RGB " or "CMYK").
+	ColorSpace string
+
+	// ConnectionSpace is the profile connection space ("XYZ " or "Lab ").
+	ConnectionSpace string
+
+	// RenderingIntent is the intent that the profile was embedded with.
+	RenderingIntent uint32
+
+	tags map[string][]byte
+}
+
+// ParseIccProfile parses the header and the tag table of a profile.
+func ParseIccProfile(data []byte) (ip *IccProfile, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if len(data) < iccHeaderSize+4 {
+		log.Panicf("ICC profile too short: (%d)", len(data))
+	} else if string(data[36:40]) != "acsp" {
+		log.Panicf("ICC profile signature not valid")
+	}
+
+	ip = &IccProfile{
+		Version:         binary.BigEndian.Uint32(data[8:12]),
+		Class:           string(data[12:16]),
+		ColorSpace:      string(data[16:20]),
+		ConnectionSpace: string(data[20:24]),
+		RenderingIntent: binary.BigEndian.Uint32(data[64:68]),
+		tags:            make(map[string][]byte),
+	}
+
+	count := int(binary.BigEndian.Uint32(data[iccHeaderSize:]))
+	if len(data) < iccHeaderSize+4+count*12 {
+		log.Panicf("ICC tag table truncated: (%d)", count)
+	}
+
+	for i := 0; i < count; i++ {
+		raw := data[iccHeaderSize+4+i*12:]
+
+		signature := string(raw[0:4])
+		offset := int(binary.BigEndian.Uint32(raw[4:8]))
+		size := int(binary.BigEndian.Uint32(raw[8:12]))
+
+		if offset < 0 || size < 0 || offset+size > len(data) || offset+size < offset {
+			log.Panicf("ICC tag [%s] out of bounds: OFFSET=(%d) SIZE=(%d)", signature, offset, size)
+		}
+
+		ip.tags[signature] = data[offset : offset+size]
+	}
+
+	return ip, nil
+}
+
+// Tag returns the raw data of the tag with the given signature.
+func (ip *IccProfile) Tag(signature string) (data []byte, found bool) {
+	data, found = ip.tags[signature]
+	return data, found
+}
+
+// String returns a descriptive string.
+func (ip *IccProfile) String() string {
+	return fmt.Sprintf("IccProfile<VERSION=(0x%08x) CLASS=[%s] COLOR-SPACE=[%s] PCS=[%s] TAGS=(%d)>", ip.Version, ip.Class, ip.ColorSpace, ip.ConnectionSpace, len(ip.tags))
+}
+
+// IccProfile reassembles the embedded ICC profile from its APP2 chunks.
+func (sl *SegmentList) IccProfile() (data []byte, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	chunks := make([]*Segment, 0)
+	count := 0
+
+	for _, s := range sl.segments {
+		if s.IsIccProfile() == false {
+			continue
+		}
+
+		l := len(iccProfilePrefix)
+
+		sequence := int(s.Data[l])
+		if count == 0 {
+			count = int(s.Data[l+1])
+		} else if int(s.Data[l+1]) != count {
+			log.Panicf("ICC profile chunk-counts not consistent: (%d) != (%d)", s.Data[l+1], count)
+		}
+
+		if sequence < 1 || sequence > count {
+			log.Panicf("ICC profile chunk sequence-number not valid: (%d) of (%d)", sequence, count)
+		}
+
+		chunks = append(chunks, s)
+	}
+
+	if len(chunks) == 0 {
+		return nil, ErrNoIccProfile
+	}
+
+	// The chunks are supposed to be in order but they're numbered, so we
+	// don't depend on it.
+
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].Data[len(iccProfilePrefix)] < chunks[j].Data[len(iccProfilePrefix)]
+	})
+
+	if len(chunks) != count {
+		log.Panicf("ICC profile has (%d) chunks but should have (%d)", len(chunks), count)
+	}
+
+	for i, s := range chunks {
+		sequence := int(s.Data[len(iccProfilePrefix)])
+		if sequence != i+1 {
+			log.Panicf("ICC profile chunk (%d) missing or duplicated", i+1)
+		}
+
+		data = append(data, s.Data[len(iccProfilePrefix)+2:]...)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,178 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/dsoprea/go-logging"
+)
+
+// getIccTestProfile returns a profile with the given tags.
+func getIccTestProfile(version uint32, colorSpace, pcs string, tags map[string][]byte) []byte {
+	signatures := make([]string, 0, len(tags))
+	for signature := range tags {
+		signatures = append(signatures, signature)
+	}
+
+	header := make([]byte, iccHeaderSize)
+	binary.BigEndian.PutUint32(header[8:], version)
+	copy(header[12:], "prtr")
+	copy(header[16:], colorSpace)
+	copy(header[20:], pcs)
+	copy(header[36:], "acsp")
+
+	table := new(bytes.Buffer)
+	binary.Write(table, binary.BigEndian, uint32(len(signatures)))
+
+	body := new(bytes.Buffer)
+	offset := iccHeaderSize + 4 + len(signatures)*12
+
+	for _, signature := range signatures {
+		data := tags[signature]
+
+		table.WriteString(signature)
+		binary.Write(table, binary.BigEndian, uint32(offset+body.Len()))
+		binary.Write(table, binary.BigEndian, uint32(len(data)))
+
+		body.Write(data)
+
+		for body.Len()%4 != 0 {
+			body.WriteByte(0)
+		}
+	}
+
+	profile := append(header, table.Bytes()...)
+	profile = append(profile, body.Bytes()...)
+
+	binary.BigEndian.PutUint32(profile[0:], uint32(len(profile)))
+
+	return profile
+}
+
+// getIccTestSegments splits the profile into APP2 chunks of the given size.
+func getIccTestSegments(profile []byte, chunkSize int) []*Segment {
+	count := (len(profile) + chunkSize - 1) / chunkSize
+	segments := make([]*Segment, 0, count)
+
+	for i := 0; i < count; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(profile) {
+			end = len(profile)
+		}
+
+		data := append([]byte{}, iccProfilePrefix...)
+		data = append(data, byte(i+1), byte(count))
+		data = append(data, profile[i*chunkSize:end]...)
+
+		s := &Segment{
+			MarkerId:   MARKER_APP2,
+			MarkerName: markerNames[MARKER_APP2],
+			Data:       data,
+		}
+
+		segments = append(segments, s)
+	}
+
+	return segments
+}
+
+func TestParseIccProfile(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	tags := map[string][]byte{
+		"desc": []byte("some description"),
+	}
+
+	data := getIccTestProfile(0x02100000, "CMYK", "Lab ", tags)
+
+	ip, err := ParseIccProfile(data)
+	log.PanicIf(err)
+
+	if ip.Version != 0x02100000 || ip.Class != "prtr" || ip.ColorSpace != "CMYK" || ip.ConnectionSpace != "Lab " {
+		t.Fatalf("Header not correct: %s", ip)
+	}
+
+	tag, found := ip.Tag("desc")
+	if found != true || string(tag) != "some description" {
+		t.Fatalf("Tag not correct: [%s]", string(tag))
+	}
+
+	_, found = ip.Tag("A2B0")
+	if found != false {
+		t.Fatalf("Expected tag to not be found.")
+	}
+}
+
+func TestParseIccProfile_Invalid(t *testing.T) {
+	data := getIccTestProfile(0x02100000, "CMYK", "Lab ", map[string][]byte{"desc": []byte("abc")})
+
+	_, err := ParseIccProfile(data[:100])
+	if err == nil {
+		t.Fatalf("Expected error for truncated profile.")
+	}
+
+	// The tag points past the end.
+
+	_, err = ParseIccProfile(data[:len(data)-4])
+	if err == nil {
+		t.Fatalf("Expected error for tag out of bounds.")
+	}
+
+	data[36] = 'x'
+
+	_, err = ParseIccProfile(data)
+	if err == nil {
+		t.Fatalf("Expected error for signature.")
+	}
+}
+
+func TestSegmentList_IccProfile(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	_, err := NewSegmentList(nil).IccProfile()
+	if err != ErrNoIccProfile {
+		t.Fatalf("Expected no profile: %v", err)
+	}
+
+	profile := getIccTestProfile(0x02100000, "CMYK", "Lab ", map[string][]byte{"desc": bytes.Repeat([]byte{1, 2, 3}, 100)})
+	segments := getIccTestSegments(profile, 100)
+
+	if len(segments) != 5 {
+		t.Fatalf("Chunk-count not correct: (%d)", len(segments))
+	}
+
+	// The chunks are numbered, so the order doesn't matter.
+	segments[1], segments[3] = segments[3], segments[1]
+
+	recovered, err := NewSegmentList(segments).IccProfile()
+	log.PanicIf(err)
+
+	if bytes.Equal(recovered, profile) != true {
+		t.Fatalf("Profile not correct.")
+	}
+
+	_, err = NewSegmentList(segments[1:]).IccProfile()
+	if err == nil {
+		t.Fatalf("Expected error for missing chunk.")
+	}
+
+	duplicated := append([]*Segment{segments[0]}, segments[:4]...)
+
+	_, err = NewSegmentList(duplicated).IccProfile()
+	if err == nil {
+		t.Fatalf("Expected error for duplicated chunk.")
+	}
+}
@@ -0,0 +1,686 @@
+package jpegstructure
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/dsoprea/go-logging"
+)
+
+var (
+	// iccD50 is the white-point of the profile connection space.
+	iccD50 = [3]float64{0.9642, 1.0, 0.8249}
+
+	// xyzD50ToLinearSrgb converts D50 XYZ to linear sRGB, with Bradford
+	// adaptation to D65.
+	xyzD50ToLinearSrgb = [3][3]float64{
+		{3.1338561, -1.6168667, -0.4906146},
+		{-0.9787684, 1.9161415, 0.0334540},
+		{0.0719453, -0.2289914, 1.4052427},
+	}
+)
+
+const (
+	// iccMaxClutSize is the most CLUT entries that we'll allocate.
+	iccMaxClutSize = 1 << 24
+)
+
+// iccCurve maps a normalized value to a normalized value.
+type iccCurve func(x float64) float64
+
+func identityCurve(x float64) float64 {
+	return x
+}
+
+// tableCurve returns a curve that linearly interpolates between the values.
+func tableCurve(table []float64) iccCurve {
+	if len(table) == 1 {
+		value := table[0]
+
+		return func(x float64) float64 {
+			return value
+		}
+	}
+
+	return func(x float64) float64 {
+		position := clampUnit(x) * float64(len(table)-1)
+
+		i := int(position)
+		if i >= len(table)-1 {
+			return table[len(table)-1]
+		}
+
+		fraction := position - float64(i)
+
+		return table[i] + (table[i+1]-table[i])*fraction
+	}
+}
+
+func clampUnit(x float64) float64 {
+	if x < 0 {
+		return 0
+	} else if x > 1 {
+		return 1
+	}
+
+	return x
+}
+
+// iccClut is a multi-dimensional lookup table.
+type iccClut struct {
+	grid    []int
+	outputs int
+
+	// values are normalized, with the first input varying the slowest.
+	values []float64
+}
+
+// apply looks up the inputs with multilinear interpolation.
+func (ic *iccClut) apply(inputs []float64, outputs []float64) {
+	n := len(ic.grid)
+
+	base := 0
+	strides := make([]int, n)
+	fractions := make([]float64, n)
+
+	stride := ic.outputs
+	for i := n - 1; i >= 0; i-- {
+		strides[i] = stride
+
+		position := clampUnit(inputs[i]) * float64(ic.grid[i]-1)
+
+		j := int(position)
+		if j >= ic.grid[i]-1 {
+			j = ic.grid[i] - 1
+		}
+
+		fractions[i] = position - float64(j)
+
+		// There's nothing to interpolate with at the last grid point.
+		if j == ic.grid[i]-1 {
+			strides[i] = 0
+		}
+
+		base += j * stride
+		stride *= ic.grid[i]
+	}
+
+	for k := range outputs[:ic.outputs] {
+		outputs[k] = 0
+	}
+
+	for corner := 0; corner < 1<<uint(n); corner++ {
+		weight := 1.0
+		offset := base
+
+		for i := 0; i < n; i++ {
+			if corner&(1<<uint(i)) != 0 {
+				weight *= fractions[i]
+				offset += strides[i]
+			} else {
+				weight *= 1 - fractions[i]
+			}
+		}
+
+		if weight == 0 {
+			continue
+		}
+
+		for k := 0; k < ic.outputs; k++ {
+			outputs[k] += weight * ic.values[offset+k]
+		}
+	}
+}
+
+// newIccClut reads the CLUT entries, which are `precision` bytes each.
+func newIccClut(grid []int, outputs int, precision int, data []byte) (ic *iccClut, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	count := outputs
+	for _, g := range grid {
+		if g < 1 {
+			log.Panicf("CLUT grid not valid: %v", grid)
+		}
+
+		count *= g
+		if count > iccMaxClutSize {
+			log.Panicf("CLUT too large: %v", grid)
+		}
+	}
+
+	if len(data) < count*precision {
+		log.Panicf("CLUT truncated: (%d) < (%d)", len(data), count*precision)
+	}
+
+	ic = &iccClut{
+		grid:    grid,
+		outputs: outputs,
+		values:  make([]float64, count),
+	}
+
+	for i := range ic.values {
+		if precision == 1 {
+			ic.values[i] = float64(data[i]) / 0xff
+		} else {
+			ic.values[i] = float64(binary.BigEndian.Uint16(data[i*2:])) / 0xffff
+		}
+	}
+
+	return ic, nil
+}
+
+// iccPipeline is the device-to-PCS ("A2B") transform of a profile: the "A"
+// curves, the CLUT, the "M" curves, the matrix, and the "B" curves. The older
+// LUT types only have the first, second, and last of these.
+type iccPipeline struct {
+	inputs  int
+	outputs int
+
+	aCurves []iccCurve
+	clut    *iccClut
+	mCurves []iccCurve
+	matrix  []float64
+	bCurves []iccCurve
+
+	// isLegacyLab is true if the PCS uses the 16-bit Lab encoding from
+	// version 2, which `lut16Type` always uses.
+	isLegacyLab bool
+}
+
+// apply returns the normalized PCS values for the normalized device values.
+func (ip *iccPipeline) apply(inputs []float64) (pcs [3]float64) {
+	values := make([]float64, 16)
+	copy(values, inputs)
+
+	n := ip.inputs
+
+	for i, curve := range ip.aCurves {
+		values[i] = curve(values[i])
+	}
+
+	if ip.clut != nil {
+		outputs := make([]float64, ip.clut.outputs)
+		ip.clut.apply(values[:n], outputs)
+
+		copy(values, outputs)
+		n = ip.clut.outputs
+	}
+
+	for i, curve := range ip.mCurves {
+		values[i] = curve(values[i])
+	}
+
+	if ip.matrix != nil {
+		m := ip.matrix
+
+		x, y, z := values[0], values[1], values[2]
+
+		values[0] = m[0]*x + m[1]*y + m[2]*z + m[9]
+		values[1] = m[3]*x + m[4]*y + m[5]*z + m[10]
+		values[2] = m[6]*x + m[7]*y + m[8]*z + m[11]
+	}
+
+	for i, curve := range ip.bCurves {
+		values[i] = curve(values[i])
+	}
+
+	copy(pcs[:], values[:3])
+
+	return pcs
+}
+
+func readS15Fixed16(data []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(data))) / 65536
+}
+
+// parseIccCurve parses a `curveType` or `parametricCurveType` and returns the
+// number of bytes that it takes up, including the padding.
+func parseIccCurve(data []byte) (curve iccCurve, size int, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if len(data) < 12 {
+		log.Panicf("curve truncated")
+	}
+
+	switch string(data[0:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(data[8:12]))
+		if len(data) < 12+count*2 {
+			log.Panicf("curve table truncated: (%d)", count)
+		}
+
+		size = 12 + count*2
+
+		if count == 0 {
+			curve = identityCurve
+		} else if count == 1 {
+			gamma := float64(binary.BigEndian.Uint16(data[12:14])) / 256
+
+			curve = func(x float64) float64 {
+				return math.Pow(clampUnit(x), gamma)
+			}
+		} else {
+			table := make([]float64, count)
+			for i := range table {
+				table[i] = float64(binary.BigEndian.Uint16(data[12+i*2:])) / 0xffff
+			}
+
+			curve = tableCurve(table)
+		}
+	case "para":
+		parameterCounts := []int{1, 3, 4, 5, 7}
+
+		functionType := int(binary.BigEndian.Uint16(data[8:10]))
+		if functionType >= len(parameterCounts) {
+			log.Panicf("parametric curve type not valid: (%d)", functionType)
+		}
+
+		count := parameterCounts[functionType]
+		if len(data) < 12+count*4 {
+			log.Panicf("parametric curve truncated")
+		}
+
+		size = 12 + count*4
+
+		// Missing parameters default to the values that have no effect.
+		p := []float64{1, 1, 0, 0, 0, 0, 0}
+		for i := 0; i < count; i++ {
+			p[i] = readS15Fixed16(data[12+i*4:])
+		}
+
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+
+		power := func(x float64) float64 {
+			base := a*x + b
+			if base <= 0 {
+				return 0
+			}
+
+			return math.Pow(base, g)
+		}
+
+		switch functionType {
+		case 0:
+			curve = func(x float64) float64 {
+				return math.Pow(clampUnit(x), g)
+			}
+		case 1, 2:
+			if functionType == 1 {
+				c = 0
+			}
+
+			curve = func(x float64) float64 {
+				if a != 0 && x < -b/a {
+					return c
+				}
+
+				return power(x) + c
+			}
+		default:
+			if functionType == 3 {
+				e = 0
+				f = 0
+			}
+
+			curve = func(x float64) float64 {
+				if x < d {
+					return c*x + f
+				}
+
+				return power(x) + e
+			}
+		}
+	default:
+		log.Panicf("curve type not supported: [%s]", string(data[0:4]))
+	}
+
+	// Curves are padded to a four-byte boundary.
+	size = (size + 3) &^ 3
+
+	return curve, size, nil
+}
+
+// parseIccCurves parses `count` consecutive curves.
+func parseIccCurves(data []byte, count int) (curves []iccCurve, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	curves = make([]iccCurve, count)
+
+	for i := range curves {
+		curve, size, err := parseIccCurve(data)
+		log.PanicIf(err)
+
+		curves[i] = curve
+
+		if size > len(data) {
+			size = len(data)
+		}
+
+		data = data[size:]
+	}
+
+	return curves, nil
+}
+
+// parseIccLutTables parses the input or output tables of a `lut8Type` or
+// `lut16Type`.
+func parseIccLutTables(data []byte, count, entries, precision int) (curves []iccCurve, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if entries < 1 || len(data) < count*entries*precision {
+		log.Panicf("LUT tables truncated or not valid: (%d) (%d)", count, entries)
+	}
+
+	curves = make([]iccCurve, count)
+
+	for i := range curves {
+		table := make([]float64, entries)
+
+		for j := range table {
+			offset := (i*entries + j) * precision
+
+			if precision == 1 {
+				table[j] = float64(data[offset]) / 0xff
+			} else {
+				table[j] = float64(binary.BigEndian.Uint16(data[offset:])) / 0xffff
+			}
+		}
+
+		curves[i] = tableCurve(table)
+	}
+
+	return curves, nil
+}
+
+// parseIccLut parses a `lut8Type` or `lut16Type` tag. The matrix only applies
+// to XYZ input and is ignored.
+func parseIccLut(data []byte) (ip *iccPipeline, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if len(data) < 52 {
+		log.Panicf("LUT truncated")
+	}
+
+	isLut16 := string(data[0:4]) == "mft2"
+
+	ip = &iccPipeline{
+		inputs:      int(data[8]),
+		outputs:     int(data[9]),
+		isLegacyLab: isLut16,
+	}
+
+	gridPoints := int(data[10])
+
+	if ip.inputs < 1 || ip.inputs > 15 || ip.outputs < 3 || ip.outputs > 15 || gridPoints < 2 {
+		log.Panicf("LUT parameters not valid: IN=(%d) OUT=(%d) GRID=(%d)", ip.inputs, ip.outputs, gridPoints)
+	}
+
+	precision := 1
+	inputEntries := 256
+	outputEntries := 256
+	offset := 48
+
+	if isLut16 == true {
+		precision = 2
+		inputEntries = int(binary.BigEndian.Uint16(data[48:50]))
+		outputEntries = int(binary.BigEndian.Uint16(data[50:52]))
+		offset = 52
+	}
+
+	ip.aCurves, err = parseIccLutTables(data[offset:], ip.inputs, inputEntries, precision)
+	log.PanicIf(err)
+
+	offset += ip.inputs * inputEntries * precision
+
+	grid := make([]int, ip.inputs)
+	for i := range grid {
+		grid[i] = gridPoints
+	}
+
+	ip.clut, err = newIccClut(grid, ip.outputs, precision, data[offset:])
+	log.PanicIf(err)
+
+	offset += len(ip.clut.values) * precision
+
+	if offset > len(data) {
+		log.Panicf("LUT output tables missing")
+	}
+
+	ip.bCurves, err = parseIccLutTables(data[offset:], ip.outputs, outputEntries, precision)
+	log.PanicIf(err)
+
+	return ip, nil
+}
+
+// parseIccLutAToB parses a `lutAToBType` tag.
+func parseIccLutAToB(data []byte) (ip *iccPipeline, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if len(data) < 32 {
+		log.Panicf("LUT truncated")
+	}
+
+	ip = &iccPipeline{
+		inputs:  int(data[8]),
+		outputs: int(data[9]),
+	}
+
+	if ip.inputs < 1 || ip.inputs > 15 || ip.outputs != 3 {
+		log.Panicf("LUT parameters not valid: IN=(%d) OUT=(%d)", ip.inputs, ip.outputs)
+	}
+
+	offsetAt := func(position int) []byte {
+		offset := int(binary.BigEndian.Uint32(data[position:]))
+		if offset == 0 {
+			return nil
+		} else if offset >= len(data) {
+			log.Panicf("LUT element out of bounds: (%d)", offset)
+		}
+
+		return data[offset:]
+	}
+
+	if raw := offsetAt(12); raw != nil {
+		ip.bCurves, err = parseIccCurves(raw, ip.outputs)
+		log.PanicIf(err)
+	}
+
+	if raw := offsetAt(16); raw != nil {
+		if len(raw) < 48 {
+			log.Panicf("LUT matrix truncated")
+		}
+
+		ip.matrix = make([]float64, 12)
+		for i := range ip.matrix {
+			ip.matrix[i] = readS15Fixed16(raw[i*4:])
+		}
+	}
+
+	if raw := offsetAt(20); raw != nil {
+		ip.mCurves, err = parseIccCurves(raw, ip.outputs)
+		log.PanicIf(err)
+	}
+
+	if raw := offsetAt(24); raw != nil {
+		if len(raw) < 20 {
+			log.Panicf("LUT CLUT truncated")
+		}
+
+		grid := make([]int, ip.inputs)
+		for i := range grid {
+			grid[i] = int(raw[i])
+		}
+
+		precision := int(raw[16])
+		if precision != 1 && precision != 2 {
+			log.Panicf("CLUT precision not valid: (%d)", precision)
+		}
+
+		ip.clut, err = newIccClut(grid, ip.outputs, precision, raw[20:])
+		log.PanicIf(err)
+	} else if ip.inputs != ip.outputs {
+		log.Panicf("LUT without CLUT must have as many inputs as outputs")
+	}
+
+	if raw := offsetAt(28); raw != nil {
+		ip.aCurves, err = parseIccCurves(raw, ip.inputs)
+		log.PanicIf(err)
+	}
+
+	return ip, nil
+}
+
+// iccTransform converts device values to sRGB through a profile.
+type iccTransform struct {
+	pipeline *iccPipeline
+	isLab    bool
+}
+
+// newIccTransform returns the transform for the profile's perceptual intent,
+// falling back to the other intents. The profile must convert from a color
+// space with the given number of components.
+func newIccTransform(profile *IccProfile, components int) (it *iccTransform, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if profile.ConnectionSpace != "Lab " && profile.ConnectionSpace != "XYZ " {
+		log.Panicf("profile connection space not supported: [%s]", profile.ConnectionSpace)
+	}
+
+	var data []byte
+	for _, signature := range []string{"A2B0", "A2B1", "A2B2"} {
+		var found bool
+
+		data, found = profile.Tag(signature)
+		if found == true {
+			break
+		}
+	}
+
+	if data == nil {
+		log.Panicf("profile has no device-to-PCS table")
+	} else if len(data) < 4 {
+		log.Panicf("device-to-PCS table truncated")
+	}
+
+	var pipeline *iccPipeline
+
+	switch string(data[0:4]) {
+	case "mft1", "mft2":
+		pipeline, err = parseIccLut(data)
+		log.PanicIf(err)
+	case "mAB ":
+		pipeline, err = parseIccLutAToB(data)
+		log.PanicIf(err)
+	default:
+		log.Panicf("device-to-PCS table type not supported: [%s]", string(data[0:4]))
+	}
+
+	if pipeline.inputs != components {
+		log.Panicf("profile is for (%d) components, not (%d)", pipeline.inputs, components)
+	}
+
+	it = &iccTransform{
+		pipeline: pipeline,
+		isLab:    profile.ConnectionSpace == "Lab ",
+	}
+
+	return it, nil
+}
+
+// convert returns the (gamma-encoded) sRGB values, from zero to one, for the
+// normalized device values.
+func (it *iccTransform) convert(inputs []float64) (r, g, b float64) {
+	pcs := it.pipeline.apply(inputs)
+
+	var xyz [3]float64
+
+	if it.isLab == true {
+		var l, a, bb float64
+
+		if it.pipeline.isLegacyLab == true {
+			l = pcs[0] * 0xffff / 0xff00 * 100
+			a = pcs[1]*0xffff/0x100 - 128
+			bb = pcs[2]*0xffff/0x100 - 128
+		} else {
+			l = pcs[0] * 100
+			a = pcs[1]*255 - 128
+			bb = pcs[2]*255 - 128
+		}
+
+		xyz = labToXyz(l, a, bb)
+	} else {
+		// The XYZ encoding tops out just short of two.
+		for i := range xyz {
+			xyz[i] = pcs[i] * 0xffff / 0x8000
+		}
+	}
+
+	r, g, b = xyzToSrgb(xyz)
+
+	return r, g, b
+}
+
+// labToXyz converts D50 Lab to XYZ (CIE 15).
+func labToXyz(l, a, b float64) (xyz [3]float64) {
+	fy := (l + 16) / 116
+	f := [3]float64{fy + a/500, fy, fy - b/200}
+
+	const delta = 6.0 / 29
+
+	for i, t := range f {
+		if t > delta {
+			xyz[i] = t * t * t
+		} else {
+			xyz[i] = 3 * delta * delta * (t - 4.0/29)
+		}
+
+		xyz[i] *= iccD50[i]
+	}
+
+	return xyz
+}
+
+// xyzToSrgb converts D50 XYZ to gamma-encoded sRGB, clipped to the gamut.
+func xyzToSrgb(xyz [3]float64) (r, g, b float64) {
+	var rgb [3]float64
+
+	for i, row := range xyzD50ToLinearSrgb {
+		linear := clampUnit(row[0]*xyz[0] + row[1]*xyz[1] + row[2]*xyz[2])
+
+		if linear <= 0.0031308 {
+			rgb[i] = 12.92 * linear
+		} else {
+			rgb[i] = 1.055*math.Pow(linear, 1/2.4) - 0.055
+		}
+	}
+
+	return rgb[0], rgb[1], rgb[2]
+}
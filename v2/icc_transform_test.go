@@ -0,0 +1,376 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/dsoprea/go-logging"
+)
+
+// iccTestCorners has the Lab value of each corner of the CMYK cube, with C
+// varying the slowest. Anything with K is black, C alone is sRGB red, M alone
+// is sRGB blue, and any other mix is a mid-gray.
+func iccTestCorners() [16][3]float64 {
+	var corners [16][3]float64
+
+	for i := range corners {
+		c, m, y, k := i>>3&1, i>>2&1, i>>1&1, i&1
+
+		switch {
+		case k == 1:
+			corners[i] = [3]float64{0, 0, 0}
+		case c == 0 && m == 0 && y == 0:
+			corners[i] = [3]float64{100, 0, 0}
+		case c == 1 && m == 0 && y == 0:
+			corners[i] = [3]float64{54.29, 80.81, 69.89}
+		case c == 0 && m == 1 && y == 0:
+			corners[i] = [3]float64{29.57, 68.29, -112.03}
+		default:
+			corners[i] = [3]float64{50, 0, 0}
+		}
+	}
+
+	return corners
+}
+
+// encodeIccTestLab returns the PCS encoding of a Lab value, normalized.
+func encodeIccTestLab(lab [3]float64, isLegacy bool) [3]float64 {
+	if isLegacy == true {
+		return [3]float64{
+			lab[0] / 100 * 0xff00 / 0xffff,
+			(lab[1] + 128) * 0x100 / 0xffff,
+			(lab[2] + 128) * 0x100 / 0xffff,
+		}
+	}
+
+	return [3]float64{
+		lab[0] / 100,
+		(lab[1] + 128) / 255,
+		(lab[2] + 128) / 255,
+	}
+}
+
+func writeIccTestValue(b *bytes.Buffer, value float64, precision int) {
+	if precision == 1 {
+		b.WriteByte(byte(math.Floor(value*0xff + 0.5)))
+	} else {
+		binary.Write(b, binary.BigEndian, uint16(math.Floor(value*0xffff+0.5)))
+	}
+}
+
+// getIccTestLut returns a `lut8Type` or `lut16Type` for the test corners.
+func getIccTestLut(precision int) []byte {
+	b := new(bytes.Buffer)
+
+	if precision == 1 {
+		b.WriteString("mft1")
+	} else {
+		b.WriteString("mft2")
+	}
+
+	b.Write([]byte{0, 0, 0, 0, 4, 3, 2, 0})
+
+	for i := 0; i < 9; i++ {
+		value := uint32(0)
+		if i%4 == 0 {
+			value = 0x10000
+		}
+
+		binary.Write(b, binary.BigEndian, value)
+	}
+
+	entries := 256
+	if precision == 2 {
+		entries = 2
+
+		binary.Write(b, binary.BigEndian, uint16(entries))
+		binary.Write(b, binary.BigEndian, uint16(entries))
+	}
+
+	identity := func(count int) {
+		for i := 0; i < count; i++ {
+			for j := 0; j < entries; j++ {
+				writeIccTestValue(b, float64(j)/float64(entries-1), precision)
+			}
+		}
+	}
+
+	identity(4)
+
+	for _, lab := range iccTestCorners() {
+		for _, value := range encodeIccTestLab(lab, precision == 2) {
+			writeIccTestValue(b, value, precision)
+		}
+	}
+
+	identity(3)
+
+	return b.Bytes()
+}
+
+// getIccTestLutAToB returns a `lutAToBType` for the test corners. Every
+// element is present and has no effect.
+func getIccTestLutAToB() []byte {
+	identityCurve := func(b *bytes.Buffer) {
+		b.WriteString("curv")
+		b.Write(make([]byte, 8))
+	}
+
+	gammaOneCurve := func(b *bytes.Buffer) {
+		b.WriteString("para")
+		b.Write(make([]byte, 8))
+		binary.Write(b, binary.BigEndian, uint32(0x10000))
+	}
+
+	elements := new(bytes.Buffer)
+	offsets := make([]uint32, 5)
+
+	// B curves.
+	offsets[0] = uint32(32 + elements.Len())
+	for i := 0; i < 3; i++ {
+		identityCurve(elements)
+	}
+
+	// Matrix.
+	offsets[1] = uint32(32 + elements.Len())
+	for i := 0; i < 12; i++ {
+		value := uint32(0)
+		if i < 9 && i%4 == 0 {
+			value = 0x10000
+		}
+
+		binary.Write(elements, binary.BigEndian, value)
+	}
+
+	// M curves.
+	offsets[2] = uint32(32 + elements.Len())
+	for i := 0; i < 3; i++ {
+		gammaOneCurve(elements)
+	}
+
+	// CLUT.
+	offsets[3] = uint32(32 + elements.Len())
+	elements.Write([]byte{2, 2, 2, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0})
+
+	for _, lab := range iccTestCorners() {
+		for _, value := range encodeIccTestLab(lab, false) {
+			writeIccTestValue(elements, value, 2)
+		}
+	}
+
+	// A curves.
+	offsets[4] = uint32(32 + elements.Len())
+	for i := 0; i < 4; i++ {
+		gammaOneCurve(elements)
+	}
+
+	b := new(bytes.Buffer)
+	b.WriteString("mAB ")
+	b.Write([]byte{0, 0, 0, 0, 4, 3, 0, 0})
+
+	for _, offset := range offsets {
+		binary.Write(b, binary.BigEndian, offset)
+	}
+
+	b.Write(elements.Bytes())
+
+	return b.Bytes()
+}
+
+// checkIccTestTransform checks the transform against the test corners.
+func checkIccTestTransform(t *testing.T, it *iccTransform) {
+	cases := []struct {
+		inks     []float64
+		expected [3]float64
+	}{
+		{[]float64{0, 0, 0, 0}, [3]float64{255, 255, 255}},
+		{[]float64{0, 0, 0, 1}, [3]float64{0, 0, 0}},
+		{[]float64{1, 0, 0, 0}, [3]float64{255, 0, 0}},
+		{[]float64{0, 1, 0, 0}, [3]float64{0, 0, 255}},
+		{[]float64{0, 0, 1, 0}, [3]float64{119, 119, 119}},
+		{[]float64{0.25, 0.5, 0.75, 1}, [3]float64{0, 0, 0}},
+	}
+
+	for i, c := range cases {
+		r, g, b := it.convert(c.inks)
+
+		actual := [3]float64{r * 255, g * 255, b * 255}
+		for j := range actual {
+			if math.Abs(actual[j]-c.expected[j]) > 1 {
+				t.Fatalf("Case (%d) not correct: %v != %v", i, actual, c.expected)
+			}
+		}
+	}
+
+	// Halfway between white and gray is interpolated in the PCS.
+
+	r, _, _ := it.convert([]float64{0, 0, 0.5, 0})
+
+	expected, _, _ := xyzToSrgb(labToXyz(75, 0, 0))
+	if math.Abs(r-expected)*255 > 1 {
+		t.Fatalf("Interpolation not correct: (%f) != (%f)", r*255, expected*255)
+	}
+}
+
+func TestNewIccTransform_Lut16(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	data := getIccTestProfile(0x02100000, "CMYK", "Lab ", map[string][]byte{"A2B0": getIccTestLut(2)})
+
+	profile, err := ParseIccProfile(data)
+	log.PanicIf(err)
+
+	it, err := newIccTransform(profile, 4)
+	log.PanicIf(err)
+
+	checkIccTestTransform(t, it)
+
+	_, err = newIccTransform(profile, 3)
+	if err == nil {
+		t.Fatalf("Expected error for component-count.")
+	}
+}
+
+func TestNewIccTransform_Lut8(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	// Only the relative-colorimetric intent is there.
+
+	data := getIccTestProfile(0x02100000, "CMYK", "Lab ", map[string][]byte{"A2B1": getIccTestLut(1)})
+
+	profile, err := ParseIccProfile(data)
+	log.PanicIf(err)
+
+	it, err := newIccTransform(profile, 4)
+	log.PanicIf(err)
+
+	checkIccTestTransform(t, it)
+}
+
+func TestNewIccTransform_LutAToB(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	data := getIccTestProfile(0x04200000, "CMYK", "Lab ", map[string][]byte{"A2B0": getIccTestLutAToB()})
+
+	profile, err := ParseIccProfile(data)
+	log.PanicIf(err)
+
+	it, err := newIccTransform(profile, 4)
+	log.PanicIf(err)
+
+	checkIccTestTransform(t, it)
+}
+
+func TestNewIccTransform_Unsupported(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	cases := []map[string][]byte{
+		{"desc": []byte("no table")},
+		{"A2B0": []byte("mBA \000\000\000\000")},
+		{"A2B0": getIccTestLut(2)[:100]},
+	}
+
+	for i, tags := range cases {
+		data := getIccTestProfile(0x02100000, "CMYK", "Lab ", tags)
+
+		profile, err := ParseIccProfile(data)
+		log.PanicIf(err)
+
+		_, err = newIccTransform(profile, 4)
+		if err == nil {
+			t.Fatalf("Expected error for case (%d).", i)
+		}
+	}
+}
+
+func TestParseIccCurve(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	fixed := func(value float64) []byte {
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, uint32(int32(value*65536)))
+
+		return data
+	}
+
+	parametric := func(functionType uint16, parameters ...float64) []byte {
+		data := []byte("para\000\000\000\000")
+		data = append(data, byte(functionType>>8), byte(functionType), 0, 0)
+
+		for _, p := range parameters {
+			data = append(data, fixed(p)...)
+		}
+
+		return data
+	}
+
+	cases := []struct {
+		data         []byte
+		expectedSize int
+		x            float64
+		expected     float64
+	}{
+		// Identity.
+		{[]byte("curv\000\000\000\000\000\000\000\000"), 12, 0.3, 0.3},
+
+		// Gamma of (2.0) and then padded.
+		{[]byte("curv\000\000\000\000\000\000\000\001\002\000"), 16, 0.5, 0.25},
+
+		// Table.
+		{[]byte("curv\000\000\000\000\000\000\000\003\000\000\x80\x00\xff\xff"), 20, 0.25, 0.25},
+
+		{parametric(0, 2), 16, 0.5, 0.25},
+		{parametric(1, 1, 2, -0.5), 24, 0.2, 0},
+		{parametric(2, 1, 2, -0.5, 0.1), 28, 0.5, 0.6},
+		{parametric(3, 1, 1, 0, 0.5, 0.5), 32, 0.25, 0.125},
+		{parametric(4, 1, 1, 0, 0.5, 0.5, 0.25, 0.1), 40, 0.75, 1},
+	}
+
+	for i, c := range cases {
+		curve, size, err := parseIccCurve(c.data)
+		log.PanicIf(err)
+
+		if size != c.expectedSize {
+			t.Fatalf("Size for case (%d) not correct: (%d)", i, size)
+		} else if value := curve(c.x); math.Abs(value-c.expected) > 0.0001 {
+			t.Fatalf("Value for case (%d) not correct: (%f) != (%f)", i, value, c.expected)
+		}
+	}
+
+	_, _, err := parseIccCurve(parametric(5, 1))
+	if err == nil {
+		t.Fatalf("Expected error for function-type.")
+	}
+}
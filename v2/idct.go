@@ -0,0 +1,83 @@
+package jpegstructure
+
+import (
+	"math"
+)
+
+var (
+	// idctCosines has, for each sample position and frequency, the cosine
+	// term of the inverse DCT along with its scale-factor (T.81 A.3.3).
+	idctCosines [blockSize][blockSize]float64
+)
+
+func init() {
+	for x := 0; x < blockSize; x++ {
+		for u := 0; u < blockSize; u++ {
+			c := 1.0
+			if u == 0 {
+				c = 1 / math.Sqrt2
+			}
+
+			idctCosines[x][u] = c / 2 * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+}
+
+// inverseDct dequantizes the block and returns its samples, level-shifted and
+// clamped for the given precision. This is a straightforward (separable)
+// floating-point implementation, which is precise enough for twelve-bit
+// samples.
+func inverseDct(block *CoefficientBlock, qt *QuantizationTable, precision byte, samples *[64]uint16) {
+	var rows [64]float64
+
+	// Transform the rows of the dequantized coefficients.
+	for v := 0; v < blockSize; v++ {
+		var coefficients [blockSize]float64
+		isZero := true
+
+		for u := 0; u < blockSize; u++ {
+			i := v*blockSize + u
+
+			coefficients[u] = float64(block[i]) * float64(qt.Values[i])
+			if coefficients[u] != 0 {
+				isZero = false
+			}
+		}
+
+		if isZero == true {
+			continue
+		}
+
+		for x := 0; x < blockSize; x++ {
+			sum := 0.0
+			for u := 0; u < blockSize; u++ {
+				sum += idctCosines[x][u] * coefficients[u]
+			}
+
+			rows[v*blockSize+x] = sum
+		}
+	}
+
+	// Then the columns.
+
+	levelShift := float64(int(1) << (precision - 1))
+	maximum := float64(int(1)<<precision - 1)
+
+	for x := 0; x < blockSize; x++ {
+		for y := 0; y < blockSize; y++ {
+			sum := levelShift
+			for v := 0; v < blockSize; v++ {
+				sum += idctCosines[y][v] * rows[v*blockSize+x]
+			}
+
+			sum = math.Floor(sum + 0.5)
+			if sum < 0 {
+				sum = 0
+			} else if sum > maximum {
+				sum = maximum
+			}
+
+			samples[y*blockSize+x] = uint16(sum)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package jpegstructure
+
+import (
+	"math"
+	"testing"
+)
+
+func TestInverseDct_Flat(t *testing.T) {
+	qt := &QuantizationTable{}
+	for i := range qt.Values {
+		qt.Values[i] = 1
+	}
+
+	block := &CoefficientBlock{}
+
+	// A DC of (8) times the offset shifts every sample by that offset.
+	block[0] = 8 * 100
+
+	var samples [64]uint16
+	inverseDct(block, qt, 12, &samples)
+
+	for i, sample := range samples {
+		if sample != 2048+100 {
+			t.Fatalf("Sample (%d) not correct: (%d)", i, sample)
+		}
+	}
+
+	// Clamped to the precision.
+
+	block[0] = 8 * 1000
+
+	inverseDct(block, qt, 8, &samples)
+
+	for i, sample := range samples {
+		if sample != 255 {
+			t.Fatalf("Sample (%d) not clamped: (%d)", i, sample)
+		}
+	}
+}
+
+func TestInverseDct_Reference(t *testing.T) {
+	qt := &QuantizationTable{}
+	for i := range qt.Values {
+		qt.Values[i] = uint16(i%5 + 1)
+	}
+
+	block := &CoefficientBlock{}
+	for i := range block {
+		block[i] = int16((i*37)%23 - 11)
+	}
+
+	var samples [64]uint16
+	inverseDct(block, qt, 12, &samples)
+
+	// The two-dimensional formula, directly (T.81 A.3.3).
+
+	c := func(u int) float64 {
+		if u == 0 {
+			return 1 / math.Sqrt2
+		}
+
+		return 1
+	}
+
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			sum := 0.0
+			for v := 0; v < 8; v++ {
+				for u := 0; u < 8; u++ {
+					coefficient := float64(block[v*8+u]) * float64(qt.Values[v*8+u])
+					sum += c(u) * c(v) * coefficient * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16) * math.Cos(float64(2*y+1)*float64(v)*math.Pi/16)
+				}
+			}
+
+			expected := uint16(math.Floor(sum/4 + 2048 + 0.5))
+
+			if samples[y*8+x] != expected {
+				t.Fatalf("Sample (%d, %d) not correct: (%d) != (%d)", x, y, samples[y*8+x], expected)
+			}
+		}
+	}
+}
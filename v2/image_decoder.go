@@ -0,0 +1,475 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/dsoprea/go-logging"
+)
+
+// imageColorModel is how the components of an image are to be interpreted.
+type imageColorModel int
+
+const (
+	imageColorModelGray imageColorModel = iota
+	imageColorModelRgb
+	imageColorModelYCbCr
+	imageColorModelCmyk
+	imageColorModelYcck
+)
+
+// DecodeImageOptions controls how `DecodeImage` converts the samples.
+type DecodeImageOptions struct {
+	// UseIccProfile converts CMYK and YCCK images through the embedded ICC
+	// profile. If there's no profile or it can't be used, the conversion is
+	// done naively as if no profile had been requested.
+	UseIccProfile bool
+}
+
+// DecodeImage reconstructs the image from its scans. This covers what the
+// standard decoder can't: lossless (SOF3) images, with any precision from two
+// to sixteen bits, and DCT images with twelve-bit samples. Eight-bit DCT
+// images, whether Huffman- or arithmetic-coded, work too. `options` may be
+// nil.
+//
+// One-component images are returned as `*image.Gray16` and three- and
+// four-component images as `*image.RGBA64`, with the samples scaled to
+// sixteen bits. Subsampled components are upsampled by replication.
+//
+// The components are interpreted the way that libjpeg does: with a JFIF
+// segment, three components are YCbCr; with an Adobe segment, its transform
+// decides between RGB and YCbCr or between CMYK and YCCK; otherwise, three
+// components are YCbCr unless their IDs are "R", "G", and "B" and four are
+// CMYK. Lossless images are taken to be RGB rather than YCbCr, which is how
+// DICOM and DNG use them. Like Photoshop, CMYK values are taken to be
+// inverted if there's an Adobe segment.
+func (sl *SegmentList) DecodeImage(options *DecodeImageOptions) (img image.Image, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	fh, sd, quantizationTables, err := sl.decodeScans()
+	log.PanicIf(err)
+
+	var planes []*samplePlane
+
+	if fh.IsLossless() == true {
+		planes = sd.(*losslessScanDecoder).samplePlanes()
+	} else {
+		coefficients, err := decodedCoefficients(fh, sd, quantizationTables)
+		log.PanicIf(err)
+
+		planes = dctSamplePlanes(coefficients)
+	}
+
+	img, err = sl.planesImage(fh, planes, options)
+	log.PanicIf(err)
+
+	return img, nil
+}
+
+// decodeDcImage reconstructs the image at one-eighth of its size from only
+// the DC coefficients, which is much cheaper than `DecodeImage` when only an
+// impression of the image is needed. Lossless images are decoded in full.
+func (sl *SegmentList) decodeDcImage() (img image.Image, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	fh, sd, quantizationTables, err := sl.decodeScans()
+	log.PanicIf(err)
+
+	if fh.IsLossless() == true {
+		img, err = sl.planesImage(fh, sd.(*losslessScanDecoder).samplePlanes(), nil)
+		log.PanicIf(err)
+
+		return img, nil
+	}
+
+	coefficients, err := decodedCoefficients(fh, sd, quantizationTables)
+	log.PanicIf(err)
+
+	// Every block becomes one sample, which is the average of the block.
+
+	ss := newSampleScaler(fh.BitsPerSample)
+	center := float64(int(1) << (fh.BitsPerSample - 1))
+
+	planes := make([]*samplePlane, len(coefficients.Components))
+	for i, cc := range coefficients.Components {
+		qt := coefficients.QuantizationTables[fh.Components[i].QuantizationTableId]
+		plane := newSamplePlane(cc.BlocksWide, cc.BlocksHigh)
+
+		for row := 0; row < cc.BlocksHigh; row++ {
+			for column := 0; column < cc.BlocksWide; column++ {
+				value := float64(cc.Block(column, row)[0])*float64(qt.Values[0])/8 + center
+				value = math.Min(math.Max(math.Floor(value+0.5), 0), float64(ss.maximum))
+
+				plane.set(column, row, uint16(value))
+			}
+		}
+
+		planes[i] = plane
+	}
+
+	scaled := *fh
+	scaled.Width = uint16((int(fh.Width) + blockSize - 1) / blockSize)
+	scaled.Height = uint16((int(fh.Height) + blockSize - 1) / blockSize)
+
+	img, err = sl.planesImage(&scaled, planes, nil)
+	log.PanicIf(err)
+
+	return img, nil
+}
+
+// planesImage converts the component samples to an image.
+func (sl *SegmentList) planesImage(fh *SofSegment, planes []*samplePlane, options *DecodeImageOptions) (img image.Image, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if options == nil {
+		options = new(DecodeImageOptions)
+	}
+
+	colorModel, isInverted, err := sl.colorModel(fh)
+	log.PanicIf(err)
+
+	switch colorModel {
+	case imageColorModelGray:
+		img = grayImage(fh, planes[0])
+	case imageColorModelRgb, imageColorModelYCbCr:
+		img = rgbImage(fh, planes, colorModel == imageColorModelYCbCr)
+	default:
+		var it *iccTransform
+		if options.UseIccProfile == true {
+			it = sl.cmykIccTransform()
+		}
+
+		img = cmykImage(fh, planes, colorModel == imageColorModelYcck, isInverted, it)
+	}
+
+	return img, nil
+}
+
+// colorModel returns how the components of the frame are to be interpreted
+// and whether CMYK values are inverted.
+func (sl *SegmentList) colorModel(fh *SofSegment) (colorModel imageColorModel, isInverted bool, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	hasJfif := false
+	for _, s := range sl.segments {
+		if s.MarkerId == MARKER_APP0 && bytes.HasPrefix(s.Data, jfifPrefix) == true {
+			hasJfif = true
+			break
+		}
+	}
+
+	adobe, err := sl.Adobe()
+	if err != nil {
+		if err != ErrNoAdobe {
+			log.Panic(err)
+		}
+
+		adobe = nil
+	}
+
+	switch len(fh.Components) {
+	case 1:
+		return imageColorModelGray, false, nil
+	case 3:
+		if hasJfif == true {
+			return imageColorModelYCbCr, false, nil
+		} else if adobe != nil {
+			if adobe.ColorTransform == AdobeColorTransformNone {
+				return imageColorModelRgb, false, nil
+			}
+
+			return imageColorModelYCbCr, false, nil
+		} else if fh.Components[0].Id == 'R' && fh.Components[1].Id == 'G' && fh.Components[2].Id == 'B' {
+			return imageColorModelRgb, false, nil
+		} else if fh.IsLossless() == true {
+			return imageColorModelRgb, false, nil
+		}
+
+		return imageColorModelYCbCr, false, nil
+	case 4:
+		if adobe == nil {
+			return imageColorModelCmyk, false, nil
+		} else if adobe.ColorTransform == AdobeColorTransformNone {
+			return imageColorModelCmyk, true, nil
+		}
+
+		return imageColorModelYcck, true, nil
+	}
+
+	log.Panicf("component-count not supported: (%d)", len(fh.Components))
+	return 0, false, nil
+}
+
+// cmykIccTransform returns the transform for the embedded profile or nil if
+// there isn't one that we can use.
+func (sl *SegmentList) cmykIccTransform() *iccTransform {
+	data, err := sl.IccProfile()
+	if err != nil {
+		return nil
+	}
+
+	profile, err := ParseIccProfile(data)
+	if err != nil || profile.ColorSpace != "CMYK" {
+		return nil
+	}
+
+	it, err := newIccTransform(profile, 4)
+	if err != nil {
+		return nil
+	}
+
+	return it
+}
+
+// dctSamplePlanes returns the samples of each component. The planes include
+// the padding blocks.
+func dctSamplePlanes(coefficients *Coefficients) []*samplePlane {
+	fh := coefficients.Frame
+	planes := make([]*samplePlane, len(coefficients.Components))
+
+	var samples [64]uint16
+
+	for i, cc := range coefficients.Components {
+		qt := coefficients.QuantizationTables[fh.Components[i].QuantizationTableId]
+		plane := newSamplePlane(cc.BlocksWide*blockSize, cc.BlocksHigh*blockSize)
+
+		for row := 0; row < cc.BlocksHigh; row++ {
+			for column := 0; column < cc.BlocksWide; column++ {
+				inverseDct(cc.Block(column, row), qt, fh.BitsPerSample, &samples)
+
+				for y := 0; y < blockSize; y++ {
+					for x := 0; x < blockSize; x++ {
+						plane.set(column*blockSize+x, row*blockSize+y, samples[y*blockSize+x])
+					}
+				}
+			}
+		}
+
+		planes[i] = plane
+	}
+
+	return planes
+}
+
+// sampleScaler scales samples of the given precision to sixteen bits.
+type sampleScaler struct {
+	maximum uint32
+}
+
+func newSampleScaler(precision byte) sampleScaler {
+	return sampleScaler{
+		maximum: uint32(1)<<precision - 1,
+	}
+}
+
+func (ss sampleScaler) scale(value uint32) uint16 {
+	if value > ss.maximum {
+		value = ss.maximum
+	}
+
+	return uint16(value * 0xffff / ss.maximum)
+}
+
+func (ss sampleScaler) scaleFloat(value float64) uint16 {
+	value = math.Floor(value + 0.5)
+	if value < 0 {
+		return 0
+	}
+
+	return ss.scale(uint32(math.Min(value, float64(ss.maximum))))
+}
+
+// componentSampler returns the sample that covers the given pixel.
+func componentSampler(fh *SofSegment, i int, plane *samplePlane) func(x, y int) uint16 {
+	hMax, vMax := fh.MaxSampling()
+
+	fc := fh.Components[i]
+	h := int(fc.HorizontalSampling)
+	v := int(fc.VerticalSampling)
+
+	return func(x, y int) uint16 {
+		return plane.at(x*h/hMax, y*v/vMax)
+	}
+}
+
+func grayImage(fh *SofSegment, plane *samplePlane) *image.Gray16 {
+	width := int(fh.Width)
+	height := int(fh.Height)
+
+	g := image.NewGray16(image.Rect(0, 0, width, height))
+
+	ss := newSampleScaler(fh.BitsPerSample)
+	sample := componentSampler(fh, 0, plane)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			g.SetGray16(x, y, color.Gray16{Y: ss.scale(uint32(sample(x, y)))})
+		}
+	}
+
+	return g
+}
+
+func rgbImage(fh *SofSegment, planes []*samplePlane, isYCbCr bool) *image.RGBA64 {
+	width := int(fh.Width)
+	height := int(fh.Height)
+
+	rgba := image.NewRGBA64(image.Rect(0, 0, width, height))
+
+	ss := newSampleScaler(fh.BitsPerSample)
+
+	samplers := make([]func(x, y int) uint16, len(planes))
+	for i, plane := range planes {
+		samplers[i] = componentSampler(fh, i, plane)
+	}
+
+	// The chroma is centered on half of the range.
+	center := float64(int(1) << (fh.BitsPerSample - 1))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			a := samplers[0](x, y)
+			b := samplers[1](x, y)
+			c := samplers[2](x, y)
+
+			var pixel color.RGBA64
+			if isYCbCr == true {
+				// T.871 section 7.
+				yy := float64(a)
+				cb := float64(b) - center
+				cr := float64(c) - center
+
+				pixel = color.RGBA64{
+					R: ss.scaleFloat(yy + 1.402*cr),
+					G: ss.scaleFloat(yy - 0.344136*cb - 0.714136*cr),
+					B: ss.scaleFloat(yy + 1.772*cb),
+					A: 0xffff,
+				}
+			} else {
+				pixel = color.RGBA64{
+					R: ss.scale(uint32(a)),
+					G: ss.scale(uint32(b)),
+					B: ss.scale(uint32(c)),
+					A: 0xffff,
+				}
+			}
+
+			rgba.SetRGBA64(x, y, pixel)
+		}
+	}
+
+	return rgba
+}
+
+// cmykImage converts CMYK or YCCK to RGB, either through the ICC transform or,
+// if that's nil, naively.
+func cmykImage(fh *SofSegment, planes []*samplePlane, isYcck, isInverted bool, it *iccTransform) *image.RGBA64 {
+	width := int(fh.Width)
+	height := int(fh.Height)
+
+	rgba := image.NewRGBA64(image.Rect(0, 0, width, height))
+
+	ss := newSampleScaler(fh.BitsPerSample)
+	maximum := float64(ss.maximum)
+	center := float64(int(1) << (fh.BitsPerSample - 1))
+
+	samplers := make([]func(x, y int) uint16, len(planes))
+	for i, plane := range planes {
+		samplers[i] = componentSampler(fh, i, plane)
+	}
+
+	// Most images have far fewer colors than pixels and the profile is
+	// expensive, so remember what we've converted (up to a point).
+	cache := make(map[uint64]color.RGBA64)
+
+	const maxCacheSize = 1 << 18
+
+	var inks [4]float64
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var stored [4]uint16
+			for i := range stored {
+				stored[i] = samplers[i](x, y)
+			}
+
+			key := uint64(stored[0])<<48 | uint64(stored[1])<<32 | uint64(stored[2])<<16 | uint64(stored[3])
+
+			if pixel, found := cache[key]; found == true {
+				rgba.SetRGBA64(x, y, pixel)
+				continue
+			}
+
+			values := [4]float64{float64(stored[0]), float64(stored[1]), float64(stored[2]), float64(stored[3])}
+
+			if isYcck == true {
+				// The CMY was converted as if it was RGB (T.871 section 7).
+				// Like libjpeg, what comes back is already the CMY inks
+				// (only K is stored inverted).
+				yy := values[0]
+				cb := values[1] - center
+				cr := values[2] - center
+
+				values[0] = math.Min(math.Max(yy+1.402*cr, 0), maximum)
+				values[1] = math.Min(math.Max(yy-0.344136*cb-0.714136*cr, 0), maximum)
+				values[2] = math.Min(math.Max(yy+1.772*cb, 0), maximum)
+			}
+
+			for i, value := range values {
+				inks[i] = value / maximum
+
+				if isInverted == true && (isYcck == false || i == 3) {
+					inks[i] = 1 - inks[i]
+				}
+			}
+
+			var pixel color.RGBA64
+
+			if it != nil {
+				r, g, b := it.convert(inks[:])
+
+				pixel = color.RGBA64{
+					R: ss.scaleFloat(r * maximum),
+					G: ss.scaleFloat(g * maximum),
+					B: ss.scaleFloat(b * maximum),
+					A: 0xffff,
+				}
+			} else {
+				white := 1 - inks[3]
+
+				pixel = color.RGBA64{
+					R: ss.scaleFloat((1 - inks[0]) * white * maximum),
+					G: ss.scaleFloat((1 - inks[1]) * white * maximum),
+					B: ss.scaleFloat((1 - inks[2]) * white * maximum),
+					A: 0xffff,
+				}
+			}
+
+			if len(cache) < maxCacheSize {
+				cache[key] = pixel
+			}
+
+			rgba.SetRGBA64(x, y, pixel)
+		}
+	}
+
+	return rgba
+}
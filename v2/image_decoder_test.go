@@ -0,0 +1,533 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"testing"
+
+	"github.com/dsoprea/go-logging"
+)
+
+// checkImagesSimilar makes sure that every pixel is within the given
+// tolerance (in sixteen-bit units).
+func checkImagesSimilar(t *testing.T, actual, expected image.Image, tolerance int) {
+	if actual.Bounds() != expected.Bounds() {
+		t.Fatalf("Bounds not equal: %v != %v", actual.Bounds(), expected.Bounds())
+	}
+
+	difference := func(a, b uint32) int {
+		if a > b {
+			return int(a - b)
+		}
+
+		return int(b - a)
+	}
+
+	bounds := expected.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, _ := actual.At(x, y).RGBA()
+			r2, g2, b2, _ := expected.At(x, y).RGBA()
+
+			if difference(r1, r2) > tolerance || difference(g1, g2) > tolerance || difference(b1, b2) > tolerance {
+				t.Fatalf("Pixel (%d, %d) not similar: (%d, %d, %d) != (%d, %d, %d)", x, y, r1, g1, b1, r2, g2, b2)
+			}
+		}
+	}
+}
+
+// getTwelveBitTestSegmentList returns an image whose samples are sixteen
+// times those of the given eight-bit image.
+func getTwelveBitTestSegmentList(original []byte) *SegmentList {
+	sl := getCoefficientsTestSegmentList(original)
+
+	coefficients, err := sl.ReadCoefficients()
+	log.PanicIf(err)
+
+	// The transform is linear, so scaling the quantization scales the
+	// samples. The level-shift scales with the precision.
+
+	coefficients.Frame.BitsPerSample = 12
+
+	for i, qt := range coefficients.QuantizationTables {
+		if qt == nil {
+			continue
+		}
+
+		scaled := *qt
+		for j := range scaled.Values {
+			scaled.Values[j] *= 16
+		}
+
+		coefficients.QuantizationTables[i] = &scaled
+	}
+
+	err = sl.WriteCoefficients(coefficients, nil)
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	return sl
+}
+
+func TestSegmentList_DecodeImage(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	original := getTestGeneratedJpeg(100, 75, false)
+	sl := getCoefficientsTestSegmentList(original)
+
+	img, err := sl.DecodeImage(nil)
+	log.PanicIf(err)
+
+	if _, ok := img.(*image.RGBA64); ok != true {
+		t.Fatalf("Image type not correct: [%T]", img)
+	}
+
+	expected, err := jpeg.Decode(bytes.NewReader(original))
+	log.PanicIf(err)
+
+	// The IDCT and the color conversion are done differently.
+	checkImagesSimilar(t, img, expected, 4*0x101)
+}
+
+func TestSegmentList_DecodeImage_TwelveBit(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	for _, isGray := range []bool{false, true} {
+		original := getTestGeneratedJpeg(100, 75, isGray)
+
+		expected, err := getCoefficientsTestSegmentList(original).DecodeImage(nil)
+		log.PanicIf(err)
+
+		sl := getTwelveBitTestSegmentList(original)
+
+		_, data := reparseSegmentList(sl)
+
+		// The standard decoder can't handle it.
+
+		_, err = jpeg.Decode(bytes.NewReader(data))
+		if err == nil {
+			t.Fatalf("Expected the standard decoder to fail.")
+		}
+
+		jmp := NewJpegMediaParser()
+
+		img, err := jmp.GetImage(bytes.NewReader(data))
+		log.PanicIf(err)
+
+		if isGray == true {
+			if _, ok := img.(*image.Gray16); ok != true {
+				t.Fatalf("Image type not correct: [%T]", img)
+			}
+		} else if _, ok := img.(*image.RGBA64); ok != true {
+			t.Fatalf("Image type not correct: [%T]", img)
+		}
+
+		// The eight-bit image is rounded before the color conversion, which
+		// costs it a couple of levels.
+		checkImagesSimilar(t, img, expected, 3*0x101)
+	}
+}
+
+func TestSegmentList_DecodeImage_Arithmetic(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	original := getTestGeneratedJpeg(64, 48, false)
+	sl := getCoefficientsTestSegmentList(original)
+
+	expected, err := sl.DecodeImage(nil)
+	log.PanicIf(err)
+
+	err = sl.Reencode(&WriteCoefficientsOptions{Arithmetic: true, Progressive: true})
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	img, err := sl.DecodeImage(nil)
+	log.PanicIf(err)
+
+	checkImagesSimilar(t, img, expected, 0)
+}
+
+func TestSegmentList_DecodeImage_LosslessRgb(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	lti := &losslessTestImage{
+		frame:     getLosslessTestFrame(20, 10, 8, 1, 1, 1, 1, 1, 1),
+		predictor: 5,
+	}
+
+	sl := checkLosslessRoundTrip(t, lti)
+
+	img, err := sl.DecodeImage(nil)
+	log.PanicIf(err)
+
+	rgba, ok := img.(*image.RGBA64)
+	if ok != true {
+		t.Fatalf("Image type not correct: [%T]", img)
+	}
+
+	// Without a JFIF segment, the samples are RGB.
+
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 20; x++ {
+			c := rgba.RGBA64At(x, y)
+			i := y*20 + x
+
+			if c.R != lti.samples[0][i]*0x101 || c.G != lti.samples[1][i]*0x101 || c.B != lti.samples[2][i]*0x101 || c.A != 0xffff {
+				t.Fatalf("Pixel (%d, %d) not correct: %v", x, y, c)
+			}
+		}
+	}
+}
+
+func TestSegmentList_colorModel(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	jfif := &Segment{
+		MarkerId: MARKER_APP0,
+		Data:     []byte("JFIF\000\001\002\000\000\001\000\001\000\000"),
+	}
+
+	adobe := func(transform AdobeColorTransform) *Segment {
+		as := &AdobeSegment{
+			Version:        100,
+			ColorTransform: transform,
+		}
+
+		return &Segment{
+			MarkerId: MARKER_APP14,
+			Data:     as.Encode(),
+		}
+	}
+
+	lossless := getLosslessTestFrame(8, 8, 8, 1, 1, 1, 1, 1, 1)
+
+	dct := getLosslessTestFrame(8, 8, 8, 1, 1, 1, 1, 1, 1)
+	dct.MarkerId = MARKER_SOF1
+
+	rgb := getLosslessTestFrame(8, 8, 8, 1, 1, 1, 1, 1, 1)
+	rgb.MarkerId = MARKER_SOF1
+	rgb.Components[0].Id = 'R'
+	rgb.Components[1].Id = 'G'
+	rgb.Components[2].Id = 'B'
+
+	cmyk := getLosslessTestFrame(8, 8, 8, 1, 1, 1, 1, 1, 1, 1, 1)
+	cmyk.MarkerId = MARKER_SOF1
+
+	gray := getLosslessTestFrame(8, 8, 8, 1, 1)
+
+	cases := []struct {
+		segments           []*Segment
+		fh                 *SofSegment
+		expectedColorModel imageColorModel
+		expectedIsInverted bool
+	}{
+		{nil, gray, imageColorModelGray, false},
+		{nil, lossless, imageColorModelRgb, false},
+		{[]*Segment{jfif}, lossless, imageColorModelYCbCr, false},
+		{nil, dct, imageColorModelYCbCr, false},
+		{nil, rgb, imageColorModelRgb, false},
+		{[]*Segment{jfif}, rgb, imageColorModelYCbCr, false},
+		{[]*Segment{adobe(AdobeColorTransformNone)}, dct, imageColorModelRgb, false},
+		{[]*Segment{adobe(AdobeColorTransformYCbCr)}, rgb, imageColorModelYCbCr, false},
+		{nil, cmyk, imageColorModelCmyk, false},
+		{[]*Segment{adobe(AdobeColorTransformNone)}, cmyk, imageColorModelCmyk, true},
+		{[]*Segment{adobe(AdobeColorTransformYcck)}, cmyk, imageColorModelYcck, true},
+	}
+
+	for i, c := range cases {
+		sl := NewSegmentList(c.segments)
+
+		colorModel, isInverted, err := sl.colorModel(c.fh)
+		log.PanicIf(err)
+
+		if colorModel != c.expectedColorModel || isInverted != c.expectedIsInverted {
+			t.Fatalf("Case (%d) not correct: (%d) %v", i, colorModel, isInverted)
+		}
+	}
+
+	fh := getLosslessTestFrame(8, 8, 8, 1, 1, 1, 1)
+
+	_, _, err := NewSegmentList(nil).colorModel(fh)
+	if err == nil {
+		t.Fatalf("Expected error for two components.")
+	}
+}
+
+// getCmykTestSegmentList returns a four-component image with one flat block
+// per color. The segments are inserted after the SOI.
+func getCmykTestSegmentList(colors [][4]byte, segments []*Segment) *SegmentList {
+	original := getTestGeneratedJpeg(8*len(colors), 8, true)
+	sl := getCoefficientsTestSegmentList(original)
+
+	fh := getLosslessTestFrame(8*len(colors), 8, 8, 1, 1, 1, 1, 1, 1, 1, 1)
+	fh.MarkerId = MARKER_SOF1
+
+	qt := &QuantizationTable{}
+	for i := range qt.Values {
+		qt.Values[i] = 1
+	}
+
+	coefficients := &Coefficients{
+		Frame:      fh,
+		Components: make([]*ComponentCoefficients, 4),
+	}
+
+	coefficients.QuantizationTables[0] = qt
+
+	for i := range coefficients.Components {
+		cc := newComponentCoefficients(fh.Components[i].Id, len(colors), 1)
+
+		// With a flat table, the DC is eight times the level-shifted sample.
+		for j, c := range colors {
+			cc.Blocks[j][0] = int16(8 * (int(c[i]) - 128))
+		}
+
+		coefficients.Components[i] = cc
+	}
+
+	err := sl.WriteCoefficients(coefficients, nil)
+	log.PanicIf(err)
+
+	inserted := append([]*Segment{sl.segments[0]}, segments...)
+	sl.segments = append(inserted, sl.segments[1:]...)
+
+	sl, _ = reparseSegmentList(sl)
+
+	return sl
+}
+
+// checkCmykTestImage checks the color of each block, to the given number of
+// eight-bit levels.
+func checkCmykTestImage(t *testing.T, img image.Image, expected [][3]int, tolerance int) {
+	rgba, ok := img.(*image.RGBA64)
+	if ok != true {
+		t.Fatalf("Image type not correct: [%T]", img)
+	}
+
+	for i, e := range expected {
+		c := rgba.RGBA64At(i*8+4, 4)
+
+		actual := [3]int{int(c.R >> 8), int(c.G >> 8), int(c.B >> 8)}
+		for j := range actual {
+			if actual[j]-e[j] > tolerance || e[j]-actual[j] > tolerance {
+				t.Fatalf("Block (%d) not correct: %v != %v", i, actual, e)
+			}
+		}
+	}
+}
+
+func TestSegmentList_DecodeImage_Cmyk(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	adobe := func(transform AdobeColorTransform) []*Segment {
+		as := &AdobeSegment{
+			Version:        100,
+			ColorTransform: transform,
+		}
+
+		s := &Segment{
+			MarkerId:   MARKER_APP14,
+			MarkerName: markerNames[MARKER_APP14],
+			Data:       as.Encode(),
+		}
+
+		return []*Segment{s}
+	}
+
+	expected := [][3]int{
+		{0, 255, 255},
+		{255, 255, 255},
+		{0, 0, 0},
+	}
+
+	// Not inverted.
+
+	sl := getCmykTestSegmentList([][4]byte{{255, 0, 0, 0}, {0, 0, 0, 0}, {0, 0, 0, 255}}, nil)
+
+	img, err := sl.DecodeImage(nil)
+	log.PanicIf(err)
+
+	checkCmykTestImage(t, img, expected, 1)
+
+	// Inverted, the way that Photoshop writes them.
+
+	sl = getCmykTestSegmentList([][4]byte{{0, 255, 255, 255}, {255, 255, 255, 255}, {255, 255, 255, 0}}, adobe(AdobeColorTransformNone))
+
+	img, err = sl.DecodeImage(nil)
+	log.PanicIf(err)
+
+	checkCmykTestImage(t, img, expected, 1)
+
+	// The standard decoder can't do these.
+
+	_, data := reparseSegmentList(sl)
+
+	jmp := NewJpegMediaParser()
+
+	img, err = jmp.GetImage(bytes.NewReader(data))
+	log.PanicIf(err)
+
+	checkCmykTestImage(t, img, expected, 1)
+
+	// YCCK, where the CMY inks were converted like RGB and K is inverted.
+
+	sl = getCmykTestSegmentList([][4]byte{{76, 85, 255, 255}, {0, 128, 128, 255}, {0, 128, 128, 0}}, adobe(AdobeColorTransformYcck))
+
+	img, err = sl.DecodeImage(nil)
+	log.PanicIf(err)
+
+	checkCmykTestImage(t, img, expected, 2)
+
+	// The standard decoder converts YCCK to CMYK itself, so it can check
+	// us.
+
+	sl = getCmykTestSegmentList([][4]byte{{76, 85, 255, 255}, {150, 100, 200, 60}, {200, 140, 90, 180}, {30, 128, 128, 255}}, adobe(AdobeColorTransformYcck))
+
+	img, err = sl.DecodeImage(nil)
+	log.PanicIf(err)
+
+	_, data = reparseSegmentList(sl)
+
+	standardImg, err := jpeg.Decode(bytes.NewReader(data))
+	log.PanicIf(err)
+
+	if _, ok := standardImg.(*image.CMYK); ok != true {
+		t.Fatalf("Standard image type not correct: [%T]", standardImg)
+	}
+
+	checkImagesSimilar(t, img, standardImg, 0x300)
+}
+
+func TestSegmentList_DecodeImage_CmykIccProfile(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	profile := getIccTestProfile(0x02100000, "CMYK", "Lab ", map[string][]byte{"A2B0": getIccTestLut(2)})
+
+	colors := [][4]byte{{255, 0, 0, 0}, {0, 255, 0, 0}, {0, 0, 0, 0}, {0, 0, 0, 255}}
+	sl := getCmykTestSegmentList(colors, getIccTestSegments(profile, 100))
+
+	// The test profile maps cyan to red and magenta to blue.
+
+	img, err := sl.DecodeImage(&DecodeImageOptions{UseIccProfile: true})
+	log.PanicIf(err)
+
+	checkCmykTestImage(t, img, [][3]int{{255, 0, 0}, {0, 0, 255}, {255, 255, 255}, {0, 0, 0}}, 1)
+
+	// Without it, the conversion is naive.
+
+	img, err = sl.DecodeImage(nil)
+	log.PanicIf(err)
+
+	checkCmykTestImage(t, img, [][3]int{{0, 255, 255}, {255, 0, 255}, {255, 255, 255}, {0, 0, 0}}, 1)
+
+	// A profile that we can't use is ignored.
+
+	profile = getIccTestProfile(0x02100000, "CMYK", "Lab ", map[string][]byte{"desc": []byte("no table")})
+	sl = getCmykTestSegmentList(colors, getIccTestSegments(profile, 100))
+
+	img, err = sl.DecodeImage(&DecodeImageOptions{UseIccProfile: true})
+	log.PanicIf(err)
+
+	checkCmykTestImage(t, img, [][3]int{{0, 255, 255}, {255, 0, 255}, {255, 255, 255}, {0, 0, 0}}, 1)
+}
+
+func TestSegmentList_decodeDcImage(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(100, 75, true))
+
+	full, err := sl.DecodeImage(nil)
+	log.PanicIf(err)
+
+	dc, err := sl.decodeDcImage()
+	log.PanicIf(err)
+
+	if dc.Bounds() != image.Rect(0, 0, 13, 10) {
+		t.Fatalf("Bounds not correct: %v", dc.Bounds())
+	}
+
+	// Each sample is the average of its block. The last row and column of
+	// blocks are partly padding, which the full image doesn't have.
+
+	g := full.(*image.Gray16)
+
+	for y := 0; y < 9; y++ {
+		for x := 0; x < 12; x++ {
+			total := 0
+			for i := 0; i < 64; i++ {
+				total += int(g.Gray16At(x*8+i%8, y*8+i/8).Y >> 8)
+			}
+
+			expected := (total + 32) / 64
+			actual := int(dc.(*image.Gray16).Gray16At(x, y).Y >> 8)
+
+			if actual-expected > 1 || expected-actual > 1 {
+				t.Fatalf("Block (%d, %d) not correct: (%d) != (%d)", x, y, actual, expected)
+			}
+		}
+	}
+
+	// Subsampled color.
+
+	sl = getCoefficientsTestSegmentList(getTestGeneratedJpeg(100, 75, false))
+
+	dc, err = sl.decodeDcImage()
+	log.PanicIf(err)
+
+	if _, ok := dc.(*image.RGBA64); ok != true {
+		t.Fatalf("Image type not correct: [%T]", dc)
+	} else if dc.Bounds() != image.Rect(0, 0, 13, 10) {
+		t.Fatalf("Color bounds not correct: %v", dc.Bounds())
+	}
+}
@@ -0,0 +1,589 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"encoding/binary"
+	"encoding/hex"
+
+	"github.com/dsoprea/go-logging"
+)
+
+var (
+	// jumbfPrefix is the common identifier of JPEG XT box segments (ISO/IEC
+	// 18477-3), which carry JUMBF (ISO/IEC 19566-5) in APP11.
+	jumbfPrefix = []byte("JP")
+
+	// jumbfUuidSuffix is shared by the UUIDs of the standard content types,
+	// which start with their four-character code.
+	jumbfUuidSuffix = []byte{0x00, 0x11, 0x00, 0x10, 0x80, 0x00, 0x00, 0xaa, 0x00, 0x38, 0x9b, 0x71}
+)
+
+var (
+	// ErrNoJumbf is returned if JUMBF data was requested but not found.
+	ErrNoJumbf = errors.New("no JUMBF data")
+
+	// ErrNoC2pa is returned if the C2PA manifest store was requested but not
+	// found.
+	ErrNoC2pa = errors.New("no C2PA manifest store")
+)
+
+const (
+	// jumbfPacketHeaderSize is the size of the common identifier, the box
+	// instance number, and the packet sequence number.
+	jumbfPacketHeaderSize = 8
+
+	// jumbfBoxHeaderSize is the size of LBox and TBox.
+	jumbfBoxHeaderSize = 8
+
+	// jumbfDescriptionHashSize is the size of the SHA-256 digest that a
+	// description box can have.
+	jumbfDescriptionHashSize = 32
+)
+
+const (
+	// JumbfBoxTypeSuperbox is the type of a box that contains a description
+	// box and content boxes.
+	JumbfBoxTypeSuperbox = "jumb"
+
+	// JumbfBoxTypeDescription is the type of the box that describes a
+	// superbox.
+	JumbfBoxTypeDescription = "jumd"
+
+	// JumbfBoxTypeJson is the type of a content box with JSON.
+	JumbfBoxTypeJson = "json"
+
+	// JumbfBoxTypeCbor is the type of a content box with CBOR.
+	JumbfBoxTypeCbor = "cbor"
+
+	// JumbfBoxTypeUuid is the type of a content box with a UUID and then
+	// data.
+	JumbfBoxTypeUuid = "uuid"
+)
+
+const (
+	// JumbfContentTypeJson is a superbox with a JSON content box.
+	JumbfContentTypeJson = "json"
+
+	// JumbfContentTypeCbor is a superbox with a CBOR content box.
+	JumbfContentTypeCbor = "cbor"
+
+	// JumbfContentTypeUuid is a superbox with a UUID content box.
+	JumbfContentTypeUuid = "uuid"
+
+	// JumbfContentTypeEmbeddedFile is a superbox with an embedded file.
+	JumbfContentTypeEmbeddedFile = "40cb0c32-bb8a-489d-a70b-2ad6f47f4369"
+
+	// JumbfContentTypeC2paManifestStore is the C2PA manifest store.
+	JumbfContentTypeC2paManifestStore = "c2pa"
+
+	// JumbfContentTypeC2paManifest is one C2PA manifest.
+	JumbfContentTypeC2paManifest = "c2ma"
+
+	// JumbfContentTypeC2paUpdateManifest is a C2PA update manifest.
+	JumbfContentTypeC2paUpdateManifest = "c2um"
+
+	// JumbfContentTypeC2paAssertionStore is the assertions of a manifest.
+	JumbfContentTypeC2paAssertionStore = "c2as"
+
+	// JumbfContentTypeC2paClaim is the claim of a manifest.
+	JumbfContentTypeC2paClaim = "c2cl"
+
+	// JumbfContentTypeC2paClaimSignature is the signature of a claim.
+	JumbfContentTypeC2paClaimSignature = "c2cs"
+
+	// JumbfContentTypeC2paCredentials is the verifiable credentials of a
+	// manifest.
+	JumbfContentTypeC2paCredentials = "c2vc"
+)
+
+// JumbfDescription is the description box (jumd) of a superbox.
+type JumbfDescription struct {
+	// Type is the UUID of the content type.
+	Type [16]byte
+
+	// Toggles has the flags for which of the optional fields are present, and
+	// whether the superbox is requestable (0x01).
+	Toggles byte
+
+	// Label is the label, if there is one.
+	Label string
+
+	// HasId is true if there's an ID.
+	HasId bool
+
+	// Id is the ID.
+	Id uint32
+
+	// Hash is the SHA-256 digest of the content, if there is one.
+	Hash []byte
+
+	// Private is the private box, if there is one.
+	Private *JumbfBox
+}
+
+// ContentType returns the four-character code of the content type for the
+// standard types, and the formatted UUID otherwise.
+func (jd *JumbfDescription) ContentType() string {
+	if bytes.Equal(jd.Type[4:], jumbfUuidSuffix) == true {
+		return string(jd.Type[:4])
+	}
+
+	return formatUuid(jd.Type)
+}
+
+// String returns a descriptive string.
+func (jd *JumbfDescription) String() string {
+	return fmt.Sprintf("JumbfDescription<TYPE=[%s] LABEL=[%s] TOGGLES=(0x%02x)>", jd.ContentType(), jd.Label, jd.Toggles)
+}
+
+// formatUuid returns the UUID in the usual hyphenated form.
+func formatUuid(uuid [16]byte) string {
+	s := hex.EncodeToString(uuid[:])
+	return strings.Join([]string{s[:8], s[8:12], s[12:16], s[16:20], s[20:]}, "-")
+}
+
+// JumbfBox is a box from a JUMBF tree.
+type JumbfBox struct {
+	// Type is the four-character box type.
+	Type string
+
+	// Description is the description of a superbox.
+	Description *JumbfDescription
+
+	// Children are the content boxes of a superbox (after the description).
+	Children []*JumbfBox
+
+	// Payload is the content of any other box.
+	Payload []byte
+
+	// contents is everything after the header of a superbox, which is what
+	// C2PA hashes to refer to it.
+	contents []byte
+}
+
+// IsSuperbox returns true if the box is a superbox.
+func (jb *JumbfBox) IsSuperbox() bool {
+	return jb.Type == JumbfBoxTypeSuperbox
+}
+
+// Label returns the label of a superbox, or an empty string.
+func (jb *JumbfBox) Label() string {
+	if jb.Description == nil {
+		return ""
+	}
+
+	return jb.Description.Label
+}
+
+// ContentType returns the content type of a superbox, or an empty string.
+func (jb *JumbfBox) ContentType() string {
+	if jb.Description == nil {
+		return ""
+	}
+
+	return jb.Description.ContentType()
+}
+
+// Child returns the first child superbox with the given label.
+func (jb *JumbfBox) Child(label string) (child *JumbfBox, found bool) {
+	for _, child := range jb.Children {
+		if child.IsSuperbox() == true && child.Label() == label {
+			return child, true
+		}
+	}
+
+	return nil, false
+}
+
+// Find returns the superbox at the given path of labels, separated by
+// slashes, relative to this one. This is how C2PA URIs refer to boxes, after
+// the "self#jumbf=" prefix.
+func (jb *JumbfBox) Find(path string) (box *JumbfBox, found bool) {
+	box = jb
+
+	for _, label := range strings.Split(strings.Trim(path, "/"), "/") {
+		box, found = box.Child(label)
+		if found == false {
+			return nil, false
+		}
+	}
+
+	return box, true
+}
+
+// Content returns the first content box of a superbox, which is where the
+// data of the standard content types is.
+func (jb *JumbfBox) Content() (content *JumbfBox, found bool) {
+	for _, child := range jb.Children {
+		if child.IsSuperbox() == false {
+			return child, true
+		}
+	}
+
+	return nil, false
+}
+
+// Uuid returns the UUID and the data of a "uuid" content box.
+func (jb *JumbfBox) Uuid() (uuid [16]byte, data []byte, err error) {
+	if jb.Type != JumbfBoxTypeUuid || len(jb.Payload) < 16 {
+		return uuid, nil, fmt.Errorf("not a UUID box: [%s]", jb.Type)
+	}
+
+	copy(uuid[:], jb.Payload)
+
+	return uuid, jb.Payload[16:], nil
+}
+
+// String returns a descriptive string.
+func (jb *JumbfBox) String() string {
+	if jb.IsSuperbox() == true {
+		return fmt.Sprintf("JumbfBox<TYPE=[%s] CONTENT-TYPE=[%s] LABEL=[%s] CHILDREN=(%d)>", jb.Type, jb.ContentType(), jb.Label(), len(jb.Children))
+	}
+
+	return fmt.Sprintf("JumbfBox<TYPE=[%s] SIZE=(%d)>", jb.Type, len(jb.Payload))
+}
+
+// Dump returns the tree, one box per line, indented by depth.
+func (jb *JumbfBox) Dump() string {
+	b := new(strings.Builder)
+	jb.dump(b, 0)
+
+	return b.String()
+}
+
+func (jb *JumbfBox) dump(b *strings.Builder, depth int) {
+	fmt.Fprintf(b, "%s%s\n", strings.Repeat("  ", depth), jb)
+
+	for _, child := range jb.Children {
+		child.dump(b, depth+1)
+	}
+}
+
+// readJumbfBoxHeader returns the type of the box at the front of the data and
+// the sizes of its header and of the whole box. A zero size in LBox means
+// that the box runs to the end of the data.
+func readJumbfBoxHeader(data []byte) (boxType string, headerSize, boxSize int, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if len(data) < jumbfBoxHeaderSize {
+		log.Panicf("box header truncated: (%d)", len(data))
+	}
+
+	size := uint64(binary.BigEndian.Uint32(data))
+	boxType = string(data[4:8])
+	headerSize = jumbfBoxHeaderSize
+
+	if size == 1 {
+		if len(data) < jumbfBoxHeaderSize+8 {
+			log.Panicf("extended box header truncated: (%d)", len(data))
+		}
+
+		size = binary.BigEndian.Uint64(data[8:])
+		headerSize += 8
+	} else if size == 0 {
+		size = uint64(len(data))
+	}
+
+	if size < uint64(headerSize) {
+		log.Panicf("box size not valid: (%d)", size)
+	}
+
+	return boxType, headerSize, int(size), nil
+}
+
+// ParseJumbfBoxes parses a sequence of boxes.
+func ParseJumbfBoxes(data []byte) (boxes []*JumbfBox, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	boxes = make([]*JumbfBox, 0)
+
+	for len(data) > 0 {
+		boxType, headerSize, boxSize, err := readJumbfBoxHeader(data)
+		log.PanicIf(err)
+
+		if boxSize > len(data) {
+			log.Panicf("box [%s] truncated: (%d) > (%d)", boxType, boxSize, len(data))
+		}
+
+		jb := &JumbfBox{
+			Type: boxType,
+		}
+
+		payload := data[headerSize:boxSize]
+
+		if boxType == JumbfBoxTypeSuperbox {
+			children, err := ParseJumbfBoxes(payload)
+			log.PanicIf(err)
+
+			if len(children) == 0 || children[0].Type != JumbfBoxTypeDescription {
+				log.Panicf("superbox does not start with a description box")
+			}
+
+			jb.Description, err = parseJumbfDescription(children[0].Payload)
+			log.PanicIf(err)
+
+			jb.Children = children[1:]
+			jb.contents = payload
+		} else {
+			jb.Payload = payload
+		}
+
+		boxes = append(boxes, jb)
+		data = data[boxSize:]
+	}
+
+	return boxes, nil
+}
+
+// parseJumbfDescription parses the payload of a description box.
+func parseJumbfDescription(data []byte) (jd *JumbfDescription, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if len(data) < 17 {
+		log.Panicf("description box truncated: (%d)", len(data))
+	}
+
+	jd = &JumbfDescription{
+		Toggles: data[16],
+	}
+
+	copy(jd.Type[:], data)
+	data = data[17:]
+
+	if jd.Toggles&0x02 != 0 {
+		i := bytes.IndexByte(data, 0)
+		if i == -1 {
+			log.Panicf("description label not terminated")
+		}
+
+		jd.Label = string(data[:i])
+		data = data[i+1:]
+	}
+
+	if jd.Toggles&0x04 != 0 {
+		if len(data) < 4 {
+			log.Panicf("description ID truncated")
+		}
+
+		jd.HasId = true
+		jd.Id = binary.BigEndian.Uint32(data)
+		data = data[4:]
+	}
+
+	if jd.Toggles&0x08 != 0 {
+		if len(data) < jumbfDescriptionHashSize {
+			log.Panicf("description hash truncated")
+		}
+
+		jd.Hash = data[:jumbfDescriptionHashSize]
+		data = data[jumbfDescriptionHashSize:]
+	}
+
+	if jd.Toggles&0x10 != 0 {
+		boxes, err := ParseJumbfBoxes(data)
+		log.PanicIf(err)
+
+		if len(boxes) != 1 {
+			log.Panicf("description must have one private box: (%d)", len(boxes))
+		}
+
+		jd.Private = boxes[0]
+	}
+
+	return jd, nil
+}
+
+// IsJumbf returns true if the segment has a packet of a JUMBF box.
+func (s *Segment) IsJumbf() bool {
+	return s.MarkerId == MARKER_APP11 && len(s.Data) >= jumbfPacketHeaderSize+jumbfBoxHeaderSize && bytes.HasPrefix(s.Data, jumbfPrefix) == true
+}
+
+// jumbfPacket is the part of a box carried by one APP11 segment.
+type jumbfPacket struct {
+	sequence uint32
+	header   []byte
+	payload  []byte
+}
+
+// JumbfData reassembles the boxes that are split across the APP11 segments.
+// Each segment has the box instance number, which identifies the box, the
+// sequence number of the packet, and a copy of the box header, followed by the
+// next part of the payload. The boxes are returned in the order in which they
+// first appear.
+func (sl *SegmentList) JumbfData() (boxes [][]byte, err error) {
+	_, boxes, err = sl.jumbfInstances()
+	return boxes, err
+}
+
+// jumbfInstances reassembles the boxes and returns them with their instance
+// numbers.
+func (sl *SegmentList) jumbfInstances() (instances []uint16, boxes [][]byte, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	instances = make([]uint16, 0)
+	packets := make(map[uint16][]jumbfPacket)
+
+	for _, s := range sl.segments {
+		if s.IsJumbf() == false {
+			continue
+		}
+
+		instance := binary.BigEndian.Uint16(s.Data[2:])
+
+		_, headerSize, _, err := readJumbfBoxHeader(s.Data[jumbfPacketHeaderSize:])
+		log.PanicIf(err)
+
+		jp := jumbfPacket{
+			sequence: binary.BigEndian.Uint32(s.Data[4:]),
+			header:   s.Data[jumbfPacketHeaderSize : jumbfPacketHeaderSize+headerSize],
+			payload:  s.Data[jumbfPacketHeaderSize+headerSize:],
+		}
+
+		if _, found := packets[instance]; found == false {
+			instances = append(instances, instance)
+		}
+
+		packets[instance] = append(packets[instance], jp)
+	}
+
+	if len(instances) == 0 {
+		return nil, nil, ErrNoJumbf
+	}
+
+	boxes = make([][]byte, len(instances))
+
+	for i, instance := range instances {
+		jps := packets[instance]
+
+		sort.SliceStable(jps, func(i, j int) bool {
+			return jps[i].sequence < jps[j].sequence
+		})
+
+		box := append([]byte{}, jps[0].header...)
+
+		for j, jp := range jps {
+			if j > 0 && jp.sequence != jps[j-1].sequence+1 {
+				log.Panicf("JUMBF packets of box (%d) not contiguous: (%d) after (%d)", instance, jp.sequence, jps[j-1].sequence)
+			} else if bytes.Equal(jp.header, jps[0].header) == false {
+				log.Panicf("JUMBF packet headers of box (%d) not consistent", instance)
+			}
+
+			box = append(box, jp.payload...)
+		}
+
+		// Make sure that nothing is missing.
+
+		_, _, boxSize, err := readJumbfBoxHeader(box)
+		log.PanicIf(err)
+
+		if boxSize != len(box) {
+			log.Panicf("JUMBF box (%d) size not correct: (%d) != (%d)", instance, len(box), boxSize)
+		}
+
+		boxes[i] = box
+	}
+
+	return instances, boxes, nil
+}
+
+// Jumbf returns the parsed JUMBF boxes. `ErrNoJumbf` is returned if there
+// aren't any.
+func (sl *SegmentList) Jumbf() (boxes []*JumbfBox, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	data, err := sl.JumbfData()
+	if err != nil {
+		if err == ErrNoJumbf {
+			return nil, err
+		}
+
+		log.Panic(err)
+	}
+
+	boxes = make([]*JumbfBox, 0, len(data))
+
+	for _, raw := range data {
+		parsed, err := ParseJumbfBoxes(raw)
+		log.PanicIf(err)
+
+		boxes = append(boxes, parsed...)
+	}
+
+	return boxes, nil
+}
+
+// C2paManifestStore returns the parsed C2PA manifest store and its raw box.
+// `ErrNoC2pa` is returned if there isn't one.
+func (sl *SegmentList) C2paManifestStore() (store *JumbfBox, raw []byte, err error) {
+	store, raw, _, err = sl.c2paManifestStore()
+	return store, raw, err
+}
+
+// c2paManifestStore returns the manifest store with its box instance number.
+func (sl *SegmentList) c2paManifestStore() (store *JumbfBox, raw []byte, instance uint16, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	instances, data, err := sl.jumbfInstances()
+	if err != nil {
+		if err == ErrNoJumbf {
+			return nil, nil, 0, ErrNoC2pa
+		}
+
+		log.Panic(err)
+	}
+
+	for i, raw := range data {
+		boxes, err := ParseJumbfBoxes(raw)
+		log.PanicIf(err)
+
+		if len(boxes) == 1 && boxes[0].IsSuperbox() == true && boxes[0].ContentType() == JumbfContentTypeC2paManifestStore {
+			return boxes[0], raw, instances[i], nil
+		}
+	}
+
+	return nil, nil, 0, ErrNoC2pa
+}
+
+// C2paManifests returns the manifests in the store. The active manifest is
+// the last one.
+func (jb *JumbfBox) C2paManifests() (manifests []*JumbfBox) {
+	manifests = make([]*JumbfBox, 0)
+
+	for _, child := range jb.Children {
+		contentType := child.ContentType()
+		if contentType == JumbfContentTypeC2paManifest || contentType == JumbfContentTypeC2paUpdateManifest {
+			manifests = append(manifests, child)
+		}
+	}
+
+	return manifests
+}
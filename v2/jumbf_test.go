@@ -0,0 +1,363 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"encoding/binary"
+
+	"github.com/dsoprea/go-logging"
+)
+
+// getJumbfTestBox returns an encoded box.
+func getJumbfTestBox(boxType string, payload []byte) []byte {
+	data := make([]byte, jumbfBoxHeaderSize, jumbfBoxHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(data, uint32(jumbfBoxHeaderSize+len(payload)))
+	copy(data[4:], boxType)
+
+	return append(data, payload...)
+}
+
+// getJumbfTestSuperbox returns an encoded, requestable superbox with a
+// standard content type and a label.
+func getJumbfTestSuperbox(contentType, label string, children ...[]byte) []byte {
+	description := append([]byte(contentType), jumbfUuidSuffix...)
+	description = append(description, 0x03)
+	description = append(description, label...)
+	description = append(description, 0)
+
+	payload := getJumbfTestBox(JumbfBoxTypeDescription, description)
+	for _, child := range children {
+		payload = append(payload, child...)
+	}
+
+	return getJumbfTestBox(JumbfBoxTypeSuperbox, payload)
+}
+
+// getJumbfTestSegments splits the box across APP11 segments with at most the
+// given amount of payload each.
+func getJumbfTestSegments(instance uint16, box []byte, chunkSize int) []*Segment {
+	header := box[:jumbfBoxHeaderSize]
+	payload := box[jumbfBoxHeaderSize:]
+
+	segments := make([]*Segment, 0)
+
+	for sequence := uint32(1); len(payload) > 0; sequence++ {
+		size := chunkSize
+		if size > len(payload) {
+			size = len(payload)
+		}
+
+		data := make([]byte, jumbfPacketHeaderSize)
+		copy(data, jumbfPrefix)
+		binary.BigEndian.PutUint16(data[2:], instance)
+		binary.BigEndian.PutUint32(data[4:], sequence)
+
+		data = append(data, header...)
+		data = append(data, payload[:size]...)
+
+		s := &Segment{
+			MarkerId:   MARKER_APP11,
+			MarkerName: markerNames[MARKER_APP11],
+			Data:       data,
+		}
+
+		segments = append(segments, s)
+		payload = payload[size:]
+	}
+
+	return segments
+}
+
+// getJumbfTestSegmentList returns an image with the segments inserted after
+// the SOI.
+func getJumbfTestSegmentList(segments []*Segment) *SegmentList {
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(16, 16, false))
+
+	inserted := append([]*Segment{sl.segments[0]}, segments...)
+	sl.segments = append(inserted, sl.segments[1:]...)
+
+	return sl
+}
+
+// getJumbfTestC2paStore returns a manifest store with a single manifest.
+func getJumbfTestC2paStore() []byte {
+	assertion := getJumbfTestSuperbox(
+		JumbfContentTypeCbor,
+		"c2pa.hash.data",
+		getJumbfTestBox(JumbfBoxTypeCbor, []byte{0xa0}))
+
+	assertions := getJumbfTestSuperbox(JumbfContentTypeC2paAssertionStore, "c2pa.assertions", assertion)
+
+	claim := getJumbfTestSuperbox(
+		JumbfContentTypeC2paClaim,
+		"c2pa.claim",
+		getJumbfTestBox(JumbfBoxTypeCbor, []byte{0xa1, 0x61, 'a', 0x01}))
+
+	signature := getJumbfTestSuperbox(
+		JumbfContentTypeC2paClaimSignature,
+		"c2pa.signature",
+		getJumbfTestBox(JumbfBoxTypeCbor, []byte{0x80}))
+
+	manifest := getJumbfTestSuperbox(JumbfContentTypeC2paManifest, "urn:uuid:1234", assertions, claim, signature)
+
+	return getJumbfTestSuperbox(JumbfContentTypeC2paManifestStore, "c2pa", manifest)
+}
+
+func TestParseJumbfBoxes(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	// A description with everything: a non-standard type, a label, an ID, a
+	// hash, and a private box.
+
+	description := []byte{
+		0x40, 0xcb, 0x0c, 0x32, 0xbb, 0x8a, 0x48, 0x9d, 0xa7, 0x0b, 0x2a, 0xd6, 0xf4, 0x7f, 0x43, 0x69,
+		0x1f,
+	}
+
+	description = append(description, "file\000"...)
+	description = append(description, 0x00, 0x00, 0x01, 0x02)
+	description = append(description, bytes.Repeat([]byte{0xaa}, jumbfDescriptionHashSize)...)
+	description = append(description, getJumbfTestBox("priv", []byte{1, 2})...)
+
+	// An extended-size box and a box that runs to the end.
+
+	extended := []byte{0, 0, 0, 1, 'b', 'i', 'd', 'b', 0, 0, 0, 0, 0, 0, 0, 18, 'x', 'y'}
+	open := []byte{0, 0, 0, 0, 'u', 'u', 'i', 'd'}
+	open = append(open, bytes.Repeat([]byte{0x11}, 16)...)
+	open = append(open, "data"...)
+
+	payload := getJumbfTestBox(JumbfBoxTypeDescription, description)
+	payload = append(payload, extended...)
+	payload = append(payload, open...)
+
+	boxes, err := ParseJumbfBoxes(getJumbfTestBox(JumbfBoxTypeSuperbox, payload))
+	log.PanicIf(err)
+
+	if len(boxes) != 1 {
+		t.Fatalf("Box count not correct: (%d)", len(boxes))
+	}
+
+	jb := boxes[0]
+	jd := jb.Description
+
+	if jb.IsSuperbox() != true || jb.ContentType() != JumbfContentTypeEmbeddedFile || jb.Label() != "file" {
+		t.Fatalf("Superbox not correct: %s", jb)
+	} else if jd.HasId != true || jd.Id != 0x102 || bytes.Equal(jd.Hash, bytes.Repeat([]byte{0xaa}, 32)) != true {
+		t.Fatalf("Description not correct: %s", jd)
+	} else if jd.Private == nil || jd.Private.Type != "priv" || bytes.Equal(jd.Private.Payload, []byte{1, 2}) != true {
+		t.Fatalf("Private box not correct: %v", jd.Private)
+	}
+
+	if len(jb.Children) != 2 {
+		t.Fatalf("Child count not correct: (%d)", len(jb.Children))
+	} else if jb.Children[0].Type != "bidb" || string(jb.Children[0].Payload) != "xy" {
+		t.Fatalf("Extended box not correct: %s", jb.Children[0])
+	}
+
+	uuid, data, err := jb.Children[1].Uuid()
+	log.PanicIf(err)
+
+	if uuid[0] != 0x11 || string(data) != "data" {
+		t.Fatalf("UUID box not correct: %x [%s]", uuid, data)
+	}
+
+	content, found := jb.Content()
+	if found != true || content != jb.Children[0] {
+		t.Fatalf("Content box not correct.")
+	}
+
+	if _, _, err := content.Uuid(); err == nil {
+		t.Fatalf("Expected error for non-UUID box.")
+	}
+}
+
+func TestParseJumbfBoxes_Invalid(t *testing.T) {
+	cases := [][]byte{
+		// No description.
+		getJumbfTestBox(JumbfBoxTypeSuperbox, getJumbfTestBox(JumbfBoxTypeJson, []byte("{}"))),
+
+		// Truncated.
+		getJumbfTestBox(JumbfBoxTypeJson, []byte("{}"))[:9],
+
+		// Size smaller than the header.
+		{0, 0, 0, 4, 'j', 's', 'o', 'n'},
+
+		// Unterminated label.
+		getJumbfTestBox(JumbfBoxTypeSuperbox, getJumbfTestBox(JumbfBoxTypeDescription, append(make([]byte, 16), 0x02, 'a'))),
+	}
+
+	for i, data := range cases {
+		if _, err := ParseJumbfBoxes(data); err == nil {
+			t.Fatalf("Expected error for case (%d).", i)
+		}
+	}
+}
+
+func TestJumbfBox_Find(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	boxes, err := ParseJumbfBoxes(getJumbfTestC2paStore())
+	log.PanicIf(err)
+
+	store := boxes[0]
+
+	assertion, found := store.Find("/urn:uuid:1234/c2pa.assertions/c2pa.hash.data")
+	if found != true || assertion.ContentType() != JumbfContentTypeCbor {
+		t.Fatalf("Assertion not found: %v", assertion)
+	}
+
+	content, found := assertion.Content()
+	if found != true || content.Type != JumbfBoxTypeCbor || bytes.Equal(content.Payload, []byte{0xa0}) != true {
+		t.Fatalf("Assertion content not correct: %v", content)
+	}
+
+	if _, found := store.Find("urn:uuid:1234/c2pa.missing"); found != false {
+		t.Fatalf("Expected missing box to not be found.")
+	}
+
+	expected := `JumbfBox<TYPE=[jumb] CONTENT-TYPE=[c2pa] LABEL=[c2pa] CHILDREN=(1)>
+  JumbfBox<TYPE=[jumb] CONTENT-TYPE=[c2ma] LABEL=[urn:uuid:1234] CHILDREN=(3)>
+    JumbfBox<TYPE=[jumb] CONTENT-TYPE=[c2as] LABEL=[c2pa.assertions] CHILDREN=(1)>
+      JumbfBox<TYPE=[jumb] CONTENT-TYPE=[cbor] LABEL=[c2pa.hash.data] CHILDREN=(1)>
+        JumbfBox<TYPE=[cbor] SIZE=(1)>
+    JumbfBox<TYPE=[jumb] CONTENT-TYPE=[c2cl] LABEL=[c2pa.claim] CHILDREN=(1)>
+      JumbfBox<TYPE=[cbor] SIZE=(4)>
+    JumbfBox<TYPE=[jumb] CONTENT-TYPE=[c2cs] LABEL=[c2pa.signature] CHILDREN=(1)>
+      JumbfBox<TYPE=[cbor] SIZE=(1)>
+`
+
+	if store.Dump() != expected {
+		t.Fatalf("Dump not correct:\n%s", store.Dump())
+	}
+}
+
+func TestSegmentList_JumbfData(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	store := getJumbfTestC2paStore()
+	other := getJumbfTestSuperbox(JumbfContentTypeJson, "other", getJumbfTestBox(JumbfBoxTypeJson, []byte(`{"a":1}`)))
+
+	storeSegments := getJumbfTestSegments(1, store, 100)
+	otherSegments := getJumbfTestSegments(2, other, 10)
+
+	if len(storeSegments) < 3 || len(otherSegments) < 3 {
+		t.Fatalf("Expected boxes to be split.")
+	}
+
+	// The packets of the two boxes are interleaved and out of order.
+
+	segments := []*Segment{
+		storeSegments[1],
+		otherSegments[0],
+	}
+
+	segments = append(segments, storeSegments[2:]...)
+	segments = append(segments, otherSegments[1:]...)
+	segments = append(segments, storeSegments[0])
+
+	sl := getJumbfTestSegmentList(segments)
+
+	// Make sure that the segments survive being written and parsed.
+	sl, _ = reparseSegmentList(sl)
+
+	count := 0
+	for _, s := range sl.Segments() {
+		if s.IsJumbf() == true {
+			count++
+
+			if s.MarkerName != "APP11" {
+				t.Fatalf("Marker name not correct: [%s]", s.MarkerName)
+			}
+		}
+	}
+
+	if count != len(segments) {
+		t.Fatalf("JUMBF segment count not correct: (%d)", count)
+	}
+
+	data, err := sl.JumbfData()
+	log.PanicIf(err)
+
+	if reflect.DeepEqual(data, [][]byte{store, other}) != true {
+		t.Fatalf("Reassembled boxes not correct.")
+	}
+
+	boxes, err := sl.Jumbf()
+	log.PanicIf(err)
+
+	if len(boxes) != 2 || boxes[0].Label() != "c2pa" || boxes[1].Label() != "other" {
+		t.Fatalf("Boxes not correct: %v", boxes)
+	}
+
+	c2pa, raw, err := sl.C2paManifestStore()
+	log.PanicIf(err)
+
+	if bytes.Equal(raw, store) != true {
+		t.Fatalf("Raw manifest store not correct.")
+	}
+
+	manifests := c2pa.C2paManifests()
+	if len(manifests) != 1 || manifests[0].Label() != "urn:uuid:1234" {
+		t.Fatalf("Manifests not correct: %v", manifests)
+	}
+}
+
+func TestSegmentList_JumbfData_Missing(t *testing.T) {
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(16, 16, false))
+
+	if _, err := sl.JumbfData(); err != ErrNoJumbf {
+		t.Fatalf("Expected ErrNoJumbf: %v", err)
+	} else if _, err := sl.Jumbf(); err != ErrNoJumbf {
+		t.Fatalf("Expected ErrNoJumbf: %v", err)
+	} else if _, _, err := sl.C2paManifestStore(); err != ErrNoC2pa {
+		t.Fatalf("Expected ErrNoC2pa: %v", err)
+	}
+
+	// Without a manifest store.
+
+	other := getJumbfTestSuperbox(JumbfContentTypeJson, "other", getJumbfTestBox(JumbfBoxTypeJson, []byte(`{}`)))
+	sl = getJumbfTestSegmentList(getJumbfTestSegments(1, other, 100))
+
+	if _, _, err := sl.C2paManifestStore(); err != ErrNoC2pa {
+		t.Fatalf("Expected ErrNoC2pa: %v", err)
+	}
+
+	// A packet is missing.
+
+	segments := getJumbfTestSegments(1, getJumbfTestC2paStore(), 100)
+	sl = getJumbfTestSegmentList(append(segments[:1], segments[2:]...))
+
+	if _, err := sl.JumbfData(); err == nil || strings.Contains(err.Error(), "not contiguous") == false {
+		t.Fatalf("Expected error for missing packet: %v", err)
+	}
+
+	// The last packet is missing.
+
+	segments = getJumbfTestSegments(1, getJumbfTestC2paStore(), 100)
+	sl = getJumbfTestSegmentList(segments[:len(segments)-1])
+
+	if _, err := sl.JumbfData(); err == nil || strings.Contains(err.Error(), "size not correct") == false {
+		t.Fatalf("Expected error for truncated box: %v", err)
+	}
+}
@@ -0,0 +1,348 @@
+package jpegstructure
+
+import (
+	"fmt"
+
+	"github.com/dsoprea/go-logging"
+)
+
+// samplePlane has the reconstructed samples of one component. The plane may
+// be larger than the component when the scans code padding.
+type samplePlane struct {
+	width   int
+	height  int
+	samples []uint16
+}
+
+func newSamplePlane(width, height int) *samplePlane {
+	return &samplePlane{
+		width:   width,
+		height:  height,
+		samples: make([]uint16, width*height),
+	}
+}
+
+func (sp *samplePlane) at(x, y int) uint16 {
+	return sp.samples[y*sp.width+x]
+}
+
+func (sp *samplePlane) set(x, y int, value uint16) {
+	sp.samples[y*sp.width+x] = value
+}
+
+// losslessScanDecoder decodes Huffman-coded lossless scans into samples
+// (T.81 H.2). It satisfies `scanDecoder` so that lossless images can be walked
+// like any other, but it has no coefficients.
+type losslessScanDecoder struct {
+	frame  *SofSegment
+	planes []*samplePlane
+
+	dcTables [4]*huffmanLookup
+
+	restartInterval int
+
+	// isCoded records which components have been coded by a scan.
+	isCoded []bool
+}
+
+func newLosslessScanDecoder(fh *SofSegment) (lsd *losslessScanDecoder, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if fh.IsLossless() == false || fh.IsHierarchical() == true || fh.IsArithmetic() == true {
+		log.Panicf("coding process not supported: [%s]", markerNames[fh.MarkerId])
+	} else if fh.BitsPerSample < 2 || fh.BitsPerSample > 16 {
+		log.Panicf("lossless sample precision not valid: (%d)", fh.BitsPerSample)
+	} else if fh.Width == 0 || fh.Height == 0 {
+		log.Panicf("frame dimensions must be known: (%d)x(%d)", fh.Width, fh.Height)
+	} else if len(fh.Components) == 0 {
+		log.Panicf("frame has no components")
+	}
+
+	hMax, vMax := fh.MaxSampling()
+	mcuColumns := ceilDiv(int(fh.Width), hMax)
+	mcuRows := ceilDiv(int(fh.Height), vMax)
+
+	planes := make([]*samplePlane, len(fh.Components))
+
+	for i, fc := range fh.Components {
+		if fc.HorizontalSampling < 1 || fc.HorizontalSampling > 4 || fc.VerticalSampling < 1 || fc.VerticalSampling > 4 {
+			log.Panicf("sampling factors not valid for component (%d): (%d)x(%d)", fc.Id, fc.HorizontalSampling, fc.VerticalSampling)
+		}
+
+		// Interleaved scans code whole MCUs, so allow for the padding.
+		planes[i] = newSamplePlane(mcuColumns*int(fc.HorizontalSampling), mcuRows*int(fc.VerticalSampling))
+	}
+
+	lsd = &losslessScanDecoder{
+		frame:   fh,
+		planes:  planes,
+		isCoded: make([]bool, len(fh.Components)),
+	}
+
+	return lsd, nil
+}
+
+// setHuffmanTables installs tables from a DHT segment. Only the DC tables are
+// used in lossless mode.
+func (lsd *losslessScanDecoder) setHuffmanTables(tables []*HuffmanTable) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	for _, ht := range tables {
+		if ht.Id > 3 {
+			log.Panicf("Huffman table ID not valid: (%d)", ht.Id)
+		} else if ht.Class != HuffmanClassDc {
+			continue
+		}
+
+		hl, err := newHuffmanLookup(ht)
+		log.PanicIf(err)
+
+		lsd.dcTables[ht.Id] = hl
+	}
+
+	return nil
+}
+
+// setArithmeticConditioning ignores the DAC segments, which have no effect on
+// Huffman coding.
+func (lsd *losslessScanDecoder) setArithmeticConditioning(conditioning []*ArithmeticConditioning) error {
+	return nil
+}
+
+func (lsd *losslessScanDecoder) setRestartInterval(interval int) {
+	lsd.restartInterval = interval
+}
+
+// incompleteComponents returns the IDs of the components that no scan has
+// coded.
+func (lsd *losslessScanDecoder) incompleteComponents() (ids []byte) {
+	ids = make([]byte, 0)
+
+	for i, isCoded := range lsd.isCoded {
+		if isCoded == false {
+			ids = append(ids, lsd.frame.Components[i].Id)
+		}
+	}
+
+	return ids
+}
+
+// coefficientPlanes returns nothing since lossless images have no
+// coefficients.
+func (lsd *losslessScanDecoder) coefficientPlanes() []*ComponentCoefficients {
+	return nil
+}
+
+// samplePlanes returns the samples decoded so far, with the point-transforms
+// undone.
+func (lsd *losslessScanDecoder) samplePlanes() []*samplePlane {
+	return lsd.planes
+}
+
+// losslessScanComponent has the state for one component of the current scan.
+type losslessScanComponent struct {
+	plane     *samplePlane
+	dcTable   *huffmanLookup
+	hSampling int
+	vSampling int
+
+	// firstRow is the first sample row of the scan or of the current restart
+	// interval, which is predicted differently.
+	firstRow int
+}
+
+// predict returns the prediction for the sample at the given position
+// (T.81 H.1.2.1).
+func (lsc *losslessScanComponent) predict(x, y int, predictor int, initial int32) int32 {
+	plane := lsc.plane
+
+	if y == lsc.firstRow {
+		if x == 0 {
+			return initial
+		}
+
+		return int32(plane.at(x-1, y))
+	} else if x == 0 {
+		return int32(plane.at(x, y-1))
+	}
+
+	ra := int32(plane.at(x-1, y))
+	rb := int32(plane.at(x, y-1))
+	rc := int32(plane.at(x-1, y-1))
+
+	switch predictor {
+	case 1:
+		return ra
+	case 2:
+		return rb
+	case 3:
+		return rc
+	case 4:
+		return ra + rb - rc
+	case 5:
+		return ra + (rb-rc)>>1
+	case 6:
+		return rb + (ra-rc)>>1
+	}
+
+	return (ra + rb) >> 1
+}
+
+// decodeDifference decodes the next difference (T.81 H.1.2.2). Category
+// (16) has no additional bits.
+func decodeDifference(er *entropyReader, hl *huffmanLookup) (difference int32, err error) {
+	t, err := er.decodeHuffman(hl)
+	if err != nil {
+		return 0, err
+	} else if t > 16 {
+		return 0, fmt.Errorf("difference magnitude category not valid: (%d)", t)
+	} else if t == 16 {
+		return 32768, nil
+	}
+
+	return er.receiveExtend(uint(t)), nil
+}
+
+// decodeScan decodes the entropy-coded data of one scan. Whatever was
+// decoded before a failure is kept and the stats reflect how far we got.
+func (lsd *losslessScanDecoder) decodeScan(sh *ScanHeader, data []byte) (stats scanDecodeStats, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	fh := lsd.frame
+
+	indices, err := checkScanHeader(fh, sh)
+	log.PanicIf(err)
+
+	components := make([]*losslessScanComponent, len(indices))
+
+	for i, j := range indices {
+		if lsd.isCoded[j] == true {
+			log.Panicf("component (%d) coded more than once", fh.Components[j].Id)
+		}
+
+		lsd.isCoded[j] = true
+
+		sc := sh.Components[i]
+		fc := fh.Components[j]
+
+		c := &losslessScanComponent{
+			plane:     lsd.planes[j],
+			dcTable:   lsd.dcTables[sc.DcTableId],
+			hSampling: int(fc.HorizontalSampling),
+			vSampling: int(fc.VerticalSampling),
+		}
+
+		if c.dcTable == nil {
+			log.Panicf("DC Huffman table (%d) not defined", sc.DcTableId)
+		}
+
+		components[i] = c
+	}
+
+	// In a non-interleaved scan, every sample is an MCU.
+
+	var mcuColumns, mcuRows int
+	if len(components) == 1 {
+		mcuColumns, mcuRows = fh.ComponentSize(indices[0])
+
+		components[0].hSampling = 1
+		components[0].vSampling = 1
+	} else {
+		hMax, vMax := fh.MaxSampling()
+
+		mcuColumns = ceilDiv(int(fh.Width), hMax)
+		mcuRows = ceilDiv(int(fh.Height), vMax)
+	}
+
+	stats.expectedMcus = mcuColumns * mcuRows
+
+	if lsd.restartInterval%mcuColumns != 0 {
+		log.Panicf("lossless restart interval must be a whole number of MCU rows: (%d) (%d)", lsd.restartInterval, mcuColumns)
+	}
+
+	predictor := int(sh.SpectralStart)
+	pt := uint(sh.ApproximationLow)
+	initial := int32(1) << (uint(fh.BitsPerSample) - pt - 1)
+
+	er := newEntropyReader(data)
+
+	for mcu := 0; mcu < stats.expectedMcus; mcu++ {
+		mcuColumn := mcu % mcuColumns
+		mcuRow := mcu / mcuColumns
+
+		if lsd.restartInterval > 0 && mcu > 0 && mcu%lsd.restartInterval == 0 {
+			expected := stats.restartMarkers % 8
+
+			err := er.processRestart(expected)
+			if err != nil {
+				stats.isTruncated = err == ErrEntropyTruncated
+
+				log.Panicf("restart failed before MCU (%d) of (%d): %s", mcu, stats.expectedMcus, err.Error())
+			}
+
+			stats.restartMarkers++
+
+			for _, c := range components {
+				c.firstRow = mcuRow * c.vSampling
+			}
+		}
+
+		for _, c := range components {
+			for v := 0; v < c.vSampling; v++ {
+				for h := 0; h < c.hSampling; h++ {
+					x := mcuColumn*c.hSampling + h
+					y := mcuRow*c.vSampling + v
+
+					difference, err := decodeDifference(er, c.dcTable)
+					if err != nil {
+						// If the zeros supplied past the end of the data made an invalid code,
+						// the data is short rather than damaged.
+						stats.isTruncated = er.overrun > 0 && er.markerReached == false
+
+						log.Panicf("could not decode MCU (%d) of (%d) at byte (%d): %s", mcu, stats.expectedMcus, er.bytePosition(), err.Error())
+					}
+
+					value := c.predict(x, y, predictor, initial) + difference
+					c.plane.set(x, y, uint16(value))
+				}
+			}
+		}
+
+		if er.overrun > 0 {
+			// If we stopped at a restart marker then the data is damaged
+			// rather than short.
+			stats.isTruncated = er.markerReached == false
+
+			log.Panicf("entropy-coded data ended in MCU (%d) of (%d)", mcu, stats.expectedMcus)
+		}
+
+		stats.decodedMcus = mcu + 1
+	}
+
+	stats.unconsumedBytes = len(data) - er.bytePosition()
+
+	// Undo the point-transform now that we no longer need the values for
+	// prediction.
+
+	if pt > 0 {
+		for _, c := range components {
+			for i, value := range c.plane.samples {
+				c.plane.samples[i] = value << pt
+			}
+		}
+	}
+
+	return stats, nil
+}
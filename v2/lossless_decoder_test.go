@@ -0,0 +1,595 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"testing"
+
+	"github.com/dsoprea/go-logging"
+)
+
+// losslessTestImage describes an image for `getLosslessTestJpeg`.
+type losslessTestImage struct {
+	frame *SofSegment
+
+	// samples are the samples of each component, at its own size.
+	samples [][]uint16
+
+	predictor      byte
+	pointTransform byte
+
+	// restartRows is the number of MCU rows between restart markers.
+	restartRows int
+
+	// isInterleaved codes all of the components in a single scan.
+	isInterleaved bool
+}
+
+// getLosslessTestSamples returns a plane of samples with some structure and
+// some noise in it.
+func getLosslessTestSamples(width, height int, precision byte, seed int) []uint16 {
+	samples := make([]uint16, width*height)
+	maximum := 1<<precision - 1
+
+	state := uint32(seed*7919 + 1)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			state = state*1103515245 + 12345
+
+			value := (x*maximum/width + y*maximum/height) / 2
+			value += int(state>>16)%33 - 16
+
+			if value < 0 {
+				value = 0
+			} else if value > maximum {
+				value = maximum
+			}
+
+			samples[y*width+x] = uint16(value)
+		}
+	}
+
+	return samples
+}
+
+// getLosslessTestJpeg encodes a lossless image. This is just enough of an
+// encoder to exercise the decoder: the differences are computed with the
+// decoder's own predictors and then Huffman-coded with an optimal table.
+func getLosslessTestJpeg(lti *losslessTestImage) []byte {
+	fh := lti.frame
+	pt := uint(lti.pointTransform)
+
+	lsd, err := newLosslessScanDecoder(fh)
+	log.PanicIf(err)
+
+	// Fill the planes, including any padding, with the reduced samples.
+
+	for i, plane := range lsd.planes {
+		width, height := fh.ComponentSize(i)
+
+		for y := 0; y < plane.height; y++ {
+			for x := 0; x < plane.width; x++ {
+				sx := x
+				if sx >= width {
+					sx = width - 1
+				}
+
+				sy := y
+				if sy >= height {
+					sy = height - 1
+				}
+
+				plane.set(x, y, lti.samples[i][sy*width+sx]>>pt)
+			}
+		}
+	}
+
+	var scans [][]int
+	if lti.isInterleaved == true {
+		all := make([]int, len(fh.Components))
+		for i := range all {
+			all[i] = i
+		}
+
+		scans = [][]int{all}
+	} else {
+		for i := range fh.Components {
+			scans = append(scans, []int{i})
+		}
+	}
+
+	b := new(bytes.Buffer)
+
+	writeSegment := func(markerId byte, data []byte) {
+		b.Write([]byte{0xff, markerId})
+
+		if data != nil {
+			binary.Write(b, binary.BigEndian, uint16(len(data)+2))
+			b.Write(data)
+		}
+	}
+
+	writeSegment(MARKER_SOI, nil)
+	writeSegment(fh.MarkerId, fh.Encode())
+
+	for _, indices := range scans {
+		sh := &ScanHeader{
+			Components:       make([]ScanComponent, len(indices)),
+			SpectralStart:    lti.predictor,
+			ApproximationLow: lti.pointTransform,
+		}
+
+		components := make([]*losslessScanComponent, len(indices))
+
+		for i, j := range indices {
+			sh.Components[i].ComponentId = fh.Components[j].Id
+
+			components[i] = &losslessScanComponent{
+				plane:     lsd.planes[j],
+				hSampling: int(fh.Components[j].HorizontalSampling),
+				vSampling: int(fh.Components[j].VerticalSampling),
+			}
+		}
+
+		var mcuColumns, mcuRows int
+		if len(indices) == 1 {
+			mcuColumns, mcuRows = fh.ComponentSize(indices[0])
+
+			components[0].hSampling = 1
+			components[0].vSampling = 1
+		} else {
+			hMax, vMax := fh.MaxSampling()
+
+			mcuColumns = ceilDiv(int(fh.Width), hMax)
+			mcuRows = ceilDiv(int(fh.Height), vMax)
+		}
+
+		restartInterval := lti.restartRows * mcuColumns
+		initial := int32(1) << (uint(fh.BitsPerSample) - pt - 1)
+
+		// Find the differences, noting where the restarts go.
+
+		differences := make([]int32, 0)
+		restarts := make(map[int]bool)
+
+		for mcu := 0; mcu < mcuColumns*mcuRows; mcu++ {
+			mcuColumn := mcu % mcuColumns
+			mcuRow := mcu / mcuColumns
+
+			if restartInterval > 0 && mcu > 0 && mcu%restartInterval == 0 {
+				restarts[len(differences)] = true
+
+				for _, c := range components {
+					c.firstRow = mcuRow * c.vSampling
+				}
+			}
+
+			for _, c := range components {
+				for v := 0; v < c.vSampling; v++ {
+					for h := 0; h < c.hSampling; h++ {
+						x := mcuColumn*c.hSampling + h
+						y := mcuRow*c.vSampling + v
+
+						prediction := c.predict(x, y, int(lti.predictor), initial)
+						difference := int32(int16(uint16(int32(c.plane.at(x, y)) - prediction)))
+
+						differences = append(differences, difference)
+					}
+				}
+			}
+		}
+
+		category := func(difference int32) (uint, uint32) {
+			if difference == -32768 {
+				return 16, 0
+			}
+
+			return magnitudeCategory(difference)
+		}
+
+		var frequencies huffmanFrequencies
+		for _, difference := range differences {
+			c, _ := category(difference)
+			frequencies[c]++
+		}
+
+		ht := buildOptimalHuffmanTable(HuffmanClassDc, 0, &frequencies)
+		et := newEntropyWriter()
+		codes := newHuffmanEncoderTable(ht)
+
+		restartIndex := 0
+		for i, difference := range differences {
+			if restarts[i] == true {
+				et.writeRestart(restartIndex)
+				restartIndex++
+			}
+
+			c, bits := category(difference)
+
+			code := codes[c]
+			et.writeBits(uint32(code.code), uint(code.length))
+
+			// Category (16) has no additional bits.
+			if c < 16 {
+				et.writeBits(bits, c)
+			}
+		}
+
+		et.flush()
+
+		writeSegment(MARKER_DHT, EncodeHuffmanTables([]*HuffmanTable{ht}))
+
+		if restartInterval > 0 {
+			dri := make([]byte, 2)
+			binary.BigEndian.PutUint16(dri, uint16(restartInterval))
+
+			writeSegment(MARKER_DRI, dri)
+		}
+
+		writeSegment(MARKER_SOS, sh.Encode())
+		b.Write(et.b.Bytes())
+	}
+
+	writeSegment(MARKER_EOI, nil)
+
+	return b.Bytes()
+}
+
+// getLosslessTestFrame returns a lossless frame with the given sampling
+// factors for each component.
+func getLosslessTestFrame(width, height int, precision byte, sampling ...byte) *SofSegment {
+	fh := &SofSegment{
+		MarkerId:      MARKER_SOF3,
+		BitsPerSample: precision,
+		Width:         uint16(width),
+		Height:        uint16(height),
+	}
+
+	for i := 0; i < len(sampling); i += 2 {
+		fc := FrameComponent{
+			Id:                 byte(i/2 + 1),
+			HorizontalSampling: sampling[i],
+			VerticalSampling:   sampling[i+1],
+		}
+
+		fh.Components = append(fh.Components, fc)
+	}
+
+	return fh
+}
+
+// checkLosslessRoundTrip encodes the image, decodes it, and makes sure that
+// the samples are the same.
+func checkLosslessRoundTrip(t *testing.T, lti *losslessTestImage) *SegmentList {
+	fh := lti.frame
+
+	if lti.samples == nil {
+		for i := range fh.Components {
+			width, height := fh.ComponentSize(i)
+			samples := getLosslessTestSamples(width, height, fh.BitsPerSample, i)
+
+			// Anything below the point-transform is lost.
+			for j := range samples {
+				samples[j] &^= 1<<lti.pointTransform - 1
+			}
+
+			lti.samples = append(lti.samples, samples)
+		}
+	}
+
+	data := getLosslessTestJpeg(lti)
+	sl := getCoefficientsTestSegmentList(data)
+
+	_, sd, _, err := sl.decodeScans()
+	log.PanicIf(err)
+
+	planes := sd.(*losslessScanDecoder).samplePlanes()
+
+	for i, plane := range planes {
+		width, height := fh.ComponentSize(i)
+
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				if plane.at(x, y) != lti.samples[i][y*width+x] {
+					t.Fatalf("Sample (%d, %d) of component (%d) not correct: (%d) != (%d)", x, y, i, plane.at(x, y), lti.samples[i][y*width+x])
+				}
+			}
+		}
+	}
+
+	return sl
+}
+
+func TestLosslessScanDecoder_Predictors(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	for predictor := byte(1); predictor <= 7; predictor++ {
+		lti := &losslessTestImage{
+			frame:     getLosslessTestFrame(37, 23, 16, 1, 1),
+			predictor: predictor,
+		}
+
+		checkLosslessRoundTrip(t, lti)
+	}
+}
+
+func TestLosslessScanDecoder_PointTransform(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	lti := &losslessTestImage{
+		frame:          getLosslessTestFrame(20, 10, 12, 1, 1),
+		predictor:      4,
+		pointTransform: 3,
+	}
+
+	checkLosslessRoundTrip(t, lti)
+}
+
+func TestLosslessScanDecoder_KnownVectors(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	// These were coded by hand from T.81 (H.1) rather than with
+	// `getLosslessTestJpeg`, so they don't share any of the decoder's logic.
+
+	cases := []struct {
+		name    string
+		data    []byte
+		width   int
+		samples []uint16
+	}{
+		{
+			// 4x2, eight bits, predictor 1 (Ra), no point-transform. The
+			// differences are [-28 2 -1 4] and [-2 0 1 11]; the first sample
+			// is predicted from 128 and the first of the second row from the
+			// one above it. The table has a three-bit code for each of
+			// categories 0-5. The padding makes a 0xff, which is stuffed.
+			name: "predictor 1",
+			data: []byte{
+				0xff, 0xd8,
+				// DHT: class 0, table 0; six codes of length three.
+				0xff, 0xc4, 0x00, 0x19, 0x00,
+				0x00, 0x00, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0x00, 0x01, 0x02, 0x03, 0x04, 0x05,
+				// SOF3: eight bits, 2 lines, 4 samples per line, one component.
+				0xff, 0xc3, 0x00, 0x0b, 0x08, 0x00, 0x02, 0x00, 0x04, 0x01, 0x01, 0x11, 0x00,
+				// SOS: one component, table 0, Ss (predictor) 1, Se 0, Ah/Al 0.
+				0xff, 0xda, 0x00, 0x08, 0x01, 0x01, 0x00, 0x01, 0x00, 0x00,
+				0xa3, 0x51, 0x38, 0x90, 0x72, 0xff, 0x00,
+				0xff, 0xd9,
+			},
+			width: 4,
+			samples: []uint16{
+				100, 102, 101, 105,
+				98, 98, 99, 110,
+			},
+		},
+		{
+			// 3x2, eight bits, predictor 7 ((Ra + Rb) / 2), point-transform
+			// 2. The reduced samples are [40 42 45] and [38 41 43], so the
+			// first is predicted from 32 and the differences are [8 2 3] and
+			// [-2 1 0]. The codes are "0" for category 2, "10" for 4, "110"
+			// for 0, and "1110" for 1.
+			name: "predictor 7 with point-transform",
+			data: []byte{
+				0xff, 0xd8,
+				// DHT: class 0, table 0; one code each of lengths one to four.
+				0xff, 0xc4, 0x00, 0x17, 0x00,
+				0x01, 0x01, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0x02, 0x04, 0x00, 0x01,
+				// SOF3: eight bits, 2 lines, 3 samples per line, one component.
+				0xff, 0xc3, 0x00, 0x0b, 0x08, 0x00, 0x02, 0x00, 0x03, 0x01, 0x01, 0x11, 0x00,
+				// SOS: one component, table 0, Ss (predictor) 7, Se 0, Ah/Al 2.
+				0xff, 0xda, 0x00, 0x08, 0x01, 0x01, 0x00, 0x07, 0x00, 0x02,
+				0xa1, 0x33, 0xdd,
+				0xff, 0xd9,
+			},
+			width: 3,
+			samples: []uint16{
+				160, 168, 180,
+				152, 164, 172,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		sl := getCoefficientsTestSegmentList(c.data)
+
+		_, sd, _, err := sl.decodeScans()
+		log.PanicIf(err)
+
+		plane := sd.(*losslessScanDecoder).samplePlanes()[0]
+
+		for i, expected := range c.samples {
+			x := i % c.width
+			y := i / c.width
+
+			if plane.at(x, y) != expected {
+				t.Fatalf("Sample (%d, %d) not correct for [%s]: (%d) != (%d)", x, y, c.name, plane.at(x, y), expected)
+			}
+		}
+	}
+}
+
+func TestLosslessScanDecoder_Restart(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	lti := &losslessTestImage{
+		frame:       getLosslessTestFrame(30, 17, 8, 1, 1, 1, 1, 1, 1),
+		predictor:   6,
+		restartRows: 4,
+	}
+
+	sl := checkLosslessRoundTrip(t, lti)
+
+	report, err := sl.CheckScanData()
+	log.PanicIf(err)
+
+	if report.IsValid() != true || len(report.Findings) != 0 {
+		t.Fatalf("Scan-data not valid: %v", report.Findings)
+	} else if len(report.Scans) != 3 {
+		t.Fatalf("Scan-count not correct: (%d)", len(report.Scans))
+	} else if report.Scans[0].ExpectedMcus != 30*17 || report.Scans[0].RestartMarkers != 4 {
+		t.Fatalf("Scan not correct: %s", report.Scans[0])
+	}
+}
+
+func TestLosslessScanDecoder_Interleaved(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	lti := &losslessTestImage{
+		frame:         getLosslessTestFrame(31, 19, 10, 2, 2, 1, 1, 1, 1),
+		predictor:     7,
+		restartRows:   3,
+		isInterleaved: true,
+	}
+
+	checkLosslessRoundTrip(t, lti)
+}
+
+func TestLosslessScanDecoder_InvalidRestartInterval(t *testing.T) {
+	lti := &losslessTestImage{
+		frame:     getLosslessTestFrame(16, 16, 8, 1, 1),
+		predictor: 1,
+		samples:   [][]uint16{make([]uint16, 16*16)},
+	}
+
+	data := getLosslessTestJpeg(lti)
+	sl := getCoefficientsTestSegmentList(data)
+
+	// Restarts must be at the start of a row.
+
+	dri := &Segment{
+		MarkerId: MARKER_DRI,
+		Data:     []byte{0, 5},
+	}
+
+	segments := []*Segment{sl.segments[0], dri}
+	segments = append(segments, sl.segments[1:]...)
+
+	sl = NewSegmentList(segments)
+
+	_, _, _, err := sl.decodeScans()
+	if err == nil {
+		t.Fatalf("Expected error for restart interval.")
+	}
+}
+
+func TestLosslessScanComponent_Predict(t *testing.T) {
+	plane := newSamplePlane(2, 2)
+	plane.set(0, 0, 100)
+	plane.set(1, 0, 40)
+	plane.set(0, 1, 20)
+
+	lsc := &losslessScanComponent{
+		plane: plane,
+	}
+
+	// Ra=(20) Rb=(40) Rc=(100)
+	expected := []int32{20, 40, 100, -40, -10, 0, 30}
+
+	for i, value := range expected {
+		prediction := lsc.predict(1, 1, i+1, 0)
+		if prediction != value {
+			t.Fatalf("Prediction (%d) not correct: (%d) != (%d)", i+1, prediction, value)
+		}
+	}
+
+	// The first row and the first column are predicted from the only
+	// neighbor that they have.
+
+	if prediction := lsc.predict(0, 0, 4, 128); prediction != 128 {
+		t.Fatalf("Initial prediction not correct: (%d)", prediction)
+	} else if prediction := lsc.predict(1, 0, 4, 128); prediction != 100 {
+		t.Fatalf("First-row prediction not correct: (%d)", prediction)
+	} else if prediction := lsc.predict(0, 1, 4, 128); prediction != 100 {
+		t.Fatalf("First-column prediction not correct: (%d)", prediction)
+	}
+}
+
+func TestSegmentList_ReadCoefficients_Lossless(t *testing.T) {
+	lti := &losslessTestImage{
+		frame:     getLosslessTestFrame(16, 16, 8, 1, 1),
+		predictor: 1,
+		samples:   [][]uint16{make([]uint16, 16*16)},
+	}
+
+	data := getLosslessTestJpeg(lti)
+	sl := getCoefficientsTestSegmentList(data)
+
+	_, err := sl.ReadCoefficients()
+	if err == nil {
+		t.Fatalf("Expected error for lossless image.")
+	}
+}
+
+func TestJpegMediaParser_GetImage_Lossless(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	samples := getLosslessTestSamples(24, 12, 16, 0)
+
+	lti := &losslessTestImage{
+		frame:     getLosslessTestFrame(24, 12, 16, 1, 1),
+		predictor: 1,
+		samples:   [][]uint16{samples},
+	}
+
+	data := getLosslessTestJpeg(lti)
+
+	jmp := NewJpegMediaParser()
+
+	img, err := jmp.GetImage(bytes.NewReader(data))
+	log.PanicIf(err)
+
+	g, ok := img.(*image.Gray16)
+	if ok != true {
+		t.Fatalf("Image type not correct: [%T]", img)
+	} else if g.Bounds() != image.Rect(0, 0, 24, 12) {
+		t.Fatalf("Bounds not correct: %v", g.Bounds())
+	}
+
+	// Sixteen-bit samples are returned as they are.
+	for y := 0; y < 12; y++ {
+		for x := 0; x < 24; x++ {
+			if g.Gray16At(x, y).Y != samples[y*24+x] {
+				t.Fatalf("Pixel (%d, %d) not correct.", x, y)
+			}
+		}
+	}
+}
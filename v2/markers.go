@@ -47,9 +47,15 @@ const (
 	// MARKER_APP8 marker
 	MARKER_APP8 = 0xe8
 
+	// MARKER_APP9 marker
+	MARKER_APP9 = 0xe9
+
 	// MARKER_APP10 marker
 	MARKER_APP10 = 0xea
 
+	// MARKER_APP11 marker
+	MARKER_APP11 = 0xeb
+
 	// MARKER_APP12 marker
 	MARKER_APP12 = 0xec
 
@@ -118,6 +124,18 @@ const (
 
 	// MARKER_SOF15 marker
 	MARKER_SOF15 = 0xcf
+
+	// MARKER_DNL marker
+	MARKER_DNL = 0xdc
+
+	// MARKER_DRI marker
+	MARKER_DRI = 0xdd
+
+	// MARKER_RST0 marker
+	MARKER_RST0 = 0xd0
+
+	// MARKER_RST7 marker
+	MARKER_RST7 = 0xd7
 )
 
 var (
@@ -182,7 +200,9 @@ var (
 		MARKER_APP6:  "APP6",
 		MARKER_APP7:  "APP7",
 		MARKER_APP8:  "APP8",
+		MARKER_APP9:  "APP9",
 		MARKER_APP10: "APP10",
+		MARKER_APP11: "APP11",
 		MARKER_APP12: "APP12",
 		MARKER_APP13: "APP13",
 		MARKER_APP14: "APP14",
@@ -194,6 +214,8 @@ var (
 		MARKER_DHT: "DHT",
 		MARKER_JPG: "JPG",
 		MARKER_DAC: "DAC",
+		MARKER_DNL: "DNL",
+		MARKER_DRI: "DRI",
 
 		MARKER_SOF0:  "SOF0",
 		MARKER_SOF1:  "SOF1",
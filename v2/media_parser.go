@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"image"
 	"io"
+	"io/ioutil"
 	"os"
 
 	"image/jpeg"
@@ -26,8 +27,9 @@ func NewJpegMediaParser() *JpegMediaParser {
 	return new(JpegMediaParser)
 }
 
-// Parse parses a JPEG uses an `io.ReadSeeker`. Even if it fails, it will return
-// the list of segments encountered prior to the failure.
+// Parse parses a JPEG uses an `io.ReadSeeker`, starting from its current
+// position. Even if it fails, it will return the list of segments encountered
+// prior to the failure. Any data after the EOI is kept as the trailer.
 func (jmp *JpegMediaParser) Parse(rs io.ReadSeeker, size int) (ec riimage.MediaContext, err error) {
 	defer func() {
 		if state := recover(); state != nil {
@@ -35,6 +37,10 @@ func (jmp *JpegMediaParser) Parse(rs io.ReadSeeker, size int) (ec riimage.MediaC
 		}
 	}()
 
+	// The image doesn't necessarily start at the beginning of the stream.
+	start, err := rs.Seek(0, io.SeekCurrent)
+	log.PanicIf(err)
+
 	s := bufio.NewScanner(rs)
 
 	// Since each segment can be any size, our buffer must allowed to grow as
@@ -50,10 +56,23 @@ func (jmp *JpegMediaParser) Parse(rs io.ReadSeeker, size int) (ec riimage.MediaC
 
 	// Always return the segments that were parsed, at least until there was an
 	// error.
-	ec = js.Segments()
+	sl := js.Segments()
+	ec = sl
 
 	log.PanicIf(s.Err())
 
+	// Keep anything after the EOI (e.g. the additional images of an MPF file)
+	// so that it can be written back.
+	if js.MarkerId() == MARKER_EOI && js.consumed < size {
+		_, err := rs.Seek(start+int64(js.consumed), io.SeekStart)
+		log.PanicIf(err)
+
+		trailer, err := ioutil.ReadAll(rs)
+		log.PanicIf(err)
+
+		sl.trailer = trailer
+	}
+
 	return ec, nil
 }
 
@@ -125,9 +144,61 @@ func (jmp *JpegMediaParser) LooksLikeFormat(data []byte) bool {
 	return true
 }
 
-// GetImage returns an image.Image-compatible struct.
+// GetImage returns an image.Image-compatible struct. Lossless images and
+// images with samples of other than eight bits, which the standard decoder
+// doesn't support, and CMYK and YCCK images, which it doesn't convert to RGB
+// (or, without an Adobe segment, interpret correctly), are decoded by
+// `DecodeImage` using the embedded ICC profile. Arithmetic-coded images are
+// losslessly transcoded to Huffman coding first.
 func (jmp *JpegMediaParser) GetImage(r io.Reader) (img image.Image, err error) {
-	img, err = jpeg.Decode(r)
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	data, err := ioutil.ReadAll(r)
+	log.PanicIf(err)
+
+	// If we can't parse it, let the standard decoder report the problem.
+
+	intfc, err := jmp.ParseBytes(data)
+	if err == nil {
+		sl := intfc.(*SegmentList)
+
+		var fh *SofSegment
+		for _, s := range sl.Segments() {
+			if isSofMarker(s.MarkerId) == true {
+				fh, err = ParseSofSegment(s.MarkerId, s.Data)
+				log.PanicIf(err)
+
+				break
+			}
+		}
+
+		if fh != nil && (fh.IsLossless() == true || fh.BitsPerSample != 8 || len(fh.Components) == 4) {
+			options := &DecodeImageOptions{
+				UseIccProfile: true,
+			}
+
+			img, err = sl.DecodeImage(options)
+			log.PanicIf(err)
+
+			return img, nil
+		} else if fh != nil && fh.IsArithmetic() == true {
+			err = sl.Reencode(nil)
+			log.PanicIf(err)
+
+			b := new(bytes.Buffer)
+
+			err = sl.Write(b)
+			log.PanicIf(err)
+
+			data = b.Bytes()
+		}
+	}
+
+	img, err = jpeg.Decode(bytes.NewReader(data))
 	log.PanicIf(err)
 
 	return img, nil
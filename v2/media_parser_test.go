@@ -1,7 +1,9 @@
 package jpegstructure
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"testing"
@@ -251,3 +253,94 @@ func TestJpegMediaParser_LooksLikeFormat(t *testing.T) {
 		t.Fatalf("not detected as JPEG")
 	}
 }
+
+func TestJpegMediaParser_ParseBytes_Trailer(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	original := getTestGeneratedJpeg(16, 16, false)
+
+	jmp := NewJpegMediaParser()
+
+	intfc, err := jmp.ParseBytes(original)
+	log.PanicIf(err)
+
+	sl := intfc.(*SegmentList)
+
+	if sl.Trailer() != nil {
+		t.Fatalf("Expected no trailer.")
+	}
+
+	// Anything after the EOI is kept and written back.
+
+	trailer := []byte("\000\000some trailing data\377\330")
+	data := append(append([]byte{}, original...), trailer...)
+
+	intfc, err = jmp.ParseBytes(data)
+	log.PanicIf(err)
+
+	sl = intfc.(*SegmentList)
+
+	if bytes.Equal(sl.Trailer(), trailer) != true {
+		t.Fatalf("Trailer not correct: %v", sl.Trailer())
+	}
+
+	b := new(bytes.Buffer)
+
+	err = sl.Write(b)
+	log.PanicIf(err)
+
+	if bytes.Equal(b.Bytes(), data) != true {
+		t.Fatalf("Written data not correct.")
+	}
+
+	sl.SetTrailer(nil)
+
+	b = new(bytes.Buffer)
+
+	err = sl.Write(b)
+	log.PanicIf(err)
+
+	if bytes.Equal(b.Bytes(), original) != true {
+		t.Fatalf("Written data not correct after dropping the trailer.")
+	}
+}
+
+func TestJpegMediaParser_Parse_Trailer_NotAtStart(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	original := getTestGeneratedJpeg(16, 16, false)
+	trailer := []byte("some trailing data")
+
+	prefix := []byte("a container header")
+	data := append(append(append([]byte{}, prefix...), original...), trailer...)
+
+	// The image starts partway into the stream.
+
+	r := bytes.NewReader(data)
+
+	_, err := r.Seek(int64(len(prefix)), io.SeekStart)
+	log.PanicIf(err)
+
+	jmp := NewJpegMediaParser()
+
+	intfc, err := jmp.Parse(r, len(data)-len(prefix))
+	log.PanicIf(err)
+
+	sl := intfc.(*SegmentList)
+
+	if bytes.Equal(sl.Trailer(), trailer) != true {
+		t.Fatalf("Trailer not correct: %v", sl.Trailer())
+	}
+}
@@ -0,0 +1,566 @@
+package jpegstructure
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/dsoprea/go-logging"
+)
+
+var (
+	// ErrNoMotionPhoto is returned if there's no motion-photo video.
+	ErrNoMotionPhoto = errors.New("no motion-photo video")
+)
+
+const (
+	xmpNamespaceGCamera = "http://ns.google.com/photos/1.0/camera/"
+
+	containerSemanticMotionPhoto = "MotionPhoto"
+
+	// motionPhotoMime is the type of the video if nothing says otherwise.
+	motionPhotoMime = "video/mp4"
+
+	// sefMotionPhotoName and sefMotionPhotoType identify the video in a SEF
+	// trailer.
+	sefMotionPhotoName = "MotionPhoto_Data"
+	sefMotionPhotoType = uint16(0x0a30)
+)
+
+// MotionPhotoFormat is how the video of a motion photo is stored.
+type MotionPhotoFormat int
+
+const (
+	// MotionPhotoFormatContainer is a Motion Photo, where the video is an
+	// item of the container directory in the XMP.
+	MotionPhotoFormatContainer MotionPhotoFormat = iota
+
+	// MotionPhotoFormatMicroVideo is the older format, where the XMP has the
+	// distance from the start of the video to the end of the file.
+	MotionPhotoFormatMicroVideo
+
+	// MotionPhotoFormatSamsung is a Samsung motion photo, where the video is
+	// an entry of the SEF trailer.
+	MotionPhotoFormatSamsung
+)
+
+// String returns a descriptive string.
+func (mpf MotionPhotoFormat) String() string {
+	switch mpf {
+	case MotionPhotoFormatContainer:
+		return "Container"
+	case MotionPhotoFormatMicroVideo:
+		return "MicroVideo"
+	case MotionPhotoFormatSamsung:
+		return "Samsung"
+	}
+
+	return fmt.Sprintf("Unknown(%d)", int(mpf))
+}
+
+// MotionPhoto is the video of a motion photo.
+type MotionPhoto struct {
+	// Format is how the video is stored.
+	Format MotionPhotoFormat
+
+	// Mime is the type of the video.
+	Mime string
+
+	// PresentationTimestampUs is the time in the video that the still image
+	// was taken at, in microseconds, or (-1) if it isn't given.
+	PresentationTimestampUs int64
+
+	// Video is the video.
+	Video []byte
+}
+
+// String returns a descriptive string.
+func (mp *MotionPhoto) String() string {
+	return fmt.Sprintf("MotionPhoto<FORMAT=[%s] MIME=[%s] TIMESTAMP-US=(%d) SIZE=(%d)>", mp.Format, mp.Mime, mp.PresentationTimestampUs, len(mp.Video))
+}
+
+// motionPhotoLocation is where the video is and how it's described.
+type motionPhotoLocation struct {
+	format                  MotionPhotoFormat
+	mime                    string
+	presentationTimestampUs int64
+
+	// start and end are where the video is in the trailer, for the formats
+	// other than Samsung.
+	start int
+	end   int
+
+	// st is the SEF trailer, and entry is the index of the video in it, for
+	// the Samsung format.
+	st    *SefTrailer
+	entry int
+}
+
+// video returns the video.
+func (ml *motionPhotoLocation) video(trailer []byte) []byte {
+	if ml.format == MotionPhotoFormatSamsung {
+		return ml.st.Entries[ml.entry].Data
+	}
+
+	return trailer[ml.start:ml.end]
+}
+
+// findMotionPhoto finds the video. A SEF entry is preferred, then the
+// container directory, and then the older offset. `ErrNoMotionPhoto` is
+// returned if there's no video.
+func (sl *SegmentList) findMotionPhoto() (ml *motionPhotoLocation, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	var xd *xmpDocument
+
+	_, s, err := sl.FindXmp()
+	if err == nil {
+		xd, err = parseXmpDocument(s.Data[len(xmpPrefix):])
+		log.PanicIf(err)
+	} else if err != ErrNoXmp {
+		log.Panic(err)
+	}
+
+	ml = &motionPhotoLocation{
+		mime:                    motionPhotoMime,
+		presentationTimestampUs: -1,
+	}
+
+	if xd != nil {
+		for _, local := range []string{"MotionPhotoPresentationTimestampUs", "MicroVideoPresentationTimestampUs"} {
+			if raw, found := xd.property(xmpNamespaceGCamera, local); found == true {
+				ml.presentationTimestampUs, err = strconv.ParseInt(raw, 10, 64)
+				log.PanicIf(err)
+
+				break
+			}
+		}
+	}
+
+	_, st, err := parseSefTrailer(sl.trailer)
+	log.PanicIf(err)
+
+	if st != nil {
+		if i := st.Find(sefMotionPhotoName); i >= 0 {
+			ml.format = MotionPhotoFormatSamsung
+			ml.st = st
+			ml.entry = i
+
+			return ml, nil
+		}
+	}
+
+	if xd == nil {
+		return nil, ErrNoMotionPhoto
+	}
+
+	items, err := xd.containerDirectory()
+	log.PanicIf(err)
+
+	for i := 1; i < len(items); i++ {
+		if items[i].Semantic != containerSemanticMotionPhoto {
+			continue
+		}
+
+		start := containerItemOffset(items, i)
+
+		// Without a length, the video runs to the end.
+		end := len(sl.trailer)
+		if items[i].Length != 0 {
+			end = start + items[i].Length
+		}
+
+		if start < end && end <= len(sl.trailer) {
+			ml.format = MotionPhotoFormatContainer
+			ml.start = start
+			ml.end = end
+
+			if items[i].Mime != "" {
+				ml.mime = items[i].Mime
+			}
+
+			return ml, nil
+		}
+
+		break
+	}
+
+	if raw, found := xd.property(xmpNamespaceGCamera, "MicroVideoOffset"); found == true {
+		offset, err := strconv.Atoi(raw)
+		log.PanicIf(err)
+
+		if offset > 0 && offset <= len(sl.trailer) {
+			ml.format = MotionPhotoFormatMicroVideo
+			ml.start = len(sl.trailer) - offset
+			ml.end = len(sl.trailer)
+
+			return ml, nil
+		}
+	}
+
+	return nil, ErrNoMotionPhoto
+}
+
+// MotionPhoto returns the video of a Google or Samsung motion photo, which is
+// stored after the image. `ErrNoMotionPhoto` is returned if there isn't one.
+func (sl *SegmentList) MotionPhoto() (mp *MotionPhoto, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	ml, err := sl.findMotionPhoto()
+	if err != nil {
+		if err == ErrNoMotionPhoto {
+			return nil, err
+		}
+
+		log.Panic(err)
+	}
+
+	mp = &MotionPhoto{
+		Format:                  ml.format,
+		Mime:                    ml.mime,
+		PresentationTimestampUs: ml.presentationTimestampUs,
+		Video:                   append([]byte{}, ml.video(sl.trailer)...),
+	}
+
+	return mp, nil
+}
+
+// isMotionPhotoProperty returns true for the properties that describe the
+// video.
+func isMotionPhotoProperty(namespace, local string) bool {
+	if namespace != xmpNamespaceGCamera {
+		return false
+	}
+
+	switch local {
+	case "MotionPhoto", "MotionPhotoVersion", "MotionPhotoPresentationTimestampUs", "MicroVideo", "MicroVideoVersion", "MicroVideoOffset", "MicroVideoPresentationTimestampUs":
+		return true
+	}
+
+	return false
+}
+
+// updateMotionPhotoXmp updates the XMP after the size of the video has
+// changed by `delta`, or removes the description of the video if it was
+// dropped. Both the container directory and the older offset are relative to
+// the end of the primary image or of the file, so they only depend on what
+// comes after the primary image.
+func (sl *SegmentList) updateMotionPhotoXmp(isDropped bool, delta int) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	_, s, err := sl.FindXmp()
+	if err == ErrNoXmp {
+		return nil
+	}
+
+	log.PanicIf(err)
+
+	xd, err := parseXmpDocument(s.Data[len(xmpPrefix):])
+	log.PanicIf(err)
+
+	items, err := xd.containerDirectory()
+	log.PanicIf(err)
+
+	updated := make([]containerItem, 0, len(items))
+	isChanged := false
+
+	for _, ci := range items {
+		if ci.Semantic == containerSemanticMotionPhoto {
+			isChanged = true
+
+			if isDropped == true {
+				continue
+			}
+
+			if ci.Length != 0 {
+				ci.Length += delta
+			}
+		}
+
+		updated = append(updated, ci)
+	}
+
+	if isChanged == true && len(updated) <= 1 {
+		xd.removeProperties(func(namespace, local string) bool {
+			return namespace == xmpNamespaceContainer && local == "Directory"
+		})
+	} else if isChanged == true {
+		_, err := xd.setContainerDirectory(updated)
+		log.PanicIf(err)
+	}
+
+	if isDropped == true {
+		xd.removeProperties(isMotionPhotoProperty)
+	} else if raw, found := xd.property(xmpNamespaceGCamera, "MicroVideoOffset"); found == true {
+		offset, err := strconv.Atoi(raw)
+		log.PanicIf(err)
+
+		xd.setProperty(xmpNamespaceGCamera, "MicroVideoOffset", strconv.Itoa(offset+delta))
+	}
+
+	err = setXmpDocument(s, xd)
+	log.PanicIf(err)
+
+	return nil
+}
+
+// relocateMotionPhotoXmp updates the XMP after the video has moved to
+// `start`-`end` in a trailer of `trailerSize` bytes without changing size
+// itself, which happens when other parts of a SEF trailer change. The padding
+// before the container item is adjusted to match.
+func (sl *SegmentList) relocateMotionPhotoXmp(start, end, trailerSize int) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	_, s, err := sl.FindXmp()
+	if err == ErrNoXmp {
+		return nil
+	}
+
+	log.PanicIf(err)
+
+	xd, err := parseXmpDocument(s.Data[len(xmpPrefix):])
+	log.PanicIf(err)
+
+	items, err := xd.containerDirectory()
+	log.PanicIf(err)
+
+	isChanged := false
+
+	for i := 1; i < len(items); i++ {
+		if items[i].Semantic != containerSemanticMotionPhoto {
+			continue
+		}
+
+		padding := items[i-1].Padding + start - containerItemOffset(items, i)
+		if padding < 0 {
+			log.Panicf("container items before the video overlap it: (%d)", padding)
+		}
+
+		items[i-1].Padding = padding
+
+		if items[i].Length != 0 {
+			items[i].Length = end - start
+		}
+
+		_, err := xd.setContainerDirectory(items)
+		log.PanicIf(err)
+
+		isChanged = true
+
+		break
+	}
+
+	if _, found := xd.property(xmpNamespaceGCamera, "MicroVideoOffset"); found == true {
+		xd.setProperty(xmpNamespaceGCamera, "MicroVideoOffset", strconv.Itoa(trailerSize-start))
+		isChanged = true
+	}
+
+	if isChanged == true {
+		err = setXmpDocument(s, xd)
+		log.PanicIf(err)
+	}
+
+	return nil
+}
+
+// refreshUltraHdr rewrites the MPF index of an Ultra HDR image, since its
+// offsets depend on the size of the primary image.
+func (sl *SegmentList) refreshUltraHdr() (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	uh, err := sl.UltraHdr()
+	if err == ErrNoUltraHdr {
+		return nil
+	}
+
+	log.PanicIf(err)
+
+	err = sl.SetUltraHdr(uh.GainMap)
+	log.PanicIf(err)
+
+	return nil
+}
+
+// DropMotionPhoto removes the video of a motion photo and the XMP that
+// describes it. Whatever else is in the trailer is kept.
+func (sl *SegmentList) DropMotionPhoto() (wasDropped bool, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	ml, err := sl.findMotionPhoto()
+	if err != nil {
+		if err == ErrNoMotionPhoto {
+			return false, nil
+		}
+
+		log.Panic(err)
+	}
+
+	if ml.format == MotionPhotoFormatSamsung {
+		ml.st.Entries = append(ml.st.Entries[:ml.entry], ml.st.Entries[ml.entry+1:]...)
+
+		err := sl.SetSefTrailer(ml.st)
+		log.PanicIf(err)
+
+		return true, nil
+	}
+
+	trailer := append([]byte{}, sl.trailer[:ml.start]...)
+	sl.trailer = append(trailer, sl.trailer[ml.end:]...)
+
+	err = sl.updateMotionPhotoXmp(true, 0)
+	log.PanicIf(err)
+
+	err = sl.refreshUltraHdr()
+	log.PanicIf(err)
+
+	return true, nil
+}
+
+// SetMotionPhoto replaces the video of a motion photo, keeping the format that
+// it was stored in, and updates the XMP to match. If there's no video yet, it's
+// added as a SEF entry if there's a SEF trailer and as a container-directory
+// item otherwise.
+//
+// The container directory and the older offset are relative to the end of the
+// image or of the file, so changes to the image don't affect them. The MPF
+// index of an Ultra HDR image does depend on the size of the image and is
+// rewritten, so this should be done after any other changes to the segments.
+func (sl *SegmentList) SetMotionPhoto(video []byte) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	ml, err := sl.findMotionPhoto()
+	if err == ErrNoMotionPhoto {
+		err := sl.addMotionPhoto(video)
+		log.PanicIf(err)
+
+		return nil
+	}
+
+	log.PanicIf(err)
+
+	if ml.format == MotionPhotoFormatSamsung {
+		ml.st.Entries[ml.entry].Data = video
+
+		err := sl.SetSefTrailer(ml.st)
+		log.PanicIf(err)
+
+		return nil
+	}
+
+	delta := len(video) - len(ml.video(sl.trailer))
+
+	trailer := append([]byte{}, sl.trailer[:ml.start]...)
+	trailer = append(trailer, video...)
+	sl.trailer = append(trailer, sl.trailer[ml.end:]...)
+
+	err = sl.updateMotionPhotoXmp(false, delta)
+	log.PanicIf(err)
+
+	err = sl.refreshUltraHdr()
+	log.PanicIf(err)
+
+	return nil
+}
+
+// addMotionPhoto adds a video to an image that doesn't have one.
+func (sl *SegmentList) addMotionPhoto(video []byte) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	st, err := sl.SefTrailer()
+	if err == nil {
+		se := SefEntry{
+			Type: sefMotionPhotoType,
+			Name: sefMotionPhotoName,
+			Data: video,
+		}
+
+		st.Entries = append(st.Entries, se)
+
+		err := sl.SetSefTrailer(st)
+		log.PanicIf(err)
+
+		return nil
+	} else if err != ErrNoSefTrailer {
+		log.Panic(err)
+	}
+
+	s, xd, err := sl.editableXmp()
+	log.PanicIf(err)
+
+	items, err := xd.containerDirectory()
+	log.PanicIf(err)
+
+	if len(items) == 0 {
+		items = []containerItem{
+			{Semantic: containerSemanticPrimary, Mime: "image/jpeg"},
+		}
+	}
+
+	// The video goes at the end, and anything in the trailer that the
+	// directory doesn't account for becomes padding before it.
+
+	offset := containerItemOffset(items, len(items))
+	if offset > len(sl.trailer) {
+		log.Panicf("container directory describes more than the trailer: (%d) > (%d)", offset, len(sl.trailer))
+	}
+
+	items[len(items)-1].Padding += len(sl.trailer) - offset
+
+	mpItem := containerItem{
+		Semantic: containerSemanticMotionPhoto,
+		Mime:     motionPhotoMime,
+		Length:   len(video),
+	}
+
+	items = append(items, mpItem)
+
+	description, err := xd.setContainerDirectory(items)
+	log.PanicIf(err)
+
+	if _, found := xd.property(xmpNamespaceGCamera, "MotionPhoto"); found == false {
+		description.addAttribute("GCamera", xmpNamespaceGCamera, "MotionPhoto", "1")
+		description.addAttribute("GCamera", xmpNamespaceGCamera, "MotionPhotoVersion", "1")
+	}
+
+	err = setXmpDocument(s, xd)
+	log.PanicIf(err)
+
+	sl.trailer = append(append([]byte{}, sl.trailer...), video...)
+
+	err = sl.refreshUltraHdr()
+	log.PanicIf(err)
+
+	return nil
+}
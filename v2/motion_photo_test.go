@@ -0,0 +1,361 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/dsoprea/go-logging"
+)
+
+const (
+	motionPhotoTestMicroVideoPacket = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:GCamera="http://ns.google.com/photos/1.0/camera/"
+    GCamera:MicroVideo="1"
+    GCamera:MicroVideoVersion="1"
+    GCamera:MicroVideoOffset="%d"
+    GCamera:MicroVideoPresentationTimestampUs="1500000"/>
+ </rdf:RDF>
+</x:xmpmeta>`
+)
+
+// getMotionPhotoTestVideo returns something that looks like the start of an
+// MP4.
+func getMotionPhotoTestVideo(size int) []byte {
+	video := make([]byte, size)
+	copy(video, "\x00\x00\x00\x18ftypmp42")
+
+	for i := 12; i < size; i++ {
+		video[i] = byte(i)
+	}
+
+	return video
+}
+
+// getMotionPhotoTestXmp returns the XMP properties of the image.
+func getMotionPhotoTestXmp(sl *SegmentList) (xd *xmpDocument, items []containerItem) {
+	_, s, err := sl.FindXmp()
+	log.PanicIf(err)
+
+	xd, err = parseXmpDocument(s.Data[len(xmpPrefix):])
+	log.PanicIf(err)
+
+	items, err = xd.containerDirectory()
+	log.PanicIf(err)
+
+	return xd, items
+}
+
+func TestSegmentList_MotionPhoto_Container(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getSanitizeTestSegmentList()
+	video := getMotionPhotoTestVideo(100)
+
+	err := sl.SetMotionPhoto(video)
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	mp, err := sl.MotionPhoto()
+	log.PanicIf(err)
+
+	if mp.Format != MotionPhotoFormatContainer || mp.Mime != "video/mp4" || mp.PresentationTimestampUs != -1 {
+		t.Fatalf("Motion photo not correct: %s", mp)
+	} else if bytes.Equal(mp.Video, video) != true {
+		t.Fatalf("Video not correct.")
+	} else if mp.String() != "MotionPhoto<FORMAT=[Container] MIME=[video/mp4] TIMESTAMP-US=(-1) SIZE=(100)>" {
+		t.Fatalf("String not correct: [%s]", mp)
+	}
+
+	// The old trailer is padding before the video.
+
+	xd, items := getMotionPhotoTestXmp(sl)
+
+	if len(items) != 2 || items[0].Semantic != "Primary" || items[0].Padding != len("private trailer") || items[1].Semantic != "MotionPhoto" || items[1].Length != 100 {
+		t.Fatalf("Container directory not correct: %v", items)
+	} else if value, _ := xd.property(xmpNamespaceGCamera, "MotionPhoto"); value != "1" {
+		t.Fatalf("MotionPhoto property not correct: [%s]", value)
+	} else if bytes.HasPrefix(sl.Trailer(), []byte("private trailer")) != true {
+		t.Fatalf("Trailer not kept.")
+	}
+
+	// Edits to the image don't affect the video.
+
+	sl.AddComment("edited")
+
+	err = sl.Transform(TransformRotate90, nil)
+	log.PanicIf(err)
+
+	video = getMotionPhotoTestVideo(150)
+
+	err = sl.SetMotionPhoto(video)
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	mp, err = sl.MotionPhoto()
+	log.PanicIf(err)
+
+	if bytes.Equal(mp.Video, video) != true {
+		t.Fatalf("Replaced video not correct.")
+	}
+
+	_, items = getMotionPhotoTestXmp(sl)
+
+	if len(items) != 2 || items[1].Length != 150 {
+		t.Fatalf("Container directory not updated: %v", items)
+	}
+
+	wasDropped, err := sl.DropMotionPhoto()
+	log.PanicIf(err)
+
+	if wasDropped != true {
+		t.Fatalf("Expected the video to be dropped.")
+	}
+
+	sl, _ = reparseSegmentList(sl)
+
+	if _, err := sl.MotionPhoto(); err != ErrNoMotionPhoto {
+		t.Fatalf("Expected no motion photo: %v", err)
+	} else if bytes.Equal(sl.Trailer(), []byte("private trailer")) != true {
+		t.Fatalf("Trailer not correct: [%s]", sl.Trailer())
+	}
+
+	xd, items = getMotionPhotoTestXmp(sl)
+
+	if len(items) != 0 {
+		t.Fatalf("Container directory not removed: %v", items)
+	} else if _, found := xd.property(xmpNamespaceGCamera, "MotionPhoto"); found == true {
+		t.Fatalf("MotionPhoto property not removed.")
+	}
+
+	xmpProperties, err := sl.xmpProperties()
+	log.PanicIf(err)
+
+	if xmpProperties["dc:creator[1]"] != "Someone" {
+		t.Fatalf("XMP not kept: %v", xmpProperties)
+	}
+
+	wasDropped, err = sl.DropMotionPhoto()
+	log.PanicIf(err)
+
+	if wasDropped != false {
+		t.Fatalf("Expected nothing to drop.")
+	}
+}
+
+func TestSegmentList_MotionPhoto_MicroVideo(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(32, 32, false))
+	video := getMotionPhotoTestVideo(80)
+
+	s, xd, err := sl.editableXmp()
+	log.PanicIf(err)
+
+	xd, err = parseXmpDocument([]byte(fmt.Sprintf(motionPhotoTestMicroVideoPacket, len(video))))
+	log.PanicIf(err)
+
+	err = setXmpDocument(s, xd)
+	log.PanicIf(err)
+
+	sl.SetTrailer(append([]byte("before"), video...))
+
+	mp, err := sl.MotionPhoto()
+	log.PanicIf(err)
+
+	if mp.Format != MotionPhotoFormatMicroVideo || mp.PresentationTimestampUs != 1500000 {
+		t.Fatalf("Motion photo not correct: %s", mp)
+	} else if bytes.Equal(mp.Video, video) != true {
+		t.Fatalf("Video not correct.")
+	}
+
+	video = getMotionPhotoTestVideo(50)
+
+	err = sl.SetMotionPhoto(video)
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	mp, err = sl.MotionPhoto()
+	log.PanicIf(err)
+
+	if mp.Format != MotionPhotoFormatMicroVideo || bytes.Equal(mp.Video, video) != true {
+		t.Fatalf("Replaced video not correct: %s", mp)
+	}
+
+	xd, _ = getMotionPhotoTestXmp(sl)
+
+	if offset, _ := xd.property(xmpNamespaceGCamera, "MicroVideoOffset"); offset != "50" {
+		t.Fatalf("Offset not updated: [%s]", offset)
+	}
+
+	_, err = sl.DropMotionPhoto()
+	log.PanicIf(err)
+
+	if bytes.Equal(sl.Trailer(), []byte("before")) != true {
+		t.Fatalf("Trailer not correct: [%s]", sl.Trailer())
+	}
+
+	xd, _ = getMotionPhotoTestXmp(sl)
+
+	if _, found := xd.property(xmpNamespaceGCamera, "MicroVideoOffset"); found == true {
+		t.Fatalf("Offset not removed.")
+	}
+}
+
+func TestSegmentList_MotionPhoto_Samsung(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(32, 32, false))
+	sl.SetTrailer(append([]byte("prefix"), sefTestTrailer...))
+
+	mp, err := sl.MotionPhoto()
+	log.PanicIf(err)
+
+	if mp.Format != MotionPhotoFormatSamsung || bytes.Equal(mp.Video, []byte("video")) != true {
+		t.Fatalf("Motion photo not correct: %s", mp)
+	}
+
+	video := getMotionPhotoTestVideo(60)
+
+	err = sl.SetMotionPhoto(video)
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	mp, err = sl.MotionPhoto()
+	log.PanicIf(err)
+
+	if bytes.Equal(mp.Video, video) != true {
+		t.Fatalf("Replaced video not correct.")
+	}
+
+	start, st, err := parseSefTrailer(sl.Trailer())
+	log.PanicIf(err)
+
+	if start != 6 || len(st.Entries) != 2 || st.Entries[0].Name != "Image_UTC_Data" || st.Version != 0x6b {
+		t.Fatalf("SEF trailer not correct: %v", st.Entries)
+	}
+
+	_, err = sl.DropMotionPhoto()
+	log.PanicIf(err)
+
+	_, st, err = parseSefTrailer(sl.Trailer())
+	log.PanicIf(err)
+
+	if len(st.Entries) != 1 || st.Entries[0].Name != "Image_UTC_Data" {
+		t.Fatalf("SEF trailer not correct after drop: %v", st.Entries)
+	}
+
+	// A new video is added to the SEF trailer.
+
+	err = sl.SetMotionPhoto(video)
+	log.PanicIf(err)
+
+	mp, err = sl.MotionPhoto()
+	log.PanicIf(err)
+
+	if mp.Format != MotionPhotoFormatSamsung || bytes.Equal(mp.Video, video) != true {
+		t.Fatalf("Added video not correct: %s", mp)
+	} else if _, _, err := sl.FindXmp(); err != ErrNoXmp {
+		t.Fatalf("Expected no XMP to be added: %v", err)
+	}
+}
+
+func TestSegmentList_MotionPhoto_UltraHdr(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl, gainMap := getUltraHdrTestSegmentList()
+	video := getMotionPhotoTestVideo(100)
+
+	err := sl.SetMotionPhoto(video)
+	log.PanicIf(err)
+
+	_, items := getMotionPhotoTestXmp(sl)
+
+	if len(items) != 3 || items[1].Semantic != "GainMap" || items[2].Semantic != "MotionPhoto" {
+		t.Fatalf("Container directory not correct: %v", items)
+	}
+
+	// The MPF index is rewritten after the image changes.
+
+	sl.AddComment("edited")
+
+	video = getMotionPhotoTestVideo(120)
+
+	err = sl.SetMotionPhoto(video)
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	data, err := sl.MpfImage(1)
+	log.PanicIf(err)
+
+	if bytes.Equal(data, gainMap) != true {
+		t.Fatalf("MPF image not correct.")
+	}
+
+	mp, err := sl.MotionPhoto()
+	log.PanicIf(err)
+
+	if bytes.Equal(mp.Video, video) != true {
+		t.Fatalf("Video not correct.")
+	}
+
+	_, err = sl.DropMotionPhoto()
+	log.PanicIf(err)
+
+	uh, err := sl.UltraHdr()
+	log.PanicIf(err)
+
+	if bytes.Equal(uh.GainMap, gainMap) != true || bytes.Equal(sl.Trailer(), gainMap) != true {
+		t.Fatalf("Gain map not kept.")
+	}
+
+	_, items = getMotionPhotoTestXmp(sl)
+
+	if len(items) != 2 || items[1].Semantic != "GainMap" {
+		t.Fatalf("Container directory not correct after drop: %v", items)
+	}
+}
+
+func TestSegmentList_MotionPhoto_NotMotionPhoto(t *testing.T) {
+	sl := getSanitizeTestSegmentList()
+
+	if _, err := sl.MotionPhoto(); err != ErrNoMotionPhoto {
+		t.Fatalf("Expected no motion photo: %v", err)
+	}
+
+	sl = getCoefficientsTestSegmentList(getTestGeneratedJpeg(16, 16, false))
+
+	if _, err := sl.MotionPhoto(); err != ErrNoMotionPhoto {
+		t.Fatalf("Expected no motion photo: %v", err)
+	}
+}
@@ -0,0 +1,552 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/dsoprea/go-logging"
+)
+
+var (
+	mpfPrefix = []byte("MPF\000")
+)
+
+var (
+	// ErrNoMpf is returned if MPF data was requested but not found.
+	ErrNoMpf = errors.New("no MPF data")
+)
+
+const (
+	mpfVersionTagId        = uint16(0xb000)
+	mpfNumberOfImagesTagId = uint16(0xb001)
+	mpfEntryTagId          = uint16(0xb002)
+
+	// mpfEntrySize is the size of one MP entry.
+	mpfEntrySize = 16
+)
+
+// MpfImageType is the type code of an MPF image (CIPA DC-007 5.2.3.3.1).
+type MpfImageType uint32
+
+const (
+	// MpfImageTypeUndefined is an image with no particular role.
+	MpfImageTypeUndefined MpfImageType = 0x000000
+
+	// MpfImageTypeLargeThumbnailVga is a VGA-sized preview.
+	MpfImageTypeLargeThumbnailVga MpfImageType = 0x010001
+
+	// MpfImageTypeLargeThumbnailFullHd is a full-HD-sized preview.
+	MpfImageTypeLargeThumbnailFullHd MpfImageType = 0x010002
+
+	// MpfImageTypeMultiFramePanorama is one frame of a panorama.
+	MpfImageTypeMultiFramePanorama MpfImageType = 0x020001
+
+	// MpfImageTypeMultiFrameDisparity is one view of a stereo image.
+	MpfImageTypeMultiFrameDisparity MpfImageType = 0x020002
+
+	// MpfImageTypeMultiFrameMultiAngle is one view of a multi-angle image.
+	MpfImageTypeMultiFrameMultiAngle MpfImageType = 0x020003
+
+	// MpfImageTypeBaselinePrimary is the primary image.
+	MpfImageTypeBaselinePrimary MpfImageType = 0x030000
+)
+
+// String returns a descriptive string.
+func (mit MpfImageType) String() string {
+	switch mit {
+	case MpfImageTypeUndefined:
+		return "Undefined"
+	case MpfImageTypeLargeThumbnailVga:
+		return "LargeThumbnailVga"
+	case MpfImageTypeLargeThumbnailFullHd:
+		return "LargeThumbnailFullHd"
+	case MpfImageTypeMultiFramePanorama:
+		return "MultiFramePanorama"
+	case MpfImageTypeMultiFrameDisparity:
+		return "MultiFrameDisparity"
+	case MpfImageTypeMultiFrameMultiAngle:
+		return "MultiFrameMultiAngle"
+	case MpfImageTypeBaselinePrimary:
+		return "BaselinePrimary"
+	}
+
+	return fmt.Sprintf("Unknown(0x%06x)", uint32(mit))
+}
+
+// IsThumbnail returns true if the image is one of the large-thumbnail types.
+func (mit MpfImageType) IsThumbnail() bool {
+	return mit == MpfImageTypeLargeThumbnailVga || mit == MpfImageTypeLargeThumbnailFullHd
+}
+
+// MpfEntry describes one of the images in an MPF file.
+type MpfEntry struct {
+	// Attribute has the flags in the top byte and the type in the rest.
+	Attribute uint32
+
+	// Size is the size of the image data.
+	Size uint32
+
+	// Offset is where the image starts, relative to the MP header (the byte-
+	// order mark just after the MPF prefix). It's (0) for the first image.
+	Offset uint32
+
+	// DependentImage1 and DependentImage2 are the (one-based) numbers of the
+	// images that this one depends on, if any.
+	DependentImage1 uint16
+	DependentImage2 uint16
+}
+
+// Type returns the image type.
+func (me MpfEntry) Type() MpfImageType {
+	return MpfImageType(me.Attribute & 0xffffff)
+}
+
+// IsRepresentative returns true if the image is the one to show by default.
+func (me MpfEntry) IsRepresentative() bool {
+	return me.Attribute&(1<<29) != 0
+}
+
+// String returns a descriptive string.
+func (me MpfEntry) String() string {
+	return fmt.Sprintf("MpfEntry<TYPE=[%s] SIZE=(%d) OFFSET=(%d)>", me.Type(), me.Size, me.Offset)
+}
+
+// MpfIndex is the MP index IFD of the first image of an MPF file.
+type MpfIndex struct {
+	// Version is the MPF version (usually "0100").
+	Version string
+
+	// ByteOrder is the byte-order of the MP header.
+	ByteOrder binary.ByteOrder
+
+	// Entries describe the images, with the primary image first.
+	Entries []MpfEntry
+}
+
+// String returns a descriptive string.
+func (mi *MpfIndex) String() string {
+	return fmt.Sprintf("MpfIndex<VERSION=[%s] IMAGES=(%d)>", mi.Version, len(mi.Entries))
+}
+
+// ParseMpfSegment parses the MP index IFD from the payload of an MPF APP2
+// segment. The attribute IFD is not interpreted.
+func ParseMpfSegment(data []byte) (mi *MpfIndex, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if bytes.HasPrefix(data, mpfPrefix) == false {
+		log.Panicf("not an MPF segment")
+	}
+
+	header := data[len(mpfPrefix):]
+	if len(header) < 8 {
+		log.Panicf("MP header truncated")
+	}
+
+	var byteOrder binary.ByteOrder
+	switch string(header[0:4]) {
+	case "II*\000":
+		byteOrder = binary.LittleEndian
+	case "MM\000*":
+		byteOrder = binary.BigEndian
+	default:
+		log.Panicf("MP header byte-order not valid")
+	}
+
+	ifdOffset := int(byteOrder.Uint32(header[4:8]))
+	if ifdOffset < 8 || ifdOffset+2 > len(header) {
+		log.Panicf("MP index IFD out of bounds: (%d)", ifdOffset)
+	}
+
+	count := int(byteOrder.Uint16(header[ifdOffset:]))
+	if ifdOffset+2+count*12 > len(header) {
+		log.Panicf("MP index IFD truncated")
+	}
+
+	mi = &MpfIndex{
+		ByteOrder: byteOrder,
+	}
+
+	numberOfImages := -1
+	var rawEntries []byte
+
+	for i := 0; i < count; i++ {
+		raw := header[ifdOffset+2+i*12:]
+
+		tagId := byteOrder.Uint16(raw[0:2])
+		valueCount := int(byteOrder.Uint32(raw[4:8]))
+
+		switch tagId {
+		case mpfVersionTagId:
+			mi.Version = string(raw[8:12])
+		case mpfNumberOfImagesTagId:
+			numberOfImages = int(byteOrder.Uint32(raw[8:12]))
+		case mpfEntryTagId:
+			offset := int(byteOrder.Uint32(raw[8:12]))
+			if valueCount <= 4 {
+				rawEntries = raw[8 : 8+valueCount]
+			} else if offset < 0 || offset+valueCount > len(header) || offset+valueCount < offset {
+				log.Panicf("MP entries out of bounds: OFFSET=(%d) SIZE=(%d)", offset, valueCount)
+			} else {
+				rawEntries = header[offset : offset+valueCount]
+			}
+		}
+	}
+
+	if numberOfImages < 0 {
+		log.Panicf("MP number-of-images missing")
+	} else if len(rawEntries) != numberOfImages*mpfEntrySize {
+		log.Panicf("MP entries not consistent with the number of images: (%d) != (%d)", len(rawEntries), numberOfImages*mpfEntrySize)
+	}
+
+	mi.Entries = make([]MpfEntry, numberOfImages)
+
+	for i := range mi.Entries {
+		raw := rawEntries[i*mpfEntrySize:]
+
+		mi.Entries[i] = MpfEntry{
+			Attribute:       byteOrder.Uint32(raw[0:4]),
+			Size:            byteOrder.Uint32(raw[4:8]),
+			Offset:          byteOrder.Uint32(raw[8:12]),
+			DependentImage1: byteOrder.Uint16(raw[12:14]),
+			DependentImage2: byteOrder.Uint16(raw[14:16]),
+		}
+	}
+
+	return mi, nil
+}
+
+// FindMpf returns the segment that hosts the MPF index.
+func (sl *SegmentList) FindMpf() (index int, segment *Segment, err error) {
+	for i, s := range sl.segments {
+		if s.IsMpf() == true {
+			return i, s, nil
+		}
+	}
+
+	return -1, nil, ErrNoMpf
+}
+
+// Mpf returns the parsed MPF index. `ErrNoMpf` is returned if there isn't
+// one.
+func (sl *SegmentList) Mpf() (mi *MpfIndex, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	_, s, err := sl.FindMpf()
+	if err != nil {
+		return nil, err
+	}
+
+	mi, err = ParseMpfSegment(s.Data)
+	log.PanicIf(err)
+
+	return mi, nil
+}
+
+// mpfHeaderOffset returns where the MP header will be written, which is what
+// the entry offsets are relative to.
+func (sl *SegmentList) mpfHeaderOffset() (offset int, err error) {
+	i, _, err := sl.FindMpf()
+	if err != nil {
+		return 0, err
+	}
+
+	offsets, _ := sl.encodedOffsets()
+
+	// The marker and the length precede the payload.
+	return offsets[i] + 4 + len(mpfPrefix), nil
+}
+
+// MpfImage returns the data of the given additional image, which is stored in
+// the trailer. The primary image (entry zero) is the segment-list itself and
+// is not returned this way.
+func (sl *SegmentList) MpfImage(entryIndex int) (data []byte, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	mi, err := sl.Mpf()
+	if err != nil {
+		if err == ErrNoMpf {
+			return nil, err
+		}
+
+		log.Panic(err)
+	}
+
+	if entryIndex < 1 || entryIndex >= len(mi.Entries) {
+		log.Panicf("MPF entry not valid: (%d)", entryIndex)
+	}
+
+	headerOffset, err := sl.mpfHeaderOffset()
+	log.PanicIf(err)
+
+	_, size := sl.encodedOffsets()
+
+	me := mi.Entries[entryIndex]
+
+	start := headerOffset + int(me.Offset) - size
+	end := start + int(me.Size)
+
+	if start < 0 || end > len(sl.trailer) || end < start {
+		log.Panicf("MPF image (%d) not within the trailer: START=(%d) END=(%d) TRAILER-SIZE=(%d)", entryIndex, start, end, len(sl.trailer))
+	}
+
+	return sl.trailer[start:end], nil
+}
+
+// mpfImages returns the MPF index, the data of each additional image (in the
+// order of the entries, after the primary), and whatever follows the last of
+// them in the trailer.
+func (sl *SegmentList) mpfImages() (mi *MpfIndex, images [][]byte, remainder []byte, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	mi, err = sl.Mpf()
+	if err != nil {
+		if err == ErrNoMpf {
+			return nil, nil, nil, err
+		}
+
+		log.Panic(err)
+	}
+
+	headerOffset, err := sl.mpfHeaderOffset()
+	log.PanicIf(err)
+
+	_, size := sl.encodedOffsets()
+
+	images = make([][]byte, len(mi.Entries)-1)
+	end := 0
+
+	for i := range images {
+		data, err := sl.MpfImage(i + 1)
+		log.PanicIf(err)
+
+		images[i] = data
+
+		me := mi.Entries[i+1]
+		if imageEnd := headerOffset + int(me.Offset) - size + int(me.Size); imageEnd > end {
+			end = imageEnd
+		}
+	}
+
+	return mi, images, sl.trailer[end:], nil
+}
+
+// encodeMpfSegment returns the payload of a new MPF segment with the given
+// entries and no attribute IFD.
+func encodeMpfSegment(entries []MpfEntry) []byte {
+	byteOrder := binary.BigEndian
+
+	b := new(bytes.Buffer)
+	b.Write(mpfPrefix)
+	b.WriteString("MM\000*")
+
+	binary.Write(b, byteOrder, uint32(8))
+
+	// Three tags and the next-IFD offset, and then the entries.
+
+	binary.Write(b, byteOrder, uint16(3))
+
+	binary.Write(b, byteOrder, []uint16{mpfVersionTagId, 7})
+	binary.Write(b, byteOrder, uint32(4))
+	b.WriteString("0100")
+
+	binary.Write(b, byteOrder, []uint16{mpfNumberOfImagesTagId, 4})
+	binary.Write(b, byteOrder, []uint32{1, uint32(len(entries))})
+
+	binary.Write(b, byteOrder, []uint16{mpfEntryTagId, 7})
+	binary.Write(b, byteOrder, []uint32{uint32(len(entries) * mpfEntrySize), 8 + 2 + 3*12 + 4})
+
+	binary.Write(b, byteOrder, uint32(0))
+
+	for _, me := range entries {
+		binary.Write(b, byteOrder, []uint32{me.Attribute, me.Size, me.Offset})
+		binary.Write(b, byteOrder, []uint16{me.DependentImage1, me.DependentImage2})
+	}
+
+	return b.Bytes()
+}
+
+// setMpfEntries returns the payload of the MPF segment with the given
+// entries. They're written over the old ones if they fit, and otherwise after
+// everything else in the segment.
+func setMpfEntries(data []byte, entries []MpfEntry) (updated []byte, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	// This has already been validated.
+	mi, err := ParseMpfSegment(data)
+	log.PanicIf(err)
+
+	byteOrder := mi.ByteOrder
+
+	updated = make([]byte, len(data))
+	copy(updated, data)
+
+	header := updated[len(mpfPrefix):]
+	ifdOffset := int(byteOrder.Uint32(header[4:8]))
+	count := int(byteOrder.Uint16(header[ifdOffset:]))
+
+	size := len(entries) * mpfEntrySize
+	entriesOffset := -1
+
+	for i := 0; i < count; i++ {
+		raw := header[ifdOffset+2+i*12:]
+
+		switch byteOrder.Uint16(raw[0:2]) {
+		case mpfNumberOfImagesTagId:
+			byteOrder.PutUint32(raw[8:12], uint32(len(entries)))
+		case mpfEntryTagId:
+			valueCount := int(byteOrder.Uint32(raw[4:8]))
+
+			if valueCount > 4 && size <= valueCount {
+				entriesOffset = int(byteOrder.Uint32(raw[8:12]))
+			} else {
+				// Offsets are kept even.
+				if len(header)%2 == 1 {
+					updated = append(updated, 0)
+					header = updated[len(mpfPrefix):]
+					raw = header[ifdOffset+2+i*12:]
+				}
+
+				entriesOffset = len(header)
+				byteOrder.PutUint32(raw[8:12], uint32(entriesOffset))
+
+				updated = append(updated, make([]byte, size)...)
+				header = updated[len(mpfPrefix):]
+				raw = header[ifdOffset+2+i*12:]
+			}
+
+			byteOrder.PutUint32(raw[4:8], uint32(size))
+		}
+	}
+
+	if entriesOffset < 0 {
+		log.Panicf("MP entries tag missing")
+	}
+
+	for i, me := range entries {
+		raw := header[entriesOffset+i*mpfEntrySize:]
+
+		byteOrder.PutUint32(raw[0:4], me.Attribute)
+		byteOrder.PutUint32(raw[4:8], me.Size)
+		byteOrder.PutUint32(raw[8:12], me.Offset)
+		byteOrder.PutUint16(raw[12:14], me.DependentImage1)
+		byteOrder.PutUint16(raw[14:16], me.DependentImage2)
+	}
+
+	return updated, nil
+}
+
+// setMpfImages rewrites the MPF index and the trailer so that the given
+// images follow the primary image, with `remainder` after them. `images` has
+// one item for each entry after the first. The sizes and offsets of the
+// entries are recalculated, so this has to be done after any other changes to
+// the segments.
+func (sl *SegmentList) setMpfImages(entries []MpfEntry, images [][]byte, remainder []byte) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if len(entries) != len(images)+1 {
+		log.Panicf("MPF entries not consistent with the images: (%d) != (%d)", len(entries), len(images)+1)
+	}
+
+	_, s, err := sl.FindMpf()
+	log.PanicIf(err)
+
+	entries = append([]MpfEntry{}, entries...)
+
+	// Place the entries first, since that might change the size of the
+	// segment.
+
+	s.Data, err = setMpfEntries(s.Data, entries)
+	log.PanicIf(err)
+
+	headerOffset, err := sl.mpfHeaderOffset()
+	log.PanicIf(err)
+
+	_, size := sl.encodedOffsets()
+
+	entries[0].Size = uint32(size)
+	entries[0].Offset = 0
+
+	trailer := make([]byte, 0)
+	for i, data := range images {
+		entries[i+1].Size = uint32(len(data))
+		entries[i+1].Offset = uint32(size + len(trailer) - headerOffset)
+
+		trailer = append(trailer, data...)
+	}
+
+	trailer = append(trailer, remainder...)
+
+	s.Data, err = setMpfEntries(s.Data, entries)
+	log.PanicIf(err)
+
+	sl.trailer = trailer
+
+	return nil
+}
+
+// dropMpfEntries removes the entries (and images) that match and renumbers
+// the dependent-image references of the rest. References to dropped images
+// are cleared. The primary entry is never dropped.
+func dropMpfEntries(entries []MpfEntry, images [][]byte, matches func(me MpfEntry) bool) (keptEntries []MpfEntry, keptImages [][]byte, dropped []int) {
+	// The one-based image numbers, by their old number.
+	numbers := make([]uint16, len(entries)+1)
+
+	keptEntries = []MpfEntry{entries[0]}
+	keptImages = make([][]byte, 0)
+	dropped = make([]int, 0)
+
+	numbers[1] = 1
+
+	for i := 1; i < len(entries); i++ {
+		if matches(entries[i]) == true {
+			dropped = append(dropped, i)
+			continue
+		}
+
+		keptEntries = append(keptEntries, entries[i])
+		keptImages = append(keptImages, images[i-1])
+
+		numbers[i+1] = uint16(len(keptEntries))
+	}
+
+	renumber := func(number uint16) uint16 {
+		if int(number) >= len(numbers) {
+			return 0
+		}
+
+		return numbers[number]
+	}
+
+	for i := range keptEntries {
+		keptEntries[i].DependentImage1 = renumber(keptEntries[i].DependentImage1)
+		keptEntries[i].DependentImage2 = renumber(keptEntries[i].DependentImage2)
+	}
+
+	return keptEntries, keptImages, dropped
+}
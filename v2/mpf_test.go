@@ -0,0 +1,403 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"encoding/binary"
+
+	"github.com/dsoprea/go-logging"
+)
+
+// getMpfTestSegment returns the payload of an MPF segment with the given
+// entries.
+func getMpfTestSegment(byteOrder binary.ByteOrder, entries []MpfEntry) []byte {
+	b := new(bytes.Buffer)
+	b.Write(mpfPrefix)
+
+	if byteOrder == binary.BigEndian {
+		b.WriteString("MM\000*")
+	} else {
+		b.WriteString("II*\000")
+	}
+
+	binary.Write(b, byteOrder, uint32(8))
+
+	// Three tags, followed by the next-IFD offset and then the entries.
+
+	binary.Write(b, byteOrder, uint16(3))
+
+	binary.Write(b, byteOrder, []uint16{mpfVersionTagId, 7})
+	binary.Write(b, byteOrder, uint32(4))
+	b.WriteString("0100")
+
+	binary.Write(b, byteOrder, []uint16{mpfNumberOfImagesTagId, 4})
+	binary.Write(b, byteOrder, []uint32{1, uint32(len(entries))})
+
+	binary.Write(b, byteOrder, []uint16{mpfEntryTagId, 7})
+	binary.Write(b, byteOrder, []uint32{uint32(len(entries) * mpfEntrySize), 8 + 2 + 3*12 + 4})
+
+	binary.Write(b, byteOrder, uint32(0))
+
+	for _, me := range entries {
+		binary.Write(b, byteOrder, []uint32{me.Attribute, me.Size, me.Offset})
+		binary.Write(b, byteOrder, []uint16{me.DependentImage1, me.DependentImage2})
+	}
+
+	return b.Bytes()
+}
+
+// getMpfTestSegmentList returns the primary image with the given images
+// stored after it, the way that a camera writes them.
+func getMpfTestSegmentList(primary []byte, images [][]byte, types []MpfImageType) *SegmentList {
+	sl := getCoefficientsTestSegmentList(primary)
+
+	entries := make([]MpfEntry, len(images)+1)
+	entries[0].Attribute = uint32(MpfImageTypeBaselinePrimary) | 1<<29
+
+	for i, imageType := range types {
+		entries[i+1].Attribute = uint32(imageType)
+	}
+
+	s := &Segment{
+		MarkerId:   MARKER_APP2,
+		MarkerName: markerNames[MARKER_APP2],
+		Data:       getMpfTestSegment(binary.BigEndian, entries),
+	}
+
+	sl.segments = append([]*Segment{sl.segments[0], s}, sl.segments[1:]...)
+
+	// The size of the segment doesn't depend on the offsets, so we can fill
+	// them in now.
+
+	_, size := sl.encodedOffsets()
+	headerOffset := 2 + 4 + len(mpfPrefix)
+
+	entries[0].Size = uint32(size)
+
+	var trailer []byte
+	for i, data := range images {
+		entries[i+1].Size = uint32(len(data))
+		entries[i+1].Offset = uint32(size + len(trailer) - headerOffset)
+
+		trailer = append(trailer, data...)
+	}
+
+	s.Data = getMpfTestSegment(binary.BigEndian, entries)
+	sl.SetTrailer(trailer)
+
+	return sl
+}
+
+func TestParseMpfSegment(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	entries := []MpfEntry{
+		{
+			Attribute: uint32(MpfImageTypeBaselinePrimary) | 1<<29,
+			Size:      1000,
+		},
+		{
+			Attribute:       uint32(MpfImageTypeLargeThumbnailVga),
+			Size:            200,
+			Offset:          990,
+			DependentImage1: 1,
+		},
+	}
+
+	for _, byteOrder := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		mi, err := ParseMpfSegment(getMpfTestSegment(byteOrder, entries))
+		log.PanicIf(err)
+
+		if mi.Version != "0100" || mi.ByteOrder != byteOrder {
+			t.Fatalf("Index not correct: %s", mi)
+		} else if len(mi.Entries) != 2 || mi.Entries[0] != entries[0] || mi.Entries[1] != entries[1] {
+			t.Fatalf("Entries not correct: %v", mi.Entries)
+		}
+	}
+
+	if entries[0].IsRepresentative() != true || entries[1].IsRepresentative() != false {
+		t.Fatalf("Representative flag not correct.")
+	} else if entries[1].Type() != MpfImageTypeLargeThumbnailVga || entries[1].Type().IsThumbnail() != true {
+		t.Fatalf("Type not correct: [%s]", entries[1].Type())
+	} else if entries[1].String() != "MpfEntry<TYPE=[LargeThumbnailVga] SIZE=(200) OFFSET=(990)>" {
+		t.Fatalf("String not correct: [%s]", entries[1].String())
+	}
+}
+
+func TestParseMpfSegment_Invalid(t *testing.T) {
+	valid := getMpfTestSegment(binary.BigEndian, make([]MpfEntry, 2))
+
+	inconsistent := append([]byte{}, valid...)
+	inconsistent[len(mpfPrefix)+8+2+12+11] = 3
+
+	cases := [][]byte{
+		[]byte("MPX\000MM\000*\000\000\000\010"),
+		[]byte("MPF\000XX\000*\000\000\000\010"),
+		[]byte("MPF\000MM\000*\000\000\001\000"),
+		valid[:len(valid)-20],
+		inconsistent,
+	}
+
+	for i, data := range cases {
+		_, err := ParseMpfSegment(data)
+		if err == nil {
+			t.Fatalf("Expected error for case (%d).", i)
+		}
+	}
+}
+
+func TestMpfImageType_String(t *testing.T) {
+	if MpfImageTypeMultiFrameDisparity.String() != "MultiFrameDisparity" {
+		t.Fatalf("String not correct: [%s]", MpfImageTypeMultiFrameDisparity)
+	} else if MpfImageType(0x040000).String() != "Unknown(0x040000)" {
+		t.Fatalf("Unknown string not correct: [%s]", MpfImageType(0x040000))
+	}
+}
+
+func TestSegmentList_MpfImage(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	images := [][]byte{
+		getTestGeneratedJpeg(16, 8, false),
+		getTestGeneratedJpeg(32, 16, false),
+	}
+
+	types := []MpfImageType{MpfImageTypeLargeThumbnailVga, MpfImageTypeMultiFrameDisparity}
+
+	sl := getMpfTestSegmentList(getTestGeneratedJpeg(64, 32, false), images, types)
+
+	// Make sure that it survives being written.
+
+	sl, data := reparseSegmentList(sl)
+
+	mi, err := sl.Mpf()
+	log.PanicIf(err)
+
+	if int(mi.Entries[0].Size)+len(images[0])+len(images[1]) != len(data) {
+		t.Fatalf("Primary size not correct: (%d)", mi.Entries[0].Size)
+	}
+
+	for i, expected := range images {
+		actual, err := sl.MpfImage(i + 1)
+		log.PanicIf(err)
+
+		if bytes.Equal(actual, expected) != true {
+			t.Fatalf("Image (%d) not correct.", i+1)
+		}
+	}
+
+	for _, i := range []int{0, 3} {
+		_, err := sl.MpfImage(i)
+		if err == nil {
+			t.Fatalf("Expected error for entry (%d).", i)
+		}
+	}
+
+	// The images have to be within the trailer.
+
+	sl.SetTrailer(sl.Trailer()[:len(images[0])+10])
+
+	_, err = sl.MpfImage(2)
+	if err == nil {
+		t.Fatalf("Expected error for truncated trailer.")
+	}
+}
+
+func TestSegmentList_Mpf_Missing(t *testing.T) {
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(16, 16, false))
+
+	_, err := sl.Mpf()
+	if err != ErrNoMpf {
+		t.Fatalf("Expected ErrNoMpf: %v", err)
+	}
+
+	_, err = sl.MpfImage(1)
+	if err != ErrNoMpf {
+		t.Fatalf("Expected ErrNoMpf for image: %v", err)
+	}
+}
+
+func TestSetMpfEntries(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	for _, byteOrder := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		original := getMpfTestSegment(byteOrder, make([]MpfEntry, 2))
+
+		// Fewer entries are written over the old ones.
+
+		fewer := []MpfEntry{
+			{Attribute: uint32(MpfImageTypeBaselinePrimary), Size: 100},
+		}
+
+		updated, err := setMpfEntries(original, fewer)
+		log.PanicIf(err)
+
+		if len(updated) != len(original) {
+			t.Fatalf("Segment size changed: (%d) != (%d)", len(updated), len(original))
+		}
+
+		mi, err := ParseMpfSegment(updated)
+		log.PanicIf(err)
+
+		if reflect.DeepEqual(mi.Entries, fewer) != true {
+			t.Fatalf("Entries not correct: %v", mi.Entries)
+		}
+
+		// More entries are written at the end.
+
+		more := []MpfEntry{
+			{Attribute: uint32(MpfImageTypeBaselinePrimary), Size: 100},
+			{Attribute: uint32(MpfImageTypeLargeThumbnailVga), Size: 20, Offset: 92},
+			{Attribute: uint32(MpfImageTypeMultiFrameDisparity), Size: 30, Offset: 112, DependentImage1: 2},
+		}
+
+		updated, err = setMpfEntries(original, more)
+		log.PanicIf(err)
+
+		if len(updated) != len(original)+3*mpfEntrySize {
+			t.Fatalf("Segment size not correct: (%d)", len(updated))
+		}
+
+		mi, err = ParseMpfSegment(updated)
+		log.PanicIf(err)
+
+		if reflect.DeepEqual(mi.Entries, more) != true {
+			t.Fatalf("Entries not correct: %v", mi.Entries)
+		}
+	}
+}
+
+func TestDropMpfEntries(t *testing.T) {
+	entries := []MpfEntry{
+		{Attribute: uint32(MpfImageTypeBaselinePrimary), DependentImage1: 2, DependentImage2: 4},
+		{Attribute: uint32(MpfImageTypeLargeThumbnailVga)},
+		{Attribute: uint32(MpfImageTypeMultiFrameDisparity), DependentImage1: 2},
+		{Attribute: uint32(MpfImageTypeMultiFrameDisparity), DependentImage1: 3},
+	}
+
+	images := [][]byte{{1}, {2}, {3}}
+
+	keptEntries, keptImages, dropped := dropMpfEntries(entries, images, func(me MpfEntry) bool {
+		return me.Type().IsThumbnail()
+	})
+
+	expectedEntries := []MpfEntry{
+		{Attribute: uint32(MpfImageTypeBaselinePrimary), DependentImage1: 0, DependentImage2: 3},
+		{Attribute: uint32(MpfImageTypeMultiFrameDisparity), DependentImage1: 0},
+		{Attribute: uint32(MpfImageTypeMultiFrameDisparity), DependentImage1: 2},
+	}
+
+	if reflect.DeepEqual(keptEntries, expectedEntries) != true {
+		t.Fatalf("Entries not correct: %v", keptEntries)
+	} else if reflect.DeepEqual(keptImages, [][]byte{{2}, {3}}) != true {
+		t.Fatalf("Images not correct: %v", keptImages)
+	} else if reflect.DeepEqual(dropped, []int{1}) != true {
+		t.Fatalf("Dropped entries not correct: %v", dropped)
+	}
+}
+
+func TestSegmentList_setMpfImages(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	images := [][]byte{
+		getTestGeneratedJpeg(16, 8, false),
+		getTestGeneratedJpeg(32, 16, false),
+	}
+
+	types := []MpfImageType{MpfImageTypeLargeThumbnailVga, MpfImageTypeMultiFrameDisparity}
+
+	sl := getMpfTestSegmentList(getTestGeneratedJpeg(64, 32, false), images, types)
+	sl.SetTrailer(append(sl.Trailer(), "extra"...))
+
+	mi, recoveredImages, remainder, err := sl.mpfImages()
+	log.PanicIf(err)
+
+	if reflect.DeepEqual(recoveredImages, images) != true {
+		t.Fatalf("Images not correct.")
+	} else if string(remainder) != "extra" {
+		t.Fatalf("Remainder not correct: [%s]", remainder)
+	}
+
+	// Add a third image (which moves the entries to the end of the segment)
+	// and change the size of the primary.
+
+	entries := append(mi.Entries, MpfEntry{Attribute: uint32(MpfImageTypeMultiFrameMultiAngle)})
+	images = append(images, getTestGeneratedJpeg(8, 8, true))
+
+	sl.segments = append([]*Segment{sl.segments[0], {MarkerId: MARKER_COM, Data: []byte("comment")}}, sl.segments[1:]...)
+
+	err = sl.setMpfImages(entries, images, remainder)
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	mi, recoveredImages, remainder, err = sl.mpfImages()
+	log.PanicIf(err)
+
+	if len(mi.Entries) != 4 || mi.Entries[3].Type() != MpfImageTypeMultiFrameMultiAngle {
+		t.Fatalf("Entries not correct: %v", mi.Entries)
+	} else if reflect.DeepEqual(recoveredImages, images) != true {
+		t.Fatalf("Images not correct after update.")
+	} else if string(remainder) != "extra" {
+		t.Fatalf("Remainder not correct after update: [%s]", remainder)
+	}
+
+	err = sl.setMpfImages(entries, images[:1], remainder)
+	if err == nil {
+		t.Fatalf("Expected error for inconsistent images.")
+	}
+}
+
+func TestEncodeMpfSegment(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	entries := []MpfEntry{
+		{Attribute: uint32(MpfImageTypeBaselinePrimary), Size: 1000},
+		{Attribute: uint32(MpfImageTypeUndefined), Size: 200, Offset: 990},
+	}
+
+	data := encodeMpfSegment(entries)
+
+	if bytes.Equal(data, getMpfTestSegment(binary.BigEndian, entries)) != true {
+		t.Fatalf("Encoding not correct.")
+	}
+
+	mi, err := ParseMpfSegment(data)
+	log.PanicIf(err)
+
+	if reflect.DeepEqual(mi.Entries, entries) != true {
+		t.Fatalf("Entries not correct: %v", mi.Entries)
+	}
+}
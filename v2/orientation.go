@@ -0,0 +1,337 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+
+	"image/draw"
+	"image/jpeg"
+
+	"github.com/dsoprea/go-exif/v3"
+	"github.com/dsoprea/go-logging"
+)
+
+var (
+	// orientationTransforms maps the EXIF orientations to the transforms that
+	// display the image correctly. The normal orientation (1) needs nothing.
+	orientationTransforms = map[int]TransformType{
+		2: TransformFlipHorizontal,
+		3: TransformRotate180,
+		4: TransformFlipVertical,
+		5: TransformTranspose,
+		6: TransformRotate90,
+		7: TransformTransverse,
+		8: TransformRotate270,
+	}
+)
+
+// OrientationTransform returns the transform that displays an image with the
+// given EXIF orientation correctly, or (0) if the orientation is normal (1) or
+// not valid.
+func OrientationTransform(orientation int) TransformType {
+	return orientationTransforms[orientation]
+}
+
+// Orientation returns the EXIF orientation (1-8). If there is no EXIF or no
+// orientation tag, or the value is not valid, the orientation is normal (1),
+// as it is to most readers.
+func (sl *SegmentList) Orientation() (orientation int, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	rootIfd, _, err := sl.Exif()
+	if err != nil {
+		if log.Is(err, exif.ErrNoExif) == true {
+			return 1, nil
+		}
+
+		log.Panic(err)
+	}
+
+	results, err := rootIfd.FindTagWithId(exifOrientationTagId)
+	if err != nil {
+		if log.Is(err, exif.ErrTagNotFound) == true {
+			return 1, nil
+		}
+
+		log.Panic(err)
+	}
+
+	value, err := results[0].Value()
+	log.PanicIf(err)
+
+	switch v := value.(type) {
+	case []uint16:
+		if len(v) > 0 {
+			orientation = int(v[0])
+		}
+	case []uint32:
+		if len(v) > 0 {
+			orientation = int(v[0])
+		}
+	}
+
+	if orientation < 1 || orientation > 8 {
+		return 1, nil
+	}
+
+	return orientation, nil
+}
+
+// sourcePoint maps a pixel of the transformed image, which has the given
+// dimensions, back to the original image.
+func (tt TransformType) sourcePoint(x, y, width, height int) (sx, sy int) {
+	transposes, mirrorsX, mirrorsY := tt.parameters()
+
+	if mirrorsX == true {
+		x = width - 1 - x
+	}
+
+	if mirrorsY == true {
+		y = height - 1 - y
+	}
+
+	if transposes == true {
+		return y, x
+	}
+
+	return x, y
+}
+
+// transformImage returns a transformed copy of the image. Grayscale images
+// stay grayscale.
+func transformImage(img image.Image, transformType TransformType) image.Image {
+	transposes, _, _ := transformType.parameters()
+
+	bounds := img.Bounds()
+
+	width, height := bounds.Dx(), bounds.Dy()
+	if transposes == true {
+		width, height = height, width
+	}
+
+	r := image.Rect(0, 0, width, height)
+
+	var transformed draw.Image
+
+	switch img.(type) {
+	case *image.Gray:
+		transformed = image.NewGray(r)
+	case *image.Gray16:
+		transformed = image.NewGray16(r)
+	case *image.RGBA64, *image.NRGBA64:
+		transformed = image.NewRGBA64(r)
+	default:
+		transformed = image.NewRGBA(r)
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			sx, sy := transformType.sourcePoint(x, y, width, height)
+			transformed.Set(x, y, img.At(bounds.Min.X+sx, bounds.Min.Y+sy))
+		}
+	}
+
+	return transformed
+}
+
+// OrientedImage decodes the image with `GetImage` and applies the EXIF
+// orientation, so that it's the right way up.
+func (sl *SegmentList) OrientedImage() (img image.Image, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	orientation, err := sl.Orientation()
+	log.PanicIf(err)
+
+	b := new(bytes.Buffer)
+
+	err = sl.Write(b)
+	log.PanicIf(err)
+
+	img, err = NewJpegMediaParser().GetImage(b)
+	log.PanicIf(err)
+
+	if tt := OrientationTransform(orientation); tt != 0 {
+		img = transformImage(img, tt)
+	}
+
+	return img, nil
+}
+
+// NormalizeOrientationOptions controls how `NormalizeOrientation` handles
+// images that can't be transformed losslessly.
+type NormalizeOrientationOptions struct {
+	// Trim drops the partial iMCUs along the edges that would otherwise
+	// prevent a lossless transform (see `TransformOptions`), rather than
+	// re-encoding the image.
+	Trim bool
+
+	// Quality is the quality (1-100) to re-encode with. If zero, it's
+	// estimated from the luminance quantization table of the image.
+	Quality int
+}
+
+// NormalizeOrientationResult describes the outcome of `NormalizeOrientation`.
+type NormalizeOrientationResult struct {
+	// Orientation is the EXIF orientation that the image had.
+	Orientation int
+
+	// Transform is the transform that was applied, or (0) if the orientation
+	// was already normal.
+	Transform TransformType
+
+	// IsLossless is true if the transform was applied to the DCT
+	// coefficients rather than by re-encoding.
+	IsLossless bool
+
+	// Quality is the quality that the image was re-encoded with, if it was.
+	Quality int
+}
+
+// String returns a descriptive string.
+func (nor *NormalizeOrientationResult) String() string {
+	return fmt.Sprintf("NormalizeOrientationResult<ORIENTATION=(%d) TRANSFORM=[%s] LOSSLESS=[%v] QUALITY=(%d)>", nor.Orientation, nor.Transform, nor.IsLossless, nor.Quality)
+}
+
+// NormalizeOrientation applies the EXIF orientation to the image itself and
+// resets the orientation to (1). The transform is done losslessly with
+// `Transform` if every block can be moved (or `Trim` is set), and otherwise the
+// image is decoded, transformed and re-encoded as a baseline image with a
+// quality matching its quantization tables. Re-encoding drops any Adobe
+// segment, and the ICC profile of CMYK images, since the new image is YCbCr
+// (or grayscale) and already converted from CMYK. Either way, every embedded
+// thumbnail is dropped, since it would be in the old orientation, and nothing
+// is changed if there's an error.
+func (sl *SegmentList) NormalizeOrientation(options *NormalizeOrientationOptions) (result *NormalizeOrientationResult, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if options == nil {
+		options = new(NormalizeOrientationOptions)
+	}
+
+	orientation, err := sl.Orientation()
+	log.PanicIf(err)
+
+	result = &NormalizeOrientationResult{
+		Orientation: orientation,
+		Transform:   OrientationTransform(orientation),
+	}
+
+	if result.Transform == 0 {
+		return result, nil
+	}
+
+	var fh *SofSegment
+	var tables []*QuantizationTable
+
+	for _, s := range sl.segments {
+		if isSofMarker(s.MarkerId) == true && fh == nil {
+			fh, err = ParseSofSegment(s.MarkerId, s.Data)
+			log.PanicIf(err)
+		} else if s.MarkerId == MARKER_DQT {
+			parsed, err := ParseQuantizationTables(s.Data)
+			log.PanicIf(err)
+
+			tables = append(tables, parsed...)
+		}
+	}
+
+	if fh == nil {
+		log.Panicf("no frame header")
+	}
+
+	if checkDctFrame(fh) == nil && (options.Trim == true || isPerfectTransform(fh, result.Transform) == true) {
+		to := &TransformOptions{
+			Trim: options.Trim,
+		}
+
+		err := sl.Transform(result.Transform, to)
+		log.PanicIf(err)
+
+		result.IsLossless = true
+
+		return result, nil
+	}
+
+	result.Quality = options.Quality
+	if result.Quality == 0 {
+		// Lossless images have no tables, so keep as much as we can.
+		result.Quality = 100
+
+		for _, qt := range tables {
+			if len(fh.Components) > 0 && qt.Id == fh.Components[0].QuantizationTableId {
+				result.Quality = qt.EstimateQuality()
+			}
+		}
+	}
+
+	img, err := sl.OrientedImage()
+	log.PanicIf(err)
+
+	b := new(bytes.Buffer)
+
+	err = jpeg.Encode(b, img, &jpeg.Options{Quality: result.Quality})
+	log.PanicIf(err)
+
+	intfc, err := NewJpegMediaParser().ParseBytes(b.Bytes())
+	log.PanicIf(err)
+
+	tableSegments := make([]*Segment, 0)
+	var scanData []byte
+
+	for _, s := range intfc.(*SegmentList).segments {
+		if isImageDataSegment(s.MarkerId) == true {
+			tableSegments = append(tableSegments, s)
+		} else if s.MarkerId == 0 {
+			scanData = s.Data
+		}
+	}
+
+	// Update the metadata first, on a copy, so that nothing is changed if it
+	// fails.
+
+	work := sl.clone()
+
+	bounds := img.Bounds()
+
+	err = work.updateExifGeometry(bounds.Dx(), bounds.Dy(), true)
+	log.PanicIf(err)
+
+	err = work.dropThumbnails()
+	log.PanicIf(err)
+
+	err = work.replaceImageData(tableSegments, scanData)
+	log.PanicIf(err)
+
+	segments := make([]*Segment, 0, len(work.segments))
+	for _, s := range work.segments {
+		if s.IsAdobe() == true || (s.IsIccProfile() == true && len(fh.Components) == 4) {
+			continue
+		}
+
+		segments = append(segments, s)
+	}
+
+	work.segments = segments
+
+	transposes, _, _ := result.Transform.parameters()
+	if transposes == true {
+		work.swapJfifDensity()
+	}
+
+	*sl = *work
+
+	return result, nil
+}
@@ -0,0 +1,509 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"image"
+	"testing"
+
+	"image/jpeg"
+
+	"github.com/dsoprea/go-exif/v3"
+	"github.com/dsoprea/go-logging"
+)
+
+// getOrientationTestSegmentList returns the image with the given EXIF
+// orientation.
+func getOrientationTestSegmentList(data []byte, orientation int) *SegmentList {
+	sl := getCoefficientsTestSegmentList(data)
+
+	rootIb, err := sl.ConstructExifBuilder()
+	log.PanicIf(err)
+
+	err = rootIb.AddStandardWithName("Orientation", []uint16{uint16(orientation)})
+	log.PanicIf(err)
+
+	err = sl.SetExif(rootIb)
+	log.PanicIf(err)
+
+	return sl
+}
+
+// checkOrientationReset makes sure that the orientation is now normal.
+func checkOrientationReset(t *testing.T, sl *SegmentList) {
+	orientation, err := sl.Orientation()
+	log.PanicIf(err)
+
+	if orientation != 1 {
+		t.Fatalf("Orientation not reset: (%d)", orientation)
+	}
+
+	rootIfd, _, err := sl.Exif()
+	log.PanicIf(err)
+
+	_, err = rootIfd.FindTagWithId(exifOrientationTagId)
+	log.PanicIf(err)
+}
+
+func TestOrientationTransform(t *testing.T) {
+	expected := []TransformType{
+		0,
+		0,
+		TransformFlipHorizontal,
+		TransformRotate180,
+		TransformFlipVertical,
+		TransformTranspose,
+		TransformRotate90,
+		TransformTransverse,
+		TransformRotate270,
+		0,
+	}
+
+	for orientation, tt := range expected {
+		if OrientationTransform(orientation) != tt {
+			t.Fatalf("Transform for orientation (%d) not correct: [%s]", orientation, OrientationTransform(orientation))
+		}
+	}
+}
+
+func TestSegmentList_Orientation(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	original := getTestGeneratedJpeg(16, 16, false)
+
+	orientation, err := getCoefficientsTestSegmentList(original).Orientation()
+	log.PanicIf(err)
+
+	if orientation != 1 {
+		t.Fatalf("Orientation without EXIF not correct: (%d)", orientation)
+	}
+
+	expected := map[int]int{
+		6: 6,
+		8: 8,
+		0: 1,
+		9: 1,
+	}
+
+	for stored, expectedOrientation := range expected {
+		sl := getOrientationTestSegmentList(original, stored)
+
+		orientation, err := sl.Orientation()
+		log.PanicIf(err)
+
+		if orientation != expectedOrientation {
+			t.Fatalf("Orientation (%d) not correct: (%d)", stored, orientation)
+		}
+	}
+}
+
+func TestTransformType_sourcePoint(t *testing.T) {
+	for tt := TransformFlipHorizontal; tt <= TransformRotate270; tt++ {
+		width, height := 7, 5
+		if transposes, _, _ := tt.parameters(); transposes == true {
+			width, height = height, width
+		}
+
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				sx, sy := tt.sourcePoint(x, y, width, height)
+				ex, ey := transformTestPoint(tt, x, y, 7, 5)
+
+				if sx != ex || sy != ey {
+					t.Fatalf("Point (%d, %d) for [%s] not correct: (%d, %d) != (%d, %d)", x, y, tt, sx, sy, ex, ey)
+				}
+			}
+		}
+	}
+}
+
+func TestSegmentList_OrientedImage(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	for _, isGray := range []bool{false, true} {
+		original := getTestGeneratedJpeg(61, 45, isGray)
+
+		originalImage, err := jpeg.Decode(bytes.NewReader(original))
+		log.PanicIf(err)
+
+		for orientation := 1; orientation <= 8; orientation++ {
+			sl := getOrientationTestSegmentList(original, orientation)
+
+			img, err := sl.OrientedImage()
+			log.PanicIf(err)
+
+			tt := OrientationTransform(orientation)
+			if tt == 0 {
+				checkImagesSimilar(t, img, originalImage, 0)
+				continue
+			}
+
+			expectedBounds := image.Rect(0, 0, 61, 45)
+			if transposes, _, _ := tt.parameters(); transposes == true {
+				expectedBounds = image.Rect(0, 0, 45, 61)
+			}
+
+			if img.Bounds() != expectedBounds {
+				t.Fatalf("Bounds for orientation (%d) not correct: %v", orientation, img.Bounds())
+			}
+
+			if _, ok := img.(*image.Gray); ok != isGray {
+				t.Fatalf("Image type for orientation (%d) not correct: %T", orientation, img)
+			}
+
+			checkTransformedPixels(t, tt, originalImage, img, 0)
+		}
+	}
+}
+
+func TestSegmentList_NormalizeOrientation_Lossless(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	original := getTestGeneratedJpeg(64, 48, false)
+
+	originalImage, err := jpeg.Decode(bytes.NewReader(original))
+	log.PanicIf(err)
+
+	for orientation := 2; orientation <= 8; orientation++ {
+		sl := getOrientationTestSegmentList(original, orientation)
+
+		result, err := sl.NormalizeOrientation(nil)
+		log.PanicIf(err)
+
+		tt := OrientationTransform(orientation)
+		if result.Orientation != orientation || result.Transform != tt || result.IsLossless != true || result.Quality != 0 {
+			t.Fatalf("Result not correct: %s", result)
+		}
+
+		sl, data := reparseSegmentList(sl)
+
+		checkOrientationReset(t, sl)
+		checkTransformedImage(t, tt, originalImage, data)
+	}
+}
+
+func TestSegmentList_NormalizeOrientation_Normal(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	original := getTestGeneratedJpeg(61, 45, false)
+	sl := getCoefficientsTestSegmentList(original)
+
+	result, err := sl.NormalizeOrientation(nil)
+	log.PanicIf(err)
+
+	if result.Orientation != 1 || result.Transform != 0 || result.IsLossless != false {
+		t.Fatalf("Result not correct: %s", result)
+	}
+
+	_, data := reparseSegmentList(sl)
+
+	if bytes.Equal(data, original) != true {
+		t.Fatalf("Image changed.")
+	}
+}
+
+func TestSegmentList_NormalizeOrientation_Reencode(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	original := getTestGeneratedJpeg(61, 45, true)
+
+	for orientation := 2; orientation <= 8; orientation++ {
+		sl := getOrientationTestSegmentList(original, orientation)
+
+		orientedImage, err := sl.OrientedImage()
+		log.PanicIf(err)
+
+		result, err := sl.NormalizeOrientation(nil)
+		log.PanicIf(err)
+
+		// A transpose doesn't mirror anything, so it's always lossless. The
+		// test image is encoded with a quality of 90.
+		if result.Transform == TransformTranspose {
+			if result.IsLossless != true {
+				t.Fatalf("Expected lossless transpose: %s", result)
+			}
+
+			continue
+		} else if result.IsLossless != false || result.Quality != 90 {
+			t.Fatalf("Result not correct: %s", result)
+		}
+
+		sl, data := reparseSegmentList(sl)
+
+		checkOrientationReset(t, sl)
+
+		transformedImage, err := jpeg.Decode(bytes.NewReader(data))
+		log.PanicIf(err)
+
+		if _, ok := transformedImage.(*image.Gray); ok != true {
+			t.Fatalf("Re-encoded image not grayscale: %T", transformedImage)
+		}
+
+		// The oriented image is what was encoded.
+
+		b := new(bytes.Buffer)
+
+		err = jpeg.Encode(b, orientedImage, &jpeg.Options{Quality: 90})
+		log.PanicIf(err)
+
+		expectedImage, err := jpeg.Decode(b)
+		log.PanicIf(err)
+
+		checkImagesSimilar(t, transformedImage, expectedImage, 0)
+	}
+}
+
+func TestSegmentList_NormalizeOrientation_Options(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	original := getTestGeneratedJpeg(61, 45, false)
+
+	// Trimming keeps it lossless.
+
+	sl := getOrientationTestSegmentList(original, 6)
+
+	options := &NormalizeOrientationOptions{
+		Trim: true,
+	}
+
+	result, err := sl.NormalizeOrientation(options)
+	log.PanicIf(err)
+
+	if result.IsLossless != true {
+		t.Fatalf("Expected lossless transform: %s", result)
+	}
+
+	sl, _ = reparseSegmentList(sl)
+
+	coefficients, err := sl.ReadCoefficients()
+	log.PanicIf(err)
+
+	if coefficients.Frame.Width != 32 || coefficients.Frame.Height != 61 {
+		t.Fatalf("Trimmed dimensions not correct: (%d)x(%d)", coefficients.Frame.Width, coefficients.Frame.Height)
+	}
+
+	// The quality can be given.
+
+	sl = getOrientationTestSegmentList(original, 6)
+
+	options = &NormalizeOrientationOptions{
+		Quality: 60,
+	}
+
+	result, err = sl.NormalizeOrientation(options)
+	log.PanicIf(err)
+
+	if result.IsLossless != false || result.Quality != 60 {
+		t.Fatalf("Result not correct: %s", result)
+	}
+
+	sl, _ = reparseSegmentList(sl)
+
+	coefficients, err = sl.ReadCoefficients()
+	log.PanicIf(err)
+
+	if coefficients.Frame.Width != 45 || coefficients.Frame.Height != 61 {
+		t.Fatalf("Dimensions not correct: (%d)x(%d)", coefficients.Frame.Width, coefficients.Frame.Height)
+	} else if coefficients.QuantizationTables[0].EstimateQuality() != 60 {
+		t.Fatalf("Re-encoded quality not correct: (%d)", coefficients.QuantizationTables[0].EstimateQuality())
+	}
+}
+
+func TestSegmentList_NormalizeOrientation_LosslessProcess(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	lti := &losslessTestImage{
+		frame:     getLosslessTestFrame(24, 16, 8, 1, 1),
+		predictor: 1,
+	}
+
+	original := checkLosslessRoundTrip(t, lti)
+
+	originalImage, err := original.DecodeImage(nil)
+	log.PanicIf(err)
+
+	_, data := reparseSegmentList(original)
+
+	sl := getOrientationTestSegmentList(data, 6)
+
+	// A grayscale image doesn't depend on the Adobe segment, but it should
+	// still be dropped.
+	adobe := &Segment{
+		MarkerId:   MARKER_APP14,
+		MarkerName: markerNames[MARKER_APP14],
+		Data:       (&AdobeSegment{Version: 100, ColorTransform: AdobeColorTransformNone}).Encode(),
+	}
+
+	sl.segments = append([]*Segment{sl.segments[0], adobe}, sl.segments[1:]...)
+
+	result, err := sl.NormalizeOrientation(nil)
+	log.PanicIf(err)
+
+	// There are no quantization tables to go by.
+	if result.IsLossless != false || result.Quality != 100 {
+		t.Fatalf("Result not correct: %s", result)
+	}
+
+	sl, data = reparseSegmentList(sl)
+
+	if _, _, err := sl.FindAdobe(); err != ErrNoAdobe {
+		t.Fatalf("Adobe segment not dropped.")
+	}
+
+	transformedImage, err := jpeg.Decode(bytes.NewReader(data))
+	log.PanicIf(err)
+
+	checkTransformedPixels(t, TransformRotate90, originalImage, transformedImage, 2)
+}
+
+func TestSegmentList_NormalizeOrientation_Thumbnails(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	// The first is transformed losslessly and the second is re-encoded.
+
+	reencoded := getOrientationTestSegmentList(getTestGeneratedJpeg(61, 45, true), 6)
+
+	err := reencoded.SetExifThumbnail(getThumbnailTestJpeg(getTestGeneratedImage(16, 12, true)))
+	log.PanicIf(err)
+
+	lists := []*SegmentList{
+		getSanitizeTestSegmentList(),
+		reencoded,
+	}
+
+	for i, sl := range lists {
+		result, err := sl.NormalizeOrientation(nil)
+		log.PanicIf(err)
+
+		if result.IsLossless != (i == 0) {
+			t.Fatalf("Result not correct: %s", result)
+		}
+
+		sl, _ = reparseSegmentList(sl)
+
+		checkOrientationReset(t, sl)
+
+		// They'd be in the old orientation.
+
+		thumbnails, err := sl.Thumbnails()
+		log.PanicIf(err)
+
+		if len(thumbnails) != 0 {
+			t.Fatalf("Thumbnails not dropped: %v", thumbnails)
+		}
+
+		_, _, err = sl.ExifThumbnail()
+		if log.Is(err, exif.ErrNoThumbnail) == false {
+			t.Fatalf("Expected no EXIF thumbnail: %v", err)
+		}
+	}
+}
+
+func TestSegmentList_NormalizeOrientation_ExifNotRebuildable(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	// Put the EXIF of the Fuji image, which can't be rebuilt, on an image that
+	// has to be re-encoded, with the orientation set to (6).
+
+	fuji, _ := getFujiTestSegmentList()
+
+	_, s, err := fuji.FindExif()
+	log.PanicIf(err)
+
+	data := append([]byte{}, s.Data...)
+
+	entry := []byte{0x12, 0x01, 0x03, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00}
+
+	i := bytes.Index(data, entry)
+	if i == -1 {
+		t.Fatalf("Orientation entry not found.")
+	}
+
+	data[i+8] = 6
+
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(61, 45, true))
+
+	exifSegment := &Segment{
+		MarkerId:   MARKER_APP1,
+		MarkerName: markerNames[MARKER_APP1],
+		Data:       data,
+	}
+
+	sl.segments = append([]*Segment{sl.segments[0], exifSegment}, sl.segments[1:]...)
+
+	b := new(bytes.Buffer)
+
+	err = sl.Write(b)
+	log.PanicIf(err)
+
+	original := b.Bytes()
+
+	_, err = sl.NormalizeOrientation(nil)
+	if err == nil {
+		t.Fatalf("Expected error for EXIF that can't be rebuilt.")
+	}
+
+	// Nothing was changed, so the image still matches the orientation.
+
+	b = new(bytes.Buffer)
+
+	err = sl.Write(b)
+	log.PanicIf(err)
+
+	if bytes.Equal(b.Bytes(), original) != true {
+		t.Fatalf("Image was changed by the failed normalization.")
+	}
+}
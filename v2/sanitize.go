@@ -0,0 +1,916 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"encoding/binary"
+
+	"github.com/dsoprea/go-exif/v3"
+	"github.com/dsoprea/go-exif/v3/common"
+	"github.com/dsoprea/go-logging"
+)
+
+const (
+	exifOrientationTagId = uint16(0x0112)
+
+	photoshopOldThumbnailResourceId = uint16(0x0409)
+	photoshopIccProfileResourceId   = uint16(0x040f)
+	photoshopExifData1ResourceId    = uint16(0x0422)
+	photoshopExifData3ResourceId    = uint16(0x0423)
+	photoshopXmpResourceId          = uint16(0x0424)
+	photoshopIptcDigestResourceId   = uint16(0x0425)
+
+	// iptcTagMarker starts every IPTC IIM dataset.
+	iptcTagMarker = 0x1c
+)
+
+// SanitizeContainer is the kind of metadata that something was removed from.
+type SanitizeContainer string
+
+const (
+	// SanitizeContainerExif is the EXIF segment.
+	SanitizeContainerExif SanitizeContainer = "EXIF"
+
+	// SanitizeContainerXmp is the XMP segment and the extended-XMP segments.
+	SanitizeContainerXmp SanitizeContainer = "XMP"
+
+	// SanitizeContainerIptc is the IPTC data in the Photoshop segment.
+	SanitizeContainerIptc SanitizeContainer = "IPTC"
+
+	// SanitizeContainerPhotoshop is the rest of the Photoshop segment.
+	SanitizeContainerPhotoshop SanitizeContainer = "Photoshop"
+
+	// SanitizeContainerJfif is the JFIF segment and its extensions.
+	SanitizeContainerJfif SanitizeContainer = "JFIF"
+
+	// SanitizeContainerIcc is the ICC profile.
+	SanitizeContainerIcc SanitizeContainer = "ICC"
+
+	// SanitizeContainerMpf is the MPF index and the images it describes.
+	SanitizeContainerMpf SanitizeContainer = "MPF"
+
+	// SanitizeContainerComment is the COM segments.
+	SanitizeContainerComment SanitizeContainer = "COM"
+
+	// SanitizeContainerSegment is any other APPn segment.
+	SanitizeContainerSegment SanitizeContainer = "Segment"
+
+	// SanitizeContainerTrailer is the data after the EOI marker.
+	SanitizeContainerTrailer SanitizeContainer = "Trailer"
+
+	// SanitizeContainerSef is the Samsung (SEF) trailer.
+	SanitizeContainerSef SanitizeContainer = "SEF"
+)
+
+// SanitizePolicy describes what `Sanitize` removes. Everything not mentioned
+// is kept.
+type SanitizePolicy struct {
+	// DropExif drops the EXIF segment.
+	DropExif bool
+
+	// KeepOrientation keeps the orientation tag when `DropExif` is set (or
+	// the EXIF has to be dropped because it can't be filtered), so that the
+	// image is still shown the right way up.
+	KeepOrientation bool
+
+	// DropXmp drops the XMP segment and any extended XMP.
+	DropXmp bool
+
+	// DropIptc drops the IPTC data.
+	DropIptc bool
+
+	// DropIccProfile drops the ICC profile.
+	DropIccProfile bool
+
+	// DropGps drops the GPS IFD and the GPS XMP properties.
+	DropGps bool
+
+	// DropSerialNumbers drops the camera and lens serial numbers.
+	DropSerialNumbers bool
+
+	// DropOwnerNames drops the camera owner, the artist, and the creator.
+	DropOwnerNames bool
+
+	// DropMakerNotes drops the EXIF maker notes.
+	DropMakerNotes bool
+
+	// DropXmpHistory drops the XMP editing history and the documents that
+	// this one was derived from.
+	DropXmpHistory bool
+
+	// DropIptcContact drops the contact fields of the IPTC data and of the
+	// IPTC XMP properties.
+	DropIptcContact bool
+
+	// DropComments drops the COM segments.
+	DropComments bool
+
+	// DropTrailer drops everything after the EOI marker, along with the MPF
+	// index that describes any images stored there.
+	DropTrailer bool
+
+	// DropEditData drops the edit data and the copies of the original image
+	// that Samsung devices keep in the SEF trailer, which would reveal what
+	// was edited. The rest of the trailer is kept.
+	DropEditData bool
+
+	// DropThumbnails drops every embedded thumbnail (EXIF, JFIF, JFXX,
+	// Photoshop, XMP, and MPF).
+	DropThumbnails bool
+
+	// DropUnknownSegments drops every APPn segment other than JFIF, EXIF,
+	// XMP, ICC, MPF, Photoshop, and Adobe.
+	DropUnknownSegments bool
+
+	// isMpfKept leaves the MPF index and its images alone, for when they
+	// can't be located.
+	isMpfKept bool
+}
+
+// StrictSanitizePolicy returns the policy for images that are to be published:
+// the color profile and the orientation are kept, and everything that might
+// identify a person, a place, or a device is dropped.
+func StrictSanitizePolicy() *SanitizePolicy {
+	return &SanitizePolicy{
+		KeepOrientation:     true,
+		DropGps:             true,
+		DropSerialNumbers:   true,
+		DropOwnerNames:      true,
+		DropMakerNotes:      true,
+		DropXmpHistory:      true,
+		DropIptcContact:     true,
+		DropComments:        true,
+		DropTrailer:         true,
+		DropEditData:        true,
+		DropThumbnails:      true,
+		DropUnknownSegments: true,
+	}
+}
+
+// isExifFiltered returns true if tags might be removed from the EXIF.
+func (sp *SanitizePolicy) isExifFiltered() bool {
+	return sp.DropGps || sp.DropSerialNumbers || sp.DropOwnerNames || sp.DropMakerNotes || sp.DropThumbnails
+}
+
+// isXmpFiltered returns true if properties might be removed from the XMP.
+func (sp *SanitizePolicy) isXmpFiltered() bool {
+	return sp.DropGps || sp.DropSerialNumbers || sp.DropOwnerNames || sp.DropXmpHistory || sp.DropIptcContact || sp.DropThumbnails
+}
+
+// SanitizeRemoval is one thing that was removed.
+type SanitizeRemoval struct {
+	// Container is where it was removed from.
+	Container SanitizeContainer
+
+	// Item describes what was removed.
+	Item string
+}
+
+// String returns a descriptive string.
+func (sr SanitizeRemoval) String() string {
+	return fmt.Sprintf("%s: %s", sr.Container, sr.Item)
+}
+
+// SanitizeReport is what `Sanitize` removed, in the order that it was found.
+type SanitizeReport struct {
+	Removals []SanitizeRemoval
+
+	// ExifRebuildError is why the EXIF couldn't be rebuilt to filter it, if
+	// it couldn't. The whole EXIF segment is dropped instead (keeping just the
+	// orientation if the policy says to).
+	ExifRebuildError error
+}
+
+func (sr *SanitizeReport) add(container SanitizeContainer, format string, args ...interface{}) {
+	sr.Removals = append(sr.Removals, SanitizeRemoval{
+		Container: container,
+		Item:      fmt.Sprintf(format, args...),
+	})
+}
+
+// String returns a descriptive string.
+func (sr *SanitizeReport) String() string {
+	return fmt.Sprintf("SanitizeReport<REMOVALS=(%d)>", len(sr.Removals))
+}
+
+// exifSanitizeRule is a tag that's removed from any IFD that has it.
+type exifSanitizeRule struct {
+	tagId uint16
+	name  string
+}
+
+// exifSanitizeRules returns the tags that the policy removes.
+func (sp *SanitizePolicy) exifSanitizeRules() (rules []exifSanitizeRule) {
+	rules = make([]exifSanitizeRule, 0)
+
+	if sp.DropGps == true {
+		rules = append(rules, exifSanitizeRule{exifGpsIfdTagId, "GPSTag"})
+	}
+
+	if sp.DropSerialNumbers == true {
+		rules = append(rules,
+			exifSanitizeRule{0xa431, "BodySerialNumber"},
+			exifSanitizeRule{0xa435, "LensSerialNumber"},
+			exifSanitizeRule{0xc62f, "CameraSerialNumber"})
+	}
+
+	if sp.DropOwnerNames == true {
+		rules = append(rules,
+			exifSanitizeRule{0xa430, "CameraOwnerName"},
+			exifSanitizeRule{0x013b, "Artist"},
+			exifSanitizeRule{0x9c9d, "XPAuthor"})
+	}
+
+	if sp.DropMakerNotes == true {
+		rules = append(rules, exifSanitizeRule{0x927c, "MakerNote"})
+	}
+
+	return rules
+}
+
+// nextExifIfdPath returns the path of the next sibling ("IFD" is followed by
+// "IFD1").
+func nextExifIfdPath(path string) string {
+	index := 0
+	fmt.Sscanf(strings.TrimPrefix(path, "IFD"), "%d", &index)
+
+	return fmt.Sprintf("IFD%d", index+1)
+}
+
+// sanitizeExifIfd removes the tags from the IFD, its children, and its
+// siblings. It returns true if anything was removed. The path is tracked here
+// since the builders of the siblings share the identity of the first.
+func sanitizeExifIfd(ib *exif.IfdBuilder, path string, rules []exifSanitizeRule, report *SanitizeReport) (isChanged bool, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	for _, rule := range rules {
+		n, err := ib.DeleteAll(rule.tagId)
+		log.PanicIf(err)
+
+		if n > 0 {
+			report.add(SanitizeContainerExif, "%s %s", path, rule.name)
+			isChanged = true
+		}
+	}
+
+	for _, bt := range ib.Tags() {
+		if bt.Value().IsIb() == false {
+			continue
+		}
+
+		childIb := bt.Value().Ib()
+
+		isChildChanged, err := sanitizeExifIfd(childIb, path+"/"+childIb.IfdIdentity().Name(), rules, report)
+		log.PanicIf(err)
+
+		isChanged = isChanged || isChildChanged
+	}
+
+	nextIb, err := ib.NextIb()
+	log.PanicIf(err)
+
+	if nextIb != nil {
+		isNextChanged, err := sanitizeExifIfd(nextIb, nextExifIfdPath(path), rules, report)
+		log.PanicIf(err)
+
+		isChanged = isChanged || isNextChanged
+	}
+
+	return isChanged, nil
+}
+
+func (sl *SegmentList) sanitizeExif(policy *SanitizePolicy, report *SanitizeReport) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	rootIfd, _, err := sl.Exif()
+	if err != nil {
+		if log.Is(err, exif.ErrNoExif) == true {
+			return nil
+		}
+
+		log.Panic(err)
+	}
+
+	if policy.DropExif == true {
+		err := sl.dropSanitizedExif(rootIfd, policy, report)
+		log.PanicIf(err)
+
+		return nil
+	} else if policy.isExifFiltered() == false {
+		return nil
+	}
+
+	rootIb, err := sl.ConstructExifBuilder()
+	if err != nil {
+		// Some EXIF can't be rebuilt (e.g. if it has an undefined-type tag
+		// that doesn't parse). Rather than leave the tags that should have
+		// been removed, drop all of it.
+		report.ExifRebuildError = err
+
+		err := sl.dropSanitizedExif(rootIfd, policy, report)
+		log.PanicIf(err)
+
+		return nil
+	}
+
+	isChanged, err := sanitizeExifIfd(rootIb, "IFD", policy.exifSanitizeRules(), report)
+	log.PanicIf(err)
+
+	if policy.DropThumbnails == true {
+		nextIb, err := rootIb.NextIb()
+		log.PanicIf(err)
+
+		// The second IFD only exists to describe the thumbnail.
+		if nextIb != nil {
+			err = rootIb.SetNextIb(nil)
+			log.PanicIf(err)
+
+			report.add(SanitizeContainerExif, "IFD1 thumbnail")
+			isChanged = true
+		}
+	}
+
+	if isChanged == true {
+		err = sl.SetExif(rootIb)
+		log.PanicIf(err)
+	}
+
+	return nil
+}
+
+// dropSanitizedExif drops the EXIF segment, replacing it with one that has
+// only the orientation if the policy keeps that.
+func (sl *SegmentList) dropSanitizedExif(rootIfd *exif.Ifd, policy *SanitizePolicy, report *SanitizeReport) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	var orientationIb *exif.IfdBuilder
+
+	if policy.KeepOrientation == true {
+		_, err := rootIfd.FindTagWithId(exifOrientationTagId)
+		if err == nil {
+			im := exifcommon.NewIfdMapping()
+
+			err := exifcommon.LoadStandardIfds(im)
+			log.PanicIf(err)
+
+			ti := exif.NewTagIndex()
+
+			orientationIb = exif.NewIfdBuilder(im, ti, exifcommon.IfdStandardIfdIdentity, rootIfd.ByteOrder())
+
+			err = orientationIb.AddTagsFromExisting(rootIfd, []uint16{exifOrientationTagId}, nil)
+			log.PanicIf(err)
+		} else if log.Is(err, exif.ErrTagNotFound) == false {
+			log.Panic(err)
+		}
+	}
+
+	_, err = sl.DropExif()
+	log.PanicIf(err)
+
+	if orientationIb == nil {
+		report.add(SanitizeContainerExif, "all tags")
+	} else {
+		report.add(SanitizeContainerExif, "all tags except Orientation")
+
+		err = sl.SetExif(orientationIb)
+		log.PanicIf(err)
+	}
+
+	return nil
+}
+
+// xmpSanitizeMatcher returns a function that's true for the XMP properties
+// that the policy removes.
+func (sp *SanitizePolicy) xmpSanitizeMatcher() func(namespace, local string) bool {
+	return func(namespace, local string) bool {
+		switch namespace {
+		case xmpNamespaceExif:
+			return sp.DropGps == true && strings.HasPrefix(local, "GPS") == true
+		case xmpNamespaceExifEx:
+			switch local {
+			case "BodySerialNumber", "LensSerialNumber":
+				return sp.DropSerialNumbers
+			case "CameraOwnerName":
+				return sp.DropOwnerNames
+			}
+		case xmpNamespaceAux:
+			switch local {
+			case "SerialNumber", "LensSerialNumber":
+				return sp.DropSerialNumbers
+			case "OwnerName":
+				return sp.DropOwnerNames
+			}
+		case xmpNamespaceDc:
+			return sp.DropOwnerNames == true && local == "creator"
+		case xmpNamespaceXmpMm:
+			switch local {
+			case "History", "DerivedFrom", "Ingredients", "Pantry":
+				return sp.DropXmpHistory
+			}
+		case xmpNamespacePhotoshop:
+			switch local {
+			case "DocumentAncestors":
+				return sp.DropXmpHistory
+			case "AuthorsPosition":
+				return sp.DropIptcContact
+			}
+		case xmpNamespaceIptc4xmpCore:
+			return sp.DropIptcContact == true && local == "CreatorContactInfo"
+		case xmpNamespaceXmp:
+			return sp.DropThumbnails == true && local == "Thumbnails"
+		case xmpNamespaceXmpNote:
+			// The extended XMP is always dropped when the XMP is filtered, so
+			// the reference to it has to go, too.
+			return local == "HasExtendedXMP"
+		}
+
+		return false
+	}
+}
+
+// sanitizeXmp removes properties from the XMP segment. It returns true if
+// anything was removed.
+func sanitizeXmp(s *Segment, policy *SanitizePolicy, report *SanitizeReport) (isChanged bool, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	xd, err := parseXmpDocument(s.Data[len(xmpPrefix):])
+	log.PanicIf(err)
+
+	removed := xd.removeProperties(policy.xmpSanitizeMatcher())
+	if len(removed) == 0 {
+		return false, nil
+	}
+
+	for _, name := range removed {
+		report.add(SanitizeContainerXmp, "%s", name)
+	}
+
+	s.Data = append(append([]byte{}, xmpPrefix...), xd.encode()...)
+
+	return true, nil
+}
+
+// iptcDatasetNames has the names of the datasets that might be removed.
+var iptcDatasetNames = map[[2]byte]string{
+	{2, 80}:  "By-line",
+	{2, 85}:  "By-line Title",
+	{2, 118}: "Contact",
+	{2, 122}: "Writer/Editor",
+}
+
+// iptcSanitizeMatcher returns a function that's true for the IPTC datasets
+// that the policy removes.
+func (sp *SanitizePolicy) iptcSanitizeMatcher() func(record, dataset byte) bool {
+	return func(record, dataset byte) bool {
+		if record != 2 {
+			return false
+		}
+
+		switch dataset {
+		case 80:
+			return sp.DropOwnerNames
+		case 85, 118, 122:
+			return sp.DropIptcContact
+		}
+
+		return false
+	}
+}
+
+// filterIptcDatasets returns the IPTC IIM stream without the datasets that
+// match, along with the record and dataset numbers of those that were
+// removed. Anything after the last dataset (usually padding) is kept.
+func filterIptcDatasets(data []byte, matches func(record, dataset byte) bool) (filtered []byte, removed [][2]byte, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	filtered = make([]byte, 0, len(data))
+	removed = make([][2]byte, 0)
+
+	i := 0
+	for i < len(data) && data[i] == iptcTagMarker {
+		if i+5 > len(data) {
+			log.Panicf("IPTC dataset header truncated")
+		}
+
+		record := data[i+1]
+		dataset := data[i+2]
+		size := int(binary.BigEndian.Uint16(data[i+3:]))
+		headerSize := 5
+
+		// The high bit means that the size is itself stored in the given
+		// number of bytes.
+		if size&0x8000 != 0 {
+			sizeSize := size & 0x7fff
+			if sizeSize > 4 || i+5+sizeSize > len(data) {
+				log.Panicf("IPTC extended dataset size not valid: (%d)", sizeSize)
+			}
+
+			size = 0
+			for _, c := range data[i+5 : i+5+sizeSize] {
+				size = size<<8 | int(c)
+			}
+
+			headerSize += sizeSize
+		}
+
+		end := i + headerSize + size
+		if end > len(data) || end < i {
+			log.Panicf("IPTC dataset (%d:%d) truncated", record, dataset)
+		}
+
+		if matches(record, dataset) == true {
+			removed = append(removed, [2]byte{record, dataset})
+		} else {
+			filtered = append(filtered, data[i:end]...)
+		}
+
+		i = end
+	}
+
+	filtered = append(filtered, data[i:]...)
+
+	return filtered, removed, nil
+}
+
+// photoshopResource is one image resource of a Photoshop segment.
+type photoshopResource struct {
+	// Signature is usually "8BIM".
+	Signature []byte
+
+	Id uint16
+
+	// Name is the Pascal string, including the length and the padding.
+	Name []byte
+
+	Data []byte
+}
+
+// parsePhotoshopResources parses the image resources of a Photoshop segment
+// (after the prefix), in the order that they're stored.
+func parsePhotoshopResources(data []byte) (resources []photoshopResource, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	resources = make([]photoshopResource, 0)
+
+	i := 0
+	for i < len(data) {
+		if i+7 > len(data) {
+			log.Panicf("Photoshop resource header truncated")
+		}
+
+		pr := photoshopResource{
+			Signature: data[i : i+4],
+			Id:        binary.BigEndian.Uint16(data[i+4:]),
+		}
+
+		// The name, with its length, is padded to an even size.
+		nameSize := 1 + int(data[i+6])
+		if nameSize%2 == 1 {
+			nameSize++
+		}
+
+		if i+6+nameSize+4 > len(data) {
+			log.Panicf("Photoshop resource (0x%04x) name truncated", pr.Id)
+		}
+
+		pr.Name = data[i+6 : i+6+nameSize]
+
+		dataOffset := i + 6 + nameSize + 4
+		size := int(binary.BigEndian.Uint32(data[dataOffset-4:]))
+
+		if dataOffset+size > len(data) || dataOffset+size < dataOffset {
+			log.Panicf("Photoshop resource (0x%04x) data truncated", pr.Id)
+		}
+
+		pr.Data = data[dataOffset : dataOffset+size]
+		resources = append(resources, pr)
+
+		// The data is padded to an even size, too.
+		i = dataOffset + size + size%2
+	}
+
+	return resources, nil
+}
+
+// encodePhotoshopResources encodes the image resources of a Photoshop segment
+// (without the prefix).
+func encodePhotoshopResources(resources []photoshopResource) []byte {
+	b := new(bytes.Buffer)
+
+	for _, pr := range resources {
+		b.Write(pr.Signature)
+		binary.Write(b, binary.BigEndian, pr.Id)
+		b.Write(pr.Name)
+		binary.Write(b, binary.BigEndian, uint32(len(pr.Data)))
+		b.Write(pr.Data)
+
+		if len(pr.Data)%2 == 1 {
+			b.WriteByte(0)
+		}
+	}
+
+	return b.Bytes()
+}
+
+// sanitizePhotoshop removes resources from the Photoshop segment, and
+// datasets from the IPTC data in it. It returns true if anything was removed
+// and whether anything is left.
+func sanitizePhotoshop(s *Segment, policy *SanitizePolicy, report *SanitizeReport) (isChanged, isEmpty bool, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	resources, err := parsePhotoshopResources(s.Data[len(ps30Prefix):])
+	log.PanicIf(err)
+
+	isIptcChanged := false
+	kept := make([]photoshopResource, 0, len(resources))
+
+	for _, pr := range resources {
+		switch pr.Id {
+		case photoshopThumbnailResourceId, photoshopOldThumbnailResourceId:
+			if policy.DropThumbnails == true {
+				report.add(SanitizeContainerPhotoshop, "thumbnail (0x%04X)", pr.Id)
+				continue
+			}
+		case pirIptcImageResourceId:
+			if policy.DropIptc == true {
+				report.add(SanitizeContainerIptc, "all datasets")
+				isIptcChanged = true
+
+				continue
+			}
+
+			filtered, removed, err := filterIptcDatasets(pr.Data, policy.iptcSanitizeMatcher())
+			log.PanicIf(err)
+
+			if len(removed) > 0 {
+				for _, key := range removed {
+					report.add(SanitizeContainerIptc, "%d:%d (%s)", key[0], key[1], iptcDatasetNames[key])
+				}
+
+				pr.Data = filtered
+				isIptcChanged = true
+			}
+		case photoshopIccProfileResourceId:
+			if policy.DropIccProfile == true {
+				report.add(SanitizeContainerPhotoshop, "ICC profile (0x%04X)", pr.Id)
+				continue
+			}
+		case photoshopExifData1ResourceId, photoshopExifData3ResourceId:
+			// These are copies of the EXIF, which would otherwise keep what
+			// was removed from it.
+			if policy.DropExif == true || policy.isExifFiltered() == true {
+				report.add(SanitizeContainerPhotoshop, "EXIF copy (0x%04X)", pr.Id)
+				continue
+			}
+		case photoshopXmpResourceId:
+			if policy.DropXmp == true || policy.isXmpFiltered() == true {
+				report.add(SanitizeContainerPhotoshop, "XMP copy (0x%04X)", pr.Id)
+				continue
+			}
+		}
+
+		kept = append(kept, pr)
+	}
+
+	// The digest won't match anymore. The resources before it have already
+	// been processed, so it's removed in a second pass.
+	if isIptcChanged == true {
+		withoutDigest := kept[:0]
+		for _, pr := range kept {
+			if pr.Id == photoshopIptcDigestResourceId {
+				report.add(SanitizeContainerPhotoshop, "IPTC digest (0x%04X)", pr.Id)
+				continue
+			}
+
+			withoutDigest = append(withoutDigest, pr)
+		}
+
+		kept = withoutDigest
+	}
+
+	if len(kept) == len(resources) && isIptcChanged == false {
+		return false, false, nil
+	}
+
+	s.Data = append(append([]byte{}, ps30Prefix...), encodePhotoshopResources(kept)...)
+
+	// Forget what was parsed before.
+	s.photoshopInfo = nil
+	s.iptcTags = nil
+
+	return true, len(kept) == 0, nil
+}
+
+// segmentIdentifier returns the printable prefix of the payload, which is
+// usually what identifies the kind of APPn segment.
+func segmentIdentifier(s *Segment) string {
+	b := new(strings.Builder)
+
+	for i, c := range s.Data {
+		if i >= 32 || c < 0x20 || c > 0x7e {
+			break
+		}
+
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
+
+// isKnownApplicationSegment returns true for the APPn segments that
+// `Sanitize` understands.
+func isKnownApplicationSegment(s *Segment) bool {
+	switch s.MarkerId {
+	case MARKER_APP0:
+		return bytes.HasPrefix(s.Data, jfifPrefix) == true || bytes.HasPrefix(s.Data, jfxxPrefix) == true
+	case MARKER_APP1:
+		return s.IsExif() == true || s.IsXmp() == true || bytes.HasPrefix(s.Data, xmpExtensionPrefix) == true
+	case MARKER_APP2:
+		return s.IsIccProfile() == true || s.IsMpf() == true
+	case MARKER_APP13:
+		return bytes.HasPrefix(s.Data, ps30Prefix) == true
+	case MARKER_APP14:
+		return s.IsAdobe() == true
+	}
+
+	return false
+}
+
+// Sanitize removes metadata according to the policy and returns what was
+// removed. EXIF, XMP, IPTC, and the Photoshop resources are filtered rather
+// than dropped wholesale, unless the policy says otherwise. EXIF that can't be
+// rebuilt is dropped wholesale instead (see `SanitizeReport.ExifRebuildError`).
+// Extended XMP is dropped whenever the XMP is filtered, since it can have the
+// same properties. Any MPF images that are kept are rewritten so that their
+// offsets account for the change in size. The SEF directory is rewritten the
+// same way when entries are dropped from it.
+func (sl *SegmentList) Sanitize(policy *SanitizePolicy) (report *SanitizeReport, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	report = &SanitizeReport{
+		Removals: make([]SanitizeRemoval, 0),
+	}
+
+	// The MPF offsets depend on the size of everything before the trailer,
+	// so the images are collected before anything changes.
+
+	var mi *MpfIndex
+	var mpfImages [][]byte
+	var remainder []byte
+
+	if policy.DropTrailer == false && policy.isMpfKept == false {
+		mi, mpfImages, remainder, err = sl.mpfImages()
+		if err != nil && err != ErrNoMpf {
+			log.Panic(err)
+		}
+	}
+
+	err = sl.sanitizeExif(policy, report)
+	log.PanicIf(err)
+
+	isIccDropped := false
+	kept := make([]*Segment, 0, len(sl.segments))
+
+	for _, s := range sl.segments {
+		isApplication := s.MarkerId >= MARKER_APP0 && s.MarkerId <= MARKER_APP15
+
+		if s.MarkerId == MARKER_COM {
+			if policy.DropComments == true {
+				report.add(SanitizeContainerComment, "(%d) bytes", len(s.Data))
+				continue
+			}
+		} else if isApplication == true && isKnownApplicationSegment(s) == false {
+			if policy.DropUnknownSegments == true {
+				report.add(SanitizeContainerSegment, "APP%d [%s]", s.MarkerId-MARKER_APP0, segmentIdentifier(s))
+				continue
+			}
+		} else if bytes.HasPrefix(s.Data, jfifPrefix) == true && s.MarkerId == MARKER_APP0 {
+			if policy.DropThumbnails == true && len(s.Data) >= jfifThumbnailOffset+2 && (s.Data[jfifThumbnailOffset] != 0 || s.Data[jfifThumbnailOffset+1] != 0) {
+				// Keep everything up to the dimensions, which are left as
+				// zero.
+				data := make([]byte, jfifThumbnailOffset+2)
+				copy(data, s.Data[:jfifThumbnailOffset])
+
+				s.Data = data
+
+				report.add(SanitizeContainerJfif, "thumbnail")
+			}
+		} else if bytes.HasPrefix(s.Data, jfxxPrefix) == true && s.MarkerId == MARKER_APP0 {
+			if policy.DropThumbnails == true {
+				report.add(SanitizeContainerJfif, "JFXX thumbnail")
+				continue
+			}
+		} else if s.IsXmp() == true {
+			if policy.DropXmp == true {
+				report.add(SanitizeContainerXmp, "all properties")
+				continue
+			} else if policy.isXmpFiltered() == true {
+				_, err := sanitizeXmp(s, policy, report)
+				log.PanicIf(err)
+			}
+		} else if bytes.HasPrefix(s.Data, xmpExtensionPrefix) == true && s.MarkerId == MARKER_APP1 {
+			if policy.DropXmp == true || policy.isXmpFiltered() == true {
+				report.add(SanitizeContainerXmp, "extended XMP (%d) bytes", len(s.Data))
+				continue
+			}
+		} else if s.IsIccProfile() == true {
+			if policy.DropIccProfile == true {
+				if isIccDropped == false {
+					report.add(SanitizeContainerIcc, "profile")
+					isIccDropped = true
+				}
+
+				continue
+			}
+		} else if s.IsMpf() == true {
+			if policy.DropTrailer == true {
+				report.add(SanitizeContainerMpf, "index")
+				continue
+			}
+		} else if bytes.HasPrefix(s.Data, ps30Prefix) == true && s.MarkerId == MARKER_APP13 {
+			_, isEmpty, err := sanitizePhotoshop(s, policy, report)
+			log.PanicIf(err)
+
+			if isEmpty == true {
+				continue
+			}
+		}
+
+		kept = append(kept, s)
+	}
+
+	sl.segments = kept
+
+	if policy.DropTrailer == true {
+		if len(sl.trailer) > 0 {
+			report.add(SanitizeContainerTrailer, "(%d) bytes", len(sl.trailer))
+			sl.trailer = nil
+		}
+	} else if mi != nil {
+		entries := mi.Entries
+
+		if policy.DropThumbnails == true {
+			var dropped []int
+
+			entries, mpfImages, dropped = dropMpfEntries(entries, mpfImages, func(me MpfEntry) bool {
+				return me.Type().IsThumbnail()
+			})
+
+			for _, i := range dropped {
+				report.add(SanitizeContainerMpf, "image (%d) [%s]", i, mi.Entries[i].Type())
+			}
+		}
+
+		err = sl.setMpfImages(entries, mpfImages, remainder)
+		log.PanicIf(err)
+	}
+
+	if policy.DropTrailer == false && policy.DropEditData == true {
+		dropped, err := sl.DropSefEntries(func(se SefEntry) bool {
+			kind := se.Kind()
+			return kind == SefEntryKindEditData || kind == SefEntryKindOriginalImage
+		})
+
+		log.PanicIf(err)
+
+		for _, se := range dropped {
+			report.add(SanitizeContainerSef, "entry [%s]", se.Name)
+		}
+	}
+
+	return report, nil
+}
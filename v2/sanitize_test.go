@@ -0,0 +1,672 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"encoding/binary"
+
+	"github.com/dsoprea/go-exif/v3"
+	"github.com/dsoprea/go-exif/v3/undefined"
+	"github.com/dsoprea/go-logging"
+)
+
+const (
+	sanitizeTestXmpPacket = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:exif="http://ns.adobe.com/exif/1.0/"
+    xmlns:aux="http://ns.adobe.com/exif/1.0/aux/"
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:tiff="http://ns.adobe.com/tiff/1.0/"
+    xmlns:xmpMM="http://ns.adobe.com/xap/1.0/mm/"
+    xmlns:xmpNote="http://ns.adobe.com/xmp/note/"
+    xmlns:Iptc4xmpCore="http://iptc.org/std/Iptc4xmpCore/1.0/xmlns/"
+    exif:GPSLatitude="12,34.5N"
+    aux:SerialNumber="12345"
+    tiff:Orientation="6"
+    xmpNote:HasExtendedXMP="0123456789ABCDEF0123456789ABCDEF">
+   <dc:creator><rdf:Seq><rdf:li>Someone</rdf:li></rdf:Seq></dc:creator>
+   <xmpMM:History><rdf:Seq><rdf:li>saved</rdf:li></rdf:Seq></xmpMM:History>
+   <xmpMM:DocumentID>abc</xmpMM:DocumentID>
+   <Iptc4xmpCore:CreatorContactInfo rdf:parseType="Resource"/>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`
+)
+
+// getSanitizeTestIptc returns an IPTC stream with the record version, a
+// by-line, a contact, and a caption.
+func getSanitizeTestIptc() []byte {
+	b := new(bytes.Buffer)
+
+	b.Write([]byte{iptcTagMarker, 2, 0, 0, 2, 0, 4})
+
+	b.Write([]byte{iptcTagMarker, 2, 80, 0, 7})
+	b.WriteString("Someone")
+
+	b.Write([]byte{iptcTagMarker, 2, 118, 0, 5})
+	b.WriteString("phone")
+
+	b.Write([]byte{iptcTagMarker, 2, 120, 0, 7})
+	b.WriteString("Caption")
+
+	return b.Bytes()
+}
+
+func getSanitizeTestPhotoshopSegment(resources []photoshopResource) *Segment {
+	return &Segment{
+		MarkerId:   MARKER_APP13,
+		MarkerName: markerNames[MARKER_APP13],
+		Data:       append(append([]byte{}, ps30Prefix...), encodePhotoshopResources(resources)...),
+	}
+}
+
+// getSanitizeTestSegmentList returns an image with a bit of everything.
+func getSanitizeTestSegmentList() *SegmentList {
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(64, 48, false))
+
+	thumbnail := getThumbnailTestImage(8, 6, false)
+
+	resources := []photoshopResource{
+		{Signature: []byte("8BIM"), Id: pirIptcImageResourceId, Name: []byte{0, 0}, Data: getSanitizeTestIptc()},
+		{Signature: []byte("8BIM"), Id: photoshopIptcDigestResourceId, Name: []byte{0, 0}, Data: make([]byte, 16)},
+		{Signature: []byte("8BIM"), Id: 0x03ed, Name: []byte{0, 0}, Data: make([]byte, 16)},
+	}
+
+	photoshopSegment := getSanitizeTestPhotoshopSegment(resources)
+
+	thumbnailResources, err := parsePhotoshopResources(getPhotoshopThumbnailTestSegment(photoshopThumbnailFormatJpeg, getThumbnailTestJpeg(thumbnail)).Data[len(ps30Prefix):])
+	log.PanicIf(err)
+
+	photoshopSegment.Data = append(photoshopSegment.Data, encodePhotoshopResources(thumbnailResources)...)
+
+	segments := []*Segment{
+		sl.segments[0],
+		getApp0ThumbnailTestSegment(jfifPrefix, -1, thumbnail),
+		getApp0ThumbnailTestSegment(jfxxPrefix, jfxxExtensionRgb, thumbnail),
+		{
+			MarkerId:   MARKER_APP1,
+			MarkerName: markerNames[MARKER_APP1],
+			Data:       append(append([]byte{}, xmpPrefix...), sanitizeTestXmpPacket...),
+		},
+		{
+			MarkerId:   MARKER_APP1,
+			MarkerName: markerNames[MARKER_APP1],
+			Data:       append(append([]byte{}, xmpExtensionPrefix...), "0123456789ABCDEF0123456789ABCDEF"...),
+		},
+	}
+
+	segments = append(segments, getIccTestSegments(getIccTestProfile(0x02100000, "RGB ", "XYZ ", map[string][]byte{"desc": []byte("abc")}), 100)...)
+
+	segments = append(segments,
+		photoshopSegment,
+		&Segment{
+			MarkerId:   MARKER_COM,
+			MarkerName: markerNames[MARKER_COM],
+			Data:       []byte("taken at home"),
+		},
+		&Segment{
+			MarkerId: 0xeb,
+			Data:     []byte("JP\000\001private"),
+		})
+
+	sl.segments = append(segments, sl.segments[1:]...)
+
+	rootIb, err := sl.ConstructExifBuilder()
+	log.PanicIf(err)
+
+	err = rootIb.AddStandardWithName("Orientation", []uint16{6})
+	log.PanicIf(err)
+
+	err = rootIb.AddStandardWithName("Artist", "Someone")
+	log.PanicIf(err)
+
+	exifIb, err := exif.GetOrCreateIbFromRootIb(rootIb, "IFD/Exif")
+	log.PanicIf(err)
+
+	err = exifIb.AddStandardWithName("BodySerialNumber", "12345")
+	log.PanicIf(err)
+
+	err = exifIb.AddStandardWithName("MakerNote", exifundefined.Tag927CMakerNote{MakerNoteBytes: []byte("private")})
+	log.PanicIf(err)
+
+	gpsIb, err := exif.GetOrCreateIbFromRootIb(rootIb, "IFD/GPSInfo")
+	log.PanicIf(err)
+
+	err = gpsIb.AddStandardWithName("GPSVersionID", []byte{2, 2, 0, 0})
+	log.PanicIf(err)
+
+	err = sl.SetExif(rootIb)
+	log.PanicIf(err)
+
+	err = sl.SetExifThumbnail(getThumbnailTestJpeg(thumbnail))
+	log.PanicIf(err)
+
+	sl.SetTrailer([]byte("private trailer"))
+
+	sl, _ = reparseSegmentList(sl)
+
+	return sl
+}
+
+func TestStrictSanitizePolicy(t *testing.T) {
+	policy := StrictSanitizePolicy()
+
+	if policy.DropIccProfile == true || policy.DropExif == true || policy.KeepOrientation != true {
+		t.Fatalf("Color profile and orientation not kept.")
+	} else if policy.DropGps != true || policy.DropThumbnails != true || policy.DropTrailer != true || policy.DropEditData != true || policy.DropUnknownSegments != true {
+		t.Fatalf("Policy not strict.")
+	}
+}
+
+func TestSegmentList_Sanitize_Strict(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getSanitizeTestSegmentList()
+
+	thumbnails, err := sl.Thumbnails()
+	log.PanicIf(err)
+
+	if len(thumbnails) != 4 {
+		t.Fatalf("Expected four thumbnails to start with: (%d)", len(thumbnails))
+	}
+
+	report, err := sl.Sanitize(StrictSanitizePolicy())
+	log.PanicIf(err)
+
+	actual := make([]string, len(report.Removals))
+	for i, sr := range report.Removals {
+		actual[i] = sr.String()
+	}
+
+	expected := []string{
+		"EXIF: IFD GPSTag",
+		"EXIF: IFD Artist",
+		"EXIF: IFD/Exif BodySerialNumber",
+		"EXIF: IFD/Exif MakerNote",
+		"EXIF: IFD1 thumbnail",
+		"JFIF: thumbnail",
+		"JFIF: JFXX thumbnail",
+		"XMP: exif:GPSLatitude",
+		"XMP: aux:SerialNumber",
+		"XMP: xmpNote:HasExtendedXMP",
+		"XMP: dc:creator",
+		"XMP: xmpMM:History",
+		"XMP: Iptc4xmpCore:CreatorContactInfo",
+		"XMP: extended XMP (67) bytes",
+		"IPTC: 2:80 (By-line)",
+		"IPTC: 2:118 (Contact)",
+		"Photoshop: thumbnail (0x040C)",
+		"Photoshop: IPTC digest (0x0425)",
+		"COM: (13) bytes",
+		"Segment: APP11 [JP]",
+		"Trailer: (15) bytes",
+	}
+
+	if reflect.DeepEqual(actual, expected) != true {
+		for _, line := range actual {
+			t.Logf("%s", line)
+		}
+
+		t.Fatalf("Report not correct.")
+	}
+
+	sl, _ = reparseSegmentList(sl)
+
+	// Everything that was reported is gone.
+
+	thumbnails, err = sl.Thumbnails()
+	log.PanicIf(err)
+
+	if len(thumbnails) != 0 {
+		t.Fatalf("Thumbnails not dropped: %v", thumbnails)
+	}
+
+	rootIfd, _, err := sl.Exif()
+	log.PanicIf(err)
+
+	for _, tagName := range []string{"Artist", "GPSTag"} {
+		if _, err := rootIfd.FindTagWithName(tagName); err == nil {
+			t.Fatalf("Tag not dropped: [%s]", tagName)
+		}
+	}
+
+	if results, err := rootIfd.FindTagWithName("Orientation"); err != nil || len(results) != 1 {
+		t.Fatalf("Orientation not kept.")
+	}
+
+	exifIfd, err := exif.FindIfdFromRootIfd(rootIfd, "IFD/Exif")
+	log.PanicIf(err)
+
+	if len(exifIfd.Entries()) != 0 {
+		t.Fatalf("Exif IFD not empty: (%d)", len(exifIfd.Entries()))
+	}
+
+	_, s, err := sl.FindXmp()
+	log.PanicIf(err)
+
+	xmp := string(s.Data[len(xmpPrefix):])
+	if strings.Contains(xmp, "GPSLatitude") == true || strings.Contains(xmp, "Someone") == true || strings.Contains(xmp, "saved") == true {
+		t.Fatalf("XMP not sanitized:\n%s", xmp)
+	} else if strings.Contains(xmp, "tiff:Orientation=\"6\"") == false || strings.Contains(xmp, "<xmpMM:DocumentID>abc</xmpMM:DocumentID>") == false {
+		t.Fatalf("XMP not kept:\n%s", xmp)
+	}
+
+	tags, err := sl.Iptc()
+	log.PanicIf(err)
+
+	if len(tags) != 2 {
+		t.Fatalf("IPTC datasets not correct: %v", tags)
+	}
+
+	iccCount := 0
+	for _, s := range sl.segments {
+		if s.MarkerId == MARKER_COM || s.MarkerId == 0xeb || bytes.HasPrefix(s.Data, xmpExtensionPrefix) == true {
+			t.Fatalf("Segment not dropped: %s", s)
+		} else if s.IsIccProfile() == true {
+			iccCount++
+		}
+	}
+
+	if iccCount == 0 {
+		t.Fatalf("ICC profile not kept.")
+	} else if len(sl.Trailer()) != 0 {
+		t.Fatalf("Trailer not dropped.")
+	}
+
+	// Sanitizing again finds nothing else.
+
+	report, err = sl.Sanitize(StrictSanitizePolicy())
+	log.PanicIf(err)
+
+	if len(report.Removals) != 0 {
+		t.Fatalf("Expected nothing more to be removed: %v", report.Removals)
+	}
+}
+
+func TestSegmentList_Sanitize_DropAll(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getSanitizeTestSegmentList()
+
+	policy := &SanitizePolicy{
+		DropExif:        true,
+		KeepOrientation: true,
+		DropXmp:         true,
+		DropIptc:        true,
+		DropIccProfile:  true,
+	}
+
+	report, err := sl.Sanitize(policy)
+	log.PanicIf(err)
+
+	actual := make([]string, len(report.Removals))
+	for i, sr := range report.Removals {
+		actual[i] = sr.String()
+	}
+
+	expected := []string{
+		"EXIF: all tags except Orientation",
+		"XMP: all properties",
+		"XMP: extended XMP (67) bytes",
+		"ICC: profile",
+		"IPTC: all datasets",
+		"Photoshop: IPTC digest (0x0425)",
+	}
+
+	if reflect.DeepEqual(actual, expected) != true {
+		for _, line := range actual {
+			t.Logf("%s", line)
+		}
+
+		t.Fatalf("Report not correct.")
+	}
+
+	sl, _ = reparseSegmentList(sl)
+
+	rootIfd, _, err := sl.Exif()
+	log.PanicIf(err)
+
+	entries := rootIfd.Entries()
+	if len(entries) != 1 || entries[0].TagId() != exifOrientationTagId {
+		t.Fatalf("Expected only the orientation to be kept: %v", entries)
+	}
+
+	value, err := entries[0].Value()
+	log.PanicIf(err)
+
+	if reflect.DeepEqual(value, []uint16{6}) != true {
+		t.Fatalf("Orientation not correct: %v", value)
+	}
+
+	if _, _, err := sl.FindXmp(); err != ErrNoXmp {
+		t.Fatalf("XMP not dropped.")
+	} else if _, _, err := sl.FindIptc(); err != ErrNoIptc {
+		t.Fatalf("IPTC not dropped.")
+	}
+
+	for _, s := range sl.segments {
+		if s.IsIccProfile() == true {
+			t.Fatalf("ICC profile not dropped.")
+		}
+	}
+
+	// What wasn't in the policy is still there.
+
+	if len(sl.Trailer()) == 0 {
+		t.Fatalf("Trailer dropped.")
+	}
+
+	thumbnails, err := sl.Thumbnails()
+	log.PanicIf(err)
+
+	if len(thumbnails) != 3 {
+		t.Fatalf("Expected the JFIF, JFXX, and Photoshop thumbnails to be kept: (%d)", len(thumbnails))
+	}
+}
+
+func TestSegmentList_Sanitize_Mpf(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	// Put a comment in the primary image, so that removing it moves
+	// everything after it.
+
+	primarySl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(64, 48, false))
+
+	comment := &Segment{
+		MarkerId:   MARKER_COM,
+		MarkerName: markerNames[MARKER_COM],
+		Data:       []byte("a comment"),
+	}
+
+	primarySl.segments = append([]*Segment{primarySl.segments[0], comment}, primarySl.segments[1:]...)
+
+	b := new(bytes.Buffer)
+
+	err := primarySl.Write(b)
+	log.PanicIf(err)
+
+	thumbnailJpeg := getThumbnailTestJpeg(getThumbnailTestImage(16, 12, false))
+	disparityJpeg := getTestGeneratedJpeg(64, 48, true)
+
+	sl := getMpfTestSegmentList(b.Bytes(), [][]byte{thumbnailJpeg, disparityJpeg}, []MpfImageType{MpfImageTypeLargeThumbnailVga, MpfImageTypeMultiFrameDisparity})
+	sl.SetTrailer(append(sl.Trailer(), "remainder"...))
+
+	policy := &SanitizePolicy{
+		DropComments:   true,
+		DropThumbnails: true,
+	}
+
+	report, err := sl.Sanitize(policy)
+	log.PanicIf(err)
+
+	expected := []SanitizeRemoval{
+		{SanitizeContainerComment, "(9) bytes"},
+		{SanitizeContainerMpf, "image (1) [LargeThumbnailVga]"},
+	}
+
+	if reflect.DeepEqual(report.Removals, expected) != true {
+		t.Fatalf("Report not correct: %v", report.Removals)
+	}
+
+	sl, _ = reparseSegmentList(sl)
+
+	mi, err := sl.Mpf()
+	log.PanicIf(err)
+
+	if len(mi.Entries) != 2 || mi.Entries[1].Type() != MpfImageTypeMultiFrameDisparity {
+		t.Fatalf("MPF entries not correct: %v", mi.Entries)
+	}
+
+	_, size := sl.encodedOffsets()
+	if mi.Entries[0].Size != uint32(size) {
+		t.Fatalf("Primary size not correct: (%d) != (%d)", mi.Entries[0].Size, size)
+	}
+
+	data, err := sl.MpfImage(1)
+	log.PanicIf(err)
+
+	if bytes.Equal(data, disparityJpeg) != true {
+		t.Fatalf("MPF image not correct.")
+	} else if bytes.HasSuffix(sl.Trailer(), []byte("remainder")) != true || len(sl.Trailer()) != len(disparityJpeg)+len("remainder") {
+		t.Fatalf("Trailer not correct.")
+	}
+}
+
+func TestSegmentList_Sanitize_DropEditData(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl, video := getSefTestSegmentList()
+
+	policy := &SanitizePolicy{
+		DropEditData: true,
+	}
+
+	report, err := sl.Sanitize(policy)
+	log.PanicIf(err)
+
+	expected := []SanitizeRemoval{
+		{SanitizeContainerSef, "entry [Original_Image]"},
+		{SanitizeContainerSef, "entry [Photo_Editor_Re_Edit_Data]"},
+	}
+
+	if reflect.DeepEqual(report.Removals, expected) != true {
+		t.Fatalf("Report not correct: %v", report.Removals)
+	}
+
+	sl, _ = reparseSegmentList(sl)
+
+	st, err := sl.SefTrailer()
+	log.PanicIf(err)
+
+	if len(st.Entries) != 2 || st.Entries[0].Kind() != SefEntryKindTimestamp || st.Entries[1].Kind() != SefEntryKindVideo {
+		t.Fatalf("SEF entries not correct: %v", st.Entries)
+	}
+
+	mp, err := sl.MotionPhoto()
+	log.PanicIf(err)
+
+	if bytes.Equal(mp.Video, video) != true {
+		t.Fatalf("Video not kept.")
+	}
+
+	// Without the policy, nothing is dropped.
+
+	sl, _ = getSefTestSegmentList()
+
+	report, err = sl.Sanitize(&SanitizePolicy{})
+	log.PanicIf(err)
+
+	if len(report.Removals) != 0 {
+		t.Fatalf("Expected nothing to be removed: %v", report.Removals)
+	}
+}
+
+func TestFilterIptcDatasets(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	data := getSanitizeTestIptc()
+
+	// An extended dataset (the size is in the two bytes that follow), and
+	// then padding.
+
+	extended := []byte{iptcTagMarker, 2, 118, 0x80, 2, 0, 3, 'a', 'b', 'c'}
+	data = append(data, extended...)
+	data = append(data, 0, 0)
+
+	filtered, removed, err := filterIptcDatasets(data, func(record, dataset byte) bool {
+		return record == 2 && dataset == 118
+	})
+
+	log.PanicIf(err)
+
+	if reflect.DeepEqual(removed, [][2]byte{{2, 118}, {2, 118}}) != true {
+		t.Fatalf("Removed datasets not correct: %v", removed)
+	}
+
+	expected := getSanitizeTestIptc()
+	expected = append(expected[:7+12], expected[7+12+10:]...)
+	expected = append(expected, 0, 0)
+
+	if bytes.Equal(filtered, expected) != true {
+		t.Fatalf("Filtered data not correct:\n%v\n%v", filtered, expected)
+	}
+
+	_, _, err = filterIptcDatasets(data[:len(data)-4], func(record, dataset byte) bool {
+		return false
+	})
+
+	if err == nil {
+		t.Fatalf("Expected error for truncated dataset.")
+	}
+}
+
+func TestParsePhotoshopResources(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	// An odd-sized resource with a name, followed by the thumbnail.
+
+	b := new(bytes.Buffer)
+	b.WriteString("8BIM")
+	binary.Write(b, binary.BigEndian, uint16(0x0404))
+	b.Write([]byte{4, 'n', 'a', 'm', 'e', 0})
+	binary.Write(b, binary.BigEndian, uint32(3))
+	b.Write([]byte{1, 2, 3, 0})
+
+	thumbnailSegment := getPhotoshopThumbnailTestSegment(photoshopThumbnailFormatJpeg, []byte{1, 2, 3, 4, 5})
+	b.Write(thumbnailSegment.Data[len(ps30Prefix):])
+
+	data := b.Bytes()
+
+	resources, err := parsePhotoshopResources(data)
+	log.PanicIf(err)
+
+	if len(resources) != 2 {
+		t.Fatalf("Resource count not correct: (%d)", len(resources))
+	} else if resources[0].Id != 0x0404 || string(resources[0].Name) != "\004name\000" || bytes.Equal(resources[0].Data, []byte{1, 2, 3}) != true {
+		t.Fatalf("First resource not correct: %v", resources[0])
+	} else if resources[1].Id != photoshopThumbnailResourceId || len(resources[1].Data) != photoshopThumbnailHeaderSize+5 {
+		t.Fatalf("Second resource not correct: %v", resources[1])
+	}
+
+	if bytes.Equal(encodePhotoshopResources(resources), data) != true {
+		t.Fatalf("Encoded resources not correct.")
+	}
+
+	_, err = parsePhotoshopResources(data[:len(data)-8])
+	if err == nil {
+		t.Fatalf("Expected error for truncated resource.")
+	}
+}
+
+func TestSegmentList_Sanitize_ExifNotRebuildable(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl, _ := getFujiTestSegmentList()
+
+	if _, err := sl.ConstructExifBuilder(); err == nil {
+		t.Fatalf("Test image should have EXIF that can't be rebuilt.")
+	}
+
+	orientation, err := sl.Orientation()
+	log.PanicIf(err)
+
+	report, err := sl.Sanitize(StrictSanitizePolicy())
+	log.PanicIf(err)
+
+	if report.ExifRebuildError == nil {
+		t.Fatalf("Expected the rebuild error to be reported.")
+	}
+
+	found := false
+	for _, sr := range report.Removals {
+		if sr.Container == SanitizeContainerExif && sr.Item == "all tags except Orientation" {
+			found = true
+		}
+	}
+
+	if found != true {
+		t.Fatalf("Expected the EXIF to be dropped: %v", report.Removals)
+	}
+
+	sl, _ = reparseSegmentList(sl)
+
+	// Only the orientation is left.
+
+	rootIfd, _, err := sl.Exif()
+	log.PanicIf(err)
+
+	if len(rootIfd.Entries()) != 1 || rootIfd.NextIfd() != nil {
+		t.Fatalf("Expected only the orientation: %v", rootIfd.Entries())
+	}
+
+	sanitizedOrientation, err := sl.Orientation()
+	log.PanicIf(err)
+
+	if sanitizedOrientation != orientation {
+		t.Fatalf("Orientation not correct: (%d) != (%d)", sanitizedOrientation, orientation)
+	}
+
+	// The policy without the orientation.
+
+	sl, _ = getFujiTestSegmentList()
+
+	policy := StrictSanitizePolicy()
+	policy.KeepOrientation = false
+
+	report, err = sl.Sanitize(policy)
+	log.PanicIf(err)
+
+	if report.ExifRebuildError == nil {
+		t.Fatalf("Expected the rebuild error to be reported without the orientation.")
+	}
+
+	if _, _, err := sl.FindExif(); log.Is(err, exif.ErrNoExif) == false {
+		t.Fatalf("Expected no EXIF: %v", err)
+	}
+}
@@ -0,0 +1,269 @@
+package jpegstructure
+
+import (
+	"fmt"
+
+	"github.com/dsoprea/go-logging"
+)
+
+// Scan-data finding codes (see `ValidationFinding`).
+const (
+	FindingUnsupportedCoding     = "unsupported-coding"
+	FindingInvalidScan           = "invalid-scan"
+	FindingEntropyCorrupt        = "entropy-corrupt"
+	FindingEntropyTruncated      = "entropy-truncated"
+	FindingExtraEntropyData      = "extra-entropy-data"
+	FindingIncompleteCoefficient = "incomplete-coefficients"
+)
+
+// ScanSummary describes the result of walking a single scan.
+type ScanSummary struct {
+	// Offset is the file offset of the scan's SOS segment.
+	Offset int
+
+	// Header is the parsed SOS segment.
+	Header *ScanHeader
+
+	// ExpectedMcus is the number of MCUs that the frame dimensions require.
+	ExpectedMcus int
+
+	// DecodedMcus is the number of MCUs that were decoded successfully.
+	DecodedMcus int
+
+	// RestartMarkers is the number of restart markers that were consumed.
+	RestartMarkers int
+
+	// UnconsumedBytes is the amount of entropy-coded data that was left over
+	// after the last MCU. This is always zero for arithmetic-coded scans,
+	// which don't necessarily need all of their data.
+	UnconsumedBytes int
+}
+
+// IsComplete returns true if every MCU in the scan was decoded.
+func (ss ScanSummary) IsComplete() bool {
+	return ss.DecodedMcus == ss.ExpectedMcus
+}
+
+// String returns a descriptive string.
+func (ss ScanSummary) String() string {
+	return fmt.Sprintf("ScanSummary<OFFSET=(%d) MCUS=(%d)/(%d) RESTARTS=(%d) UNCONSUMED=(%d)>", ss.Offset, ss.DecodedMcus, ss.ExpectedMcus, ss.RestartMarkers, ss.UnconsumedBytes)
+}
+
+// ScanDataReport is the result of `CheckScanData`.
+type ScanDataReport struct {
+	// Frame is the parsed SOF segment.
+	Frame *SofSegment
+
+	// Scans describes each scan that was walked.
+	Scans []ScanSummary
+
+	// Findings are the problems that were found.
+	Findings ValidationFindings
+}
+
+// IsValid returns true if no errors were found.
+func (sdr *ScanDataReport) IsValid() bool {
+	return sdr.Findings.HasErrors() == false
+}
+
+// maxEntropyPaddingBytes is the most fill that may follow the last MCU before
+// the leftover data is taken to mean that the decoder lost sync.
+const maxEntropyPaddingBytes = 4
+
+// isEntropyPadding returns true if what follows the last MCU (from `start`)
+// is no more than a few fill bytes (0xff, possibly stuffed) rather than coded
+// data.
+func isEntropyPadding(data []byte, start int) bool {
+	if len(data)-start > maxEntropyPaddingBytes {
+		return false
+	}
+
+	for i := start; i < len(data); i++ {
+		if data[i] != 0xff && (data[i] != 0x00 || i == 0 || data[i-1] != 0xff) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CheckScanData decodes the entropy-coded data of every scan down to the
+// level of the quantized coefficients (or the samples, for lossless images),
+// without doing any of the (far more expensive) pixel reconstruction. This
+// makes sure that the bitstream can be completely consumed, that it has
+// exactly as many MCUs as the frame requires, and that the restart markers are
+// where they should be. Coded data left over after the last MCU means that the
+// decoder lost sync, so it's an error; only a few fill bytes are a warning. An
+// error is only returned if the check itself could not be performed.
+func (sl *SegmentList) CheckScanData() (report *ScanDataReport, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	report = new(ScanDataReport)
+
+	add := func(severity ValidationSeverity, code string, s *Segment, format string, args ...interface{}) {
+		vf := ValidationFinding{
+			Severity: severity,
+			Code:     code,
+			Offset:   -1,
+			Message:  fmt.Sprintf(format, args...),
+		}
+
+		if s != nil {
+			vf.MarkerId = s.MarkerId
+			vf.Offset = s.Offset
+		}
+
+		report.Findings = append(report.Findings, vf)
+	}
+
+	segments, err := sl.expandedSegments()
+	if err != nil {
+		add(ValidationSeverityError, FindingMalformedSegment, nil, "scan-data could not be split: %s", err.Error())
+		return report, nil
+	}
+
+	var sd scanDecoder
+	var pendingTables []*HuffmanTable
+	var pendingConditioning []*ArithmeticConditioning
+	restartInterval := 0
+
+	for i, s := range segments {
+		switch {
+		case s.MarkerId == MARKER_DHT:
+			tables, err := ParseHuffmanTables(s.Data)
+			if err != nil {
+				add(ValidationSeverityError, FindingMalformedSegment, s, "DHT segment could not be parsed: %s", err.Error())
+				continue
+			}
+
+			if sd == nil {
+				pendingTables = append(pendingTables, tables...)
+			} else if err := sd.setHuffmanTables(tables); err != nil {
+				add(ValidationSeverityError, FindingMalformedSegment, s, "DHT segment not valid: %s", err.Error())
+			}
+		case s.MarkerId == MARKER_DAC:
+			conditioning, err := ParseArithmeticConditioning(s.Data)
+			if err != nil {
+				add(ValidationSeverityError, FindingMalformedSegment, s, "DAC segment could not be parsed: %s", err.Error())
+				continue
+			}
+
+			if sd == nil {
+				pendingConditioning = append(pendingConditioning, conditioning...)
+			} else if err := sd.setArithmeticConditioning(conditioning); err != nil {
+				add(ValidationSeverityError, FindingMalformedSegment, s, "DAC segment not valid: %s", err.Error())
+			}
+		case s.MarkerId == MARKER_DRI:
+			interval, err := ParseRestartInterval(s.Data)
+			if err != nil {
+				add(ValidationSeverityError, FindingInvalidRestartInterval, s, "DRI segment could not be parsed: %s", err.Error())
+				continue
+			}
+
+			restartInterval = interval
+
+			if sd != nil {
+				sd.setRestartInterval(interval)
+			}
+		case isSofMarker(s.MarkerId) == true:
+			if report.Frame != nil {
+				add(ValidationSeverityError, FindingDuplicateSof, s, "more than one SOF segment")
+				return report, nil
+			}
+
+			fh, err := ParseSofSegment(s.MarkerId, s.Data)
+			if err != nil {
+				add(ValidationSeverityError, FindingMalformedSegment, s, "SOF segment could not be parsed: %s", err.Error())
+				return report, nil
+			}
+
+			report.Frame = fh
+
+			sd, err = newScanDecoder(fh)
+			if err != nil {
+				add(ValidationSeverityError, FindingUnsupportedCoding, s, "frame can not be walked: %s", err.Error())
+				return report, nil
+			}
+
+			sd.setRestartInterval(restartInterval)
+
+			if err := sd.setHuffmanTables(pendingTables); err != nil {
+				add(ValidationSeverityError, FindingMalformedSegment, s, "DHT segment not valid: %s", err.Error())
+			}
+
+			if err := sd.setArithmeticConditioning(pendingConditioning); err != nil {
+				add(ValidationSeverityError, FindingMalformedSegment, s, "DAC segment not valid: %s", err.Error())
+			}
+		case s.MarkerId == MARKER_SOS:
+			if sd == nil {
+				add(ValidationSeverityError, FindingScanBeforeFrame, s, "SOS segment before any SOF segment")
+				return report, nil
+			}
+
+			sh, err := ParseScanHeader(s.Data)
+			if err != nil {
+				add(ValidationSeverityError, FindingMalformedSegment, s, "SOS segment could not be parsed: %s", err.Error())
+				continue
+			}
+
+			var entropyData []byte
+			if i+1 < len(segments) && segments[i+1].MarkerId == 0 {
+				entropyData = segments[i+1].Data
+			}
+
+			stats, err := sd.decodeScan(sh, entropyData)
+
+			summary := ScanSummary{
+				Offset:          s.Offset,
+				Header:          sh,
+				ExpectedMcus:    stats.expectedMcus,
+				DecodedMcus:     stats.decodedMcus,
+				RestartMarkers:  stats.restartMarkers,
+				UnconsumedBytes: stats.unconsumedBytes,
+			}
+
+			report.Scans = append(report.Scans, summary)
+
+			if err != nil {
+				code := FindingEntropyCorrupt
+				if summary.ExpectedMcus == 0 {
+					code = FindingInvalidScan
+				} else if stats.isTruncated == true {
+					code = FindingEntropyTruncated
+				}
+
+				add(ValidationSeverityError, code, s, "%s", err.Error())
+
+				continue
+			}
+
+			if summary.UnconsumedBytes > 0 {
+				if isEntropyPadding(entropyData, len(entropyData)-summary.UnconsumedBytes) == true {
+					add(ValidationSeverityWarning, FindingExtraEntropyData, s, "(%d) bytes of fill follow the last MCU", summary.UnconsumedBytes)
+				} else {
+					add(ValidationSeverityError, FindingEntropyCorrupt, s, "(%d) bytes of entropy-coded data follow the last MCU", summary.UnconsumedBytes)
+				}
+			}
+		}
+	}
+
+	if sd == nil {
+		if report.Frame == nil {
+			add(ValidationSeverityError, FindingMissingSof, nil, "no SOF segment")
+		}
+
+		return report, nil
+	}
+
+	if len(report.Scans) == 0 {
+		add(ValidationSeverityError, FindingMissingSos, nil, "no SOS segment")
+	} else if ids := sd.incompleteComponents(); len(ids) > 0 {
+		add(ValidationSeverityError, FindingIncompleteCoefficient, nil, "not all coefficients were coded for components %v", ids)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,361 @@
+package jpegstructure
+
+import (
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/dsoprea/go-logging"
+)
+
+// getScanCheckTestScanData returns the index of the segment that has the scan-
+// data.
+func getScanCheckTestScanData(sl *SegmentList) int {
+	for i, s := range sl.segments {
+		if s.MarkerId == 0 {
+			return i
+		}
+	}
+
+	log.Panicf("no scan-data segment")
+	return 0
+}
+
+func TestSegmentList_CheckScanData_Clean(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getValidationTestSegmentList()
+
+	report, err := sl.CheckScanData()
+	log.PanicIf(err)
+
+	if report.IsValid() != true {
+		t.Fatalf("Expected valid: %v", report.Findings)
+	} else if len(report.Findings) != 0 {
+		t.Fatalf("Expected no findings: %v", report.Findings)
+	} else if report.Frame == nil || report.Frame.Width != 64 || report.Frame.Height != 48 {
+		t.Fatalf("Frame not correct: %v", report.Frame)
+	} else if len(report.Scans) != 1 {
+		t.Fatalf("Expected one scan: (%d)", len(report.Scans))
+	}
+
+	ss := report.Scans[0]
+
+	// 4:2:0 has 16x16 MCUs.
+	if ss.ExpectedMcus != 4*3 {
+		t.Fatalf("Expected MCU count not correct: (%d)", ss.ExpectedMcus)
+	} else if ss.IsComplete() != true {
+		t.Fatalf("Scan not complete: %s", ss)
+	} else if ss.UnconsumedBytes != 0 {
+		t.Fatalf("Expected no unconsumed bytes: %s", ss)
+	}
+}
+
+func TestSegmentList_CheckScanData_Grayscale(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	data := getTestGeneratedJpeg(33, 17, true)
+
+	jmp := NewJpegMediaParser()
+
+	intfc, err := jmp.ParseBytes(data)
+	log.PanicIf(err)
+
+	sl := intfc.(*SegmentList)
+
+	report, err := sl.CheckScanData()
+	log.PanicIf(err)
+
+	if report.IsValid() != true {
+		t.Fatalf("Expected valid: %v", report.Findings)
+	}
+
+	// A single-component scan only codes the visible blocks.
+	if report.Scans[0].ExpectedMcus != 5*3 {
+		t.Fatalf("Expected MCU count not correct: %s", report.Scans[0])
+	} else if report.Scans[0].IsComplete() != true {
+		t.Fatalf("Scan not complete: %s", report.Scans[0])
+	}
+}
+
+func TestSegmentList_CheckScanData_Asset(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	assetsPath := GetTestAssetsPath()
+	filepath := path.Join(assetsPath, "20180428_212314.jpg")
+
+	jmp := NewJpegMediaParser()
+
+	intfc, err := jmp.ParseFile(filepath)
+	log.PanicIf(err)
+
+	sl := intfc.(*SegmentList)
+
+	report, err := sl.CheckScanData()
+	log.PanicIf(err)
+
+	if report.IsValid() != true {
+		t.Fatalf("Expected valid: %v", report.Findings)
+	}
+
+	for _, ss := range report.Scans {
+		if ss.IsComplete() != true {
+			t.Fatalf("Scan not complete: %s", ss)
+		}
+	}
+}
+
+func TestSegmentList_CheckScanData_Truncated(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getValidationTestSegmentList()
+
+	i := getScanCheckTestScanData(sl)
+	s := sl.segments[i]
+
+	sl.segments[i] = &Segment{
+		MarkerId: s.MarkerId,
+		Offset:   s.Offset,
+		Data:     s.Data[:len(s.Data)/2],
+	}
+
+	report, err := sl.CheckScanData()
+	log.PanicIf(err)
+
+	expected := []string{
+		FindingEntropyTruncated,
+	}
+
+	if reflect.DeepEqual(report.Findings.Codes(), expected) != true {
+		t.Fatalf("Findings not correct: %v", report.Findings)
+	} else if report.Scans[0].DecodedMcus >= report.Scans[0].ExpectedMcus {
+		t.Fatalf("Expected fewer MCUs: %s", report.Scans[0])
+	}
+}
+
+func TestSegmentList_CheckScanData_TruncatedAnywhere(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	original := getCoefficientsTestSegmentList(getTestGeneratedJpeg(32, 32, true))
+
+	i := getScanCheckTestScanData(original)
+	s := original.segments[i]
+
+	scanHeaderSize := 2 + 2 + 6 + 2
+
+	// Wherever the data ends (even in the middle of a stuffed byte), it's
+	// reported as truncated rather than corrupt.
+
+	for size := scanHeaderSize + 1; size < len(s.Data); size++ {
+		segments := append([]*Segment{}, original.segments...)
+
+		segments[i] = &Segment{
+			MarkerId: s.MarkerId,
+			Offset:   s.Offset,
+			Data:     s.Data[:size],
+		}
+
+		sl := NewSegmentList(segments)
+
+		report, err := sl.CheckScanData()
+		log.PanicIf(err)
+
+		codes := report.Findings.Codes()
+		if len(codes) != 1 || codes[0] != FindingEntropyTruncated {
+			t.Fatalf("Findings not correct at (%d) of (%d): %v", size, len(s.Data), report.Findings)
+		}
+	}
+}
+
+func TestSegmentList_CheckScanData_Corrupt(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getValidationTestSegmentList()
+
+	i := getScanCheckTestScanData(sl)
+	s := sl.segments[i]
+
+	// A run of one-bits is never a valid code.
+
+	data := make([]byte, len(s.Data))
+	copy(data, s.Data)
+
+	for j := len(data) / 2; j < len(data)/2+8; j += 2 {
+		data[j] = 0xff
+		data[j+1] = 0x00
+	}
+
+	sl.segments[i] = &Segment{
+		MarkerId: s.MarkerId,
+		Offset:   s.Offset,
+		Data:     data,
+	}
+
+	report, err := sl.CheckScanData()
+	log.PanicIf(err)
+
+	expected := []string{
+		FindingEntropyCorrupt,
+	}
+
+	if reflect.DeepEqual(report.Findings.Codes(), expected) != true {
+		t.Fatalf("Findings not correct: %v", report.Findings)
+	}
+}
+
+func TestSegmentList_CheckScanData_ExtraData(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	original := getValidationTestSegmentList()
+
+	i := getScanCheckTestScanData(original)
+	s := original.segments[i]
+
+	check := func(extra []byte, isValid bool, expected []string) {
+		segments := append([]*Segment{}, original.segments...)
+
+		segments[i] = &Segment{
+			MarkerId: s.MarkerId,
+			Offset:   s.Offset,
+			Data:     append(append([]byte{}, s.Data...), extra...),
+		}
+
+		sl := NewSegmentList(segments)
+
+		report, err := sl.CheckScanData()
+		log.PanicIf(err)
+
+		if reflect.DeepEqual(report.Findings.Codes(), expected) != true {
+			t.Fatalf("Findings not correct for (%d) extra bytes: %v", len(extra), report.Findings)
+		} else if report.IsValid() != isValid {
+			t.Fatalf("Validity not correct for (%d) extra bytes: %v", len(extra), report.Findings)
+		} else if report.Scans[0].UnconsumedBytes == 0 {
+			t.Fatalf("Unconsumed bytes not correct: %s", report.Scans[0])
+		}
+	}
+
+	// A little fill is tolerated.
+	check([]byte{0xff, 0x00, 0xff}, true, []string{FindingExtraEntropyData})
+
+	// Coded data means that the decoder lost sync.
+	check([]byte{0x12, 0x34}, false, []string{FindingEntropyCorrupt})
+
+	extra := make([]byte, 100)
+	for j := range extra {
+		extra[j] = 0xff
+		if j%2 == 1 {
+			extra[j] = 0x00
+		}
+	}
+
+	check(extra, false, []string{FindingEntropyCorrupt})
+}
+
+func TestSegmentList_CheckScanData_MissingRestart(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getValidationTestSegmentList()
+
+	dri := &Segment{
+		MarkerId: MARKER_DRI,
+		Data:     []byte{0, 2},
+	}
+
+	segments := []*Segment{sl.segments[0], dri}
+	segments = append(segments, sl.segments[1:]...)
+
+	sl = NewSegmentList(segments)
+
+	report, err := sl.CheckScanData()
+	log.PanicIf(err)
+
+	expected := []string{
+		FindingEntropyCorrupt,
+	}
+
+	if reflect.DeepEqual(report.Findings.Codes(), expected) != true {
+		t.Fatalf("Findings not correct: %v", report.Findings)
+	} else if report.Scans[0].DecodedMcus != 2 {
+		t.Fatalf("Expected decoding to stop at the first restart: %s", report.Scans[0])
+	}
+}
+
+func TestSegmentList_CheckScanData_MissingSof(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getValidationTestSegmentList()
+
+	segments := make([]*Segment, 0)
+	for _, s := range sl.segments {
+		if s.MarkerId != MARKER_SOF0 {
+			segments = append(segments, s)
+		}
+	}
+
+	sl = NewSegmentList(segments)
+
+	report, err := sl.CheckScanData()
+	log.PanicIf(err)
+
+	expected := []string{
+		FindingScanBeforeFrame,
+	}
+
+	if reflect.DeepEqual(report.Findings.Codes(), expected) != true {
+		t.Fatalf("Findings not correct: %v", report.Findings)
+	}
+}
@@ -0,0 +1,223 @@
+package jpegstructure
+
+import (
+	"bytes"
+
+	"encoding/binary"
+
+	"github.com/dsoprea/go-logging"
+)
+
+const (
+	scanDataMarkerName = "!SCANDATA"
+)
+
+// isRestartMarker returns true if the marker is one of RST0-RST7.
+func isRestartMarker(markerId byte) bool {
+	return markerId >= MARKER_RST0 && markerId <= MARKER_RST7
+}
+
+// isSofMarker returns true for the SOFn markers.
+func isSofMarker(markerId byte) bool {
+	return markerId >= MARKER_SOF0 && markerId <= MARKER_SOF15 && markerId != MARKER_DHT && markerId != MARKER_JPG && markerId != MARKER_DAC
+}
+
+// findEntropyEnd returns the position of the first marker in the given data
+// that is not a restart marker. Stuffed zero-bytes and restart markers are part
+// of the entropy-coded data. If no marker is found, the length of the data is
+// returned.
+func findEntropyEnd(data []byte) int {
+	for i := 0; i < len(data); i++ {
+		if data[i] != 0xff {
+			continue
+		}
+
+		// Skip fill bytes.
+		j := i + 1
+		for j < len(data) && data[j] == 0xff {
+			j++
+		}
+
+		if j >= len(data) {
+			return len(data)
+		}
+
+		if data[j] == 0x00 || isRestartMarker(data[j]) == true {
+			i = j
+			continue
+		}
+
+		return i
+	}
+
+	return len(data)
+}
+
+// splitScanData divides the payload of a scan-data segment into the header of
+// the first scan, its entropy-coded data, and any segments and scans that
+// follow it, each as its own segment. The SOS segments carry their header
+// (without the length) and the entropy-coded data has a marker-ID of (0).
+// `offset` is the file offset of the scan-data segment.
+func splitScanData(data []byte, offset int) (segments []*Segment, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	segments = make([]*Segment, 0)
+
+	// The SOS marker itself precedes the scan-data segment.
+	markerOffset := offset - 2
+	markerId := byte(MARKER_SOS)
+	pos := 0
+
+	for {
+		// Note that the SOS marker is registered as having no length because
+		// the splitter includes its header in the scan-data.
+		if sizeLen, found := markerLen[markerId]; markerId != MARKER_SOS && found == true && sizeLen == 0 {
+			s := &Segment{
+				MarkerId:   markerId,
+				MarkerName: markerNames[markerId],
+				Offset:     markerOffset,
+			}
+
+			segments = append(segments, s)
+		} else {
+			if len(data)-pos < 2 {
+				log.Panicf("segment length truncated in scan-data: MARKER=(0x%02x) OFFSET=(%d)", markerId, offset+pos)
+			}
+
+			l := int(binary.BigEndian.Uint16(data[pos:]))
+			if l < 2 || pos+l > len(data) {
+				log.Panicf("segment length not valid in scan-data: MARKER=(0x%02x) OFFSET=(%d) LENGTH=(%d)", markerId, offset+pos, l)
+			}
+
+			s := &Segment{
+				MarkerId:   markerId,
+				MarkerName: markerNames[markerId],
+				Offset:     markerOffset,
+				Data:       data[pos+2 : pos+l],
+			}
+
+			segments = append(segments, s)
+			pos += l
+
+			if markerId == MARKER_SOS {
+				entropyLength := findEntropyEnd(data[pos:])
+
+				s := &Segment{
+					MarkerId:   0,
+					MarkerName: scanDataMarkerName,
+					Offset:     offset + pos,
+					Data:       data[pos : pos+entropyLength],
+				}
+
+				segments = append(segments, s)
+				pos += entropyLength
+			}
+		}
+
+		if pos >= len(data) {
+			break
+		}
+
+		if data[pos] != 0xff {
+			log.Panicf("expected marker in scan-data: OFFSET=(%d) BYTE=(0x%02x)", offset+pos, data[pos])
+		}
+
+		markerOffset = offset + pos
+
+		// Skip fill bytes.
+		for pos < len(data) && data[pos] == 0xff {
+			pos++
+		}
+
+		if pos >= len(data) {
+			break
+		}
+
+		markerId = data[pos]
+		pos++
+	}
+
+	return segments, nil
+}
+
+// joinScanData builds the payload of a scan-data segment from segments in the
+// form returned by `splitScanData`. The first segment must be a SOS segment.
+func joinScanData(segments []*Segment) (data []byte, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if len(segments) == 0 || segments[0].MarkerId != MARKER_SOS {
+		log.Panicf("scan-data must start with a SOS segment")
+	}
+
+	b := new(bytes.Buffer)
+
+	for i, s := range segments {
+		if s.MarkerId == 0 {
+			b.Write(s.Data)
+			continue
+		}
+
+		// The first SOS marker is written as its own (empty) segment.
+		if i > 0 {
+			b.Write([]byte{0xff, s.MarkerId})
+		}
+
+		if sizeLen, found := markerLen[s.MarkerId]; s.MarkerId != MARKER_SOS && found == true && sizeLen == 0 {
+			continue
+		}
+
+		if len(s.Data) > maxSegmentPayloadSize {
+			log.Panicf("segment too large for scan-data: MARKER=(0x%02x) SIZE=(%d)", s.MarkerId, len(s.Data))
+		}
+
+		l := uint16(len(s.Data) + 2)
+
+		err := binary.Write(b, binary.BigEndian, l)
+		log.PanicIf(err)
+
+		b.Write(s.Data)
+	}
+
+	return b.Bytes(), nil
+}
+
+// expandedSegments returns the list of segments with the scan-data segment
+// split into its individual scans and embedded segments (see
+// `splitScanData`).
+func (sl *SegmentList) expandedSegments() (segments []*Segment, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	segments = make([]*Segment, 0, len(sl.segments))
+
+	for i := 0; i < len(sl.segments); i++ {
+		s := sl.segments[i]
+
+		if s.MarkerId == MARKER_SOS && len(s.Data) == 0 && i+1 < len(sl.segments) && sl.segments[i+1].MarkerId == 0 {
+			scanData := sl.segments[i+1]
+
+			scanSegments, err := splitScanData(scanData.Data, scanData.Offset)
+			log.PanicIf(err)
+
+			segments = append(segments, scanSegments...)
+			i++
+
+			continue
+		}
+
+		segments = append(segments, s)
+	}
+
+	return segments, nil
+}
@@ -0,0 +1,70 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dsoprea/go-logging"
+)
+
+func TestSplitScanData_JoinScanData(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	data := []byte{
+		// SOS header.
+		0x00, 0x08, 0x01, 0x01, 0x00, 0x00, 0x3f, 0x00,
+
+		// Entropy-coded data with a stuffed byte and a restart marker.
+		0x12, 0xff, 0x00, 0x34, 0xff, 0xd0, 0x56,
+
+		// An embedded DHT with fill bytes ahead of it.
+		0xff, 0xff, 0xc4, 0x00, 0x03, 0x99,
+
+		// A second scan.
+		0xff, 0xda, 0x00, 0x08, 0x01, 0x01, 0x00, 0x01, 0x3f, 0x00,
+		0x78,
+	}
+
+	segments, err := splitScanData(data, 100)
+	log.PanicIf(err)
+
+	expectedMarkers := []byte{MARKER_SOS, 0, MARKER_DHT, MARKER_SOS, 0}
+	expectedOffsets := []int{98, 108, 115, 121, 131}
+
+	if len(segments) != len(expectedMarkers) {
+		t.Fatalf("Segment count not correct: (%d)", len(segments))
+	}
+
+	for i, s := range segments {
+		if s.MarkerId != expectedMarkers[i] || s.Offset != expectedOffsets[i] {
+			t.Fatalf("Segment (%d) not correct: %s", i, s)
+		}
+	}
+
+	if bytes.Equal(segments[1].Data, []byte{0x12, 0xff, 0x00, 0x34, 0xff, 0xd0, 0x56}) != true {
+		t.Fatalf("Entropy-coded data not correct.")
+	}
+
+	joined, err := joinScanData(segments)
+	log.PanicIf(err)
+
+	// The fill bytes aren't preserved.
+	expectedJoined := append(append([]byte{}, data[:15]...), data[16:]...)
+
+	if bytes.Equal(joined, expectedJoined) != true {
+		t.Fatalf("Joined scan-data not correct:\n%s\n%s", DumpBytesToString(joined), DumpBytesToString(expectedJoined))
+	}
+}
+
+func TestSplitScanData_Truncated(t *testing.T) {
+	_, err := splitScanData([]byte{0x00, 0x08, 0x01}, 0)
+	if err == nil {
+		t.Fatalf("Expected error for truncated header.")
+	}
+}
@@ -0,0 +1,374 @@
+package jpegstructure
+
+import (
+	"github.com/dsoprea/go-logging"
+)
+
+// scanEncoder walks the coefficients of a scan and produces its symbols. It
+// is the counterpart of `huffmanScanDecoder`.
+type scanEncoder struct {
+	frame           *SofSegment
+	components      []*ComponentCoefficients
+	restartInterval int
+
+	// maxDcCategory and maxAcCategory are the largest magnitudes that the
+	// sample precision allows.
+	maxDcCategory uint
+	maxAcCategory uint
+}
+
+func newScanEncoder(frame *SofSegment, components []*ComponentCoefficients, restartInterval int) *scanEncoder {
+	se := &scanEncoder{
+		frame:           frame,
+		components:      components,
+		restartInterval: restartInterval,
+		maxDcCategory:   11,
+		maxAcCategory:   10,
+	}
+
+	if frame.BitsPerSample == 12 {
+		se.maxDcCategory = 15
+		se.maxAcCategory = 14
+	}
+
+	return se
+}
+
+// scanEncoderState is the state that carries from block to block.
+type scanEncoderState struct {
+	v  scanSymbolVisitor
+	sh *ScanHeader
+
+	predictors []int32
+
+	// eobrun is the number of blocks in the pending end-of-band run.
+	eobrun int
+
+	// correctionBits are the refinement bits that belong to the blocks in
+	// the pending end-of-band run.
+	correctionBits []byte
+}
+
+// flushEobRun emits the pending end-of-band run, if any (T.81 G.1.2.2).
+func (ses *scanEncoderState) flushEobRun() {
+	if ses.eobrun == 0 {
+		return
+	}
+
+	n := uint(0)
+	for temp := ses.eobrun >> 1; temp != 0; temp >>= 1 {
+		n++
+	}
+
+	ses.v.symbol(HuffmanClassAc, ses.sh.Components[0].AcTableId, byte(n<<4))
+	ses.v.bits(uint32(ses.eobrun), n)
+
+	for _, bit := range ses.correctionBits {
+		ses.v.bits(uint32(bit), 1)
+	}
+
+	ses.eobrun = 0
+	ses.correctionBits = ses.correctionBits[:0]
+}
+
+// emitDcDifference emits the DC value relative to the last one.
+func (se *scanEncoder) emitDcDifference(ses *scanEncoderState, i int, dc int32) {
+	sc := ses.sh.Components[i]
+
+	category, bits := magnitudeCategory(dc - ses.predictors[i])
+	if category > se.maxDcCategory {
+		log.Panicf("DC difference out of range for component (%d): (%d)", sc.ComponentId, dc-ses.predictors[i])
+	}
+
+	ses.predictors[i] = dc
+
+	ses.v.symbol(HuffmanClassDc, sc.DcTableId, byte(category))
+	ses.v.bits(bits, category)
+}
+
+// encodeBlockSequential encodes a whole block (T.81 F.1.2).
+func (se *scanEncoder) encodeBlockSequential(ses *scanEncoderState, i int, block *CoefficientBlock) {
+	se.emitDcDifference(ses, i, int32(block[0]))
+
+	tableId := ses.sh.Components[i].AcTableId
+	v := ses.v
+
+	run := 0
+	for k := 1; k < 64; k++ {
+		coefficient := int32(block[zigzag[k]])
+		if coefficient == 0 {
+			run++
+			continue
+		}
+
+		for run > 15 {
+			v.symbol(HuffmanClassAc, tableId, 0xf0)
+			run -= 16
+		}
+
+		category, bits := magnitudeCategory(coefficient)
+		if category > se.maxAcCategory {
+			log.Panicf("AC coefficient out of range for component (%d): (%d)", ses.sh.Components[i].ComponentId, coefficient)
+		}
+
+		v.symbol(HuffmanClassAc, tableId, byte(run<<4)|byte(category))
+		v.bits(bits, category)
+
+		run = 0
+	}
+
+	if run > 0 {
+		v.symbol(HuffmanClassAc, tableId, 0x00)
+	}
+}
+
+// encodeBlockDcFirst encodes the point-transformed DC value (T.81 G.1.2.1).
+// Unlike the AC coefficients, the DC is shifted arithmetically.
+func (se *scanEncoder) encodeBlockDcFirst(ses *scanEncoderState, i int, block *CoefficientBlock) {
+	se.emitDcDifference(ses, i, int32(block[0])>>ses.sh.ApproximationLow)
+}
+
+// encodeBlockDcRefine emits the next bit of the DC value.
+func (se *scanEncoder) encodeBlockDcRefine(ses *scanEncoderState, i int, block *CoefficientBlock) {
+	ses.v.bits(uint32(int32(block[0])>>ses.sh.ApproximationLow)&1, 1)
+}
+
+// encodeBlockAcFirst encodes the point-transformed AC coefficients in the
+// band (T.81 G.1.2.2).
+func (se *scanEncoder) encodeBlockAcFirst(ses *scanEncoderState, i int, block *CoefficientBlock) {
+	sh := ses.sh
+	tableId := sh.Components[0].AcTableId
+	v := ses.v
+
+	run := 0
+	for k := int(sh.SpectralStart); k <= int(sh.SpectralEnd); k++ {
+		coefficient := int32(block[zigzag[k]])
+
+		// The point-transform applies to the magnitude.
+		magnitude := coefficient
+		if magnitude < 0 {
+			magnitude = -magnitude
+		}
+
+		magnitude >>= sh.ApproximationLow
+		if magnitude == 0 {
+			run++
+			continue
+		}
+
+		if coefficient < 0 {
+			magnitude = -magnitude
+		}
+
+		ses.flushEobRun()
+
+		for run > 15 {
+			v.symbol(HuffmanClassAc, tableId, 0xf0)
+			run -= 16
+		}
+
+		category, bits := magnitudeCategory(magnitude)
+		if category > se.maxAcCategory {
+			log.Panicf("AC coefficient out of range for component (%d): (%d)", sh.Components[0].ComponentId, coefficient)
+		}
+
+		v.symbol(HuffmanClassAc, tableId, byte(run<<4)|byte(category))
+		v.bits(bits, category)
+
+		run = 0
+	}
+
+	if run > 0 {
+		ses.eobrun++
+
+		if ses.eobrun == maxEobRun {
+			ses.flushEobRun()
+		}
+	}
+}
+
+// encodeBlockAcRefine encodes the next bit of the AC coefficients in the band
+// (T.81 G.1.2.3). This follows libjpeg's `encode_mcu_AC_refine`.
+func (se *scanEncoder) encodeBlockAcRefine(ses *scanEncoderState, i int, block *CoefficientBlock) {
+	sh := ses.sh
+	tableId := sh.Components[0].AcTableId
+	v := ses.v
+
+	start := int(sh.SpectralStart)
+	end := int(sh.SpectralEnd)
+
+	var magnitudes [64]int32
+
+	// eob is the position of the last coefficient that becomes non-zero in
+	// this scan.
+	eob := 0
+
+	for k := start; k <= end; k++ {
+		magnitude := int32(block[zigzag[k]])
+		if magnitude < 0 {
+			magnitude = -magnitude
+		}
+
+		magnitude >>= sh.ApproximationLow
+		magnitudes[k] = magnitude
+
+		if magnitude == 1 {
+			eob = k
+		}
+	}
+
+	// The correction bits for coefficients that were already non-zero.
+	pending := make([]byte, 0)
+
+	emitPending := func() {
+		for _, bit := range pending {
+			v.bits(uint32(bit), 1)
+		}
+
+		pending = pending[:0]
+	}
+
+	run := 0
+	for k := start; k <= end; k++ {
+		magnitude := magnitudes[k]
+		if magnitude == 0 {
+			run++
+			continue
+		}
+
+		for run > 15 && k <= eob {
+			ses.flushEobRun()
+
+			v.symbol(HuffmanClassAc, tableId, 0xf0)
+			run -= 16
+
+			emitPending()
+		}
+
+		if magnitude > 1 {
+			pending = append(pending, byte(magnitude&1))
+			continue
+		}
+
+		// The coefficient becomes non-zero.
+
+		ses.flushEobRun()
+
+		v.symbol(HuffmanClassAc, tableId, byte(run<<4)|1)
+
+		if block[zigzag[k]] < 0 {
+			v.bits(0, 1)
+		} else {
+			v.bits(1, 1)
+		}
+
+		emitPending()
+
+		run = 0
+	}
+
+	if run > 0 || len(pending) > 0 {
+		ses.eobrun++
+		ses.correctionBits = append(ses.correctionBits, pending...)
+
+		// Like libjpeg, don't let the buffered bits grow without bound.
+		if ses.eobrun == maxEobRun || len(ses.correctionBits) > 1000-64+1 {
+			ses.flushEobRun()
+		}
+	}
+}
+
+// walkScan produces the symbols of the given scan.
+func (se *scanEncoder) walkScan(sh *ScanHeader, v scanSymbolVisitor) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	fh := se.frame
+
+	indices, err := checkScanHeader(fh, sh)
+	log.PanicIf(err)
+
+	ses := &scanEncoderState{
+		v:              v,
+		sh:             sh,
+		predictors:     make([]int32, len(sh.Components)),
+		correctionBits: make([]byte, 0),
+	}
+
+	var encodeBlock func(ses *scanEncoderState, i int, block *CoefficientBlock)
+
+	if fh.IsProgressive() == false {
+		encodeBlock = se.encodeBlockSequential
+	} else if sh.SpectralStart == 0 {
+		if sh.ApproximationHigh == 0 {
+			encodeBlock = se.encodeBlockDcFirst
+		} else {
+			encodeBlock = se.encodeBlockDcRefine
+		}
+	} else if sh.ApproximationHigh == 0 {
+		encodeBlock = se.encodeBlockAcFirst
+	} else {
+		encodeBlock = se.encodeBlockAcRefine
+	}
+
+	restart := func(index int) {
+		ses.flushEobRun()
+
+		v.restart(index)
+
+		for i := range ses.predictors {
+			ses.predictors[i] = 0
+		}
+	}
+
+	visit := func(i int, block *CoefficientBlock) {
+		encodeBlock(ses, i, block)
+	}
+
+	se.walkScanBlocks(sh, indices, restart, visit)
+
+	ses.flushEobRun()
+
+	return nil
+}
+
+// walkScanBlocks calls `visit` for each block of the scan in coding order, with
+// the index of the block's component in the scan, and `restart` at the end of
+// each restart interval with the index of the restart.
+func (se *scanEncoder) walkScanBlocks(sh *ScanHeader, indices []int, restart func(index int), visit func(i int, block *CoefficientBlock)) {
+	fh := se.frame
+
+	mcuColumns, mcuRows := scanMcuLayout(fh, sh)
+	mcuCount := mcuColumns * mcuRows
+
+	for mcu := 0; mcu < mcuCount; mcu++ {
+		if se.restartInterval > 0 && mcu > 0 && mcu%se.restartInterval == 0 {
+			restart(mcu/se.restartInterval - 1)
+		}
+
+		mcuColumn := mcu % mcuColumns
+		mcuRow := mcu / mcuColumns
+
+		if len(indices) == 1 {
+			cc := se.components[indices[0]]
+			visit(0, cc.Block(mcuColumn, mcuRow))
+
+			continue
+		}
+
+		for i, j := range indices {
+			fc := fh.Components[j]
+			cc := se.components[j]
+
+			for y := 0; y < int(fc.VerticalSampling); y++ {
+				for x := 0; x < int(fc.HorizontalSampling); x++ {
+					block := cc.Block(mcuColumn*int(fc.HorizontalSampling)+x, mcuRow*int(fc.VerticalSampling)+y)
+					visit(i, block)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"path"
+	"testing"
+
+	"image/jpeg"
+
+	"github.com/dsoprea/go-logging"
+)
+
+// equalVisibleCoefficients compares the blocks that are inside the image.
+// Progressive scans that have a single component don't code the blocks that
+// only pad the MCUs.
+func equalVisibleCoefficients(a, b *Coefficients) bool {
+	for i := range a.Frame.Components {
+		columns, rows := a.Frame.ComponentVisibleBlocks(i)
+
+		for y := 0; y < rows; y++ {
+			for x := 0; x < columns; x++ {
+				if *a.Components[i].Block(x, y) != *b.Components[i].Block(x, y) {
+					return false
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+// checkProgressiveRoundTrip writes the coefficients as a progressive image
+// and makes sure that they, and (if image/jpeg can decode the result) the
+// pixels, survive.
+func checkProgressiveRoundTrip(t *testing.T, original []byte, options *WriteCoefficientsOptions, isDecodable bool) *SegmentList {
+	sl := getCoefficientsTestSegmentList(original)
+
+	coefficients, err := sl.ReadCoefficients()
+	log.PanicIf(err)
+
+	err = sl.WriteCoefficients(coefficients, options)
+	log.PanicIf(err)
+
+	sl, data := reparseSegmentList(sl)
+
+	report, err := sl.CheckScanData()
+	log.PanicIf(err)
+
+	if report.IsValid() != true || len(report.Findings) != 0 {
+		t.Fatalf("Scan-data not valid: %v", report.Findings)
+	} else if report.Frame.IsProgressive() != true {
+		t.Fatalf("Expected progressive frame: %s", report.Frame)
+	}
+
+	recovered, err := sl.ReadCoefficients()
+	log.PanicIf(err)
+
+	if equalVisibleCoefficients(recovered, coefficients) != true {
+		t.Fatalf("Coefficients not equal after round-trip.")
+	}
+
+	if isDecodable == false {
+		return sl
+	}
+
+	// The pixels should be exactly the same. The padding isn't.
+
+	originalImage, err := jpeg.Decode(bytes.NewReader(original))
+	log.PanicIf(err)
+
+	recoveredImage, err := jpeg.Decode(bytes.NewReader(data))
+	log.PanicIf(err)
+
+	bounds := originalImage.Bounds()
+	if recoveredImage.Bounds() != bounds {
+		t.Fatalf("Decoded bounds not equal: %v != %v", recoveredImage.Bounds(), bounds)
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if originalImage.At(x, y) != recoveredImage.At(x, y) {
+				t.Fatalf("Pixel (%d, %d) not equal.", x, y)
+			}
+		}
+	}
+
+	return sl
+}
+
+func TestScanEncoder_Progressive(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	options := &WriteCoefficientsOptions{
+		Progressive: true,
+	}
+
+	original := getTestGeneratedJpeg(100, 75, false)
+	sl := checkProgressiveRoundTrip(t, original, options, true)
+
+	report, err := sl.CheckScanData()
+	log.PanicIf(err)
+
+	if len(report.Scans) != 10 {
+		t.Fatalf("Scan count not correct: (%d)", len(report.Scans))
+	}
+
+	original = getTestGeneratedJpeg(100, 75, true)
+	checkProgressiveRoundTrip(t, original, options, true)
+}
+
+func TestScanEncoder_Progressive_Restart(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	options := &WriteCoefficientsOptions{
+		OptimizeHuffman: true,
+		RestartInterval: 3,
+		Progressive:     true,
+	}
+
+	original := getTestGeneratedJpeg(100, 75, true)
+	checkProgressiveRoundTrip(t, original, options, true)
+
+	// image/jpeg counts the restart interval in MCUs of the whole frame,
+	// rather than in blocks, for scans of a single subsampled component.
+
+	original = getTestGeneratedJpeg(100, 75, false)
+	checkProgressiveRoundTrip(t, original, options, false)
+}
+
+func TestScanEncoder_Progressive_Script(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	original := getTestGeneratedJpeg(64, 48, true)
+
+	// Long end-of-band runs and deep successive-approximation.
+	script := []*ScanHeader{
+		{Components: []ScanComponent{{ComponentId: 1}}, ApproximationLow: 3},
+		{Components: []ScanComponent{{ComponentId: 1}}, SpectralStart: 1, SpectralEnd: 2, ApproximationLow: 4},
+		{Components: []ScanComponent{{ComponentId: 1}}, SpectralStart: 3, SpectralEnd: 63, ApproximationLow: 4},
+		{Components: []ScanComponent{{ComponentId: 1}}, ApproximationHigh: 3, ApproximationLow: 2},
+		{Components: []ScanComponent{{ComponentId: 1}}, SpectralStart: 1, SpectralEnd: 63, ApproximationHigh: 4, ApproximationLow: 3},
+		{Components: []ScanComponent{{ComponentId: 1}}, SpectralStart: 1, SpectralEnd: 63, ApproximationHigh: 3, ApproximationLow: 2},
+		{Components: []ScanComponent{{ComponentId: 1}}, SpectralStart: 1, SpectralEnd: 63, ApproximationHigh: 2, ApproximationLow: 1},
+		{Components: []ScanComponent{{ComponentId: 1}}, SpectralStart: 1, SpectralEnd: 63, ApproximationHigh: 1, ApproximationLow: 0},
+		{Components: []ScanComponent{{ComponentId: 1}}, ApproximationHigh: 2, ApproximationLow: 1},
+		{Components: []ScanComponent{{ComponentId: 1}}, ApproximationHigh: 1, ApproximationLow: 0},
+	}
+
+	options := &WriteCoefficientsOptions{
+		Progressive: true,
+		ScanScript:  script,
+	}
+
+	checkProgressiveRoundTrip(t, original, options, true)
+
+	// The caller's script isn't modified.
+	if script[0].Components[0].DcTableId != 0 || script[0].Components[0].AcTableId != 0 {
+		t.Fatalf("Script was modified.")
+	}
+}
+
+func TestScanEncoder_Progressive_InvalidScript(t *testing.T) {
+	sl := getValidationTestSegmentList()
+
+	options := &WriteCoefficientsOptions{
+		Progressive: true,
+		ScanScript: []*ScanHeader{
+			{Components: []ScanComponent{{ComponentId: 1}}},
+		},
+	}
+
+	err := sl.Reencode(options)
+	if err == nil {
+		t.Fatalf("Expected error for incomplete script.")
+	}
+}
+
+func TestSegmentList_Reencode(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	assetsPath := GetTestAssetsPath()
+	filepath := path.Join(assetsPath, "20180428_212314.jpg")
+
+	jmp := NewJpegMediaParser()
+
+	intfc, err := jmp.ParseFile(filepath)
+	log.PanicIf(err)
+
+	sl := intfc.(*SegmentList)
+
+	coefficients, err := sl.ReadCoefficients()
+	log.PanicIf(err)
+
+	// Keep the metadata segments to compare against.
+
+	metadata := make([]*Segment, 0)
+	for _, s := range sl.Segments() {
+		if s.MarkerId >= MARKER_APP0 && s.MarkerId <= MARKER_APP15 || s.MarkerId == MARKER_COM {
+			metadata = append(metadata, s)
+		}
+	}
+
+	// Convert to progressive.
+
+	err = sl.Reencode(&WriteCoefficientsOptions{Progressive: true, OptimizeHuffman: true})
+	log.PanicIf(err)
+
+	sl, progressiveData := reparseSegmentList(sl)
+
+	recovered, err := sl.ReadCoefficients()
+	log.PanicIf(err)
+
+	if recovered.Frame.IsProgressive() != true {
+		t.Fatalf("Expected progressive frame.")
+	} else if equalVisibleCoefficients(recovered, coefficients) != true {
+		t.Fatalf("Coefficients not equal after converting to progressive.")
+	}
+
+	// And back to baseline.
+
+	err = sl.Reencode(&WriteCoefficientsOptions{OptimizeHuffman: true})
+	log.PanicIf(err)
+
+	sl, baselineData := reparseSegmentList(sl)
+
+	recovered, err = sl.ReadCoefficients()
+	log.PanicIf(err)
+
+	if recovered.Frame.MarkerId != MARKER_SOF0 {
+		t.Fatalf("Expected baseline frame.")
+	} else if equalVisibleCoefficients(recovered, coefficients) != true {
+		t.Fatalf("Coefficients not equal after converting to baseline.")
+	} else if len(progressiveData) >= len(baselineData) {
+		t.Fatalf("Expected progressive image to be smaller: (%d) >= (%d)", len(progressiveData), len(baselineData))
+	}
+
+	// The metadata segments are untouched.
+
+	i := 0
+	for _, s := range sl.Segments() {
+		if s.MarkerId >= MARKER_APP0 && s.MarkerId <= MARKER_APP15 || s.MarkerId == MARKER_COM {
+			if i >= len(metadata) || s.MarkerId != metadata[i].MarkerId || bytes.Equal(s.Data, metadata[i].Data) != true {
+				t.Fatalf("Metadata segment (%d) not preserved.", i)
+			}
+
+			i++
+		}
+	}
+
+	if i != len(metadata) {
+		t.Fatalf("Metadata segment count not correct: (%d) != (%d)", i, len(metadata))
+	}
+}
@@ -0,0 +1,272 @@
+package jpegstructure
+
+import (
+	"fmt"
+
+	"github.com/dsoprea/go-logging"
+)
+
+const (
+	// maxEobRun is the longest end-of-band run that an encoder emits.
+	maxEobRun = 0x7fff
+)
+
+// checkScanHeader makes sure that the scan parameters are valid for the frame
+// and returns the frame index of each of the scan's components.
+func checkScanHeader(fh *SofSegment, sh *ScanHeader) (indices []int, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if len(sh.Components) < 1 || len(sh.Components) > 4 {
+		log.Panicf("scan component-count not valid: (%d)", len(sh.Components))
+	}
+
+	ss, se, ah, al := sh.SpectralStart, sh.SpectralEnd, sh.ApproximationHigh, sh.ApproximationLow
+
+	if fh.IsLossless() == true {
+		// The spectral-selection start is the predictor, and the low
+		// approximation is the point-transform.
+		if ss < 1 || ss > 7 || se != 0 || ah != 0 || al >= fh.BitsPerSample {
+			log.Panicf("lossless scan parameters not valid: %s", sh)
+		}
+	} else if fh.IsProgressive() == true {
+		if ss > se || se > 63 || al > 13 || (ah != 0 && ah != al+1) {
+			log.Panicf("progressive scan parameters not valid: %s", sh)
+		} else if ss == 0 && se != 0 {
+			log.Panicf("progressive DC scan may not include AC coefficients: %s", sh)
+		} else if ss > 0 && len(sh.Components) != 1 {
+			log.Panicf("progressive AC scan must have one component: %s", sh)
+		}
+	} else if ss != 0 || se != 63 || ah != 0 || al != 0 {
+		log.Panicf("sequential scan parameters not valid: %s", sh)
+	}
+
+	indices = make([]int, len(sh.Components))
+	blocks := 0
+
+	for i, sc := range sh.Components {
+		j := fh.ComponentIndex(sc.ComponentId)
+		if j == -1 {
+			log.Panicf("scan refers to unknown component: (%d)", sc.ComponentId)
+		}
+
+		for _, existing := range indices[:i] {
+			if existing == j {
+				log.Panicf("scan has component more than once: (%d)", sc.ComponentId)
+			}
+		}
+
+		if sc.DcTableId > 3 || sc.AcTableId > 3 {
+			log.Panicf("scan refers to an invalid table: (%d) (%d)", sc.DcTableId, sc.AcTableId)
+		}
+
+		fc := fh.Components[j]
+		blocks += int(fc.HorizontalSampling) * int(fc.VerticalSampling)
+
+		indices[i] = j
+	}
+
+	if len(indices) > 1 && blocks > maxBlocksPerMcu {
+		log.Panicf("too many blocks in MCU: (%d)", blocks)
+	}
+
+	return indices, nil
+}
+
+// coefficientCoverage has, for each component and coefficient, the
+// point-transform of the last scan that coded it, or -1 if no scan has.
+type coefficientCoverage [][64]int8
+
+func newCoefficientCoverage(componentCount int) coefficientCoverage {
+	cc := make(coefficientCoverage, componentCount)
+
+	for i := range cc {
+		for k := range cc[i] {
+			cc[i][k] = -1
+		}
+	}
+
+	return cc
+}
+
+// update records which coefficients the scan codes and makes sure that
+// successive-approximation scans are in a sensible order.
+func (cc coefficientCoverage) update(fh *SofSegment, indices []int, sh *ScanHeader) (err error) {
+	for _, i := range indices {
+		coverage := &cc[i]
+
+		for k := int(sh.SpectralStart); k <= int(sh.SpectralEnd); k++ {
+			current := coverage[k]
+
+			if sh.ApproximationHigh == 0 {
+				if current != -1 {
+					return fmt.Errorf("coefficient (%d) of component (%d) coded more than once", k, fh.Components[i].Id)
+				}
+			} else if current != int8(sh.ApproximationHigh) {
+				return fmt.Errorf("refinement of coefficient (%d) of component (%d) out of order", k, fh.Components[i].Id)
+			}
+
+			coverage[k] = int8(sh.ApproximationLow)
+		}
+	}
+
+	return nil
+}
+
+// incompleteComponents returns the IDs of the components that don't have all
+// of their coefficients fully coded.
+func (cc coefficientCoverage) incompleteComponents(fh *SofSegment) (ids []byte) {
+	ids = make([]byte, 0)
+
+	for i, coverage := range cc {
+		for _, al := range coverage {
+			if al != 0 {
+				ids = append(ids, fh.Components[i].Id)
+				break
+			}
+		}
+	}
+
+	return ids
+}
+
+// CheckScanScript makes sure that the scans are valid for a progressive frame
+// and that, together, they completely code every coefficient of every
+// component. The Huffman table IDs are ignored.
+func CheckScanScript(fh *SofSegment, script []*ScanHeader) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	progressive := *fh
+	progressive.MarkerId = MARKER_SOF2
+
+	cc := newCoefficientCoverage(len(fh.Components))
+
+	for i, sh := range script {
+		indices, err := checkScanHeader(&progressive, sh)
+		if err != nil {
+			log.Panicf("scan (%d) not valid: %s", i, err.Error())
+		}
+
+		// AC scans may only follow the first DC scan for that component.
+		if sh.SpectralStart > 0 && cc[indices[0]][0] == -1 {
+			log.Panicf("scan (%d) codes AC coefficients before DC coefficients", i)
+		}
+
+		err = cc.update(&progressive, indices, sh)
+		if err != nil {
+			log.Panicf("scan (%d) not valid: %s", i, err.Error())
+		}
+	}
+
+	if ids := cc.incompleteComponents(fh); len(ids) > 0 {
+		log.Panicf("scan script does not fully code components %v", ids)
+	}
+
+	return nil
+}
+
+// DefaultScanScript returns the progression that libjpeg uses by default
+// (`jpeg_simple_progression`): a coarse DC scan, then spectral selection and
+// successive approximation of the AC coefficients.
+func DefaultScanScript(fh *SofSegment) []*ScanHeader {
+	script := make([]*ScanHeader, 0)
+
+	component := func(i int) ScanComponent {
+		return ScanComponent{
+			ComponentId: fh.Components[i].Id,
+		}
+	}
+
+	acScan := func(i int, ss, se, ah, al byte) {
+		sh := &ScanHeader{
+			Components:        []ScanComponent{component(i)},
+			SpectralStart:     ss,
+			SpectralEnd:       se,
+			ApproximationHigh: ah,
+			ApproximationLow:  al,
+		}
+
+		script = append(script, sh)
+	}
+
+	blocks := 0
+	for _, fc := range fh.Components {
+		blocks += int(fc.HorizontalSampling) * int(fc.VerticalSampling)
+	}
+
+	isInterleaved := len(fh.Components) <= 4 && (len(fh.Components) == 1 || blocks <= maxBlocksPerMcu)
+
+	dcScans := func(ah, al byte) {
+		if isInterleaved == true {
+			sh := &ScanHeader{
+				Components:        make([]ScanComponent, len(fh.Components)),
+				ApproximationHigh: ah,
+				ApproximationLow:  al,
+			}
+
+			for i := range fh.Components {
+				sh.Components[i] = component(i)
+			}
+
+			script = append(script, sh)
+
+			return
+		}
+
+		for i := range fh.Components {
+			sh := &ScanHeader{
+				Components:        []ScanComponent{component(i)},
+				ApproximationHigh: ah,
+				ApproximationLow:  al,
+			}
+
+			script = append(script, sh)
+		}
+	}
+
+	if len(fh.Components) == 3 {
+		// This is specifically tuned for YCbCr.
+
+		dcScans(0, 1)
+		acScan(0, 1, 5, 0, 2)
+		acScan(2, 1, 63, 0, 1)
+		acScan(1, 1, 63, 0, 1)
+		acScan(0, 6, 63, 0, 2)
+		acScan(0, 1, 63, 2, 1)
+		dcScans(1, 0)
+		acScan(2, 1, 63, 1, 0)
+		acScan(1, 1, 63, 1, 0)
+		acScan(0, 1, 63, 1, 0)
+
+		return script
+	}
+
+	dcScans(0, 1)
+
+	for i := range fh.Components {
+		acScan(i, 1, 5, 0, 2)
+	}
+
+	for i := range fh.Components {
+		acScan(i, 6, 63, 0, 2)
+	}
+
+	for i := range fh.Components {
+		acScan(i, 1, 63, 2, 1)
+	}
+
+	dcScans(1, 0)
+
+	for i := range fh.Components {
+		acScan(i, 1, 63, 1, 0)
+	}
+
+	return script
+}
@@ -0,0 +1,96 @@
+package jpegstructure
+
+import (
+	"testing"
+
+	"github.com/dsoprea/go-logging"
+)
+
+func getScanScriptTestFrame() *SofSegment {
+	return &SofSegment{
+		MarkerId:      MARKER_SOF0,
+		BitsPerSample: 8,
+		Width:         64,
+		Height:        48,
+		Components: []FrameComponent{
+			{Id: 1, HorizontalSampling: 2, VerticalSampling: 2},
+			{Id: 2, HorizontalSampling: 1, VerticalSampling: 1, QuantizationTableId: 1},
+			{Id: 3, HorizontalSampling: 1, VerticalSampling: 1, QuantizationTableId: 1},
+		},
+	}
+}
+
+func TestDefaultScanScript(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	fh := getScanScriptTestFrame()
+
+	script := DefaultScanScript(fh)
+	if len(script) != 10 {
+		t.Fatalf("Scan count not correct: (%d)", len(script))
+	} else if len(script[0].Components) != 3 {
+		t.Fatalf("Expected interleaved DC scan: %s", script[0])
+	}
+
+	err := CheckScanScript(fh, script)
+	log.PanicIf(err)
+
+	// Two components.
+
+	fh.Components = fh.Components[:2]
+
+	script = DefaultScanScript(fh)
+	if len(script) != 10 {
+		t.Fatalf("Scan count not correct: (%d)", len(script))
+	}
+
+	err = CheckScanScript(fh, script)
+	log.PanicIf(err)
+}
+
+func TestCheckScanScript_Invalid(t *testing.T) {
+	fh := getScanScriptTestFrame()
+	fh.Components = fh.Components[:1]
+
+	component := []ScanComponent{{ComponentId: 1}}
+
+	scripts := map[string][]*ScanHeader{
+		"incomplete": {
+			{Components: component},
+			{Components: component, SpectralStart: 1, SpectralEnd: 62},
+		},
+		"AC before DC": {
+			{Components: component, SpectralStart: 1, SpectralEnd: 63},
+			{Components: component},
+		},
+		"coded twice": {
+			{Components: component},
+			{Components: component, SpectralStart: 1, SpectralEnd: 63},
+			{Components: component, SpectralStart: 63, SpectralEnd: 63},
+		},
+		"refinement out of order": {
+			{Components: component, ApproximationLow: 2},
+			{Components: component, SpectralStart: 1, SpectralEnd: 63},
+			{Components: component, ApproximationHigh: 1, ApproximationLow: 0},
+		},
+		"unknown component": {
+			{Components: []ScanComponent{{ComponentId: 9}}},
+		},
+		"DC with AC": {
+			{Components: component, SpectralEnd: 63},
+		},
+	}
+
+	for name, script := range scripts {
+		err := CheckScanScript(fh, script)
+		if err == nil {
+			t.Fatalf("Expected error for script: [%s]", name)
+		}
+	}
+}
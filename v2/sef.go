@@ -0,0 +1,463 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"encoding/binary"
+
+	"github.com/dsoprea/go-logging"
+)
+
+var (
+	sefHeaderMagic  = []byte("SEFH")
+	sefTrailerMagic = []byte("SEFT")
+)
+
+var (
+	// ErrNoSefTrailer is returned if the trailer doesn't end with a SEF
+	// directory.
+	ErrNoSefTrailer = errors.New("no SEF trailer")
+)
+
+const (
+	// sefRecordSize is the size of one record of the directory.
+	sefRecordSize = 12
+
+	// sefBlockHeaderSize is the size of the header of each block, before the
+	// name.
+	sefBlockHeaderSize = 8
+
+	// sefDefaultVersion is the version of the directory when there isn't one
+	// already.
+	sefDefaultVersion = uint32(107)
+
+	// sefTimestampName is the entry with the time that the picture was taken.
+	sefTimestampName = "Image_UTC_Data"
+)
+
+// SefEntryKind is what a SEF entry holds, as far as can be told from its
+// name.
+type SefEntryKind int
+
+const (
+	// SefEntryKindUnknown is anything not otherwise recognized.
+	SefEntryKindUnknown SefEntryKind = iota
+
+	// SefEntryKindTimestamp is the time that the picture was taken, in
+	// milliseconds since the epoch.
+	SefEntryKindTimestamp
+
+	// SefEntryKindVideo is the video of a motion photo.
+	SefEntryKindVideo
+
+	// SefEntryKindShotInfo describes how the picture was taken (the camera
+	// mode, burst and dual-camera information, and so on).
+	SefEntryKindShotInfo
+
+	// SefEntryKindEditData is what the gallery's editor needs to revert or
+	// redo its edits.
+	SefEntryKindEditData
+
+	// SefEntryKindOriginalImage is a copy of the image from before it was
+	// edited.
+	SefEntryKindOriginalImage
+
+	// SefEntryKindDepthMap is the depth map of a dual-camera picture.
+	SefEntryKindDepthMap
+)
+
+// String returns a descriptive string.
+func (sek SefEntryKind) String() string {
+	switch sek {
+	case SefEntryKindUnknown:
+		return "Unknown"
+	case SefEntryKindTimestamp:
+		return "Timestamp"
+	case SefEntryKindVideo:
+		return "Video"
+	case SefEntryKindShotInfo:
+		return "ShotInfo"
+	case SefEntryKindEditData:
+		return "EditData"
+	case SefEntryKindOriginalImage:
+		return "OriginalImage"
+	case SefEntryKindDepthMap:
+		return "DepthMap"
+	}
+
+	return fmt.Sprintf("Unknown(%d)", int(sek))
+}
+
+// SefEntry is one entry of a Samsung (SEF) trailer.
+type SefEntry struct {
+	// Type is the type code of the entry.
+	Type uint16
+
+	// Name identifies the entry (e.g. "MotionPhoto_Data").
+	Name string
+
+	// Data is the content of the entry, after the name.
+	Data []byte
+}
+
+// String returns a descriptive string.
+func (se SefEntry) String() string {
+	return fmt.Sprintf("SefEntry<TYPE=(0x%04x) NAME=[%s] KIND=[%s] SIZE=(%d)>", se.Type, se.Name, se.Kind(), len(se.Data))
+}
+
+// Kind returns what the entry holds. The type codes aren't documented and
+// vary between devices, so this goes by the name.
+func (se SefEntry) Kind() SefEntryKind {
+	name := se.Name
+
+	switch {
+	case name == sefTimestampName:
+		return SefEntryKindTimestamp
+	case name == sefMotionPhotoName:
+		return SefEntryKindVideo
+	case strings.Contains(name, "Original_Image") == true:
+		return SefEntryKindOriginalImage
+	case strings.Contains(name, "Re_Edit") == true || name == "Original_Path_Hash_Key":
+		return SefEntryKindEditData
+	case strings.Contains(name, "DepthMap") == true:
+		return SefEntryKindDepthMap
+	case strings.HasSuffix(name, "_Info") == true || strings.HasSuffix(name, "_Meta") == true || name == "MCC_Data":
+		return SefEntryKindShotInfo
+	}
+
+	return SefEntryKindUnknown
+}
+
+// Timestamp returns the time of a timestamp entry.
+func (se SefEntry) Timestamp() (timestamp time.Time, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if se.Kind() != SefEntryKindTimestamp {
+		log.Panicf("SEF entry is not a timestamp: [%s]", se.Name)
+	}
+
+	milliseconds, err := strconv.ParseInt(strings.TrimRight(string(se.Data), "\000 "), 10, 64)
+	log.PanicIf(err)
+
+	return time.Unix(milliseconds/1000, (milliseconds%1000)*int64(time.Millisecond)).UTC(), nil
+}
+
+// SefTrailer is the directory that Samsung devices put at the end of the
+// file, and the blocks that it describes. Each block has a small header with
+// its type and name, and the directory (between "SEFH" and "SEFT") has the
+// type, the distance back from the directory, and the size of each block.
+type SefTrailer struct {
+	// Version is the version of the directory.
+	Version uint32
+
+	// Entries are the blocks, in the order that they're stored.
+	Entries []SefEntry
+}
+
+// parseSefTrailer parses the SEF directory at the end of the trailer and the
+// blocks that it describes. `start` is where the first block starts. `st` is
+// nil if the trailer doesn't end with a SEF directory.
+func parseSefTrailer(trailer []byte) (start int, st *SefTrailer, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if len(trailer) < 8 || bytes.HasSuffix(trailer, sefTrailerMagic) == false {
+		return 0, nil, nil
+	}
+
+	byteOrder := binary.LittleEndian
+
+	directorySize := int(byteOrder.Uint32(trailer[len(trailer)-8:]))
+	directoryOffset := len(trailer) - 8 - directorySize
+
+	if directorySize < 12 || directoryOffset < 0 || bytes.Equal(trailer[directoryOffset:directoryOffset+4], sefHeaderMagic) == false {
+		log.Panicf("SEF directory not valid: SIZE=(%d)", directorySize)
+	}
+
+	directory := trailer[directoryOffset : directoryOffset+directorySize]
+
+	st = &SefTrailer{
+		Version: byteOrder.Uint32(directory[4:8]),
+	}
+
+	count := int(byteOrder.Uint32(directory[8:12]))
+	if 12+count*sefRecordSize > len(directory) {
+		log.Panicf("SEF directory truncated: COUNT=(%d)", count)
+	}
+
+	type block struct {
+		offset int
+		entry  SefEntry
+	}
+
+	blocks := make([]block, count)
+	start = directoryOffset
+
+	for i := range blocks {
+		record := directory[12+i*sefRecordSize:]
+
+		recordType := byteOrder.Uint16(record[2:4])
+		distance := int(byteOrder.Uint32(record[4:8]))
+		size := int(byteOrder.Uint32(record[8:12]))
+
+		offset := directoryOffset - distance
+		if distance <= 0 || offset < 0 || size < sefBlockHeaderSize || offset+size > directoryOffset {
+			log.Panicf("SEF block (%d) out of bounds: OFFSET=(%d) SIZE=(%d)", i, offset, size)
+		}
+
+		// Copy the block so that the entries don't alias the trailer.
+		raw := make([]byte, size)
+		copy(raw, trailer[offset:offset+size])
+
+		nameLength := int(byteOrder.Uint32(raw[4:8]))
+		if sefBlockHeaderSize+nameLength > size {
+			log.Panicf("SEF block (%d) name out of bounds: (%d)", i, nameLength)
+		}
+
+		if blockType := byteOrder.Uint16(raw[2:4]); blockType != recordType {
+			log.Panicf("SEF block (%d) type not consistent with the directory: (0x%04x) != (0x%04x)", i, blockType, recordType)
+		}
+
+		blocks[i] = block{
+			offset: offset,
+			entry: SefEntry{
+				Type: recordType,
+				Name: string(raw[sefBlockHeaderSize : sefBlockHeaderSize+nameLength]),
+				Data: raw[sefBlockHeaderSize+nameLength:],
+			},
+		}
+
+		if offset < start {
+			start = offset
+		}
+	}
+
+	sort.SliceStable(blocks, func(i, j int) bool {
+		return blocks[i].offset < blocks[j].offset
+	})
+
+	st.Entries = make([]SefEntry, len(blocks))
+	for i, b := range blocks {
+		st.Entries[i] = b.entry
+	}
+
+	return start, st, nil
+}
+
+// String returns a descriptive string.
+func (st *SefTrailer) String() string {
+	return fmt.Sprintf("SefTrailer<VERSION=(%d) ENTRIES=(%d)>", st.Version, len(st.Entries))
+}
+
+// Find returns the index of the first entry with the given name, or (-1).
+func (st *SefTrailer) Find(name string) int {
+	for i, se := range st.Entries {
+		if se.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Drop removes the entries that match and returns them.
+func (st *SefTrailer) Drop(matches func(se SefEntry) bool) (dropped []SefEntry) {
+	kept := make([]SefEntry, 0, len(st.Entries))
+	dropped = make([]SefEntry, 0)
+
+	for _, se := range st.Entries {
+		if matches(se) == true {
+			dropped = append(dropped, se)
+		} else {
+			kept = append(kept, se)
+		}
+	}
+
+	st.Entries = kept
+
+	return dropped
+}
+
+// dataOffset returns where the data of the given entry will be in what
+// `Encode` returns.
+func (st *SefTrailer) dataOffset(entryIndex int) int {
+	offset := 0
+	for _, se := range st.Entries[:entryIndex] {
+		offset += sefBlockHeaderSize + len(se.Name) + len(se.Data)
+	}
+
+	return offset + sefBlockHeaderSize + len(st.Entries[entryIndex].Name)
+}
+
+// Encode returns the blocks, in order, followed by the directory. The
+// distances in the directory are calculated from where the blocks end up.
+func (st *SefTrailer) Encode() []byte {
+	byteOrder := binary.LittleEndian
+
+	b := new(bytes.Buffer)
+	offsets := make([]int, len(st.Entries))
+
+	for i, se := range st.Entries {
+		offsets[i] = b.Len()
+
+		binary.Write(b, byteOrder, []uint16{0, se.Type})
+		binary.Write(b, byteOrder, uint32(len(se.Name)))
+		b.WriteString(se.Name)
+		b.Write(se.Data)
+	}
+
+	directoryOffset := b.Len()
+
+	b.Write(sefHeaderMagic)
+	binary.Write(b, byteOrder, []uint32{st.Version, uint32(len(st.Entries))})
+
+	for i, se := range st.Entries {
+		size := sefBlockHeaderSize + len(se.Name) + len(se.Data)
+
+		binary.Write(b, byteOrder, []uint16{0, se.Type})
+		binary.Write(b, byteOrder, []uint32{uint32(directoryOffset - offsets[i]), uint32(size)})
+	}
+
+	binary.Write(b, byteOrder, uint32(b.Len()-directoryOffset))
+	b.Write(sefTrailerMagic)
+
+	return b.Bytes()
+}
+
+// SefTrailer parses the SEF directory at the end of the trailer, which Samsung
+// devices use for the video of a motion photo, information about the shot,
+// and the data of the gallery's editor. `ErrNoSefTrailer` is returned if
+// there isn't one.
+func (sl *SegmentList) SefTrailer() (st *SefTrailer, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	_, st, err = parseSefTrailer(sl.trailer)
+	log.PanicIf(err)
+
+	if st == nil {
+		return nil, ErrNoSefTrailer
+	}
+
+	return st, nil
+}
+
+// SetSefTrailer replaces the SEF blocks and directory at the end of the
+// trailer, or appends them if there aren't any. If `st` is nil or has no
+// entries, they're removed. Whatever precedes them in the trailer is kept.
+//
+// The blocks are written back to back in the order of the entries (which
+// `SefTrailer` returns sorted by offset), so any bytes that were between
+// blocks in the original are dropped. The blocks are addressed from the
+// directory, so the distances are recalculated. If the video of a motion photo is in the trailer, the XMP
+// that locates it is updated, and the MPF index is rewritten since the size of
+// the XMP might change. This should be done after any other changes to the
+// segments.
+func (sl *SegmentList) SetSefTrailer(st *SefTrailer) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	// The SEF blocks are after the MPF images, if there are any, so only
+	// the remainder changes.
+
+	mi, images, remainder, err := sl.mpfImages()
+	if err == ErrNoMpf {
+		remainder = sl.trailer
+	} else if err != nil {
+		log.Panic(err)
+	}
+
+	imagesSize := len(sl.trailer) - len(remainder)
+
+	sefStart, original, err := parseSefTrailer(remainder)
+	log.PanicIf(err)
+
+	updated := make([]byte, 0)
+	if original != nil {
+		updated = append(updated, remainder[:sefStart]...)
+	} else {
+		updated = append(updated, remainder...)
+	}
+
+	base := len(updated)
+
+	if st != nil && len(st.Entries) > 0 {
+		updated = append(updated, st.Encode()...)
+	}
+
+	if original != nil && original.Find(sefMotionPhotoName) >= 0 {
+		i := -1
+		if st != nil {
+			i = st.Find(sefMotionPhotoName)
+		}
+
+		if i < 0 {
+			err := sl.updateMotionPhotoXmp(true, 0)
+			log.PanicIf(err)
+		} else {
+			start := imagesSize + base + st.dataOffset(i)
+			end := start + len(st.Entries[i].Data)
+
+			err := sl.relocateMotionPhotoXmp(start, end, imagesSize+len(updated))
+			log.PanicIf(err)
+		}
+	}
+
+	if mi != nil {
+		err := sl.setMpfImages(mi.Entries, images, updated)
+		log.PanicIf(err)
+	} else {
+		sl.trailer = updated
+	}
+
+	return nil
+}
+
+// DropSefEntries removes the SEF entries that match and returns them. If
+// that leaves no entries, the SEF directory is removed, too. Nothing is
+// returned if there's no SEF trailer.
+func (sl *SegmentList) DropSefEntries(matches func(se SefEntry) bool) (dropped []SefEntry, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	st, err := sl.SefTrailer()
+	if err != nil {
+		if err == ErrNoSefTrailer {
+			return []SefEntry{}, nil
+		}
+
+		log.Panic(err)
+	}
+
+	dropped = st.Drop(matches)
+	if len(dropped) == 0 {
+		return dropped, nil
+	}
+
+	err = sl.SetSefTrailer(st)
+	log.PanicIf(err)
+
+	return dropped, nil
+}
@@ -0,0 +1,389 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dsoprea/go-logging"
+)
+
+// sefTestTrailer is a SEF trailer with two blocks, written by hand.
+var sefTestTrailer = []byte(
+	// Block 0: type 0x0a01, "Image_UTC_Data", "1600000000000".
+	"\x00\x00\x01\x0a\x0e\x00\x00\x00Image_UTC_Data1600000000000" +
+		// Block 1: type 0x0a30, "MotionPhoto_Data", "video".
+		"\x00\x00\x30\x0a\x10\x00\x00\x00MotionPhoto_Datavideo" +
+		// The directory.
+		"SEFH\x6b\x00\x00\x00\x02\x00\x00\x00" +
+		"\x00\x00\x01\x0a\x40\x00\x00\x00\x23\x00\x00\x00" +
+		"\x00\x00\x30\x0a\x1d\x00\x00\x00\x1d\x00\x00\x00" +
+		"\x24\x00\x00\x00SEFT")
+
+func TestParseSefTrailer(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	trailer := append([]byte("prefix"), sefTestTrailer...)
+
+	start, st, err := parseSefTrailer(trailer)
+	log.PanicIf(err)
+
+	expected := []SefEntry{
+		{Type: 0x0a01, Name: "Image_UTC_Data", Data: []byte("1600000000000")},
+		{Type: 0x0a30, Name: "MotionPhoto_Data", Data: []byte("video")},
+	}
+
+	if start != 6 {
+		t.Fatalf("Start not correct: (%d)", start)
+	} else if st.Version != 0x6b {
+		t.Fatalf("Version not correct: (%d)", st.Version)
+	} else if reflect.DeepEqual(st.Entries, expected) != true {
+		t.Fatalf("Entries not correct: %v", st.Entries)
+	} else if st.Find("MotionPhoto_Data") != 1 || st.Find("Missing") != -1 {
+		t.Fatalf("find not correct.")
+	} else if st.Entries[1].String() != "SefEntry<TYPE=(0x0a30) NAME=[MotionPhoto_Data] KIND=[Video] SIZE=(5)>" {
+		t.Fatalf("String not correct: [%s]", st.Entries[1])
+	}
+
+	if bytes.Equal(st.Encode(), sefTestTrailer) != true {
+		t.Fatalf("Encoding not correct.")
+	}
+
+	// The data is a copy.
+
+	st.Entries[1].Data[0] = 'V'
+
+	if bytes.Equal(trailer[6:], sefTestTrailer) != true {
+		t.Fatalf("Trailer was changed through the entry data.")
+	}
+}
+
+func TestParseSefTrailer_NotSef(t *testing.T) {
+	for _, trailer := range [][]byte{nil, []byte("SEFT"), []byte("private trailer")} {
+		if start, st, err := parseSefTrailer(trailer); err != nil || st != nil || start != 0 {
+			t.Fatalf("Expected no SEF trailer: %v %v", st, err)
+		}
+	}
+}
+
+func TestParseSefTrailer_Invalid(t *testing.T) {
+	// The size of the directory is too large.
+
+	trailer := append([]byte{}, sefTestTrailer...)
+	trailer[len(trailer)-8] = 0xff
+
+	if _, _, err := parseSefTrailer(trailer); err == nil {
+		t.Fatalf("Expected error for a bad directory size.")
+	}
+
+	// A block is out of bounds.
+
+	trailer = append([]byte{}, sefTestTrailer...)
+	recordOffset := bytes.Index(trailer, []byte("SEFH")) + 12
+
+	trailer[recordOffset+4] = 0xff
+
+	if _, _, err := parseSefTrailer(trailer); err == nil {
+		t.Fatalf("Expected error for a bad block offset.")
+	}
+}
+
+func TestSefEntry_Kind(t *testing.T) {
+	expected := map[string]SefEntryKind{
+		"Image_UTC_Data":             SefEntryKindTimestamp,
+		"MotionPhoto_Data":           SefEntryKindVideo,
+		"Original_Image":             SefEntryKindOriginalImage,
+		"Photo_Editor_Re_Edit_Data":  SefEntryKindEditData,
+		"Original_Path_Hash_Key":     SefEntryKindEditData,
+		"DualShot_DepthMap_1":        SefEntryKindDepthMap,
+		"Camera_Capture_Mode_Info":   SefEntryKindShotInfo,
+		"DualShot_Meta":              SefEntryKindShotInfo,
+		"MCC_Data":                   SefEntryKindShotInfo,
+		"Something_Else_Entirely":    SefEntryKindUnknown,
+		"Background_Original_Image":  SefEntryKindOriginalImage,
+		"PhotoEditor_Re_Edit_Data":   SefEntryKindEditData,
+		"Burst_Shot_Info":            SefEntryKindShotInfo,
+		"Color_Display_P3_Something": SefEntryKindUnknown,
+	}
+
+	for name, kind := range expected {
+		if actual := (SefEntry{Name: name}).Kind(); actual != kind {
+			t.Fatalf("Kind of [%s] not correct: [%s] != [%s]", name, actual, kind)
+		}
+	}
+
+	if SefEntryKindEditData.String() != "EditData" || SefEntryKind(99).String() != "Unknown(99)" {
+		t.Fatalf("String not correct.")
+	}
+}
+
+func TestSefEntry_Timestamp(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	se := SefEntry{Name: "Image_UTC_Data", Data: []byte("1600000000123")}
+
+	timestamp, err := se.Timestamp()
+	log.PanicIf(err)
+
+	if timestamp.Equal(time.Date(2020, 9, 13, 12, 26, 40, 123000000, time.UTC)) != true {
+		t.Fatalf("Timestamp not correct: [%s]", timestamp)
+	}
+
+	if _, err := (SefEntry{Name: "MCC_Data", Data: []byte("1")}).Timestamp(); err == nil {
+		t.Fatalf("Expected error for an entry that isn't a timestamp.")
+	}
+}
+
+func TestSefTrailer_Drop(t *testing.T) {
+	_, st, err := parseSefTrailer(sefTestTrailer)
+	log.PanicIf(err)
+
+	dropped := st.Drop(func(se SefEntry) bool {
+		return se.Kind() == SefEntryKindTimestamp
+	})
+
+	if len(dropped) != 1 || dropped[0].Name != "Image_UTC_Data" {
+		t.Fatalf("Dropped entries not correct: %v", dropped)
+	} else if len(st.Entries) != 1 || st.Entries[0].Name != "MotionPhoto_Data" {
+		t.Fatalf("Kept entries not correct: %v", st.Entries)
+	} else if st.String() != "SefTrailer<VERSION=(107) ENTRIES=(1)>" {
+		t.Fatalf("String not correct: [%s]", st)
+	}
+
+	// The directory points at the blocks where they are now.
+
+	_, reparsed, err := parseSefTrailer(st.Encode())
+	log.PanicIf(err)
+
+	if reflect.DeepEqual(reparsed.Entries, st.Entries) != true {
+		t.Fatalf("Reparsed entries not correct: %v", reparsed.Entries)
+	}
+}
+
+// getSefTestSegmentList returns an image with an older motion-photo offset
+// and a SEF trailer that has the video between an original image and some
+// edit data.
+func getSefTestSegmentList() (sl *SegmentList, video []byte) {
+	video = getMotionPhotoTestVideo(100)
+
+	st := &SefTrailer{
+		Version: sefDefaultVersion,
+		Entries: []SefEntry{
+			{Type: 0x0001, Name: "Image_UTC_Data", Data: []byte("1600000000000")},
+			{Type: 0x0bd1, Name: "Original_Image", Data: getTestGeneratedJpeg(16, 16, false)},
+			{Type: sefMotionPhotoType, Name: sefMotionPhotoName, Data: video},
+			{Type: 0x0ba1, Name: "Photo_Editor_Re_Edit_Data", Data: []byte("{\"rotate\":90}")},
+		},
+	}
+
+	encoded := st.Encode()
+	offset := len(encoded) - st.dataOffset(2)
+
+	data := getAuxiliaryImageTestJpeg(32, 32, false, fmt.Sprintf(motionPhotoTestMicroVideoPacket, offset))
+
+	sl = getCoefficientsTestSegmentList(data)
+	sl.SetTrailer(append([]byte("prefix"), encoded...))
+
+	return sl, video
+}
+
+func TestSegmentList_SefTrailer(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl, _ := getSefTestSegmentList()
+
+	st, err := sl.SefTrailer()
+	log.PanicIf(err)
+
+	if len(st.Entries) != 4 || st.Entries[1].Kind() != SefEntryKindOriginalImage {
+		t.Fatalf("Entries not correct: %v", st.Entries)
+	}
+
+	sl = getSanitizeTestSegmentList()
+
+	if _, err := sl.SefTrailer(); err != ErrNoSefTrailer {
+		t.Fatalf("Expected no SEF trailer: %v", err)
+	}
+}
+
+func TestSegmentList_DropSefEntries(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl, video := getSefTestSegmentList()
+
+	// Both the SEF video and the older offset find the same video to start
+	// with.
+
+	mp, err := sl.MotionPhoto()
+	log.PanicIf(err)
+
+	if bytes.Equal(mp.Video, video) != true {
+		t.Fatalf("Video not correct.")
+	}
+
+	dropped, err := sl.DropSefEntries(func(se SefEntry) bool {
+		return se.Kind() == SefEntryKindOriginalImage || se.Kind() == SefEntryKindEditData
+	})
+
+	log.PanicIf(err)
+
+	if len(dropped) != 2 || dropped[0].Name != "Original_Image" || dropped[1].Name != "Photo_Editor_Re_Edit_Data" {
+		t.Fatalf("Dropped entries not correct: %v", dropped)
+	}
+
+	sl, _ = reparseSegmentList(sl)
+
+	st, err := sl.SefTrailer()
+	log.PanicIf(err)
+
+	if len(st.Entries) != 2 || st.Entries[0].Name != "Image_UTC_Data" || bytes.Equal(st.Entries[1].Data, video) != true {
+		t.Fatalf("Kept entries not correct: %v", st.Entries)
+	} else if bytes.HasPrefix(sl.Trailer(), []byte("prefix")) != true {
+		t.Fatalf("Trailer prefix not kept.")
+	}
+
+	// The older offset was moved along with the video.
+
+	xd, _ := getMotionPhotoTestXmp(sl)
+
+	raw, _ := xd.property(xmpNamespaceGCamera, "MicroVideoOffset")
+
+	trailer := sl.Trailer()
+	if expected := len(trailer) - bytes.Index(trailer, video); raw != fmt.Sprintf("%d", expected) {
+		t.Fatalf("Offset not correct: [%s] != (%d)", raw, expected)
+	}
+
+	// Nothing else matches.
+
+	dropped, err = sl.DropSefEntries(func(se SefEntry) bool {
+		return se.Kind() == SefEntryKindOriginalImage
+	})
+
+	log.PanicIf(err)
+
+	if len(dropped) != 0 {
+		t.Fatalf("Expected nothing to be dropped: %v", dropped)
+	}
+
+	// Dropping the video removes its XMP, too.
+
+	_, err = sl.DropSefEntries(func(se SefEntry) bool {
+		return se.Kind() == SefEntryKindVideo
+	})
+
+	log.PanicIf(err)
+
+	xd, _ = getMotionPhotoTestXmp(sl)
+
+	if _, found := xd.property(xmpNamespaceGCamera, "MicroVideoOffset"); found == true {
+		t.Fatalf("Offset not removed.")
+	}
+
+	// Dropping everything removes the directory.
+
+	_, err = sl.DropSefEntries(func(se SefEntry) bool {
+		return true
+	})
+
+	log.PanicIf(err)
+
+	if bytes.Equal(sl.Trailer(), []byte("prefix")) != true {
+		t.Fatalf("Trailer not correct: [%s]", sl.Trailer())
+	}
+
+	dropped, err = sl.DropSefEntries(func(se SefEntry) bool {
+		return true
+	})
+
+	log.PanicIf(err)
+
+	if len(dropped) != 0 {
+		t.Fatalf("Expected nothing to be dropped without a SEF trailer.")
+	}
+}
+
+func TestSegmentList_SetSefTrailer_Mpf(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	// The MPF images come before the SEF trailer and are kept where they
+	// can be found even though the XMP changes size.
+
+	sl, gainMap := getUltraHdrTestSegmentList()
+
+	_, st, err := parseSefTrailer(sefTestTrailer)
+	log.PanicIf(err)
+
+	sl.SetTrailer(append(sl.Trailer(), sefTestTrailer...))
+
+	err = sl.SetSefTrailer(st)
+	log.PanicIf(err)
+
+	video := getMotionPhotoTestVideo(100)
+
+	err = sl.SetMotionPhoto(video)
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	data, err := sl.MpfImage(1)
+	log.PanicIf(err)
+
+	if bytes.Equal(data, gainMap) != true {
+		t.Fatalf("MPF image not correct.")
+	}
+
+	mp, err := sl.MotionPhoto()
+	log.PanicIf(err)
+
+	if mp.Format != MotionPhotoFormatSamsung || bytes.Equal(mp.Video, video) != true {
+		t.Fatalf("Video not correct: %s", mp)
+	}
+
+	err = sl.SetSefTrailer(nil)
+	log.PanicIf(err)
+
+	if bytes.Equal(sl.Trailer(), gainMap) != true {
+		t.Fatalf("Trailer not correct.")
+	}
+
+	// A new trailer is appended.
+
+	err = sl.SetSefTrailer(st)
+	log.PanicIf(err)
+
+	if bytes.HasSuffix(sl.Trailer(), st.Encode()) != true || bytes.HasPrefix(sl.Trailer(), gainMap) != true {
+		t.Fatalf("Trailer not appended.")
+	}
+}
@@ -40,30 +40,11 @@ var (
 	// ErrNoPhotoshopData is returned if Photoshop info was requested but not
 	// found.
 	ErrNoPhotoshopData = errors.New("no photoshop data")
-)
-
-// SofSegment has info read from a SOF segment.
-type SofSegment struct {
-	// BitsPerSample is the bits-per-sample.
-	BitsPerSample byte
-
-	// Width is the image width.
-	Width uint16
-
-	// Height is the image height.
-	Height uint16
-
-	// ComponentCount is the number of color components.
-	ComponentCount byte
-}
-
-// String returns a string representation of the SOF segment.
-func (ss SofSegment) String() string {
 
-	// TODO(dustin): Add test
-
-	return fmt.Sprintf("SOF<BitsPerSample=(%d) Width=(%d) Height=(%d) ComponentCount=(%d)>", ss.BitsPerSample, ss.Width, ss.Height, ss.ComponentCount)
-}
+	// ErrExifTooLarge is returned if the encoded EXIF data won't fit in one
+	// APP1 segment.
+	ErrExifTooLarge = errors.New("EXIF too large for one segment")
+)
 
 // SegmentVisitor describes a segment-visitor struct.
 type SegmentVisitor interface {
@@ -105,6 +86,11 @@ func (s *Segment) SetExif(ib *exif.IfdBuilder) (err error) {
 
 	l := len(exifPrefix)
 
+	// The segment is left as it was if the data doesn't fit.
+	if l+len(exifData) > maxSegmentPayloadSize {
+		log.Panic(ErrExifTooLarge)
+	}
+
 	s.Data = make([]byte, l+len(exifData))
 	copy(s.Data[0:], exifPrefix)
 	copy(s.Data[l:], exifData)
@@ -222,6 +208,21 @@ func (s *Segment) IsXmp() bool {
 	return true
 }
 
+// IsAdobe returns true if an Adobe APP14 segment.
+func (s *Segment) IsAdobe() bool {
+	return s.MarkerId == MARKER_APP14 && len(s.Data) >= adobeSegmentSize && bytes.HasPrefix(s.Data, adobePrefix) == true
+}
+
+// IsIccProfile returns true if the segment has a chunk of an ICC profile.
+func (s *Segment) IsIccProfile() bool {
+	return s.MarkerId == MARKER_APP2 && len(s.Data) >= len(iccProfilePrefix)+2 && bytes.HasPrefix(s.Data, iccProfilePrefix) == true
+}
+
+// IsMpf returns true if the segment has the MPF (multi-picture) header.
+func (s *Segment) IsMpf() bool {
+	return s.MarkerId == MARKER_APP2 && bytes.HasPrefix(s.Data, mpfPrefix) == true
+}
+
 // FormattedXmp returns a formatted XML string. This only makes sense for a
 // segment comprised of XML data (like XMP).
 func (s *Segment) FormattedXmp() (formatted string, err error) {
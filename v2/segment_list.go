@@ -17,6 +17,9 @@ import (
 // SegmentList contains a slice of segments.
 type SegmentList struct {
 	segments []*Segment
+
+	// trailer is whatever followed the EOI marker.
+	trailer []byte
 }
 
 // NewSegmentList returns a new SegmentList struct.
@@ -56,6 +59,36 @@ func (sl *SegmentList) Add(s *Segment) {
 	sl.segments = append(sl.segments, s)
 }
 
+// clone returns a copy of the list whose segments can be changed or replaced
+// without affecting this one. The segment data isn't copied, since it's
+// always replaced rather than changed in place.
+func (sl *SegmentList) clone() *SegmentList {
+	segments := make([]*Segment, len(sl.segments))
+	for i, s := range sl.segments {
+		copied := *s
+		segments[i] = &copied
+	}
+
+	cloned := &SegmentList{
+		segments: segments,
+		trailer:  sl.trailer,
+	}
+
+	return cloned
+}
+
+// Trailer returns the data that follows the EOI marker, if any. Some formats
+// (e.g. MPF) store additional images there.
+func (sl *SegmentList) Trailer() []byte {
+	return sl.trailer
+}
+
+// SetTrailer sets the data to be written after the EOI marker. Passing nil
+// drops it.
+func (sl *SegmentList) SetTrailer(trailer []byte) {
+	sl.trailer = trailer
+}
+
 // Print prints segment info.
 func (sl *SegmentList) Print() {
 	if len(sl.segments) == 0 {
@@ -196,6 +229,36 @@ func (sl *SegmentList) FindIptc() (index int, segment *Segment, err error) {
 	return -1, nil, ErrNoIptc
 }
 
+// FindAdobe returns the the Adobe APP14 segment (if present).
+func (sl *SegmentList) FindAdobe() (index int, segment *Segment, err error) {
+	for i, s := range sl.segments {
+		if s.IsAdobe() == true {
+			return i, s, nil
+		}
+	}
+
+	return -1, nil, ErrNoAdobe
+}
+
+// Adobe returns the parsed Adobe APP14 segment (if present).
+func (sl *SegmentList) Adobe() (as *AdobeSegment, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	_, s, err := sl.FindAdobe()
+	if err != nil {
+		return nil, err
+	}
+
+	as, err = ParseAdobeSegment(s.Data)
+	log.PanicIf(err)
+
+	return as, nil
+}
+
 // Exif returns an `exif.Ifd` instance for the EXIF data we currently have.
 func (sl *SegmentList) Exif() (rootIfd *exif.Ifd, rawExif []byte, err error) {
 	defer func() {
@@ -318,6 +381,10 @@ func (sl *SegmentList) SetExif(ib *exif.IfdBuilder) (err error) {
 
 		s = makeEmptyExifSegment()
 
+		// Only install the new segment once we know the EXIF fits in it.
+		err = s.SetExif(ib)
+		log.PanicIf(err)
+
 		prefix := sl.segments[:1]
 
 		// Install it near the beginning where we know it's safe. We can't
@@ -326,6 +393,8 @@ func (sl *SegmentList) SetExif(ib *exif.IfdBuilder) (err error) {
 		tail := append([]*Segment{s}, sl.segments[1:]...)
 
 		sl.segments = append(prefix, tail...)
+
+		return nil
 	}
 
 	err = s.SetExif(ib)
@@ -358,7 +427,150 @@ func (sl *SegmentList) DropExif() (wasDropped bool, err error) {
 	return false, nil
 }
 
-// Write writes the segment data to the given `io.Writer`.
+// ExifThumbnail returns the JPEG thumbnail stored in the second IFD, both
+// parsed and as raw bytes. `exif.ErrNoThumbnail` is returned if there's EXIF
+// but no thumbnail.
+func (sl *SegmentList) ExifThumbnail() (thumbnailSl *SegmentList, data []byte, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	rootIfd, _, err := sl.Exif()
+	if err != nil {
+		if log.Is(err, exif.ErrNoExif) == true {
+			return nil, nil, err
+		}
+
+		log.Panic(err)
+	}
+
+	nextIfd := rootIfd.NextIfd()
+	if nextIfd == nil {
+		return nil, nil, exif.ErrNoThumbnail
+	}
+
+	data, err = nextIfd.Thumbnail()
+	if err != nil {
+		if log.Is(err, exif.ErrNoThumbnail) == true {
+			return nil, nil, err
+		}
+
+		log.Panic(err)
+	}
+
+	jmp := NewJpegMediaParser()
+
+	intfc, err := jmp.ParseBytes(data)
+	log.PanicIf(err)
+
+	thumbnailSl = intfc.(*SegmentList)
+
+	return thumbnailSl, data, nil
+}
+
+// SetExifThumbnail stores the given JPEG as the EXIF thumbnail, replacing any
+// existing one. The second IFD is created if there isn't one and EXIF is
+// created if there isn't any. `ErrExifTooLarge` is returned (and nothing is
+// changed) if the EXIF would no longer fit in its segment.
+func (sl *SegmentList) SetExifThumbnail(data []byte) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	jmp := NewJpegMediaParser()
+
+	_, err = jmp.ParseBytes(data)
+	if err != nil {
+		log.Panicf("thumbnail is not a valid JPEG: %s", err.Error())
+	}
+
+	rootIb, err := sl.ConstructExifBuilder()
+	log.PanicIf(err)
+
+	nextIb, err := rootIb.NextIb()
+	log.PanicIf(err)
+
+	if nextIb == nil {
+		var byteOrder binary.ByteOrder = exifcommon.EncodeDefaultByteOrder
+
+		_, rawExif, err := sl.Exif()
+		if err == nil {
+			eh, err := exif.ParseExifHeader(rawExif)
+			log.PanicIf(err)
+
+			byteOrder = eh.ByteOrder
+		} else if log.Is(err, exif.ErrNoExif) == false {
+			log.Panic(err)
+		}
+
+		im, err := exifcommon.NewIfdMappingWithStandard()
+		log.PanicIf(err)
+
+		ti := exif.NewTagIndex()
+
+		nextIb = exif.NewIfdBuilder(im, ti, exifcommon.IfdStandardIfdIdentity, byteOrder)
+
+		err = rootIb.SetNextIb(nextIb)
+		log.PanicIf(err)
+	}
+
+	// Compression 6 is "JPEG (old-style)", which is what thumbnails use.
+	err = nextIb.SetStandardWithName("Compression", []uint16{6})
+	log.PanicIf(err)
+
+	err = nextIb.SetThumbnail(data)
+	log.PanicIf(err)
+
+	err = sl.SetExif(rootIb)
+	log.PanicIf(err)
+
+	return nil
+}
+
+// DropExifThumbnail drops the thumbnail along with the IFD that describes it.
+// The IFD is dropped even if the thumbnail it points to is missing or broken.
+// Nothing is done (and `false` is returned) if there's no EXIF or second IFD.
+func (sl *SegmentList) DropExifThumbnail() (wasDropped bool, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	rootIfd, _, err := sl.Exif()
+	if err != nil {
+		if log.Is(err, exif.ErrNoExif) == true {
+			return false, nil
+		}
+
+		log.Panic(err)
+	}
+
+	// A broken thumbnail can still be dropped, so we don't look at it.
+	if rootIfd.NextIfd() == nil {
+		return false, nil
+	}
+
+	rootIb, err := sl.ConstructExifBuilder()
+	log.PanicIf(err)
+
+	err = rootIb.SetNextIb(nil)
+	log.PanicIf(err)
+
+	err = sl.SetExif(rootIb)
+	log.PanicIf(err)
+
+	return true, nil
+}
+
+// Write writes the segment data to the given `io.Writer`, followed by any data
+// that came after the EOI marker (see `Trailer`), so that an image is written
+// back with everything that it was parsed with. Call `SetTrailer` with nil
+// first to leave it out.
 func (sl *SegmentList) Write(w io.Writer) (err error) {
 	defer func() {
 		if state := recover(); state != nil {
@@ -412,5 +624,33 @@ func (sl *SegmentList) Write(w io.Writer) (err error) {
 		offset += len(s.Data)
 	}
 
+	_, err = w.Write(sl.trailer)
+	log.PanicIf(err)
+
 	return nil
 }
+
+// encodedOffsets returns the offset that each segment will be written at and
+// the size of everything up to the trailer.
+func (sl *SegmentList) encodedOffsets() (offsets []int, size int) {
+	offsets = make([]int, len(sl.segments))
+
+	for i, s := range sl.segments {
+		offsets[i] = size
+
+		if s.MarkerId != 0 {
+			size += 2
+
+			sizeLen, found := markerLen[s.MarkerId]
+			if found == false || sizeLen == 2 {
+				size += 2
+			} else {
+				size += sizeLen
+			}
+		}
+
+		size += len(s.Data)
+	}
+
+	return offsets, size
+}
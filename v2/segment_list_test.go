@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"io/ioutil"
+	"path"
 
 	"github.com/dsoprea/go-exif/v3"
 	"github.com/dsoprea/go-exif/v3/common"
@@ -598,3 +599,301 @@ func TestSegmentList_Validate(t *testing.T) {
 		log.Panic(err)
 	}
 }
+
+func TestSegmentList_ExifThumbnail(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	assetsPath := GetTestAssetsPath()
+	filepath := path.Join(assetsPath, "20180428_212314.jpg")
+
+	jmp := NewJpegMediaParser()
+
+	intfc, err := jmp.ParseFile(filepath)
+	log.PanicIf(err)
+
+	sl := intfc.(*SegmentList)
+
+	thumbnailSl, data, err := sl.ExifThumbnail()
+	log.PanicIf(err)
+
+	if len(data) != 18318 {
+		t.Fatalf("Thumbnail size not correct: (%d)", len(data))
+	}
+
+	coefficients, err := thumbnailSl.ReadCoefficients()
+	log.PanicIf(err)
+
+	fh := coefficients.Frame
+
+	if fh.Width != 480 || fh.Height != 272 {
+		t.Fatalf("Thumbnail dimensions not correct: (%d)x(%d)", fh.Width, fh.Height)
+	}
+}
+
+func TestSegmentList_ExifThumbnail_NoExif(t *testing.T) {
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(16, 16, false))
+
+	_, _, err := sl.ExifThumbnail()
+	if err == nil {
+		t.Fatalf("Expected error for no EXIF.")
+	} else if log.Is(err, exif.ErrNoExif) == false {
+		log.Panic(err)
+	}
+
+	wasDropped, err := sl.DropExifThumbnail()
+	log.PanicIf(err)
+
+	if wasDropped != false {
+		t.Fatalf("Expected nothing to be dropped.")
+	}
+}
+
+func TestSegmentList_SetExifThumbnail(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(64, 48, false))
+
+	rootIb, err := sl.ConstructExifBuilder()
+	log.PanicIf(err)
+
+	err = rootIb.AddStandardWithName("ProcessingSoftware", "some software")
+	log.PanicIf(err)
+
+	err = sl.SetExif(rootIb)
+	log.PanicIf(err)
+
+	// There's EXIF but only the one IFD.
+
+	_, _, err = sl.ExifThumbnail()
+	if err == nil {
+		t.Fatalf("Expected error for no thumbnail.")
+	} else if log.Is(err, exif.ErrNoThumbnail) == false {
+		log.Panic(err)
+	}
+
+	// Add one and then replace it.
+
+	for _, width := range []int{16, 24} {
+		thumbnail := getTestGeneratedJpeg(width, 12, false)
+
+		err = sl.SetExifThumbnail(thumbnail)
+		log.PanicIf(err)
+
+		sl, _ = reparseSegmentList(sl)
+
+		thumbnailSl, data, err := sl.ExifThumbnail()
+		log.PanicIf(err)
+
+		if bytes.Equal(data, thumbnail) != true {
+			t.Fatalf("Thumbnail not correct for width (%d).", width)
+		}
+
+		coefficients, err := thumbnailSl.ReadCoefficients()
+		log.PanicIf(err)
+
+		if fh := coefficients.Frame; int(fh.Width) != width {
+			t.Fatalf("Thumbnail width not correct: (%d)", fh.Width)
+		}
+
+		rootIfd, _, err := sl.Exif()
+		log.PanicIf(err)
+
+		_, err = rootIfd.FindTagWithName("ProcessingSoftware")
+		log.PanicIf(err)
+
+		results, err := rootIfd.NextIfd().FindTagWithName("Compression")
+		log.PanicIf(err)
+
+		value, err := results[0].Value()
+		log.PanicIf(err)
+
+		if reflect.DeepEqual(value, []uint16{6}) != true {
+			t.Fatalf("Compression not correct: %v", value)
+		}
+	}
+
+	// Drop it.
+
+	wasDropped, err := sl.DropExifThumbnail()
+	log.PanicIf(err)
+
+	if wasDropped != true {
+		t.Fatalf("Expected the thumbnail to be dropped.")
+	}
+
+	sl, _ = reparseSegmentList(sl)
+
+	_, _, err = sl.ExifThumbnail()
+	if err == nil {
+		t.Fatalf("Expected error for no thumbnail after drop.")
+	} else if log.Is(err, exif.ErrNoThumbnail) == false {
+		log.Panic(err)
+	}
+
+	rootIfd, _, err := sl.Exif()
+	log.PanicIf(err)
+
+	_, err = rootIfd.FindTagWithName("ProcessingSoftware")
+	log.PanicIf(err)
+
+	wasDropped, err = sl.DropExifThumbnail()
+	log.PanicIf(err)
+
+	if wasDropped != false {
+		t.Fatalf("Expected nothing to be dropped the second time.")
+	}
+}
+
+func TestSegmentList_SetExifThumbnail_FromScratch(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(64, 48, false))
+	thumbnail := getTestGeneratedJpeg(16, 12, false)
+
+	err := sl.SetExifThumbnail(thumbnail)
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	_, data, err := sl.ExifThumbnail()
+	log.PanicIf(err)
+
+	if bytes.Equal(data, thumbnail) != true {
+		t.Fatalf("Thumbnail not correct.")
+	}
+}
+
+func TestSegmentList_SetExifThumbnail_Invalid(t *testing.T) {
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(64, 48, false))
+
+	err := sl.SetExifThumbnail([]byte("not a JPEG"))
+	if err == nil {
+		t.Fatalf("Expected error for invalid thumbnail.")
+	}
+
+	// Too big for the segment. Nothing should change.
+
+	thumbnail := getTestGeneratedJpeg(600, 600, false)
+	if len(thumbnail) <= maxSegmentPayloadSize {
+		t.Fatalf("Test thumbnail not large enough: (%d)", len(thumbnail))
+	}
+
+	err = sl.SetExifThumbnail(getTestGeneratedJpeg(16, 12, false))
+	log.PanicIf(err)
+
+	_, s, err := sl.FindExif()
+	log.PanicIf(err)
+
+	original := s.Data
+
+	err = sl.SetExifThumbnail(thumbnail)
+	if err == nil {
+		t.Fatalf("Expected error for large thumbnail.")
+	} else if log.Is(err, ErrExifTooLarge) == false {
+		log.Panic(err)
+	}
+
+	if bytes.Equal(s.Data, original) != true {
+		t.Fatalf("EXIF segment was changed.")
+	}
+
+	// Too big when there's no EXIF yet. No segment should be added.
+
+	sl = getCoefficientsTestSegmentList(getTestGeneratedJpeg(64, 48, false))
+	count := len(sl.Segments())
+
+	err = sl.SetExifThumbnail(thumbnail)
+	if err == nil {
+		t.Fatalf("Expected error for large thumbnail without EXIF.")
+	} else if log.Is(err, ErrExifTooLarge) == false {
+		log.Panic(err)
+	}
+
+	if len(sl.Segments()) != count {
+		t.Fatalf("Segment count changed: (%d) != (%d)", len(sl.Segments()), count)
+	}
+
+	_, _, err = sl.FindExif()
+	if log.Is(err, exif.ErrNoExif) == false {
+		t.Fatalf("Expected no EXIF: %v", err)
+	}
+}
+
+func TestSegmentList_DropExifThumbnail_NoThumbnail(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(64, 48, false))
+
+	rootIb, err := sl.ConstructExifBuilder()
+	log.PanicIf(err)
+
+	err = rootIb.AddStandardWithName("ProcessingSoftware", "some software")
+	log.PanicIf(err)
+
+	// A second IFD that doesn't actually have a thumbnail.
+
+	im, err := exifcommon.NewIfdMappingWithStandard()
+	log.PanicIf(err)
+
+	ti := exif.NewTagIndex()
+
+	nextIb := exif.NewIfdBuilder(im, ti, exifcommon.IfdStandardIfdIdentity, exifcommon.EncodeDefaultByteOrder)
+
+	err = nextIb.SetStandardWithName("Compression", []uint16{6})
+	log.PanicIf(err)
+
+	err = rootIb.SetNextIb(nextIb)
+	log.PanicIf(err)
+
+	err = sl.SetExif(rootIb)
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	rootIfd, _, err := sl.Exif()
+	log.PanicIf(err)
+
+	if rootIfd.NextIfd() == nil {
+		t.Fatalf("Test EXIF should have a second IFD.")
+	}
+
+	wasDropped, err := sl.DropExifThumbnail()
+	log.PanicIf(err)
+
+	if wasDropped != true {
+		t.Fatalf("Expected the second IFD to be dropped.")
+	}
+
+	sl, _ = reparseSegmentList(sl)
+
+	rootIfd, _, err = sl.Exif()
+	log.PanicIf(err)
+
+	if rootIfd.NextIfd() != nil {
+		t.Fatalf("Second IFD was not dropped.")
+	}
+}
@@ -1,7 +1,6 @@
 package jpegstructure
 
 import (
-	"bufio"
 	"bytes"
 	"io"
 
@@ -22,6 +21,10 @@ type JpegSplitter struct {
 	currentOffset int
 	segments      *SegmentList
 
+	// consumed is the number of bytes that have been split so far, including
+	// any fill bytes before the markers.
+	consumed int
+
 	scandataOffset int
 }
 
@@ -341,43 +344,11 @@ func (js *JpegSplitter) Split(data []byte, atEOF bool) (advance int, token []byt
 
 		data = data[currentAdvance:]
 		advance += currentAdvance
-	}
-
-	return advance, nil, nil
-}
-
-func (js *JpegSplitter) parseSof(data []byte) (sof *SofSegment, err error) {
-	defer func() {
-		if state := recover(); state != nil {
-			err = log.Wrap(state.(error))
-		}
-	}()
 
-	stream := bytes.NewBuffer(data)
-	buffer := bufio.NewReader(stream)
-
-	bitsPerSample, err := buffer.ReadByte()
-	log.PanicIf(err)
-
-	height := uint16(0)
-	err = binary.Read(buffer, binary.BigEndian, &height)
-	log.PanicIf(err)
-
-	width := uint16(0)
-	err = binary.Read(buffer, binary.BigEndian, &width)
-	log.PanicIf(err)
-
-	componentCount, err := buffer.ReadByte()
-	log.PanicIf(err)
-
-	sof = &SofSegment{
-		BitsPerSample:  bitsPerSample,
-		Width:          width,
-		Height:         height,
-		ComponentCount: componentCount,
+		js.consumed += currentAdvance
 	}
 
-	return sof, nil
+	return advance, nil, nil
 }
 
 func (js *JpegSplitter) parseAppData(markerId byte, data []byte) (err error) {
@@ -419,10 +390,10 @@ func (js *JpegSplitter) handleSegment(markerId byte, markerName string, headerSi
 		log.PanicIf(err)
 	}
 
-	if markerId >= MARKER_SOF0 && markerId <= MARKER_SOF15 {
+	if isSofMarker(markerId) == true {
 		ssv, ok := js.visitor.(SofSegmentVisitor)
 		if ok == true {
-			sof, err := js.parseSof(payload)
+			sof, err := ParseSofSegment(markerId, payload)
 			log.PanicIf(err)
 
 			err = ssv.HandleSof(sof)
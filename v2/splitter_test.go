@@ -86,22 +86,69 @@ func Test_JpegSplitter_Split(t *testing.T) {
 		t.Fatalf("Markers found are not correct: %v\n", DumpBytesToString(v.markerList))
 	}
 
-	expectedSofList := []SofSegment{
-		{
-			BitsPerSample:  8,
-			Width:          3840,
-			Height:         2560,
-			ComponentCount: 3,
-		},
-		{
-			BitsPerSample:  0,
-			Width:          1281,
-			Height:         1,
-			ComponentCount: 1,
-		},
+	// The DHT segment (0xc4) is in the range of the SOF markers but isn't one.
+
+	if len(v.sofList) != 1 {
+		t.Fatalf("SOF segment count not correct: (%d)", len(v.sofList))
+	}
+
+	sof := v.sofList[0]
+
+	if len(sof.Components) != 3 {
+		t.Fatalf("SOF components not correct: %v", sof.Components)
+	}
+
+	sof.Components = nil
+
+	expectedSof := SofSegment{
+		MarkerId:       MARKER_SOF0,
+		BitsPerSample:  8,
+		Width:          3840,
+		Height:         2560,
+		ComponentCount: 3,
+	}
+
+	if reflect.DeepEqual(sof, expectedSof) == false {
+		t.Fatalf("SOF segment not correct: %s\n", sof)
+	}
+}
+
+func Test_JpegSplitter_Split_Sof(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	data := getTestGeneratedJpeg(64, 48, false)
+
+	v := new(collectorVisitor)
+	js := NewJpegSplitter(v)
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer([]byte{}, len(data))
+	s.Split(js.Split)
+
+	for s.Scan() != false {
+	}
+
+	log.PanicIf(s.Err())
+
+	// Only the SOF is reported, with its components, and not the DHT
+	// segments.
+
+	if len(v.sofList) != 1 {
+		t.Fatalf("SOF segment count not correct: (%d)", len(v.sofList))
 	}
 
-	if reflect.DeepEqual(v.sofList, expectedSofList) == false {
-		t.Fatalf("SOF segments not equal: %v\n", v.sofList)
+	sof := v.sofList[0]
+
+	expectedSof, err := getCoefficientsTestSegmentList(data).frameHeader()
+	log.PanicIf(err)
+
+	if reflect.DeepEqual(sof, *expectedSof) == false {
+		t.Fatalf("SOF segment not correct: %s", sof)
 	}
 }
@@ -1,14 +1,25 @@
 package jpegstructure
 
 import (
+	"bytes"
+	"image"
 	"os"
 	"path"
 
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+
 	"github.com/dsoprea/go-logging"
 )
 
 var (
 	testImageRelFilepath = "NDM_8901.jpg"
+
+	// fujiTestImageRelFilepath is a camera image with EXIF that
+	// `ConstructExifBuilder` can't rebuild (it has an undefined-type tag
+	// that doesn't parse).
+	fujiTestImageRelFilepath = "FUJI.jpg"
 )
 
 var (
@@ -71,3 +82,61 @@ func GetTestImageFilepath() string {
 
 	return filepath
 }
+
+// getFujiTestSegmentList parses the FUJI test-image.
+func getFujiTestSegmentList() (sl *SegmentList, data []byte) {
+	filepath := path.Join(GetTestAssetsPath(), fujiTestImageRelFilepath)
+
+	data, err := ioutil.ReadFile(filepath)
+	log.PanicIf(err)
+
+	intfc, err := NewJpegMediaParser().ParseBytes(data)
+	log.PanicIf(err)
+
+	return intfc.(*SegmentList), data
+}
+
+// getTestGeneratedImage returns a deterministic test-pattern of the given
+// size.
+func getTestGeneratedImage(width, height int, isGray bool) image.Image {
+	r := image.Rect(0, 0, width, height)
+
+	var img interface {
+		image.Image
+		Set(x, y int, c color.Color)
+	}
+
+	if isGray == true {
+		img = image.NewGray(r)
+	} else {
+		img = image.NewRGBA(r)
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.RGBA{
+				R: uint8(x * 255 / width),
+				G: uint8(y * 255 / height),
+				B: uint8((x*y + (x^y)*7) % 256),
+				A: 0xff,
+			}
+
+			img.Set(x, y, c)
+		}
+	}
+
+	return img
+}
+
+// getTestGeneratedJpeg returns a baseline JPEG encoding of a test-pattern.
+// Color images are 4:2:0 subsampled.
+func getTestGeneratedJpeg(width, height int, isGray bool) []byte {
+	img := getTestGeneratedImage(width, height, isGray)
+
+	b := new(bytes.Buffer)
+
+	err := jpeg.Encode(b, img, &jpeg.Options{Quality: 90})
+	log.PanicIf(err)
+
+	return b.Bytes()
+}
@@ -0,0 +1,559 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+
+	"encoding/binary"
+	"image/color"
+
+	"github.com/dsoprea/go-exif/v3"
+	"github.com/dsoprea/go-logging"
+)
+
+var (
+	jfxxPrefix = []byte("JFXX\000")
+)
+
+const (
+	// jfifThumbnailOffset is where the dimensions of the uncompressed JFIF
+	// thumbnail are, after the prefix, the version, the units and the
+	// densities.
+	jfifThumbnailOffset = 12
+
+	jfxxExtensionJpeg    = 0x10
+	jfxxExtensionPalette = 0x11
+	jfxxExtensionRgb     = 0x13
+
+	photoshopThumbnailResourceId = uint16(0x040c)
+
+	// photoshopThumbnailHeaderSize is the size of the header that precedes
+	// the thumbnail data in the resource.
+	photoshopThumbnailHeaderSize = 28
+
+	// photoshopThumbnailFormatJpeg is the format for JPEG ("kJpegRGB").
+	photoshopThumbnailFormatJpeg = 1
+)
+
+const (
+	defaultThumbnailCheckGridSize             = 16
+	defaultThumbnailCheckAspectRatioTolerance = 0.02
+	defaultThumbnailCheckMinimumSimilarity    = 0.9
+)
+
+// ThumbnailSource is the container that an embedded thumbnail was found in.
+type ThumbnailSource int
+
+const (
+	// ThumbnailSourceExif is the JPEG thumbnail of the second EXIF IFD.
+	ThumbnailSourceExif ThumbnailSource = iota
+
+	// ThumbnailSourceJfif is the uncompressed thumbnail of the JFIF segment.
+	ThumbnailSourceJfif
+
+	// ThumbnailSourceJfxx is the thumbnail of a JFIF extension (JFXX)
+	// segment, which may be JPEG, paletted or RGB.
+	ThumbnailSourceJfxx
+
+	// ThumbnailSourcePhotoshop is the thumbnail resource (0x040C) of the
+	// Photoshop segment.
+	ThumbnailSourcePhotoshop
+
+	// ThumbnailSourceMpf is a large-thumbnail image of an MPF file.
+	ThumbnailSourceMpf
+)
+
+// String returns a descriptive string.
+func (ts ThumbnailSource) String() string {
+	switch ts {
+	case ThumbnailSourceExif:
+		return "EXIF"
+	case ThumbnailSourceJfif:
+		return "JFIF"
+	case ThumbnailSourceJfxx:
+		return "JFXX"
+	case ThumbnailSourcePhotoshop:
+		return "Photoshop"
+	case ThumbnailSourceMpf:
+		return "MPF"
+	}
+
+	return fmt.Sprintf("Unknown(%d)", int(ts))
+}
+
+// EmbeddedThumbnail is a thumbnail that was found in the image.
+type EmbeddedThumbnail struct {
+	// Source is the container that the thumbnail was found in.
+	Source ThumbnailSource
+
+	// SegmentIndex is the segment that has the thumbnail (the MPF segment,
+	// for MPF).
+	SegmentIndex int
+
+	// MpfEntryIndex is the MPF entry of the thumbnail (for MPF only).
+	MpfEntryIndex int
+
+	// Data is the JPEG data of the thumbnail. It's nil for uncompressed
+	// thumbnails.
+	Data []byte
+
+	// Image is the decoded thumbnail. It's nil if the thumbnail couldn't be
+	// decoded.
+	Image image.Image
+
+	// DecodeError is why the thumbnail couldn't be decoded.
+	DecodeError error
+}
+
+// String returns a descriptive string.
+func (et *EmbeddedThumbnail) String() string {
+	if et.Image == nil {
+		return fmt.Sprintf("EmbeddedThumbnail<SOURCE=[%s] SEGMENT=(%d) ERROR=[%v]>", et.Source, et.SegmentIndex, et.DecodeError)
+	}
+
+	size := et.Image.Bounds().Size()
+
+	return fmt.Sprintf("EmbeddedThumbnail<SOURCE=[%s] SEGMENT=(%d) SIZE=(%d)x(%d)>", et.Source, et.SegmentIndex, size.X, size.Y)
+}
+
+// newJpegEmbeddedThumbnail decodes a JPEG thumbnail. A thumbnail that can't
+// be decoded is still returned.
+func newJpegEmbeddedThumbnail(source ThumbnailSource, segmentIndex int, data []byte) *EmbeddedThumbnail {
+	et := &EmbeddedThumbnail{
+		Source:       source,
+		SegmentIndex: segmentIndex,
+		Data:         data,
+	}
+
+	jmp := NewJpegMediaParser()
+
+	et.Image, et.DecodeError = jmp.GetImage(bytes.NewReader(data))
+
+	return et
+}
+
+// rgbThumbnailImage returns the image for packed RGB data.
+func rgbThumbnailImage(width, height int, data []byte) (img image.Image, err error) {
+	if width == 0 || height == 0 {
+		return nil, errors.New("thumbnail has no pixels")
+	} else if len(data) < width*height*3 {
+		return nil, fmt.Errorf("thumbnail data truncated: (%d) < (%d)", len(data), width*height*3)
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for i := 0; i < width*height; i++ {
+		rgba.Pix[i*4+0] = data[i*3+0]
+		rgba.Pix[i*4+1] = data[i*3+1]
+		rgba.Pix[i*4+2] = data[i*3+2]
+		rgba.Pix[i*4+3] = 0xff
+	}
+
+	return rgba, nil
+}
+
+// app0Thumbnail returns the thumbnail in a JFIF or JFXX segment, or nil if
+// there isn't one.
+func app0Thumbnail(segmentIndex int, s *Segment) *EmbeddedThumbnail {
+	if bytes.HasPrefix(s.Data, jfifPrefix) == true {
+		if len(s.Data) < jfifThumbnailOffset+2 {
+			return nil
+		}
+
+		width := int(s.Data[jfifThumbnailOffset])
+		height := int(s.Data[jfifThumbnailOffset+1])
+
+		if width == 0 || height == 0 {
+			return nil
+		}
+
+		et := &EmbeddedThumbnail{
+			Source:       ThumbnailSourceJfif,
+			SegmentIndex: segmentIndex,
+		}
+
+		et.Image, et.DecodeError = rgbThumbnailImage(width, height, s.Data[jfifThumbnailOffset+2:])
+
+		return et
+	} else if bytes.HasPrefix(s.Data, jfxxPrefix) == false || len(s.Data) < len(jfxxPrefix)+1 {
+		return nil
+	}
+
+	l := len(jfxxPrefix)
+	extension := s.Data[l]
+	data := s.Data[l+1:]
+
+	if extension == jfxxExtensionJpeg {
+		return newJpegEmbeddedThumbnail(ThumbnailSourceJfxx, segmentIndex, data)
+	}
+
+	et := &EmbeddedThumbnail{
+		Source:       ThumbnailSourceJfxx,
+		SegmentIndex: segmentIndex,
+	}
+
+	if len(data) < 2 {
+		et.DecodeError = errors.New("JFXX thumbnail truncated")
+		return et
+	}
+
+	width := int(data[0])
+	height := int(data[1])
+	data = data[2:]
+
+	switch extension {
+	case jfxxExtensionRgb:
+		et.Image, et.DecodeError = rgbThumbnailImage(width, height, data)
+	case jfxxExtensionPalette:
+		if width == 0 || height == 0 {
+			et.DecodeError = errors.New("thumbnail has no pixels")
+		} else if len(data) < 768+width*height {
+			et.DecodeError = errors.New("JFXX paletted thumbnail truncated")
+		} else {
+			palette := make(color.Palette, 256)
+			for i := range palette {
+				palette[i] = color.RGBA{R: data[i*3], G: data[i*3+1], B: data[i*3+2], A: 0xff}
+			}
+
+			paletted := image.NewPaletted(image.Rect(0, 0, width, height), palette)
+			copy(paletted.Pix, data[768:768+width*height])
+
+			et.Image = paletted
+		}
+	default:
+		et.DecodeError = fmt.Errorf("JFXX extension not valid: (0x%02x)", extension)
+	}
+
+	return et
+}
+
+// Thumbnails finds and decodes every embedded thumbnail: the EXIF thumbnail,
+// the JFIF and JFXX thumbnails, the Photoshop thumbnail resource, and the
+// large thumbnails of an MPF file. Thumbnails that can't be decoded are
+// returned with the reason.
+func (sl *SegmentList) Thumbnails() (thumbnails []*EmbeddedThumbnail, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	thumbnails = make([]*EmbeddedThumbnail, 0)
+
+	exifIndex, _, err := sl.FindExif()
+	if err == nil {
+		rootIfd, _, err := sl.Exif()
+		log.PanicIf(err)
+
+		if nextIfd := rootIfd.NextIfd(); nextIfd != nil {
+			data, err := nextIfd.Thumbnail()
+			if err == nil {
+				et := newJpegEmbeddedThumbnail(ThumbnailSourceExif, exifIndex, data)
+				thumbnails = append(thumbnails, et)
+			} else if log.Is(err, exif.ErrNoThumbnail) == false {
+				log.Panic(err)
+			}
+		}
+	} else if log.Is(err, exif.ErrNoExif) == false {
+		log.Panic(err)
+	}
+
+	for i, s := range sl.segments {
+		switch s.MarkerId {
+		case MARKER_APP0:
+			if et := app0Thumbnail(i, s); et != nil {
+				thumbnails = append(thumbnails, et)
+			}
+		case MARKER_APP13:
+			photoshopInfo, err := s.parsePhotoshopInfo()
+			if err != nil {
+				if err == ErrNoPhotoshopData {
+					continue
+				}
+
+				log.Panic(err)
+			}
+
+			record, found := photoshopInfo[photoshopThumbnailResourceId]
+			if found == false {
+				continue
+			}
+
+			if len(record.Data) < photoshopThumbnailHeaderSize {
+				et := &EmbeddedThumbnail{
+					Source:       ThumbnailSourcePhotoshop,
+					SegmentIndex: i,
+					DecodeError:  errors.New("Photoshop thumbnail truncated"),
+				}
+
+				thumbnails = append(thumbnails, et)
+			} else if format := binary.BigEndian.Uint32(record.Data[0:4]); format != photoshopThumbnailFormatJpeg {
+				et := &EmbeddedThumbnail{
+					Source:       ThumbnailSourcePhotoshop,
+					SegmentIndex: i,
+					DecodeError:  fmt.Errorf("Photoshop thumbnail format not supported: (%d)", format),
+				}
+
+				thumbnails = append(thumbnails, et)
+			} else {
+				et := newJpegEmbeddedThumbnail(ThumbnailSourcePhotoshop, i, record.Data[photoshopThumbnailHeaderSize:])
+				thumbnails = append(thumbnails, et)
+			}
+		}
+	}
+
+	mpfIndex, _, err := sl.FindMpf()
+	if err == nil {
+		mi, err := sl.Mpf()
+		log.PanicIf(err)
+
+		for j, me := range mi.Entries {
+			if me.Type().IsThumbnail() == false {
+				continue
+			}
+
+			var et *EmbeddedThumbnail
+
+			data, err := sl.MpfImage(j)
+			if err == nil {
+				et = newJpegEmbeddedThumbnail(ThumbnailSourceMpf, mpfIndex, data)
+			} else {
+				et = &EmbeddedThumbnail{
+					Source:       ThumbnailSourceMpf,
+					SegmentIndex: mpfIndex,
+					DecodeError:  err,
+				}
+			}
+
+			et.MpfEntryIndex = j
+
+			thumbnails = append(thumbnails, et)
+		}
+	} else if err != ErrNoMpf {
+		log.Panic(err)
+	}
+
+	return thumbnails, nil
+}
+
+// ThumbnailCheckOptions tunes `CheckThumbnails`. The zero value of each field
+// selects its default.
+type ThumbnailCheckOptions struct {
+	// GridSize is the width and height, in cells, that the images are reduced
+	// to before they're compared. The default is 16.
+	GridSize int
+
+	// AspectRatioTolerance is how much the aspect ratios may differ, relative
+	// to that of the image, before it's reported. The default is 0.02.
+	AspectRatioTolerance float64
+
+	// MinimumSimilarity is the similarity below which a thumbnail is taken to
+	// be stale. The default is 0.9.
+	MinimumSimilarity float64
+}
+
+// ThumbnailCheck is how well a thumbnail agrees with the primary image.
+type ThumbnailCheck struct {
+	// Thumbnail is the thumbnail that was checked.
+	Thumbnail *EmbeddedThumbnail
+
+	// Similarity is from zero (nothing in common) to one (identical at the
+	// grid size). It's zero if the thumbnail couldn't be decoded.
+	Similarity float64
+
+	// ThumbnailAspectRatio is the width of the thumbnail over its height.
+	ThumbnailAspectRatio float64
+
+	// ImageAspectRatio is the width of the primary image over its height.
+	ImageAspectRatio float64
+
+	// IsAspectRatioMismatch is true if the aspect ratios differ by more than
+	// the tolerance.
+	IsAspectRatioMismatch bool
+
+	// IsStale is true if the similarity is less than the minimum, including
+	// when the thumbnail couldn't be decoded.
+	IsStale bool
+}
+
+// String returns a descriptive string.
+func (tc *ThumbnailCheck) String() string {
+	return fmt.Sprintf("ThumbnailCheck<SOURCE=[%s] SIMILARITY=(%.3f) ASPECT=(%.3f)/(%.3f) ASPECT-MISMATCH=[%v] STALE=[%v]>", tc.Thumbnail.Source, tc.Similarity, tc.ThumbnailAspectRatio, tc.ImageAspectRatio, tc.IsAspectRatioMismatch, tc.IsStale)
+}
+
+// CheckThumbnails compares every embedded thumbnail (see `Thumbnails`) with
+// the primary image, which is decoded at low resolution. Thumbnails that
+// weren't updated when the image was edited (e.g. cropped) can show content
+// that is no longer in the image.
+//
+// Both images are reduced to a small grid and compared cell by cell. If the
+// aspect ratios differ, the thumbnail is also compared as if the image had
+// been letterboxed into it (which is what cameras do), and the better of the
+// two is used. `options` may be nil.
+func (sl *SegmentList) CheckThumbnails(options *ThumbnailCheckOptions) (checks []*ThumbnailCheck, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	gridSize := defaultThumbnailCheckGridSize
+	aspectRatioTolerance := defaultThumbnailCheckAspectRatioTolerance
+	minimumSimilarity := defaultThumbnailCheckMinimumSimilarity
+
+	if options != nil {
+		if options.GridSize > 0 {
+			gridSize = options.GridSize
+		}
+
+		if options.AspectRatioTolerance > 0 {
+			aspectRatioTolerance = options.AspectRatioTolerance
+		}
+
+		if options.MinimumSimilarity > 0 {
+			minimumSimilarity = options.MinimumSimilarity
+		}
+	}
+
+	thumbnails, err := sl.Thumbnails()
+	log.PanicIf(err)
+
+	checks = make([]*ThumbnailCheck, 0, len(thumbnails))
+
+	if len(thumbnails) == 0 {
+		return checks, nil
+	}
+
+	primary, err := sl.decodeDcImage()
+	log.PanicIf(err)
+
+	primaryBounds := primary.Bounds()
+	imageAspectRatio := aspectRatio(primaryBounds)
+
+	primaryGrid := reduceToGrid(primary, primaryBounds, gridSize)
+
+	for _, et := range thumbnails {
+		tc := &ThumbnailCheck{
+			Thumbnail:        et,
+			ImageAspectRatio: imageAspectRatio,
+		}
+
+		if et.Image == nil {
+			tc.IsStale = true
+			checks = append(checks, tc)
+
+			continue
+		}
+
+		bounds := et.Image.Bounds()
+		tc.ThumbnailAspectRatio = aspectRatio(bounds)
+
+		tc.IsAspectRatioMismatch = math.Abs(tc.ThumbnailAspectRatio/imageAspectRatio-1) > aspectRatioTolerance
+
+		tc.Similarity = gridSimilarity(primaryGrid, reduceToGrid(et.Image, bounds, gridSize))
+
+		if tc.IsAspectRatioMismatch == true {
+			fitted := letterboxRectangle(bounds, imageAspectRatio)
+
+			similarity := gridSimilarity(primaryGrid, reduceToGrid(et.Image, fitted, gridSize))
+			if similarity > tc.Similarity {
+				tc.Similarity = similarity
+			}
+		}
+
+		tc.IsStale = tc.Similarity < minimumSimilarity
+
+		checks = append(checks, tc)
+	}
+
+	return checks, nil
+}
+
+func aspectRatio(r image.Rectangle) float64 {
+	return float64(r.Dx()) / float64(r.Dy())
+}
+
+// letterboxRectangle returns the part of `r` that an image with the given
+// aspect ratio would cover if it was centered and scaled to fit.
+func letterboxRectangle(r image.Rectangle, ratio float64) image.Rectangle {
+	width := r.Dx()
+	height := r.Dy()
+
+	if float64(width)/float64(height) > ratio {
+		fittedWidth := int(math.Floor(float64(height)*ratio + 0.5))
+		if fittedWidth < 1 {
+			fittedWidth = 1
+		}
+
+		x := r.Min.X + (width-fittedWidth)/2
+
+		return image.Rect(x, r.Min.Y, x+fittedWidth, r.Max.Y)
+	}
+
+	fittedHeight := int(math.Floor(float64(width)/ratio + 0.5))
+	if fittedHeight < 1 {
+		fittedHeight = 1
+	}
+
+	y := r.Min.Y + (height-fittedHeight)/2
+
+	return image.Rect(r.Min.X, y, r.Max.X, y+fittedHeight)
+}
+
+// reduceToGrid averages the RGB of the given part of the image over a grid
+// of `size` by `size` cells. The values are from zero to one.
+func reduceToGrid(img image.Image, r image.Rectangle, size int) []float64 {
+	grid := make([]float64, size*size*3)
+
+	width := r.Dx()
+	height := r.Dy()
+
+	for cy := 0; cy < size; cy++ {
+		y0 := r.Min.Y + cy*height/size
+		y1 := r.Min.Y + (cy+1)*height/size
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+
+		for cx := 0; cx < size; cx++ {
+			x0 := r.Min.X + cx*width/size
+			x1 := r.Min.X + (cx+1)*width/size
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var sums [3]float64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					red, green, blue, _ := img.At(x, y).RGBA()
+
+					sums[0] += float64(red)
+					sums[1] += float64(green)
+					sums[2] += float64(blue)
+				}
+			}
+
+			count := float64((x1-x0)*(y1-y0)) * 0xffff
+			i := (cy*size + cx) * 3
+
+			grid[i+0] = sums[0] / count
+			grid[i+1] = sums[1] / count
+			grid[i+2] = sums[2] / count
+		}
+	}
+
+	return grid
+}
+
+// gridSimilarity returns one minus the mean absolute difference.
+func gridSimilarity(a, b []float64) float64 {
+	total := 0.0
+	for i := range a {
+		total += math.Abs(a[i] - b[i])
+	}
+
+	return 1 - total/float64(len(a))
+}
@@ -0,0 +1,346 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"image"
+	"testing"
+
+	"encoding/binary"
+	"image/color"
+	"image/jpeg"
+
+	"github.com/dsoprea/go-logging"
+)
+
+// getThumbnailTestImage returns a smooth pattern that looks the same at any
+// size. If `isStale`, the pattern is mirrored.
+func getThumbnailTestImage(width, height int, isStale bool) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			u := (x*2 + 1) * 255 / (width * 2)
+			v := (y*2 + 1) * 255 / (height * 2)
+
+			if isStale == true {
+				u = 255 - u
+				v = 255 - v
+			}
+
+			img.SetRGBA(x, y, color.RGBA{R: uint8(u), G: uint8(v), B: 128, A: 0xff})
+		}
+	}
+
+	return img
+}
+
+func getThumbnailTestJpeg(img image.Image) []byte {
+	b := new(bytes.Buffer)
+
+	err := jpeg.Encode(b, img, &jpeg.Options{Quality: 90})
+	log.PanicIf(err)
+
+	return b.Bytes()
+}
+
+// getLetterboxedThumbnailTestImage returns the pattern centered between black
+// bars.
+func getLetterboxedThumbnailTestImage(width, height, contentHeight int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	content := getThumbnailTestImage(width, contentHeight, false)
+
+	top := (height - contentHeight) / 2
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if y < top || y >= top+contentHeight {
+				img.SetRGBA(x, y, color.RGBA{A: 0xff})
+			} else {
+				img.SetRGBA(x, y, content.RGBAAt(x, y-top))
+			}
+		}
+	}
+
+	return img
+}
+
+func getPhotoshopThumbnailTestSegment(format uint32, data []byte) *Segment {
+	b := new(bytes.Buffer)
+	b.Write(ps30Prefix)
+
+	b.WriteString("8BIM")
+	binary.Write(b, binary.BigEndian, photoshopThumbnailResourceId)
+	b.Write([]byte{0, 0})
+
+	binary.Write(b, binary.BigEndian, uint32(photoshopThumbnailHeaderSize+len(data)))
+	binary.Write(b, binary.BigEndian, []uint32{format, 0, 0, 0, 0, uint32(len(data))})
+	binary.Write(b, binary.BigEndian, []uint16{24, 1})
+	b.Write(data)
+
+	if b.Len()%2 == 1 {
+		b.WriteByte(0)
+	}
+
+	return &Segment{
+		MarkerId:   MARKER_APP13,
+		MarkerName: markerNames[MARKER_APP13],
+		Data:       b.Bytes(),
+	}
+}
+
+func getApp0ThumbnailTestSegment(prefix []byte, extension int, img *image.RGBA) *Segment {
+	size := img.Bounds().Size()
+
+	data := append([]byte{}, prefix...)
+
+	if extension < 0 {
+		data = append(data, 1, 2, 0, 0, 1, 0, 1)
+	} else {
+		data = append(data, byte(extension))
+	}
+
+	data = append(data, byte(size.X), byte(size.Y))
+
+	if extension == jfxxExtensionPalette {
+		// A gray palette, with the red as the index.
+
+		for i := 0; i < 256; i++ {
+			data = append(data, byte(i), byte(i), byte(i))
+		}
+
+		for i := 0; i < size.X*size.Y; i++ {
+			data = append(data, img.Pix[i*4])
+		}
+	} else {
+		for i := 0; i < size.X*size.Y; i++ {
+			data = append(data, img.Pix[i*4:i*4+3]...)
+		}
+	}
+
+	return &Segment{
+		MarkerId:   MARKER_APP0,
+		MarkerName: markerNames[MARKER_APP0],
+		Data:       data,
+	}
+}
+
+func TestSegmentList_Thumbnails(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	thumbnail := getThumbnailTestImage(12, 8, false)
+	thumbnailJpeg := getThumbnailTestJpeg(thumbnail)
+
+	primary := getThumbnailTestJpeg(getThumbnailTestImage(96, 64, false))
+
+	sl := getMpfTestSegmentList(primary, [][]byte{thumbnailJpeg, thumbnailJpeg}, []MpfImageType{MpfImageTypeMultiFrameDisparity, MpfImageTypeLargeThumbnailFullHd})
+
+	jfxxJpeg := &Segment{
+		MarkerId:   MARKER_APP0,
+		MarkerName: markerNames[MARKER_APP0],
+		Data:       append(append([]byte{}, jfxxPrefix...), append([]byte{jfxxExtensionJpeg}, thumbnailJpeg...)...),
+	}
+
+	segments := []*Segment{
+		getApp0ThumbnailTestSegment(jfifPrefix, -1, thumbnail),
+		getApp0ThumbnailTestSegment(jfxxPrefix, jfxxExtensionRgb, thumbnail),
+		getApp0ThumbnailTestSegment(jfxxPrefix, jfxxExtensionPalette, thumbnail),
+		jfxxJpeg,
+		getPhotoshopThumbnailTestSegment(photoshopThumbnailFormatJpeg, thumbnailJpeg),
+	}
+
+	sl.segments = append(append([]*Segment{sl.segments[0]}, segments...), sl.segments[1:]...)
+
+	err := sl.SetExifThumbnail(thumbnailJpeg)
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	thumbnails, err := sl.Thumbnails()
+	log.PanicIf(err)
+
+	expected := []struct {
+		source       ThumbnailSource
+		segmentIndex int
+		isJpeg       bool
+	}{
+		{ThumbnailSourceExif, 1, true},
+		{ThumbnailSourceJfif, 2, false},
+		{ThumbnailSourceJfxx, 3, false},
+		{ThumbnailSourceJfxx, 4, false},
+		{ThumbnailSourceJfxx, 5, true},
+		{ThumbnailSourcePhotoshop, 6, true},
+		{ThumbnailSourceMpf, 7, true},
+	}
+
+	if len(thumbnails) != len(expected) {
+		t.Fatalf("Thumbnail count not correct: (%d)", len(thumbnails))
+	}
+
+	for i, e := range expected {
+		et := thumbnails[i]
+
+		if et.Source != e.source || et.SegmentIndex != e.segmentIndex || (et.Data != nil) != e.isJpeg {
+			t.Fatalf("Thumbnail (%d) not correct: %s", i, et)
+		} else if et.DecodeError != nil {
+			t.Fatalf("Thumbnail (%d) not decoded: %v", i, et.DecodeError)
+		} else if et.Image.Bounds() != thumbnail.Bounds() {
+			t.Fatalf("Thumbnail (%d) size not correct: %v", i, et.Image.Bounds())
+		}
+	}
+
+	if thumbnails[6].MpfEntryIndex != 2 {
+		t.Fatalf("MPF entry not correct: (%d)", thumbnails[6].MpfEntryIndex)
+	}
+
+	// The uncompressed ones are exact (the paletted one is gray).
+
+	checkImagesSimilar(t, thumbnails[1].Image, thumbnail, 0)
+	checkImagesSimilar(t, thumbnails[2].Image, thumbnail, 0)
+
+	r, g, b, _ := thumbnails[3].Image.At(5, 3).RGBA()
+	if r != g || g != b || r>>8 != uint32(thumbnail.RGBAAt(5, 3).R) {
+		t.Fatalf("Paletted thumbnail not correct: (%d, %d, %d)", r, g, b)
+	}
+}
+
+func TestSegmentList_Thumbnails_Undecodable(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getMpfTestSegmentList(getTestGeneratedJpeg(32, 32, false), [][]byte{[]byte("not a JPEG")}, []MpfImageType{MpfImageTypeLargeThumbnailVga})
+
+	truncated := getApp0ThumbnailTestSegment(jfifPrefix, -1, getThumbnailTestImage(4, 4, false))
+	truncated.Data = truncated.Data[:20]
+
+	segments := []*Segment{
+		truncated,
+		getPhotoshopThumbnailTestSegment(0, []byte{1, 2, 3}),
+		getApp0ThumbnailTestSegment(jfxxPrefix, 0x12, getThumbnailTestImage(4, 4, false)),
+	}
+
+	sl.segments = append(append([]*Segment{sl.segments[0]}, segments...), sl.segments[1:]...)
+
+	thumbnails, err := sl.Thumbnails()
+	log.PanicIf(err)
+
+	if len(thumbnails) != 4 {
+		t.Fatalf("Thumbnail count not correct: (%d)", len(thumbnails))
+	}
+
+	for i, et := range thumbnails {
+		if et.Image != nil || et.DecodeError == nil {
+			t.Fatalf("Expected thumbnail (%d) to not be decoded: %s", i, et)
+		}
+	}
+
+	checks, err := sl.CheckThumbnails(nil)
+	log.PanicIf(err)
+
+	for i, tc := range checks {
+		if tc.IsStale != true || tc.Similarity != 0 {
+			t.Fatalf("Expected check (%d) to be stale: %s", i, tc)
+		}
+	}
+}
+
+func TestSegmentList_CheckThumbnails(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	primary := getThumbnailTestJpeg(getThumbnailTestImage(240, 160, false))
+
+	cases := []struct {
+		thumbnail               *image.RGBA
+		expectedIsStale         bool
+		expectedAspectMismatch  bool
+		expectedMinimumSimilary float64
+	}{
+		{getThumbnailTestImage(36, 24, false), false, false, 0.97},
+		{getThumbnailTestImage(36, 24, true), true, false, 0},
+		{getLetterboxedThumbnailTestImage(32, 24, 21), false, true, 0.95},
+		{getThumbnailTestImage(32, 24, false), false, true, 0.95},
+	}
+
+	for i, c := range cases {
+		sl := getCoefficientsTestSegmentList(primary)
+
+		err := sl.SetExifThumbnail(getThumbnailTestJpeg(c.thumbnail))
+		log.PanicIf(err)
+
+		checks, err := sl.CheckThumbnails(nil)
+		log.PanicIf(err)
+
+		if len(checks) != 1 {
+			t.Fatalf("Check count not correct for case (%d): (%d)", i, len(checks))
+		}
+
+		tc := checks[0]
+
+		if tc.IsStale != c.expectedIsStale || tc.IsAspectRatioMismatch != c.expectedAspectMismatch || tc.Similarity < c.expectedMinimumSimilary {
+			t.Fatalf("Case (%d) not correct: %s", i, tc)
+		} else if tc.ImageAspectRatio != 1.5 {
+			t.Fatalf("Image aspect-ratio not correct: (%f)", tc.ImageAspectRatio)
+		}
+	}
+
+	// A higher bar.
+
+	sl := getCoefficientsTestSegmentList(primary)
+
+	err := sl.SetExifThumbnail(getThumbnailTestJpeg(getThumbnailTestImage(36, 24, false)))
+	log.PanicIf(err)
+
+	checks, err := sl.CheckThumbnails(&ThumbnailCheckOptions{MinimumSimilarity: 0.9999})
+	log.PanicIf(err)
+
+	if checks[0].IsStale != true {
+		t.Fatalf("Expected stale with a higher minimum: %s", checks[0])
+	}
+
+	// No thumbnails.
+
+	sl = getCoefficientsTestSegmentList(primary)
+
+	checks, err = sl.CheckThumbnails(nil)
+	log.PanicIf(err)
+
+	if len(checks) != 0 {
+		t.Fatalf("Expected no checks.")
+	}
+}
+
+func TestLetterboxRectangle(t *testing.T) {
+	r := letterboxRectangle(image.Rect(0, 0, 160, 120), 1.5)
+	if r != image.Rect(0, 6, 160, 113) {
+		t.Fatalf("Wide image not correct: %v", r)
+	}
+
+	r = letterboxRectangle(image.Rect(0, 0, 160, 120), 1)
+	if r != image.Rect(20, 0, 140, 120) {
+		t.Fatalf("Tall image not correct: %v", r)
+	}
+}
+
+func TestThumbnailSource_String(t *testing.T) {
+	if ThumbnailSourcePhotoshop.String() != "Photoshop" {
+		t.Fatalf("String not correct: [%s]", ThumbnailSourcePhotoshop)
+	} else if ThumbnailSource(99).String() != "Unknown(99)" {
+		t.Fatalf("Unknown string not correct: [%s]", ThumbnailSource(99))
+	}
+}
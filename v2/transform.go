@@ -0,0 +1,420 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/dsoprea/go-exif/v3"
+	"github.com/dsoprea/go-exif/v3/common"
+	"github.com/dsoprea/go-logging"
+)
+
+// TransformType is a lossless geometric transform.
+type TransformType int
+
+const (
+	// TransformFlipHorizontal mirrors the image left-to-right.
+	TransformFlipHorizontal TransformType = iota + 1
+
+	// TransformFlipVertical mirrors the image top-to-bottom.
+	TransformFlipVertical
+
+	// TransformTranspose mirrors the image across its top-left to
+	// bottom-right diagonal.
+	TransformTranspose
+
+	// TransformTransverse mirrors the image across its top-right to
+	// bottom-left diagonal.
+	TransformTransverse
+
+	// TransformRotate90 rotates the image clockwise by 90 degrees.
+	TransformRotate90
+
+	// TransformRotate180 rotates the image by 180 degrees.
+	TransformRotate180
+
+	// TransformRotate270 rotates the image clockwise by 270 degrees.
+	TransformRotate270
+)
+
+var (
+	transformNames = map[TransformType]string{
+		TransformFlipHorizontal: "flip-horizontal",
+		TransformFlipVertical:   "flip-vertical",
+		TransformTranspose:      "transpose",
+		TransformTransverse:     "transverse",
+		TransformRotate90:       "rotate-90",
+		TransformRotate180:      "rotate-180",
+		TransformRotate270:      "rotate-270",
+	}
+)
+
+// String returns the name of the transform.
+func (tt TransformType) String() string {
+	name, found := transformNames[tt]
+	if found == false {
+		return fmt.Sprintf("TransformType<%d>", int(tt))
+	}
+
+	return name
+}
+
+// parameters returns whether the transform swaps the axes and whether it then
+// mirrors each (output) axis.
+func (tt TransformType) parameters() (transposes, mirrorsX, mirrorsY bool) {
+	switch tt {
+	case TransformFlipHorizontal:
+		return false, true, false
+	case TransformFlipVertical:
+		return false, false, true
+	case TransformTranspose:
+		return true, false, false
+	case TransformTransverse:
+		return true, true, true
+	case TransformRotate90:
+		return true, true, false
+	case TransformRotate180:
+		return false, true, true
+	case TransformRotate270:
+		return true, false, true
+	}
+
+	log.Panicf("transform not valid: (%d)", int(tt))
+	return false, false, false
+}
+
+// TransformOptions controls how `Transform` handles the image edges.
+type TransformOptions struct {
+	// Trim drops the partial iMCUs along any edge that is mirrored. Those
+	// blocks can't be moved without breaking the block grid. If not trimmed,
+	// they are left where they are and untransformed (like jpegtran without
+	// "-trim"), which is lossless but leaves a strip of unaltered image along
+	// the right and/or bottom edges.
+	Trim bool
+}
+
+// imcuSize returns the size, in pixels, of the largest unit that blocks can be
+// moved by. Single-component images are coded one block at a time.
+func imcuSize(fh *SofSegment) (width, height int) {
+	if len(fh.Components) == 1 {
+		return blockSize, blockSize
+	}
+
+	hMax, vMax := fh.MaxSampling()
+
+	return blockSize * hMax, blockSize * vMax
+}
+
+// isPerfectTransform returns true if every block of the image can be moved by
+// the transform, so that there's nothing along the edges to trim or to leave
+// untransformed.
+func isPerfectTransform(fh *SofSegment, transformType TransformType) bool {
+	transposes, mirrorsX, mirrorsY := transformType.parameters()
+
+	width, height := int(fh.Width), int(fh.Height)
+	imcuWidth, imcuHeight := imcuSize(fh)
+
+	if transposes == true {
+		width, height = height, width
+		imcuWidth, imcuHeight = imcuHeight, imcuWidth
+	}
+
+	return (mirrorsX == false || width%imcuWidth == 0) && (mirrorsY == false || height%imcuHeight == 0)
+}
+
+// transformBlock writes the transformed coefficients of `src` into `dst`.
+// Mirroring a block negates its odd frequencies along that axis.
+func transformBlock(src, dst *CoefficientBlock, transposes, mirrorsX, mirrorsY bool) {
+	for i := 0; i < blockSize; i++ {
+		for j := 0; j < blockSize; j++ {
+			var value int16
+			if transposes == true {
+				value = src[j*blockSize+i]
+			} else {
+				value = src[i*blockSize+j]
+			}
+
+			if mirrorsX == true && j%2 == 1 {
+				value = -value
+			}
+
+			if mirrorsY == true && i%2 == 1 {
+				value = -value
+			}
+
+			dst[i*blockSize+j] = value
+		}
+	}
+}
+
+// transformCoefficients returns a transformed copy of the coefficients.
+func transformCoefficients(coefficients *Coefficients, transformType TransformType, trim bool) (transformed *Coefficients, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	transposes, mirrorsX, mirrorsY := transformType.parameters()
+
+	fh := coefficients.Frame
+
+	nf := *fh
+	nf.Components = make([]FrameComponent, len(fh.Components))
+	copy(nf.Components, fh.Components)
+
+	if transposes == true {
+		nf.Width, nf.Height = fh.Height, fh.Width
+
+		for i := range nf.Components {
+			fc := &nf.Components[i]
+			fc.HorizontalSampling, fc.VerticalSampling = fc.VerticalSampling, fc.HorizontalSampling
+		}
+	}
+
+	imcuWidth, imcuHeight := imcuSize(&nf)
+
+	if trim == true {
+		if mirrorsX == true {
+			nf.Width = uint16(int(nf.Width) / imcuWidth * imcuWidth)
+		}
+
+		if mirrorsY == true {
+			nf.Height = uint16(int(nf.Height) / imcuHeight * imcuHeight)
+		}
+
+		if nf.Width == 0 || nf.Height == 0 {
+			log.Panicf("image is too small to trim: (%d)x(%d)", fh.Width, fh.Height)
+		}
+	}
+
+	transformed = &Coefficients{
+		Frame:      &nf,
+		Components: make([]*ComponentCoefficients, len(nf.Components)),
+	}
+
+	for id, qt := range coefficients.QuantizationTables {
+		if qt == nil {
+			continue
+		}
+
+		tqt := *qt
+
+		// Each coefficient keeps its quantizer, so the tables are transposed
+		// along with the blocks.
+		if transposes == true {
+			for i := 0; i < blockSize; i++ {
+				for j := 0; j < blockSize; j++ {
+					tqt.Values[i*blockSize+j] = qt.Values[j*blockSize+i]
+				}
+			}
+		}
+
+		transformed.QuantizationTables[id] = &tqt
+	}
+
+	for i, fc := range nf.Components {
+		hSampling, vSampling := int(fc.HorizontalSampling), int(fc.VerticalSampling)
+		if len(nf.Components) == 1 {
+			hSampling, vSampling = 1, 1
+		}
+
+		// These are the blocks in whole iMCUs, which are the only ones that
+		// can be mirrored.
+		fullColumns := int(nf.Width) / imcuWidth * hSampling
+		fullRows := int(nf.Height) / imcuHeight * vSampling
+
+		columns, rows := nf.ComponentBlocks(i)
+
+		src := coefficients.Components[i]
+		dst := newComponentCoefficients(fc.Id, columns, rows)
+
+		for y := 0; y < rows; y++ {
+			for x := 0; x < columns; x++ {
+				tx, mx := x, false
+				if mirrorsX == true && x < fullColumns {
+					tx, mx = fullColumns-1-x, true
+				}
+
+				ty, my := y, false
+				if mirrorsY == true && y < fullRows {
+					ty, my = fullRows-1-y, true
+				}
+
+				sx, sy := tx, ty
+				if transposes == true {
+					sx, sy = ty, tx
+				}
+
+				if sx >= src.BlocksWide || sy >= src.BlocksHigh {
+					continue
+				}
+
+				transformBlock(src.Block(sx, sy), dst.Block(x, y), transposes, mx, my)
+			}
+		}
+
+		transformed.Components[i] = dst
+	}
+
+	return transformed, nil
+}
+
+// Transform applies a lossless geometric transform to the image by
+// rearranging its DCT coefficients, in the manner of jpegtran. The image is
+// re-encoded with the same coding process (with optimized Huffman tables if
+// Huffman-coded). The frame dimensions are updated and, if there is EXIF, the
+// orientation is reset to (1) and the pixel dimensions are updated if present.
+// Every embedded thumbnail is dropped, since it would no longer match. Nothing
+// is changed if there's an error (e.g. EXIF that can't be rebuilt).
+func (sl *SegmentList) Transform(transformType TransformType, options *TransformOptions) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if options == nil {
+		options = new(TransformOptions)
+	}
+
+	coefficients, err := sl.ReadCoefficients()
+	log.PanicIf(err)
+
+	transformed, err := transformCoefficients(coefficients, transformType, options.Trim)
+	log.PanicIf(err)
+
+	// Work on a copy so that nothing changes if any step fails. The metadata
+	// is done first since it's the most likely to.
+
+	work := sl.clone()
+
+	err = work.updateExifGeometry(int(transformed.Frame.Width), int(transformed.Frame.Height), true)
+	log.PanicIf(err)
+
+	err = work.dropThumbnails()
+	log.PanicIf(err)
+
+	transposes, _, _ := transformType.parameters()
+	if transposes == true {
+		work.swapJfifDensity()
+	}
+
+	wco := &WriteCoefficientsOptions{
+		OptimizeHuffman: true,
+		Progressive:     coefficients.Frame.IsProgressive(),
+		Arithmetic:      coefficients.Frame.IsArithmetic(),
+	}
+
+	err = work.WriteCoefficients(transformed, wco)
+	log.PanicIf(err)
+
+	*sl = *work
+
+	return nil
+}
+
+// swapJfifDensity swaps the horizontal and vertical pixel densities in the
+// JFIF segment, if there is one.
+func (sl *SegmentList) swapJfifDensity() {
+	for _, s := range sl.segments {
+		if s.MarkerId != MARKER_APP0 || bytes.HasPrefix(s.Data, jfifPrefix) == false || len(s.Data) < 12 {
+			continue
+		}
+
+		data := make([]byte, len(s.Data))
+		copy(data, s.Data)
+
+		data[8], data[9], data[10], data[11] = data[10], data[11], data[8], data[9]
+		s.Data = data
+
+		return
+	}
+}
+
+// dropThumbnails drops every embedded thumbnail (EXIF, JFIF, JFXX,
+// Photoshop, XMP, and MPF), for an image whose pixels have been changed such
+// that the thumbnails no longer match it or would show what was cropped out.
+// The extended XMP goes, too, since it can hold images of its own.
+func (sl *SegmentList) dropThumbnails() (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	policy := &SanitizePolicy{
+		DropThumbnails: true,
+	}
+
+	// An earlier edit may have left the MPF offsets stale (e.g. adding a
+	// segment), in which case the MPF images can't be found to drop their
+	// thumbnails and are left as they are.
+	if _, _, _, err := sl.mpfImages(); err != nil && err != ErrNoMpf {
+		policy.isMpfKept = true
+	}
+
+	_, err = sl.Sanitize(policy)
+	log.PanicIf(err)
+
+	return nil
+}
+
+// updateExifGeometry updates the EXIF data for an image whose pixels have
+// been changed. The pixel dimensions are only updated if they are already
+// there, and the same for the orientation. Nothing is done if there is no
+// EXIF.
+func (sl *SegmentList) updateExifGeometry(width, height int, resetOrientation bool) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	_, _, err = sl.FindExif()
+	if err != nil {
+		if log.Is(err, exif.ErrNoExif) == true {
+			return nil
+		}
+
+		log.Panic(err)
+	}
+
+	rootIb, err := sl.ConstructExifBuilder()
+	log.PanicIf(err)
+
+	if resetOrientation == true {
+		_, err := rootIb.FindTagWithName("Orientation")
+		if err == nil {
+			err := rootIb.SetStandardWithName("Orientation", []uint16{1})
+			log.PanicIf(err)
+		} else if log.Is(err, exif.ErrTagEntryNotFound) == false {
+			log.Panic(err)
+		}
+	}
+
+	exifIb, err := rootIb.ChildWithTagId(exifcommon.IfdExifStandardIfdIdentity.TagId())
+	if err == nil {
+		dimensions := map[string]uint32{
+			"PixelXDimension": uint32(width),
+			"PixelYDimension": uint32(height),
+		}
+
+		for tagName, value := range dimensions {
+			_, err := exifIb.FindTagWithName(tagName)
+			if err == nil {
+				err := exifIb.SetStandardWithName(tagName, []uint32{value})
+				log.PanicIf(err)
+			} else if log.Is(err, exif.ErrTagEntryNotFound) == false {
+				log.Panic(err)
+			}
+		}
+	} else if log.Is(err, exif.ErrChildIbNotFound) == false {
+		log.Panic(err)
+	}
+
+	err = sl.SetExif(rootIb)
+	log.PanicIf(err)
+
+	return nil
+}
@@ -0,0 +1,399 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"image"
+	"testing"
+
+	"image/jpeg"
+
+	"github.com/dsoprea/go-exif/v3"
+	"github.com/dsoprea/go-exif/v3/common"
+	"github.com/dsoprea/go-logging"
+)
+
+// transformTestPoint maps a pixel of the transformed image back to the
+// original.
+func transformTestPoint(tt TransformType, x, y, width, height int) (int, int) {
+	switch tt {
+	case TransformFlipHorizontal:
+		return width - 1 - x, y
+	case TransformFlipVertical:
+		return x, height - 1 - y
+	case TransformTranspose:
+		return y, x
+	case TransformTransverse:
+		return width - 1 - y, height - 1 - x
+	case TransformRotate90:
+		return y, height - 1 - x
+	case TransformRotate180:
+		return width - 1 - x, height - 1 - y
+	case TransformRotate270:
+		return width - 1 - y, x
+	}
+
+	log.Panicf("transform not valid")
+	return 0, 0
+}
+
+// checkTransformedImage compares the images, pixel by pixel.
+func checkTransformedImage(t *testing.T, tt TransformType, originalImage image.Image, transformed []byte) {
+	transformedImage, err := jpeg.Decode(bytes.NewReader(transformed))
+	log.PanicIf(err)
+
+	checkTransformedPixels(t, tt, originalImage, transformedImage, 3)
+}
+
+// checkTransformedPixels compares the decoded images, pixel by pixel, allowing
+// each channel to differ by the given tolerance.
+func checkTransformedPixels(t *testing.T, tt TransformType, originalImage, transformedImage image.Image, tolerance int) {
+	ob := originalImage.Bounds()
+	tb := transformedImage.Bounds()
+
+	for y := 0; y < tb.Dy(); y++ {
+		for x := 0; x < tb.Dx(); x++ {
+			ox, oy := transformTestPoint(tt, x, y, ob.Dx(), ob.Dy())
+			ox += ob.Min.X
+			oy += ob.Min.Y
+
+			r1, g1, b1, _ := originalImage.At(ox, oy).RGBA()
+			r2, g2, b2, _ := transformedImage.At(x, y).RGBA()
+
+			// Allow for rounding in the IDCT.
+			for _, pair := range [][2]uint32{{r1, r2}, {g1, g2}, {b1, b2}} {
+				difference := int(pair[0]>>8) - int(pair[1]>>8)
+				if difference < -tolerance || difference > tolerance {
+					t.Fatalf("Pixel (%d, %d) for [%s] not correct: (%d) != (%d)", x, y, tt, pair[0]>>8, pair[1]>>8)
+				}
+			}
+		}
+	}
+}
+
+func TestSegmentList_Transform(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	original := getTestGeneratedJpeg(64, 48, false)
+
+	originalImage, err := jpeg.Decode(bytes.NewReader(original))
+	log.PanicIf(err)
+
+	transforms := []TransformType{
+		TransformFlipHorizontal,
+		TransformFlipVertical,
+		TransformTranspose,
+		TransformTransverse,
+		TransformRotate90,
+		TransformRotate180,
+		TransformRotate270,
+	}
+
+	for _, tt := range transforms {
+		sl := getCoefficientsTestSegmentList(original)
+
+		err := sl.Transform(tt, nil)
+		log.PanicIf(err)
+
+		_, data := reparseSegmentList(sl)
+
+		checkTransformedImage(t, tt, originalImage, data)
+	}
+}
+
+func TestSegmentList_Transform_Trim(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	original := getTestGeneratedJpeg(61, 45, false)
+
+	originalImage, err := jpeg.Decode(bytes.NewReader(original))
+	log.PanicIf(err)
+
+	expected := map[TransformType][2]int{
+		TransformFlipHorizontal: {48, 45},
+		TransformFlipVertical:   {61, 32},
+		TransformTranspose:      {45, 61},
+		TransformRotate90:       {32, 61},
+		TransformRotate180:      {48, 32},
+		TransformRotate270:      {45, 48},
+	}
+
+	for tt, dimensions := range expected {
+		sl := getCoefficientsTestSegmentList(original)
+
+		options := &TransformOptions{
+			Trim: true,
+		}
+
+		err := sl.Transform(tt, options)
+		log.PanicIf(err)
+
+		sl, data := reparseSegmentList(sl)
+
+		coefficients, err := sl.ReadCoefficients()
+		log.PanicIf(err)
+
+		fh := coefficients.Frame
+		if int(fh.Width) != dimensions[0] || int(fh.Height) != dimensions[1] {
+			t.Fatalf("Dimensions for [%s] not correct: (%d)x(%d)", tt, fh.Width, fh.Height)
+		}
+
+		// Only the right and bottom of the original are trimmed, so the
+		// result should match the same transform of the remaining area.
+
+		width, height := int(fh.Width), int(fh.Height)
+		if transposes, _, _ := tt.parameters(); transposes == true {
+			width, height = height, width
+		}
+
+		retained := originalImage.(*image.YCbCr).SubImage(image.Rect(0, 0, width, height))
+
+		checkTransformedImage(t, tt, retained, data)
+	}
+}
+
+func TestSegmentList_Transform_Preserve(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	original := getTestGeneratedJpeg(61, 45, false)
+
+	originalImage, err := jpeg.Decode(bytes.NewReader(original))
+	log.PanicIf(err)
+
+	sl := getCoefficientsTestSegmentList(original)
+
+	err = sl.Transform(TransformFlipHorizontal, nil)
+	log.PanicIf(err)
+
+	_, data := reparseSegmentList(sl)
+
+	transformedImage, err := jpeg.Decode(bytes.NewReader(data))
+	log.PanicIf(err)
+
+	if transformedImage.Bounds() != originalImage.Bounds() {
+		t.Fatalf("Dimensions not correct: %v", transformedImage.Bounds())
+	}
+
+	// The whole iMCUs are mirrored and the partial one on the right is left
+	// alone.
+
+	retained := originalImage.(*image.YCbCr).SubImage(image.Rect(0, 0, 48, 45))
+	mirrored := transformedImage.(*image.YCbCr).SubImage(image.Rect(0, 0, 48, 45))
+
+	for y := 0; y < 45; y++ {
+		for x := 0; x < 48; x++ {
+			r1, _, _, _ := retained.At(47-x, y).RGBA()
+			r2, _, _, _ := mirrored.At(x, y).RGBA()
+
+			difference := int(r1>>8) - int(r2>>8)
+			if difference < -3 || difference > 3 {
+				t.Fatalf("Mirrored pixel (%d, %d) not correct.", x, y)
+			}
+		}
+
+		for x := 48; x < 61; x++ {
+			r1, _, _, _ := originalImage.At(x, y).RGBA()
+			r2, _, _, _ := transformedImage.At(x, y).RGBA()
+
+			difference := int(r1>>8) - int(r2>>8)
+			if difference < -3 || difference > 3 {
+				t.Fatalf("Edge pixel (%d, %d) not correct.", x, y)
+			}
+		}
+	}
+}
+
+func TestIsPerfectTransform(t *testing.T) {
+	// Color images are 4:2:0, so the iMCUs are 16x16.
+	color := getCoefficientsTestSegmentList(getTestGeneratedJpeg(64, 45, false))
+	gray := getCoefficientsTestSegmentList(getTestGeneratedJpeg(64, 45, true))
+
+	colorCoefficients, err := color.ReadCoefficients()
+	log.PanicIf(err)
+
+	grayCoefficients, err := gray.ReadCoefficients()
+	log.PanicIf(err)
+
+	expected := map[TransformType][2]bool{
+		TransformFlipHorizontal: {true, true},
+		TransformFlipVertical:   {false, false},
+		TransformTranspose:      {true, true},
+		TransformTransverse:     {false, false},
+		TransformRotate90:       {false, false},
+		TransformRotate180:      {false, false},
+		TransformRotate270:      {true, true},
+	}
+
+	for tt, isPerfect := range expected {
+		if isPerfectTransform(colorCoefficients.Frame, tt) != isPerfect[0] {
+			t.Fatalf("Color result for [%s] not correct.", tt)
+		} else if isPerfectTransform(grayCoefficients.Frame, tt) != isPerfect[1] {
+			t.Fatalf("Gray result for [%s] not correct.", tt)
+		}
+	}
+
+	// A 40-pixel height is a whole number of blocks but not of 4:2:0 iMCUs.
+
+	color = getCoefficientsTestSegmentList(getTestGeneratedJpeg(64, 40, false))
+	gray = getCoefficientsTestSegmentList(getTestGeneratedJpeg(64, 40, true))
+
+	colorCoefficients, err = color.ReadCoefficients()
+	log.PanicIf(err)
+
+	grayCoefficients, err = gray.ReadCoefficients()
+	log.PanicIf(err)
+
+	if isPerfectTransform(colorCoefficients.Frame, TransformRotate180) != false {
+		t.Fatalf("Color result not correct.")
+	} else if isPerfectTransform(grayCoefficients.Frame, TransformRotate180) != true {
+		t.Fatalf("Gray result not correct.")
+	}
+}
+
+func TestSegmentList_Transform_Exif(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getValidationTestSegmentList()
+
+	im, err := exifcommon.NewIfdMappingWithStandard()
+	log.PanicIf(err)
+
+	ti := exif.NewTagIndex()
+
+	rootIb := exif.NewIfdBuilder(im, ti, exifcommon.IfdStandardIfdIdentity, exifcommon.TestDefaultByteOrder)
+
+	err = rootIb.AddStandardWithName("Orientation", []uint16{6})
+	log.PanicIf(err)
+
+	exifIb, err := exif.GetOrCreateIbFromRootIb(rootIb, "IFD/Exif")
+	log.PanicIf(err)
+
+	err = exifIb.AddStandardWithName("PixelXDimension", []uint32{64})
+	log.PanicIf(err)
+
+	err = exifIb.AddStandardWithName("PixelYDimension", []uint32{48})
+	log.PanicIf(err)
+
+	err = sl.SetExif(rootIb)
+	log.PanicIf(err)
+
+	err = sl.Transform(TransformRotate90, nil)
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	rootIfd, _, err := sl.Exif()
+	log.PanicIf(err)
+
+	results, err := rootIfd.FindTagWithName("Orientation")
+	log.PanicIf(err)
+
+	value, err := results[0].Value()
+	log.PanicIf(err)
+
+	if value.([]uint16)[0] != 1 {
+		t.Fatalf("Orientation not reset: %v", value)
+	}
+
+	exifIfd, err := rootIfd.ChildWithIfdPath(exifcommon.IfdExifStandardIfdIdentity)
+	log.PanicIf(err)
+
+	expected := map[string]uint32{
+		"PixelXDimension": 48,
+		"PixelYDimension": 64,
+	}
+
+	for tagName, expectedValue := range expected {
+		results, err := exifIfd.FindTagWithName(tagName)
+		log.PanicIf(err)
+
+		value, err := results[0].Value()
+		log.PanicIf(err)
+
+		if value.([]uint32)[0] != expectedValue {
+			t.Fatalf("Tag [%s] not correct: %v", tagName, value)
+		}
+	}
+}
+
+func TestSegmentList_Transform_Thumbnails(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getSanitizeTestSegmentList()
+
+	err := sl.Transform(TransformRotate90, nil)
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	// They'd be the wrong way around.
+
+	thumbnails, err := sl.Thumbnails()
+	log.PanicIf(err)
+
+	if len(thumbnails) != 0 {
+		t.Fatalf("Thumbnails not dropped: %v", thumbnails)
+	}
+
+	_, _, err = sl.ExifThumbnail()
+	if log.Is(err, exif.ErrNoThumbnail) == false {
+		t.Fatalf("Expected no EXIF thumbnail: %v", err)
+	}
+}
+
+func TestSegmentList_Transform_ExifNotRebuildable(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl, original := getFujiTestSegmentList()
+
+	err := sl.Transform(TransformRotate90, nil)
+	if err == nil {
+		t.Fatalf("Expected error for EXIF that can't be rebuilt.")
+	}
+
+	// Nothing was changed, so writing it won't rotate it a second time.
+
+	b := new(bytes.Buffer)
+
+	err = sl.Write(b)
+	log.PanicIf(err)
+
+	if bytes.Equal(b.Bytes(), original) != true {
+		t.Fatalf("Image was changed by the failed transform.")
+	}
+}
@@ -0,0 +1,516 @@
+package jpegstructure
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/dsoprea/go-logging"
+)
+
+var (
+	// ErrNoUltraHdr is returned if the image isn't Ultra HDR or its gain map
+	// can't be found.
+	ErrNoUltraHdr = errors.New("no Ultra HDR gain map")
+
+	// ErrNoGainMapMetadata is returned if there's no gain-map metadata in the
+	// XMP.
+	ErrNoGainMapMetadata = errors.New("no gain-map metadata")
+)
+
+const (
+	xmpNamespaceHdrgm = "http://ns.adobe.com/hdr-gain-map/1.0/"
+
+	// ultraHdrVersion is the version that the primary image declares if we
+	// have to add it.
+	ultraHdrVersion = "1.0"
+
+	containerSemanticPrimary = "Primary"
+	containerSemanticGainMap = "GainMap"
+)
+
+// GainMapMetadata is the metadata of an Ultra HDR gain map (the "hdrgm" XMP
+// namespace). The per-channel values are red, green, and blue, and are all the
+// same if the gain map has only one channel.
+type GainMapMetadata struct {
+	// Version is the version of the format.
+	Version string
+
+	// GainMapMin is the log2 of the smallest content boost.
+	GainMapMin [3]float64
+
+	// GainMapMax is the log2 of the largest content boost.
+	GainMapMax [3]float64
+
+	// Gamma is the gamma that the gain map was encoded with.
+	Gamma [3]float64
+
+	// OffsetSdr and OffsetHdr are added to the SDR and HDR pixels before the
+	// gain is calculated.
+	OffsetSdr [3]float64
+	OffsetHdr [3]float64
+
+	// HdrCapacityMin is the log2 of the display boost at which the gain map
+	// starts to be applied.
+	HdrCapacityMin float64
+
+	// HdrCapacityMax is the log2 of the display boost at which the gain map is
+	// applied fully.
+	HdrCapacityMax float64
+
+	// BaseRenditionIsHdr is true if the primary image is the HDR rendition.
+	BaseRenditionIsHdr bool
+}
+
+// MinContentBoost returns the smallest content boost, as a linear value.
+func (gmm *GainMapMetadata) MinContentBoost() (boost [3]float64) {
+	for i, value := range gmm.GainMapMin {
+		boost[i] = math.Exp2(value)
+	}
+
+	return boost
+}
+
+// MaxContentBoost returns the largest content boost, as a linear value.
+func (gmm *GainMapMetadata) MaxContentBoost() (boost [3]float64) {
+	for i, value := range gmm.GainMapMax {
+		boost[i] = math.Exp2(value)
+	}
+
+	return boost
+}
+
+// IsMultiChannel returns true if the values differ between the channels.
+func (gmm *GainMapMetadata) IsMultiChannel() bool {
+	for _, values := range [][3]float64{gmm.GainMapMin, gmm.GainMapMax, gmm.Gamma, gmm.OffsetSdr, gmm.OffsetHdr} {
+		if values[0] != values[1] || values[0] != values[2] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String returns a descriptive string.
+func (gmm *GainMapMetadata) String() string {
+	return fmt.Sprintf("GainMapMetadata<VERSION=[%s] MIN-BOOST=(%v) MAX-BOOST=(%v) HDR-CAPACITY=(%v)-(%v)>", gmm.Version, gmm.MinContentBoost()[0], gmm.MaxContentBoost()[0], gmm.HdrCapacityMin, gmm.HdrCapacityMax)
+}
+
+// gainMapChannels returns a per-channel property, which is either one value
+// or a sequence of three.
+func gainMapChannels(description *xmpElement, local string, defaultValue float64) (values [3]float64, found bool, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	raw := make([]string, 0, 3)
+
+	if xa := description.attribute(xmpNamespaceHdrgm, local); xa != nil {
+		raw = append(raw, xa.Value)
+	} else if child := description.child(xmpNamespaceHdrgm, local); child != nil {
+		if seq := child.child(xmpNamespaceRdf, "Seq"); seq != nil {
+			for _, node := range seq.Children {
+				if li, ok := node.(*xmpElement); ok == true && li.is(xmpNamespaceRdf, "li") == true {
+					raw = append(raw, strings.TrimSpace(li.text()))
+				}
+			}
+		} else {
+			raw = append(raw, strings.TrimSpace(child.text()))
+		}
+	} else {
+		return [3]float64{defaultValue, defaultValue, defaultValue}, false, nil
+	}
+
+	if len(raw) != 1 && len(raw) != 3 {
+		log.Panicf("gain-map property [%s] has (%d) values", local, len(raw))
+	}
+
+	for i := range values {
+		value, err := strconv.ParseFloat(raw[i%len(raw)], 64)
+		log.PanicIf(err)
+
+		values[i] = value
+	}
+
+	return values, true, nil
+}
+
+// ParseGainMapMetadata parses the gain-map metadata from the XMP packet of a
+// gain-map image. `ErrNoGainMapMetadata` is returned if there isn't any.
+func ParseGainMapMetadata(packet []byte) (gmm *GainMapMetadata, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	xd, err := parseXmpDocument(packet)
+	log.PanicIf(err)
+
+	var description *xmpElement
+
+	xd.walk(func(xe *xmpElement) {
+		if description != nil || xe.is(xmpNamespaceRdf, "Description") == false {
+			return
+		}
+
+		if _, found := xe.property(xmpNamespaceHdrgm, "Version"); found == true {
+			description = xe
+		}
+	})
+
+	if description == nil {
+		return nil, ErrNoGainMapMetadata
+	}
+
+	gmm = new(GainMapMetadata)
+	gmm.Version, _ = description.property(xmpNamespaceHdrgm, "Version")
+
+	channels := []struct {
+		local        string
+		values       *[3]float64
+		defaultValue float64
+		isRequired   bool
+	}{
+		{"GainMapMin", &gmm.GainMapMin, 0, false},
+		{"GainMapMax", &gmm.GainMapMax, 0, true},
+		{"Gamma", &gmm.Gamma, 1, false},
+		{"OffsetSDR", &gmm.OffsetSdr, 1.0 / 64, false},
+		{"OffsetHDR", &gmm.OffsetHdr, 1.0 / 64, false},
+	}
+
+	for _, channel := range channels {
+		values, found, err := gainMapChannels(description, channel.local, channel.defaultValue)
+		log.PanicIf(err)
+
+		if found == false && channel.isRequired == true {
+			log.Panicf("gain-map property [%s] missing", channel.local)
+		}
+
+		*channel.values = values
+	}
+
+	capacities := []struct {
+		local        string
+		value        *float64
+		defaultValue float64
+		isRequired   bool
+	}{
+		{"HDRCapacityMin", &gmm.HdrCapacityMin, 0, false},
+		{"HDRCapacityMax", &gmm.HdrCapacityMax, 0, true},
+	}
+
+	for _, capacity := range capacities {
+		raw, found := description.property(xmpNamespaceHdrgm, capacity.local)
+		if found == false {
+			if capacity.isRequired == true {
+				log.Panicf("gain-map property [%s] missing", capacity.local)
+			}
+
+			*capacity.value = capacity.defaultValue
+			continue
+		}
+
+		*capacity.value, err = strconv.ParseFloat(raw, 64)
+		log.PanicIf(err)
+	}
+
+	if raw, found := description.property(xmpNamespaceHdrgm, "BaseRenditionIsHDR"); found == true {
+		gmm.BaseRenditionIsHdr = strings.EqualFold(raw, "True")
+	}
+
+	return gmm, nil
+}
+
+// GainMapMetadata returns the gain-map metadata of this image, which is
+// expected to be a gain map. `ErrNoGainMapMetadata` is returned if there isn't
+// any.
+func (sl *SegmentList) GainMapMetadata() (gmm *GainMapMetadata, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	_, s, err := sl.FindXmp()
+	if err != nil {
+		if err == ErrNoXmp {
+			return nil, ErrNoGainMapMetadata
+		}
+
+		log.Panic(err)
+	}
+
+	gmm, err = ParseGainMapMetadata(s.Data[len(xmpPrefix):])
+	if err != nil {
+		if err == ErrNoGainMapMetadata {
+			return nil, err
+		}
+
+		log.Panic(err)
+	}
+
+	return gmm, nil
+}
+
+// parseGainMap parses a gain-map image and returns its metadata.
+func parseGainMap(data []byte) (gmm *GainMapMetadata, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	intfc, err := NewJpegMediaParser().ParseBytes(data)
+	log.PanicIf(err)
+
+	sl := intfc.(*SegmentList)
+
+	gmm, err = sl.GainMapMetadata()
+	if err != nil {
+		if err == ErrNoGainMapMetadata {
+			return nil, err
+		}
+
+		log.Panic(err)
+	}
+
+	return gmm, nil
+}
+
+// UltraHdr is the gain map of an Ultra HDR image.
+type UltraHdr struct {
+	// Metadata is the metadata of the gain map.
+	Metadata *GainMapMetadata
+
+	// GainMap is the gain-map image.
+	GainMap []byte
+}
+
+// String returns a descriptive string.
+func (uh *UltraHdr) String() string {
+	return fmt.Sprintf("UltraHdr<METADATA=%s GAIN-MAP-SIZE=(%d)>", uh.Metadata, len(uh.GainMap))
+}
+
+// findGainMap returns where the gain map is in the trailer. The MPF index is
+// tried first and then the container directory, which doesn't depend on the
+// size of the primary image and so still finds it after the primary image has
+// been edited. `ErrNoUltraHdr` is returned if the primary image doesn't
+// declare a gain map or it can't be found.
+func (sl *SegmentList) findGainMap() (start, end int, gmm *GainMapMetadata, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	_, s, err := sl.FindXmp()
+	if err != nil {
+		if err == ErrNoXmp {
+			return 0, 0, nil, ErrNoUltraHdr
+		}
+
+		log.Panic(err)
+	}
+
+	xd, err := parseXmpDocument(s.Data[len(xmpPrefix):])
+	log.PanicIf(err)
+
+	items, err := xd.containerDirectory()
+	log.PanicIf(err)
+
+	gainMapItem := -1
+	for i, ci := range items {
+		if ci.Semantic == containerSemanticGainMap {
+			gainMapItem = i
+			break
+		}
+	}
+
+	if _, found := xd.property(xmpNamespaceHdrgm, "Version"); found == false && gainMapItem < 0 {
+		return 0, 0, nil, ErrNoUltraHdr
+	}
+
+	candidates := make([][2]int, 0)
+
+	mi, err := sl.Mpf()
+	if err == nil {
+		headerOffset, err := sl.mpfHeaderOffset()
+		log.PanicIf(err)
+
+		_, size := sl.encodedOffsets()
+
+		for _, me := range mi.Entries[1:] {
+			start := headerOffset + int(me.Offset) - size
+			candidates = append(candidates, [2]int{start, start + int(me.Size)})
+		}
+	} else if err != ErrNoMpf {
+		log.Panic(err)
+	}
+
+	if gainMapItem > 0 {
+		start := containerItemOffset(items, gainMapItem)
+		candidates = append(candidates, [2]int{start, start + items[gainMapItem].Length})
+	}
+
+	for _, candidate := range candidates {
+		start, end := candidate[0], candidate[1]
+		if start < 0 || end > len(sl.trailer) || end <= start {
+			continue
+		}
+
+		// If the offsets are stale, this is just some part of the trailer,
+		// so any error only means that it's not the gain map.
+		gmm, err := parseGainMap(sl.trailer[start:end])
+		if err == nil {
+			return start, end, gmm, nil
+		}
+	}
+
+	return 0, 0, nil, ErrNoUltraHdr
+}
+
+// UltraHdr returns the gain map of an Ultra HDR image, which is stored after
+// the primary image and described by the MPF index and the container
+// directory in the XMP. `ErrNoUltraHdr` is returned if the image isn't Ultra
+// HDR or the gain map can't be found.
+func (sl *SegmentList) UltraHdr() (uh *UltraHdr, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	start, end, gmm, err := sl.findGainMap()
+	if err != nil {
+		if err == ErrNoUltraHdr {
+			return nil, err
+		}
+
+		log.Panic(err)
+	}
+
+	uh = &UltraHdr{
+		Metadata: gmm,
+		GainMap:  append([]byte{}, sl.trailer[start:end]...),
+	}
+
+	return uh, nil
+}
+
+// SetUltraHdr stores the gain map after the primary image and rewrites the
+// XMP container directory and the MPF index to describe it. This is how an
+// Ultra HDR image is put back together after the primary image has been
+// edited: get the gain map with `UltraHdr` beforehand, make the same
+// geometric changes to it (if any), and then set it. It can also make an
+// Ultra HDR image out of any image.
+//
+// Whatever followed the old gain map in the trailer (a Motion Photo video,
+// for example) is kept after the new one. Anything before it is dropped, and
+// the MPF index only describes the primary image and the gain map. This has
+// to be done after any other changes to the segments.
+func (sl *SegmentList) SetUltraHdr(gainMap []byte) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	_, err = parseGainMap(gainMap)
+	log.PanicIf(err)
+
+	remainder := sl.trailer
+
+	_, end, _, err := sl.findGainMap()
+	isFound := err == nil
+
+	if isFound == true {
+		remainder = sl.trailer[end:]
+	} else if err != ErrNoUltraHdr {
+		log.Panic(err)
+	}
+
+	remainder = append([]byte{}, remainder...)
+
+	// Update the container directory, adding the XMP if there isn't any.
+
+	s, xd, err := sl.editableXmp()
+	log.PanicIf(err)
+
+	items, err := xd.containerDirectory()
+	log.PanicIf(err)
+
+	if len(items) == 0 {
+		items = []containerItem{
+			{Semantic: containerSemanticPrimary, Mime: "image/jpeg"},
+		}
+	}
+
+	gainMapItem := containerItem{
+		Semantic: containerSemanticGainMap,
+		Mime:     "image/jpeg",
+		Length:   len(gainMap),
+	}
+
+	// The gain map goes right after the primary image. The items that
+	// follow it are still in the remainder, but the ones that were before
+	// the old gain map were dropped with the rest of that part of the
+	// trailer.
+
+	updated := []containerItem{items[0], gainMapItem}
+	updated[0].Padding = 0
+
+	isKept := isFound == false
+	for _, ci := range items[1:] {
+		if ci.Semantic == containerSemanticGainMap {
+			isKept = true
+		} else if isKept == true {
+			updated = append(updated, ci)
+		}
+	}
+
+	description, err := xd.setContainerDirectory(updated)
+	log.PanicIf(err)
+
+	if _, found := xd.property(xmpNamespaceHdrgm, "Version"); found == false {
+		description.addAttribute("hdrgm", xmpNamespaceHdrgm, "Version", ultraHdrVersion)
+	}
+
+	err = setXmpDocument(s, xd)
+	log.PanicIf(err)
+
+	// Replace the MPF index, adding it after the application segments if
+	// there isn't one.
+
+	entries := []MpfEntry{
+		{Attribute: uint32(MpfImageTypeBaselinePrimary)},
+		{Attribute: uint32(MpfImageTypeUndefined)},
+	}
+
+	_, mpfSegment, err := sl.FindMpf()
+	if err == nil {
+		mpfSegment.Data = encodeMpfSegment(entries)
+	} else {
+		mpfSegment = &Segment{
+			MarkerId:   MARKER_APP2,
+			MarkerName: markerNames[MARKER_APP2],
+			Data:       encodeMpfSegment(entries),
+		}
+
+		i := 1
+		for i < len(sl.segments) && sl.segments[i].MarkerId >= MARKER_APP0 && sl.segments[i].MarkerId <= MARKER_APP15 {
+			i++
+		}
+
+		sl.segments = append(sl.segments[:i], append([]*Segment{mpfSegment}, sl.segments[i:]...)...)
+	}
+
+	err = sl.setMpfImages(entries, [][]byte{gainMap}, remainder)
+	log.PanicIf(err)
+
+	return nil
+}
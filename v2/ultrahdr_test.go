@@ -0,0 +1,287 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/dsoprea/go-logging"
+)
+
+const (
+	ultraHdrTestGainMapPacket = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:hdrgm="http://ns.adobe.com/hdr-gain-map/1.0/"
+    hdrgm:Version="1.0"
+    hdrgm:GainMapMin="-1"
+    hdrgm:GainMapMax="2"
+    hdrgm:Gamma="1"
+    hdrgm:HDRCapacityMin="0"
+    hdrgm:HDRCapacityMax="2.5"
+    hdrgm:BaseRenditionIsHDR="False"/>
+ </rdf:RDF>
+</x:xmpmeta>`
+
+	ultraHdrTestMultiChannelPacket = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:hdrgm="http://ns.adobe.com/hdr-gain-map/1.0/" hdrgm:Version="1.0" hdrgm:HDRCapacityMax="3">
+   <hdrgm:GainMapMax><rdf:Seq><rdf:li>1</rdf:li><rdf:li>2</rdf:li><rdf:li>3</rdf:li></rdf:Seq></hdrgm:GainMapMax>
+   <hdrgm:OffsetSDR>0.5</hdrgm:OffsetSDR>
+   <hdrgm:BaseRenditionIsHDR>True</hdrgm:BaseRenditionIsHDR>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`
+)
+
+// getUltraHdrTestGainMap returns a grayscale gain map with its metadata.
+func getUltraHdrTestGainMap(width, height int) []byte {
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(width, height, true))
+
+	s := &Segment{
+		MarkerId:   MARKER_APP1,
+		MarkerName: markerNames[MARKER_APP1],
+		Data:       append(append([]byte{}, xmpPrefix...), ultraHdrTestGainMapPacket...),
+	}
+
+	sl.segments = append([]*Segment{sl.segments[0], s}, sl.segments[1:]...)
+
+	_, data := reparseSegmentList(sl)
+
+	return data
+}
+
+// getUltraHdrTestSegmentList returns a 64x48 Ultra HDR image with a gain map
+// at a quarter of the size.
+func getUltraHdrTestSegmentList() (sl *SegmentList, gainMap []byte) {
+	sl = getCoefficientsTestSegmentList(getTestGeneratedJpeg(64, 48, false))
+	gainMap = getUltraHdrTestGainMap(16, 12)
+
+	err := sl.SetUltraHdr(gainMap)
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	return sl, gainMap
+}
+
+func TestParseGainMapMetadata(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	gmm, err := ParseGainMapMetadata([]byte(ultraHdrTestGainMapPacket))
+	log.PanicIf(err)
+
+	if gmm.Version != "1.0" || gmm.GainMapMin != [3]float64{-1, -1, -1} || gmm.GainMapMax != [3]float64{2, 2, 2} {
+		t.Fatalf("Gain-map range not correct: %v", gmm)
+	} else if gmm.OffsetSdr != [3]float64{1.0 / 64, 1.0 / 64, 1.0 / 64} || gmm.OffsetHdr != gmm.OffsetSdr {
+		t.Fatalf("Default offsets not correct: %v %v", gmm.OffsetSdr, gmm.OffsetHdr)
+	} else if gmm.HdrCapacityMin != 0 || gmm.HdrCapacityMax != 2.5 || gmm.BaseRenditionIsHdr != false {
+		t.Fatalf("Capacities not correct: %v", gmm)
+	} else if gmm.MinContentBoost() != [3]float64{0.5, 0.5, 0.5} || gmm.MaxContentBoost() != [3]float64{4, 4, 4} {
+		t.Fatalf("Content boosts not correct: %v %v", gmm.MinContentBoost(), gmm.MaxContentBoost())
+	} else if gmm.IsMultiChannel() != false {
+		t.Fatalf("Expected one channel.")
+	} else if gmm.String() != "GainMapMetadata<VERSION=[1.0] MIN-BOOST=(0.5) MAX-BOOST=(4) HDR-CAPACITY=(0)-(2.5)>" {
+		t.Fatalf("String not correct: [%s]", gmm)
+	}
+
+	gmm, err = ParseGainMapMetadata([]byte(ultraHdrTestMultiChannelPacket))
+	log.PanicIf(err)
+
+	if gmm.GainMapMax != [3]float64{1, 2, 3} || gmm.IsMultiChannel() != true {
+		t.Fatalf("Channels not correct: %v", gmm.GainMapMax)
+	} else if gmm.Gamma != [3]float64{1, 1, 1} || gmm.OffsetSdr != [3]float64{0.5, 0.5, 0.5} {
+		t.Fatalf("Scalars not correct: %v %v", gmm.Gamma, gmm.OffsetSdr)
+	} else if gmm.BaseRenditionIsHdr != true || math.Abs(gmm.HdrCapacityMax-3) > 1e-9 {
+		t.Fatalf("Properties not correct: %v", gmm)
+	}
+}
+
+func TestParseGainMapMetadata_Missing(t *testing.T) {
+	if _, err := ParseGainMapMetadata([]byte(xmpTestPacket)); err != ErrNoGainMapMetadata {
+		t.Fatalf("Expected no metadata: %v", err)
+	}
+
+	// The primary image has the version but not the rest.
+
+	packet := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"><rdf:Description xmlns:hdrgm="http://ns.adobe.com/hdr-gain-map/1.0/" hdrgm:Version="1.0"/></rdf:RDF></x:xmpmeta>`
+
+	if _, err := ParseGainMapMetadata([]byte(packet)); err == nil || err == ErrNoGainMapMetadata {
+		t.Fatalf("Expected error for missing properties: %v", err)
+	}
+}
+
+func TestSegmentList_UltraHdr(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl, gainMap := getUltraHdrTestSegmentList()
+
+	uh, err := sl.UltraHdr()
+	log.PanicIf(err)
+
+	if bytes.Equal(uh.GainMap, gainMap) != true {
+		t.Fatalf("Gain map not correct.")
+	} else if uh.Metadata.HdrCapacityMax != 2.5 {
+		t.Fatalf("Metadata not correct: %s", uh.Metadata)
+	}
+
+	// Other readers use the MPF index and the container directory.
+
+	mi, err := sl.Mpf()
+	log.PanicIf(err)
+
+	if len(mi.Entries) != 2 || mi.Entries[0].Type() != MpfImageTypeBaselinePrimary || mi.Entries[1].Type() != MpfImageTypeUndefined {
+		t.Fatalf("MPF entries not correct: %v", mi.Entries)
+	}
+
+	data, err := sl.MpfImage(1)
+	log.PanicIf(err)
+
+	if bytes.Equal(data, gainMap) != true {
+		t.Fatalf("MPF image not correct.")
+	}
+
+	_, s, err := sl.FindXmp()
+	log.PanicIf(err)
+
+	xd, err := parseXmpDocument(s.Data[len(xmpPrefix):])
+	log.PanicIf(err)
+
+	items, err := xd.containerDirectory()
+	log.PanicIf(err)
+
+	if len(items) != 2 || items[0].Semantic != "Primary" || items[1].Semantic != "GainMap" || items[1].Length != len(gainMap) {
+		t.Fatalf("Container directory not correct: %v", items)
+	} else if version, _ := xd.property(xmpNamespaceHdrgm, "Version"); version != "1.0" {
+		t.Fatalf("Version not correct: [%s]", version)
+	}
+}
+
+func TestSegmentList_UltraHdr_NotUltraHdr(t *testing.T) {
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(16, 16, false))
+
+	if _, err := sl.UltraHdr(); err != ErrNoUltraHdr {
+		t.Fatalf("Expected not Ultra HDR: %v", err)
+	}
+
+	sl = getSanitizeTestSegmentList()
+
+	if _, err := sl.UltraHdr(); err != ErrNoUltraHdr {
+		t.Fatalf("Expected not Ultra HDR: %v", err)
+	}
+}
+
+func TestSegmentList_SetUltraHdr_AfterEdit(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl, gainMap := getUltraHdrTestSegmentList()
+
+	// Something else follows the gain map.
+	sl.SetTrailer(append(sl.Trailer(), "after"...))
+
+	// Edits to the primary image leave the MPF offsets stale, but the gain
+	// map can still be found.
+
+	sl.AddComment("edited")
+
+	err := sl.Transform(TransformRotate90, nil)
+	log.PanicIf(err)
+
+	if data, err := sl.MpfImage(1); err == nil && bytes.Equal(data, gainMap) == true {
+		t.Fatalf("Expected the MPF offset to be stale.")
+	}
+
+	uh, err := sl.UltraHdr()
+	log.PanicIf(err)
+
+	gainMapSl := getCoefficientsTestSegmentList(uh.GainMap)
+
+	err = gainMapSl.Transform(TransformRotate90, nil)
+	log.PanicIf(err)
+
+	_, rotatedGainMap := reparseSegmentList(gainMapSl)
+
+	err = sl.SetUltraHdr(rotatedGainMap)
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	data, err := sl.MpfImage(1)
+	log.PanicIf(err)
+
+	if bytes.Equal(data, rotatedGainMap) != true {
+		t.Fatalf("MPF image not correct.")
+	} else if bytes.HasSuffix(sl.Trailer(), []byte("after")) != true || len(sl.Trailer()) != len(rotatedGainMap)+5 {
+		t.Fatalf("Trailer not correct.")
+	}
+
+	uh, err = sl.UltraHdr()
+	log.PanicIf(err)
+
+	if bytes.Equal(uh.GainMap, rotatedGainMap) != true {
+		t.Fatalf("Gain map not correct.")
+	}
+
+	comments := sl.Comments()
+	if len(comments) != 1 || comments[0].Text != "edited" {
+		t.Fatalf("Edit lost: %v", comments)
+	}
+}
+
+func TestSegmentList_SetUltraHdr_ExistingXmp(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getSanitizeTestSegmentList()
+	gainMap := getUltraHdrTestGainMap(16, 12)
+
+	err := sl.SetUltraHdr(gainMap)
+	log.PanicIf(err)
+
+	sl, _ = reparseSegmentList(sl)
+
+	uh, err := sl.UltraHdr()
+	log.PanicIf(err)
+
+	if bytes.Equal(uh.GainMap, gainMap) != true {
+		t.Fatalf("Gain map not correct.")
+	}
+
+	xmpProperties, err := sl.xmpProperties()
+	log.PanicIf(err)
+
+	if xmpProperties["dc:creator[1]"] != "Someone" {
+		t.Fatalf("XMP not kept: %v", xmpProperties)
+	}
+
+	// The old trailer isn't part of the container, but it's kept.
+	if bytes.HasSuffix(sl.Trailer(), []byte("private trailer")) != true {
+		t.Fatalf("Trailer not kept.")
+	}
+
+	if err := sl.SetUltraHdr(getTestGeneratedJpeg(16, 12, true)); err == nil {
+		t.Fatalf("Expected error for a gain map without metadata.")
+	}
+}
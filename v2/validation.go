@@ -0,0 +1,557 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/dsoprea/go-logging"
+)
+
+// ValidationSeverity describes how serious a validation finding is.
+type ValidationSeverity int
+
+const (
+	// ValidationSeverityInfo is a noteworthy but harmless finding.
+	ValidationSeverityInfo ValidationSeverity = iota
+
+	// ValidationSeverityWarning is a deviation from the standard that most
+	// decoders will tolerate.
+	ValidationSeverityWarning
+
+	// ValidationSeverityError is a problem that will prevent the image from
+	// being decoded correctly.
+	ValidationSeverityError
+)
+
+// String returns the name of the severity.
+func (vs ValidationSeverity) String() string {
+	switch vs {
+	case ValidationSeverityInfo:
+		return "info"
+	case ValidationSeverityWarning:
+		return "warning"
+	case ValidationSeverityError:
+		return "error"
+	}
+
+	return fmt.Sprintf("severity(%d)", int(vs))
+}
+
+// Validation finding codes. These are stable and are safe to match on.
+const (
+	FindingMissingSoi             = "missing-soi"
+	FindingMissingEoi             = "missing-eoi"
+	FindingMalformedSegment       = "malformed-segment"
+	FindingOversizedSegment       = "oversized-segment"
+	FindingMissingSof             = "missing-sof"
+	FindingDuplicateSof           = "duplicate-sof"
+	FindingMissingSos             = "missing-sos"
+	FindingScanBeforeFrame        = "scan-before-frame"
+	FindingTableDefinedLate       = "table-defined-late"
+	FindingUndefinedTable         = "undefined-table"
+	FindingJfifNotFirst           = "jfif-not-first"
+	FindingMultipleExif           = "multiple-exif"
+	FindingInvalidPrecision       = "invalid-precision"
+	FindingInvalidComponentCount  = "invalid-component-count"
+	FindingDuplicateComponentId   = "duplicate-component-id"
+	FindingInvalidSampling        = "invalid-sampling"
+	FindingUnknownScanComponent   = "unknown-scan-component"
+	FindingZeroDimensions         = "zero-dimensions"
+	FindingMissingDnl             = "missing-dnl"
+	FindingUnexpectedDnl          = "unexpected-dnl"
+	FindingUnexpectedRestart      = "unexpected-restart"
+	FindingRestartSequence        = "restart-sequence"
+	FindingRestartCountMismatch   = "restart-count-mismatch"
+	FindingInvalidRestartInterval = "invalid-restart-interval"
+)
+
+const (
+	// maxBlocksPerMcu is the most blocks that an interleaved MCU may have.
+	maxBlocksPerMcu = 10
+)
+
+var (
+	jfifPrefix = []byte("JFIF\000")
+)
+
+// ValidationFinding is a single problem found by `ValidateStructure`.
+type ValidationFinding struct {
+	// Severity is how serious the problem is.
+	Severity ValidationSeverity
+
+	// Code identifies the kind of problem (one of the `Finding*` constants).
+	Code string
+
+	// MarkerId is the marker of the segment that the finding relates to, or
+	// (0) if it relates to the image as a whole or the entropy-coded data.
+	MarkerId byte
+
+	// Offset is the file offset of the segment that the finding relates to, or
+	// -1 if it relates to the image as a whole.
+	Offset int
+
+	// Message describes the problem.
+	Message string
+}
+
+// String returns a descriptive string.
+func (vf ValidationFinding) String() string {
+	return fmt.Sprintf("ValidationFinding<SEVERITY=[%s] CODE=[%s] MARKER=(0x%02x) OFFSET=(%d) MESSAGE=[%s]>", vf.Severity, vf.Code, vf.MarkerId, vf.Offset, vf.Message)
+}
+
+// ValidationFindings is a list of findings.
+type ValidationFindings []ValidationFinding
+
+// HasErrors returns true if any of the findings are errors.
+func (vfs ValidationFindings) HasErrors() bool {
+	for _, vf := range vfs {
+		if vf.Severity == ValidationSeverityError {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Codes returns the codes of all of the findings, in order.
+func (vfs ValidationFindings) Codes() []string {
+	codes := make([]string, len(vfs))
+	for i, vf := range vfs {
+		codes[i] = vf.Code
+	}
+
+	return codes
+}
+
+type tableReference struct {
+	isHuffman bool
+	class     byte
+	id        byte
+	offset    int
+}
+
+func (tr tableReference) String() string {
+	if tr.isHuffman == false {
+		return fmt.Sprintf("DQT table (%d)", tr.id)
+	} else if tr.class == HuffmanClassDc {
+		return fmt.Sprintf("DC DHT table (%d)", tr.id)
+	}
+
+	return fmt.Sprintf("AC DHT table (%d)", tr.id)
+}
+
+type structureValidator struct {
+	findings ValidationFindings
+
+	frame           *SofSegment
+	scan            *ScanHeader
+	scanCount       int
+	restartInterval int
+	dnlSeen         bool
+
+	// isSamplingInvalid is set if the frame has sampling factors that we
+	// can't compute an MCU count from.
+	isSamplingInvalid bool
+
+	quantizationDefined [16]bool
+	huffmanDefined      [2][16]bool
+
+	// pending are references to tables that weren't yet defined when they
+	// were needed.
+	pending []tableReference
+}
+
+func (sv *structureValidator) add(severity ValidationSeverity, code string, s *Segment, format string, args ...interface{}) {
+	vf := ValidationFinding{
+		Severity: severity,
+		Code:     code,
+		Offset:   -1,
+		Message:  fmt.Sprintf(format, args...),
+	}
+
+	if s != nil {
+		vf.MarkerId = s.MarkerId
+		vf.Offset = s.Offset
+	}
+
+	sv.findings = append(sv.findings, vf)
+}
+
+func (sv *structureValidator) isTableDefined(tr tableReference) bool {
+	if tr.isHuffman == false {
+		return sv.quantizationDefined[tr.id&0x0f]
+	}
+
+	return sv.huffmanDefined[tr.class&1][tr.id&0x0f]
+}
+
+func (sv *structureValidator) require(tr tableReference, s *Segment) {
+	if sv.isTableDefined(tr) == true {
+		return
+	}
+
+	for _, existing := range sv.pending {
+		if existing.isHuffman == tr.isHuffman && existing.class == tr.class && existing.id == tr.id {
+			return
+		}
+	}
+
+	tr.offset = s.Offset
+	sv.pending = append(sv.pending, tr)
+}
+
+func (sv *structureValidator) checkFrame(s *Segment) {
+	fh, err := ParseSofSegment(s.MarkerId, s.Data)
+	if err != nil {
+		sv.add(ValidationSeverityError, FindingMalformedSegment, s, "SOF segment could not be parsed: %s", err.Error())
+		return
+	}
+
+	if sv.frame != nil && (sv.frame.IsHierarchical() == false || fh.IsHierarchical() == false) {
+		sv.add(ValidationSeverityError, FindingDuplicateSof, s, "more than one SOF segment: [%s] and [%s]", markerNames[sv.frame.MarkerId], markerNames[fh.MarkerId])
+		return
+	}
+
+	sv.frame = fh
+
+	p := fh.BitsPerSample
+	if fh.IsLossless() == true {
+		if p < 2 || p > 16 {
+			sv.add(ValidationSeverityError, FindingInvalidPrecision, s, "lossless precision must be 2-16 bits: (%d)", p)
+		}
+	} else if fh.MarkerId == MARKER_SOF0 {
+		if p != 8 {
+			sv.add(ValidationSeverityError, FindingInvalidPrecision, s, "baseline precision must be 8 bits: (%d)", p)
+		}
+	} else if p != 8 && p != 12 {
+		sv.add(ValidationSeverityError, FindingInvalidPrecision, s, "DCT precision must be 8 or 12 bits: (%d)", p)
+	}
+
+	count := len(fh.Components)
+	if count == 0 {
+		sv.add(ValidationSeverityError, FindingInvalidComponentCount, s, "frame has no components")
+	} else if count > 4 {
+		if fh.IsProgressive() == true {
+			sv.add(ValidationSeverityError, FindingInvalidComponentCount, s, "progressive frame has more than four components: (%d)", count)
+		} else {
+			sv.add(ValidationSeverityWarning, FindingInvalidComponentCount, s, "frame has more than four components: (%d)", count)
+		}
+	}
+
+	seen := make(map[byte]bool)
+	for _, fc := range fh.Components {
+		if seen[fc.Id] == true {
+			sv.add(ValidationSeverityError, FindingDuplicateComponentId, s, "component ID used more than once: (%d)", fc.Id)
+		}
+
+		seen[fc.Id] = true
+
+		if fc.HorizontalSampling < 1 || fc.HorizontalSampling > 4 || fc.VerticalSampling < 1 || fc.VerticalSampling > 4 {
+			sv.add(ValidationSeverityError, FindingInvalidSampling, s, "sampling factors for component (%d) must be 1-4: (%d)x(%d)", fc.Id, fc.HorizontalSampling, fc.VerticalSampling)
+
+			sv.isSamplingInvalid = true
+		}
+
+		if fc.QuantizationTableId > 3 {
+			sv.add(ValidationSeverityError, FindingUndefinedTable, s, "component (%d) refers to an invalid DQT table: (%d)", fc.Id, fc.QuantizationTableId)
+		}
+	}
+
+	if fh.Width == 0 {
+		sv.add(ValidationSeverityError, FindingZeroDimensions, s, "frame width is zero")
+	}
+}
+
+func (sv *structureValidator) checkScan(s *Segment) {
+	if sv.frame == nil {
+		sv.add(ValidationSeverityError, FindingScanBeforeFrame, s, "SOS segment before any SOF segment")
+	}
+
+	sh, err := ParseScanHeader(s.Data)
+	if err != nil {
+		sv.add(ValidationSeverityError, FindingMalformedSegment, s, "SOS segment could not be parsed: %s", err.Error())
+
+		sv.scan = nil
+		return
+	}
+
+	sv.scan = sh
+	sv.scanCount++
+
+	count := len(sh.Components)
+	if count < 1 || count > 4 {
+		sv.add(ValidationSeverityError, FindingInvalidComponentCount, s, "scan must have 1-4 components: (%d)", count)
+	}
+
+	if sv.frame == nil {
+		return
+	}
+
+	fh := sv.frame
+
+	// The quantization tables only need to be available by the time the
+	// first scan is decoded.
+	if sv.scanCount == 1 && fh.IsLossless() == false {
+		for _, fc := range fh.Components {
+			sv.require(tableReference{id: fc.QuantizationTableId}, s)
+		}
+	}
+
+	blocks := 0
+	for _, sc := range sh.Components {
+		i := fh.ComponentIndex(sc.ComponentId)
+		if i == -1 {
+			sv.add(ValidationSeverityError, FindingUnknownScanComponent, s, "scan refers to a component not in the frame: (%d)", sc.ComponentId)
+			continue
+		}
+
+		fc := fh.Components[i]
+		blocks += int(fc.HorizontalSampling) * int(fc.VerticalSampling)
+
+		// Arithmetic-coded images have no Huffman tables.
+		if fh.IsArithmetic() == true {
+			continue
+		}
+
+		if fh.IsLossless() == true {
+			sv.require(tableReference{isHuffman: true, class: HuffmanClassDc, id: sc.DcTableId}, s)
+			continue
+		}
+
+		// DC refinement scans are coded without tables.
+		if sh.SpectralStart == 0 && (fh.IsProgressive() == false || sh.ApproximationHigh == 0) {
+			sv.require(tableReference{isHuffman: true, class: HuffmanClassDc, id: sc.DcTableId}, s)
+		}
+
+		if sh.SpectralEnd > 0 {
+			sv.require(tableReference{isHuffman: true, class: HuffmanClassAc, id: sc.AcTableId}, s)
+		}
+	}
+
+	if count > 1 && blocks > maxBlocksPerMcu && fh.IsLossless() == false {
+		sv.add(ValidationSeverityError, FindingInvalidSampling, s, "interleaved scan has more than (%d) blocks per MCU: (%d)", maxBlocksPerMcu, blocks)
+	}
+
+	if fh.IsProgressive() == true && sh.SpectralStart > 0 && count != 1 {
+		sv.add(ValidationSeverityError, FindingInvalidComponentCount, s, "progressive AC scan must have exactly one component: (%d)", count)
+	}
+}
+
+// scanMcuCount returns the number of MCUs in the current scan.
+func (sv *structureValidator) scanMcuCount() int {
+	fh := sv.frame
+	sh := sv.scan
+
+	if len(sh.Components) == 1 {
+		i := fh.ComponentIndex(sh.Components[0].ComponentId)
+		if i == -1 {
+			return 0
+		}
+
+		if fh.IsLossless() == true {
+			width, height := fh.ComponentSize(i)
+			return width * height
+		}
+
+		columns, rows := fh.ComponentVisibleBlocks(i)
+		return columns * rows
+	}
+
+	if fh.IsLossless() == true {
+		hMax, vMax := fh.MaxSampling()
+		return ceilDiv(int(fh.Width), hMax) * ceilDiv(int(fh.Height), vMax)
+	}
+
+	columns, rows := fh.McuCount()
+	return columns * rows
+}
+
+func (sv *structureValidator) checkEntropyData(s *Segment) {
+	data := s.Data
+
+	restartCount := 0
+	for i := 0; i < len(data)-1; i++ {
+		if data[i] != 0xff || isRestartMarker(data[i+1]) == false {
+			continue
+		}
+
+		n := int(data[i+1] - MARKER_RST0)
+		if n != restartCount%8 {
+			sv.add(ValidationSeverityError, FindingRestartSequence, s, "restart marker out of sequence at offset (%d): RST%d where RST%d was expected", s.Offset+i, n, restartCount%8)
+
+			// Only report the first discontinuity.
+			restartCount = -1
+			break
+		}
+
+		restartCount++
+		i++
+	}
+
+	if restartCount == -1 || sv.frame == nil || sv.scan == nil {
+		return
+	}
+
+	if sv.restartInterval == 0 {
+		if restartCount > 0 {
+			sv.add(ValidationSeverityError, FindingUnexpectedRestart, s, "scan has (%d) restart markers but no restart interval is defined", restartCount)
+		}
+
+		return
+	}
+
+	// We can't know how many MCUs there are until we see the DNL, and we
+	// can't know at all without valid sampling factors.
+	if sv.frame.Height == 0 || sv.isSamplingInvalid == true {
+		return
+	}
+
+	mcus := sv.scanMcuCount()
+	if mcus == 0 {
+		return
+	}
+
+	expected := ceilDiv(mcus, sv.restartInterval) - 1
+	if restartCount != expected {
+		sv.add(ValidationSeverityError, FindingRestartCountMismatch, s, "scan has (%d) restart markers but (%d) were expected for (%d) MCUs with an interval of (%d)", restartCount, expected, mcus, sv.restartInterval)
+	}
+}
+
+func (sv *structureValidator) checkSegment(s *Segment, isFirstApp bool, previous *Segment) {
+	if s.MarkerId != 0 && len(s.Data) > maxSegmentPayloadSize {
+		sv.add(ValidationSeverityError, FindingOversizedSegment, s, "segment payload is larger than the format allows: (%d) > (%d)", len(s.Data), maxSegmentPayloadSize)
+	}
+
+	switch {
+	case s.MarkerId == MARKER_DQT:
+		tables, err := ParseQuantizationTables(s.Data)
+		if err != nil {
+			sv.add(ValidationSeverityError, FindingMalformedSegment, s, "DQT segment could not be parsed: %s", err.Error())
+			return
+		}
+
+		for _, qt := range tables {
+			sv.quantizationDefined[qt.Id] = true
+		}
+	case s.MarkerId == MARKER_DHT:
+		tables, err := ParseHuffmanTables(s.Data)
+		if err != nil {
+			sv.add(ValidationSeverityError, FindingMalformedSegment, s, "DHT segment could not be parsed: %s", err.Error())
+			return
+		}
+
+		for _, ht := range tables {
+			sv.huffmanDefined[ht.Class][ht.Id] = true
+		}
+	case s.MarkerId == MARKER_DRI:
+		interval, err := ParseRestartInterval(s.Data)
+		if err != nil {
+			sv.add(ValidationSeverityError, FindingInvalidRestartInterval, s, "DRI segment could not be parsed: %s", err.Error())
+			return
+		}
+
+		sv.restartInterval = interval
+	case s.MarkerId == MARKER_DNL:
+		sv.dnlSeen = true
+
+		lines, err := ParseNumberOfLines(s.Data)
+		if err != nil {
+			sv.add(ValidationSeverityError, FindingMalformedSegment, s, "DNL segment could not be parsed: %s", err.Error())
+		} else if lines == 0 {
+			sv.add(ValidationSeverityError, FindingZeroDimensions, s, "DNL segment has zero lines")
+		} else if sv.frame != nil && sv.frame.Height != 0 {
+			sv.add(ValidationSeverityWarning, FindingUnexpectedDnl, s, "DNL segment present but the frame already has a height")
+		}
+	case s.MarkerId == MARKER_SOS:
+		sv.checkScan(s)
+	case s.MarkerId == 0:
+		sv.checkEntropyData(s)
+	case isSofMarker(s.MarkerId) == true:
+		sv.checkFrame(s)
+	case s.MarkerId >= MARKER_APP0 && s.MarkerId <= MARKER_APP15:
+		if s.MarkerId == MARKER_APP0 && bytes.HasPrefix(s.Data, jfifPrefix) == true {
+			if isFirstApp == false || previous == nil || previous.MarkerId != MARKER_SOI {
+				sv.add(ValidationSeverityWarning, FindingJfifNotFirst, s, "JFIF segment does not immediately follow the SOI")
+			}
+		}
+	}
+}
+
+// ValidateStructure checks the structure of the image much more thoroughly than
+// `Validate` and returns a list of findings explaining each problem. An
+// empty list means that no problems were found. An error is only returned if
+// the check itself could not be performed.
+func (sl *SegmentList) ValidateStructure() (findings ValidationFindings, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	sv := new(structureValidator)
+
+	segments, err := sl.expandedSegments()
+	if err != nil {
+		sv.add(ValidationSeverityError, FindingMalformedSegment, nil, "scan-data could not be split: %s", err.Error())
+
+		// Validate the segments that we do have.
+		segments = sl.segments
+	}
+
+	if len(segments) == 0 || segments[0].MarkerId != MARKER_SOI {
+		sv.add(ValidationSeverityError, FindingMissingSoi, nil, "first segment is not SOI")
+	}
+
+	if len(segments) == 0 || segments[len(segments)-1].MarkerId != MARKER_EOI {
+		sv.add(ValidationSeverityError, FindingMissingEoi, nil, "last segment is not EOI")
+	}
+
+	exifCount := 0
+	appSeen := false
+
+	var previous *Segment
+	for _, s := range segments {
+		isApp := s.MarkerId >= MARKER_APP0 && s.MarkerId <= MARKER_APP15
+
+		sv.checkSegment(s, isApp == true && appSeen == false, previous)
+
+		if isApp == true {
+			appSeen = true
+		}
+
+		if s.IsExif() == true {
+			exifCount++
+
+			if exifCount == 2 {
+				sv.add(ValidationSeverityWarning, FindingMultipleExif, s, "more than one EXIF segment")
+			}
+		}
+
+		previous = s
+	}
+
+	if sv.frame == nil {
+		sv.add(ValidationSeverityError, FindingMissingSof, nil, "no SOF segment")
+	} else if sv.frame.Height == 0 && sv.dnlSeen == false {
+		sv.add(ValidationSeverityError, FindingMissingDnl, nil, "frame height is zero and there is no DNL segment")
+	}
+
+	if sv.scanCount == 0 {
+		sv.add(ValidationSeverityError, FindingMissingSos, nil, "no SOS segment")
+	}
+
+	for _, tr := range sv.pending {
+		s := &Segment{
+			MarkerId: MARKER_SOS,
+			Offset:   tr.offset,
+		}
+
+		if sv.isTableDefined(tr) == true {
+			sv.add(ValidationSeverityError, FindingTableDefinedLate, s, "%s is defined after the scan that needs it", tr)
+		} else {
+			sv.add(ValidationSeverityError, FindingUndefinedTable, s, "%s is referenced but never defined", tr)
+		}
+	}
+
+	return sv.findings, nil
+}
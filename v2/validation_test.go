@@ -0,0 +1,341 @@
+package jpegstructure
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dsoprea/go-exif/v3"
+	"github.com/dsoprea/go-exif/v3/common"
+	"github.com/dsoprea/go-logging"
+)
+
+func getValidationTestSegmentList() *SegmentList {
+	data := getTestGeneratedJpeg(64, 48, false)
+
+	jmp := NewJpegMediaParser()
+
+	intfc, err := jmp.ParseBytes(data)
+	log.PanicIf(err)
+
+	return intfc.(*SegmentList)
+}
+
+func TestSegmentList_ValidateStructure_Clean(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getValidationTestSegmentList()
+
+	findings, err := sl.ValidateStructure()
+	log.PanicIf(err)
+
+	if len(findings) != 0 {
+		for _, vf := range findings {
+			t.Logf("%s", vf)
+		}
+
+		t.Fatalf("Expected no findings.")
+	}
+}
+
+func TestSegmentList_ValidateStructure_MissingTables(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getValidationTestSegmentList()
+
+	// Move the DQT after the scan and drop the DHT entirely.
+
+	var dqt *Segment
+	segments := make([]*Segment, 0)
+	for _, s := range sl.segments {
+		if s.MarkerId == MARKER_DQT {
+			dqt = s
+			continue
+		} else if s.MarkerId == MARKER_DHT {
+			continue
+		} else if s.MarkerId == MARKER_EOI {
+			segments = append(segments, dqt)
+		}
+
+		segments = append(segments, s)
+	}
+
+	sl = NewSegmentList(segments)
+
+	findings, err := sl.ValidateStructure()
+	log.PanicIf(err)
+
+	if findings.HasErrors() != true {
+		t.Fatalf("Expected errors.")
+	}
+
+	expected := []string{
+		FindingTableDefinedLate,
+		FindingTableDefinedLate,
+		FindingUndefinedTable,
+		FindingUndefinedTable,
+		FindingUndefinedTable,
+		FindingUndefinedTable,
+	}
+
+	if reflect.DeepEqual(findings.Codes(), expected) != true {
+		t.Fatalf("Findings not correct: %v", findings)
+	}
+}
+
+func TestSegmentList_ValidateStructure_Structure(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getValidationTestSegmentList()
+
+	im, err := exifcommon.NewIfdMappingWithStandard()
+	log.PanicIf(err)
+
+	ti := exif.NewTagIndex()
+
+	ib := exif.NewIfdBuilder(im, ti, exifcommon.IfdStandardIfdIdentity, exifcommon.TestDefaultByteOrder)
+
+	err = ib.AddStandardWithName("ProcessingSoftware", "some software")
+	log.PanicIf(err)
+
+	exifSegment := makeEmptyExifSegment()
+
+	err = exifSegment.SetExif(ib)
+	log.PanicIf(err)
+
+	jfifSegment := &Segment{
+		MarkerId: MARKER_APP0,
+		Data:     []byte{'J', 'F', 'I', 'F', 0, 1, 1, 0, 0, 1, 0, 1, 0, 0},
+	}
+
+	segments := []*Segment{sl.segments[0], exifSegment, jfifSegment, exifSegment}
+
+	for _, s := range sl.segments[1:] {
+		segments = append(segments, s)
+
+		if s.MarkerId == MARKER_SOF0 {
+			segments = append(segments, s)
+		}
+	}
+
+	sl = NewSegmentList(segments)
+
+	findings, err := sl.ValidateStructure()
+	log.PanicIf(err)
+
+	expected := []string{
+		FindingJfifNotFirst,
+		FindingMultipleExif,
+		FindingDuplicateSof,
+	}
+
+	if reflect.DeepEqual(findings.Codes(), expected) != true {
+		t.Fatalf("Findings not correct: %v", findings)
+	}
+}
+
+func TestSegmentList_ValidateStructure_Frame(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getValidationTestSegmentList()
+
+	for i, s := range sl.segments {
+		if s.MarkerId != MARKER_SOF0 {
+			continue
+		}
+
+		fh, err := ParseSofSegment(s.MarkerId, s.Data)
+		log.PanicIf(err)
+
+		fh.Height = 0
+		fh.Components[0].HorizontalSampling = 5
+
+		sl.segments[i] = &Segment{
+			MarkerId: s.MarkerId,
+			Offset:   s.Offset,
+			Data:     fh.Encode(),
+		}
+	}
+
+	findings, err := sl.ValidateStructure()
+	log.PanicIf(err)
+
+	expected := []string{
+		FindingInvalidSampling,
+		FindingInvalidSampling,
+		FindingMissingDnl,
+	}
+
+	if reflect.DeepEqual(findings.Codes(), expected) != true {
+		t.Fatalf("Findings not correct: %v", findings)
+	}
+}
+
+func TestSegmentList_ValidateStructure_DuplicateComponentId(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getValidationTestSegmentList()
+
+	for i, s := range sl.segments {
+		if s.MarkerId != MARKER_SOF0 {
+			continue
+		}
+
+		fh, err := ParseSofSegment(s.MarkerId, s.Data)
+		log.PanicIf(err)
+
+		fh.Components[2].Id = fh.Components[1].Id
+
+		sl.segments[i] = &Segment{
+			MarkerId: s.MarkerId,
+			Offset:   s.Offset,
+			Data:     fh.Encode(),
+		}
+	}
+
+	findings, err := sl.ValidateStructure()
+	log.PanicIf(err)
+
+	// The scan still refers to the ID that was replaced.
+
+	expected := []string{
+		FindingDuplicateComponentId,
+		FindingUnknownScanComponent,
+	}
+
+	if reflect.DeepEqual(findings.Codes(), expected) != true {
+		t.Fatalf("Findings not correct: %v", findings)
+	}
+}
+
+func TestSegmentList_ValidateStructure_Restart(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getValidationTestSegmentList()
+
+	// Declare a restart interval that the scan doesn't honor.
+
+	dri := &Segment{
+		MarkerId: MARKER_DRI,
+		Data:     []byte{0, 2},
+	}
+
+	segments := []*Segment{sl.segments[0], dri}
+	segments = append(segments, sl.segments[1:]...)
+
+	sl = NewSegmentList(segments)
+
+	findings, err := sl.ValidateStructure()
+	log.PanicIf(err)
+
+	expected := []string{
+		FindingRestartCountMismatch,
+	}
+
+	if reflect.DeepEqual(findings.Codes(), expected) != true {
+		t.Fatalf("Findings not correct: %v", findings)
+	}
+}
+
+func TestSegmentList_ValidateStructure_RestartInvalidSampling(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := getCoefficientsTestSegmentList(getTestGeneratedJpeg(32, 32, true))
+
+	coefficients, err := sl.ReadCoefficients()
+	log.PanicIf(err)
+
+	options := &WriteCoefficientsOptions{
+		RestartInterval: 2,
+	}
+
+	err = sl.WriteCoefficients(coefficients, options)
+	log.PanicIf(err)
+
+	// Zero sampling factors. The MCU count can't be known, so the restart
+	// markers can't be counted.
+
+	for _, s := range sl.segments {
+		if s.MarkerId == MARKER_SOF0 {
+			s.Data[7] = 0x00
+		}
+	}
+
+	findings, err := sl.ValidateStructure()
+	log.PanicIf(err)
+
+	expected := []string{
+		FindingInvalidSampling,
+	}
+
+	if reflect.DeepEqual(findings.Codes(), expected) != true {
+		t.Fatalf("Findings not correct: %v", findings)
+	}
+}
+
+func TestSegmentList_ValidateStructure_Empty(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl := NewSegmentList(nil)
+
+	findings, err := sl.ValidateStructure()
+	log.PanicIf(err)
+
+	expected := []string{
+		FindingMissingSoi,
+		FindingMissingEoi,
+		FindingMissingSof,
+		FindingMissingSos,
+	}
+
+	if reflect.DeepEqual(findings.Codes(), expected) != true {
+		t.Fatalf("Findings not correct: %v", findings)
+	}
+}
@@ -0,0 +1,175 @@
+package jpegstructure
+
+import (
+	"bufio"
+	"io"
+	"os"
+
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/dsoprea/go-logging"
+)
+
+const (
+	// backupFileSuffix is appended to the original file-path when a backup is
+	// kept.
+	backupFileSuffix = ".bak"
+
+	defaultWriteFileMode = os.FileMode(0644)
+)
+
+// WriteFileOptions describes how `SegmentList.WriteFile` should write the
+// file.
+type WriteFileOptions struct {
+	// KeepBackup, if true, keeps a copy of any existing file at the path with a
+	// ".bak" suffix. Any previous backup is replaced.
+	KeepBackup bool
+
+	// PreserveMode, if true, gives the new file the same permissions as the
+	// existing file.
+	PreserveMode bool
+
+	// PreserveModTime, if true, gives the new file the same modification time
+	// as the existing file.
+	PreserveModTime bool
+
+	// Mode is the mode of the new file when there is no existing file or we
+	// are not preserving the existing mode. Defaults to 0644.
+	Mode os.FileMode
+}
+
+// WriteFile writes the segment data to the given file-path. The data is
+// written to a temporary file in the same directory, flushed to disk, and then
+// atomically renamed over the destination, so the destination always has
+// either the old content or the new content in its entirety. `opts` may be
+// `nil`.
+func (sl *SegmentList) WriteFile(outputFilepath string, opts *WriteFileOptions) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	if opts == nil {
+		opts = new(WriteFileOptions)
+	}
+
+	mode := opts.Mode
+	if mode == 0 {
+		mode = defaultWriteFileMode
+	}
+
+	existingFi, err := os.Stat(outputFilepath)
+	if err != nil {
+		if os.IsNotExist(err) == false {
+			log.Panic(err)
+		}
+
+		existingFi = nil
+	} else if existingFi.Mode().IsRegular() == false {
+		log.Panicf("destination is not a regular file: [%s]", outputFilepath)
+	} else if opts.PreserveMode == true {
+		mode = existingFi.Mode().Perm()
+	}
+
+	dirPath := filepath.Dir(outputFilepath)
+	filename := filepath.Base(outputFilepath)
+
+	f, err := ioutil.TempFile(dirPath, "."+filename+".tmp-")
+	log.PanicIf(err)
+
+	tempFilepath := f.Name()
+	isRenamed := false
+
+	defer func() {
+		if isRenamed == false {
+			f.Close()
+			os.Remove(tempFilepath)
+		}
+	}()
+
+	bw := bufio.NewWriter(f)
+
+	err = sl.Write(bw)
+	log.PanicIf(err)
+
+	err = bw.Flush()
+	log.PanicIf(err)
+
+	err = f.Sync()
+	log.PanicIf(err)
+
+	err = f.Chmod(mode)
+	log.PanicIf(err)
+
+	err = f.Close()
+	log.PanicIf(err)
+
+	if existingFi != nil && opts.PreserveModTime == true {
+		mtime := existingFi.ModTime()
+
+		err := os.Chtimes(tempFilepath, mtime, mtime)
+		log.PanicIf(err)
+	}
+
+	if existingFi != nil && opts.KeepBackup == true {
+		err := backupFile(outputFilepath, existingFi.Mode().Perm())
+		log.PanicIf(err)
+	}
+
+	err = os.Rename(tempFilepath, outputFilepath)
+	log.PanicIf(err)
+
+	isRenamed = true
+
+	// Make the rename itself durable. Not every platform allows a directory to
+	// be synced, so this is best-effort.
+	if d, err := os.Open(dirPath); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+// backupFile copies the file at the given path to a sibling with the backup
+// suffix. A hard-link is used when possible.
+func backupFile(filepath string, mode os.FileMode) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	backupFilepath := filepath + backupFileSuffix
+
+	err = os.Remove(backupFilepath)
+	if err != nil && os.IsNotExist(err) == false {
+		log.Panic(err)
+	}
+
+	if err := os.Link(filepath, backupFilepath); err == nil {
+		return nil
+	}
+
+	// Hard-links aren't supported everywhere. Fallback to a copy.
+
+	src, err := os.Open(filepath)
+	log.PanicIf(err)
+
+	defer src.Close()
+
+	dst, err := os.OpenFile(backupFilepath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	log.PanicIf(err)
+
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	log.PanicIf(err)
+
+	err = dst.Sync()
+	log.PanicIf(err)
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"io/ioutil"
+
+	"github.com/dsoprea/go-logging"
+)
+
+func getWriteFileTestSegmentList() *SegmentList {
+	segments := []*Segment{
+		{MarkerId: MARKER_SOI},
+		{MarkerId: MARKER_COM, Data: []byte("comment")},
+		{MarkerId: MARKER_EOI},
+	}
+
+	return NewSegmentList(segments)
+}
+
+func TestSegmentList_WriteFile_New(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	tempPath, err := ioutil.TempDir("", "")
+	log.PanicIf(err)
+
+	defer os.RemoveAll(tempPath)
+
+	filepath := path.Join(tempPath, "new.jpg")
+
+	sl := getWriteFileTestSegmentList()
+
+	err = sl.WriteFile(filepath, nil)
+	log.PanicIf(err)
+
+	actual, err := ioutil.ReadFile(filepath)
+	log.PanicIf(err)
+
+	b := new(bytes.Buffer)
+
+	err = sl.Write(b)
+	log.PanicIf(err)
+
+	if bytes.Equal(actual, b.Bytes()) != true {
+		t.Fatalf("Written data not correct.")
+	}
+
+	fi, err := os.Stat(filepath)
+	log.PanicIf(err)
+
+	if fi.Mode().Perm() != defaultWriteFileMode {
+		t.Fatalf("Mode not correct: (%o)", fi.Mode().Perm())
+	}
+
+	// Make sure that the temporary file didn't survive.
+
+	fis, err := ioutil.ReadDir(tempPath)
+	log.PanicIf(err)
+
+	if len(fis) != 1 {
+		t.Fatalf("Expected exactly one file: (%d)", len(fis))
+	}
+}
+
+func TestSegmentList_WriteFile_Overwrite(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	tempPath, err := ioutil.TempDir("", "")
+	log.PanicIf(err)
+
+	defer os.RemoveAll(tempPath)
+
+	filepath := path.Join(tempPath, "existing.jpg")
+
+	// The existing content is larger than what we'll write, which is what
+	// would've left stale trailing bytes with a non-truncating write.
+	original := bytes.Repeat([]byte{0xaa}, 1000)
+
+	err = ioutil.WriteFile(filepath, original, 0600)
+	log.PanicIf(err)
+
+	mtime := time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	err = os.Chtimes(filepath, mtime, mtime)
+	log.PanicIf(err)
+
+	sl := getWriteFileTestSegmentList()
+
+	wfo := &WriteFileOptions{
+		KeepBackup:      true,
+		PreserveMode:    true,
+		PreserveModTime: true,
+	}
+
+	err = sl.WriteFile(filepath, wfo)
+	log.PanicIf(err)
+
+	actual, err := ioutil.ReadFile(filepath)
+	log.PanicIf(err)
+
+	b := new(bytes.Buffer)
+
+	err = sl.Write(b)
+	log.PanicIf(err)
+
+	if bytes.Equal(actual, b.Bytes()) != true {
+		t.Fatalf("Written data not correct.")
+	}
+
+	fi, err := os.Stat(filepath)
+	log.PanicIf(err)
+
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("Mode not preserved: (%o)", fi.Mode().Perm())
+	} else if fi.ModTime().Equal(mtime) != true {
+		t.Fatalf("Mod-time not preserved: [%s]", fi.ModTime())
+	}
+
+	backup, err := ioutil.ReadFile(filepath + backupFileSuffix)
+	log.PanicIf(err)
+
+	if bytes.Equal(backup, original) != true {
+		t.Fatalf("Backup not correct.")
+	}
+}
+
+func TestSegmentList_WriteFile_NotRegular(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	tempPath, err := ioutil.TempDir("", "")
+	log.PanicIf(err)
+
+	defer os.RemoveAll(tempPath)
+
+	sl := getWriteFileTestSegmentList()
+
+	err = sl.WriteFile(tempPath, nil)
+	if err == nil {
+		t.Fatalf("Expected error for non-regular destination.")
+	}
+}
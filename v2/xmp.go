@@ -0,0 +1,631 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"encoding/binary"
+	"encoding/xml"
+
+	"github.com/dsoprea/go-logging"
+)
+
+var (
+	// xmpExtensionPrefix is the prefix of the segments that carry extended
+	// XMP.
+	xmpExtensionPrefix = []byte("http://ns.adobe.com/xmp/extension/\000")
+)
+
+const (
+	// xmpExtensionGuidSize is the size of the GUID (an MD5 digest in
+	// hexadecimal) at the start of each extended-XMP segment. It's followed
+	// by the full size of the extended XMP and the offset of this part.
+	xmpExtensionGuidSize = 32
+
+	// xmpExtensionHeaderSize is the size of everything before the data.
+	xmpExtensionHeaderSize = xmpExtensionGuidSize + 8
+)
+
+const (
+	xmlNamespace   = "http://www.w3.org/XML/1998/namespace"
+	xmlnsNamespace = "http://www.w3.org/2000/xmlns/"
+)
+
+const (
+	xmpNamespaceRdf          = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	xmpNamespaceXmp          = "http://ns.adobe.com/xap/1.0/"
+	xmpNamespaceXmpMm        = "http://ns.adobe.com/xap/1.0/mm/"
+	xmpNamespaceXmpNote      = "http://ns.adobe.com/xmp/note/"
+	xmpNamespaceDc           = "http://purl.org/dc/elements/1.1/"
+	xmpNamespaceExif         = "http://ns.adobe.com/exif/1.0/"
+	xmpNamespaceTiff         = "http://ns.adobe.com/tiff/1.0/"
+	xmpNamespaceExifEx       = "http://cipa.jp/exif/1.0/"
+	xmpNamespaceAux          = "http://ns.adobe.com/exif/1.0/aux/"
+	xmpNamespacePhotoshop    = "http://ns.adobe.com/photoshop/1.0/"
+	xmpNamespaceIptc4xmpCore = "http://iptc.org/std/Iptc4xmpCore/1.0/xmlns/"
+)
+
+// xmpNode is a node of an XMP document. It's an `*xmpElement`, an `xmpText`,
+// or an `xmpMarkup`.
+type xmpNode interface{}
+
+// xmpText is (unescaped) character data.
+type xmpText string
+
+// xmpMarkup is anything else (comments, processing instructions, and
+// directives), kept exactly as it was encoded.
+type xmpMarkup string
+
+// xmpAttribute is an attribute of an element.
+type xmpAttribute struct {
+	// Prefix is the prefix as written, if any.
+	Prefix string
+
+	// Local is the local name.
+	Local string
+
+	// Namespace is the namespace URI that the prefix resolved to. It's empty
+	// for unprefixed attributes.
+	Namespace string
+
+	// Value is the unescaped value.
+	Value string
+}
+
+// isNamespaceDeclaration returns true for the "xmlns" attributes.
+func (xa *xmpAttribute) isNamespaceDeclaration() bool {
+	return xa.Prefix == "xmlns" || (xa.Prefix == "" && xa.Local == "xmlns")
+}
+
+// xmpElement is an element of an XMP document.
+type xmpElement struct {
+	// Prefix is the prefix as written, if any.
+	Prefix string
+
+	// Local is the local name.
+	Local string
+
+	// Namespace is the namespace URI that the prefix resolved to.
+	Namespace string
+
+	Attributes []*xmpAttribute
+	Children   []xmpNode
+}
+
+// qualifiedName returns the name as written.
+func (xe *xmpElement) qualifiedName() string {
+	if xe.Prefix == "" {
+		return xe.Local
+	}
+
+	return xe.Prefix + ":" + xe.Local
+}
+
+// is returns true if the element has the given expanded name.
+func (xe *xmpElement) is(namespace, local string) bool {
+	return xe.Namespace == namespace && xe.Local == local
+}
+
+// attribute returns the attribute with the given expanded name, or nil.
+func (xe *xmpElement) attribute(namespace, local string) *xmpAttribute {
+	for _, xa := range xe.Attributes {
+		if xa.Namespace == namespace && xa.Local == local && xa.isNamespaceDeclaration() == false {
+			return xa
+		}
+	}
+
+	return nil
+}
+
+// text returns the character data directly within the element.
+func (xe *xmpElement) text() string {
+	parts := make([]string, 0)
+	for _, node := range xe.Children {
+		if text, ok := node.(xmpText); ok == true {
+			parts = append(parts, string(text))
+		}
+	}
+
+	return strings.Join(parts, "")
+}
+
+// child returns the first child element with the given expanded name, or nil.
+func (xe *xmpElement) child(namespace, local string) *xmpElement {
+	for _, node := range xe.Children {
+		if child, ok := node.(*xmpElement); ok == true && child.is(namespace, local) == true {
+			return child
+		}
+	}
+
+	return nil
+}
+
+// property returns the value of a simple property of the element, whether
+// it's written as an attribute or as a child element.
+func (xe *xmpElement) property(namespace, local string) (value string, found bool) {
+	if xa := xe.attribute(namespace, local); xa != nil {
+		return xa.Value, true
+	}
+
+	if child := xe.child(namespace, local); child != nil {
+		return strings.TrimSpace(child.text()), true
+	}
+
+	return "", false
+}
+
+// declareNamespace declares the namespace on the element with the given
+// prefix, unless the element already declares it. The prefix to use is
+// returned.
+func (xe *xmpElement) declareNamespace(prefix, namespace string) string {
+	for _, xa := range xe.Attributes {
+		if xa.Prefix == "xmlns" && xa.Value == namespace {
+			return xa.Local
+		}
+	}
+
+	declaration := &xmpAttribute{
+		Prefix:    "xmlns",
+		Local:     prefix,
+		Namespace: xmlnsNamespace,
+		Value:     namespace,
+	}
+
+	xe.Attributes = append(xe.Attributes, declaration)
+
+	return prefix
+}
+
+// addAttribute adds an attribute, declaring the namespace on the element if
+// it isn't already.
+func (xe *xmpElement) addAttribute(prefix, namespace, local, value string) {
+	xa := &xmpAttribute{
+		Prefix:    xe.declareNamespace(prefix, namespace),
+		Local:     local,
+		Namespace: namespace,
+		Value:     value,
+	}
+
+	xe.Attributes = append(xe.Attributes, xa)
+}
+
+// xmpDocument is a parsed XMP packet. Only what's needed to find and edit
+// properties is modeled; everything else is written back as it was.
+type xmpDocument struct {
+	Nodes []xmpNode
+}
+
+// emptyXmpPacket is the packet that new XMP starts from.
+const emptyXmpPacket = `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"></rdf:RDF></x:xmpmeta>`
+
+// parseXmpDocument parses an XMP packet (without the segment prefix).
+func parseXmpDocument(data []byte) (xd *xmpDocument, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+
+	// Prefixes are resolved here, so that they can be written back as they
+	// were.
+
+	scopes := []map[string]string{
+		{
+			"xml": xmlNamespace,
+		},
+	}
+
+	resolve := func(prefix string) string {
+		for i := len(scopes) - 1; i >= 0; i-- {
+			if namespace, found := scopes[i][prefix]; found == true {
+				return namespace
+			}
+		}
+
+		return ""
+	}
+
+	xd = new(xmpDocument)
+
+	stack := make([]*xmpElement, 0)
+
+	add := func(node xmpNode) {
+		if len(stack) == 0 {
+			xd.Nodes = append(xd.Nodes, node)
+		} else {
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, node)
+		}
+	}
+
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+
+		log.PanicIf(err)
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			scope := make(map[string]string)
+
+			for _, attr := range t.Attr {
+				if attr.Name.Space == "xmlns" {
+					scope[attr.Name.Local] = attr.Value
+				} else if attr.Name.Space == "" && attr.Name.Local == "xmlns" {
+					scope[""] = attr.Value
+				}
+			}
+
+			scopes = append(scopes, scope)
+
+			xe := &xmpElement{
+				Prefix:     t.Name.Space,
+				Local:      t.Name.Local,
+				Namespace:  resolve(t.Name.Space),
+				Attributes: make([]*xmpAttribute, len(t.Attr)),
+			}
+
+			for i, attr := range t.Attr {
+				xa := &xmpAttribute{
+					Prefix: attr.Name.Space,
+					Local:  attr.Name.Local,
+					Value:  attr.Value,
+				}
+
+				if xa.isNamespaceDeclaration() == true {
+					xa.Namespace = xmlnsNamespace
+				} else if xa.Prefix != "" {
+					xa.Namespace = resolve(xa.Prefix)
+				}
+
+				xe.Attributes[i] = xa
+			}
+
+			add(xe)
+			stack = append(stack, xe)
+		case xml.EndElement:
+			if len(stack) == 0 {
+				log.Panicf("XMP end-element not expected: [%s]", t.Name.Local)
+			}
+
+			stack = stack[:len(stack)-1]
+			scopes = scopes[:len(scopes)-1]
+		case xml.CharData:
+			add(xmpText(t))
+		case xml.Comment:
+			add(xmpMarkup("<!--" + string(t) + "-->"))
+		case xml.ProcInst:
+			if len(t.Inst) == 0 {
+				add(xmpMarkup("<?" + t.Target + "?>"))
+			} else {
+				add(xmpMarkup("<?" + t.Target + " " + string(t.Inst) + "?>"))
+			}
+		case xml.Directive:
+			add(xmpMarkup("<!" + string(t) + ">"))
+		}
+	}
+
+	if len(stack) != 0 {
+		log.Panicf("XMP element not closed: [%s]", stack[len(stack)-1].qualifiedName())
+	}
+
+	return xd, nil
+}
+
+var (
+	xmpTextEscaper = strings.NewReplacer(
+		"&", "&amp;",
+		"<", "&lt;",
+		">", "&gt;")
+
+	xmpAttributeEscaper = strings.NewReplacer(
+		"&", "&amp;",
+		"<", "&lt;",
+		"\"", "&quot;",
+		"\t", "&#x9;",
+		"\n", "&#xA;",
+		"\r", "&#xD;")
+)
+
+func encodeXmpNode(b *bytes.Buffer, node xmpNode) {
+	switch n := node.(type) {
+	case *xmpElement:
+		b.WriteString("<")
+		b.WriteString(n.qualifiedName())
+
+		for _, xa := range n.Attributes {
+			b.WriteString(" ")
+
+			if xa.Prefix != "" {
+				b.WriteString(xa.Prefix)
+				b.WriteString(":")
+			}
+
+			b.WriteString(xa.Local)
+			b.WriteString("=\"")
+			b.WriteString(xmpAttributeEscaper.Replace(xa.Value))
+			b.WriteString("\"")
+		}
+
+		if len(n.Children) == 0 {
+			b.WriteString("/>")
+			return
+		}
+
+		b.WriteString(">")
+
+		for _, child := range n.Children {
+			encodeXmpNode(b, child)
+		}
+
+		b.WriteString("</")
+		b.WriteString(n.qualifiedName())
+		b.WriteString(">")
+	case xmpText:
+		b.WriteString(xmpTextEscaper.Replace(string(n)))
+	case xmpMarkup:
+		b.WriteString(string(n))
+	}
+}
+
+// encode returns the packet.
+func (xd *xmpDocument) encode() []byte {
+	b := new(bytes.Buffer)
+
+	for _, node := range xd.Nodes {
+		encodeXmpNode(b, node)
+	}
+
+	return b.Bytes()
+}
+
+// walk calls `cb` for every element, parents before children.
+func (xd *xmpDocument) walk(cb func(xe *xmpElement)) {
+	var visit func(nodes []xmpNode)
+
+	visit = func(nodes []xmpNode) {
+		for _, node := range nodes {
+			if xe, ok := node.(*xmpElement); ok == true {
+				cb(xe)
+				visit(xe.Children)
+			}
+		}
+	}
+
+	visit(xd.Nodes)
+}
+
+// removeProperties removes every element and attribute whose expanded name
+// matches, along with everything within the elements. The qualified names of
+// what was removed are returned.
+func (xd *xmpDocument) removeProperties(matches func(namespace, local string) bool) (removed []string) {
+	removed = make([]string, 0)
+
+	xd.walk(func(xe *xmpElement) {
+		attributes := xe.Attributes[:0]
+		for _, xa := range xe.Attributes {
+			if xa.isNamespaceDeclaration() == false && xa.Namespace != "" && matches(xa.Namespace, xa.Local) == true {
+				removed = append(removed, xa.Prefix+":"+xa.Local)
+				continue
+			}
+
+			attributes = append(attributes, xa)
+		}
+
+		xe.Attributes = attributes
+
+		children := xe.Children[:0]
+		for _, node := range xe.Children {
+			if child, ok := node.(*xmpElement); ok == true && matches(child.Namespace, child.Local) == true {
+				removed = append(removed, child.qualifiedName())
+				continue
+			}
+
+			children = append(children, node)
+		}
+
+		xe.Children = children
+	})
+
+	return removed
+}
+
+// setProperty sets the value of every simple property with the given expanded
+// name, whether it's written as an attribute or as an element. Properties
+// that aren't there aren't added. It returns true if any were set.
+func (xd *xmpDocument) setProperty(namespace, local, value string) (isSet bool) {
+	xd.walk(func(xe *xmpElement) {
+		if xe.is(xmpNamespaceRdf, "Description") == false {
+			return
+		}
+
+		if xa := xe.attribute(namespace, local); xa != nil {
+			xa.Value = value
+			isSet = true
+		}
+
+		for _, node := range xe.Children {
+			child, ok := node.(*xmpElement)
+			if ok == false || child.is(namespace, local) == false {
+				continue
+			}
+
+			isSimple := true
+			for _, grandchild := range child.Children {
+				if _, ok := grandchild.(*xmpElement); ok == true {
+					isSimple = false
+					break
+				}
+			}
+
+			if isSimple == true {
+				child.Children = []xmpNode{xmpText(value)}
+				isSet = true
+			}
+		}
+	})
+
+	return isSet
+}
+
+// property returns the value of the first simple property with the given
+// expanded name on any of the descriptions.
+func (xd *xmpDocument) property(namespace, local string) (value string, found bool) {
+	xd.walk(func(xe *xmpElement) {
+		if found == true || xe.is(xmpNamespaceRdf, "Description") == false {
+			return
+		}
+
+		value, found = xe.property(namespace, local)
+	})
+
+	return value, found
+}
+
+// addDescription adds an empty description to the RDF element and returns it.
+func (xd *xmpDocument) addDescription() (description *xmpElement, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	var rdf *xmpElement
+
+	xd.walk(func(xe *xmpElement) {
+		if rdf == nil && xe.is(xmpNamespaceRdf, "RDF") == true {
+			rdf = xe
+		}
+	})
+
+	if rdf == nil {
+		log.Panicf("XMP has no RDF element")
+	}
+
+	description = &xmpElement{
+		Prefix:    rdf.Prefix,
+		Local:     "Description",
+		Namespace: xmpNamespaceRdf,
+		Attributes: []*xmpAttribute{
+			{Prefix: rdf.Prefix, Local: "about", Namespace: xmpNamespaceRdf},
+		},
+	}
+
+	rdf.Children = append(rdf.Children, description)
+
+	return description, nil
+}
+
+// editableXmp returns the XMP segment and its document, adding an empty XMP
+// segment after the JFIF and EXIF segments if there isn't one.
+func (sl *SegmentList) editableXmp() (s *Segment, xd *xmpDocument, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	_, s, err = sl.FindXmp()
+	if err == ErrNoXmp {
+		s = &Segment{
+			MarkerId:   MARKER_APP1,
+			MarkerName: markerNames[MARKER_APP1],
+			Data:       append(append([]byte{}, xmpPrefix...), emptyXmpPacket...),
+		}
+
+		i := 1
+		for i < len(sl.segments) && (sl.segments[i].MarkerId == MARKER_APP0 || sl.segments[i].MarkerId == MARKER_APP1) {
+			i++
+		}
+
+		sl.segments = append(sl.segments[:i], append([]*Segment{s}, sl.segments[i:]...)...)
+	} else if err != nil {
+		log.Panic(err)
+	}
+
+	xd, err = parseXmpDocument(s.Data[len(xmpPrefix):])
+	log.PanicIf(err)
+
+	return s, xd, nil
+}
+
+// setXmpDocument encodes the document into the XMP segment.
+func setXmpDocument(s *Segment, xd *xmpDocument) (err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	data := append(append([]byte{}, xmpPrefix...), xd.encode()...)
+	if len(data) > maxSegmentPayloadSize {
+		log.Panicf("XMP too large for one segment: (%d)", len(data))
+	}
+
+	s.Data = data
+
+	return nil
+}
+
+// extendedXmp assembles the extended XMP that the main XMP refers to (with
+// "xmpNote:HasExtendedXMP") from the segments that carry its parts. It
+// returns nil if there's no reference or no segments with its GUID.
+func (sl *SegmentList) extendedXmp(xd *xmpDocument) (extended *xmpDocument, err error) {
+	defer func() {
+		if state := recover(); state != nil {
+			err = log.Wrap(state.(error))
+		}
+	}()
+
+	guid, found := xd.property(xmpNamespaceXmpNote, "HasExtendedXMP")
+	if found == false || len(guid) != xmpExtensionGuidSize {
+		return nil, nil
+	}
+
+	var data []byte
+	received := 0
+
+	for _, s := range sl.segments {
+		if s.MarkerId != MARKER_APP1 || bytes.HasPrefix(s.Data, xmpExtensionPrefix) == false {
+			continue
+		}
+
+		header := s.Data[len(xmpExtensionPrefix):]
+		if len(header) < xmpExtensionHeaderSize || string(header[:xmpExtensionGuidSize]) != guid {
+			continue
+		}
+
+		size := int(binary.BigEndian.Uint32(header[xmpExtensionGuidSize:]))
+		offset := int(binary.BigEndian.Uint32(header[xmpExtensionGuidSize+4:]))
+		part := header[xmpExtensionHeaderSize:]
+
+		if data == nil {
+			data = make([]byte, size)
+		} else if size != len(data) {
+			log.Panicf("extended-XMP size not consistent: (%d) != (%d)", size, len(data))
+		}
+
+		if offset+len(part) > size {
+			log.Panicf("extended-XMP part out of bounds: OFFSET=(%d) SIZE=(%d)", offset, len(part))
+		}
+
+		copy(data[offset:], part)
+		received += len(part)
+	}
+
+	if data == nil {
+		return nil, nil
+	} else if received != len(data) {
+		log.Panicf("extended XMP incomplete: (%d) != (%d)", received, len(data))
+	}
+
+	extended, err = parseXmpDocument(data)
+	log.PanicIf(err)
+
+	return extended, nil
+}
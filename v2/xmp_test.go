@@ -0,0 +1,301 @@
+package jpegstructure
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dsoprea/go-logging"
+)
+
+const (
+	xmpTestPacket = `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <!-- A comment. -->
+  <rdf:Description rdf:about="" xmlns:ex="http://ns.adobe.com/exif/1.0/" xmlns:xmpMM="http://ns.adobe.com/xap/1.0/mm/" ex:GPSLatitude="12,34.5N" ex:ExposureTime="1/60">
+   <ex:GPSLongitude>56,7.8W</ex:GPSLongitude>
+   <xmpMM:History>
+    <rdf:Seq>
+     <rdf:li>opened &amp; &lt;saved&gt;</rdf:li>
+    </rdf:Seq>
+   </xmpMM:History>
+   <xmpMM:DocumentID>doc &quot;1&quot;</xmpMM:DocumentID>
+   <other xmlns="http://example.com/ns/" title="a&#xA;b"/>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`
+)
+
+func TestParseXmpDocument(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	xd, err := parseXmpDocument([]byte(xmpTestPacket))
+	log.PanicIf(err)
+
+	var description, other, documentId *xmpElement
+
+	xd.walk(func(xe *xmpElement) {
+		if xe.is(xmpNamespaceRdf, "Description") == true {
+			description = xe
+		} else if xe.is("http://example.com/ns/", "other") == true {
+			other = xe
+		} else if xe.is(xmpNamespaceXmpMm, "DocumentID") == true {
+			documentId = xe
+		}
+	})
+
+	if description == nil || other == nil || documentId == nil {
+		t.Fatalf("Elements not found.")
+	}
+
+	if xa := description.attribute(xmpNamespaceExif, "ExposureTime"); xa == nil || xa.Value != "1/60" {
+		t.Fatalf("Attribute not correct: %v", xa)
+	} else if xa.Prefix != "ex" {
+		t.Fatalf("Attribute prefix not correct: [%s]", xa.Prefix)
+	}
+
+	if xa := description.attribute(xmpNamespaceRdf, "about"); xa == nil || xa.Value != "" {
+		t.Fatalf("Attribute not correct: %v", xa)
+	}
+
+	// Unprefixed attributes aren't in the default namespace.
+	if xa := other.attribute("", "title"); xa == nil || xa.Value != "a\nb" {
+		t.Fatalf("Unprefixed attribute not correct: %v", xa)
+	} else if other.qualifiedName() != "other" {
+		t.Fatalf("Qualified name not correct: [%s]", other.qualifiedName())
+	}
+
+	if documentId.text() != "doc \"1\"" {
+		t.Fatalf("Text not correct: [%s]", documentId.text())
+	}
+
+	// Everything but the escaping of the quotes in the text comes back as it
+	// was.
+
+	expected := strings.Replace(xmpTestPacket, "doc &quot;1&quot;", "doc \"1\"", 1)
+
+	encoded := string(xd.encode())
+	if encoded != expected {
+		t.Fatalf("Encoded packet not correct:\n%s", encoded)
+	}
+}
+
+func TestParseXmpDocument_NotClosed(t *testing.T) {
+	_, err := parseXmpDocument([]byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><a>`))
+	if err == nil {
+		t.Fatalf("Expected error for unclosed element.")
+	}
+}
+
+func TestXmpDocument_removeProperties(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	xd, err := parseXmpDocument([]byte(xmpTestPacket))
+	log.PanicIf(err)
+
+	// The prefix in the packet is "ex", so this matches on the namespace.
+	removed := xd.removeProperties(func(namespace, local string) bool {
+		return (namespace == xmpNamespaceExif && strings.HasPrefix(local, "GPS") == true) || (namespace == xmpNamespaceXmpMm && local == "History")
+	})
+
+	expectedRemoved := []string{"ex:GPSLatitude", "ex:GPSLongitude", "xmpMM:History"}
+	if reflect.DeepEqual(removed, expectedRemoved) != true {
+		t.Fatalf("Removed properties not correct: %v", removed)
+	}
+
+	reparsed, err := parseXmpDocument(xd.encode())
+	log.PanicIf(err)
+
+	count := 0
+	reparsed.walk(func(xe *xmpElement) {
+		count++
+
+		if xe.is(xmpNamespaceExif, "GPSLongitude") == true || xe.is(xmpNamespaceXmpMm, "History") == true || xe.is(xmpNamespaceRdf, "li") == true {
+			t.Fatalf("Element not removed: [%s]", xe.qualifiedName())
+		} else if xe.is(xmpNamespaceRdf, "Description") == true {
+			if xe.attribute(xmpNamespaceExif, "GPSLatitude") != nil {
+				t.Fatalf("Attribute not removed.")
+			} else if xe.attribute(xmpNamespaceExif, "ExposureTime") == nil {
+				t.Fatalf("Attribute removed but shouldn't have been.")
+			}
+		}
+	})
+
+	// xmpmeta, RDF, Description, DocumentID, and other.
+	if count != 5 {
+		t.Fatalf("Element count not correct: (%d)", count)
+	}
+}
+
+func TestXmpDocument_setProperty(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	xd, err := parseXmpDocument([]byte(xmpTestPacket))
+	log.PanicIf(err)
+
+	if xd.setProperty(xmpNamespaceExif, "ExposureTime", "1/125") != true {
+		t.Fatalf("Attribute not set.")
+	} else if xd.setProperty(xmpNamespaceExif, "GPSLongitude", "1,2.3E") != true {
+		t.Fatalf("Element not set.")
+	} else if xd.setProperty(xmpNamespaceXmpMm, "History", "none") != false {
+		t.Fatalf("Structured property was set.")
+	} else if xd.setProperty(xmpNamespaceExif, "FNumber", "4") != false {
+		t.Fatalf("Missing property was set.")
+	}
+
+	reparsed, err := parseXmpDocument(xd.encode())
+	log.PanicIf(err)
+
+	reparsed.walk(func(xe *xmpElement) {
+		if xe.is(xmpNamespaceRdf, "Description") == true {
+			if xa := xe.attribute(xmpNamespaceExif, "ExposureTime"); xa == nil || xa.Value != "1/125" {
+				t.Fatalf("Attribute not correct.")
+			} else if xe.attribute(xmpNamespaceExif, "FNumber") != nil {
+				t.Fatalf("Attribute added.")
+			}
+		} else if xe.is(xmpNamespaceExif, "GPSLongitude") == true {
+			if xe.text() != "1,2.3E" {
+				t.Fatalf("Element not correct: [%s]", xe.text())
+			}
+		} else if xe.is(xmpNamespaceRdf, "li") == true {
+			if xe.text() != "opened & <saved>" {
+				t.Fatalf("Structured property changed: [%s]", xe.text())
+			}
+		}
+	})
+}
+
+func TestXmpDocument_property(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	xd, err := parseXmpDocument([]byte(xmpTestPacket))
+	log.PanicIf(err)
+
+	if value, found := xd.property(xmpNamespaceExif, "ExposureTime"); found != true || value != "1/60" {
+		t.Fatalf("Attribute not correct: [%s]", value)
+	} else if value, found := xd.property(xmpNamespaceXmpMm, "DocumentID"); found != true || value != `doc "1"` {
+		t.Fatalf("Element not correct: [%s]", value)
+	} else if _, found := xd.property(xmpNamespaceExif, "FNumber"); found != false {
+		t.Fatalf("Missing property found.")
+	}
+}
+
+func TestXmpDocument_addDescription(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	xd, err := parseXmpDocument([]byte(emptyXmpPacket))
+	log.PanicIf(err)
+
+	description, err := xd.addDescription()
+	log.PanicIf(err)
+
+	description.addAttribute("dc", xmpNamespaceDc, "format", "image/jpeg")
+	description.addAttribute("xyz", xmpNamespaceDc, "source", "camera")
+
+	expected := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"><rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/" dc:format="image/jpeg" dc:source="camera"/></rdf:RDF></x:xmpmeta>`
+
+	if encoded := string(xd.encode()); encoded != expected {
+		t.Fatalf("Encoding not correct:\n%s", encoded)
+	}
+
+	xd, err = parseXmpDocument([]byte("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\"/>"))
+	log.PanicIf(err)
+
+	if _, err := xd.addDescription(); err == nil {
+		t.Fatalf("Expected error for missing RDF.")
+	}
+}
+
+func TestSegmentList_extendedXmp(t *testing.T) {
+	defer func() {
+		if state := recover(); state != nil {
+			err := log.Wrap(state.(error))
+			log.PrintErrorf(err, "Test failure.")
+			t.Fatalf("Test failure.")
+		}
+	}()
+
+	sl, _, _, _ := getAuxiliaryImageTestGDepthSegmentList()
+
+	_, s, err := sl.FindXmp()
+	log.PanicIf(err)
+
+	xd, err := parseXmpDocument(s.Data[len(xmpPrefix):])
+	log.PanicIf(err)
+
+	extended, err := sl.extendedXmp(xd)
+	log.PanicIf(err)
+
+	if _, found := extended.property(xmpNamespaceGDepth, "Data"); found != true {
+		t.Fatalf("Extended XMP not correct.")
+	}
+
+	// Without one of the parts, it's incomplete.
+
+	for i, s := range sl.segments {
+		if bytes.HasPrefix(s.Data, xmpExtensionPrefix) == true {
+			sl.segments = append(sl.segments[:i], sl.segments[i+1:]...)
+			break
+		}
+	}
+
+	if _, err := sl.extendedXmp(xd); err == nil {
+		t.Fatalf("Expected error for incomplete extended XMP.")
+	}
+
+	// Parts with another GUID are ignored.
+
+	xd.setProperty(xmpNamespaceXmpNote, "HasExtendedXMP", "fedcba9876543210fedcba9876543210")
+
+	extended, err = sl.extendedXmp(xd)
+	log.PanicIf(err)
+
+	if extended != nil {
+		t.Fatalf("Expected no extended XMP.")
+	}
+
+	// There's no reference in an ordinary XMP packet.
+
+	xd, err = parseXmpDocument([]byte(xmpTestPacket))
+	log.PanicIf(err)
+
+	extended, err = sl.extendedXmp(xd)
+	log.PanicIf(err)
+
+	if extended != nil {
+		t.Fatalf("Expected no extended XMP.")
+	}
+}